@@ -329,8 +329,22 @@ func (c *Conn) Read(b []byte) (int, error) {
 	return n, nil
 }
 
-// Write implements net.Conn.Write.
+// Write implements net.Conn.Write. The data is copied, since the stack keeps
+// referring to what it's given until the peer acknowledges it.
 func (c *Conn) Write(b []byte) (int, error) {
+	v := buffer.NewView(len(b))
+	copy(v, b)
+	return c.write(v)
+}
+
+// WriteOwned is like Write, except that b is handed over to the stack instead
+// of being copied. The caller must not modify b afterwards, as the stack may
+// still refer to it, e.g., to retransmit it.
+func (c *Conn) WriteOwned(b []byte) (int, error) {
+	return c.write(b)
+}
+
+func (c *Conn) write(v buffer.View) (int, error) {
 	deadline := c.writeCancel()
 
 	// Check if deadlineTimer has already expired.
@@ -340,9 +354,6 @@ func (c *Conn) Write(b []byte) (int, error) {
 	default:
 	}
 
-	v := buffer.NewView(len(b))
-	copy(v, b)
-
 	// We must handle two soft failure conditions simultaneously:
 	//  1. Write may write nothing and return tcpip.ErrWouldBlock.
 	//     If this happens, we need to register for notifications if we have
@@ -360,7 +371,7 @@ func (c *Conn) Write(b []byte) (int, error) {
 		reg      bool
 		notifyCh chan struct{}
 	)
-	for nbytes < len(b) && (err == tcpip.ErrWouldBlock || err == nil) {
+	for size := len(v); nbytes < size && (err == tcpip.ErrWouldBlock || err == nil); {
 		if err == tcpip.ErrWouldBlock {
 			if !reg {
 				// Only register once.
@@ -544,8 +555,21 @@ func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	return copy(b, read), fullToUDPAddr(addr), nil
 }
 
-// WriteTo implements net.PacketConn.WriteTo.
+// WriteTo implements net.PacketConn.WriteTo. The data is copied, since the
+// stack may keep referring to what it's given until it's sent.
 func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	v := buffer.NewView(len(b))
+	copy(v, b)
+	return c.writeTo(v, addr)
+}
+
+// WriteToOwned is like WriteTo, except that b is handed over to the stack
+// instead of being copied. The caller must not modify b afterwards.
+func (c *PacketConn) WriteToOwned(b []byte, addr net.Addr) (int, error) {
+	return c.writeTo(b, addr)
+}
+
+func (c *PacketConn) writeTo(v buffer.View, addr net.Addr) (int, error) {
 	deadline := c.writeCancel()
 
 	// Check if deadline has already expired.
@@ -558,9 +582,6 @@ func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 	ua := addr.(*net.UDPAddr)
 	fullAddr := tcpip.FullAddress{Addr: tcpip.Address(ua.IP), Port: uint16(ua.Port)}
 
-	v := buffer.NewView(len(b))
-	copy(v, b)
-
 	wopts := tcpip.WriteOptions{To: &fullAddr}
 	n, err := c.ep.Write(tcpip.SlicePayload(v), wopts)
 
@@ -0,0 +1,384 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bpf provides an interpreter of classic BPF programs, which can be
+// used to select the packets captured by packet taps.
+//
+// Programs are made of the same instructions as Linux socket filters, so that
+// filters produced by existing tools (e.g. "tcpdump -dd") can be used as is.
+// They run over network-layer packets, as with SOCK_DGRAM packet sockets; the
+// network protocol of a packet can be loaded from AncillaryProtocol.
+package bpf
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// Instruction classes.
+const (
+	Ld   = 0x00
+	Ldx  = 0x01
+	St   = 0x02
+	Stx  = 0x03
+	Alu  = 0x04
+	Jmp  = 0x05
+	Ret  = 0x06
+	Misc = 0x07
+)
+
+// Sizes of Ld instructions.
+const (
+	W = 0x00
+	H = 0x08
+	B = 0x10
+)
+
+// Addressing modes of Ld and Ldx instructions.
+const (
+	Imm = 0x00
+	Abs = 0x20
+	Ind = 0x40
+	Mem = 0x60
+	Len = 0x80
+	Msh = 0xa0
+)
+
+// Operations of Alu instructions.
+const (
+	Add = 0x00
+	Sub = 0x10
+	Mul = 0x20
+	Div = 0x30
+	Or  = 0x40
+	And = 0x50
+	Lsh = 0x60
+	Rsh = 0x70
+	Neg = 0x80
+	Mod = 0x90
+	Xor = 0xa0
+)
+
+// Operations of Jmp instructions.
+const (
+	Ja   = 0x00
+	Jeq  = 0x10
+	Jgt  = 0x20
+	Jge  = 0x30
+	Jset = 0x40
+)
+
+// Operand sources of Alu and Jmp instructions, and return value sources of Ret
+// instructions.
+const (
+	K = 0x00
+	X = 0x08
+	A = 0x10
+)
+
+// Operations of Misc instructions.
+const (
+	Tax = 0x00
+	Txa = 0x80
+)
+
+// AncillaryOffset is the offset from which Ld instructions in Abs mode load
+// data about the packet instead of its contents. AncillaryProtocol is added to
+// it to load the network protocol of the packet.
+const (
+	AncillaryOffset   = 0xfffff000
+	AncillaryProtocol = 0
+)
+
+// MaxInstructions is the maximum number of instructions of a program.
+const MaxInstructions = 4096
+
+// memWords is the number of words of scratch memory available to a program.
+const memWords = 16
+
+// Instruction is a classic BPF instruction. Its layout matches Linux's struct
+// sock_filter.
+type Instruction struct {
+	// Op is the opcode, made of an instruction class ORed with the flags
+	// relevant to the class.
+	Op uint16
+
+	// Jt and Jf are the number of instructions to skip when the condition
+	// of a conditional jump is true or false, respectively.
+	Jt uint8
+	Jf uint8
+
+	// K is the constant operand of the instruction.
+	K uint32
+}
+
+// Stmt returns a non-jump instruction.
+func Stmt(op uint16, k uint32) Instruction {
+	return Instruction{Op: op, K: k}
+}
+
+// Jump returns a jump instruction.
+func Jump(op uint16, k uint32, jt, jf uint8) Instruction {
+	return Instruction{Op: op, Jt: jt, Jf: jf, K: k}
+}
+
+// Program is a validated BPF program. It is created by Compile.
+type Program struct {
+	insns []Instruction
+}
+
+// Compile validates the given instructions and returns a program running them.
+// As with Linux socket filters, a valid program is non-empty, only uses known
+// opcodes, only jumps forward within the program, only accesses existing
+// scratch memory, never divides by a zero constant and ends with a Ret
+// instruction, so that it always terminates.
+func Compile(insns []Instruction) (*Program, error) {
+	if len(insns) == 0 || len(insns) > MaxInstructions {
+		return nil, fmt.Errorf("bpf: program has %d instructions, must have 1 to %d", len(insns), MaxInstructions)
+	}
+
+	for pc, in := range insns {
+		if err := validate(in, len(insns)-pc-1); err != nil {
+			return nil, fmt.Errorf("bpf: instruction %d: %v", pc, err)
+		}
+	}
+	if insns[len(insns)-1].Op&0x07 != Ret {
+		return nil, fmt.Errorf("bpf: program doesn't end with a return instruction")
+	}
+
+	return &Program{insns: append([]Instruction(nil), insns...)}, nil
+}
+
+// validate checks a single instruction, after which there are left
+// instructions.
+func validate(in Instruction, left int) error {
+	switch in.Op & 0x07 {
+	case Ld:
+		switch in.Op &^ 0x07 {
+		case W | Abs, H | Abs, B | Abs, W | Ind, H | Ind, B | Ind, W | Len, W | Imm:
+		case W | Mem:
+			if in.K >= memWords {
+				return fmt.Errorf("scratch memory index %d out of range", in.K)
+			}
+		default:
+			return fmt.Errorf("unknown opcode %#x", in.Op)
+		}
+
+	case Ldx:
+		switch in.Op &^ 0x07 {
+		case W | Imm, W | Len, B | Msh:
+		case W | Mem:
+			if in.K >= memWords {
+				return fmt.Errorf("scratch memory index %d out of range", in.K)
+			}
+		default:
+			return fmt.Errorf("unknown opcode %#x", in.Op)
+		}
+
+	case St, Stx:
+		if in.Op&^0x07 != 0 {
+			return fmt.Errorf("unknown opcode %#x", in.Op)
+		}
+		if in.K >= memWords {
+			return fmt.Errorf("scratch memory index %d out of range", in.K)
+		}
+
+	case Alu:
+		op, src := in.Op&0xf0, in.Op&0x08
+		if in.Op&^0xff != 0 || op > Xor || (op == Neg && src != K) {
+			return fmt.Errorf("unknown opcode %#x", in.Op)
+		}
+		if (op == Div || op == Mod) && src == K && in.K == 0 {
+			return fmt.Errorf("division by zero")
+		}
+
+	case Jmp:
+		op := in.Op & 0xf0
+		if in.Op&^0xff != 0 || op > Jset || (op == Ja && in.Op&0x08 != 0) {
+			return fmt.Errorf("unknown opcode %#x", in.Op)
+		}
+		if op == Ja {
+			if uint64(in.K) >= uint64(left) {
+				return fmt.Errorf("jump out of range")
+			}
+		} else if int(in.Jt) >= left || int(in.Jf) >= left {
+			return fmt.Errorf("jump out of range")
+		}
+
+	case Ret:
+		if s := in.Op &^ 0x07; s != K && s != A {
+			return fmt.Errorf("unknown opcode %#x", in.Op)
+		}
+
+	case Misc:
+		if s := in.Op &^ 0x07; s != Tax && s != Txa {
+			return fmt.Errorf("unknown opcode %#x", in.Op)
+		}
+	}
+
+	return nil
+}
+
+// Run runs the program over the given network-layer packet of the given
+// protocol. It returns the number of bytes of the packet to accept, zero
+// meaning that the packet is rejected. Loads beyond the end of the packet and
+// divisions by zero reject the packet.
+func (p *Program) Run(data []byte, protocol tcpip.NetworkProtocolNumber) uint32 {
+	var a, x uint32
+	var mem [memWords]uint32
+
+	for pc := 0; pc < len(p.insns); pc++ {
+		in := p.insns[pc]
+		switch in.Op & 0x07 {
+		case Ld:
+			switch in.Op &^ 0x07 {
+			case W | Imm:
+				a = in.K
+			case W | Len:
+				a = uint32(len(data))
+			case W | Mem:
+				a = mem[in.K]
+			default:
+				off := uint64(in.K)
+				if in.Op&0xe0 == Ind {
+					off += uint64(x)
+				} else if in.K == AncillaryOffset+AncillaryProtocol {
+					a = uint32(protocol)
+					break
+				}
+				v, ok := load(data, off, in.Op&0x18)
+				if !ok {
+					return 0
+				}
+				a = v
+			}
+
+		case Ldx:
+			switch in.Op &^ 0x07 {
+			case W | Imm:
+				x = in.K
+			case W | Len:
+				x = uint32(len(data))
+			case W | Mem:
+				x = mem[in.K]
+			case B | Msh:
+				if uint64(in.K) >= uint64(len(data)) {
+					return 0
+				}
+				x = uint32(data[in.K]&0xf) << 2
+			}
+
+		case St:
+			mem[in.K] = a
+
+		case Stx:
+			mem[in.K] = x
+
+		case Alu:
+			v := in.K
+			if in.Op&0x08 == X {
+				v = x
+			}
+			switch in.Op & 0xf0 {
+			case Add:
+				a += v
+			case Sub:
+				a -= v
+			case Mul:
+				a *= v
+			case Div:
+				if v == 0 {
+					return 0
+				}
+				a /= v
+			case Mod:
+				if v == 0 {
+					return 0
+				}
+				a %= v
+			case Or:
+				a |= v
+			case And:
+				a &= v
+			case Xor:
+				a ^= v
+			case Lsh:
+				a <<= v
+			case Rsh:
+				a >>= v
+			case Neg:
+				a = -a
+			}
+
+		case Jmp:
+			op := in.Op & 0xf0
+			if op == Ja {
+				pc += int(in.K)
+				break
+			}
+			v := in.K
+			if in.Op&0x08 == X {
+				v = x
+			}
+			var cond bool
+			switch op {
+			case Jeq:
+				cond = a == v
+			case Jgt:
+				cond = a > v
+			case Jge:
+				cond = a >= v
+			case Jset:
+				cond = a&v != 0
+			}
+			if cond {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+
+		case Ret:
+			if in.Op&0x18 == A {
+				return a
+			}
+			return in.K
+
+		case Misc:
+			if in.Op&^0x07 == Txa {
+				a = x
+			} else {
+				x = a
+			}
+		}
+	}
+
+	// Compile guarantees that programs end with a Ret instruction.
+	panic("unreachable")
+}
+
+// load loads a big-endian value of the given size at the given offset of
+// data.
+func load(data []byte, off uint64, size uint16) (uint32, bool) {
+	n := uint64(4)
+	switch size {
+	case H:
+		n = 2
+	case B:
+		n = 1
+	}
+	if off+n > uint64(len(data)) {
+		return 0, false
+	}
+
+	switch n {
+	case 4:
+		return binary.BigEndian.Uint32(data[off:]), true
+	case 2:
+		return uint32(binary.BigEndian.Uint16(data[off:])), true
+	default:
+		return uint32(data[off]), true
+	}
+}
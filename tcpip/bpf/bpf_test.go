@@ -0,0 +1,163 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bpf_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip/bpf"
+	"github.com/google/netstack/tcpip/header"
+)
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name  string
+		insns []bpf.Instruction
+		ok    bool
+	}{
+		{"empty", nil, false},
+		{"accept", []bpf.Instruction{bpf.Stmt(bpf.Ret|bpf.K, 1)}, true},
+		{"no return", []bpf.Instruction{bpf.Stmt(bpf.Ld|bpf.W|bpf.Imm, 1)}, false},
+		{"unknown opcode", []bpf.Instruction{bpf.Stmt(bpf.Ld|bpf.W|bpf.Msh, 0), bpf.Stmt(bpf.Ret|bpf.A, 0)}, false},
+		{"bad scratch memory", []bpf.Instruction{bpf.Stmt(bpf.St, 16), bpf.Stmt(bpf.Ret|bpf.A, 0)}, false},
+		{"division by zero", []bpf.Instruction{bpf.Stmt(bpf.Alu|bpf.Div|bpf.K, 0), bpf.Stmt(bpf.Ret|bpf.A, 0)}, false},
+		{"division by X", []bpf.Instruction{bpf.Stmt(bpf.Alu|bpf.Div|bpf.X, 0), bpf.Stmt(bpf.Ret|bpf.A, 0)}, true},
+		{"jump past end", []bpf.Instruction{bpf.Jump(bpf.Jmp|bpf.Jeq|bpf.K, 0, 0, 1), bpf.Stmt(bpf.Ret|bpf.K, 0)}, false},
+		{"ja past end", []bpf.Instruction{bpf.Stmt(bpf.Jmp|bpf.Ja, 1), bpf.Stmt(bpf.Ret|bpf.K, 0)}, false},
+		{"jump to end", []bpf.Instruction{bpf.Jump(bpf.Jmp|bpf.Jeq|bpf.K, 0, 0, 0), bpf.Stmt(bpf.Ret|bpf.K, 0)}, true},
+	}
+	for _, test := range tests {
+		if _, err := bpf.Compile(test.insns); (err == nil) != test.ok {
+			t.Errorf("%s: Compile returned %v, want success %t", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	data := []byte{0x45, 0x00, 0x00, 0x1c, 0x12, 0x34, 0x56, 0x78}
+
+	tests := []struct {
+		name  string
+		insns []bpf.Instruction
+		want  uint32
+	}{
+		{
+			"load word",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ld|bpf.W|bpf.Abs, 4),
+				bpf.Stmt(bpf.Ret|bpf.A, 0),
+			},
+			0x12345678,
+		},
+		{
+			"load half word",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ld|bpf.H|bpf.Abs, 2),
+				bpf.Stmt(bpf.Ret|bpf.A, 0),
+			},
+			0x1c,
+		},
+		{
+			"load out of bounds",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ld|bpf.W|bpf.Abs, 6),
+				bpf.Stmt(bpf.Ret|bpf.K, 1),
+			},
+			0,
+		},
+		{
+			"load indirect",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ldx|bpf.W|bpf.Imm, 4),
+				bpf.Stmt(bpf.Ld|bpf.B|bpf.Ind, 1),
+				bpf.Stmt(bpf.Ret|bpf.A, 0),
+			},
+			0x34,
+		},
+		{
+			"load header length",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ldx|bpf.B|bpf.Msh, 0),
+				bpf.Stmt(bpf.Misc|bpf.Txa, 0),
+				bpf.Stmt(bpf.Ret|bpf.A, 0),
+			},
+			20,
+		},
+		{
+			"load length",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ld|bpf.W|bpf.Len, 0),
+				bpf.Stmt(bpf.Ret|bpf.A, 0),
+			},
+			uint32(len(data)),
+		},
+		{
+			"protocol",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ld|bpf.H|bpf.Abs, bpf.AncillaryOffset+bpf.AncillaryProtocol),
+				bpf.Stmt(bpf.Ret|bpf.A, 0),
+			},
+			uint32(header.IPv4ProtocolNumber),
+		},
+		{
+			"arithmetic",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ld|bpf.W|bpf.Imm, 10),
+				bpf.Stmt(bpf.Ldx|bpf.W|bpf.Imm, 3),
+				bpf.Stmt(bpf.Alu|bpf.Mul|bpf.X, 0),
+				bpf.Stmt(bpf.Alu|bpf.Add|bpf.K, 2),
+				bpf.Stmt(bpf.Alu|bpf.Mod|bpf.K, 7),
+				bpf.Stmt(bpf.Alu|bpf.Lsh|bpf.K, 4),
+				bpf.Stmt(bpf.Alu|bpf.Or|bpf.K, 1),
+				bpf.Stmt(bpf.Ret|bpf.A, 0),
+			},
+			0x41,
+		},
+		{
+			"division by zero X",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ld|bpf.W|bpf.Imm, 10),
+				bpf.Stmt(bpf.Alu|bpf.Div|bpf.X, 0),
+				bpf.Stmt(bpf.Ret|bpf.K, 1),
+			},
+			0,
+		},
+		{
+			"scratch memory",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ld|bpf.W|bpf.Imm, 42),
+				bpf.Stmt(bpf.St, 3),
+				bpf.Stmt(bpf.Ld|bpf.W|bpf.Imm, 0),
+				bpf.Stmt(bpf.Ldx|bpf.W|bpf.Mem, 3),
+				bpf.Stmt(bpf.Misc|bpf.Txa, 0),
+				bpf.Stmt(bpf.Ret|bpf.A, 0),
+			},
+			42,
+		},
+		{
+			"conditional jumps",
+			[]bpf.Instruction{
+				bpf.Stmt(bpf.Ld|bpf.B|bpf.Abs, 0),
+				bpf.Jump(bpf.Jmp|bpf.Jset|bpf.K, 0x40, 0, 3),
+				bpf.Jump(bpf.Jmp|bpf.Jgt|bpf.K, 0x45, 2, 0),
+				bpf.Jump(bpf.Jmp|bpf.Jge|bpf.K, 0x45, 0, 1),
+				bpf.Stmt(bpf.Jmp|bpf.Ja, 1),
+				bpf.Stmt(bpf.Ret|bpf.K, 0),
+				bpf.Stmt(bpf.Ret|bpf.K, 0xffff),
+			},
+			0xffff,
+		},
+	}
+	for _, test := range tests {
+		p, err := bpf.Compile(test.insns)
+		if err != nil {
+			t.Errorf("%s: Compile failed: %v", test.name, err)
+			continue
+		}
+		if got := p.Run(data, header.IPv4ProtocolNumber); got != test.want {
+			t.Errorf("%s: got Run(...) = %#x, want %#x", test.name, got, test.want)
+		}
+	}
+}
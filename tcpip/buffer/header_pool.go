@@ -0,0 +1,53 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buffer
+
+import (
+	"sync"
+)
+
+// HeaderPool recycles the memory the headers of outbound packets are built
+// into, once the link endpoints that write them are done with it.
+type HeaderPool struct {
+	size int
+	pool sync.Pool
+}
+
+// pooledHeader is memory recycled by a HeaderPool.
+type pooledHeader struct {
+	buf View
+	pb  *PacketBuffer
+}
+
+// NewHeaderPool returns a HeaderPool that recycles buffers of the given size.
+func NewHeaderPool(size int) *HeaderPool {
+	return &HeaderPool{size: size}
+}
+
+// NewPrependable is like the NewPrependable function, except that if size
+// fits in the buffers of the pool, the Prependable is made of recycled memory
+// and holds a reference to it. The caller releases it with Release once the
+// packet is written.
+func (p *HeaderPool) NewPrependable(size int) Prependable {
+	if p == nil || size > p.size {
+		return NewPrependable(size)
+	}
+
+	h, _ := p.pool.Get().(*pooledHeader)
+	if h == nil {
+		h = &pooledHeader{buf: NewView(p.size)}
+		h.pb = NewPacketBuffer(func() { p.pool.Put(h) })
+	} else {
+		h.pb.Reset()
+	}
+
+	// Don't let stale bytes of a previous packet leak into the headers of
+	// this one.
+	buf := h.buf[:size]
+	for i := range buf {
+		buf[i] = 0
+	}
+	return Prependable{buf: buf, usedIdx: size, pb: h.pb}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package buffer
+
+import (
+	"sync/atomic"
+)
+
+// PacketBuffer is the reference count of the memory a received packet was read
+// into, which lets link endpoints reuse it for other packets once nothing
+// refers to the packet anymore.
+//
+// A VectorisedView made of such memory carries its PacketBuffer. The holder of
+// a VectorisedView only borrows its views, for as long as the call it was
+// passed to lasts; to keep them, it takes a reference with Clone, and releases
+// it with Release once it's done with the clone. Failing to release a
+// reference never corrupts a packet, it only leaves its memory to the garbage
+// collector instead of having it reused.
+type PacketBuffer struct {
+	refs    int32
+	release func()
+
+	// size is the number of bytes of memory held by the PacketBuffer, see
+	// SetSize.
+	size int
+}
+
+// NewPacketBuffer returns a PacketBuffer holding a single reference. release is
+// called once all the references are released, after which the memory may be
+// reused and the PacketBuffer re-armed with Reset.
+func NewPacketBuffer(release func()) *PacketBuffer {
+	return &PacketBuffer{refs: 1, release: release}
+}
+
+// Reset makes b hold a single reference again, once all its previous ones were
+// released.
+func (b *PacketBuffer) Reset() {
+	if atomic.SwapInt32(&b.refs, 1) != 0 {
+		panic("PacketBuffer reset while referenced")
+	}
+}
+
+// SetSize records the number of bytes of memory b stands for, which the holders
+// of its packets keep alive, however small the packets are. It must be called
+// before b is shared.
+func (b *PacketBuffer) SetSize(n int) {
+	b.size = n
+}
+
+// Size returns the number of bytes of memory b stands for, or 0 if it's
+// unknown.
+func (b *PacketBuffer) Size() int {
+	return b.size
+}
+
+// IncRef takes a reference to b.
+func (b *PacketBuffer) IncRef() {
+	if atomic.AddInt32(&b.refs, 1) <= 1 {
+		panic("PacketBuffer referenced after its release")
+	}
+}
+
+// Release releases a reference to b.
+func (b *PacketBuffer) Release() {
+	switch refs := atomic.AddInt32(&b.refs, -1); {
+	case refs == 0:
+		if b.release != nil {
+			b.release()
+		}
+	case refs < 0:
+		panic("PacketBuffer released too many times")
+	}
+}
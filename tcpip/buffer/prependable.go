@@ -15,6 +15,9 @@ type Prependable struct {
 
 	// usedIdx is the index where the used part of the buffer begins.
 	usedIdx int
+
+	// pb is the PacketBuffer of buf, if buf comes from a HeaderPool.
+	pb *PacketBuffer
 }
 
 // NewPrependable allocates a new prependable buffer with the given size.
@@ -51,3 +54,35 @@ func (p *Prependable) UsedBytes() []byte {
 func (p *Prependable) UsedLength() int {
 	return len(p.buf) - p.usedIdx
 }
+
+// Buffer returns the PacketBuffer that counts the references to the memory of
+// p, or nil if the memory is never reused. Link endpoints that keep the
+// headers of a packet after writing it take a reference to it.
+func (p *Prependable) Buffer() *PacketBuffer {
+	return p.pb
+}
+
+// Release releases the reference p holds to its memory, if it was obtained
+// from a HeaderPool. p must not be used afterwards.
+func (p *Prependable) Release() {
+	if p.pb != nil {
+		p.pb.Release()
+		p.pb = nil
+	}
+}
+
+// ToVectorisedView returns a VectorisedView of the used bytes of p followed by
+// payload, e.g., to deliver an outbound packet to a stack. If the memory of p
+// is recycled, the VectorisedView holds a copy of the headers, so that the
+// stack can keep the packet while p is reused: headers are small, and packets
+// made of recycled memory would have their payload copied when kept.
+func (p *Prependable) ToVectorisedView(payload View) VectorisedView {
+	h := p.View()
+	if p.pb != nil {
+		h = append(View(nil), h...)
+	}
+	if len(payload) == 0 {
+		return NewVectorisedView(len(h), []View{h})
+	}
+	return NewVectorisedView(len(h)+len(payload), []View{h, payload})
+}
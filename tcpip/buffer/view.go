@@ -47,6 +47,10 @@ func (v *View) ToVectorisedView(views [1]View) VectorisedView {
 type VectorisedView struct {
 	views []View
 	size  int
+
+	// buf is the reference to the memory backing views, if it's a
+	// PacketBuffer.
+	buf *PacketBuffer
 }
 
 // NewVectorisedView creates a new vectorised view from an already-allocated slice
@@ -95,6 +99,9 @@ func (vv *VectorisedView) CapLength(length int) {
 // Clone returns a clone of this VectorisedView.
 // If the buffer argument is large enough to contain all the Views of this VectorisedView,
 // the method will avoid allocations and use the buffer to store the Views of the clone.
+//
+// The clone holds its own reference to the PacketBuffer of vv, if any, so that
+// its views can be kept; it must be released with Release.
 func (vv *VectorisedView) Clone(buffer []View) VectorisedView {
 	var views []View
 	if len(buffer) >= len(vv.views) {
@@ -105,7 +112,117 @@ func (vv *VectorisedView) Clone(buffer []View) VectorisedView {
 	for i, v := range vv.views {
 		views[i] = v
 	}
-	return VectorisedView{views: views, size: vv.size}
+	if vv.buf != nil {
+		vv.buf.IncRef()
+	}
+	return VectorisedView{views: views, size: vv.size, buf: vv.buf}
+}
+
+// AppendView appends v to the end of vv. The bytes of v aren't copied, so v
+// must not be modified afterwards.
+func (vv *VectorisedView) AppendView(v View) {
+	vv.views = append(vv.views, v)
+	vv.size += len(v)
+}
+
+// Append appends the views of other to the end of vv. Their bytes aren't
+// copied, and vv takes no reference to the PacketBuffer of other, if any: other
+// must not be released while vv is in use.
+func (vv *VectorisedView) Append(other VectorisedView) {
+	vv.views = append(vv.views, other.views...)
+	vv.size += other.size
+}
+
+// ReadToSlice returns a copy of the length bytes of vv starting at offset, or
+// of those up to its end if it's shorter.
+func (vv *VectorisedView) ReadToSlice(offset, length int) View {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > vv.size {
+		offset = vv.size
+	}
+	if length > vv.size-offset {
+		length = vv.size - offset
+	}
+	if length <= 0 {
+		return View{}
+	}
+	v := make(View, length)
+	u := v
+	for _, w := range vv.views {
+		if offset >= len(w) {
+			offset -= len(w)
+			continue
+		}
+		n := copy(u, w[offset:])
+		offset = 0
+		if u = u[n:]; len(u) == 0 {
+			break
+		}
+	}
+	return v
+}
+
+// SplitAt splits vv in two vectorised views, holding its offset first bytes and
+// the rest. They share the bytes of vv, and vv is left as is. Each of them
+// holds its own reference to the PacketBuffer of vv, if any, and must be
+// released with Release.
+func (vv *VectorisedView) SplitAt(offset int) (VectorisedView, VectorisedView) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > vv.size {
+		offset = vv.size
+	}
+
+	// A view is split in two at most, so a single slice holds the views of
+	// both halves.
+	views := make([]View, 0, len(vv.views)+1)
+	rem := offset
+	i := 0
+	for ; i < len(vv.views) && rem > 0 && rem >= len(vv.views[i]); i++ {
+		views = append(views, vv.views[i])
+		rem -= len(vv.views[i])
+	}
+	n := len(views)
+	if rem > 0 {
+		v := vv.views[i]
+		views = append(views, v[:rem:rem], v[rem:])
+		n++
+		i++
+	}
+	views = append(views, vv.views[i:]...)
+
+	if vv.buf != nil {
+		vv.buf.IncRef()
+		vv.buf.IncRef()
+	}
+	// The capacity of the views of the first half is capped so that
+	// appending to it doesn't overwrite those of the second one.
+	return VectorisedView{views: views[:n:n], size: offset, buf: vv.buf},
+		VectorisedView{views: views[n:], size: vv.size - offset, buf: vv.buf}
+}
+
+// Release releases the reference vv holds to its PacketBuffer, if any. vv must
+// not be used afterwards.
+func (vv *VectorisedView) Release() {
+	if vv.buf != nil {
+		vv.buf.Release()
+		vv.buf = nil
+	}
+}
+
+// Buffer returns the PacketBuffer backing the views of vv, or nil if they
+// aren't reused once released.
+func (vv *VectorisedView) Buffer() *PacketBuffer {
+	return vv.buf
+}
+
+// SetBuffer unsafely sets the PacketBuffer of the VectorisedView, handing it
+// the caller's reference.
+func (vv *VectorisedView) SetBuffer(buf *PacketBuffer) {
+	vv.buf = buf
 }
 
 // First returns the first view of the vectorised view.
@@ -6,6 +6,9 @@
 package buffer
 
 import (
+	"bytes"
+	"fmt"
+	"math/rand"
 	"reflect"
 	"testing"
 )
@@ -210,3 +213,292 @@ func TestToClone(t *testing.T) {
 		}
 	}
 }
+
+func TestPacketBufferClone(t *testing.T) {
+	released := 0
+	b := NewPacketBuffer(func() { released++ })
+	vv := NewVectorisedView(3, []View{{1, 2, 3}})
+	vv.SetBuffer(b)
+
+	clone := vv.Clone(nil)
+	if clone.Buffer() != b {
+		t.Fatalf("got clone.Buffer() = %p, want %p", clone.Buffer(), b)
+	}
+	vv.Release()
+	if released != 0 {
+		t.Fatalf("buffer released while the clone refers to it")
+	}
+	clone.Release()
+	if released != 1 {
+		t.Fatalf("got %d releases, want 1", released)
+	}
+
+	// The buffer can be reused once released.
+	b.Reset()
+	b.Release()
+	if released != 2 {
+		t.Fatalf("got %d releases, want 2", released)
+	}
+}
+
+func TestPacketBufferMisuse(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		f    func(b *PacketBuffer)
+	}{
+		{"release twice", func(b *PacketBuffer) { b.Release(); b.Release() }},
+		{"reset while referenced", func(b *PacketBuffer) { b.Reset() }},
+		{"reference after release", func(b *PacketBuffer) { b.Release(); b.IncRef() }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("didn't panic")
+				}
+			}()
+			c.f(NewPacketBuffer(nil))
+		})
+	}
+}
+
+func TestHeaderPool(t *testing.T) {
+	p := NewHeaderPool(64)
+
+	hdr := p.NewPrependable(32)
+	b := hdr.Buffer()
+	if b == nil {
+		t.Fatalf("got nil Buffer() for a pooled header")
+	}
+	copy(hdr.Prepend(4), "abcd")
+
+	// Packets built from the header hold a copy of it.
+	vv := hdr.ToVectorisedView(View("efgh"))
+	if vv.Buffer() != nil {
+		t.Fatalf("got non-nil Buffer() for a copied header")
+	}
+
+	// A link endpoint keeps the header, so it isn't reused when the
+	// writer releases it.
+	v := hdr.View()
+	b.IncRef()
+	hdr.Release()
+	if got := p.NewPrependable(32); got.Buffer() == b {
+		t.Fatalf("header reused while referenced")
+	}
+	if got := string(v); got != "abcd" {
+		t.Fatalf("got header %q, want %q", got, "abcd")
+	}
+	b.Release()
+	if got := string(vv.ToView()); got != "abcdefgh" {
+		t.Fatalf("got packet %q, want %q", got, "abcdefgh")
+	}
+
+	// Headers too large for the pool aren't recycled.
+	if got := p.NewPrependable(65); got.Buffer() != nil {
+		t.Fatalf("got non-nil Buffer() for a header larger than the pool's buffers")
+	}
+
+	// Recycled headers don't hold the bytes of previous packets.
+	hdr = p.NewPrependable(32)
+	if got := hdr.Prepend(32); !bytes.Equal(got, make([]byte, 32)) {
+		t.Fatalf("got recycled header %v, want zeroes", got)
+	}
+}
+
+// checkVV checks that vv holds want, and that its size matches its views.
+func checkVV(t *testing.T, name string, vv *VectorisedView, want string) {
+	t.Helper()
+	n := 0
+	for _, v := range vv.Views() {
+		n += len(v)
+	}
+	if n != vv.Size() {
+		t.Errorf("%s: got Size() = %d, views holding %d bytes", name, vv.Size(), n)
+	}
+	if got := string(vv.ToView()); got != want {
+		t.Errorf("%s: got %q, want %q", name, got, want)
+	}
+}
+
+func TestSplitAt(t *testing.T) {
+	for _, c := range []struct {
+		comment string
+		in      *VectorisedView
+		offset  int
+		head    string
+		tail    string
+	}{
+		{"Empty", vv(0), 0, "", ""},
+		{"Empty views", vv(0, "", ""), 0, "", ""},
+		{"Negative offset", vv(2, "12"), -1, "", "12"},
+		{"Offset 0", vv(4, "12", "34"), 0, "", "1234"},
+		{"Within first view", vv(4, "12", "34"), 1, "1", "234"},
+		{"At view boundary", vv(4, "12", "34"), 2, "12", "34"},
+		{"At boundary with empty view", vv(4, "12", "", "34"), 2, "12", "34"},
+		{"Within last view", vv(4, "12", "34"), 3, "123", "4"},
+		{"At end", vv(4, "12", "34"), 4, "1234", ""},
+		{"Past end", vv(4, "12", "34"), 5, "1234", ""},
+		{"After empty first view", vv(2, "", "12"), 1, "1", "2"},
+	} {
+		in := c.in.ToView()
+		head, tail := c.in.SplitAt(c.offset)
+		checkVV(t, c.comment+": head", &head, c.head)
+		checkVV(t, c.comment+": tail", &tail, c.tail)
+		checkVV(t, c.comment+": split view", c.in, string(in))
+
+		// Appending to the first half must leave the second one alone.
+		head.AppendView(View("x"))
+		checkVV(t, c.comment+": tail after appending to head", &tail, c.tail)
+	}
+}
+
+func TestSplitAtPacketBuffer(t *testing.T) {
+	released := 0
+	b := NewPacketBuffer(func() { released++ })
+	vv := NewVectorisedView(3, []View{{1, 2, 3}})
+	vv.SetBuffer(b)
+
+	head, tail := vv.SplitAt(1)
+	if head.Buffer() != b || tail.Buffer() != b {
+		t.Fatalf("got buffers %p and %p, want %p", head.Buffer(), tail.Buffer(), b)
+	}
+	vv.Release()
+	head.Release()
+	if released != 0 {
+		t.Fatalf("buffer released while the second half refers to it")
+	}
+	tail.Release()
+	if released != 1 {
+		t.Fatalf("got %d releases, want 1", released)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	v := vv(2, "12")
+	v.AppendView(View{})
+	checkVV(t, "AppendView of an empty view", v, "12")
+	v.AppendView(View("34"))
+	checkVV(t, "AppendView", v, "1234")
+	v.Append(*vv(0))
+	checkVV(t, "Append of an empty vectorised view", v, "1234")
+	v.Append(*vv(3, "5", "", "67"))
+	checkVV(t, "Append", v, "1234567")
+
+	empty := vv(0)
+	empty.Append(*vv(2, "", "12"))
+	checkVV(t, "Append to an empty vectorised view", empty, "12")
+}
+
+func TestReadToSlice(t *testing.T) {
+	in := vv(6, "12", "", "34", "56")
+	for _, c := range []struct {
+		offset int
+		length int
+		want   string
+	}{
+		{0, 6, "123456"},
+		{0, 0, ""},
+		{0, 1, "1"},
+		{1, 2, "23"},
+		{2, 2, "34"},
+		{2, 0, ""},
+		{3, 3, "456"},
+		{4, 10, "56"},
+		{6, 1, ""},
+		{7, 1, ""},
+		{-1, 2, "12"},
+		{1, -1, ""},
+	} {
+		if got := string(in.ReadToSlice(c.offset, c.length)); got != c.want {
+			t.Errorf("got ReadToSlice(%d, %d) = %q, want %q", c.offset, c.length, got, c.want)
+		}
+	}
+	checkVV(t, "read view", in, "123456")
+}
+
+// TestRandomOperations applies random sequences of operations to vectorised
+// views made of random views, comparing them with the same operations on a
+// flat reference.
+func TestRandomOperations(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomView := func() View {
+		v := make(View, rng.Intn(4))
+		for i := range v {
+			v[i] = byte('a' + rng.Intn(26))
+		}
+		return v
+	}
+	randomVV := func() (VectorisedView, []byte) {
+		var vv VectorisedView
+		var ref []byte
+		for n := rng.Intn(5); n > 0; n-- {
+			v := randomView()
+			vv.AppendView(v)
+			ref = append(ref, v...)
+		}
+		return vv, ref
+	}
+	clamp := func(n, max int) int {
+		if n < 0 {
+			return 0
+		}
+		if n > max {
+			return max
+		}
+		return n
+	}
+
+	for i := 0; i < 2000; i++ {
+		vv, ref := randomVV()
+		var ops []string
+		for j := 0; j < 10; j++ {
+			n := rng.Intn(len(ref)+3) - 1
+			switch op := rng.Intn(7); op {
+			case 0:
+				ops = append(ops, fmt.Sprintf("TrimFront(%d)", n))
+				vv.TrimFront(n)
+				ref = ref[clamp(n, len(ref)):]
+			case 1:
+				ops = append(ops, fmt.Sprintf("CapLength(%d)", n))
+				vv.CapLength(n)
+				ref = ref[:clamp(n, len(ref))]
+			case 2, 3:
+				ops = append(ops, fmt.Sprintf("SplitAt(%d), half %d", n, op-2))
+				head, tail := vv.SplitAt(n)
+				if op == 2 {
+					vv = head
+					ref = ref[:clamp(n, len(ref))]
+				} else {
+					vv = tail
+					ref = ref[clamp(n, len(ref)):]
+				}
+			case 4:
+				v := randomView()
+				ops = append(ops, fmt.Sprintf("AppendView(%q)", v))
+				vv.AppendView(v)
+				ref = append(ref[:len(ref):len(ref)], v...)
+			case 5:
+				other, oref := randomVV()
+				ops = append(ops, fmt.Sprintf("Append(%q)", oref))
+				vv.Append(other)
+				ref = append(ref[:len(ref):len(ref)], oref...)
+			case 6:
+				ops = append(ops, "Clone")
+				vv = vv.Clone(make([]View, rng.Intn(4)))
+			}
+
+			length := rng.Intn(len(ref)+2) - 1
+			want := ""
+			if start := clamp(n, len(ref)); length > 0 {
+				want = string(ref[start:clamp(start+length, len(ref))])
+			}
+			if got := string(vv.ReadToSlice(n, length)); got != want {
+				t.Fatalf("after %v: got ReadToSlice(%d, %d) = %q, want %q", ops, n, length, got, want)
+			}
+			checkVV(t, fmt.Sprintf("after %v", ops), &vv, string(ref))
+			if t.Failed() {
+				t.FailNow()
+			}
+		}
+	}
+}
@@ -7,25 +7,81 @@
 package header
 
 import (
+	"encoding/binary"
+
 	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
 )
 
 // Checksum calculates the checksum (as defined in RFC 1071) of the bytes in the
 // given byte array.
 func Checksum(buf []byte, initial uint16) uint16 {
-	v := uint32(initial)
+	return foldChecksum(checksumUpdate(uint64(initial), buf))
+}
 
-	l := len(buf)
-	if l&1 != 0 {
-		l--
-		v += uint32(buf[l]) << 8
+// checksumUpdate adds the bytes of buf, as big-endian 16-bit words padded with
+// a zero byte if needed, to the unfolded checksum v.
+//
+// The bytes are summed as 32-bit words into a 64-bit accumulator, read 8 at a
+// time, so the carries don't have to be handled until the sum is folded. That
+// holds for any buffer below 2^32 * 4 bytes.
+func checksumUpdate(v uint64, buf []byte) uint64 {
+	for len(buf) >= 32 {
+		w0 := binary.BigEndian.Uint64(buf)
+		w1 := binary.BigEndian.Uint64(buf[8:])
+		w2 := binary.BigEndian.Uint64(buf[16:])
+		w3 := binary.BigEndian.Uint64(buf[24:])
+		v += w0>>32 + w0&0xffffffff + w1>>32 + w1&0xffffffff
+		v += w2>>32 + w2&0xffffffff + w3>>32 + w3&0xffffffff
+		buf = buf[32:]
 	}
-
-	for i := 0; i < l; i += 2 {
-		v += (uint32(buf[i]) << 8) + uint32(buf[i+1])
+	for len(buf) >= 8 {
+		w := binary.BigEndian.Uint64(buf)
+		v += w>>32 + w&0xffffffff
+		buf = buf[8:]
 	}
+	for len(buf) >= 2 {
+		v += uint64(binary.BigEndian.Uint16(buf))
+		buf = buf[2:]
+	}
+	if len(buf) != 0 {
+		v += uint64(buf[0]) << 8
+	}
+	return v
+}
 
-	return ChecksumCombine(uint16(v), uint16(v>>16))
+// foldChecksum folds the unfolded checksum v into 16 bits, adding the carries
+// back in.
+func foldChecksum(v uint64) uint16 {
+	v = v>>32 + v&0xffffffff
+	v = v>>32 + v&0xffffffff
+	v = v>>16 + v&0xffff
+	v = v>>16 + v&0xffff
+	return uint16(v)
+}
+
+// ChecksumVV calculates the checksum (as defined in RFC 1071) of the bytes in
+// the given VectorisedView. Views of odd length are handled as if all views
+// were a single contiguous byte array.
+func ChecksumVV(vv buffer.VectorisedView, initial uint16) uint16 {
+	v := uint64(initial)
+	odd := false
+	for _, view := range vv.Views() {
+		if !odd {
+			v = checksumUpdate(v, view)
+		} else {
+			// The view starts at an odd offset, so its bytes take
+			// the other half of the 16-bit words than they would
+			// on their own. The ones' complement sum doesn't
+			// depend on the byte order, so summing the view by
+			// itself and swapping the bytes of the result is
+			// enough.
+			xsum := foldChecksum(checksumUpdate(0, view))
+			v += uint64(xsum>>8 | xsum<<8)
+		}
+		odd = odd != (len(view)&1 != 0)
+	}
+	return foldChecksum(v)
 }
 
 // ChecksumCombine combines the two uint16 to form their checksum. This is done
@@ -35,6 +91,14 @@ func ChecksumCombine(a, b uint16) uint16 {
 	return uint16(v + v>>16)
 }
 
+// PseudoHeaderChecksumWithLength adds the given transport segment length to
+// a pseudo-header checksum calculated by PseudoHeaderChecksum. The result is
+// what link endpoints that offload transport checksums expect to find in the
+// checksum field.
+func PseudoHeaderChecksumWithLength(xsum uint16, length uint16) uint16 {
+	return Checksum([]byte{uint8(length >> 8), uint8(length)}, xsum)
+}
+
 // PseudoHeaderChecksum calculates the pseudo-header checksum for the
 // given destination protocol and network address, ignoring the length
 // field. Pseudo-headers are needed by transport layers when calculating
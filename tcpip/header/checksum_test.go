@@ -0,0 +1,172 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// naiveChecksum is the straightforward implementation of RFC 1071 that
+// header.Checksum is checked against.
+func naiveChecksum(buf []byte, initial uint16) uint16 {
+	v := uint32(initial)
+
+	l := len(buf)
+	if l&1 != 0 {
+		l--
+		v += uint32(buf[l]) << 8
+	}
+
+	for i := 0; i < l; i += 2 {
+		v += (uint32(buf[i]) << 8) + uint32(buf[i+1])
+	}
+
+	return header.ChecksumCombine(uint16(v), uint16(v>>16))
+}
+
+// randomBytes returns n random bytes, mostly set to 0xff if full is set so
+// that the carries are exercised.
+func randomBytes(rng *rand.Rand, n int, full bool) []byte {
+	b := make([]byte, n)
+	rng.Read(b)
+	if full {
+		for i := range b {
+			if rng.Intn(8) != 0 {
+				b[i] = 0xff
+			}
+		}
+	}
+	return b
+}
+
+func TestChecksum(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		n := rng.Intn(200)
+		if i%100 == 0 {
+			n = rng.Intn(1 << 16)
+		}
+		buf := randomBytes(rng, n+8, i%3 == 0)
+
+		// Slice the buffer at an arbitrary offset so that its start
+		// isn't aligned.
+		off := rng.Intn(8)
+		b := buf[off : off+n]
+		initial := uint16(rng.Intn(1 << 16))
+		if got, want := header.Checksum(b, initial), naiveChecksum(b, initial); got != want {
+			t.Fatalf("got Checksum(%x, 0x%04x) = 0x%04x, want 0x%04x", b, initial, got, want)
+		}
+	}
+}
+
+func TestChecksumEdgeCases(t *testing.T) {
+	for _, tc := range []struct {
+		buf     []byte
+		initial uint16
+	}{
+		{nil, 0},
+		{nil, 0xffff},
+		{[]byte{0}, 0},
+		{[]byte{0xff}, 0},
+		{[]byte{0xff, 0xff}, 0},
+		{[]byte{0xff, 0xff}, 0xffff},
+		{[]byte{0x00, 0x01}, 0xffff},
+		{make([]byte, 33), 0},
+	} {
+		if got, want := header.Checksum(tc.buf, tc.initial), naiveChecksum(tc.buf, tc.initial); got != want {
+			t.Errorf("got Checksum(%x, 0x%04x) = 0x%04x, want 0x%04x", tc.buf, tc.initial, got, want)
+		}
+	}
+
+	// The largest possible IP packet is all ones.
+	buf := make([]byte, 1<<16)
+	for i := range buf {
+		buf[i] = 0xff
+	}
+	if got, want := header.Checksum(buf, 0xffff), naiveChecksum(buf, 0xffff); got != want {
+		t.Errorf("got Checksum(<64KiB of 0xff>, 0xffff) = 0x%04x, want 0x%04x", got, want)
+	}
+}
+
+func TestChecksumVV(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		buf := randomBytes(rng, rng.Intn(300), i%3 == 0)
+
+		// Split the buffer into views of arbitrary, often odd,
+		// lengths, including empty ones.
+		var views []buffer.View
+		for rest := buf; ; {
+			n := rng.Intn(len(rest) + 1)
+			if rng.Intn(4) == 0 {
+				n = rng.Intn(3)
+				if n > len(rest) {
+					n = len(rest)
+				}
+			}
+			views = append(views, buffer.View(rest[:n]))
+			rest = rest[n:]
+			if len(rest) == 0 {
+				break
+			}
+		}
+		vv := buffer.NewVectorisedView(len(buf), views)
+
+		initial := uint16(rng.Intn(1 << 16))
+		if got, want := header.ChecksumVV(vv, initial), naiveChecksum(buf, initial); got != want {
+			t.Fatalf("got ChecksumVV(%x, 0x%04x) = 0x%04x, want 0x%04x", views, initial, got, want)
+		}
+	}
+}
+
+func BenchmarkChecksum(b *testing.B) {
+	for _, size := range []int{64, 1500, 64 << 10} {
+		buf := randomBytes(rand.New(rand.NewSource(1)), size+1, false)
+		for _, bm := range []struct {
+			name     string
+			checksum func([]byte, uint16) uint16
+		}{
+			{"Naive", naiveChecksum},
+			{"Checksum", header.Checksum},
+		} {
+			for _, off := range []int{0, 1} {
+				b.Run(fmt.Sprintf("%s/%dB/Offset%d", bm.name, size, off), func(b *testing.B) {
+					b.SetBytes(int64(size))
+					for i := 0; i < b.N; i++ {
+						bm.checksum(buf[off:off+size], 0)
+					}
+				})
+			}
+		}
+	}
+}
+
+func BenchmarkChecksumVV(b *testing.B) {
+	buf := buffer.NewView(64 << 10)
+	rand.New(rand.NewSource(1)).Read(buf)
+
+	// Views of odd lengths force every other one to start at an odd
+	// offset.
+	var views []buffer.View
+	for rest := buf; len(rest) != 0; {
+		n := 1499
+		if n > len(rest) {
+			n = len(rest)
+		}
+		views = append(views, rest[:n])
+		rest = rest[n:]
+	}
+	vv := buffer.NewVectorisedView(len(buf), views)
+
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		header.ChecksumVV(vv, 0)
+	}
+}
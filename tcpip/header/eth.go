@@ -62,3 +62,33 @@ func (b Ethernet) Encode(e *EthernetFields) {
 	copy(b[srcMAC:][:EthernetAddressSize], e.SrcAddr)
 	copy(b[dstMAC:][:EthernetAddressSize], e.DstAddr)
 }
+
+// IsMulticastEthernetAddress determines if the provided link address is an
+// ethernet multicast (or broadcast) address, i.e., if its group bit is set.
+func IsMulticastEthernetAddress(addr tcpip.LinkAddress) bool {
+	return len(addr) == EthernetAddressSize && addr[0]&1 != 0
+}
+
+// EthernetAddressToEUI64 returns the modified EUI-64 interface identifier
+// formed from the given ethernet address, as per RFC 4291 appendix A: ff:fe is
+// inserted in the middle of the address and the universal/local bit is
+// inverted.
+func EthernetAddressToEUI64(linkAddr tcpip.LinkAddress) [8]byte {
+	return [8]byte{linkAddr[0] ^ 0x02, linkAddr[1], linkAddr[2], 0xff, 0xfe, linkAddr[3], linkAddr[4], linkAddr[5]}
+}
+
+// EthernetAddressFromMulticastIPv4Address returns the ethernet multicast
+// address that the given IPv4 multicast address maps to, as per RFC 1112
+// section 6.4: the low-order 23 bits of the group address are placed in the
+// low-order 23 bits of 01:00:5e:00:00:00.
+func EthernetAddressFromMulticastIPv4Address(addr tcpip.Address) tcpip.LinkAddress {
+	return tcpip.LinkAddress([]byte{0x01, 0x00, 0x5e, addr[1] & 0x7f, addr[2], addr[3]})
+}
+
+// EthernetAddressFromMulticastIPv6Address returns the ethernet multicast
+// address that the given IPv6 multicast address maps to, as per RFC 2464
+// section 7: the low-order 32 bits of the group address are appended to
+// 33:33.
+func EthernetAddressFromMulticastIPv6Address(addr tcpip.Address) tcpip.LinkAddress {
+	return tcpip.LinkAddress([]byte{0x33, 0x33, addr[12], addr[13], addr[14], addr[15]})
+}
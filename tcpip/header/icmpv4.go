@@ -48,6 +48,8 @@ const (
 
 // Values for ICMP code as defined in RFC 792.
 const (
+	ICMPv4NetUnreachable      = 0
+	ICMPv4HostUnreachable     = 1
 	ICMPv4PortUnreachable     = 3
 	ICMPv4FragmentationNeeded = 4
 )
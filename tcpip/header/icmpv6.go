@@ -27,6 +27,10 @@ const (
 	// ICMPv6NeighborAdvertSize is size of a neighbor advertisement.
 	ICMPv6NeighborAdvertSize = 32
 
+	// ICMPv6RouterAdvertMinimumSize is the minimum size of a router
+	// advertisement packet.
+	ICMPv6RouterAdvertMinimumSize = ICMPv6MinimumSize + NDPRouterAdvertMinimumSize
+
 	// ICMPv6EchoMinimumSize is the minimum size of a valid ICMP echo packet.
 	ICMPv6EchoMinimumSize = 8
 
@@ -62,7 +66,9 @@ const (
 
 // Values for ICMP code as defined in RFC 4443.
 const (
-	ICMPv6PortUnreachable = 4
+	ICMPv6NoRoute            = 0
+	ICMPv6AddressUnreachable = 3
+	ICMPv6PortUnreachable    = 4
 )
 
 // Type is the ICMP type field.
@@ -109,3 +115,13 @@ func (ICMPv6) SetDestinationPort(uint16) {
 func (b ICMPv6) Payload() []byte {
 	return b[ICMPv6MinimumSize:]
 }
+
+// ICMPv6Checksum calculates the checksum of the ICMPv6 message made of the
+// header h followed by payload, sent from src to dst. The checksum field of h
+// must be zero.
+func ICMPv6Checksum(h ICMPv6, src, dst tcpip.Address, payload []byte) uint16 {
+	xsum := PseudoHeaderChecksum(ICMPv6ProtocolNumber, src, dst)
+	xsum = PseudoHeaderChecksumWithLength(xsum, uint16(len(h)+len(payload)))
+	xsum = Checksum(payload, xsum)
+	return ^Checksum(h, xsum)
+}
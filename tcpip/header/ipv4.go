@@ -85,6 +85,9 @@ const (
 	IPv4Version = 4
 )
 
+// IPv4Broadcast is the limited broadcast address, 255.255.255.255.
+const IPv4Broadcast tcpip.Address = "\xff\xff\xff\xff"
+
 // Flags that may be set in an IPv4 packet.
 const (
 	IPv4FlagMoreFragments = 1 << iota
@@ -153,6 +156,18 @@ func (b IPv4) DestinationAddress() tcpip.Address {
 	return tcpip.Address(b[dstAddr : dstAddr+IPv4AddressSize])
 }
 
+// SourceAddressSlice returns the "source address" field of the ipv4 header
+// without copying it, so it's only valid as long as the header is.
+func (b IPv4) SourceAddressSlice() []byte {
+	return b[srcAddr : srcAddr+IPv4AddressSize]
+}
+
+// DestinationAddressSlice returns the "destination address" field of the ipv4
+// header without copying it, so it's only valid as long as the header is.
+func (b IPv4) DestinationAddressSlice() []byte {
+	return b[dstAddr : dstAddr+IPv4AddressSize]
+}
+
 // TransportProtocol implements Network.TransportProtocol.
 func (b IPv4) TransportProtocol() tcpip.TransportProtocolNumber {
 	return tcpip.TransportProtocolNumber(b.Protocol())
@@ -178,6 +193,11 @@ func (b IPv4) SetTOS(v uint8, _ uint32) {
 	b[tos] = v
 }
 
+// SetTTL sets the "TTL" field of the ipv4 header.
+func (b IPv4) SetTTL(v uint8) {
+	b[ttl] = v
+}
+
 // SetTotalLength sets the "total length" field of the ipv4 header.
 func (b IPv4) SetTotalLength(totalLength uint16) {
 	binary.BigEndian.PutUint16(b[totalLen:], totalLength)
@@ -249,3 +269,79 @@ func (b IPv4) IsValid(pktSize int) bool {
 
 	return true
 }
+
+// IPv4 option types, per RFC 791.
+const (
+	// IPv4OptionListEnd is the type of the option that ends the options.
+	IPv4OptionListEnd = 0
+
+	// IPv4OptionNOP is the type of the single byte padding option.
+	IPv4OptionNOP = 1
+
+	// IPv4OptionLSRR is the type of the loose source and record route
+	// option.
+	IPv4OptionLSRR = 131
+
+	// IPv4OptionSSRR is the type of the strict source and record route
+	// option.
+	IPv4OptionSSRR = 137
+)
+
+// IPv4SourceRoute is a loose or strict source route option stored in a byte
+// array, as returned by IPv4.SourceRoute.
+type IPv4SourceRoute []byte
+
+// Type returns the type of the option, IPv4OptionLSRR or IPv4OptionSSRR.
+func (o IPv4SourceRoute) Type() uint8 {
+	return o[0]
+}
+
+// Pointer returns the "pointer" field of the option, the 1-based offset in
+// the option of the next address of the route.
+func (o IPv4SourceRoute) Pointer() uint8 {
+	return o[2]
+}
+
+// Done returns whether all the addresses of the route were visited, that is,
+// whether the packet reached its final destination.
+func (o IPv4SourceRoute) Done() bool {
+	return int(o.Pointer()) > len(o)
+}
+
+// SourceRoute returns the source route option of the header, or nil if it has
+// none. ok is false if the options of the header are malformed.
+func (b IPv4) SourceRoute() (opt IPv4SourceRoute, ok bool) {
+	hlen := int(b.HeaderLength())
+	if hlen < IPv4MinimumSize || hlen > len(b) {
+		return nil, false
+	}
+	for opts := b[IPv4MinimumSize:hlen]; len(opts) > 0; {
+		switch opts[0] {
+		case IPv4OptionListEnd:
+			return opt, true
+		case IPv4OptionNOP:
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return nil, false
+		}
+		o := opts[:opts[1]]
+		opts = opts[len(o):]
+		if t := o[0]; t == IPv4OptionLSRR || t == IPv4OptionSSRR {
+			// The option holds a pointer and at least one
+			// address, and appears only once.
+			if len(o) < 3+IPv4AddressSize || opt != nil {
+				return nil, false
+			}
+			opt = IPv4SourceRoute(o)
+		}
+	}
+	return opt, true
+}
+
+// IsV4MulticastAddress determines if the provided address is an IPv4 multicast
+// address, i.e., if it's in the range 224.0.0.0/4.
+func IsV4MulticastAddress(addr tcpip.Address) bool {
+	return len(addr) == IPv4AddressSize && addr[0]&0xf0 == 0xe0
+}
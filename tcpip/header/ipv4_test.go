@@ -0,0 +1,57 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip/header"
+)
+
+func TestIPv4SourceRoute(t *testing.T) {
+	lsrr := []byte{header.IPv4OptionLSRR, 7, 4, 10, 0, 0, 1}
+	for _, tc := range []struct {
+		name     string
+		options  []byte
+		wantOK   bool
+		wantOpt  []byte
+		wantDone bool
+	}{
+		{"None", nil, true, nil, false},
+		{"Padding", []byte{header.IPv4OptionNOP, header.IPv4OptionListEnd, 0, 0}, true, nil, false},
+		{"LSRR", append(append([]byte(nil), lsrr...), header.IPv4OptionListEnd), true, lsrr, false},
+		{"SSRR done", []byte{header.IPv4OptionNOP, header.IPv4OptionSSRR, 7, 8, 10, 0, 0, 1}, true, []byte{header.IPv4OptionSSRR, 7, 8, 10, 0, 0, 1}, true},
+		{"After other option", []byte{7, 3, 4, header.IPv4OptionLSRR, 7, 4, 10, 0, 0, 1, 0, 0}, true, lsrr, false},
+		{"Ignored after end", []byte{header.IPv4OptionListEnd, header.IPv4OptionLSRR, 7, 4, 10, 0, 0, 1}, true, nil, false},
+		{"Truncated", []byte{header.IPv4OptionLSRR, 11, 4, 10, 0, 0, 1, 0}, false, nil, false},
+		{"Zero length", []byte{7, 0, 0, 0}, false, nil, false},
+		{"No address", []byte{header.IPv4OptionLSRR, 3, 4, 0}, false, nil, false},
+		{"Twice", append(append([]byte{header.IPv4OptionNOP}, lsrr...), lsrr...), false, nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			options := tc.options
+			for len(options)%4 != 0 {
+				options = append(options, header.IPv4OptionListEnd)
+			}
+			b := make(header.IPv4, header.IPv4MinimumSize+len(options))
+			b.Encode(&header.IPv4Fields{
+				IHL:         uint8(len(b)),
+				TotalLength: uint16(len(b)),
+			})
+			copy(b[header.IPv4MinimumSize:], options)
+
+			opt, ok := b.SourceRoute()
+			if ok != tc.wantOK {
+				t.Fatalf("got ok = %t, want %t", ok, tc.wantOK)
+			}
+			if string(opt) != string(tc.wantOpt) {
+				t.Fatalf("got option %x, want %x", []byte(opt), tc.wantOpt)
+			}
+			if opt != nil && opt.Done() != tc.wantDone {
+				t.Errorf("got Done() = %t, want %t", opt.Done(), tc.wantDone)
+			}
+		})
+	}
+}
@@ -66,6 +66,14 @@ const (
 	// IPv6MinimumMTU is the minimum MTU required by IPv6, per RFC 2460,
 	// section 5.
 	IPv6MinimumMTU = 1280
+
+	// IPv6FlowLabelMask is the mask of the bits of the "flow label" field
+	// of the ipv6 header.
+	IPv6FlowLabelMask = 0xfffff
+
+	// IPv6AllNodesMulticastAddress is the link-local scope multicast
+	// address of all the nodes, ff02::1.
+	IPv6AllNodesMulticastAddress tcpip.Address = "\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01"
 )
 
 // PayloadLength returns the value of the "payload length" field of the ipv6
@@ -105,6 +113,18 @@ func (b IPv6) DestinationAddress() tcpip.Address {
 	return tcpip.Address(b[v6DstAddr : v6DstAddr+IPv6AddressSize])
 }
 
+// SourceAddressSlice returns the "source address" field of the ipv6 header
+// without copying it, so it's only valid as long as the header is.
+func (b IPv6) SourceAddressSlice() []byte {
+	return b[v6SrcAddr : v6SrcAddr+IPv6AddressSize]
+}
+
+// DestinationAddressSlice returns the "destination address" field of the ipv6
+// header without copying it, so it's only valid as long as the header is.
+func (b IPv6) DestinationAddressSlice() []byte {
+	return b[v6DstAddr : v6DstAddr+IPv6AddressSize]
+}
+
 // Checksum implements Network.Checksum. Given that IPv6 doesn't have a
 // checksum, it just returns 0.
 func (IPv6) Checksum() uint16 {
@@ -114,12 +134,12 @@ func (IPv6) Checksum() uint16 {
 // TOS returns the "traffic class" and "flow label" fields of the ipv6 header.
 func (b IPv6) TOS() (uint8, uint32) {
 	v := binary.BigEndian.Uint32(b[versTCFL:])
-	return uint8(v >> 20), v & 0xfffff
+	return uint8(v >> 20), v & IPv6FlowLabelMask
 }
 
 // SetTOS sets the "traffic class" and "flow label" fields of the ipv6 header.
 func (b IPv6) SetTOS(t uint8, l uint32) {
-	vtf := (6 << 28) | (uint32(t) << 20) | (l & 0xfffff)
+	vtf := (6 << 28) | (uint32(t) << 20) | (l & IPv6FlowLabelMask)
 	binary.BigEndian.PutUint32(b[versTCFL:], vtf)
 }
 
@@ -128,6 +148,11 @@ func (b IPv6) SetPayloadLength(payloadLength uint16) {
 	binary.BigEndian.PutUint16(b[payloadLen:], payloadLength)
 }
 
+// SetHopLimit sets the value of the "hop limit" field of the ipv6 header.
+func (b IPv6) SetHopLimit(v uint8) {
+	b[hopLimit] = v
+}
+
 // SetSourceAddress sets the "source address" field of the ipv6 header.
 func (b IPv6) SetSourceAddress(addr tcpip.Address) {
 	copy(b[v6SrcAddr:v6SrcAddr+IPv6AddressSize], addr)
@@ -189,3 +214,15 @@ func IsV4MappedAddress(addr tcpip.Address) bool {
 
 	return true
 }
+
+// IsV6MulticastAddress determines if the provided address is an IPv6 multicast
+// address by checking if its prefix is ff00::/8.
+func IsV6MulticastAddress(addr tcpip.Address) bool {
+	return len(addr) == IPv6AddressSize && addr[0] == 0xff
+}
+
+// IsV6LinkLocalAddress determines if the provided address is an IPv6
+// link-local unicast address by checking if its prefix is fe80::/10.
+func IsV6LinkLocalAddress(addr tcpip.Address) bool {
+	return len(addr) == IPv6AddressSize && addr[0] == 0xfe && addr[1]&0xc0 == 0x80
+}
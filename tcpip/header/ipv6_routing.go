@@ -0,0 +1,59 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+const (
+	nextHdrRouting  = 0
+	hdrExtLen       = 1
+	routingType     = 2
+	segmentsLeftOff = 3
+)
+
+// IPv6Routing represents an ipv6 routing header stored in a byte array.
+// Always call IsValid() to validate an instance of IPv6Routing before using
+// other methods.
+type IPv6Routing []byte
+
+const (
+	// IPv6RoutingHeader is the number used to specify that the next header
+	// is a routing header, per RFC 8200.
+	IPv6RoutingHeader = 43
+
+	// IPv6RoutingMinimumSize is the minimum size of a routing header.
+	IPv6RoutingMinimumSize = 8
+
+	// IPv6RoutingType0 is the type of the deprecated source routing
+	// header, per RFC 5095.
+	IPv6RoutingType0 = 0
+)
+
+// IsValid performs basic validation on the routing header.
+func (b IPv6Routing) IsValid() bool {
+	return len(b) >= IPv6RoutingMinimumSize && len(b) >= b.Length()
+}
+
+// NextHeader returns the value of the "next header" field of the routing
+// header.
+func (b IPv6Routing) NextHeader() uint8 {
+	return b[nextHdrRouting]
+}
+
+// Length returns the length, in bytes, of the routing header.
+func (b IPv6Routing) Length() int {
+	return (int(b[hdrExtLen]) + 1) * 8
+}
+
+// RoutingType returns the value of the "routing type" field of the routing
+// header.
+func (b IPv6Routing) RoutingType() uint8 {
+	return b[routingType]
+}
+
+// SegmentsLeft returns the value of the "segments left" field of the routing
+// header, the number of nodes the packet is still to visit before its final
+// destination.
+func (b IPv6Routing) SegmentsLeft() uint8 {
+	return b[segmentsLeftOff]
+}
@@ -0,0 +1,284 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+)
+
+// Subtypes of the Multipath TCP option, see RFC 6824 section 8.
+const (
+	MPTCPSubtypeCapable = 0
+	MPTCPSubtypeJoin    = 1
+	MPTCPSubtypeDSS     = 2
+)
+
+const (
+	// MPTCPVersion is the version of Multipath TCP carried by the
+	// MP_CAPABLE option, i.e., version 0 as described in RFC 6824.
+	MPTCPVersion = 0
+
+	// MPTCPCapableFlagHMACSHA1 is the flag of the MP_CAPABLE option
+	// selecting HMAC-SHA1 to authenticate the subflows. It's the only
+	// algorithm defined.
+	MPTCPCapableFlagHMACSHA1 = 0x01
+
+	// MPTCPJoinTruncatedHMACSize and MPTCPJoinHMACSize are the sizes of the
+	// HMACs carried by the MP_JOIN options of a SYN-ACK and of the ACK that
+	// completes the handshake.
+	MPTCPJoinTruncatedHMACSize = 8
+	MPTCPJoinHMACSize          = 20
+
+	// MPTCPDSSMappingSize is the size of a DSS option carrying a data
+	// acknowledgement and a mapping, both with 8-byte data sequence
+	// numbers, and no checksum.
+	MPTCPDSSMappingSize = 26
+
+	// Sizes of the MP_CAPABLE and MP_JOIN options.
+	mptcpCapableSynSize = 12
+	mptcpCapableAckSize = 20
+	mptcpJoinSynSize    = 12
+	mptcpJoinSynAckSize = 16
+	mptcpJoinAckSize    = 24
+)
+
+// Flags of the DSS option.
+const (
+	mptcpDSSDataAck        = 0x01
+	mptcpDSSDataAck8       = 0x02
+	mptcpDSSMapping        = 0x04
+	mptcpDSSMapping8       = 0x08
+	mptcpDSSDataFin        = 0x10
+	mptcpDSSMinimumSize    = 4
+	mptcpDSSMappingMinSize = 10
+)
+
+// MPTCPOption holds the fields of a Multipath TCP option. Which ones are
+// meaningful depends on the subtype, and for MP_CAPABLE and MP_JOIN, on the
+// segment of the handshake the option is carried by.
+type MPTCPOption struct {
+	// Present is true if the segment carries a Multipath TCP option.
+	Present bool
+
+	// Subtype is the subtype of the option.
+	Subtype uint8
+
+	// SenderKey and ReceiverKey are the keys of an MP_CAPABLE option. The
+	// ReceiverKey is only carried by the ACK completing the handshake.
+	SenderKey      uint64
+	ReceiverKey    uint64
+	HasReceiverKey bool
+
+	// Token, Nonce, AddressID, Backup and HMAC are the fields of an
+	// MP_JOIN option. The Token is only carried by SYNs, and the Nonce by
+	// SYNs and SYN-ACKs; the HMAC is truncated in SYN-ACKs.
+	Token     uint32
+	Nonce     uint32
+	AddressID uint8
+	Backup    bool
+	HMAC      []byte
+
+	// DataAck is the data acknowledgement of a DSS option, if HasDataAck
+	// is set.
+	DataAck    uint64
+	HasDataAck bool
+
+	// DataSeq, SubflowSeq and DataLen are the mapping of a DSS option, if
+	// HasMapping is set: the DataLen bytes starting at the relative
+	// subflow sequence number SubflowSeq start at the data sequence number
+	// DataSeq.
+	DataSeq    uint64
+	SubflowSeq uint32
+	DataLen    uint16
+	HasMapping bool
+
+	// DataFin is set if the DSS option carries a DATA_FIN.
+	DataFin bool
+}
+
+// parseMPTCPOption parses the Multipath TCP option b, which starts with its
+// kind and length. It returns false if the option is malformed.
+func parseMPTCPOption(b []byte) (MPTCPOption, bool) {
+	if len(b) < 3 {
+		return MPTCPOption{}, false
+	}
+	opt := MPTCPOption{Present: true, Subtype: b[2] >> 4}
+	switch opt.Subtype {
+	case MPTCPSubtypeCapable:
+		switch len(b) {
+		case mptcpCapableAckSize:
+			opt.ReceiverKey = binary.BigEndian.Uint64(b[12:])
+			opt.HasReceiverKey = true
+			fallthrough
+		case mptcpCapableSynSize:
+			opt.SenderKey = binary.BigEndian.Uint64(b[4:])
+		default:
+			return MPTCPOption{}, false
+		}
+
+	case MPTCPSubtypeJoin:
+		opt.Backup = b[2]&0x01 != 0
+		switch len(b) {
+		case mptcpJoinSynSize:
+			opt.AddressID = b[3]
+			opt.Token = binary.BigEndian.Uint32(b[4:])
+			opt.Nonce = binary.BigEndian.Uint32(b[8:])
+		case mptcpJoinSynAckSize:
+			opt.AddressID = b[3]
+			opt.HMAC = b[4 : 4+MPTCPJoinTruncatedHMACSize]
+			opt.Nonce = binary.BigEndian.Uint32(b[12:])
+		case mptcpJoinAckSize:
+			opt.HMAC = b[4 : 4+MPTCPJoinHMACSize]
+		default:
+			return MPTCPOption{}, false
+		}
+
+	case MPTCPSubtypeDSS:
+		if len(b) < mptcpDSSMinimumSize {
+			return MPTCPOption{}, false
+		}
+		flags := b[3]
+		opt.DataFin = flags&mptcpDSSDataFin != 0
+		i := mptcpDSSMinimumSize
+		if flags&mptcpDSSDataAck != 0 {
+			if flags&mptcpDSSDataAck8 != 0 {
+				if i+8 > len(b) {
+					return MPTCPOption{}, false
+				}
+				opt.DataAck = binary.BigEndian.Uint64(b[i:])
+				i += 8
+			} else {
+				if i+4 > len(b) {
+					return MPTCPOption{}, false
+				}
+				opt.DataAck = uint64(binary.BigEndian.Uint32(b[i:]))
+				i += 4
+			}
+			opt.HasDataAck = true
+		}
+		if flags&mptcpDSSMapping != 0 {
+			if flags&mptcpDSSMapping8 != 0 {
+				if i+8+mptcpDSSMappingMinSize-4 > len(b) {
+					return MPTCPOption{}, false
+				}
+				opt.DataSeq = binary.BigEndian.Uint64(b[i:])
+				i += 8
+			} else {
+				if i+mptcpDSSMappingMinSize > len(b) {
+					return MPTCPOption{}, false
+				}
+				opt.DataSeq = uint64(binary.BigEndian.Uint32(b[i:]))
+				i += 4
+			}
+			opt.SubflowSeq = binary.BigEndian.Uint32(b[i:])
+			opt.DataLen = binary.BigEndian.Uint16(b[i+4:])
+			opt.HasMapping = true
+		}
+
+	default:
+		// Other subtypes are ignored.
+		return MPTCPOption{}, true
+	}
+	return opt, true
+}
+
+// EncodeMPTCPCapableOption encodes an MP_CAPABLE option carrying senderKey in
+// the provided buffer, along with receiverKey if ack is true, for the ACK that
+// completes the handshake. If the buffer is smaller than required it just
+// returns without encoding anything. It returns the number of bytes written to
+// the provided buffer.
+func EncodeMPTCPCapableOption(senderKey, receiverKey uint64, ack bool, b []byte) int {
+	size := mptcpCapableSynSize
+	if ack {
+		size = mptcpCapableAckSize
+	}
+	if len(b) < size {
+		return 0
+	}
+
+	b[0], b[1] = TCPOptionMPTCP, byte(size)
+	b[2] = MPTCPSubtypeCapable<<4 | MPTCPVersion
+	b[3] = MPTCPCapableFlagHMACSHA1
+	binary.BigEndian.PutUint64(b[4:], senderKey)
+	if ack {
+		binary.BigEndian.PutUint64(b[12:], receiverKey)
+	}
+	return size
+}
+
+// EncodeMPTCPJoinSynOption encodes the MP_JOIN option of a SYN in the provided
+// buffer. If the buffer is smaller than required it just returns without
+// encoding anything. It returns the number of bytes written to the provided
+// buffer.
+func EncodeMPTCPJoinSynOption(token, nonce uint32, addressID uint8, b []byte) int {
+	if len(b) < mptcpJoinSynSize {
+		return 0
+	}
+
+	b[0], b[1] = TCPOptionMPTCP, mptcpJoinSynSize
+	b[2], b[3] = MPTCPSubtypeJoin<<4, addressID
+	binary.BigEndian.PutUint32(b[4:], token)
+	binary.BigEndian.PutUint32(b[8:], nonce)
+	return mptcpJoinSynSize
+}
+
+// EncodeMPTCPJoinSynAckOption encodes the MP_JOIN option of a SYN-ACK in the
+// provided buffer, with the first MPTCPJoinTruncatedHMACSize bytes of hmac. If
+// the buffer is smaller than required it just returns without encoding
+// anything. It returns the number of bytes written to the provided buffer.
+func EncodeMPTCPJoinSynAckOption(hmac []byte, nonce uint32, addressID uint8, b []byte) int {
+	if len(b) < mptcpJoinSynAckSize {
+		return 0
+	}
+
+	b[0], b[1] = TCPOptionMPTCP, mptcpJoinSynAckSize
+	b[2], b[3] = MPTCPSubtypeJoin<<4, addressID
+	copy(b[4:4+MPTCPJoinTruncatedHMACSize], hmac)
+	binary.BigEndian.PutUint32(b[12:], nonce)
+	return mptcpJoinSynAckSize
+}
+
+// EncodeMPTCPJoinAckOption encodes the MP_JOIN option of the ACK that completes
+// the handshake in the provided buffer. If the buffer is smaller than required
+// it just returns without encoding anything. It returns the number of bytes
+// written to the provided buffer.
+func EncodeMPTCPJoinAckOption(hmac []byte, b []byte) int {
+	if len(b) < mptcpJoinAckSize {
+		return 0
+	}
+
+	b[0], b[1] = TCPOptionMPTCP, mptcpJoinAckSize
+	b[2], b[3] = MPTCPSubtypeJoin<<4, 0
+	copy(b[4:4+MPTCPJoinHMACSize], hmac)
+	return mptcpJoinAckSize
+}
+
+// EncodeMPTCPDSSOption encodes a DSS option carrying the data acknowledgement
+// dataAck in the provided buffer, along with a mapping of dataLen bytes from
+// the relative subflow sequence number subflowSeq to the data sequence number
+// dataSeq if mapping is true. Data sequence numbers are encoded on 8 bytes, and
+// no checksum is included. If the buffer is smaller than required it just
+// returns without encoding anything. It returns the number of bytes written to
+// the provided buffer.
+func EncodeMPTCPDSSOption(dataAck uint64, mapping bool, dataSeq uint64, subflowSeq uint32, dataLen uint16, b []byte) int {
+	size := mptcpDSSMinimumSize + 8
+	if mapping {
+		size = MPTCPDSSMappingSize
+	}
+	if len(b) < size {
+		return 0
+	}
+
+	b[0], b[1] = TCPOptionMPTCP, byte(size)
+	b[2], b[3] = MPTCPSubtypeDSS<<4, mptcpDSSDataAck|mptcpDSSDataAck8
+	binary.BigEndian.PutUint64(b[4:], dataAck)
+	if mapping {
+		b[3] |= mptcpDSSMapping | mptcpDSSMapping8
+		binary.BigEndian.PutUint64(b[12:], dataSeq)
+		binary.BigEndian.PutUint32(b[20:], subflowSeq)
+		binary.BigEndian.PutUint16(b[24:], dataLen)
+	}
+	return size
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package header
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+const (
+	// NDPRouterAdvertMinimumSize is the minimum size of the body of a
+	// router advertisement, the part that follows the ICMPv6 header.
+	NDPRouterAdvertMinimumSize = 12
+
+	// NDPPrefixInformationType is the type of the prefix information
+	// option.
+	NDPPrefixInformationType = 3
+
+	// NDPPrefixInformationSize is the size of the prefix information
+	// option, including its type and length fields.
+	NDPPrefixInformationSize = 32
+
+	// NDPInfiniteLifetime is the lifetime that NDP messages encode as all
+	// ones, which never expires.
+	NDPInfiniteLifetime = time.Duration(math.MaxInt64)
+
+	ndpRACurrHopLimit   = 0
+	ndpRARouterLifetime = 2
+	ndpRAOptions        = 12
+
+	ndpPIPrefixLength      = 2
+	ndpPIFlags             = 3
+	ndpPIValidLifetime     = 4
+	ndpPIPreferredLifetime = 8
+	ndpPIPrefix            = 16
+
+	ndpPIOnLinkFlag     = 0x80
+	ndpPIAutonomousFlag = 0x40
+)
+
+// NDPRouterAdvert represents the body of a router advertisement, the part of
+// the ICMPv6 message that follows the ICMPv6 header, stored in a byte array.
+// See RFC 4861 section 4.2.
+type NDPRouterAdvert []byte
+
+// CurrHopLimit returns the "cur hop limit" field of the router advertisement.
+func (b NDPRouterAdvert) CurrHopLimit() uint8 {
+	return b[ndpRACurrHopLimit]
+}
+
+// RouterLifetime returns the "router lifetime" field of the router
+// advertisement.
+func (b NDPRouterAdvert) RouterLifetime() time.Duration {
+	return time.Duration(binary.BigEndian.Uint16(b[ndpRARouterLifetime:])) * time.Second
+}
+
+// Options returns the options of the router advertisement.
+func (b NDPRouterAdvert) Options() NDPOptions {
+	return NDPOptions(b[ndpRAOptions:])
+}
+
+// NDPOptions represents the options of an NDP message stored in a byte array.
+type NDPOptions []byte
+
+// PrefixInformation returns the prefix information options found in b. It
+// returns false if the options are malformed.
+func (b NDPOptions) PrefixInformation() ([]NDPPrefixInformation, bool) {
+	var pis []NDPPrefixInformation
+	for len(b) > 0 {
+		// The length is in units of 8 bytes, and is never zero.
+		if len(b) < 2 || b[1] == 0 || len(b) < int(b[1])*8 {
+			return nil, false
+		}
+		opt := b[:int(b[1])*8]
+		b = b[len(opt):]
+
+		if opt[0] != NDPPrefixInformationType {
+			continue
+		}
+		if len(opt) != NDPPrefixInformationSize {
+			return nil, false
+		}
+		pis = append(pis, NDPPrefixInformation(opt))
+	}
+	return pis, true
+}
+
+// NDPPrefixInformationFields contains the fields of a prefix information
+// option. It is used to describe the fields of an option that needs to be
+// encoded.
+type NDPPrefixInformationFields struct {
+	// PrefixLength is the number of leading bits of Prefix that are valid.
+	PrefixLength uint8
+
+	// OnLink is the on-link flag, set if the prefix can be used for
+	// on-link determination.
+	OnLink bool
+
+	// Autonomous is the autonomous address-configuration flag, set if the
+	// prefix can be used for stateless address autoconfiguration.
+	Autonomous bool
+
+	// ValidLifetime and PreferredLifetime are the times the prefix remains
+	// valid and preferred for. They're truncated to seconds, and
+	// NDPInfiniteLifetime never expires.
+	ValidLifetime     time.Duration
+	PreferredLifetime time.Duration
+
+	// Prefix is the advertised prefix.
+	Prefix tcpip.Address
+}
+
+// NDPPrefixInformation represents a prefix information option stored in a byte
+// array, including its type and length fields. See RFC 4861 section 4.6.2.
+type NDPPrefixInformation []byte
+
+// PrefixLength returns the "prefix length" field of the option.
+func (b NDPPrefixInformation) PrefixLength() uint8 {
+	return b[ndpPIPrefixLength]
+}
+
+// OnLinkFlag returns the value of the on-link flag of the option.
+func (b NDPPrefixInformation) OnLinkFlag() bool {
+	return b[ndpPIFlags]&ndpPIOnLinkFlag != 0
+}
+
+// AutonomousAddressConfigurationFlag returns the value of the autonomous
+// address-configuration flag of the option.
+func (b NDPPrefixInformation) AutonomousAddressConfigurationFlag() bool {
+	return b[ndpPIFlags]&ndpPIAutonomousFlag != 0
+}
+
+// ValidLifetime returns the "valid lifetime" field of the option.
+func (b NDPPrefixInformation) ValidLifetime() time.Duration {
+	return ndpLifetime(b[ndpPIValidLifetime:])
+}
+
+// PreferredLifetime returns the "preferred lifetime" field of the option.
+func (b NDPPrefixInformation) PreferredLifetime() time.Duration {
+	return ndpLifetime(b[ndpPIPreferredLifetime:])
+}
+
+// Prefix returns the "prefix" field of the option.
+func (b NDPPrefixInformation) Prefix() tcpip.Address {
+	return tcpip.Address(b[ndpPIPrefix:][:IPv6AddressSize])
+}
+
+// Subnet returns the subnet made of the prefix of the option and its length,
+// or false if the length is invalid.
+func (b NDPPrefixInformation) Subnet() (tcpip.Subnet, bool) {
+	sn, err := tcpip.NewSubnetFromPrefix(b.Prefix(), int(b.PrefixLength()))
+	return sn, err == nil
+}
+
+// Encode encodes all the fields of the option, including its type and length.
+func (b NDPPrefixInformation) Encode(f *NDPPrefixInformationFields) {
+	b[0] = NDPPrefixInformationType
+	b[1] = NDPPrefixInformationSize / 8
+	b[ndpPIPrefixLength] = f.PrefixLength
+	b[ndpPIFlags] = 0
+	if f.OnLink {
+		b[ndpPIFlags] |= ndpPIOnLinkFlag
+	}
+	if f.Autonomous {
+		b[ndpPIFlags] |= ndpPIAutonomousFlag
+	}
+	putNDPLifetime(b[ndpPIValidLifetime:], f.ValidLifetime)
+	putNDPLifetime(b[ndpPIPreferredLifetime:], f.PreferredLifetime)
+	for i := ndpPIPreferredLifetime + 4; i < ndpPIPrefix; i++ {
+		b[i] = 0
+	}
+	copy(b[ndpPIPrefix:][:IPv6AddressSize], f.Prefix)
+}
+
+// ndpLifetime decodes the lifetime in seconds stored in b.
+func ndpLifetime(b []byte) time.Duration {
+	s := binary.BigEndian.Uint32(b)
+	if s == math.MaxUint32 {
+		return NDPInfiniteLifetime
+	}
+	return time.Duration(s) * time.Second
+}
+
+// putNDPLifetime encodes d in seconds into b.
+func putNDPLifetime(b []byte, d time.Duration) {
+	s := d / time.Second
+	if s >= math.MaxUint32 {
+		s = math.MaxUint32
+	}
+	binary.BigEndian.PutUint32(b, uint32(s))
+}
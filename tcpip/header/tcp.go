@@ -52,6 +52,8 @@ const (
 	TCPOptionTS            = 8
 	TCPOptionSACKPermitted = 4
 	TCPOptionSACK          = 5
+	TCPOptionMD5           = 19
+	TCPOptionMPTCP         = 30
 )
 
 // TCPFields contains the fields of a TCP packet. It is used to describe the
@@ -107,6 +109,10 @@ type TCPSynOptions struct {
 
 	// SACKPermitted is true if the SACK option was provided in the SYN/SYN-ACK.
 	SACKPermitted bool
+
+	// MPTCP is the Multipath TCP option provided in the SYN/SYN-ACK, if
+	// any.
+	MPTCP MPTCPOption
 }
 
 // SACKBlock represents a single contiguous SACK block.
@@ -133,6 +139,9 @@ type TCPOptions struct {
 
 	// SACKBlocks are the SACK blocks specified in the segment.
 	SACKBlocks []SACKBlock
+
+	// MPTCP is the Multipath TCP option of the segment, if any.
+	MPTCP MPTCPOption
 }
 
 // TCP represents a TCP header stored in a byte array.
@@ -142,6 +151,10 @@ const (
 	// TCPMinimumSize is the minimum size of a valid TCP packet.
 	TCPMinimumSize = 20
 
+	// TCPChecksumOffset is the offset of the checksum field in a TCP
+	// header.
+	TCPChecksumOffset = tcpChecksum
+
 	// TCPProtocolNumber is TCP's transport protocol number.
 	TCPProtocolNumber tcpip.TransportProtocolNumber = 6
 )
@@ -336,6 +349,23 @@ func ParseSynOptions(opts []byte, isAck bool) TCPSynOptions {
 			synOpts.SACKPermitted = true
 			i += 2
 
+		case TCPOptionMPTCP:
+			if i+2 > limit {
+				return synOpts
+			}
+			l := int(opts[i+1])
+			if l < 2 || i+l > limit {
+				return synOpts
+			}
+			mp, ok := parseMPTCPOption(opts[i : i+l])
+			if !ok {
+				return synOpts
+			}
+			if mp.Present {
+				synOpts.MPTCP = mp
+			}
+			i += l
+
 		default:
 			// We don't recognize this option, just skip over it.
 			if i+2 > limit {
@@ -357,7 +387,17 @@ func ParseSynOptions(opts []byte, isAck bool) TCPSynOptions {
 // ParseTCPOptions extracts and stores all known options in the provided byte
 // slice in a TCPOptions structure.
 func ParseTCPOptions(b []byte) TCPOptions {
-	opts := TCPOptions{}
+	var opts TCPOptions
+	ParseTCPOptionsInto(b, &opts)
+	return opts
+}
+
+// ParseTCPOptionsInto is like ParseTCPOptions, but stores the options in opts.
+// The SACK blocks are appended to opts.SACKBlocks truncated, so that callers
+// that provide the room for them can parse options without allocating.
+func ParseTCPOptionsInto(b []byte, opts *TCPOptions) {
+	blocks := opts.SACKBlocks[:0]
+	*opts = TCPOptions{}
 	limit := len(b)
 	for i := 0; i < limit; {
 		switch b[i] {
@@ -367,7 +407,7 @@ func ParseTCPOptions(b []byte) TCPOptions {
 			i++
 		case TCPOptionTS:
 			if i+10 > limit || (b[i+1] != 10) {
-				return opts
+				return
 			}
 			opts.TS = true
 			opts.TSVal = binary.BigEndian.Uint32(b[i+2:])
@@ -376,15 +416,18 @@ func ParseTCPOptions(b []byte) TCPOptions {
 		case TCPOptionSACK:
 			if i+2 > limit {
 				// Malformed SACK block, just return and stop parsing.
-				return opts
+				return
 			}
 			sackOptionLen := int(b[i+1])
 			if i+sackOptionLen > limit || (sackOptionLen-2)%8 != 0 {
 				// Malformed SACK block, just return and stop parsing.
-				return opts
+				return
 			}
 			numBlocks := (sackOptionLen - 2) / 8
-			opts.SACKBlocks = []SACKBlock{}
+			opts.SACKBlocks = blocks
+			if opts.SACKBlocks == nil {
+				opts.SACKBlocks = []SACKBlock{}
+			}
 			for j := 0; j < numBlocks; j++ {
 				start := binary.BigEndian.Uint32(b[i+2+j*8:])
 				end := binary.BigEndian.Uint32(b[i+2+j*8+4:])
@@ -394,21 +437,37 @@ func ParseTCPOptions(b []byte) TCPOptions {
 				})
 			}
 			i += sackOptionLen
+		case TCPOptionMPTCP:
+			if i+2 > limit {
+				return
+			}
+			l := int(b[i+1])
+			if l < 2 || i+l > limit {
+				return
+			}
+			mp, ok := parseMPTCPOption(b[i : i+l])
+			if !ok {
+				// Malformed option, just return and stop parsing.
+				return
+			}
+			if mp.Present {
+				opts.MPTCP = mp
+			}
+			i += l
 		default:
 			// We don't recognize this option, just skip over it.
 			if i+2 > limit {
-				return opts
+				return
 			}
 			l := int(b[i+1])
 			// If the length is incorrect or if l+i overflows the
 			// total options length then return false.
 			if l < 2 || i+l > limit {
-				return opts
+				return
 			}
 			i += l
 		}
 	}
-	return opts
 }
 
 // EncodeMSSOption encodes the MSS TCP option with the provided MSS values in
@@ -494,6 +553,56 @@ func EncodeSACKBlocks(sackBlocks []SACKBlock, b []byte) int {
 	return int(b[1])
 }
 
+// TCPMD5DigestSize is the size of the digest carried by the MD5 signature
+// option.
+const TCPMD5DigestSize = 16
+
+// EncodeMD5Option encodes an MD5 signature option with a zero digest into the
+// provided buffer; the digest is filled in once the segment is complete. If
+// the buffer is smaller than required it just returns without encoding
+// anything. It returns the number of bytes written to the provided buffer.
+func EncodeMD5Option(b []byte) int {
+	if len(b) < 2+TCPMD5DigestSize {
+		return 0
+	}
+
+	b[0], b[1] = TCPOptionMD5, 2+TCPMD5DigestSize
+	for i := 2; i < 2+TCPMD5DigestSize; i++ {
+		b[i] = 0
+	}
+	return int(b[1])
+}
+
+// FindMD5Option returns the digest of the MD5 signature option in the provided
+// options, or nil if there is none. The returned slice aliases b.
+func FindMD5Option(b []byte) []byte {
+	limit := len(b)
+	for i := 0; i < limit; {
+		switch b[i] {
+		case TCPOptionEOL:
+			return nil
+		case TCPOptionNOP:
+			i++
+		default:
+			if i+2 > limit {
+				return nil
+			}
+			l := int(b[i+1])
+			if l < 2 || i+l > limit {
+				return nil
+			}
+			if b[i] == TCPOptionMD5 {
+				if l != 2+TCPMD5DigestSize {
+					return nil
+				}
+				return b[i+2 : i+l]
+			}
+			i += l
+		}
+	}
+	return nil
+}
+
 // EncodeNOP adds an explicit NOP to the option list.
 func EncodeNOP(b []byte) int {
 	if len(b) == 0 {
@@ -87,48 +87,48 @@ func TestTCPParseOptions(t *testing.T) {
 		want header.TCPOptions
 	}{
 		// Trivial cases.
-		{nil, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionNOP}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionNOP, header.TCPOptionNOP}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionEOL}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionNOP, header.TCPOptionEOL, header.TCPOptionTS, 10, 1, 1}, header.TCPOptions{false, 0, 0, nil}},
+		{nil, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionNOP}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionNOP, header.TCPOptionNOP}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionEOL}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionNOP, header.TCPOptionEOL, header.TCPOptionTS, 10, 1, 1}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
 
 		// Test timestamp parsing.
-		{[]byte{header.TCPOptionNOP, header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{true, 1, 1, nil}},
-		{[]byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{true, 1, 1, nil}},
+		{[]byte{header.TCPOptionNOP, header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{true, 1, 1, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{true, 1, 1, nil, header.MPTCPOption{}}},
 
 		// Test malformed timestamp option.
-		{[]byte{header.TCPOptionTS, 8, 1, 1}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionNOP, header.TCPOptionTS, 8, 1, 1}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionNOP, header.TCPOptionTS, 8, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{false, 0, 0, nil}},
+		{[]byte{header.TCPOptionTS, 8, 1, 1}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionNOP, header.TCPOptionTS, 8, 1, 1}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionNOP, header.TCPOptionTS, 8, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
 
 		// Test SACKBlock parsing.
-		{[]byte{header.TCPOptionSACK, 10, 0, 0, 0, 1, 0, 0, 0, 10}, header.TCPOptions{false, 0, 0, []header.SACKBlock{{1, 10}}}},
-		{[]byte{header.TCPOptionSACK, 18, 0, 0, 0, 1, 0, 0, 0, 10, 0, 0, 0, 11, 0, 0, 0, 12}, header.TCPOptions{false, 0, 0, []header.SACKBlock{{1, 10}, {11, 12}}}},
+		{[]byte{header.TCPOptionSACK, 10, 0, 0, 0, 1, 0, 0, 0, 10}, header.TCPOptions{false, 0, 0, []header.SACKBlock{{1, 10}}, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK, 18, 0, 0, 0, 1, 0, 0, 0, 10, 0, 0, 0, 11, 0, 0, 0, 12}, header.TCPOptions{false, 0, 0, []header.SACKBlock{{1, 10}, {11, 12}}, header.MPTCPOption{}}},
 
 		// Test malformed SACK option.
-		{[]byte{header.TCPOptionSACK, 0}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionSACK, 8, 0, 0, 0, 1, 0, 0, 0, 10}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionSACK, 11, 0, 0, 0, 1, 0, 0, 0, 10, 0, 0, 0, 11, 0, 0, 0, 12}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionSACK, 17, 0, 0, 0, 1, 0, 0, 0, 10, 0, 0, 0, 11, 0, 0, 0, 12}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionSACK}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionSACK, 10}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionSACK, 10, 0, 0, 0, 1, 0, 0, 0}, header.TCPOptions{false, 0, 0, nil}},
+		{[]byte{header.TCPOptionSACK, 0}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK, 8, 0, 0, 0, 1, 0, 0, 0, 10}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK, 11, 0, 0, 0, 1, 0, 0, 0, 10, 0, 0, 0, 11, 0, 0, 0, 12}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK, 17, 0, 0, 0, 1, 0, 0, 0, 10, 0, 0, 0, 11, 0, 0, 0, 12}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK, 10}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK, 10, 0, 0, 0, 1, 0, 0, 0}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
 
 		// Test Timestamp + SACK block parsing.
-		{generateOptions(&tsOption{1, 1}, []header.SACKBlock{{1, 10}, {11, 12}}), header.TCPOptions{true, 1, 1, []header.SACKBlock{{1, 10}, {11, 12}}}},
-		{generateOptions(&tsOption{1, 2}, []header.SACKBlock{{1, 10}, {11, 12}}), header.TCPOptions{true, 1, 2, []header.SACKBlock{{1, 10}, {11, 12}}}},
-		{generateOptions(&tsOption{1, 3}, []header.SACKBlock{{1, 10}, {11, 12}, {13, 14}, {14, 15}, {15, 16}}), header.TCPOptions{true, 1, 3, []header.SACKBlock{{1, 10}, {11, 12}, {13, 14}, {14, 15}}}},
+		{generateOptions(&tsOption{1, 1}, []header.SACKBlock{{1, 10}, {11, 12}}), header.TCPOptions{true, 1, 1, []header.SACKBlock{{1, 10}, {11, 12}}, header.MPTCPOption{}}},
+		{generateOptions(&tsOption{1, 2}, []header.SACKBlock{{1, 10}, {11, 12}}), header.TCPOptions{true, 1, 2, []header.SACKBlock{{1, 10}, {11, 12}}, header.MPTCPOption{}}},
+		{generateOptions(&tsOption{1, 3}, []header.SACKBlock{{1, 10}, {11, 12}, {13, 14}, {14, 15}, {15, 16}}), header.TCPOptions{true, 1, 3, []header.SACKBlock{{1, 10}, {11, 12}, {13, 14}, {14, 15}}, header.MPTCPOption{}}},
 
 		// Test valid timestamp + malformed SACK block parsing.
-		{[]byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1, header.TCPOptionSACK}, header.TCPOptions{true, 1, 1, nil}},
-		{[]byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1, header.TCPOptionSACK, 10}, header.TCPOptions{true, 1, 1, nil}},
-		{[]byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1, header.TCPOptionSACK, 10, 0, 0, 0}, header.TCPOptions{true, 1, 1, nil}},
-		{[]byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1, header.TCPOptionSACK, 11, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{true, 1, 1, nil}},
-		{[]byte{header.TCPOptionSACK, header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{false, 0, 0, nil}},
-		{[]byte{header.TCPOptionSACK, 10, header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{false, 0, 0, []header.SACKBlock{{134873088, 65536}}}},
-		{[]byte{header.TCPOptionSACK, 10, 0, 0, 0, header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{false, 0, 0, []header.SACKBlock{{8, 167772160}}}},
-		{[]byte{header.TCPOptionSACK, 11, 0, 0, 0, 1, 0, 0, 0, 1, header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{false, 0, 0, nil}},
+		{[]byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1, header.TCPOptionSACK}, header.TCPOptions{true, 1, 1, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1, header.TCPOptionSACK, 10}, header.TCPOptions{true, 1, 1, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1, header.TCPOptionSACK, 10, 0, 0, 0}, header.TCPOptions{true, 1, 1, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1, header.TCPOptionSACK, 11, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{true, 1, 1, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK, header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK, 10, header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{false, 0, 0, []header.SACKBlock{{134873088, 65536}}, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK, 10, 0, 0, 0, header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{false, 0, 0, []header.SACKBlock{{8, 167772160}}, header.MPTCPOption{}}},
+		{[]byte{header.TCPOptionSACK, 11, 0, 0, 0, 1, 0, 0, 0, 1, header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}, header.TCPOptions{false, 0, 0, nil, header.MPTCPOption{}}},
 	}
 	for _, tc := range testCases {
 		if got, want := header.ParseTCPOptions(tc.b), tc.want; !reflect.DeepEqual(got, want) {
@@ -136,3 +136,157 @@ func TestTCPParseOptions(t *testing.T) {
 		}
 	}
 }
+
+func TestParseTCPOptionsInto(t *testing.T) {
+	b := []byte{
+		header.TCPOptionNOP, header.TCPOptionNOP,
+		header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 2,
+		header.TCPOptionNOP, header.TCPOptionNOP,
+		header.TCPOptionSACK, 18, 0, 0, 0, 1, 0, 0, 0, 10, 0, 0, 0, 11, 0, 0, 0, 12,
+	}
+	want := header.TCPOptions{TS: true, TSVal: 1, TSEcr: 2, SACKBlocks: []header.SACKBlock{{1, 10}, {11, 12}}}
+
+	var blocks [header.TCPMaxSACKBlocks]header.SACKBlock
+	opts := header.TCPOptions{TS: true, TSVal: 3, SACKBlocks: blocks[:1]}
+	parse := func() {
+		opts.SACKBlocks = blocks[:0]
+		header.ParseTCPOptionsInto(b, &opts)
+	}
+	if allocs := testing.AllocsPerRun(100, parse); allocs != 0 {
+		t.Errorf("got %.1f allocations per parse, want 0", allocs)
+	}
+	if !reflect.DeepEqual(opts, want) {
+		t.Errorf("got ParseTCPOptionsInto(%v) = %+v, want %+v", b, opts, want)
+	}
+	if &opts.SACKBlocks[0] != &blocks[0] {
+		t.Errorf("ParseTCPOptionsInto didn't store the SACK blocks in the room provided")
+	}
+
+	// Options previously parsed are cleared.
+	header.ParseTCPOptionsInto(nil, &opts)
+	if opts.TS || len(opts.SACKBlocks) != 0 {
+		t.Errorf("got ParseTCPOptionsInto(nil) = %+v, want no options", opts)
+	}
+}
+
+func TestFindMD5Option(t *testing.T) {
+	md5 := make([]byte, 2+header.TCPMD5DigestSize)
+	if n := header.EncodeMD5Option(md5); n != len(md5) {
+		t.Fatalf("EncodeMD5Option wrote %d bytes, want %d", n, len(md5))
+	}
+	md5[2], md5[len(md5)-1] = 1, 2
+
+	ts := []byte{header.TCPOptionTS, 10, 0, 0, 0, 1, 0, 0, 0, 1}
+	testCases := []struct {
+		b     []byte
+		found bool
+	}{
+		{nil, false},
+		{ts, false},
+		{md5, true},
+		{append([]byte{header.TCPOptionNOP, header.TCPOptionNOP}, md5...), true},
+		{append(append([]byte{}, ts...), md5...), true},
+
+		// Options after EOL are ignored.
+		{append([]byte{header.TCPOptionEOL}, md5...), false},
+
+		// Malformed options.
+		{md5[:len(md5)-1], false},
+		{[]byte{header.TCPOptionMD5, 10, 0, 0, 0, 0, 0, 0, 0, 0}, false},
+		{append([]byte{header.TCPOptionTS, 1}, md5...), false},
+	}
+	for _, tc := range testCases {
+		d := header.FindMD5Option(tc.b)
+		if !tc.found {
+			if d != nil {
+				t.Errorf("FindMD5Option(%v) = %v, want nil", tc.b, d)
+			}
+			continue
+		}
+		if len(d) != header.TCPMD5DigestSize || d[0] != 1 || d[len(d)-1] != 2 {
+			t.Errorf("FindMD5Option(%v) = %v, want %v", tc.b, d, md5[2:])
+		}
+	}
+}
+
+func TestMPTCPOptions(t *testing.T) {
+	hmac := make([]byte, header.MPTCPJoinHMACSize)
+	for i := range hmac {
+		hmac[i] = byte(i + 1)
+	}
+
+	testCases := []struct {
+		name   string
+		encode func([]byte) int
+		size   int
+		want   header.MPTCPOption
+	}{
+		{
+			name:   "MP_CAPABLE SYN",
+			encode: func(b []byte) int { return header.EncodeMPTCPCapableOption(1, 0, false, b) },
+			size:   12,
+			want:   header.MPTCPOption{Present: true, Subtype: header.MPTCPSubtypeCapable, SenderKey: 1},
+		},
+		{
+			name:   "MP_CAPABLE ACK",
+			encode: func(b []byte) int { return header.EncodeMPTCPCapableOption(1, 2, true, b) },
+			size:   20,
+			want:   header.MPTCPOption{Present: true, Subtype: header.MPTCPSubtypeCapable, SenderKey: 1, ReceiverKey: 2, HasReceiverKey: true},
+		},
+		{
+			name:   "MP_JOIN SYN",
+			encode: func(b []byte) int { return header.EncodeMPTCPJoinSynOption(3, 4, 5, b) },
+			size:   12,
+			want:   header.MPTCPOption{Present: true, Subtype: header.MPTCPSubtypeJoin, Token: 3, Nonce: 4, AddressID: 5},
+		},
+		{
+			name:   "MP_JOIN SYN-ACK",
+			encode: func(b []byte) int { return header.EncodeMPTCPJoinSynAckOption(hmac, 4, 5, b) },
+			size:   16,
+			want:   header.MPTCPOption{Present: true, Subtype: header.MPTCPSubtypeJoin, Nonce: 4, AddressID: 5, HMAC: hmac[:header.MPTCPJoinTruncatedHMACSize]},
+		},
+		{
+			name:   "MP_JOIN ACK",
+			encode: func(b []byte) int { return header.EncodeMPTCPJoinAckOption(hmac, b) },
+			size:   24,
+			want:   header.MPTCPOption{Present: true, Subtype: header.MPTCPSubtypeJoin, HMAC: hmac},
+		},
+		{
+			name:   "DSS",
+			encode: func(b []byte) int { return header.EncodeMPTCPDSSOption(6, true, 1<<40, 7, 8, b) },
+			size:   header.MPTCPDSSMappingSize,
+			want:   header.MPTCPOption{Present: true, Subtype: header.MPTCPSubtypeDSS, DataAck: 6, HasDataAck: true, DataSeq: 1 << 40, SubflowSeq: 7, DataLen: 8, HasMapping: true},
+		},
+		{
+			name:   "DSS without mapping",
+			encode: func(b []byte) int { return header.EncodeMPTCPDSSOption(6, false, 0, 0, 0, b) },
+			size:   12,
+			want:   header.MPTCPOption{Present: true, Subtype: header.MPTCPSubtypeDSS, DataAck: 6, HasDataAck: true},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if n := tc.encode(make([]byte, tc.size-1)); n != 0 {
+				t.Errorf("encoded %d bytes in a buffer too small for the option", n)
+			}
+
+			b := make([]byte, 40)
+			n := tc.encode(b)
+			if n != tc.size {
+				t.Fatalf("encoded %d bytes, want %d", n, tc.size)
+			}
+			if got := header.ParseTCPOptions(b[:n]).MPTCP; !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseTCPOptions(%v).MPTCP = %+v, want %+v", b[:n], got, tc.want)
+			}
+			if got := header.ParseSynOptions(b[:n], true).MPTCP; !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseSynOptions(%v, true).MPTCP = %+v, want %+v", b[:n], got, tc.want)
+			}
+
+			// Truncated options are ignored.
+			b[1]--
+			if got := header.ParseTCPOptions(b[:n-1]).MPTCP; got.Present {
+				t.Errorf("ParseTCPOptions(%v).MPTCP = %+v, want no option", b[:n-1], got)
+			}
+		})
+	}
+}
@@ -40,6 +40,10 @@ const (
 	// UDPMinimumSize is the minimum size of a valid UDP packet.
 	UDPMinimumSize = 8
 
+	// UDPChecksumOffset is the offset of the checksum field in a UDP
+	// header.
+	UDPChecksumOffset = udpChecksum
+
 	// UDPProtocolNumber is UDP's transport protocol number.
 	UDPProtocolNumber tcpip.TransportProtocolNumber = 17
 )
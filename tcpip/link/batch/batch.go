@@ -0,0 +1,243 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package batch provides the implementation of data-link layer endpoints that
+// wrap other endpoints and queue outbound packets so that they can be written
+// to the lower endpoint in batches.
+//
+// Queued packets are flushed when Flush is called, when the number of queued
+// packets reaches the batch size, or when the first queued packet has been
+// waiting for longer than the flush timeout.
+//
+// Batching endpoints can be used in the networking stack by calling New(eID,
+// opts) to create a new endpoint, where eID is the ID of the endpoint being
+// wrapped, and then passing it as an argument to Stack.CreateNIC().
+package batch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// DefaultBatchSize is the number of queued packets that triggers a flush when
+// no batch size is specified.
+const DefaultBatchSize = 32
+
+// Packet is an outbound packet queued by a batching endpoint.
+type Packet struct {
+	Route    stack.Route
+	Checksum *stack.PartialChecksum
+	Header   buffer.Prependable
+	Payload  buffer.View
+	Protocol tcpip.NetworkProtocolNumber
+}
+
+// PacketsWriter is implemented by link-layer endpoints that can write several
+// packets at once, such as fdbased endpoints, which use sendmmsg. Batching
+// endpoints use it when the lower endpoint implements it, and otherwise fall
+// back to calling WritePacket for each packet.
+type PacketsWriter interface {
+	// WritePackets writes the given packets in order. Their headers and
+	// routes are only borrowed for the duration of the call, as by
+	// stack.LinkEndpoint.WritePacket.
+	WritePackets(pkts []Packet) *tcpip.Error
+}
+
+// Options specify the details of a batching endpoint.
+type Options struct {
+	// BatchSize is the number of queued packets that triggers a flush. If
+	// zero, DefaultBatchSize is used.
+	BatchSize int
+
+	// FlushTimeout is the maximum amount of time a packet is kept queued
+	// before being flushed. If zero, packets are only flushed when Flush is
+	// called or the batch is full.
+	FlushTimeout time.Duration
+}
+
+// Endpoint is a batching link-layer endpoint.
+type Endpoint struct {
+	dispatcher   stack.NetworkDispatcher
+	lower        stack.LinkEndpoint
+	batchSize    int
+	flushTimeout time.Duration
+
+	// flushMu serializes flushes so that packets reach the lower endpoint
+	// in the order they were queued.
+	flushMu sync.Mutex
+
+	// mu protects the fields below.
+	mu    sync.Mutex
+	queue []Packet
+	timer *time.Timer
+}
+
+// New creates a new batching link-layer endpoint. It wraps around another
+// endpoint and queues outbound packets until they are flushed.
+func New(lower tcpip.LinkEndpointID, opts Options) (tcpip.LinkEndpointID, *Endpoint) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	e := &Endpoint{
+		lower:        stack.FindLinkEndpoint(lower),
+		batchSize:    opts.BatchSize,
+		flushTimeout: opts.FlushTimeout,
+	}
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.DeliverNetworkPacket.
+// Inbound packets are not batched, they are just forwarded to the actual
+// dispatcher.
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
+	e.dispatcher.DeliverNetworkPacket(e, remoteLinkAddr, protocol, vv, checksumValidated)
+}
+
+// Attach implements stack.LinkEndpoint.Attach. It saves the dispatcher and
+// registers with the lower endpoint as its dispatcher so that "e" is called
+// for inbound packets.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// lower endpoint.
+func (e *Endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. It just
+// forwards the request to the lower endpoint.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.lower.LinkAddress()
+}
+
+// SetLinkAddress implements stack.LinkAddressSetter.SetLinkAddress. It just
+// forwards the request to the lower endpoint.
+func (e *Endpoint) SetLinkAddress(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.LinkAddressSetter); ok {
+		return ep.SetLinkAddress(addr)
+	}
+	return tcpip.ErrNotSupported
+}
+
+// AddMulticastFilter implements stack.MulticastLinkEndpoint.AddMulticastFilter.
+// It just forwards the request to the lower endpoint, if it filters multicast
+// frames.
+func (e *Endpoint) AddMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.MulticastLinkEndpoint); ok {
+		return ep.AddMulticastFilter(addr)
+	}
+	return nil
+}
+
+// RemoveMulticastFilter implements
+// stack.MulticastLinkEndpoint.RemoveMulticastFilter. It just forwards the
+// request to the lower endpoint, if it filters multicast frames.
+func (e *Endpoint) RemoveMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.MulticastLinkEndpoint); ok {
+		return ep.RemoveMulticastFilter(addr)
+	}
+	return nil
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. It queues the packet
+// and only writes the queued packets to the lower endpoint once the batch is
+// full; errors from the lower endpoint are only reported then.
+func (e *Endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	p := Packet{
+		Checksum: csum,
+		Header:   *hdr,
+		Payload:  payload,
+		Protocol: protocol,
+	}
+	if r != nil {
+		// The caller may release its route as soon as this returns.
+		p.Route = r.Clone()
+	}
+
+	// Keep the headers and route until the packet is flushed.
+	if b := hdr.Buffer(); b != nil {
+		b.IncRef()
+	}
+
+	e.mu.Lock()
+	e.queue = append(e.queue, p)
+	full := len(e.queue) >= e.batchSize
+	if !full && e.timer == nil && e.flushTimeout > 0 {
+		e.timer = time.AfterFunc(e.flushTimeout, func() {
+			e.Flush()
+		})
+	}
+	e.mu.Unlock()
+
+	if full {
+		return e.Flush()
+	}
+	return nil
+}
+
+// Flush writes all queued packets to the lower endpoint, in the order in which
+// they were queued.
+func (e *Endpoint) Flush() *tcpip.Error {
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+
+	e.mu.Lock()
+	pkts := e.queue
+	e.queue = nil
+	if e.timer != nil {
+		e.timer.Stop()
+		e.timer = nil
+	}
+	e.mu.Unlock()
+
+	if len(pkts) == 0 {
+		return nil
+	}
+
+	defer func() {
+		for i := range pkts {
+			pkts[i].Header.Release()
+			pkts[i].Route.Release()
+		}
+	}()
+
+	if w, ok := e.lower.(PacketsWriter); ok {
+		return w.WritePackets(pkts)
+	}
+
+	var err *tcpip.Error
+	for i := range pkts {
+		p := &pkts[i]
+		if perr := e.lower.WritePacket(&p.Route, p.Checksum, &p.Header, p.Payload, p.Protocol); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// Queued returns the number of packets currently waiting to be flushed.
+func (e *Endpoint) Queued() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.queue)
+}
@@ -0,0 +1,193 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package batch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// writtenPacket holds the identifying contents of a packet written to a mock
+// endpoint.
+type writtenPacket struct {
+	payload  byte
+	protocol tcpip.NetworkProtocolNumber
+}
+
+// mockEndpoint is a link endpoint that records the packets written to it.
+type mockEndpoint struct {
+	mu      sync.Mutex
+	writes  []writtenPacket
+	batches [][]writtenPacket
+}
+
+func (*mockEndpoint) Attach(stack.NetworkDispatcher) {}
+
+func (*mockEndpoint) MTU() uint32 {
+	return 1500
+}
+
+func (*mockEndpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+func (*mockEndpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+func (*mockEndpoint) LinkAddress() tcpip.LinkAddress {
+	return ""
+}
+
+func (e *mockEndpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.writes = append(e.writes, writtenPacket{payload[0], protocol})
+	return nil
+}
+
+func (e *mockEndpoint) written() []writtenPacket {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]writtenPacket(nil), e.writes...)
+}
+
+// mockBatchEndpoint is a mock endpoint that also implements PacketsWriter.
+type mockBatchEndpoint struct {
+	mockEndpoint
+}
+
+func (e *mockBatchEndpoint) WritePackets(pkts []Packet) *tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var b []writtenPacket
+	for _, p := range pkts {
+		b = append(b, writtenPacket{p.Payload[0], p.Protocol})
+	}
+	e.batches = append(e.batches, b)
+	return nil
+}
+
+func (e *mockBatchEndpoint) flushed() [][]writtenPacket {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([][]writtenPacket(nil), e.batches...)
+}
+
+func writePackets(t *testing.T, ep *Endpoint, first, n int) []writtenPacket {
+	var want []writtenPacket
+	for i := first; i < first+n; i++ {
+		hdr := buffer.NewPrependable(0)
+		w := writtenPacket{byte(i), tcpip.NetworkProtocolNumber(i)}
+		if err := ep.WritePacket(&stack.Route{}, nil, &hdr, buffer.View{w.payload}, w.protocol); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+		want = append(want, w)
+	}
+	return want
+}
+
+func checkBatch(t *testing.T, got, want []writtenPacket) {
+	if len(got) != len(want) {
+		t.Fatalf("got %d packets, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("packet %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFlush(t *testing.T) {
+	lower := &mockBatchEndpoint{}
+	_, ep := New(stack.RegisterLinkEndpoint(lower), Options{BatchSize: 100})
+
+	const n = 10
+	want := writePackets(t, ep, 0, n)
+
+	if b := lower.flushed(); len(b) != 0 {
+		t.Fatalf("got %d batches before flush, want 0", len(b))
+	}
+	if got := ep.Queued(); got != n {
+		t.Fatalf("got Queued() = %d, want %d", got, n)
+	}
+
+	if err := ep.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	b := lower.flushed()
+	if len(b) != 1 {
+		t.Fatalf("got %d batches, want 1", len(b))
+	}
+	checkBatch(t, b[0], want)
+
+	if got := ep.Queued(); got != 0 {
+		t.Fatalf("got Queued() = %d after flush, want 0", got)
+	}
+	if w := lower.written(); len(w) != 0 {
+		t.Fatalf("got %d individual writes, want 0", len(w))
+	}
+}
+
+func TestFlushWhenFull(t *testing.T) {
+	lower := &mockBatchEndpoint{}
+	const batchSize = 4
+	_, ep := New(stack.RegisterLinkEndpoint(lower), Options{BatchSize: batchSize})
+
+	want := writePackets(t, ep, 0, 2*batchSize+1)
+
+	b := lower.flushed()
+	if len(b) != 2 {
+		t.Fatalf("got %d batches, want 2", len(b))
+	}
+	checkBatch(t, b[0], want[:batchSize])
+	checkBatch(t, b[1], want[batchSize:2*batchSize])
+
+	if got := ep.Queued(); got != 1 {
+		t.Fatalf("got Queued() = %d, want 1", got)
+	}
+}
+
+func TestFlushOnTimeout(t *testing.T) {
+	lower := &mockBatchEndpoint{}
+	_, ep := New(stack.RegisterLinkEndpoint(lower), Options{
+		BatchSize:    100,
+		FlushTimeout: 10 * time.Millisecond,
+	})
+
+	want := writePackets(t, ep, 0, 3)
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if b := lower.flushed(); len(b) != 0 {
+			if len(b) != 1 {
+				t.Fatalf("got %d batches, want 1", len(b))
+			}
+			checkBatch(t, b[0], want)
+			return
+		}
+	}
+	t.Fatalf("Partial batch wasn't flushed")
+}
+
+func TestFlushWithoutPacketsWriter(t *testing.T) {
+	lower := &mockEndpoint{}
+	_, ep := New(stack.RegisterLinkEndpoint(lower), Options{BatchSize: 100})
+
+	want := writePackets(t, ep, 0, 5)
+	if w := lower.written(); len(w) != 0 {
+		t.Fatalf("got %d writes before flush, want 0", len(w))
+	}
+
+	if err := ep.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	checkBatch(t, lower.written(), want)
+}
@@ -5,11 +5,21 @@
 // Package channel provides the implemention of channel-based data-link layer
 // endpoints. Such endpoints allow injection of inbound packets and store
 // outbound packets in a channel.
+//
+// Tests inject the packets a NIC receives with InjectInbound, and read those it
+// sends with Read or ReadTimeout, or directly from the channel.
 package channel
 
 import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/gate"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/stack"
 )
 
@@ -18,23 +28,75 @@ type PacketInfo struct {
 	Header  buffer.View
 	Payload buffer.View
 	Proto   tcpip.NetworkProtocolNumber
+
+	// Checksum is the partial checksum information passed down with the
+	// packet, if any.
+	Checksum *stack.PartialChecksum
+
+	// LocalLinkAddress and RemoteLinkAddress are the link addresses of the
+	// route the packet was written with, i.e., the source and destination
+	// of the frame.
+	LocalLinkAddress  tcpip.LinkAddress
+	RemoteLinkAddress tcpip.LinkAddress
+}
+
+// Counts holds the number of packets that went through an endpoint in each
+// direction.
+type Counts struct {
+	// Inbound is the number of injected packets delivered to the stack.
+	Inbound uint64
+
+	// InboundDropped is the number of injected packets that were dropped,
+	// because the endpoint was closed or filtered their link address out.
+	InboundDropped uint64
+
+	// Outbound is the number of packets written by the stack and queued
+	// to the channel.
+	Outbound uint64
+
+	// OutboundDropped is the number of packets written by the stack that
+	// were dropped because the channel was full.
+	OutboundDropped uint64
 }
 
 // Endpoint is link layer endpoint that stores outbound packets in a channel
 // and allows injection of inbound packets.
 type Endpoint struct {
+	// counts is accessed atomically. It comes first to be 64-bit aligned.
+	counts Counts
+
 	dispatcher stack.NetworkDispatcher
-	mtu        uint32
-	linkAddr   tcpip.LinkAddress
+
+	// dispatchGate and writeGate are closed when the endpoint is closed,
+	// to stop injected and outbound packets respectively.
+	dispatchGate gate.Gate
+	writeGate    gate.Gate
+
+	// mtu is accessed atomically.
+	mtu uint32
 
 	// C is where outbound packets are queued.
 	C chan PacketInfo
+
+	// LinkEPCapabilities is the set of capabilities advertised by the
+	// endpoint.
+	LinkEPCapabilities stack.LinkEndpointCapabilities
+
+	// mu protects the fields below.
+	mu           sync.Mutex
+	linkAddr     tcpip.LinkAddress
+	mcastFilters map[tcpip.LinkAddress]struct{}
+
+	// clock times out reads, see ReadTimeout. It is the clock of the
+	// stack the endpoint is attached to, if the dispatcher provides it.
+	clock tcpip.Clock
 }
 
 // New creates a new channel endpoint.
 func New(size int, mtu uint32, linkAddr tcpip.LinkAddress) (tcpip.LinkEndpointID, *Endpoint) {
 	e := &Endpoint{
 		C:        make(chan PacketInfo, size),
+		clock:    &tcpip.StdClock{},
 		mtu:      mtu,
 		linkAddr: linkAddr,
 	}
@@ -55,27 +117,178 @@ func (e *Endpoint) Drain() int {
 	}
 }
 
-// Inject injects an inbound packet.
+// DrainOutbound removes all outbound packets from the channel and returns them,
+// oldest first.
+func (e *Endpoint) DrainOutbound() []PacketInfo {
+	var pkts []PacketInfo
+	for {
+		select {
+		case p := <-e.C:
+			pkts = append(pkts, p)
+		default:
+			return pkts
+		}
+	}
+}
+
+// Read removes the oldest outbound packet from the channel and returns it,
+// without blocking. It returns false if there is none.
+func (e *Endpoint) Read() (PacketInfo, bool) {
+	select {
+	case p := <-e.C:
+		return p, true
+	default:
+		return PacketInfo{}, false
+	}
+}
+
+// ReadTimeout is like Read, but waits for an outbound packet until the timeout
+// elapses according to the clock of the stack, so that tests with a manual
+// clock decide when it does.
+func (e *Endpoint) ReadTimeout(timeout time.Duration) (PacketInfo, bool) {
+	if p, ok := e.Read(); ok {
+		return p, true
+	}
+
+	e.mu.Lock()
+	clock := e.clock
+	e.mu.Unlock()
+
+	expired := make(chan struct{})
+	t := clock.AfterFunc(timeout, func() { close(expired) })
+	defer t.Stop()
+
+	select {
+	case p := <-e.C:
+		return p, true
+	case <-expired:
+		// Don't miss a packet written just before the timeout.
+		return e.Read()
+	}
+}
+
+// Counts returns the number of packets that went through e so far.
+func (e *Endpoint) Counts() Counts {
+	return Counts{
+		Inbound:         atomic.LoadUint64(&e.counts.Inbound),
+		InboundDropped:  atomic.LoadUint64(&e.counts.InboundDropped),
+		Outbound:        atomic.LoadUint64(&e.counts.Outbound),
+		OutboundDropped: atomic.LoadUint64(&e.counts.OutboundDropped),
+	}
+}
+
+// InjectInbound injects a packet received by the NIC, which the stack handles
+// before it returns. vv isn't modified.
+func (e *Endpoint) InjectInbound(protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	e.inject(protocol, vv, false)
+}
+
+// Inject is the same as InjectInbound.
 func (e *Endpoint) Inject(protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	e.inject(protocol, vv, false)
+}
+
+// InjectChecksumValidated injects an inbound packet as if its transport
+// checksum had already been validated by the link.
+func (e *Endpoint) InjectChecksumValidated(protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	e.inject(protocol, vv, true)
+}
+
+// InjectTo injects an inbound packet that was sent to the given link address.
+// Like a NIC would, the endpoint drops packets sent to multicast link
+// addresses for which no filter was added.
+func (e *Endpoint) InjectTo(dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	e.InjectFrame("", dst, protocol, vv)
+}
+
+// InjectFrame injects an inbound frame sent from the src link address to the
+// dst one, which is delivered with stack.DeliverFrame. Multicast frames are
+// filtered as by InjectTo.
+func (e *Endpoint) InjectFrame(src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	if header.IsMulticastEthernetAddress(dst) && dst != broadcastMAC {
+		e.mu.Lock()
+		_, ok := e.mcastFilters[dst]
+		e.mu.Unlock()
+		if !ok {
+			atomic.AddUint64(&e.counts.InboundDropped, 1)
+			return
+		}
+	}
+
+	if !e.dispatchGate.Enter() {
+		atomic.AddUint64(&e.counts.InboundDropped, 1)
+		return
+	}
+	defer e.dispatchGate.Leave()
+
+	atomic.AddUint64(&e.counts.Inbound, 1)
 	uu := vv.Clone(nil)
-	e.dispatcher.DeliverNetworkPacket(e, "", protocol, &uu)
+	stack.DeliverFrame(e.dispatcher, e, src, dst, protocol, &uu, false)
+}
+
+func (e *Endpoint) inject(protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
+	if !e.dispatchGate.Enter() {
+		atomic.AddUint64(&e.counts.InboundDropped, 1)
+		return
+	}
+	defer e.dispatchGate.Leave()
+
+	atomic.AddUint64(&e.counts.Inbound, 1)
+	uu := vv.Clone(nil)
+	e.dispatcher.DeliverNetworkPacket(e, "", protocol, &uu, checksumValidated)
+}
+
+// InjectBatch injects inbound packets received together, which are delivered
+// as a batch with stack.DeliverNetworkPackets.
+func (e *Endpoint) InjectBatch(pkts []stack.InboundPacket) {
+	if !e.dispatchGate.Enter() {
+		atomic.AddUint64(&e.counts.InboundDropped, uint64(len(pkts)))
+		return
+	}
+	defer e.dispatchGate.Leave()
+
+	atomic.AddUint64(&e.counts.Inbound, uint64(len(pkts)))
+	batch := make([]stack.InboundPacket, len(pkts))
+	for i := range pkts {
+		batch[i] = pkts[i]
+		batch[i].VV = pkts[i].VV.Clone(nil)
+	}
+	stack.DeliverNetworkPackets(e.dispatcher, e, batch)
+}
+
+// Close implements stack.LinkEndpointCloser.Close. Packets injected afterwards
+// are dropped.
+func (e *Endpoint) Close() {
+	e.writeGate.Close()
+	e.dispatchGate.Close()
 }
 
 // Attach saves the stack network-layer dispatcher for use later when packets
-// are injected.
+// are injected, and the clock of the stack if the dispatcher provides it.
 func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
 	e.dispatcher = dispatcher
+	if d, ok := dispatcher.(interface{ Clock() tcpip.Clock }); ok {
+		e.mu.Lock()
+		e.clock = d.Clock()
+		e.mu.Unlock()
+	}
 }
 
 // MTU implements stack.LinkEndpoint.MTU. It returns the value initialized
-// during construction.
+// during construction, or set by SetMTU.
 func (e *Endpoint) MTU() uint32 {
-	return e.mtu
+	return atomic.LoadUint32(&e.mtu)
+}
+
+// SetMTU implements stack.LinkMTUSetter.SetMTU.
+func (e *Endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	atomic.StoreUint32(&e.mtu, mtu)
+	return nil
 }
 
 // Capabilities implements stack.LinkEndpoint.Capabilities.
-func (*Endpoint) Capabilities() stack.LinkEndpointCapabilities {
-	return 0
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.LinkEPCapabilities
 }
 
 // MaxHeaderLength returns the maximum size of the link layer header. Given it
@@ -86,14 +299,35 @@ func (*Endpoint) MaxHeaderLength() uint16 {
 
 // LinkAddress returns the link address of this endpoint.
 func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	return e.linkAddr
 }
 
+// SetLinkAddress implements stack.LinkAddressSetter.SetLinkAddress.
+func (e *Endpoint) SetLinkAddress(addr tcpip.LinkAddress) *tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.linkAddr = addr
+	return nil
+}
+
 // WritePacket stores outbound packets into the channel.
-func (e *Endpoint) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+func (e *Endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if !e.writeGate.Enter() {
+		return tcpip.ErrClosedForSend
+	}
+	defer e.writeGate.Leave()
+
+	// The headers may be reused once the packet is written, so keep a copy.
 	p := PacketInfo{
-		Header: hdr.View(),
-		Proto:  protocol,
+		Header:   append(buffer.View(nil), hdr.View()...),
+		Proto:    protocol,
+		Checksum: csum,
+	}
+	if r != nil {
+		p.LocalLinkAddress = r.LocalLinkAddress
+		p.RemoteLinkAddress = r.RemoteLinkAddress
 	}
 
 	if payload != nil {
@@ -103,8 +337,48 @@ func (e *Endpoint) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload
 
 	select {
 	case e.C <- p:
+		atomic.AddUint64(&e.counts.Outbound, 1)
 	default:
+		atomic.AddUint64(&e.counts.OutboundDropped, 1)
 	}
 
 	return nil
 }
+
+// AddMulticastFilter implements stack.MulticastLinkEndpoint.AddMulticastFilter.
+func (e *Endpoint) AddMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.mcastFilters == nil {
+		e.mcastFilters = make(map[tcpip.LinkAddress]struct{})
+	}
+	e.mcastFilters[addr] = struct{}{}
+	return nil
+}
+
+// RemoveMulticastFilter implements
+// stack.MulticastLinkEndpoint.RemoveMulticastFilter.
+func (e *Endpoint) RemoveMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.mcastFilters[addr]; !ok {
+		return tcpip.ErrBadAddress
+	}
+	delete(e.mcastFilters, addr)
+	return nil
+}
+
+// MulticastFilters returns the multicast link addresses the endpoint currently
+// accepts frames for, in ascending order.
+func (e *Endpoint) MulticastFilters() []tcpip.LinkAddress {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	addrs := make([]tcpip.LinkAddress, 0, len(e.mcastFilters))
+	for a := range e.mcastFilters {
+		addrs = append(addrs, a)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i] < addrs[j] })
+	return addrs
+}
+
+var broadcastMAC = tcpip.LinkAddress("\xff\xff\xff\xff\xff\xff")
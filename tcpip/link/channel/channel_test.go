@@ -0,0 +1,143 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package channel_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/testutil"
+)
+
+const (
+	localAddr  = tcpip.Address("\x0a\x00\x00\x01")
+	remoteAddr = tcpip.Address("\x0a\x00\x00\x02")
+)
+
+func newStack(t *testing.T, clock tcpip.Clock) *channel.Endpoint {
+	t.Helper()
+	s := stack.New(clock, []string{ipv4.ProtocolName}, nil)
+	id, e := channel.New(10, 1500, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	return e
+}
+
+// echoRequest returns an ICMP echo request from remoteAddr to localAddr.
+func echoRequest() *buffer.VectorisedView {
+	v := buffer.NewView(header.IPv4MinimumSize + header.ICMPv4EchoMinimumSize)
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     remoteAddr,
+		DstAddr:     localAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(ip.Payload())
+	icmp.SetType(header.ICMPv4Echo)
+	icmp.SetChecksum(^header.Checksum(icmp, 0))
+	vv := buffer.NewVectorisedView(len(v), []buffer.View{v})
+	return &vv
+}
+
+func TestInjectInbound(t *testing.T) {
+	e := newStack(t, nil)
+
+	e.InjectInbound(ipv4.ProtocolNumber, echoRequest())
+
+	// The echo reply is sent from another goroutine.
+	p, ok := e.ReadTimeout(5 * time.Second)
+	if !ok {
+		t.Fatalf("Timed out waiting for the echo reply")
+	}
+	ip := header.IPv4(append(p.Header, p.Payload...))
+	if got := ip.DestinationAddress(); got != remoteAddr {
+		t.Errorf("got reply to %s, want %s", got, remoteAddr)
+	}
+	if got := header.ICMPv4(ip.Payload()).Type(); got != header.ICMPv4EchoReply {
+		t.Errorf("got ICMP type %d, want %d", got, header.ICMPv4EchoReply)
+	}
+	if p, ok := e.Read(); ok {
+		t.Errorf("got unexpected outbound packet %+v", p)
+	}
+
+	e.Close()
+	e.InjectInbound(ipv4.ProtocolNumber, echoRequest())
+
+	want := channel.Counts{Inbound: 1, InboundDropped: 1, Outbound: 1}
+	if got := e.Counts(); got != want {
+		t.Errorf("got Counts() = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	clock := testutil.NewManualClock()
+	e := newStack(t, clock)
+
+	type result struct {
+		p  channel.PacketInfo
+		ok bool
+	}
+	read := func() <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			p, ok := e.ReadTimeout(time.Second)
+			ch <- result{p, ok}
+		}()
+		return ch
+	}
+
+	// The read times out according to the clock of the stack.
+	timers := clock.PendingTimers()
+	ch := read()
+	for deadline := time.Now().Add(5 * time.Second); clock.PendingTimers() == timers; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the read timer")
+		}
+	}
+	clock.Advance(time.Second / 2)
+	select {
+	case r := <-ch:
+		t.Fatalf("got ReadTimeout() = %+v, %t before the timeout", r.p, r.ok)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.Advance(time.Second / 2)
+	select {
+	case r := <-ch:
+		if r.ok {
+			t.Fatalf("got unexpected outbound packet %+v", r.p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ReadTimeout didn't return after the timeout")
+	}
+
+	// A packet sent before the timeout is returned as soon as it's sent.
+	ch = read()
+	e.InjectInbound(ipv4.ProtocolNumber, echoRequest())
+	select {
+	case r := <-ch:
+		if !r.ok {
+			t.Fatalf("ReadTimeout timed out")
+		}
+		if got := r.p.Proto; got != ipv4.ProtocolNumber {
+			t.Errorf("got protocol %d, want %d", got, ipv4.ProtocolNumber)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ReadTimeout didn't return the echo reply")
+	}
+}
@@ -12,32 +12,73 @@
 package fdbased
 
 import (
+	"net"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
+	"github.com/google/netstack/gate"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/batch"
 	"github.com/google/netstack/tcpip/link/rawfile"
+	"github.com/google/netstack/tcpip/link/tun"
 	"github.com/google/netstack/tcpip/stack"
 )
 
-// BufConfig defines the shape of the vectorised view used to read packets from the NIC.
+// BufConfig defines the shape of the vectorised view used to read packets from
+// the NIC. Endpoints only use as much of it as the largest frame allowed by
+// their MTU needs.
 var BufConfig = []int{128, 256, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768}
 
+const (
+	// virtioNetHdrSize is the size of the virtio_net_hdr structure that
+	// prefixes every packet when the file descriptor is a TUN/TAP device
+	// opened with IFF_VNET_HDR.
+	virtioNetHdrSize = 10
+
+	// virtioNetHdrFDataValid is the VIRTIO_NET_HDR_F_DATA_VALID flag, set
+	// by the device when it has already validated the packet checksum.
+	virtioNetHdrFDataValid = 2
+)
+
 type endpoint struct {
 	// fd is the file descriptor used to send and receive packets.
 	fd int
 
-	// mtu (maximum transmission unit) is the maximum size of a packet.
+	// mtu (maximum transmission unit) is the maximum size of a packet. It
+	// is accessed atomically because SetMTU may change it at any time.
 	mtu uint32
 
 	// hdrSize specifies the link-layer header size. If set to 0, no header
 	// is added/removed; otherwise an ethernet header is used.
 	hdrSize int
 
-	// addr is the address of the endpoint.
+	// vnetHdrSize is the size of the virtio-net header that prefixes all
+	// packets, or 0 if packets don't have one.
+	vnetHdrSize int
+
+	// isSocket is set if fd is a socket, which several packets can be
+	// written to at once with sendmmsg.
+	isSocket bool
+
+	// mu protects addr, the address of the endpoint, and the fields below
+	// it.
+	mu   sync.RWMutex
 	addr tcpip.LinkAddress
 
+	// stopFD is the write end of a pipe whose read end is polled by the
+	// goroutine reading packets, which is woken up and exits when stopFD
+	// is closed. dispatchDone is closed once the goroutine has exited.
+	stopFD       int
+	dispatchDone chan struct{}
+	isClosed     bool
+
+	// writeGate is closed when the endpoint is closed, to stop new writes
+	// and wait for those in progress.
+	writeGate gate.Gate
+
 	// caps holds the endpoint capabilities.
 	caps stack.LinkEndpointCapabilities
 
@@ -45,19 +86,109 @@ type endpoint struct {
 	// its end of the communication pipe.
 	closed func(*tcpip.Error)
 
-	vv     *buffer.VectorisedView
-	iovecs []syscall.Iovec
-	views  []buffer.View
+	// rxBuffers holds the buffers released by the stack, for other packets
+	// to be read into.
+	rxBuffers sync.Pool
+
+	// rxHeld is the number of buffers the stack holds packets in. It is
+	// accessed atomically.
+	rxHeld int64
+
+	// The fields below are only used by the goroutine reading packets.
+	//
+	// bufConfig is the shape of the views packets are read into, sized for
+	// frames whose payload is at most bufMTU bytes long. bufGen is
+	// incremented whenever it changes, so that the buffers of another shape
+	// are dropped. rx is the buffer the next packet is read into.
+	bufConfig []int
+	bufMTU    uint32
+	bufGen    uint64
+	vv        *buffer.VectorisedView
+	rx        *rxBuffer
+}
+
+// rxBuffer is the memory a packet is read into. It's handed over to the stack
+// along with the packet, and reused for another packet once the stack
+// releases it.
+type rxBuffer struct {
+	pb  *buffer.PacketBuffer
+	gen uint64
+
+	// views are the views packets are read into, through iovecs. vvViews
+	// holds those of the current packet, trimmed to its length, which the
+	// stack may trim further.
+	views   []buffer.View
+	vvViews []buffer.View
+	iovecs  []syscall.Iovec
+}
+
+// newRxBuffer allocates an rxBuffer of the given shape.
+func newRxBuffer(bufConfig []int) *rxBuffer {
+	b := &rxBuffer{
+		views:   make([]buffer.View, len(bufConfig)),
+		vvViews: make([]buffer.View, len(bufConfig)),
+		iovecs:  make([]syscall.Iovec, len(bufConfig)),
+	}
+	for i, s := range bufConfig {
+		v := buffer.NewView(s)
+		b.views[i] = v
+		b.vvViews[i] = v
+		b.iovecs[i] = syscall.Iovec{
+			Base: &v[0],
+			Len:  uint64(len(v)),
+		}
+	}
+	return b
+}
+
+// size returns the number of bytes b can hold.
+func (b *rxBuffer) size() int {
+	n := 0
+	for _, v := range b.views {
+		n += len(v)
+	}
+	return n
+}
+
+// capViews sets the views of the packet to those holding its first n bytes,
+// and returns how many there are.
+func (b *rxBuffer) capViews(n int) int {
+	c := 0
+	for i, v := range b.views {
+		c += len(v)
+		b.vvViews[i] = v
+		if c >= n {
+			b.vvViews[i].CapLength(len(v) - (c - n))
+			return i + 1
+		}
+	}
+	return len(b.views)
 }
 
 // Options specify the details about the fd-based endpoint to be created.
 type Options struct {
-	FD              int
-	MTU             uint32
+	FD int
+
+	// MTU is the MTU of the endpoint. If it is zero, the MTU of the
+	// device that FD is attached to (a TUN/TAP device, or the interface a
+	// packet socket is bound to) is used, when it can be found.
+	MTU uint32
+
 	EthernetHeader  bool
 	ChecksumOffload bool
-	ClosedFunc      func(*tcpip.Error)
-	Address         tcpip.LinkAddress
+
+	// RXChecksumOffload indicates that the device behind FD validates the
+	// checksums of all the packets it receives, so the stack trusts them.
+	RXChecksumOffload bool
+
+	ClosedFunc func(*tcpip.Error)
+	Address    tcpip.LinkAddress
+
+	// VirtioNetHeader indicates that FD is a TUN/TAP device opened with
+	// IFF_VNET_HDR, so every packet is prefixed by a virtio-net header.
+	// Inbound packets whose header says the checksum is valid are
+	// delivered to the stack as already validated.
+	VirtioNetHeader bool
 }
 
 // New creates a new fd-based endpoint.
@@ -71,6 +202,9 @@ func New(opts *Options) tcpip.LinkEndpointID {
 	if opts.ChecksumOffload {
 		caps |= stack.CapabilityChecksumOffload
 	}
+	if opts.RXChecksumOffload {
+		caps |= stack.CapabilityRXChecksumOffload
+	}
 
 	hdrSize := 0
 	if opts.EthernetHeader {
@@ -78,31 +212,124 @@ func New(opts *Options) tcpip.LinkEndpointID {
 		caps |= stack.CapabilityResolutionRequired
 	}
 
+	vnetHdrSize := 0
+	if opts.VirtioNetHeader {
+		vnetHdrSize = virtioNetHdrSize
+	}
+
+	mtu := opts.MTU
+	if mtu == 0 {
+		mtu = deviceMTU(opts.FD)
+	}
+
 	e := &endpoint{
-		fd:      opts.FD,
-		mtu:     opts.MTU,
-		caps:    caps,
-		closed:  opts.ClosedFunc,
-		addr:    opts.Address,
-		hdrSize: hdrSize,
-		views:   make([]buffer.View, len(BufConfig)),
-		iovecs:  make([]syscall.Iovec, len(BufConfig)),
-	}
-	vv := buffer.NewVectorisedView(0, e.views)
+		fd:          opts.FD,
+		mtu:         mtu,
+		caps:        caps,
+		closed:      opts.ClosedFunc,
+		addr:        opts.Address,
+		hdrSize:     hdrSize,
+		vnetHdrSize: vnetHdrSize,
+	}
+	if _, err := syscall.GetsockoptInt(opts.FD, syscall.SOL_SOCKET, syscall.SO_TYPE); err == nil {
+		e.isSocket = true
+	}
+	e.setBufConfig(mtu)
+	vv := buffer.NewVectorisedView(0, nil)
 	e.vv = &vv
 	return stack.RegisterLinkEndpoint(e)
 }
 
+// deviceMTU returns the MTU of the device that fd is attached to, or 0 if it
+// can't be found.
+func deviceMTU(fd int) uint32 {
+	// Packet sockets are bound to an interface.
+	if sa, err := syscall.Getsockname(fd); err == nil {
+		if ll, ok := sa.(*syscall.SockaddrLinklayer); ok {
+			if ifc, err := net.InterfaceByIndex(ll.Ifindex); err == nil {
+				return uint32(ifc.MTU)
+			}
+		}
+		return 0
+	}
+
+	name, err := tun.Name(fd)
+	if err != nil {
+		return 0
+	}
+	mtu, err := rawfile.GetMTU(name)
+	if err != nil {
+		return 0
+	}
+	return mtu
+}
+
 // Attach launches the goroutine that reads packets from the file descriptor and
 // dispatches them via the provided dispatcher.
 func (e *endpoint) Attach(dispatcher stack.NetworkDispatcher) {
-	go e.dispatchLoop(dispatcher)
+	// If the pipe can't be created, Close only stops the goroutine once
+	// the next packet is read.
+	p := [2]int{-1, -1}
+	syscall.Pipe2(p[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.isClosed || e.dispatchDone != nil {
+		syscall.Close(p[0])
+		syscall.Close(p[1])
+		return
+	}
+
+	e.stopFD = p[1]
+	e.dispatchDone = make(chan struct{})
+	go e.dispatchLoop(dispatcher, p[0], e.dispatchDone)
+}
+
+// Close implements stack.LinkEndpointCloser.Close. It stops the goroutine
+// reading packets and waits for it to exit, and makes further writes fail. The
+// file descriptor isn't closed, as the endpoint doesn't own it, but the caller
+// may close it once Close returns.
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	if e.isClosed {
+		e.mu.Unlock()
+		return
+	}
+	e.isClosed = true
+	done := e.dispatchDone
+	if done != nil {
+		syscall.Close(e.stopFD)
+	}
+	e.mu.Unlock()
+
+	e.writeGate.Close()
+	if done != nil {
+		<-done
+	}
+}
+
+// closing returns whether Close has been called.
+func (e *endpoint) closing() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.isClosed
 }
 
 // MTU implements stack.LinkEndpoint.MTU. It returns the value initialized
-// during construction.
+// during construction, or set by SetMTU.
 func (e *endpoint) MTU() uint32 {
-	return e.mtu
+	return atomic.LoadUint32(&e.mtu)
+}
+
+// SetMTU implements stack.LinkMTUSetter.SetMTU. The buffers packets are read
+// into are resized before the next packet is read.
+func (e *endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	if mtu == 0 {
+		return tcpip.ErrInvalidOptionValue
+	}
+	atomic.StoreUint32(&e.mtu, mtu)
+	return nil
 }
 
 // Capabilities implements stack.LinkEndpoint.Capabilities.
@@ -112,84 +339,272 @@ func (e *endpoint) Capabilities() stack.LinkEndpointCapabilities {
 
 // MaxHeaderLength returns the maximum size of the link-layer header.
 func (e *endpoint) MaxHeaderLength() uint16 {
-	return uint16(e.hdrSize)
+	return uint16(e.vnetHdrSize + e.hdrSize)
 }
 
 // LinkAddress returns the link address of this endpoint.
 func (e *endpoint) LinkAddress() tcpip.LinkAddress {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 	return e.addr
 }
 
+// SetLinkAddress implements stack.LinkAddressSetter.SetLinkAddress. It only
+// changes the source address of outbound frames; the address of the host
+// interface, if any, is left untouched.
+func (e *endpoint) SetLinkAddress(addr tcpip.LinkAddress) *tcpip.Error {
+	if e.hdrSize == 0 {
+		return tcpip.ErrNotSupported
+	}
+	e.mu.Lock()
+	e.addr = addr
+	e.mu.Unlock()
+	return nil
+}
+
+// AddMulticastFilter implements stack.MulticastLinkEndpoint.AddMulticastFilter.
+func (e *endpoint) AddMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	return e.setMulticastMembership(addr, true)
+}
+
+// RemoveMulticastFilter implements
+// stack.MulticastLinkEndpoint.RemoveMulticastFilter.
+func (e *endpoint) RemoveMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	return e.setMulticastMembership(addr, false)
+}
+
+// setMulticastMembership adds or drops addr from the multicast addresses
+// accepted by the file descriptor. Only packet sockets filter multicast frames;
+// other file descriptors (e.g., TAP devices) already deliver them all, so
+// there is nothing to program for them.
+func (e *endpoint) setMulticastMembership(addr tcpip.LinkAddress, add bool) *tcpip.Error {
+	if e.hdrSize == 0 {
+		return nil
+	}
+
+	sa, err := syscall.Getsockname(e.fd)
+	if err == syscall.ENOTSOCK {
+		return nil
+	}
+	if err != nil {
+		if errno, ok := err.(syscall.Errno); ok {
+			return rawfile.TranslateErrno(errno)
+		}
+		return tcpip.ErrInvalidEndpointState
+	}
+	ll, ok := sa.(*syscall.SockaddrLinklayer)
+	if !ok {
+		return nil
+	}
+
+	return rawfile.SetPacketMembership(e.fd, ll.Ifindex, []byte(addr), add)
+}
+
 // WritePacket writes outbound packets to the file descriptor. If it is not
 // currently writable, the packet is dropped.
-func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+func (e *endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if !e.writeGate.Enter() {
+		return tcpip.ErrClosedForSend
+	}
+	defer e.writeGate.Leave()
+
+	e.prependHeaders(r, hdr, protocol)
+
+	if len(payload) == 0 {
+		return rawfile.NonBlockingWrite(e.fd, hdr.UsedBytes())
+
+	}
+
+	return rawfile.NonBlockingWrite2(e.fd, hdr.UsedBytes(), payload)
+}
+
+// WritePackets implements batch.PacketsWriter.WritePackets. When the FD is a
+// socket, all the packets are written with a single sendmmsg syscall, and
+// otherwise with a write each. A packet that can't be written is dropped, and
+// the first such error is returned once the others are written.
+func (e *endpoint) WritePackets(pkts []batch.Packet) *tcpip.Error {
+	if !e.writeGate.Enter() {
+		return tcpip.ErrClosedForSend
+	}
+	defer e.writeGate.Leave()
+
+	var err *tcpip.Error
+	if !e.isSocket {
+		for i := range pkts {
+			p := &pkts[i]
+			e.prependHeaders(&p.Route, &p.Header, p.Protocol)
+			if perr := rawfile.NonBlockingWrite2(e.fd, p.Header.UsedBytes(), p.Payload); perr != nil && err == nil {
+				err = perr
+			}
+		}
+		return err
+	}
+
+	// The iovecs of each message are contiguous; there's enough room for
+	// all of them, so that they don't move as they're appended.
+	iovecs := make([]syscall.Iovec, 0, 2*len(pkts))
+	msgHdrs := make([]rawfile.MMsgHdr, len(pkts))
+	for i := range pkts {
+		p := &pkts[i]
+		e.prependHeaders(&p.Route, &p.Header, p.Protocol)
+		start := len(iovecs)
+		for _, b := range [][]byte{p.Header.UsedBytes(), p.Payload} {
+			if len(b) != 0 {
+				iovecs = append(iovecs, syscall.Iovec{
+					Base: &b[0],
+					Len:  uint64(len(b)),
+				})
+			}
+		}
+		if n := len(iovecs) - start; n != 0 {
+			msgHdrs[i].Msg.Iov = &iovecs[start]
+			msgHdrs[i].Msg.Iovlen = uint64(n)
+		}
+	}
+
+	for len(msgHdrs) != 0 {
+		n, serr := rawfile.NonBlockingSendMMsg(e.fd, msgHdrs)
+		if serr != nil {
+			// The first message couldn't be sent, go on with the
+			// ones after it.
+			if err == nil {
+				err = serr
+			}
+			n = 1
+		}
+		msgHdrs = msgHdrs[n:]
+	}
+	return err
+}
+
+// prependHeaders prepends the link-layer headers of the endpoint, if any, to
+// the headers of a packet sent on route r.
+func (e *endpoint) prependHeaders(r *stack.Route, hdr *buffer.Prependable, protocol tcpip.NetworkProtocolNumber) {
 	if e.hdrSize > 0 {
-		// Add ethernet header if needed.
+		// Add ethernet header if needed. Bridged frames keep their
+		// source address.
+		src := r.LocalLinkAddress
+		if src == "" {
+			src = e.LinkAddress()
+		}
 		eth := header.Ethernet(hdr.Prepend(header.EthernetMinimumSize))
 		eth.Encode(&header.EthernetFields{
 			DstAddr: r.RemoteLinkAddress,
-			SrcAddr: e.addr,
+			SrcAddr: src,
 			Type:    protocol,
 		})
 	}
 
-	if len(payload) == 0 {
-		return rawfile.NonBlockingWrite(e.fd, hdr.UsedBytes())
+	if e.vnetHdrSize > 0 {
+		// Add an empty virtio-net header: no flags and no GSO.
+		vnetHdr := hdr.Prepend(e.vnetHdrSize)
+		for i := range vnetHdr {
+			vnetHdr[i] = 0
+		}
+	}
+}
 
+// rxBufConfig returns the shape of the views needed to read frames of up to
+// frameSize bytes. It follows BufConfig, with the last view trimmed so that no
+// more memory than needed is allocated for each frame. A zero frameSize, for
+// endpoints whose MTU is unknown, uses all of BufConfig.
+func rxBufConfig(frameSize int) []int {
+	if frameSize == 0 {
+		return BufConfig
 	}
 
-	return rawfile.NonBlockingWrite2(e.fd, hdr.UsedBytes(), payload)
+	var config []int
+	for _, s := range BufConfig {
+		if frameSize <= s {
+			return append(config, frameSize)
+		}
+		config = append(config, s)
+		frameSize -= s
+	}
+	return append(config, frameSize)
 }
 
-func (e *endpoint) capViews(n int, buffers []int) int {
-	c := 0
-	for i, s := range buffers {
-		c += s
-		if c >= n {
-			e.views[i].CapLength(s - (c - n))
-			return i + 1
-		}
+// setBufConfig sizes the views packets are read into for the given MTU. The
+// current buffers are dropped.
+func (e *endpoint) setBufConfig(mtu uint32) {
+	frameSize := 0
+	if mtu != 0 {
+		frameSize = int(mtu) + e.hdrSize + e.vnetHdrSize
 	}
-	return len(buffers)
+	e.bufConfig = rxBufConfig(frameSize)
+	e.bufMTU = mtu
+	e.bufGen++
+	e.rx = nil
 }
 
-func (e *endpoint) allocateViews(bufConfig []int) {
-	for i, v := range e.views {
-		if v != nil {
-			break
-		}
-		b := buffer.NewView(bufConfig[i])
-		e.views[i] = b
-		e.iovecs[i] = syscall.Iovec{
-			Base: &b[0],
-			Len:  uint64(len(b)),
+// nextRxBuffer returns the buffer to read the next packet into, after resizing
+// the views if the MTU changed. Buffers released by the stack are reused.
+func (e *endpoint) nextRxBuffer() *rxBuffer {
+	if mtu := atomic.LoadUint32(&e.mtu); mtu != e.bufMTU {
+		e.setBufConfig(mtu)
+	}
+	for e.rx == nil {
+		b, ok := e.rxBuffers.Get().(*rxBuffer)
+		switch {
+		case !ok:
+			b = newRxBuffer(e.bufConfig)
+			b.gen = e.bufGen
+			b.pb = buffer.NewPacketBuffer(func() {
+				atomic.AddInt64(&e.rxHeld, -1)
+				e.rxBuffers.Put(b)
+			})
+			b.pb.SetSize(b.size())
+			e.rx = b
+		case b.gen == e.bufGen:
+			b.pb.Reset()
+			e.rx = b
 		}
+		// Buffers of another shape are left to the garbage collector.
 	}
+	return e.rx
 }
 
-// dispatch reads one packet from the file descriptor and dispatches it.
-func (e *endpoint) dispatch(d stack.NetworkDispatcher, largeV buffer.View) (bool, *tcpip.Error) {
-	e.allocateViews(BufConfig)
+// rxIovecs returns the iovecs to read the next packet into.
+func (e *endpoint) rxIovecs() []syscall.Iovec {
+	return e.nextRxBuffer().iovecs
+}
 
-	n, err := rawfile.BlockingReadv(e.fd, e.iovecs)
+// dispatch reads one packet from the file descriptor and dispatches it. It
+// stops, returning false, once stopFD becomes readable.
+func (e *endpoint) dispatch(d stack.NetworkDispatcher, stopFD int) (bool, *tcpip.Error) {
+	n, err := rawfile.BlockingReadvFuncUntilStopped(e.fd, stopFD, e.rxIovecs)
 	if err != nil {
 		return false, err
 	}
+	if n == -1 || e.closing() {
+		return false, nil
+	}
 
-	if n <= e.hdrSize {
+	if n <= e.vnetHdrSize+e.hdrSize {
 		return false, nil
 	}
 
+	// Packets from endpoints that don't compute checksums on transmit are
+	// expected not to need verification either. Otherwise, rely on the
+	// virtio-net header, if any, to tell whether the device validated the
+	// checksum.
+	b := e.rx
+	checksumValidated := e.caps&stack.CapabilityChecksumOffload != 0
+	if e.vnetHdrSize > 0 && b.views[0][0]&virtioNetHdrFDataValid != 0 {
+		checksumValidated = true
+	}
+
 	var p tcpip.NetworkProtocolNumber
-	var addr tcpip.LinkAddress
+	var addr, dst tcpip.LinkAddress
 	if e.hdrSize > 0 {
-		eth := header.Ethernet(e.views[0])
+		eth := header.Ethernet(b.views[0][e.vnetHdrSize:])
 		p = eth.Type()
 		addr = eth.SourceAddress()
+		dst = eth.DestinationAddress()
 	} else {
 		// We don't get any indication of what the packet is, so try to guess
 		// if it's an IPv4 or IPv6 packet.
-		switch header.IPVersion(e.views[0]) {
+		switch header.IPVersion(b.views[0][e.vnetHdrSize:]) {
 		case header.IPv4Version:
 			p = header.IPv4ProtocolNumber
 		case header.IPv6Version:
@@ -199,29 +614,40 @@ func (e *endpoint) dispatch(d stack.NetworkDispatcher, largeV buffer.View) (bool
 		}
 	}
 
-	used := e.capViews(n, BufConfig)
-	e.vv.SetViews(e.views[:used])
+	// The buffer is handed over to the stack along with the packet, and
+	// the endpoint releases its own reference once the packet is
+	// delivered.
+	e.rx = nil
+	atomic.AddInt64(&e.rxHeld, 1)
+	used := b.capViews(n)
+	e.vv.SetViews(b.vvViews[:used])
 	e.vv.SetSize(n)
-	e.vv.TrimFront(e.hdrSize)
-
-	d.DeliverNetworkPacket(e, addr, p, e.vv)
+	e.vv.SetBuffer(b.pb)
+	e.vv.TrimFront(e.vnetHdrSize + e.hdrSize)
 
-	// Prepare e.views for another packet: release used views.
-	for i := 0; i < used; i++ {
-		e.views[i] = nil
+	if e.hdrSize > 0 {
+		stack.DeliverFrame(d, e, addr, dst, p, e.vv, checksumValidated)
+	} else {
+		d.DeliverNetworkPacket(e, addr, p, e.vv, checksumValidated)
 	}
+	e.vv.Release()
 
 	return true, nil
 }
 
 // dispatchLoop reads packets from the file descriptor in a loop and dispatches
-// them to the network stack.
-func (e *endpoint) dispatchLoop(d stack.NetworkDispatcher) *tcpip.Error {
-	v := buffer.NewView(header.MaxIPPacketSize)
+// them to the network stack, until the endpoint is closed or the file
+// descriptor can't be read anymore. It closes stopFD and done when it exits.
+func (e *endpoint) dispatchLoop(d stack.NetworkDispatcher, stopFD int, done chan struct{}) *tcpip.Error {
+	defer close(done)
+	defer syscall.Close(stopFD)
+
 	for {
-		cont, err := e.dispatch(d, v)
+		cont, err := e.dispatch(d, stopFD)
 		if err != nil || !cont {
-			if e.closed != nil {
+			// The closed callback reports the peer going away, not
+			// the endpoint being closed.
+			if e.closed != nil && !e.closing() {
 				e.closed(err)
 			}
 			return err
@@ -245,7 +671,7 @@ func (e *InjectableEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
 
 // Inject injects an inbound packet.
 func (e *InjectableEndpoint) Inject(protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
-	e.dispatcher.DeliverNetworkPacket(e, "", protocol, vv)
+	e.dispatcher.DeliverNetworkPacket(e, "", protocol, vv, false)
 }
 
 // NewInjectable creates a new fd-based InjectableEndpoint.
@@ -5,9 +5,13 @@
 package fdbased
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
+	"os"
 	"reflect"
+	"runtime"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -15,13 +19,19 @@ import (
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/batch"
+	"github.com/google/netstack/tcpip/network/ipv4"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
 )
 
 type packetInfo struct {
-	raddr    tcpip.LinkAddress
-	proto    tcpip.NetworkProtocolNumber
-	contents buffer.View
+	raddr             tcpip.LinkAddress
+	proto             tcpip.NetworkProtocolNumber
+	contents          buffer.View
+	checksumValidated bool
 }
 
 type context struct {
@@ -65,8 +75,8 @@ func (c *context) cleanup() {
 	syscall.Close(c.fds[1])
 }
 
-func (c *context) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
-	c.ch <- packetInfo{remoteLinkAddr, protocol, vv.ToView()}
+func (c *context) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
+	c.ch <- packetInfo{remoteLinkAddr, protocol, vv.ToView(), checksumValidated}
 }
 
 func TestNoEthernetProperties(t *testing.T) {
@@ -146,7 +156,7 @@ func TestWritePacket(t *testing.T) {
 					payload[i] = uint8(rand.Intn(256))
 				}
 				want := append(hdr.UsedBytes(), payload...)
-				if err := c.ep.WritePacket(r, &hdr, payload, proto); err != nil {
+				if err := c.ep.WritePacket(r, nil, &hdr, payload, proto); err != nil {
 					t.Fatalf("WritePacket failed: %v", err)
 				}
 
@@ -184,6 +194,169 @@ func TestWritePacket(t *testing.T) {
 	}
 }
 
+func TestWritePackets(t *testing.T) {
+	const (
+		mtu   = 1500
+		laddr = tcpip.LinkAddress("\x11\x22\x33\x44\x55\x66")
+		raddr = tcpip.LinkAddress("\x77\x88\x99\xaa\xbb\xcc")
+		proto = 10
+	)
+
+	// newPackets returns packets whose payloads are of the given lengths,
+	// and what each of them is expected to be written as.
+	newPackets := func(lengths ...int) ([]batch.Packet, [][]byte) {
+		var pkts []batch.Packet
+		var want [][]byte
+		for i, plen := range lengths {
+			hdr := buffer.NewPrependable(header.EthernetMinimumSize + 20)
+			b := hdr.Prepend(20)
+			for j := range b {
+				b[j] = byte(i)
+			}
+			payload := make([]byte, plen)
+			for j := range payload {
+				payload[j] = uint8(rand.Intn(256))
+			}
+			eth := make([]byte, header.EthernetMinimumSize)
+			header.Ethernet(eth).Encode(&header.EthernetFields{
+				DstAddr: raddr,
+				SrcAddr: laddr,
+				Type:    proto,
+			})
+			want = append(want, append(append(eth, b...), payload...))
+			pkts = append(pkts, batch.Packet{
+				Route:    stack.Route{RemoteLinkAddress: raddr},
+				Header:   hdr,
+				Payload:  payload,
+				Protocol: proto,
+			})
+		}
+		return pkts, want
+	}
+
+	t.Run("Socket", func(t *testing.T) {
+		c := newContext(t, &Options{Address: laddr, MTU: mtu, EthernetHeader: true})
+		defer c.cleanup()
+
+		pkts, want := newPackets(0, 100, 1000)
+		if err := c.ep.(batch.PacketsWriter).WritePackets(pkts); err != nil {
+			t.Fatalf("WritePackets failed: %v", err)
+		}
+
+		// Each packet is read as a separate frame.
+		for i := range want {
+			b := make([]byte, mtu)
+			n, err := syscall.Read(c.fds[0], b)
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if !bytes.Equal(b[:n], want[i]) {
+				t.Fatalf("packet %d: Read returned %x, want %x", i, b[:n], want[i])
+			}
+		}
+	})
+
+	t.Run("Pipe", func(t *testing.T) {
+		var fds [2]int
+		if err := syscall.Pipe(fds[:]); err != nil {
+			t.Fatalf("Pipe failed: %v", err)
+		}
+		defer syscall.Close(fds[0])
+		defer syscall.Close(fds[1])
+		ep := stack.FindLinkEndpoint(New(&Options{FD: fds[1], Address: laddr, MTU: mtu, EthernetHeader: true}))
+
+		pkts, want := newPackets(0, 100, 1000)
+		if err := ep.(batch.PacketsWriter).WritePackets(pkts); err != nil {
+			t.Fatalf("WritePackets failed: %v", err)
+		}
+
+		all := bytes.Join(want, nil)
+		b := make([]byte, len(all)+1)
+		n, err := syscall.Read(fds[0], b)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(b[:n], all) {
+			t.Fatalf("Read returned %x, want %x", b[:n], all)
+		}
+	})
+}
+
+func TestMulticastFilter(t *testing.T) {
+	const addr = tcpip.LinkAddress("\x01\x00\x5e\x00\x00\x01")
+
+	// Sockets that aren't bound to an interface, like other file
+	// descriptors that aren't packet sockets, deliver all multicast
+	// frames already.
+	c := newContext(t, &Options{MTU: 1500, EthernetHeader: true})
+	defer c.cleanup()
+	mep := c.ep.(stack.MulticastLinkEndpoint)
+	if err := mep.AddMulticastFilter(addr); err != nil {
+		t.Errorf("AddMulticastFilter failed: %v", err)
+	}
+	if err := mep.RemoveMulticastFilter(addr); err != nil {
+		t.Errorf("RemoveMulticastFilter failed: %v", err)
+	}
+
+	// The filter of a file descriptor that can't be inspected isn't
+	// reported as programmed.
+	mep = stack.FindLinkEndpoint(New(&Options{FD: -1, MTU: 1500, EthernetHeader: true})).(stack.MulticastLinkEndpoint)
+	if err := mep.AddMulticastFilter(addr); err == nil {
+		t.Errorf("AddMulticastFilter succeeded on an invalid FD")
+	}
+}
+
+func TestSetLinkAddress(t *testing.T) {
+	const (
+		mtu    = 1500
+		laddr1 = tcpip.LinkAddress("\x11\x22\x33\x44\x55\x66")
+		laddr2 = tcpip.LinkAddress("\x11\x22\x33\x44\x55\x77")
+		raddr  = tcpip.LinkAddress("\x77\x88\x99\xaa\xbb\xcc")
+		proto  = 10
+	)
+
+	c := newContext(t, &Options{Address: laddr1, MTU: mtu, EthernetHeader: true})
+	defer c.cleanup()
+
+	// The same route is used before and after the change.
+	r := &stack.Route{
+		RemoteLinkAddress: raddr,
+	}
+	for _, want := range []tcpip.LinkAddress{laddr1, laddr2} {
+		if err := c.ep.(stack.LinkAddressSetter).SetLinkAddress(want); err != nil {
+			t.Fatalf("SetLinkAddress(%q) failed: %v", want, err)
+		}
+		if got := c.ep.LinkAddress(); got != want {
+			t.Fatalf("LinkAddress() = %q, want %q", got, want)
+		}
+
+		hdr := buffer.NewPrependable(int(c.ep.MaxHeaderLength()))
+		if err := c.ep.WritePacket(r, nil, &hdr, nil, proto); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+
+		b := make([]byte, mtu)
+		n, err := syscall.Read(c.fds[0], b)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		eth := header.Ethernet(b[:n])
+		if got := eth.SourceAddress(); got != want {
+			t.Fatalf("got source address %q, want %q", got, want)
+		}
+		if got := eth.DestinationAddress(); got != raddr {
+			t.Fatalf("got destination address %q, want %q", got, raddr)
+		}
+	}
+
+	// Endpoints without ethernet headers have no link address to change.
+	c2 := newContext(t, &Options{MTU: mtu})
+	defer c2.cleanup()
+	if err := c2.ep.(stack.LinkAddressSetter).SetLinkAddress(laddr2); err != tcpip.ErrNotSupported {
+		t.Fatalf("SetLinkAddress = %v, want %v", err, tcpip.ErrNotSupported)
+	}
+}
+
 func TestDeliverPacket(t *testing.T) {
 	const (
 		mtu   = 1500
@@ -249,6 +422,73 @@ func TestDeliverPacket(t *testing.T) {
 	}
 }
 
+func TestVirtioNetHeader(t *testing.T) {
+	const (
+		mtu   = 1500
+		laddr = tcpip.LinkAddress("\x11\x22\x33\x44\x55\x66")
+		raddr = tcpip.LinkAddress("\x77\x88\x99\xaa\xbb\xcc")
+		proto = 10
+	)
+
+	c := newContext(t, &Options{Address: laddr, MTU: mtu, EthernetHeader: true, VirtioNetHeader: true})
+	defer c.cleanup()
+
+	// Outbound packets must be prefixed by an empty virtio-net header.
+	hdr := buffer.NewPrependable(int(c.ep.MaxHeaderLength()) + 100)
+	copy(hdr.Prepend(100), bytes.Repeat([]byte{0xff}, 100))
+	r := &stack.Route{RemoteLinkAddress: raddr}
+	if err := c.ep.WritePacket(r, nil, &hdr, nil, proto); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	b := make([]byte, mtu)
+	n, err := syscall.Read(c.fds[0], b)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if want := virtioNetHdrSize + header.EthernetMinimumSize + 100; n != want {
+		t.Fatalf("Read returned %v bytes, want %v", n, want)
+	}
+	if got, want := b[:virtioNetHdrSize], make([]byte, virtioNetHdrSize); !bytes.Equal(got, want) {
+		t.Fatalf("Got virtio-net header %x, want %x", got, want)
+	}
+	if et := header.Ethernet(b[virtioNetHdrSize:]).Type(); et != proto {
+		t.Fatalf("Type() = %v, want %v", et, proto)
+	}
+
+	// Inbound packets are only marked as validated if the header says so.
+	for _, valid := range []bool{false, true} {
+		vnetHdr := make([]byte, virtioNetHdrSize)
+		if valid {
+			vnetHdr[0] = virtioNetHdrFDataValid
+		}
+		eth := make(header.Ethernet, header.EthernetMinimumSize)
+		eth.Encode(&header.EthernetFields{
+			SrcAddr: raddr,
+			DstAddr: laddr,
+			Type:    proto,
+		})
+		payload := bytes.Repeat([]byte{0xaa}, 100)
+		if _, err := syscall.Write(c.fds[0], append(append(vnetHdr, eth...), payload...)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		select {
+		case pi := <-c.ch:
+			want := packetInfo{
+				raddr:             raddr,
+				proto:             proto,
+				contents:          payload,
+				checksumValidated: valid,
+			}
+			if !reflect.DeepEqual(want, pi) {
+				t.Fatalf("Unexpected received packet: %+v, want %+v", pi, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for packet")
+		}
+	}
+}
+
 func TestBufConfigMaxLength(t *testing.T) {
 	got := 0
 	for _, i := range BufConfig {
@@ -271,13 +511,641 @@ func TestBufConfigFirst(t *testing.T) {
 	}
 }
 
-func build(bufConfig []int) *endpoint {
-	e := &endpoint{
-		views:  make([]buffer.View, len(bufConfig)),
-		iovecs: make([]syscall.Iovec, len(bufConfig)),
+func TestRxBufConfig(t *testing.T) {
+	for _, tc := range []struct {
+		frameSize int
+		want      []int
+	}{
+		{0, BufConfig},
+		{100, []int{100}},
+		{1514, []int{128, 256, 256, 512, 362}},
+		{9014, []int{128, 256, 256, 512, 1024, 2048, 4096, 694}},
+		{100000, append(append([]int(nil), BufConfig...), 100000-65664)},
+	} {
+		if got := rxBufConfig(tc.frameSize); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("rxBufConfig(%d) = %v, want %v", tc.frameSize, got, tc.want)
+		}
+	}
+}
+
+func TestSetMTU(t *testing.T) {
+	c := newContext(t, &Options{MTU: 1500})
+	defer c.cleanup()
+
+	send := func(size int) buffer.View {
+		b := make([]byte, size)
+		for i := range b {
+			b[i] = uint8(rand.Intn(256))
+		}
+		// So that it looks like an IPv4 packet.
+		b[0] = 0x40
+		if _, err := syscall.Write(c.fds[0], b); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		select {
+		case pi := <-c.ch:
+			if !bytes.Equal(pi.contents, b[:len(pi.contents)]) {
+				t.Fatalf("Received packet doesn't match the sent one")
+			}
+			return pi.contents
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Timed out waiting for packet")
+		}
+		return nil
+	}
+
+	// Frames larger than the MTU don't fit in the buffers.
+	if got := len(send(8000)); got != 1500 {
+		t.Fatalf("got %d bytes, want 1500", got)
+	}
+
+	if err := c.ep.(stack.LinkMTUSetter).SetMTU(9000); err != nil {
+		t.Fatalf("SetMTU failed: %v", err)
+	}
+	if got := c.ep.MTU(); got != 9000 {
+		t.Fatalf("MTU() = %v, want 9000", got)
+	}
+	if got := len(send(8000)); got != 8000 {
+		t.Fatalf("got %d bytes, want 8000", got)
+	}
+	if got := len(send(100)); got != 100 {
+		t.Fatalf("got %d bytes, want 100", got)
+	}
+}
+
+// newJumboStack creates a stack with a single NIC backed by an fd-based endpoint
+// on fd, and returns the endpoint too.
+func newJumboStack(t testing.TB, fd int, mtu uint32, addr, peer tcpip.Address) (*stack.Stack, *endpoint) {
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+	id := New(&Options{FD: fd, MTU: mtu})
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: peer,
+		Mask:        "\xff\xff\xff\xff",
+		NIC:         1,
+	}})
+	return s, stack.FindLinkEndpoint(id).(*endpoint)
+}
+
+func TestJumboFrames(t *testing.T) {
+	const (
+		mtu      = 9000
+		size     = 8000
+		addr1    = tcpip.Address("\x0a\x00\x00\x01")
+		addr2    = tcpip.Address("\x0a\x00\x00\x02")
+		port     = 1234
+		attempts = 3
+	)
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	// The NICs are removed before the file descriptors are closed, so
+	// that the endpoints stop reading them.
+	s1, _ := newJumboStack(t, fds[0], mtu, addr1, addr2)
+	defer s1.DeleteNIC(1)
+	s2, _ := newJumboStack(t, fds[1], mtu, addr2, addr1)
+	defer s2.DeleteNIC(1)
+
+	var wq waiter.Queue
+	rcv, tcpErr := s2.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if tcpErr != nil {
+		t.Fatalf("NewEndpoint failed: %v", tcpErr)
+	}
+	defer rcv.Close()
+	if err := rcv.Bind(tcpip.FullAddress{Port: port}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	snd, tcpErr := s1.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if tcpErr != nil {
+		t.Fatalf("NewEndpoint failed: %v", tcpErr)
+	}
+	defer snd.Close()
+
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = uint8(rand.Intn(256))
+	}
+	for i := 0; i < attempts; i++ {
+		if _, err := snd.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addr2, Port: port}}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		v, _, err := rcv.Read(nil)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-ch:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for datagram")
+			}
+			v, _, err = rcv.Read(nil)
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(v, payload) {
+			t.Fatalf("got %d bytes, want the %d bytes sent", len(v), len(payload))
+		}
+	}
+
+	// Each datagram was sent in a single, unfragmented, packet.
+	stats, tcpErr := s2.NICStats(1)
+	if tcpErr != nil {
+		t.Fatalf("NICStats failed: %v", tcpErr)
+	}
+	if stats.RxPackets != attempts || stats.RxMalformedPackets != 0 {
+		t.Fatalf("got %d packets received, %d malformed, want %d and 0", stats.RxPackets, stats.RxMalformedPackets, attempts)
+	}
+}
+
+// connectTCP connects a TCP endpoint of s1 to one of s2 listening on port, and
+// returns them with a channel notified when the latter is readable. cleanup
+// closes them.
+func connectTCP(t testing.TB, s1, s2 *stack.Stack, addr tcpip.Address, port uint16) (client, server tcpip.Endpoint, readable <-chan struct{}, cleanup func()) {
+	var wq waiter.Queue
+	listener, err := s2.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Port: port}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := listener.Listen(1); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	var cwq waiter.Queue
+	client, err = s1.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &cwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	cwe, cch := waiter.NewChannelEntry(nil)
+	cwq.EventRegister(&cwe, waiter.EventOut)
+	defer cwq.EventUnregister(&cwe)
+	if err := client.Connect(tcpip.FullAddress{Addr: addr, Port: port}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("got Connect = %v, want %v", err, tcpip.ErrConnectStarted)
+	}
+	select {
+	case <-cch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the connection")
+	}
+
+	server, swq, err := listener.Accept()
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the connection")
+		}
+		server, swq, err = listener.Accept()
+	}
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	swe, sch := waiter.NewChannelEntry(nil)
+	swq.EventRegister(&swe, waiter.EventIn)
+
+	return client, server, sch, func() {
+		swq.EventUnregister(&swe)
+		server.Close()
+		client.Close()
+	}
+}
+
+// readFull reads n bytes from ep, waiting on readable when there's nothing to
+// read.
+func readFull(t testing.TB, ep tcpip.Endpoint, readable <-chan struct{}, n int) []byte {
+	var b []byte
+	for len(b) < n {
+		v, _, err := ep.Read(nil)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-readable:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for data")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		b = append(b, v...)
+	}
+	return b
+}
+
+// waitRxHeld waits for the stack to hold want of the buffers of e.
+func waitRxHeld(t *testing.T, e *endpoint, want int64) {
+	t.Helper()
+	got := atomic.LoadInt64(&e.rxHeld)
+	for deadline := time.Now().Add(5 * time.Second); got != want && time.Now().Before(deadline); got = atomic.LoadInt64(&e.rxHeld) {
+		time.Sleep(time.Millisecond)
+	}
+	if got != want {
+		t.Fatalf("got %d buffers held by the stack, want %d", got, want)
+	}
+}
+
+func TestPacketBuffersReleased(t *testing.T) {
+	const (
+		mtu       = 1500
+		addr1     = tcpip.Address("\x0a\x00\x00\x01")
+		addr2     = tcpip.Address("\x0a\x00\x00\x02")
+		port      = 1234
+		datagrams = 20
+	)
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	s1, e1 := newJumboStack(t, fds[0], mtu, addr1, addr2)
+	defer s1.DeleteNIC(1)
+	s2, e2 := newJumboStack(t, fds[1], mtu, addr2, addr1)
+	defer s2.DeleteNIC(1)
+
+	payload := func(i, size int) []byte {
+		b := make([]byte, size)
+		for j := range b {
+			b[j] = byte(i + j)
+		}
+		return b
+	}
+
+	// Queued datagrams hold their buffers until they're read, and those
+	// that are dropped don't hold them at all.
+	rcv, tcpErr := s2.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if tcpErr != nil {
+		t.Fatalf("NewEndpoint failed: %v", tcpErr)
+	}
+	defer rcv.Close()
+	if err := rcv.Bind(tcpip.FullAddress{Port: port}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	snd, tcpErr := s1.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if tcpErr != nil {
+		t.Fatalf("NewEndpoint failed: %v", tcpErr)
+	}
+	defer snd.Close()
+	for i := 0; i < datagrams; i++ {
+		for _, p := range []uint16{port, port + 1} {
+			if _, err := snd.Write(tcpip.SlicePayload(payload(i, 100)), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addr2, Port: p}}); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+	}
+	waitRxHeld(t, e2, datagrams)
+	for i := 0; i < datagrams; i++ {
+		v, _, err := rcv.Read(nil)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(v, payload(i, 100)) {
+			t.Fatalf("got datagram %d = %v, want %v", i, v, payload(i, 100))
+		}
+	}
+	waitRxHeld(t, e2, 0)
+
+	// Segments hold their buffers until their data is read, and the data
+	// isn't overwritten when the buffers are reused.
+	client, server, readable, cleanup := connectTCP(t, s1, s2, addr2, port)
+	defer cleanup()
+	data := payload(0, 20000)
+	if _, err := client.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := readFull(t, server, readable, len(data)); !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes different from the %d bytes sent", len(got), len(data))
+	}
+	waitRxHeld(t, e1, 0)
+	waitRxHeld(t, e2, 0)
+}
+
+// BenchmarkTCPSend measures the rate at which data is sent from a stack to
+// another over a socket pair.
+func BenchmarkTCPSend(b *testing.B) {
+	const (
+		mtu   = 1500
+		addr1 = tcpip.Address("\x0a\x00\x00\x01")
+		addr2 = tcpip.Address("\x0a\x00\x00\x02")
+		port  = 1234
+		size  = 64 << 10
+	)
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		b.Fatalf("Socketpair failed: %v", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	s1, _ := newJumboStack(b, fds[0], mtu, addr1, addr2)
+	defer s1.DeleteNIC(1)
+	s2, _ := newJumboStack(b, fds[1], mtu, addr2, addr1)
+	defer s2.DeleteNIC(1)
+
+	client, server, readable, cleanup := connectTCP(b, s1, s2, addr2, port)
+	defer cleanup()
+
+	view := buffer.NewView(size)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := client.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+			b.Fatalf("Write failed: %v", err)
+		}
+		readFull(b, server, readable, size)
+	}
+}
+
+func TestReadViewHoldsPacketBuffers(t *testing.T) {
+	const (
+		mtu   = 1500
+		addr1 = tcpip.Address("\x0a\x00\x00\x01")
+		addr2 = tcpip.Address("\x0a\x00\x00\x02")
+		port  = 1234
+	)
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	s1, _ := newJumboStack(t, fds[0], mtu, addr1, addr2)
+	defer s1.DeleteNIC(1)
+	s2, e2 := newJumboStack(t, fds[1], mtu, addr2, addr1)
+	defer s2.DeleteNIC(1)
+
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// A datagram read as views holds its buffer until they're released.
+	rcv, tcpErr := s2.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if tcpErr != nil {
+		t.Fatalf("NewEndpoint failed: %v", tcpErr)
+	}
+	defer rcv.Close()
+	if err := rcv.Bind(tcpip.FullAddress{Port: port}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	snd, tcpErr := s1.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+	if tcpErr != nil {
+		t.Fatalf("NewEndpoint failed: %v", tcpErr)
+	}
+	defer snd.Close()
+	if _, err := snd.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addr2, Port: port}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	waitRxHeld(t, e2, 1)
+	vv, _, tcpErr := rcv.(tcpip.ViewEndpoint).ReadView(len(data), nil)
+	if tcpErr != nil {
+		t.Fatalf("ReadView failed: %v", tcpErr)
+	}
+	waitRxHeld(t, e2, 1)
+	if got := vv.ToView(); !bytes.Equal(got, data) {
+		t.Fatalf("got ReadView() = %v, want %v", got, data)
+	}
+	vv.Release()
+	waitRxHeld(t, e2, 0)
+
+	// So does data read from a segment, whether the segment was read in
+	// full or not.
+	client, server, readable, cleanup := connectTCP(t, s1, s2, addr2, port)
+	defer cleanup()
+	if _, err := client.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case <-readable:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for data")
+	}
+	var vvs []buffer.VectorisedView
+	var got []byte
+	for _, n := range []int{10, len(data)} {
+		vv, _, err := server.(tcpip.ViewEndpoint).ReadView(n, nil)
+		if err != nil {
+			t.Fatalf("ReadView(%d) failed: %v", n, err)
+		}
+		vvs = append(vvs, vv)
+		got = append(got, vv.ToView()...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %v, want %v", got, data)
+	}
+	for _, vv := range vvs {
+		waitRxHeld(t, e2, 1)
+		vv.Release()
+	}
+	waitRxHeld(t, e2, 0)
+}
+
+// BenchmarkTCPReceive compares the rate at which data sent from a stack to
+// another over a socket pair is read by copying it, and in place.
+func BenchmarkTCPReceive(b *testing.B) {
+	const (
+		mtu   = 1500
+		addr1 = tcpip.Address("\x0a\x00\x00\x01")
+		addr2 = tcpip.Address("\x0a\x00\x00\x02")
+		port  = 1234
+		size  = 64 << 10
+	)
+
+	read := func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		v, _, err := ep.Read(nil)
+		return len(v), err
+	}
+	readView := func(ep tcpip.Endpoint) (int, *tcpip.Error) {
+		vv, _, err := ep.(tcpip.ViewEndpoint).ReadView(size, nil)
+		n := vv.Size()
+		vv.Release()
+		return n, err
+	}
+	for _, bm := range []struct {
+		name string
+		read func(tcpip.Endpoint) (int, *tcpip.Error)
+	}{
+		{"Read", read},
+		{"ReadView", readView},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+			if err != nil {
+				b.Fatalf("Socketpair failed: %v", err)
+			}
+			defer syscall.Close(fds[0])
+			defer syscall.Close(fds[1])
+
+			s1, _ := newJumboStack(b, fds[0], mtu, addr1, addr2)
+			defer s1.DeleteNIC(1)
+			s2, _ := newJumboStack(b, fds[1], mtu, addr2, addr1)
+			defer s2.DeleteNIC(1)
+
+			client, server, readable, cleanup := connectTCP(b, s1, s2, addr2, port)
+			defer cleanup()
+
+			view := buffer.NewView(size)
+			b.SetBytes(size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := client.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+					b.Fatalf("Write failed: %v", err)
+				}
+				for got := 0; got < size; {
+					n, err := bm.read(server)
+					if err == tcpip.ErrWouldBlock {
+						select {
+						case <-readable:
+						case <-time.After(5 * time.Second):
+							b.Fatalf("Timed out waiting for data")
+						}
+						continue
+					}
+					if err != nil {
+						b.Fatalf("Read failed: %v", err)
+					}
+					got += n
+				}
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatalf("Socketpair failed: %v", err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	closed := make(chan *tcpip.Error, 1)
+	ep := stack.FindLinkEndpoint(New(&Options{
+		FD:         fds[1],
+		MTU:        1500,
+		ClosedFunc: func(err *tcpip.Error) { closed <- err },
+	})).(*endpoint)
+	c := &context{t: t, ch: make(chan packetInfo, 100)}
+	ep.Attach(c)
+
+	// The dispatch goroutine is blocked reading when the endpoint is
+	// closed, and must be woken up.
+	b := []byte{0x40, 1, 2, 3}
+	if _, err := syscall.Write(fds[0], b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case <-c.ch:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for packet")
+	}
+
+	ep.Close()
+
+	// Packets that arrive after Close aren't delivered, and closing the
+	// endpoint isn't reported as the peer going away.
+	if _, err := syscall.Write(fds[0], b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case <-c.ch:
+		t.Fatalf("Packet delivered after Close")
+	case err := <-closed:
+		t.Fatalf("ClosedFunc called with %v after Close", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	hdr := buffer.NewPrependable(int(ep.MaxHeaderLength()))
+	if err := ep.WritePacket(&stack.Route{}, nil, &hdr, buffer.View("payload"), header.IPv4ProtocolNumber); err != tcpip.ErrClosedForSend {
+		t.Fatalf("WritePacket after Close = %v, want %v", err, tcpip.ErrClosedForSend)
+	}
+
+	// Closing again is harmless.
+	ep.Close()
+}
+
+// openFDs returns the number of file descriptors open in the process.
+func openFDs(t *testing.T) int {
+	f, err := os.Open("/proc/self/fd")
+	if err != nil {
+		t.Skipf("Can't count open file descriptors: %v", err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		t.Fatalf("Readdirnames failed: %v", err)
+	}
+	return len(names)
+}
+
+func TestDeleteNICLeaks(t *testing.T) {
+	const nics = 100
+
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+
+	// Let goroutines from previous tests exit.
+	time.Sleep(50 * time.Millisecond)
+	goroutines := runtime.NumGoroutine()
+	fdCount := openFDs(t)
+
+	for i := 0; i < nics; i++ {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+		if err != nil {
+			t.Fatalf("Socketpair failed: %v", err)
+		}
+		if err := s.CreateNIC(1, New(&Options{FD: fds[1], MTU: 1500})); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+		if err := s.AddAddress(1, ipv4.ProtocolNumber, "\x0a\x00\x00\x01"); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+		if err := s.DeleteNIC(1); err != nil {
+			t.Fatalf("DeleteNIC failed: %v", err)
+		}
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+	}
+
+	if got := openFDs(t); got != fdCount {
+		t.Errorf("got %d open file descriptors, want %d", got, fdCount)
+	}
+
+	// Goroutines may take a moment to exit after signaling it.
+	got := runtime.NumGoroutine()
+	for deadline := time.Now().Add(5 * time.Second); got > goroutines && time.Now().Before(deadline); got = runtime.NumGoroutine() {
+		time.Sleep(time.Millisecond)
+	}
+	if got > goroutines {
+		t.Errorf("got %d goroutines, want at most %d", got, goroutines)
 	}
-	e.allocateViews(bufConfig)
-	return e
 }
 
 var capLengthTestCases = []struct {
@@ -319,13 +1187,13 @@ var capLengthTestCases = []struct {
 
 func TestCapLength(t *testing.T) {
 	for _, c := range capLengthTestCases {
-		e := build(c.config)
-		used := e.capViews(c.n, c.config)
+		b := newRxBuffer(c.config)
+		used := b.capViews(c.n)
 		if used != c.wantUsed {
 			t.Errorf("Test \"%s\" failed when calling capViews(%d, %v). Got %d. Want %d", c.comment, c.n, c.config, used, c.wantUsed)
 		}
-		lengths := make([]int, len(e.views))
-		for i, v := range e.views {
+		lengths := make([]int, len(b.vvViews))
+		for i, v := range b.vvViews {
 			lengths[i] = len(v)
 		}
 		if !reflect.DeepEqual(lengths, c.wantLengths) {
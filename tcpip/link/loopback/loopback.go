@@ -39,9 +39,10 @@ func (*endpoint) MTU() uint32 {
 }
 
 // Capabilities implements stack.LinkEndpoint.Capabilities. Loopback advertises
-// itself as supporting checksum offload, but in reality it's just omitted.
+// itself as supporting checksum offload, but in reality it's just omitted,
+// unless the stack forces checksums with SetLoopbackChecksums.
 func (*endpoint) Capabilities() stack.LinkEndpointCapabilities {
-	return stack.CapabilityChecksumOffload
+	return stack.CapabilityChecksumOffload | stack.CapabilityLoopback
 }
 
 // MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. Given that the
@@ -56,19 +57,12 @@ func (*endpoint) LinkAddress() tcpip.LinkAddress {
 }
 
 // WritePacket implements stack.LinkEndpoint.WritePacket. It delivers outbound
-// packets to the network-layer dispatcher.
-func (e *endpoint) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
-	if len(payload) == 0 {
-		// We don't have a payload, so just use the buffer from the
-		// header as the full packet.
-		v := hdr.View()
-		vv := v.ToVectorisedView([1]buffer.View{})
-		e.dispatcher.DeliverNetworkPacket(e, "", protocol, &vv)
-	} else {
-		views := []buffer.View{hdr.View(), payload}
-		vv := buffer.NewVectorisedView(len(views[0])+len(views[1]), views)
-		e.dispatcher.DeliverNetworkPacket(e, "", protocol, &vv)
-	}
+// packets to the network-layer dispatcher. The packets never leave the host, so
+// they're marked as having their checksums validated.
+func (e *endpoint) WritePacket(_ *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	// The headers are copied if they're reused once the call returns.
+	vv := hdr.ToVectorisedView(payload)
+	e.dispatcher.DeliverNetworkPacket(e, "", protocol, &vv, true)
 
 	return nil
 }
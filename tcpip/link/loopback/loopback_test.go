@@ -0,0 +1,207 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loopback_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	nicID     = 1
+	localAddr = "\x7f\x00\x00\x01"
+	srcPort   = 1000
+	dstPort   = 2000
+)
+
+type testContext struct {
+	t      testing.TB
+	s      *stack.Stack
+	linkEP stack.LinkEndpoint
+	ep     tcpip.Endpoint
+}
+
+func newTestContext(t testing.TB) *testContext {
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+
+	id := loopback.New()
+	if err := s.CreateNIC(nicID, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(nicID, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x7f\x00\x00\x00",
+		Mask:        "\xff\x00\x00\x00",
+		NIC:         nicID,
+	}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Addr: localAddr, Port: dstPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	return &testContext{t: t, s: s, linkEP: stack.FindLinkEndpoint(id), ep: ep}
+}
+
+func (c *testContext) cleanup() {
+	c.ep.Close()
+}
+
+// loopPacket sends a datagram to the endpoint through the loopback link, with
+// a checksum that doesn't match its payload if corrupt is set.
+func (c *testContext) loopPacket(payload []byte, corrupt bool) {
+	hdr := buffer.NewPrependable(header.IPv4MinimumSize + header.UDPMinimumSize)
+	length := uint16(header.UDPMinimumSize + len(payload))
+
+	u := header.UDP(hdr.Prepend(header.UDPMinimumSize))
+	u.Encode(&header.UDPFields{
+		SrcPort: srcPort,
+		DstPort: dstPort,
+		Length:  length,
+	})
+	xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, localAddr, localAddr)
+	xsum = header.Checksum(payload, xsum)
+	xsum = u.CalculateChecksum(xsum, length)
+	if corrupt {
+		xsum++
+	}
+	u.SetChecksum(^xsum)
+
+	ip := header.IPv4(hdr.Prepend(header.IPv4MinimumSize))
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(hdr.UsedLength() + len(payload)),
+		TTL:         64,
+		Protocol:    uint8(udp.ProtocolNumber),
+		SrcAddr:     localAddr,
+		DstAddr:     localAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	if err := c.linkEP.WritePacket(nil, nil, &hdr, payload, ipv4.ProtocolNumber); err != nil {
+		c.t.Fatalf("WritePacket failed: %v", err)
+	}
+}
+
+// expectRead checks whether the endpoint has a datagram to read.
+func (c *testContext) expectRead(want bool) {
+	_, _, err := c.ep.Read(nil)
+	if want && err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	if !want && err != tcpip.ErrWouldBlock {
+		c.t.Fatalf("got Read = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestChecksumsSkipped(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	if c.s.LoopbackChecksums() {
+		t.Fatalf("got LoopbackChecksums() = true, want false")
+	}
+
+	// The link vouches for the checksum, wrong as it is.
+	c.loopPacket([]byte("hello"), true)
+	c.expectRead(true)
+
+	// Neither side computes checksums.
+	if _, err := c.ep.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: localAddr, Port: dstPort},
+	}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.expectRead(true)
+
+	stats := c.s.Stats()
+	if got := stats.ChecksumSkippedRcvdPackets.Value(); got != 2 {
+		t.Errorf("got ChecksumSkippedRcvdPackets = %d, want 2", got)
+	}
+	if got := stats.ChecksumVerifiedRcvdPackets.Value(); got != 0 {
+		t.Errorf("got ChecksumVerifiedRcvdPackets = %d, want 0", got)
+	}
+}
+
+func TestForcedChecksums(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	c.s.SetLoopbackChecksums(true)
+	if !c.s.LoopbackChecksums() {
+		t.Fatalf("got LoopbackChecksums() = false, want true")
+	}
+
+	// A corrupted datagram is detected and dropped.
+	c.loopPacket([]byte("hello"), true)
+	c.expectRead(false)
+	stats := c.s.Stats()
+	if got := stats.UDP.MalformedPacketsReceived.Value(); got != 1 {
+		t.Fatalf("got UDP.MalformedPacketsReceived = %d, want 1", got)
+	}
+
+	// An intact one goes through.
+	c.loopPacket([]byte("hello"), false)
+	c.expectRead(true)
+
+	// Datagrams sent by the stack carry a checksum that is verified.
+	if _, err := c.ep.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: localAddr, Port: dstPort},
+	}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.expectRead(true)
+
+	stats = c.s.Stats()
+	if got := stats.ChecksumSkippedRcvdPackets.Value(); got != 0 {
+		t.Errorf("got ChecksumSkippedRcvdPackets = %d, want 0", got)
+	}
+	if got := stats.ChecksumVerifiedRcvdPackets.Value(); got != 3 {
+		t.Errorf("got ChecksumVerifiedRcvdPackets = %d, want 3", got)
+	}
+}
+
+func BenchmarkLoopbackUDP(b *testing.B) {
+	for _, bm := range []struct {
+		name  string
+		force bool
+	}{
+		{"ChecksumOffload", false},
+		{"ForcedChecksums", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			c := newTestContext(b)
+			defer c.cleanup()
+			c.s.SetLoopbackChecksums(bm.force)
+
+			payload := tcpip.SlicePayload(make([]byte, 32<<10))
+			to := tcpip.FullAddress{Addr: localAddr, Port: dstPort}
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.ep.Write(payload, tcpip.WriteOptions{To: &to}); err != nil {
+					b.Fatalf("Write failed: %v", err)
+				}
+				if _, _, err := c.ep.Read(nil); err != nil {
+					b.Fatalf("Read failed: %v", err)
+				}
+			}
+		})
+	}
+}
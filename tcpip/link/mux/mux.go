@@ -0,0 +1,195 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mux provides the implementation of data-link layer endpoints that
+// wrap ethernet endpoints and demultiplex inbound frames by EtherType. Frames
+// of registered EtherTypes are delivered to the stack as usual, while all other
+// frames are handed to a raw frame handler, which can also send frames of its
+// own through the wrapped endpoint.
+//
+// Mux endpoints can be used in the networking stack by calling New(eID,
+// types...) to create a new endpoint, where eID is the ID of the endpoint being
+// wrapped, and then passing it as an argument to Stack.CreateNIC().
+package mux
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// RawHandler is called for inbound frames whose EtherType isn't registered
+// with a mux endpoint. remote is the link address the frame was sent from, if
+// known, and vv holds the frame's payload, after the ethernet header.
+//
+// The handler is called synchronously from the goroutine delivering the
+// frame, so it must not block. It must copy vv if it retains it.
+type RawHandler func(remote tcpip.LinkAddress, etherType tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView)
+
+// Endpoint is a link-layer endpoint that demultiplexes inbound frames by
+// EtherType.
+type Endpoint struct {
+	dispatcher stack.NetworkDispatcher
+	lower      stack.LinkEndpoint
+
+	// mu protects the fields below. It is only held for reading while
+	// frames are being delivered, so registrations can change at any time.
+	mu    sync.RWMutex
+	types map[tcpip.NetworkProtocolNumber]struct{}
+	raw   RawHandler
+}
+
+// New creates a new mux endpoint wrapping the given ethernet endpoint. Frames of
+// the given EtherTypes are delivered to the stack; the set can be changed with
+// Register and Unregister.
+func New(lower tcpip.LinkEndpointID, types ...tcpip.NetworkProtocolNumber) (tcpip.LinkEndpointID, *Endpoint) {
+	e := &Endpoint{
+		lower: stack.FindLinkEndpoint(lower),
+		types: make(map[tcpip.NetworkProtocolNumber]struct{}),
+	}
+	for _, t := range types {
+		e.types[t] = struct{}{}
+	}
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// Register causes inbound frames of the given EtherType to be delivered to the
+// stack.
+func (e *Endpoint) Register(etherType tcpip.NetworkProtocolNumber) {
+	e.mu.Lock()
+	e.types[etherType] = struct{}{}
+	e.mu.Unlock()
+}
+
+// Unregister causes inbound frames of the given EtherType to be handed to the
+// raw handler instead of the stack.
+func (e *Endpoint) Unregister(etherType tcpip.NetworkProtocolNumber) {
+	e.mu.Lock()
+	delete(e.types, etherType)
+	e.mu.Unlock()
+}
+
+// SetRawHandler sets the handler of inbound frames whose EtherType isn't
+// registered. Such frames are dropped if the handler is nil, which is the
+// default.
+func (e *Endpoint) SetRawHandler(h RawHandler) {
+	e.mu.Lock()
+	e.raw = h
+	e.mu.Unlock()
+}
+
+// WriteRawFrame sends a frame of the given EtherType and payload to the given
+// link address through the wrapped endpoint, which adds the ethernet header.
+func (e *Endpoint) WriteRawFrame(dst tcpip.LinkAddress, etherType tcpip.NetworkProtocolNumber, payload buffer.View) *tcpip.Error {
+	r := stack.Route{
+		LocalLinkAddress:  e.lower.LinkAddress(),
+		RemoteLinkAddress: dst,
+	}
+	hdr := buffer.NewPrependable(int(e.lower.MaxHeaderLength()))
+	return e.lower.WritePacket(&r, nil, &hdr, payload, etherType)
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.DeliverNetworkPacket.
+// It is called by the wrapped endpoint when a frame arrives, and hands the
+// frame to the stack or to the raw handler depending on its EtherType.
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
+	e.mu.RLock()
+	_, ok := e.types[protocol]
+	raw := e.raw
+	e.mu.RUnlock()
+
+	if ok {
+		e.dispatcher.DeliverNetworkPacket(e, remoteLinkAddr, protocol, vv, checksumValidated)
+		return
+	}
+	if raw != nil {
+		raw(remoteLinkAddr, protocol, vv)
+	}
+}
+
+// Attach implements stack.LinkEndpoint.Attach. It saves the dispatcher and
+// registers with the lower endpoint as its dispatcher so that "e" is called
+// for inbound frames.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// lower endpoint.
+func (e *Endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. It just
+// forwards the request to the lower endpoint.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.lower.LinkAddress()
+}
+
+// SetMTU implements stack.LinkMTUSetter.SetMTU. It just forwards the request
+// to the lower endpoint.
+func (e *Endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	if ep, ok := e.lower.(stack.LinkMTUSetter); ok {
+		return ep.SetMTU(mtu)
+	}
+	return tcpip.ErrNotSupported
+}
+
+// SetLinkAddress implements stack.LinkAddressSetter.SetLinkAddress. It just
+// forwards the request to the lower endpoint.
+func (e *Endpoint) SetLinkAddress(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.LinkAddressSetter); ok {
+		return ep.SetLinkAddress(addr)
+	}
+	return tcpip.ErrNotSupported
+}
+
+// AddMulticastFilter implements stack.MulticastLinkEndpoint.AddMulticastFilter.
+// It just forwards the request to the lower endpoint, if it filters multicast
+// frames.
+func (e *Endpoint) AddMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.MulticastLinkEndpoint); ok {
+		return ep.AddMulticastFilter(addr)
+	}
+	return nil
+}
+
+// RemoveMulticastFilter implements
+// stack.MulticastLinkEndpoint.RemoveMulticastFilter. It just forwards the
+// request to the lower endpoint, if it filters multicast frames.
+func (e *Endpoint) RemoveMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.MulticastLinkEndpoint); ok {
+		return ep.RemoveMulticastFilter(addr)
+	}
+	return nil
+}
+
+// Close implements stack.LinkEndpointCloser.Close. It just forwards the request
+// to the lower endpoint, if it can be closed.
+func (e *Endpoint) Close() {
+	if ep, ok := e.lower.(stack.LinkEndpointCloser); ok {
+		ep.Close()
+	}
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	return e.lower.WritePacket(r, csum, hdr, payload, protocol)
+}
@@ -0,0 +1,251 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mux_test
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/mux"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	stackAddr = tcpip.Address("\x0a\x00\x00\x01")
+	peerAddr  = tcpip.Address("\x0a\x00\x00\x02")
+	port      = 1234
+
+	// lldpEtherType is the EtherType of LLDP frames.
+	lldpEtherType = tcpip.NetworkProtocolNumber(0x88cc)
+)
+
+// rawFrame is a frame received by a raw handler.
+type rawFrame struct {
+	etherType tcpip.NetworkProtocolNumber
+	data      buffer.View
+}
+
+type testContext struct {
+	t   *testing.T
+	s   *stack.Stack
+	ch  *channel.Endpoint
+	mux *mux.Endpoint
+	ep  tcpip.Endpoint
+
+	mu  sync.Mutex
+	raw []rawFrame
+}
+
+func newTestContext(t *testing.T) *testContext {
+	c := &testContext{t: t}
+
+	var chID tcpip.LinkEndpointID
+	chID, c.ch = channel.New(10, 1500, "\x02\x00\x00\x00\x00\x01")
+	id, m := mux.New(chID, header.IPv4ProtocolNumber, header.ARPProtocolNumber)
+	c.mux = m
+	m.SetRawHandler(func(_ tcpip.LinkAddress, etherType tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+		c.mu.Lock()
+		c.raw = append(c.raw, rawFrame{etherType, vv.ToView()})
+		c.mu.Unlock()
+	})
+
+	c.s = stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	if err := c.s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := c.s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	c.s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: port}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	c.ep = ep
+
+	return c
+}
+
+func (c *testContext) cleanup() {
+	c.ep.Close()
+}
+
+// injectUDP injects an IPv4 packet holding a UDP datagram with the given
+// payload.
+func (c *testContext) injectUDP(payload string) {
+	size := header.IPv4MinimumSize + header.UDPMinimumSize + len(payload)
+	buf := buffer.NewView(size)
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(size),
+		TTL:         65,
+		Protocol:    uint8(udp.ProtocolNumber),
+		SrcAddr:     peerAddr,
+		DstAddr:     stackAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	u := header.UDP(buf[header.IPv4MinimumSize:])
+	u.Encode(&header.UDPFields{
+		SrcPort: port,
+		DstPort: port,
+		Length:  uint16(header.UDPMinimumSize + len(payload)),
+	})
+	copy(u.Payload(), payload)
+
+	vv := buf.ToVectorisedView([1]buffer.View{})
+	c.ch.Inject(header.IPv4ProtocolNumber, &vv)
+}
+
+// injectRaw injects a frame of the given EtherType and payload.
+func (c *testContext) injectRaw(etherType tcpip.NetworkProtocolNumber, payload string) {
+	buf := buffer.View(payload)
+	vv := buf.ToVectorisedView([1]buffer.View{})
+	c.ch.Inject(etherType, &vv)
+}
+
+// readUDP returns the datagrams received by the UDP endpoint.
+func (c *testContext) readUDP() []string {
+	var got []string
+	for {
+		v, _, err := c.ep.Read(nil)
+		if err != nil {
+			return got
+		}
+		got = append(got, string(v))
+	}
+}
+
+func (c *testContext) rawFrames() []rawFrame {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]rawFrame(nil), c.raw...)
+}
+
+func TestDemux(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	c.injectUDP("ip 1")
+	c.injectRaw(lldpEtherType, "lldp 1")
+	c.injectUDP("ip 2")
+	c.injectRaw(0x88b5, "local experimental")
+	c.injectRaw(lldpEtherType, "lldp 2")
+	c.injectUDP("ip 3")
+
+	if got, want := c.readUDP(), []string{"ip 1", "ip 2", "ip 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got datagrams %q, want %q", got, want)
+	}
+
+	want := []rawFrame{
+		{lldpEtherType, buffer.View("lldp 1")},
+		{0x88b5, buffer.View("local experimental")},
+		{lldpEtherType, buffer.View("lldp 2")},
+	}
+	got := c.rawFrames()
+	if len(got) != len(want) {
+		t.Fatalf("got %d raw frames, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i].etherType != want[i].etherType || !bytes.Equal(got[i].data, want[i].data) {
+			t.Errorf("got raw frame %d = {%#x, %q}, want {%#x, %q}", i, got[i].etherType, got[i].data, want[i].etherType, want[i].data)
+		}
+	}
+}
+
+func TestRegisterUnregister(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	// Once IPv4 is unregistered, IPv4 frames go to the raw handler.
+	c.mux.Unregister(header.IPv4ProtocolNumber)
+	c.injectUDP("to raw")
+	if got := c.readUDP(); len(got) != 0 {
+		t.Errorf("got datagrams %q after unregistering IPv4", got)
+	}
+	if got := c.rawFrames(); len(got) != 1 || got[0].etherType != header.IPv4ProtocolNumber {
+		t.Errorf("got raw frames %+v, want a single IPv4 frame", got)
+	}
+
+	c.mux.Register(header.IPv4ProtocolNumber)
+	c.injectUDP("to stack")
+	if got, want := c.readUDP(), []string{"to stack"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got datagrams %q, want %q", got, want)
+	}
+
+	// Without a raw handler, unregistered frames are dropped.
+	c.mux.SetRawHandler(nil)
+	c.injectRaw(lldpEtherType, "dropped")
+	if got := c.rawFrames(); len(got) != 1 {
+		t.Errorf("got %d raw frames, want 1", len(got))
+	}
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	const n = 1000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			c.mux.Register(lldpEtherType)
+			c.mux.Unregister(lldpEtherType)
+		}
+	}()
+	for i := 0; i < n; i++ {
+		c.injectRaw(0x88b5, "raw")
+		c.injectUDP("ip")
+		c.readUDP()
+	}
+	<-done
+
+	if got := len(c.rawFrames()); got != n {
+		t.Errorf("got %d raw frames, want %d", got, n)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	// Both the stack and the raw frame writer can transmit.
+	if err := c.mux.WriteRawFrame("\xff\xff\xff\xff\xff\xff", lldpEtherType, buffer.View("lldp")); err != nil {
+		t.Fatalf("WriteRawFrame failed: %v", err)
+	}
+	p := <-c.ch.C
+	if p.Proto != lldpEtherType || string(p.Payload) != "lldp" {
+		t.Errorf("got packet {%#x, %q}, want {%#x, %q}", p.Proto, p.Payload, lldpEtherType, "lldp")
+	}
+
+	c.s.AddLinkAddress(1, peerAddr, "\x02\x00\x00\x00\x00\x02")
+	if _, err := c.ep.Write(tcpip.SlicePayload("ip"), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: peerAddr, Port: port}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	p = <-c.ch.C
+	if p.Proto != header.IPv4ProtocolNumber || string(p.Payload) != "ip" {
+		t.Errorf("got packet {%#x, %q}, want {%#x, %q}", p.Proto, p.Payload, header.IPv4ProtocolNumber, "ip")
+	}
+}
@@ -0,0 +1,396 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package prio provides the implementation of data-link layer endpoints that
+// wrap other endpoints and queue outbound packets in several egress queues,
+// selected by the tcpip.PriorityOption of the endpoint sending each packet or
+// by its DSCP.
+//
+// By default the queues are strictly ordered: a queued packet is only written
+// to the lower endpoint once all the queues ahead of its own are empty, so
+// traffic marked for a high-priority queue bypasses a congested default queue.
+// When the queues are given weights, they're served in turn instead, each
+// writing up to its weight in packets, so that no queue is starved.
+//
+// Priority endpoints can be used in the networking stack by calling New(eID,
+// opts) to create a new endpoint, where eID is the ID of the endpoint being
+// wrapped, and then passing it as an argument to Stack.CreateNIC().
+package prio
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// DefaultQueueLength is the number of packets each queue holds when no queue
+// length is specified.
+const DefaultQueueLength = 1000
+
+// maxDSCP is the largest differentiated services code point.
+const maxDSCP = 1<<6 - 1
+
+// Options specify the details of a priority endpoint.
+type Options struct {
+	// Queues is the number of egress queues, in decreasing order of
+	// priority. If zero, the endpoint has a single queue.
+	Queues int
+
+	// QueueLength is the number of packets each queue holds before further
+	// packets are dropped. If zero, DefaultQueueLength is used.
+	QueueLength int
+
+	// DefaultQueue is the queue of packets whose DSCP isn't mapped to a
+	// queue, and of packets that aren't IP.
+	DefaultQueue int
+
+	// QueueForDSCP maps DSCP values to the queue of the packets carrying
+	// them. It can be changed later with SetQueue.
+	QueueForDSCP map[uint8]int
+
+	// QueueForPriority maps non-zero tcpip.PriorityOption values to the
+	// queue of the packets sent by endpoints that set them. It takes
+	// precedence over QueueForDSCP, and can be changed later with
+	// SetPriorityQueue.
+	QueueForPriority map[uint8]int
+
+	// Weights, if not nil, holds the positive weight of each queue, which
+	// are then served by weighted round robin rather than strictly in
+	// order.
+	Weights []int
+}
+
+// packet is an outbound packet queued by a priority endpoint.
+type packet struct {
+	route    stack.Route
+	checksum *stack.PartialChecksum
+	header   buffer.Prependable
+	payload  buffer.View
+	protocol tcpip.NetworkProtocolNumber
+}
+
+// Endpoint is a priority link-layer endpoint.
+type Endpoint struct {
+	dispatcher   stack.NetworkDispatcher
+	lower        stack.LinkEndpoint
+	queueLength  int
+	defaultQueue int
+
+	// mu protects the fields below; cond is signaled when a packet is
+	// queued.
+	mu      sync.Mutex
+	cond    sync.Cond
+	queues  [][]packet
+	queueOf [maxDSCP + 1]int
+	dropped uint64
+
+	// queueOfPriority maps priorities to queues, or to -1 for those that
+	// aren't mapped.
+	queueOfPriority [256]int
+
+	// weights holds the weight of each queue, or is nil if they're
+	// strictly ordered. current is the queue being served, and credit the
+	// number of packets it may still write in its turn.
+	weights []int
+	current int
+	credit  int
+}
+
+// New creates a new priority link-layer endpoint. It wraps around another
+// endpoint and writes the packets queued in its egress queues to it from a
+// separate goroutine.
+func New(lower tcpip.LinkEndpointID, opts Options) (tcpip.LinkEndpointID, *Endpoint) {
+	if opts.Queues <= 0 {
+		opts.Queues = 1
+	}
+	if opts.QueueLength <= 0 {
+		opts.QueueLength = DefaultQueueLength
+	}
+	if opts.DefaultQueue < 0 || opts.DefaultQueue >= opts.Queues {
+		panic("default queue out of range")
+	}
+	if opts.Weights != nil {
+		if len(opts.Weights) != opts.Queues {
+			panic("wrong number of weights")
+		}
+		for _, w := range opts.Weights {
+			if w <= 0 {
+				panic("weights must be positive")
+			}
+		}
+	}
+	e := &Endpoint{
+		lower:        stack.FindLinkEndpoint(lower),
+		queueLength:  opts.QueueLength,
+		defaultQueue: opts.DefaultQueue,
+		queues:       make([][]packet, opts.Queues),
+		weights:      append([]int(nil), opts.Weights...),
+	}
+	if e.weights != nil {
+		e.credit = e.weights[0]
+	}
+	e.cond.L = &e.mu
+	for i := range e.queueOf {
+		e.queueOf[i] = opts.DefaultQueue
+	}
+	for i := range e.queueOfPriority {
+		e.queueOfPriority[i] = -1
+	}
+	for dscp, q := range opts.QueueForDSCP {
+		if err := e.SetQueue(dscp, q); err != nil {
+			panic(err.String())
+		}
+	}
+	for priority, q := range opts.QueueForPriority {
+		if err := e.SetPriorityQueue(priority, q); err != nil {
+			panic(err.String())
+		}
+	}
+	go e.dispatchLoop()
+	return stack.RegisterLinkEndpoint(e), e
+}
+
+// SetQueue maps the given DSCP value to an egress queue, for the packets
+// written from then on.
+func (e *Endpoint) SetQueue(dscp uint8, queue int) *tcpip.Error {
+	if dscp > maxDSCP || queue < 0 || queue >= len(e.queues) {
+		return tcpip.ErrInvalidOptionValue
+	}
+	e.mu.Lock()
+	e.queueOf[dscp] = queue
+	e.mu.Unlock()
+	return nil
+}
+
+// Queue returns the egress queue the given DSCP value is mapped to.
+func (e *Endpoint) Queue(dscp uint8) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.queueOf[dscp&maxDSCP]
+}
+
+// SetPriorityQueue maps the given non-zero priority to an egress queue, for the
+// packets written from then on. A negative queue removes the mapping.
+func (e *Endpoint) SetPriorityQueue(priority uint8, queue int) *tcpip.Error {
+	if priority == 0 || queue >= len(e.queues) {
+		return tcpip.ErrInvalidOptionValue
+	}
+	if queue < 0 {
+		queue = -1
+	}
+	e.mu.Lock()
+	e.queueOfPriority[priority] = queue
+	e.mu.Unlock()
+	return nil
+}
+
+// PriorityQueue returns the egress queue the given priority is mapped to, and
+// whether it is mapped.
+func (e *Endpoint) PriorityQueue(priority uint8) (int, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	q := e.queueOfPriority[priority]
+	return q, q >= 0
+}
+
+// Queued returns the number of packets waiting in the given egress queue.
+func (e *Endpoint) Queued(queue int) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.queues[queue])
+}
+
+// Dropped returns the number of packets dropped because their queue was full.
+func (e *Endpoint) Dropped() uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dropped
+}
+
+// DeliverNetworkPacket implements stack.NetworkDispatcher.DeliverNetworkPacket.
+// Inbound packets are not queued, they are just forwarded to the actual
+// dispatcher.
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
+	e.dispatcher.DeliverNetworkPacket(e, remoteLinkAddr, protocol, vv, checksumValidated)
+}
+
+// Attach implements stack.LinkEndpoint.Attach. It saves the dispatcher and
+// registers with the lower endpoint as its dispatcher so that "e" is called
+// for inbound packets.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.lower.Attach(e)
+}
+
+// MTU implements stack.LinkEndpoint.MTU. It just forwards the request to the
+// lower endpoint.
+func (e *Endpoint) MTU() uint32 {
+	return e.lower.MTU()
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return e.lower.Capabilities()
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. It just
+// forwards the request to the lower endpoint.
+func (e *Endpoint) MaxHeaderLength() uint16 {
+	return e.lower.MaxHeaderLength()
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress. It just forwards the
+// request to the lower endpoint.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.lower.LinkAddress()
+}
+
+// SetLinkAddress implements stack.LinkAddressSetter.SetLinkAddress. It just
+// forwards the request to the lower endpoint.
+func (e *Endpoint) SetLinkAddress(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.LinkAddressSetter); ok {
+		return ep.SetLinkAddress(addr)
+	}
+	return tcpip.ErrNotSupported
+}
+
+// AddMulticastFilter implements stack.MulticastLinkEndpoint.AddMulticastFilter.
+// It just forwards the request to the lower endpoint, if it filters multicast
+// frames.
+func (e *Endpoint) AddMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.MulticastLinkEndpoint); ok {
+		return ep.AddMulticastFilter(addr)
+	}
+	return nil
+}
+
+// RemoveMulticastFilter implements
+// stack.MulticastLinkEndpoint.RemoveMulticastFilter. It just forwards the
+// request to the lower endpoint, if it filters multicast frames.
+func (e *Endpoint) RemoveMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.MulticastLinkEndpoint); ok {
+		return ep.RemoveMulticastFilter(addr)
+	}
+	return nil
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. It queues the packet
+// in the egress queue the priority of its route is mapped to, or else the one
+// its DSCP is mapped to; errors from the lower endpoint are not reported.
+func (e *Endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	p := packet{
+		checksum: csum,
+		header:   *hdr,
+		payload:  payload,
+		protocol: protocol,
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	q := e.defaultQueue
+	if dscp, ok := packetDSCP(hdr.View(), protocol); ok {
+		q = e.queueOf[dscp]
+	}
+	if r != nil && r.Priority != 0 && e.queueOfPriority[r.Priority] >= 0 {
+		q = e.queueOfPriority[r.Priority]
+	}
+	if len(e.queues[q]) >= e.queueLength {
+		e.dropped++
+		return tcpip.ErrWouldBlock
+	}
+	// Keep the route and headers until the packet is written.
+	if r != nil {
+		p.route = r.Clone()
+	}
+	if b := hdr.Buffer(); b != nil {
+		b.IncRef()
+	}
+	e.queues[q] = append(e.queues[q], p)
+	e.cond.Signal()
+	return nil
+}
+
+// dispatchLoop writes the queued packets to the lower endpoint, in the order
+// dequeueLocked picks them.
+func (e *Endpoint) dispatchLoop() {
+	for {
+		e.mu.Lock()
+		p, ok := e.dequeueLocked()
+		for !ok {
+			e.cond.Wait()
+			p, ok = e.dequeueLocked()
+		}
+		e.mu.Unlock()
+
+		e.lower.WritePacket(&p.route, p.checksum, &p.header, p.payload, p.protocol)
+		p.header.Release()
+		p.route.Release()
+	}
+}
+
+// dequeueLocked removes the next packet to be written from its queue: the
+// first one of the first queue that isn't empty if the queues are strictly
+// ordered, or of the queue whose turn it is otherwise. A queue's turn ends once
+// it's empty or has written its weight in packets.
+//
+// Precondition: e.mu must be held.
+func (e *Endpoint) dequeueLocked() (packet, bool) {
+	if e.weights == nil {
+		for i, q := range e.queues {
+			if len(q) != 0 {
+				return e.popLocked(i), true
+			}
+		}
+		return packet{}, false
+	}
+
+	// Going around once more than there are queues gives the current one
+	// a new turn if it's the only one with packets.
+	for i := 0; i <= len(e.queues); i++ {
+		if len(e.queues[e.current]) != 0 && e.credit > 0 {
+			e.credit--
+			return e.popLocked(e.current), true
+		}
+		e.current = (e.current + 1) % len(e.queues)
+		e.credit = e.weights[e.current]
+	}
+	return packet{}, false
+}
+
+// popLocked removes the first packet of the given queue, which must not be
+// empty.
+//
+// Precondition: e.mu must be held.
+func (e *Endpoint) popLocked(i int) packet {
+	q := e.queues[i]
+	p := q[0]
+	q[0] = packet{}
+	e.queues[i] = q[1:]
+	return p
+}
+
+// packetDSCP returns the DSCP of the IP packet whose headers start at the
+// front of b.
+func packetDSCP(b []byte, protocol tcpip.NetworkProtocolNumber) (uint8, bool) {
+	var tos uint8
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if len(b) < header.IPv4MinimumSize {
+			return 0, false
+		}
+		tos, _ = header.IPv4(b).TOS()
+	case header.IPv6ProtocolNumber:
+		if len(b) < header.IPv6MinimumSize {
+			return 0, false
+		}
+		tos, _ = header.IPv6(b).TOS()
+	default:
+		return 0, false
+	}
+	return tos >> 2, true
+}
@@ -0,0 +1,340 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package prio
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	stackAddr = "\x0a\x00\x00\x01"
+	peerAddr  = "\x0a\x00\x00\x02"
+	port      = 1234
+
+	// expeditedForwarding is the DSCP of the EF per-hop behavior.
+	expeditedForwarding = 46
+)
+
+// writtenPacket holds the identifying contents of a packet written to a mock
+// endpoint.
+type writtenPacket struct {
+	payload byte
+	dscp    uint8
+}
+
+// blockingEndpoint is a link endpoint that records the packets written to it,
+// and blocks writes while it is congested.
+type blockingEndpoint struct {
+	// congested is closed when the endpoint can write packets again.
+	congested chan struct{}
+
+	// blocked is signaled when a write blocks.
+	blocked chan struct{}
+
+	mu     sync.Mutex
+	writes []writtenPacket
+}
+
+func (*blockingEndpoint) Attach(stack.NetworkDispatcher) {}
+
+func (*blockingEndpoint) MTU() uint32 {
+	return 1500
+}
+
+func (*blockingEndpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+func (*blockingEndpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+func (*blockingEndpoint) LinkAddress() tcpip.LinkAddress {
+	return ""
+}
+
+func (e *blockingEndpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	select {
+	case <-e.congested:
+	default:
+		e.blocked <- struct{}{}
+		<-e.congested
+	}
+
+	tos, _ := header.IPv4(hdr.View()).TOS()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.writes = append(e.writes, writtenPacket{payload[0], tos >> 2})
+	return nil
+}
+
+func (e *blockingEndpoint) written() []writtenPacket {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]writtenPacket(nil), e.writes...)
+}
+
+func newEndpoint(t *testing.T, s *stack.Stack, tos uint8) tcpip.Endpoint {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := ep.SetSockOpt(tcpip.TOSOption(tos)); err != nil {
+		t.Fatalf("SetSockOpt(TOSOption(%d)) failed: %v", tos, err)
+	}
+	if err := ep.Connect(tcpip.FullAddress{Addr: peerAddr, Port: port}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	return ep
+}
+
+func send(t *testing.T, ep tcpip.Endpoint, payload byte) {
+	if _, err := ep.Write(tcpip.SlicePayload{payload}, tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+func TestPriorityQueueBypassesCongestedDefaultQueue(t *testing.T) {
+	lower := &blockingEndpoint{
+		congested: make(chan struct{}),
+		blocked:   make(chan struct{}, 1),
+	}
+	id, ep := New(stack.RegisterLinkEndpoint(lower), Options{
+		Queues:       2,
+		DefaultQueue: 1,
+		QueueForDSCP: map[uint8]int{expeditedForwarding: 0},
+	})
+
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	bulk := newEndpoint(t, s, 0)
+	defer bulk.Close()
+	marked := newEndpoint(t, s, expeditedForwarding<<2)
+	defer marked.Close()
+
+	// The first packet congests the link, so the following unmarked ones
+	// wait in the default queue.
+	send(t, bulk, 0)
+	select {
+	case <-lower.blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the first packet to be written")
+	}
+	for i := byte(1); i <= 3; i++ {
+		send(t, bulk, i)
+	}
+	send(t, marked, 100)
+	send(t, marked, 101)
+
+	if got := ep.Queued(1); got != 3 {
+		t.Fatalf("got Queued(1) = %d, want 3", got)
+	}
+	if got := ep.Queued(0); got != 2 {
+		t.Fatalf("got Queued(0) = %d, want 2", got)
+	}
+
+	close(lower.congested)
+
+	want := []writtenPacket{
+		{0, 0},
+		{100, expeditedForwarding},
+		{101, expeditedForwarding},
+		{1, 0},
+		{2, 0},
+		{3, 0},
+	}
+	var got []writtenPacket
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(time.Millisecond) {
+		if got = lower.written(); len(got) == len(want) {
+			break
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d packets written, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("packet %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestSetQueue(t *testing.T) {
+	_, ep := New(stack.RegisterLinkEndpoint(&blockingEndpoint{}), Options{Queues: 3, DefaultQueue: 2})
+
+	if got := ep.Queue(expeditedForwarding); got != 2 {
+		t.Errorf("got Queue(%d) = %d, want 2", expeditedForwarding, got)
+	}
+	if err := ep.SetQueue(expeditedForwarding, 0); err != nil {
+		t.Fatalf("SetQueue failed: %v", err)
+	}
+	if got := ep.Queue(expeditedForwarding); got != 0 {
+		t.Errorf("got Queue(%d) = %d, want 0", expeditedForwarding, got)
+	}
+	if err := ep.SetQueue(expeditedForwarding, 3); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("got SetQueue with queue 3 = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := ep.SetQueue(64, 0); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("got SetQueue with DSCP 64 = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+}
+
+// gatedEndpoint is a link endpoint that hands the payload of each packet
+// written to it to the test, so that a write doesn't complete, and the next
+// packet isn't dequeued, until the test takes it.
+type gatedEndpoint struct {
+	blockingEndpoint
+	written chan byte
+	closed  chan struct{}
+}
+
+func (e *gatedEndpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	select {
+	case e.written <- payload[0]:
+	case <-e.closed:
+	}
+	return nil
+}
+
+// next returns the payload of the packet being written.
+func (e *gatedEndpoint) next(t *testing.T) byte {
+	select {
+	case b := <-e.written:
+		return b
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a packet to be written")
+		return 0
+	}
+}
+
+func TestPriorityFlowUnderContention(t *testing.T) {
+	const priority = 6
+	lower := &gatedEndpoint{
+		written: make(chan byte),
+		closed:  make(chan struct{}),
+	}
+	defer close(lower.closed)
+	id, ep := New(stack.RegisterLinkEndpoint(lower), Options{
+		Queues:           2,
+		DefaultQueue:     1,
+		QueueForPriority: map[uint8]int{priority: 0},
+		Weights:          []int{4, 1},
+	})
+
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	bulk := newEndpoint(t, s, 0)
+	defer bulk.Close()
+	urgent := newEndpoint(t, s, 0)
+	defer urgent.Close()
+	if err := urgent.SetSockOpt(tcpip.PriorityOption(priority)); err != nil {
+		t.Fatalf("SetSockOpt(PriorityOption(%d)) failed: %v", priority, err)
+	}
+	var got tcpip.PriorityOption
+	if err := urgent.GetSockOpt(&got); err != nil || got != priority {
+		t.Fatalf("got GetSockOpt(&PriorityOption) = %d, %v, want %d, nil", got, err, priority)
+	}
+
+	// The bulk flow has a backlog of packets in the default queue, and one
+	// of them is being written.
+	const backlog = 100
+	for i := 0; i < backlog; i++ {
+		send(t, bulk, 0)
+	}
+
+	// Each packet of the priority flow is written once the one being
+	// written is, and at most a single bulk packet whose turn it is.
+	const probes = 20
+	for i := 0; i < probes; i++ {
+		if q := ep.Queued(1); q < backlog/2 {
+			t.Fatalf("probe %d: got Queued(1) = %d, want a backlog of at least %d", i, q, backlog/2)
+		}
+		send(t, urgent, byte(i+1))
+		others := 0
+		for lower.next(t) != byte(i+1) {
+			others++
+		}
+		if others > 2 {
+			t.Errorf("probe %d: written after %d other packets, want at most 2", i, others)
+		}
+	}
+
+	// A burst of the priority flow doesn't starve the bulk one: it gets a
+	// turn for every four priority packets.
+	const burst = 20
+	for i := 0; i < burst; i++ {
+		send(t, urgent, byte(probes+i+1))
+	}
+	written, others := 0, 0
+	for written < burst {
+		if b := lower.next(t); b > probes {
+			written++
+		} else if written > 0 {
+			others++
+		}
+	}
+	if others < burst/4-1 {
+		t.Errorf("got %d bulk packets written during the burst, want at least %d", others, burst/4-1)
+	}
+}
+
+func TestSetPriorityQueue(t *testing.T) {
+	_, ep := New(stack.RegisterLinkEndpoint(&blockingEndpoint{}), Options{Queues: 2})
+
+	if _, ok := ep.PriorityQueue(3); ok {
+		t.Errorf("got PriorityQueue(3) mapped, want unmapped")
+	}
+	if err := ep.SetPriorityQueue(3, 1); err != nil {
+		t.Fatalf("SetPriorityQueue failed: %v", err)
+	}
+	if q, ok := ep.PriorityQueue(3); !ok || q != 1 {
+		t.Errorf("got PriorityQueue(3) = %d, %t, want 1, true", q, ok)
+	}
+	if err := ep.SetPriorityQueue(3, -1); err != nil {
+		t.Fatalf("SetPriorityQueue failed: %v", err)
+	}
+	if _, ok := ep.PriorityQueue(3); ok {
+		t.Errorf("got PriorityQueue(3) mapped after removing it, want unmapped")
+	}
+	if err := ep.SetPriorityQueue(0, 0); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("got SetPriorityQueue with priority 0 = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := ep.SetPriorityQueue(3, 2); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("got SetPriorityQueue with queue 2 = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+}
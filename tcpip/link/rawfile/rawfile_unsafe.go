@@ -108,6 +108,29 @@ func NonBlockingWriteN(fd int, bs ...[]byte) *tcpip.Error {
 	return nil
 }
 
+// sysSendmmsg is the number of the sendmmsg syscall, which package syscall
+// doesn't define on amd64.
+const sysSendmmsg = 307
+
+// MMsgHdr is the mmsghdr structure of the sendmmsg syscall, which describes a
+// message and receives the number of bytes sent for it.
+type MMsgHdr struct {
+	Msg syscall.Msghdr
+	Len uint32
+	_   [4]byte
+}
+
+// NonBlockingSendMMsg sends the given messages to the socket fd in a single
+// syscall, and returns the number of messages that were sent.
+func NonBlockingSendMMsg(fd int, msgHdrs []MMsgHdr) (int, *tcpip.Error) {
+	n, _, e := syscall.RawSyscall6(sysSendmmsg, uintptr(fd), uintptr(unsafe.Pointer(&msgHdrs[0])), uintptr(len(msgHdrs)), syscall.MSG_DONTWAIT, 0, 0)
+	if e != 0 {
+		return 0, TranslateErrno(e)
+	}
+
+	return int(n), nil
+}
+
 // BlockingRead reads from a file descriptor that is set up as non-blocking. If
 // no data is available, it will block in a poll() syscall until the file
 // descirptor becomes readable.
@@ -159,3 +182,96 @@ func BlockingReadv(fd int, iovecs []syscall.Iovec) (int, *tcpip.Error) {
 		}
 	}
 }
+
+// BlockingReadvFunc is like BlockingReadv, but it calls iovecs to get the
+// buffers to read into before every read attempt. This allows callers to change
+// the buffers while the file descriptor isn't readable, for example to grow
+// them when the MTU of the device is raised.
+func BlockingReadvFunc(fd int, iovecs func() []syscall.Iovec) (int, *tcpip.Error) {
+	for {
+		iov := iovecs()
+		n, _, e := syscall.RawSyscall(syscall.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)))
+		if e == 0 {
+			return int(n), nil
+		}
+
+		event := struct {
+			fd      int32
+			events  int16
+			revents int16
+		}{
+			fd:     int32(fd),
+			events: 1, // POLLIN
+		}
+
+		_, e = blockingPoll(unsafe.Pointer(&event), 1, -1)
+		if e != 0 && e != syscall.EINTR {
+			return 0, TranslateErrno(e)
+		}
+	}
+}
+
+// BlockingReadvFuncUntilStopped is like BlockingReadvFunc, but it also polls
+// stopFD, and returns -1 without reading anything once stopFD becomes readable
+// (or is the read end of a pipe whose write end was closed). A negative stopFD
+// is ignored.
+func BlockingReadvFuncUntilStopped(fd, stopFD int, iovecs func() []syscall.Iovec) (int, *tcpip.Error) {
+	for {
+		iov := iovecs()
+		n, _, e := syscall.RawSyscall(syscall.SYS_READV, uintptr(fd), uintptr(unsafe.Pointer(&iov[0])), uintptr(len(iov)))
+		if e == 0 {
+			return int(n), nil
+		}
+
+		events := [2]struct {
+			fd      int32
+			events  int16
+			revents int16
+		}{
+			{
+				fd:     int32(fd),
+				events: 1, // POLLIN
+			},
+			{
+				fd:     int32(stopFD),
+				events: 1, // POLLIN
+			},
+		}
+
+		_, e = blockingPoll(unsafe.Pointer(&events[0]), len(events), -1)
+		if e != 0 && e != syscall.EINTR {
+			return 0, TranslateErrno(e)
+		}
+
+		if events[1].revents != 0 {
+			return -1, nil
+		}
+	}
+}
+
+// SetPacketMembership adds (or drops, if add is false) addr to the multicast
+// link addresses accepted by the packet socket fd, which is bound to the
+// interface with the given index.
+func SetPacketMembership(fd, ifindex int, addr []byte, add bool) *tcpip.Error {
+	var mreq struct {
+		ifindex int32
+		typ     uint16
+		alen    uint16
+		address [8]byte
+	}
+	mreq.ifindex = int32(ifindex)
+	mreq.typ = syscall.PACKET_MR_MULTICAST
+	mreq.alen = uint16(copy(mreq.address[:], addr))
+
+	op := syscall.PACKET_ADD_MEMBERSHIP
+	if !add {
+		op = syscall.PACKET_DROP_MEMBERSHIP
+	}
+
+	_, _, e := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(fd), syscall.SOL_PACKET, uintptr(op), uintptr(unsafe.Pointer(&mreq)), unsafe.Sizeof(mreq), 0)
+	if e != 0 {
+		return TranslateErrno(e)
+	}
+
+	return nil
+}
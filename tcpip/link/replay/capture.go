@@ -0,0 +1,336 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package replay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Link types, as defined in http://www.tcpdump.org/linktypes.html.
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+
+	// linkTypeDLTRaw is the value of DLT_RAW on most platforms. It's found
+	// in captures written by tools that don't map it to linkTypeRaw.
+	linkTypeDLTRaw = 12
+)
+
+// Magic numbers of the supported capture formats.
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+	pcapngSectionHeader   = 0x0a0d0d0a
+	pcapngByteOrderMagic  = 0x1a2b3c4d
+)
+
+// pcapng block types.
+const (
+	pcapngInterfaceDescription = 1
+	pcapngSimplePacket         = 3
+	pcapngEnhancedPacket       = 6
+)
+
+// pcapngOptionTSResol is the code of the if_tsresol option of pcapng interface
+// description blocks.
+const pcapngOptionTSResol = 9
+
+// errUnknownFormat is returned when the capture is neither a pcap nor a pcapng
+// file.
+var errUnknownFormat = errors.New("unknown capture format")
+
+// capturedPacket is a packet read from a capture.
+type capturedPacket struct {
+	// timestamp is the capture time of the packet, in nanoseconds.
+	timestamp int64
+
+	// linkType is the link type of the interface the packet was captured
+	// on.
+	linkType uint32
+
+	data []byte
+}
+
+// captureReader reads the packets of a capture.
+type captureReader interface {
+	// next returns the next packet of the capture, or io.EOF once all
+	// packets have been read.
+	next() (capturedPacket, error)
+}
+
+// newCaptureReader reads the header of the capture from r, and returns a
+// reader for its packets.
+func newCaptureReader(r io.Reader) (captureReader, error) {
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return nil, err
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(magic[:]) {
+		case pcapMagicMicroseconds:
+			return newPCAPReader(r, order, 1000)
+		case pcapMagicNanoseconds:
+			return newPCAPReader(r, order, 1)
+		}
+	}
+	if binary.LittleEndian.Uint32(magic[:]) == pcapngSectionHeader {
+		var length [4]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return nil, err
+		}
+		p := &pcapngReader{r: r}
+		if err := p.readSectionHeader(length[:]); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	return nil, errUnknownFormat
+}
+
+// checkLinkType returns an error if packets of the given link type can't be
+// replayed.
+func checkLinkType(linkType uint32) error {
+	switch linkType {
+	case linkTypeEthernet, linkTypeRaw, linkTypeDLTRaw, linkTypeIPv4, linkTypeIPv6:
+		return nil
+	}
+	return fmt.Errorf("unsupported link type %d", linkType)
+}
+
+// pcapReader reads captures in the pcap format, described in
+// https://wiki.wireshark.org/Development/LibpcapFileFormat.
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	linkType uint32
+
+	// fractionUnit is the duration, in nanoseconds, of the unit of the
+	// fractional part of timestamps.
+	fractionUnit int64
+}
+
+func newPCAPReader(r io.Reader, order binary.ByteOrder, fractionUnit int64) (*pcapReader, error) {
+	// The remainder of the header, after the magic number.
+	var hdr [20]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	p := &pcapReader{
+		r:            r,
+		order:        order,
+		linkType:     order.Uint32(hdr[16:]),
+		fractionUnit: fractionUnit,
+	}
+	if err := checkLinkType(p.linkType); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *pcapReader) next() (capturedPacket, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+		return capturedPacket{}, err
+	}
+
+	data := make([]byte, p.order.Uint32(hdr[8:]))
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return capturedPacket{}, io.ErrUnexpectedEOF
+	}
+
+	return capturedPacket{
+		timestamp: int64(p.order.Uint32(hdr[0:]))*1e9 + int64(p.order.Uint32(hdr[4:]))*p.fractionUnit,
+		linkType:  p.linkType,
+		data:      data,
+	}, nil
+}
+
+// pcapngInterface describes an interface of a pcapng section.
+type pcapngInterface struct {
+	linkType uint32
+
+	// ticksPerSecond is the resolution of the timestamps of packets
+	// captured on the interface.
+	ticksPerSecond uint64
+}
+
+// pcapngReader reads captures in the pcapng format, described in
+// https://github.com/pcapng/pcapng.
+type pcapngReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterface
+}
+
+// readSectionHeader reads a section header block whose type, and the given
+// length field, were already read.
+func (p *pcapngReader) readSectionHeader(length []byte) error {
+	var bom [4]byte
+	if _, err := io.ReadFull(p.r, bom[:]); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(bom[:]) == pcapngByteOrderMagic:
+		p.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(bom[:]) == pcapngByteOrderMagic:
+		p.order = binary.BigEndian
+	default:
+		return errUnknownFormat
+	}
+	p.interfaces = nil
+
+	// Skip the rest of the block.
+	_, err := p.readBody(p.order.Uint32(length), 12)
+	return err
+}
+
+// readBody reads the body of a block of the given total length, from which
+// read bytes were already read.
+func (p *pcapngReader) readBody(length uint32, read int) ([]byte, error) {
+	if length%4 != 0 || int(length) < read+4 {
+		return nil, fmt.Errorf("invalid pcapng block length %d", length)
+	}
+
+	// The body is followed by a copy of the block length.
+	body := make([]byte, int(length)-read)
+	if _, err := io.ReadFull(p.r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return body[:len(body)-4], nil
+}
+
+func (p *pcapngReader) next() (capturedPacket, error) {
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(p.r, hdr[:]); err != nil {
+			return capturedPacket{}, err
+		}
+
+		// A new section may use a different byte order, which its
+		// header's type doesn't depend on.
+		if binary.LittleEndian.Uint32(hdr[0:]) == pcapngSectionHeader {
+			if err := p.readSectionHeader(hdr[4:]); err != nil {
+				return capturedPacket{}, err
+			}
+			continue
+		}
+
+		body, err := p.readBody(p.order.Uint32(hdr[4:]), len(hdr))
+		if err != nil {
+			return capturedPacket{}, err
+		}
+
+		switch p.order.Uint32(hdr[0:]) {
+		case pcapngInterfaceDescription:
+			if err := p.addInterface(body); err != nil {
+				return capturedPacket{}, err
+			}
+
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return capturedPacket{}, errors.New("truncated pcapng packet block")
+			}
+			ifc, err := p.iface(p.order.Uint32(body[0:]))
+			if err != nil {
+				return capturedPacket{}, err
+			}
+			ticks := uint64(p.order.Uint32(body[4:]))<<32 | uint64(p.order.Uint32(body[8:]))
+			capLen := p.order.Uint32(body[12:])
+			if int(capLen) > len(body)-20 {
+				return capturedPacket{}, errors.New("truncated pcapng packet block")
+			}
+			return capturedPacket{
+				timestamp: ticksToNanoseconds(ticks, ifc.ticksPerSecond),
+				linkType:  ifc.linkType,
+				data:      body[20 : 20+capLen],
+			}, nil
+
+		case pcapngSimplePacket:
+			// Simple packet blocks have no timestamps, and hold
+			// packets captured on the first interface.
+			if len(body) < 4 {
+				return capturedPacket{}, errors.New("truncated pcapng packet block")
+			}
+			ifc, err := p.iface(0)
+			if err != nil {
+				return capturedPacket{}, err
+			}
+			data := body[4:]
+			if l := p.order.Uint32(body[0:]); int(l) < len(data) {
+				data = data[:l]
+			}
+			return capturedPacket{
+				linkType: ifc.linkType,
+				data:     data,
+			}, nil
+		}
+	}
+}
+
+// addInterface adds the interface described by the given interface description
+// block body.
+func (p *pcapngReader) addInterface(body []byte) error {
+	if len(body) < 8 {
+		return errors.New("truncated pcapng interface block")
+	}
+
+	ifc := pcapngInterface{
+		linkType:       uint32(p.order.Uint16(body[0:])),
+		ticksPerSecond: 1000000,
+	}
+	if err := checkLinkType(ifc.linkType); err != nil {
+		return err
+	}
+
+	// Look for the timestamp resolution in the options.
+	for opts := body[8:]; len(opts) >= 4; {
+		code := p.order.Uint16(opts[0:])
+		l := int(p.order.Uint16(opts[2:]))
+		if len(opts) < 4+l {
+			break
+		}
+		if code == pcapngOptionTSResol && l == 1 {
+			v := opts[4]
+			base := uint64(10)
+			if v&0x80 != 0 {
+				base = 2
+				v &^= 0x80
+			}
+			ifc.ticksPerSecond = 1
+			for i := uint8(0); i < v; i++ {
+				ifc.ticksPerSecond *= base
+			}
+		}
+		opts = opts[4+(l+3)&^3:]
+	}
+
+	p.interfaces = append(p.interfaces, ifc)
+	return nil
+}
+
+// iface returns the interface of the current section with the given ID.
+func (p *pcapngReader) iface(id uint32) (pcapngInterface, error) {
+	if int(id) >= len(p.interfaces) {
+		return pcapngInterface{}, fmt.Errorf("unknown pcapng interface %d", id)
+	}
+	return p.interfaces[id], nil
+}
+
+// ticksToNanoseconds converts a timestamp expressed in the given number of
+// ticks per second to nanoseconds.
+func ticksToNanoseconds(ticks, ticksPerSecond uint64) int64 {
+	sec := ticks / ticksPerSecond
+	frac := ticks % ticksPerSecond
+	return int64(sec*1e9 + frac*1e9/ticksPerSecond)
+}
@@ -0,0 +1,323 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package replay provides the implementation of data-link layer endpoints that
+// replay captured traffic. Packets read from a pcap or pcapng capture are
+// delivered to the stack as if they had been received, and packets sent by the
+// stack may be recorded so that they can be compared to the expected ones.
+//
+// Replay endpoints can be used in the networking stack by calling New() to
+// create a new endpoint, and then passing it as an argument to
+// Stack.CreateNIC(). The capture starts being replayed once the NIC is
+// enabled.
+package replay
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// defaultMTU is the MTU of endpoints for which no MTU was specified. It is the
+// maximum size of an IP packet.
+const defaultMTU = 65536
+
+// pollInterval is the longest time the replay goroutine sleeps for before
+// checking the clock again when it honors the timing of the capture. It allows
+// clocks that don't follow the real time to be used.
+const pollInterval = time.Millisecond
+
+// Options specify the behavior of a replay endpoint.
+type Options struct {
+	// MTU is the MTU of the endpoint. It defaults to 65536.
+	MTU uint32
+
+	// LinkAddress is the link address of the endpoint.
+	LinkAddress tcpip.LinkAddress
+
+	// Timed indicates whether the original inter-packet timing of the
+	// capture is honored. Packets are replayed as fast as possible
+	// otherwise.
+	Timed bool
+
+	// Clock is the clock against which the timing of the capture is
+	// honored. It defaults to tcpip.StdClock.
+	Clock tcpip.Clock
+
+	// Record indicates whether the packets sent by the stack through the
+	// endpoint are recorded, in which case they can be retrieved with
+	// Endpoint.Responses.
+	Record bool
+}
+
+// Packet is a network-layer packet sent through a replay endpoint.
+type Packet struct {
+	// Timestamp is the time at which the packet was sent, as returned by
+	// the endpoint's clock.
+	Timestamp int64
+
+	// Protocol is the network protocol of the packet.
+	Protocol tcpip.NetworkProtocolNumber
+
+	// Data holds the packet, starting with its network header.
+	Data buffer.View
+}
+
+// Endpoint is a link-layer endpoint that replays a capture.
+type Endpoint struct {
+	// replayed is the number of packets replayed so far. It is accessed
+	// atomically, so it is kept first for alignment.
+	replayed uint64
+
+	opts       Options
+	reader     captureReader
+	dispatcher stack.NetworkDispatcher
+
+	// done is closed once the capture has been fully replayed, at which
+	// point err holds the error that stopped the replay, if any.
+	done chan struct{}
+	err  error
+
+	// stop is closed when the endpoint is closed, to stop the replay.
+	stop chan struct{}
+
+	mu        sync.Mutex
+	responses []Packet
+	attached  bool
+	closed    bool
+}
+
+// New creates a new replay endpoint that replays the capture read from r. The
+// header of the capture is read immediately, but packets are only read as they
+// are replayed.
+func New(r io.Reader, opts Options) (tcpip.LinkEndpointID, *Endpoint, error) {
+	reader, err := newCaptureReader(r)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if opts.MTU == 0 {
+		opts.MTU = defaultMTU
+	}
+	if opts.Clock == nil {
+		opts.Clock = &tcpip.StdClock{}
+	}
+
+	e := &Endpoint{
+		opts:   opts,
+		reader: reader,
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+	}
+
+	return stack.RegisterLinkEndpoint(e), e, nil
+}
+
+// Attach implements stack.LinkEndpoint.Attach. It starts replaying the
+// capture.
+func (e *Endpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.attached || e.closed {
+		return
+	}
+	e.attached = true
+	e.dispatcher = dispatcher
+	go e.replay()
+}
+
+// Close implements stack.LinkEndpointCloser.Close. It stops replaying the
+// capture, and waits for the packet being delivered, if any, to be done with.
+func (e *Endpoint) Close() {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return
+	}
+	e.closed = true
+	attached := e.attached
+	e.mu.Unlock()
+
+	close(e.stop)
+	if !attached {
+		close(e.done)
+	}
+	<-e.done
+}
+
+// MTU implements stack.LinkEndpoint.MTU.
+func (e *Endpoint) MTU() uint32 {
+	return e.opts.MTU
+}
+
+// Capabilities implements stack.LinkEndpoint.Capabilities.
+func (*Endpoint) Capabilities() stack.LinkEndpointCapabilities {
+	return 0
+}
+
+// MaxHeaderLength implements stack.LinkEndpoint.MaxHeaderLength. Packets are
+// recorded without link-layer headers, so it returns 0.
+func (*Endpoint) MaxHeaderLength() uint16 {
+	return 0
+}
+
+// LinkAddress implements stack.LinkEndpoint.LinkAddress.
+func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	return e.opts.LinkAddress
+}
+
+// WritePacket implements stack.LinkEndpoint.WritePacket. It records the packet
+// if the endpoint was asked to, and discards it otherwise.
+func (e *Endpoint) WritePacket(_ *stack.Route, _ *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	e.mu.Lock()
+	closed := e.closed
+	e.mu.Unlock()
+
+	if closed {
+		return tcpip.ErrClosedForSend
+	}
+	if !e.opts.Record {
+		return nil
+	}
+
+	h := hdr.UsedBytes()
+	data := make(buffer.View, len(h)+len(payload))
+	copy(data, h)
+	copy(data[len(h):], payload)
+
+	p := Packet{
+		Timestamp: e.opts.Clock.NowNanoseconds(),
+		Protocol:  protocol,
+		Data:      data,
+	}
+
+	e.mu.Lock()
+	e.responses = append(e.responses, p)
+	e.mu.Unlock()
+
+	return nil
+}
+
+// Responses returns the packets recorded so far.
+func (e *Endpoint) Responses() []Packet {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Packet(nil), e.responses...)
+}
+
+// Replayed returns the number of packets replayed so far.
+func (e *Endpoint) Replayed() uint64 {
+	return atomic.LoadUint64(&e.replayed)
+}
+
+// Wait waits until the capture has been fully replayed, or the endpoint closed.
+// It returns the error that stopped the replay early, if any.
+func (e *Endpoint) Wait() error {
+	<-e.done
+	return e.err
+}
+
+// replay delivers the packets of the capture to the dispatcher.
+func (e *Endpoint) replay() {
+	defer close(e.done)
+
+	var start, first int64
+	for i := 0; ; i++ {
+		if e.stopped() {
+			return
+		}
+
+		p, err := e.reader.next()
+		if err != nil {
+			if err != io.EOF {
+				e.err = err
+			}
+			return
+		}
+
+		if e.opts.Timed {
+			if i == 0 {
+				start, first = e.opts.Clock.NowNanoseconds(), p.timestamp
+			} else if !e.waitUntil(start + p.timestamp - first) {
+				return
+			}
+		}
+
+		e.deliver(p)
+		atomic.AddUint64(&e.replayed, 1)
+	}
+}
+
+// stopped returns whether the endpoint has been closed.
+func (e *Endpoint) stopped() bool {
+	select {
+	case <-e.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitUntil waits until the endpoint's clock reaches the given time. It returns
+// false if the endpoint was closed in the meantime.
+func (e *Endpoint) waitUntil(t int64) bool {
+	for {
+		d := time.Duration(t - e.opts.Clock.NowNanoseconds())
+		if d <= 0 {
+			return true
+		}
+		if d > pollInterval {
+			d = pollInterval
+		}
+		select {
+		case <-e.stop:
+			return false
+		case <-time.After(d):
+		}
+	}
+}
+
+// deliver delivers a captured packet to the dispatcher, after stripping its
+// link-layer header. Packets that can't be parsed are skipped.
+func (e *Endpoint) deliver(p capturedPacket) {
+	var remoteLinkAddr tcpip.LinkAddress
+	var protocol tcpip.NetworkProtocolNumber
+	data := p.data
+
+	switch p.linkType {
+	case linkTypeEthernet:
+		if len(data) < header.EthernetMinimumSize {
+			return
+		}
+		eth := header.Ethernet(data)
+		remoteLinkAddr = eth.SourceAddress()
+		protocol = eth.Type()
+		data = data[header.EthernetMinimumSize:]
+
+	default:
+		// Raw IP packets; the version tells the protocol apart.
+		if len(data) == 0 {
+			return
+		}
+		switch header.IPVersion(data) {
+		case header.IPv4Version:
+			protocol = header.IPv4ProtocolNumber
+		case header.IPv6Version:
+			protocol = header.IPv6ProtocolNumber
+		default:
+			return
+		}
+	}
+
+	v := buffer.View(data)
+	vv := v.ToVectorisedView([1]buffer.View{})
+	e.dispatcher.DeliverNetworkPacket(e, remoteLinkAddr, protocol, &vv, false)
+}
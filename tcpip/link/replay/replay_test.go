@@ -0,0 +1,388 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package replay_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/replay"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/testutil"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	stackAddr = tcpip.Address("\x0a\x00\x00\x01")
+	stackPort = 80
+	peerAddr  = tcpip.Address("\x0a\x00\x00\x02")
+	peerPort  = 1234
+	peerISN   = 1000
+
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+)
+
+// pcapHeader returns the header of a pcap capture of the given link type.
+func pcapHeader(linkType uint32) []byte {
+	b := make([]byte, 24)
+	binary.LittleEndian.PutUint32(b[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(b[4:], 2)
+	binary.LittleEndian.PutUint16(b[6:], 4)
+	binary.LittleEndian.PutUint32(b[16:], 65535)
+	binary.LittleEndian.PutUint32(b[20:], linkType)
+	return b
+}
+
+// pcapRecord returns a pcap record holding the given packet.
+func pcapRecord(ts time.Duration, data []byte) []byte {
+	b := make([]byte, 16+len(data))
+	binary.LittleEndian.PutUint32(b[0:], uint32(ts/time.Second))
+	binary.LittleEndian.PutUint32(b[4:], uint32(ts%time.Second/time.Microsecond))
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(b[12:], uint32(len(data)))
+	copy(b[16:], data)
+	return b
+}
+
+// pcapngBlock returns a pcapng block of the given type and body.
+func pcapngBlock(blockType uint32, body []byte) []byte {
+	padded := (len(body) + 3) &^ 3
+	b := make([]byte, 12+padded)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	copy(b[8:], body)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(b)))
+	return b
+}
+
+// pcapngHeader returns the section header and interface description blocks of
+// a pcapng capture with a single interface of the given link type, whose
+// timestamps have a nanosecond resolution.
+func pcapngHeader(linkType uint16) []byte {
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], 0x1a2b3c4d)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint64(shb[8:], ^uint64(0))
+
+	idb := make([]byte, 8+8+4)
+	binary.LittleEndian.PutUint16(idb[0:], linkType)
+	// if_tsresol option, followed by opt_endofopt.
+	binary.LittleEndian.PutUint16(idb[8:], 9)
+	binary.LittleEndian.PutUint16(idb[10:], 1)
+	idb[12] = 9
+
+	return append(pcapngBlock(0x0a0d0d0a, shb), pcapngBlock(1, idb)...)
+}
+
+// pcapngPacket returns an enhanced packet block holding the given packet,
+// captured on the first interface.
+func pcapngPacket(ts time.Duration, data []byte) []byte {
+	body := make([]byte, 20+len(data))
+	binary.LittleEndian.PutUint32(body[4:], uint32(uint64(ts)>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(data)))
+	copy(body[20:], data)
+	return pcapngBlock(6, body)
+}
+
+// ipv4Packet returns an IPv4 packet sent by the peer to the stack.
+func ipv4Packet(protocol tcpip.TransportProtocolNumber, payload []byte) []byte {
+	b := make([]byte, header.IPv4MinimumSize+len(payload))
+	ip := header.IPv4(b)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(b)),
+		TTL:         65,
+		Protocol:    uint8(protocol),
+		SrcAddr:     peerAddr,
+		DstAddr:     stackAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	copy(b[header.IPv4MinimumSize:], payload)
+	return b
+}
+
+// tcpPacket returns a TCP segment sent by the peer to the stack.
+func tcpPacket(seq, ack uint32, flags uint8, data []byte) []byte {
+	b := make([]byte, header.TCPMinimumSize+len(data))
+	t := header.TCP(b)
+	t.Encode(&header.TCPFields{
+		SrcPort:    peerPort,
+		DstPort:    stackPort,
+		SeqNum:     seq,
+		AckNum:     ack,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      flags,
+		WindowSize: 30000,
+	})
+	copy(b[header.TCPMinimumSize:], data)
+	xsum := header.PseudoHeaderChecksum(tcp.ProtocolNumber, peerAddr, stackAddr)
+	xsum = header.Checksum(data, xsum)
+	t.SetChecksum(^t.CalculateChecksum(xsum, uint16(len(b))))
+	return ipv4Packet(tcp.ProtocolNumber, b)
+}
+
+// udpPacket returns an ethernet frame holding a UDP datagram sent by the peer
+// to the stack.
+func udpPacket(data []byte) []byte {
+	b := make([]byte, header.UDPMinimumSize+len(data))
+	u := header.UDP(b)
+	u.Encode(&header.UDPFields{
+		SrcPort: peerPort,
+		DstPort: stackPort,
+		Length:  uint16(len(b)),
+	})
+	copy(b[header.UDPMinimumSize:], data)
+	xsum := header.PseudoHeaderChecksum(udp.ProtocolNumber, peerAddr, stackAddr)
+	xsum = header.Checksum(data, xsum)
+	u.SetChecksum(^u.CalculateChecksum(xsum, uint16(len(b))))
+
+	ip := ipv4Packet(udp.ProtocolNumber, b)
+	frame := make([]byte, header.EthernetMinimumSize+len(ip))
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: "\x02\x00\x00\x00\x00\x02",
+		DstAddr: "\x02\x00\x00\x00\x00\x01",
+		Type:    ipv4.ProtocolNumber,
+	})
+	copy(frame[header.EthernetMinimumSize:], ip)
+	return frame
+}
+
+// newStack creates a stack with a disabled NIC backed by the given replay
+// endpoint. The capture is replayed once the NIC is enabled.
+func newStack(t *testing.T, id tcpip.LinkEndpointID, transport string) *stack.Stack {
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{transport})
+	if err := s.CreateDisabledNIC(1, id); err != nil {
+		t.Fatalf("CreateDisabledNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+	return s
+}
+
+// enableNIC starts replaying the capture.
+func enableNIC(t *testing.T, s *stack.Stack) {
+	if err := s.EnableNIC(1); err != nil {
+		t.Fatalf("EnableNIC failed: %v", err)
+	}
+}
+
+// waitForResponse waits until the endpoint has recorded more than n packets,
+// and returns the last one.
+func waitForResponse(t *testing.T, e *replay.Endpoint, n int) replay.Packet {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if r := e.Responses(); len(r) > n {
+			return r[len(r)-1]
+		}
+	}
+	t.Fatalf("Timed out waiting for response %d", n+1)
+	return replay.Packet{}
+}
+
+func TestReplayTCP(t *testing.T) {
+	// The SYN-ACK carries a random sequence number, so the rest of the
+	// trace is only written once it has been seen.
+	pr, pw := io.Pipe()
+	capture := append(pcapHeader(linkTypeRaw), pcapRecord(0, tcpPacket(peerISN, 0, header.TCPFlagSyn, nil))...)
+	id, e, err := replay.New(io.MultiReader(bytes.NewReader(capture), pr), replay.Options{Record: true})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	s := newStack(t, id, tcp.ProtocolName)
+	var wq waiter.Queue
+	ep, tcpErr := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if tcpErr != nil {
+		t.Fatalf("NewEndpoint failed: %v", tcpErr)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	enableNIC(t, s)
+
+	synAck := waitForResponse(t, e, 0)
+	h := header.TCP(header.IPv4(synAck.Data).Payload())
+	if h.Flags() != header.TCPFlagSyn|header.TCPFlagAck || h.AckNumber() != peerISN+1 {
+		t.Fatalf("got flags %x and ack %d, want SYN-ACK acknowledging %d", h.Flags(), h.AckNumber(), peerISN+1)
+	}
+	iss := h.SequenceNumber()
+
+	data := []byte("hello replay")
+	go func() {
+		pw.Write(pcapRecord(time.Millisecond, tcpPacket(peerISN+1, iss+1, header.TCPFlagAck, nil)))
+		pw.Write(pcapRecord(2*time.Millisecond, tcpPacket(peerISN+1, iss+1, header.TCPFlagAck|header.TCPFlagPsh, data)))
+		pw.Close()
+	}()
+
+	if err := e.Wait(); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if got := e.Replayed(); got != 3 {
+		t.Fatalf("got %d replayed packets, want 3", got)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+	accepted, _, tcpErr := ep.Accept()
+	if tcpErr == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+		accepted, _, tcpErr = ep.Accept()
+	}
+	if tcpErr != nil {
+		t.Fatalf("Accept failed: %v", tcpErr)
+	}
+	defer accepted.Close()
+
+	// The accepted endpoint was created with a waiter queue of its own, so
+	// it is polled.
+	var got buffer.View
+	for deadline := time.Now().Add(5 * time.Second); len(got) == 0 && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		got, _, _ = accepted.Read(nil)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got data %q, want %q", got, data)
+	}
+
+	// The data was acknowledged.
+	ack := waitForResponse(t, e, 1)
+	if h := header.TCP(header.IPv4(ack.Data).Payload()); h.AckNumber() != peerISN+1+uint32(len(data)) {
+		t.Fatalf("got ack %d, want %d", h.AckNumber(), peerISN+1+uint32(len(data)))
+	}
+}
+
+func TestReplayTimedPcapngEthernet(t *testing.T) {
+	capture := pcapngHeader(linkTypeEthernet)
+	capture = append(capture, pcapngPacket(10*time.Second, udpPacket([]byte("first")))...)
+	capture = append(capture, pcapngPacket(11*time.Second, udpPacket([]byte("second")))...)
+
+	clock := testutil.NewManualClock()
+	id, e, err := replay.New(bytes.NewReader(capture), replay.Options{Timed: true, Clock: clock})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	s := newStack(t, id, udp.ProtocolName)
+	var wq waiter.Queue
+	ep, tcpErr := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if tcpErr != nil {
+		t.Fatalf("NewEndpoint failed: %v", tcpErr)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	enableNIC(t, s)
+
+	read := func() buffer.View {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+			if v, _, err := ep.Read(nil); err == nil {
+				return v
+			}
+		}
+		t.Fatalf("Timed out waiting for data")
+		return nil
+	}
+
+	if got := read(); string(got) != "first" {
+		t.Fatalf("got data %q, want %q", got, "first")
+	}
+
+	// The second datagram is held back until a second has elapsed.
+	clock.Advance(999 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if got := e.Replayed(); got != 1 {
+		t.Fatalf("got %d replayed packets before the second elapsed, want 1", got)
+	}
+
+	clock.Advance(time.Millisecond)
+	if got := read(); string(got) != "second" {
+		t.Fatalf("got data %q, want %q", got, "second")
+	}
+	if err := e.Wait(); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+}
+
+func TestReplayClose(t *testing.T) {
+	capture := pcapngHeader(linkTypeEthernet)
+	capture = append(capture, pcapngPacket(10*time.Second, udpPacket([]byte("first")))...)
+	capture = append(capture, pcapngPacket(11*time.Second, udpPacket([]byte("second")))...)
+
+	id, e, err := replay.New(bytes.NewReader(capture), replay.Options{Timed: true, Clock: testutil.NewManualClock()})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	s := newStack(t, id, udp.ProtocolName)
+	enableNIC(t, s)
+
+	for deadline := time.Now().Add(5 * time.Second); e.Replayed() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the first packet to be replayed")
+		}
+	}
+
+	// The clock never advances, so the replay is stopped while waiting for
+	// the second packet.
+	if err := s.DeleteNIC(1); err != nil {
+		t.Fatalf("DeleteNIC failed: %v", err)
+	}
+	if err := e.Wait(); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if got := e.Replayed(); got != 1 {
+		t.Fatalf("got %d replayed packets, want 1", got)
+	}
+
+	hdr := buffer.NewPrependable(0)
+	if err := e.WritePacket(&stack.Route{}, nil, &hdr, nil, header.IPv4ProtocolNumber); err != tcpip.ErrClosedForSend {
+		t.Fatalf("WritePacket after Close = %v, want %v", err, tcpip.ErrClosedForSend)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	if _, _, err := replay.New(bytes.NewReader([]byte("not a capture at all")), replay.Options{}); err == nil {
+		t.Fatalf("New succeeded on an unknown format")
+	}
+	if _, _, err := replay.New(bytes.NewReader(pcapHeader(105)), replay.Options{}); err == nil {
+		t.Fatalf("New succeeded on an unsupported link type")
+	}
+
+	// A truncated record stops the replay with an error.
+	capture := append(pcapHeader(linkTypeRaw), pcapRecord(0, tcpPacket(peerISN, 0, header.TCPFlagSyn, nil))[:20]...)
+	id, e, err := replay.New(bytes.NewReader(capture), replay.Options{})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	enableNIC(t, newStack(t, id, tcp.ProtocolName))
+	if err := e.Wait(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got Wait() = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
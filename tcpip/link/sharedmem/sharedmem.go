@@ -101,7 +101,8 @@ func New(mtu, bufferSize uint32, addr tcpip.LinkAddress, tx, rx QueueConfig) (tc
 	return stack.RegisterLinkEndpoint(e), nil
 }
 
-// Close frees all resources associated with the endpoint.
+// Close implements stack.LinkEndpointCloser.Close. It frees all resources
+// associated with the endpoint, once the worker goroutine has stopped.
 func (e *endpoint) Close() {
 	// Tell dispatch goroutine to stop, then write to the eventfd so that
 	// it wakes up in case it's sleeping.
@@ -112,15 +113,17 @@ func (e *endpoint) Close() {
 	// know it won't start from now on because stopRequested is set to 1.
 	e.mu.Lock()
 	workerPresent := e.workerStarted
-	e.mu.Unlock()
-
 	if !workerPresent {
 		e.tx.cleanup()
 		e.rx.cleanup()
 	}
+	e.mu.Unlock()
+
+	e.completed.Wait()
 }
 
-// Wait waits until all workers have stopped after a Close() call.
+// Wait waits until all workers have stopped after a Close() call. Close itself
+// waits for them, so it's only useful to wait from another goroutine.
 func (e *endpoint) Wait() {
 	e.completed.Wait()
 }
@@ -162,17 +165,26 @@ func (e *endpoint) LinkAddress() tcpip.LinkAddress {
 
 // WritePacket writes outbound packets to the file descriptor. If it is not
 // currently writable, the packet is dropped.
-func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
-	// Add the ethernet header here.
+func (e *endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	// Add the ethernet header here. Bridged frames keep their source
+	// address.
+	src := r.LocalLinkAddress
+	if src == "" {
+		src = e.addr
+	}
 	eth := header.Ethernet(hdr.Prepend(header.EthernetMinimumSize))
 	eth.Encode(&header.EthernetFields{
 		DstAddr: r.RemoteLinkAddress,
-		SrcAddr: e.addr,
+		SrcAddr: src,
 		Type:    protocol,
 	})
 
-	// Transmit the packet.
+	// Transmit the packet, unless the queues may have been cleaned up.
 	e.mu.Lock()
+	if atomic.LoadUint32(&e.stopRequested) != 0 {
+		e.mu.Unlock()
+		return tcpip.ErrClosedForSend
+	}
 	ok := e.tx.transmit(hdr.UsedBytes(), payload)
 	e.mu.Unlock()
 
@@ -225,15 +237,19 @@ func (e *endpoint) dispatchLoop(d stack.NetworkDispatcher) {
 			continue
 		}
 
-		// Send packet up the stack.
+		// Send packet up the stack. Packets are copied straight from
+		// the peer's memory and can't be corrupted along the way, so
+		// there's no need to verify their checksums.
 		eth := header.Ethernet(b)
 		views[0] = b[header.EthernetMinimumSize:]
 		vv.SetSize(int(n) - header.EthernetMinimumSize)
-		d.DeliverNetworkPacket(e, eth.SourceAddress(), eth.Type(), &vv)
+		stack.DeliverFrame(d, e, eth.SourceAddress(), eth.DestinationAddress(), eth.Type(), &vv, true)
 	}
 
 	// Clean state.
+	e.mu.Lock()
 	e.tx.cleanup()
+	e.mu.Unlock()
 	e.rx.cleanup()
 
 	e.completed.Done()
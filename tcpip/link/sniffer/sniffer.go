@@ -107,7 +107,7 @@ func NewWithFile(lower tcpip.LinkEndpointID, file *os.File, snapLen uint32) (tcp
 // DeliverNetworkPacket implements the stack.NetworkDispatcher interface. It is
 // called by the link-layer endpoint being wrapped when a packet arrives, and
 // logs the packet before forwarding to the actual dispatcher.
-func (e *endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+func (e *endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
 	if atomic.LoadUint32(&LogPackets) == 1 && e.file == nil {
 		LogPacket("recv", protocol, vv.First(), nil)
 	}
@@ -132,7 +132,7 @@ func (e *endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remoteLinkAdd
 			panic(err)
 		}
 	}
-	e.dispatcher.DeliverNetworkPacket(e, remoteLinkAddr, protocol, vv)
+	e.dispatcher.DeliverNetworkPacket(e, remoteLinkAddr, protocol, vv, checksumValidated)
 }
 
 // Attach implements the stack.LinkEndpoint interface. It saves the dispatcher
@@ -165,15 +165,76 @@ func (e *endpoint) LinkAddress() tcpip.LinkAddress {
 	return e.lower.LinkAddress()
 }
 
+// SetMTU implements stack.LinkMTUSetter.SetMTU. It just forwards the request
+// to the lower endpoint.
+func (e *endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	if ep, ok := e.lower.(stack.LinkMTUSetter); ok {
+		return ep.SetMTU(mtu)
+	}
+	return tcpip.ErrNotSupported
+}
+
+// SetLinkAddress implements stack.LinkAddressSetter.SetLinkAddress. It just
+// forwards the request to the lower endpoint.
+func (e *endpoint) SetLinkAddress(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.LinkAddressSetter); ok {
+		return ep.SetLinkAddress(addr)
+	}
+	return tcpip.ErrNotSupported
+}
+
+// AddMulticastFilter implements stack.MulticastLinkEndpoint.AddMulticastFilter.
+// It just forwards the request to the lower endpoint, if it filters multicast
+// frames.
+func (e *endpoint) AddMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.MulticastLinkEndpoint); ok {
+		return ep.AddMulticastFilter(addr)
+	}
+	return nil
+}
+
+// RemoveMulticastFilter implements
+// stack.MulticastLinkEndpoint.RemoveMulticastFilter. It just forwards the
+// request to the lower endpoint, if it filters multicast frames.
+func (e *endpoint) RemoveMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.MulticastLinkEndpoint); ok {
+		return ep.RemoveMulticastFilter(addr)
+	}
+	return nil
+}
+
+// Close implements stack.LinkEndpointCloser.Close. It just forwards the request
+// to the lower endpoint, if it can be closed.
+func (e *endpoint) Close() {
+	if ep, ok := e.lower.(stack.LinkEndpointCloser); ok {
+		ep.Close()
+	}
+}
+
 // WritePacket implements the stack.LinkEndpoint interface. It is called by
 // higher-level protocols to write packets; it just logs the packet and forwards
 // the request to the lower endpoint.
-func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
-	if atomic.LoadUint32(&LogPackets) == 1 && e.file == nil {
-		LogPacket("send", protocol, hdr.UsedBytes(), payload)
+func (e *endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	logPackets := atomic.LoadUint32(&LogPackets) == 1 && e.file == nil
+	logToFile := e.file != nil && atomic.LoadUint32(&LogPacketsToFile) == 1
+	if !logPackets && !logToFile {
+		return e.lower.WritePacket(r, csum, hdr, payload, protocol)
 	}
-	if e.file != nil && atomic.LoadUint32(&LogPacketsToFile) == 1 {
-		bs := [][]byte{nil, hdr.UsedBytes(), payload}
+
+	b := hdr.UsedBytes()
+	if csum != nil {
+		// The transport checksum will only be completed further down,
+		// so log a copy of the headers with the full checksum in place
+		// to show the packet as it will appear on the wire.
+		b = append([]byte(nil), b...)
+		csum.Complete(b[csum.TransportOffset:], payload)
+	}
+
+	if logPackets {
+		LogPacket("send", protocol, b, payload)
+	}
+	if logToFile {
+		bs := [][]byte{nil, b, payload}
 		var length int
 
 		for i, b := range bs[1:] {
@@ -191,7 +252,31 @@ func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload
 			panic(err)
 		}
 	}
-	return e.lower.WritePacket(r, hdr, payload, protocol)
+	return e.lower.WritePacket(r, csum, hdr, payload, protocol)
+}
+
+// maxLoggedHeaderLen is the number of bytes of the packets passed to
+// LogPacketHook that are logged, which is enough for the network and
+// transport headers that LogPacket decodes.
+const maxLoggedHeaderLen = 256
+
+// LogPacketHook is a stack.PacketHook that logs packets like sniffer endpoints
+// do, without wrapping the link endpoints of the stack. It is set with:
+//
+//	s.SetPacketHook(stack.PacketInbound, sniffer.LogPacketHook)
+//	s.SetPacketHook(stack.PacketOutbound, sniffer.LogPacketHook)
+//
+// As with sniffer endpoints, packets are only logged while LogPackets is set.
+func LogPacketHook(p *stack.TracedPacket) {
+	if atomic.LoadUint32(&LogPackets) != 1 {
+		return
+	}
+	prefix := "recv"
+	if p.Direction == stack.PacketOutbound {
+		prefix = "send"
+	}
+	var b [maxLoggedHeaderLen]byte
+	LogPacket(prefix, p.NetworkProtocol, b[:p.CopyTo(b[:])], nil)
 }
 
 // LogPacket logs the given packet.
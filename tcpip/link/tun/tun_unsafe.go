@@ -6,10 +6,15 @@
 package tun
 
 import (
+	"bytes"
 	"syscall"
 	"unsafe"
 )
 
+// tunGetIff is the TUNGETIFF ioctl request, which isn't defined by package
+// syscall.
+const tunGetIff = 0x800454d2
+
 // Open opens the specified TUN device, sets it to non-blocking mode, and
 // returns its file descriptor.
 func Open(name string) (int, error) {
@@ -49,3 +54,23 @@ func open(name string, flags uint16) (int, error) {
 
 	return fd, nil
 }
+
+// Name returns the name of the TUN or TAP device that the given file
+// descriptor is attached to.
+func Name(fd int) (string, error) {
+	var ifr struct {
+		name  [16]byte
+		flags uint16
+		_     [22]byte
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunGetIff, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return "", errno
+	}
+
+	if i := bytes.IndexByte(ifr.name[:], 0); i >= 0 {
+		return string(ifr.name[:i]), nil
+	}
+	return string(ifr.name[:]), nil
+}
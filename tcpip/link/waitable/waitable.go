@@ -41,12 +41,12 @@ func New(lower tcpip.LinkEndpointID) (tcpip.LinkEndpointID, *Endpoint) {
 // It is called by the link-layer endpoint being wrapped when a packet arrives,
 // and only forwards to the actual dispatcher if Wait or WaitDispatch haven't
 // been called.
-func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+func (e *Endpoint) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
 	if !e.dispatchGate.Enter() {
 		return
 	}
 
-	e.dispatcher.DeliverNetworkPacket(e, remoteLinkAddr, protocol, vv)
+	e.dispatcher.DeliverNetworkPacket(e, remoteLinkAddr, protocol, vv, checksumValidated)
 	e.dispatchGate.Leave()
 }
 
@@ -82,15 +82,61 @@ func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
 	return e.lower.LinkAddress()
 }
 
+// SetMTU implements stack.LinkMTUSetter.SetMTU. It just forwards the request
+// to the lower endpoint.
+func (e *Endpoint) SetMTU(mtu uint32) *tcpip.Error {
+	if ep, ok := e.lower.(stack.LinkMTUSetter); ok {
+		return ep.SetMTU(mtu)
+	}
+	return tcpip.ErrNotSupported
+}
+
+// SetLinkAddress implements stack.LinkAddressSetter.SetLinkAddress. It just
+// forwards the request to the lower endpoint.
+func (e *Endpoint) SetLinkAddress(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.LinkAddressSetter); ok {
+		return ep.SetLinkAddress(addr)
+	}
+	return tcpip.ErrNotSupported
+}
+
+// AddMulticastFilter implements stack.MulticastLinkEndpoint.AddMulticastFilter.
+// It just forwards the request to the lower endpoint, if it filters multicast
+// frames.
+func (e *Endpoint) AddMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.MulticastLinkEndpoint); ok {
+		return ep.AddMulticastFilter(addr)
+	}
+	return nil
+}
+
+// RemoveMulticastFilter implements
+// stack.MulticastLinkEndpoint.RemoveMulticastFilter. It just forwards the
+// request to the lower endpoint, if it filters multicast frames.
+func (e *Endpoint) RemoveMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error {
+	if ep, ok := e.lower.(stack.MulticastLinkEndpoint); ok {
+		return ep.RemoveMulticastFilter(addr)
+	}
+	return nil
+}
+
+// Close implements stack.LinkEndpointCloser.Close. It just forwards the request
+// to the lower endpoint, if it can be closed.
+func (e *Endpoint) Close() {
+	if ep, ok := e.lower.(stack.LinkEndpointCloser); ok {
+		ep.Close()
+	}
+}
+
 // WritePacket implements stack.LinkEndpoint.WritePacket. It is called by
 // higher-level protocols to write packets. It only forwards packets to the
 // lower endpoint if Wait or WaitWrite haven't been called.
-func (e *Endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+func (e *Endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
 	if !e.writeGate.Enter() {
 		return nil
 	}
 
-	err := e.lower.WritePacket(r, hdr, payload, protocol)
+	err := e.lower.WritePacket(r, csum, hdr, payload, protocol)
 	e.writeGate.Leave()
 	return err
 }
@@ -64,7 +64,7 @@ func (e *endpoint) MaxHeaderLength() uint16 {
 
 func (e *endpoint) Close() {}
 
-func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error {
+func (e *endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error {
 	return tcpip.ErrNotSupported
 }
 
@@ -75,6 +75,14 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
 		return
 	}
 
+	// Any host using an address we're probing for is a conflict, and so is
+	// another host probing for the same address (RFC 5227 section 2.1.1).
+	if sender := tcpip.Address(h.ProtocolAddressSender()); sender != unspecifiedAddress {
+		e.linkAddrCache.AddressConflict(e.nicid, header.IPv4ProtocolNumber, sender)
+	} else if h.Op() == header.ARPRequest {
+		e.linkAddrCache.AddressConflict(e.nicid, header.IPv4ProtocolNumber, tcpip.Address(h.ProtocolAddressTarget()))
+	}
+
 	switch h.Op() {
 	case header.ARPRequest:
 		localAddr := tcpip.Address(h.ProtocolAddressTarget())
@@ -88,7 +96,7 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
 		copy(pkt.HardwareAddressSender(), r.LocalLinkAddress[:])
 		copy(pkt.ProtocolAddressSender(), h.ProtocolAddressTarget())
 		copy(pkt.ProtocolAddressTarget(), h.ProtocolAddressSender())
-		e.linkEP.WritePacket(r, &hdr, nil, ProtocolNumber)
+		e.linkEP.WritePacket(r, nil, &hdr, nil, ProtocolNumber)
 		fallthrough // also fill the cache from requests
 	case header.ARPReply:
 		addr := tcpip.Address(h.ProtocolAddressSender())
@@ -128,6 +136,23 @@ func (*protocol) LinkAddressProtocol() tcpip.NetworkProtocolNumber {
 
 // LinkAddressRequest implements stack.LinkAddressResolver.
 func (*protocol) LinkAddressRequest(addr, localAddr tcpip.Address, linkEP stack.LinkEndpoint) *tcpip.Error {
+	return sendRequest(localAddr, addr, linkEP)
+}
+
+// LinkAddressProbe implements stack.DuplicateAddressDetector. As per RFC 5227,
+// probes are requests for addr with an all-zero sender address.
+func (*protocol) LinkAddressProbe(addr tcpip.Address, linkEP stack.LinkEndpoint) *tcpip.Error {
+	return sendRequest(unspecifiedAddress, addr, linkEP)
+}
+
+// LinkAddressAnnounce implements stack.DuplicateAddressDetector. As per RFC
+// 5227, announcements are requests for addr with addr as the sender address.
+func (*protocol) LinkAddressAnnounce(addr tcpip.Address, linkEP stack.LinkEndpoint) *tcpip.Error {
+	return sendRequest(addr, addr, linkEP)
+}
+
+// sendRequest broadcasts an ARP request for addr on linkEP.
+func sendRequest(localAddr, addr tcpip.Address, linkEP stack.LinkEndpoint) *tcpip.Error {
 	r := &stack.Route{
 		RemoteLinkAddress: broadcastMAC,
 	}
@@ -140,7 +165,7 @@ func (*protocol) LinkAddressRequest(addr, localAddr tcpip.Address, linkEP stack.
 	copy(h.ProtocolAddressSender(), localAddr)
 	copy(h.ProtocolAddressTarget(), addr)
 
-	return linkEP.WritePacket(r, &hdr, nil, ProtocolNumber)
+	return linkEP.WritePacket(r, nil, &hdr, nil, ProtocolNumber)
 }
 
 // ResolveStaticAddress implements stack.LinkAddressResolver.
@@ -163,6 +188,8 @@ func (p *protocol) Option(option interface{}) *tcpip.Error {
 
 var broadcastMAC = tcpip.LinkAddress([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
 
+var unspecifiedAddress = tcpip.Address([]byte{0, 0, 0, 0})
+
 func init() {
 	stack.RegisterNetworkProtocolFactory(ProtocolName, func() stack.NetworkProtocol {
 		return &protocol{}
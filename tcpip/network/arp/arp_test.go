@@ -5,6 +5,7 @@
 package arp_test
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -137,3 +138,225 @@ func TestDirectRequest(t *testing.T) {
 		// If there is no bug this will reliably succeed.
 	}
 }
+
+const dadAddr = tcpip.Address("\x0a\x00\x00\x04")
+
+// dadResult holds the arguments of a DAD callback.
+type dadResult struct {
+	nicid tcpip.NICID
+	addr  tcpip.Address
+	err   *tcpip.Error
+}
+
+// startDAD starts duplicate address detection for dadAddr on NIC 1, and returns
+// a channel that receives the result.
+func (c *testContext) startDAD(config stack.DADConfig) <-chan dadResult {
+	c.linkEP.LinkEPCapabilities |= stack.CapabilityResolutionRequired
+
+	ch := make(chan dadResult, 1)
+	if err := c.s.AddAddressWithOptions(1, ipv4.ProtocolNumber, dadAddr, stack.AddressOptions{
+		DAD:       true,
+		DADConfig: &config,
+		DADCallback: func(nicid tcpip.NICID, addr tcpip.Address, err *tcpip.Error) {
+			ch <- dadResult{nicid, addr, err}
+		},
+	}); err != nil {
+		c.t.Fatalf("AddAddressWithOptions failed: %v", err)
+	}
+	return ch
+}
+
+// checkRequest reads the next packet sent by the stack and checks that it is an
+// ARP request from the given sender address for dadAddr.
+func (c *testContext) checkRequest(desc string, sender tcpip.Address) {
+	select {
+	case pkt := <-c.linkEP.C:
+		if pkt.Proto != arp.ProtocolNumber {
+			c.t.Fatalf("%s: expected ARP request, got network protocol number %v", desc, pkt.Proto)
+		}
+		h := header.ARP(pkt.Header)
+		if !h.IsValid() {
+			c.t.Fatalf("%s: invalid ARP request len(pkt.Header)=%d", desc, len(pkt.Header))
+		}
+		if h.Op() != header.ARPRequest {
+			c.t.Fatalf("%s: got op %v, want %v", desc, h.Op(), header.ARPRequest)
+		}
+		if got := tcpip.LinkAddress(h.HardwareAddressSender()); got != stackLinkAddr {
+			c.t.Fatalf("%s: got sender hardware address %q, want %q", desc, got, stackLinkAddr)
+		}
+		if got := tcpip.Address(h.ProtocolAddressSender()); got != sender {
+			c.t.Fatalf("%s: got sender address %v, want %v", desc, got, sender)
+		}
+		if got := tcpip.Address(h.ProtocolAddressTarget()); got != dadAddr {
+			c.t.Fatalf("%s: got target address %v, want %v", desc, got, dadAddr)
+		}
+	case <-time.After(5 * time.Second):
+		c.t.Fatalf("%s: timed out waiting for ARP request", desc)
+	}
+}
+
+func (c *testContext) assigned() bool {
+	return c.s.CheckLocalAddress(1, ipv4.ProtocolNumber, dadAddr) != 0
+}
+
+func TestDADProbeAndAnnounce(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	const probes = 3
+	const announcements = 2
+	ch := c.startDAD(stack.DADConfig{
+		ProbeNum:         probes,
+		ProbeMin:         10 * time.Millisecond,
+		ProbeMax:         20 * time.Millisecond,
+		AnnounceWait:     10 * time.Millisecond,
+		AnnounceNum:      announcements,
+		AnnounceInterval: 10 * time.Millisecond,
+	})
+
+	for i := 0; i < probes; i++ {
+		c.checkRequest(fmt.Sprintf("probe %d", i), "\x00\x00\x00\x00")
+		select {
+		case r := <-ch:
+			t.Fatalf("DAD completed after %d probes: %+v", i+1, r)
+		default:
+		}
+		if c.assigned() {
+			t.Fatalf("Tentative address was assigned after %d probes", i+1)
+		}
+	}
+
+	select {
+	case r := <-ch:
+		if want := (dadResult{1, dadAddr, nil}); r != want {
+			t.Fatalf("got DAD result %+v, want %+v", r, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for DAD to complete")
+	}
+	if !c.assigned() {
+		t.Fatalf("Address wasn't assigned after DAD completed")
+	}
+
+	for i := 0; i < announcements; i++ {
+		c.checkRequest(fmt.Sprintf("announcement %d", i), dadAddr)
+	}
+
+	select {
+	case pkt := <-c.linkEP.C:
+		t.Fatalf("Unexpected packet sent after announcements, Proto=%v", pkt.Proto)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDADConflict(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+
+	ch := c.startDAD(stack.DADConfig{
+		ProbeNum:         3,
+		ProbeMin:         time.Second,
+		ProbeMax:         time.Second,
+		AnnounceWait:     time.Second,
+		AnnounceNum:      2,
+		AnnounceInterval: time.Second,
+	})
+
+	c.checkRequest("probe", "\x00\x00\x00\x00")
+
+	// Another host replies to the probe: the address is in use.
+	const senderMAC = "\x01\x02\x03\x04\x05\x06"
+	v := make(buffer.View, header.ARPSize)
+	h := header.ARP(v)
+	h.SetIPv4OverEthernet()
+	h.SetOp(header.ARPReply)
+	copy(h.HardwareAddressSender(), senderMAC)
+	copy(h.ProtocolAddressSender(), dadAddr)
+	copy(h.HardwareAddressTarget(), stackLinkAddr)
+	copy(h.ProtocolAddressTarget(), "\x00\x00\x00\x00")
+	vv := v.ToVectorisedView([1]buffer.View{})
+	c.linkEP.Inject(arp.ProtocolNumber, &vv)
+
+	select {
+	case r := <-ch:
+		if want := (dadResult{1, dadAddr, tcpip.ErrDuplicateAddress}); r != want {
+			t.Fatalf("got DAD result %+v, want %+v", r, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for DAD to complete")
+	}
+
+	if c.assigned() {
+		t.Fatalf("Conflicting address was assigned")
+	}
+	if err := c.s.RemoveAddress(1, dadAddr); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("got RemoveAddress(1, %v) = %v, want %v", dadAddr, err, tcpip.ErrBadLocalAddress)
+	}
+
+	// The address was abandoned, so no more probes are sent.
+	select {
+	case pkt := <-c.linkEP.C:
+		t.Fatalf("Unexpected packet sent after conflict, Proto=%v", pkt.Proto)
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestSetLinkAddress(t *testing.T) {
+	c := newTestContext(t)
+	defer c.cleanup()
+	c.linkEP.LinkEPCapabilities |= stack.CapabilityResolutionRequired
+
+	const newLinkAddr = tcpip.LinkAddress("\x0a\x0a\x0b\x0b\x0c\x0d")
+	if err := c.s.SetLinkAddress(1, newLinkAddr); err != nil {
+		t.Fatalf("SetLinkAddress failed: %v", err)
+	}
+	if got := c.linkEP.LinkAddress(); got != newLinkAddr {
+		t.Fatalf("got LinkAddress() = %q, want %q", got, newLinkAddr)
+	}
+
+	// Both addresses are announced with the new link address.
+	announced := make(map[tcpip.Address]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case pkt := <-c.linkEP.C:
+			h := header.ARP(pkt.Header)
+			if pkt.Proto != arp.ProtocolNumber || !h.IsValid() || h.Op() != header.ARPRequest {
+				t.Fatalf("announcement %d: expected ARP request, got network protocol number %v", i, pkt.Proto)
+			}
+			if got := tcpip.LinkAddress(h.HardwareAddressSender()); got != newLinkAddr {
+				t.Fatalf("announcement %d: got sender hardware address %q, want %q", i, got, newLinkAddr)
+			}
+			sender := tcpip.Address(h.ProtocolAddressSender())
+			if target := tcpip.Address(h.ProtocolAddressTarget()); target != sender {
+				t.Fatalf("announcement %d: got target address %v, want %v", i, target, sender)
+			}
+			announced[sender] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for announcement %d", i)
+		}
+	}
+	if !announced[stackAddr1] || !announced[stackAddr2] {
+		t.Fatalf("got announcements for %v, want %v and %v", announced, stackAddr1, stackAddr2)
+	}
+
+	// Replies use the new link address too.
+	const senderMAC = "\x01\x02\x03\x04\x05\x06"
+	v := make(buffer.View, header.ARPSize)
+	h := header.ARP(v)
+	h.SetIPv4OverEthernet()
+	h.SetOp(header.ARPRequest)
+	copy(h.HardwareAddressSender(), senderMAC)
+	copy(h.ProtocolAddressSender(), "\x0a\x00\x00\x09")
+	copy(h.ProtocolAddressTarget(), stackAddr1)
+	vv := v.ToVectorisedView([1]buffer.View{})
+	c.linkEP.Inject(arp.ProtocolNumber, &vv)
+
+	pkt := <-c.linkEP.C
+	rep := header.ARP(pkt.Header)
+	if !rep.IsValid() || rep.Op() != header.ARPReply {
+		t.Fatalf("expected ARP reply, got network protocol number %v", pkt.Proto)
+	}
+	if got := tcpip.LinkAddress(rep.HardwareAddressSender()); got != newLinkAddr {
+		t.Fatalf("got reply sender hardware address %q, want %q", got, newLinkAddr)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 )
 
@@ -29,16 +30,23 @@ const HighFragThreshold = 4 << 20 // 4MB
 // net.ipv4.ipfrag_low_thresh for more information.
 const LowFragThreshold = 3 << 20 // 3MB
 
+// DefaultMaxFragments is the default maximum number of fragments accepted for
+// a single packet. It is enough to reassemble packets of the maximum size that
+// were fragmented over links with an MTU of about 300 bytes.
+const DefaultMaxFragments = 256
+
 // Fragmentation is the main structure that other modules
 // of the stack should use to implement IP Fragmentation.
 type Fragmentation struct {
 	mu           sync.Mutex
 	highLimit    int
 	lowLimit     int
+	maxFragments int
 	reassemblers map[uint32]*reassembler
 	rList        reassemblerList
 	size         int
 	timeout      time.Duration
+	clock        tcpip.Clock
 }
 
 // NewFragmentation creates a new Fragmentation.
@@ -50,10 +58,15 @@ type Fragmentation struct {
 // lowMemoryLimit specifies the limit on which we will reach by dropping
 // fragments after reaching highMemoryLimit.
 //
+// maxFragments specifies the maximum number of fragments accepted for a single
+// packet. When it's exceeded, the reassembly of the packet is aborted and the
+// fragments received so far are dropped. A value of zero means no limit.
+//
 // reassemblingTimeout specifes the maximum time allowed to reassemble a packet.
 // Fragments are lazily evicted only when a new a packet with an
-// already existing fragmentation-id arrives after the timeout.
-func NewFragmentation(highMemoryLimit, lowMemoryLimit int, reassemblingTimeout time.Duration) *Fragmentation {
+// already existing fragmentation-id arrives after the timeout. It is measured
+// with clock.
+func NewFragmentation(highMemoryLimit, lowMemoryLimit, maxFragments int, reassemblingTimeout time.Duration, clock tcpip.Clock) *Fragmentation {
 	if lowMemoryLimit >= highMemoryLimit {
 		lowMemoryLimit = highMemoryLimit
 	}
@@ -66,25 +79,38 @@ func NewFragmentation(highMemoryLimit, lowMemoryLimit int, reassemblingTimeout t
 		reassemblers: make(map[uint32]*reassembler),
 		highLimit:    highMemoryLimit,
 		lowLimit:     lowMemoryLimit,
+		maxFragments: maxFragments,
 		timeout:      reassemblingTimeout,
+		clock:        clock,
 	}
 }
 
 // Process processes an incoming fragment beloning to an ID
 // and returns a complete packet when all the packets belonging to that ID have been received.
-func (f *Fragmentation) Process(id uint32, first, last uint16, more bool, vv *buffer.VectorisedView) (buffer.VectorisedView, bool) {
+// aborted is set if the fragment was one too many, and the reassembly of the
+// packet was given up.
+func (f *Fragmentation) Process(id uint32, first, last uint16, more bool, vv *buffer.VectorisedView) (res buffer.VectorisedView, done bool, aborted bool) {
 	f.mu.Lock()
 	r, ok := f.reassemblers[id]
-	if ok && r.tooOld(f.timeout) {
+	now := f.clock.NowNanoseconds()
+	if ok && r.tooOld(now, f.timeout) {
 		// This is very likely to be an id-collision or someone performing a slow-rate attack.
 		f.release(r)
 		ok = false
 	}
 	if !ok {
-		r = newReassembler(id)
+		r = newReassembler(id, now)
 		f.reassemblers[id] = r
 		f.rList.PushFront(r)
 	}
+	r.fragments++
+	if f.maxFragments > 0 && r.fragments > f.maxFragments {
+		// Too many fragments for a single packet, which likely means
+		// someone is trying to exhaust our resources. Give up on it.
+		f.release(r)
+		f.mu.Unlock()
+		return buffer.NewVectorisedView(0, nil), false, true
+	}
 	f.mu.Unlock()
 
 	res, done, consumed := r.process(first, last, more, vv)
@@ -104,7 +130,7 @@ func (f *Fragmentation) Process(id uint32, first, last uint16, more bool, vv *bu
 		}
 	}
 	f.mu.Unlock()
-	return res, done
+	return res, done, false
 }
 
 func (f *Fragmentation) release(r *reassembler) {
@@ -6,10 +6,13 @@ package fragmentation
 
 import (
 	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/testutil"
 )
 
 // vv is a helper to build VectorisedView from different strings.
@@ -76,9 +79,9 @@ var processTestCases = []struct {
 
 func TestFragmentationProcess(t *testing.T) {
 	for _, c := range processTestCases {
-		f := NewFragmentation(1024, 512, DefaultReassembleTimeout)
+		f := NewFragmentation(1024, 512, DefaultMaxFragments, DefaultReassembleTimeout, &tcpip.StdClock{})
 		for i, in := range c.in {
-			vv, done := f.Process(in.id, in.first, in.last, in.more, in.vv)
+			vv, done, _ := f.Process(in.id, in.first, in.last, in.more, in.vv)
 			if !reflect.DeepEqual(vv, *(c.out[i].vv)) {
 				t.Errorf("Test \"%s\" Process() returned a wrong vv. Got %v. Want %v", c.comment, vv, *(c.out[i].vv))
 			}
@@ -101,21 +104,22 @@ func TestFragmentationProcess(t *testing.T) {
 
 func TestReassemblingTimeout(t *testing.T) {
 	timeout := time.Millisecond
-	f := NewFragmentation(1024, 512, timeout)
+	clock := testutil.NewManualClock()
+	f := NewFragmentation(1024, 512, DefaultMaxFragments, timeout, clock)
 	// Send first fragment with id = 0, first = 0, last = 0, and more = true.
 	f.Process(0, 0, 0, true, vv(1, "0"))
-	// Sleep more than the timeout.
-	time.Sleep(2 * timeout)
+	// Let more than the timeout elapse.
+	clock.Advance(2 * timeout)
 	// Send another fragment that completes a packet.
 	// However, no packet should be reassembled because the fragment arrived after the timeout.
-	_, done := f.Process(0, 1, 1, false, vv(1, "1"))
+	_, done, _ := f.Process(0, 1, 1, false, vv(1, "1"))
 	if done {
 		t.Errorf("Fragmentation does not respect the reassembling timeout.")
 	}
 }
 
 func TestMemoryLimits(t *testing.T) {
-	f := NewFragmentation(3, 1, DefaultReassembleTimeout)
+	f := NewFragmentation(3, 1, DefaultMaxFragments, DefaultReassembleTimeout, &tcpip.StdClock{})
 	// Send first fragment with id = 0.
 	f.Process(0, 0, 0, true, vv(1, "0"))
 	// Send first fragment with id = 1.
@@ -139,7 +143,7 @@ func TestMemoryLimits(t *testing.T) {
 }
 
 func TestMemoryLimitsIgnoresDuplicates(t *testing.T) {
-	f := NewFragmentation(1, 0, DefaultReassembleTimeout)
+	f := NewFragmentation(1, 0, DefaultMaxFragments, DefaultReassembleTimeout, &tcpip.StdClock{})
 	// Send first fragment with id = 0.
 	f.Process(0, 0, 0, true, vv(1, "0"))
 	// Send the same packet again.
@@ -153,14 +157,100 @@ func TestMemoryLimitsIgnoresDuplicates(t *testing.T) {
 }
 
 func TestFragmentationViewsDoNotEscape(t *testing.T) {
-	f := NewFragmentation(1024, 512, DefaultReassembleTimeout)
+	f := NewFragmentation(1024, 512, DefaultMaxFragments, DefaultReassembleTimeout, &tcpip.StdClock{})
 	in := vv(2, "0", "1")
 	f.Process(0, 0, 1, true, in)
 	// Modify input view.
 	in.RemoveFirst()
-	got, _ := f.Process(0, 2, 2, false, vv(1, "2"))
+	got, _, _ := f.Process(0, 2, 2, false, vv(1, "2"))
 	want := vv(3, "0", "1", "2")
 	if !reflect.DeepEqual(got, *want) {
 		t.Errorf("Process() returned a wrong vv. Got %v. Want %v", got, *want)
 	}
 }
+
+func TestMaxFragments(t *testing.T) {
+	const maxFragments = 5
+	f := NewFragmentation(1024, 512, maxFragments, DefaultReassembleTimeout, &tcpip.StdClock{})
+	// Send one more one-byte fragment with id = 0 than allowed.
+	for i := 0; i <= maxFragments; i++ {
+		s := strconv.Itoa(i)
+		_, done, aborted := f.Process(0, uint16(i), uint16(i), true, vv(1, s))
+		if done {
+			t.Fatalf("Process(0, %d, %d, true, %q) completed a reassembly", i, i, s)
+		}
+		if want := i == maxFragments; aborted != want {
+			t.Fatalf("Process(0, %d, %d, true, %q) got aborted = %t, want %t", i, i, s, aborted, want)
+		}
+	}
+
+	if _, ok := f.reassemblers[0]; ok {
+		t.Errorf("Reassembly of id=0 was not aborted after %d fragments", maxFragments+1)
+	}
+	if f.size != 0 {
+		t.Errorf("Wrong size after aborted reassembly: got=%d, want=0", f.size)
+	}
+
+	// A packet with fewer fragments than the limit is still reassembled.
+	f.Process(1, 0, 0, true, vv(1, "0"))
+	f.Process(1, 1, 1, true, vv(1, "1"))
+	got, done, _ := f.Process(1, 2, 2, false, vv(1, "2"))
+	if !done {
+		t.Fatalf("Reassembly of id=1 is not complete")
+	}
+	if want := vv(3, "0", "1", "2"); !reflect.DeepEqual(got, *want) {
+		t.Errorf("Process() returned a wrong vv. Got %v. Want %v", got, *want)
+	}
+}
+
+// pooledVv is a helper to build a VectorisedView held in reusable memory, whose
+// release is counted in released.
+func pooledVv(s string, released *int) *buffer.VectorisedView {
+	vv := vv(len(s), s)
+	vv.SetBuffer(buffer.NewPacketBuffer(func() { *released++ }))
+	return vv
+}
+
+func TestPooledFragmentsReleased(t *testing.T) {
+	timeout := time.Millisecond
+	clock := testutil.NewManualClock()
+	f := NewFragmentation(1024, 512, DefaultMaxFragments, timeout, clock)
+
+	// The stack releases its own references once Process returns.
+	process := func(id uint32, first, last uint16, more bool, vv *buffer.VectorisedView) (buffer.VectorisedView, bool) {
+		res, done, _ := f.Process(id, first, last, more, vv)
+		vv.Release()
+		return res, done
+	}
+
+	// A reassembled packet releases its fragments, and doesn't refer to
+	// their memory anymore.
+	var released int
+	in := []*buffer.VectorisedView{pooledVv("01", &released), pooledVv("23", &released)}
+	process(0, 0, 1, true, in[0])
+	got, done := process(0, 2, 3, false, in[1])
+	if !done {
+		t.Fatalf("Reassembly of id=0 is not complete")
+	}
+	if released != 2 {
+		t.Errorf("got %d fragments released after reassembly, want 2", released)
+	}
+	for _, vv := range in {
+		copy(vv.First(), "xx")
+	}
+	if got, want := string(got.ToView()), "0123"; got != want {
+		t.Errorf("Process() returned %q after the fragments were reused, want %q", got, want)
+	}
+
+	// An expired reassembly releases its fragments.
+	released = 0
+	process(1, 0, 1, true, pooledVv("01", &released))
+	if released != 0 {
+		t.Fatalf("got %d fragments released before the reassembly expired, want 0", released)
+	}
+	clock.Advance(2 * timeout)
+	process(1, 2, 3, false, pooledVv("23", &released))
+	if released != 1 {
+		t.Errorf("got %d fragments released after the reassembly expired, want 1", released)
+	}
+}
@@ -29,16 +29,24 @@ type reassembler struct {
 	deleted      int
 	heap         fragHeap
 	done         bool
-	creationTime time.Time
+	creationTime int64
+
+	// pooled is set if some of the fragments are held in reusable memory,
+	// see buffer.PacketBuffer.
+	pooled bool
+
+	// fragments is the number of fragments received so far. It is
+	// protected by the owning Fragmentation's mutex.
+	fragments int
 }
 
-func newReassembler(id uint32) *reassembler {
+func newReassembler(id uint32, now int64) *reassembler {
 	r := &reassembler{
 		id:           id,
 		holes:        make([]hole, 0, 16),
 		deleted:      0,
 		heap:         make(fragHeap, 0, 8),
-		creationTime: time.Now(),
+		creationTime: now,
 	}
 	r.holes = append(r.holes, hole{
 		first:   0,
@@ -80,7 +88,12 @@ func (r *reassembler) process(first, last uint16, more bool, vv *buffer.Vectoris
 	}
 	if r.updateHoles(first, last, more) {
 		// We store the incoming packet only if it filled some holes.
+		// The clone keeps the memory of the fragment until the packet
+		// is reassembled or given up on.
 		uu := vv.Clone(nil)
+		if uu.Buffer() != nil {
+			r.pooled = true
+		}
 		heap.Push(&r.heap, fragment{offset: first, vv: &uu})
 		consumed = vv.Size()
 		r.size += consumed
@@ -89,21 +102,39 @@ func (r *reassembler) process(first, last uint16, more bool, vv *buffer.Vectoris
 	if r.deleted < len(r.holes) {
 		return buffer.NewVectorisedView(0, nil), false, consumed
 	}
+	frags := append([]fragment(nil), r.heap...)
 	res, err := r.heap.reassemble()
 	if err != nil {
 		panic(fmt.Sprintf("reassemble failed with: %v. There is probably a bug in the code handling the holes.", err))
 	}
+	if r.pooled {
+		// The memory of the fragments is about to be reused, so the
+		// packet is copied out of it.
+		v := res.ToView()
+		res = v.ToVectorisedView([1]buffer.View{})
+	}
+	for _, f := range frags {
+		f.vv.Release()
+	}
 	return res, true, consumed
 }
 
-func (r *reassembler) tooOld(timeout time.Duration) bool {
-	return time.Now().Sub(r.creationTime) > timeout
+// tooOld returns whether the reassembly has been going on for longer than
+// timeout at time now.
+func (r *reassembler) tooOld(now int64, timeout time.Duration) bool {
+	return time.Duration(now-r.creationTime) > timeout
 }
 
+// checkDoneOrMark marks r as done, releasing the fragments it still holds, and
+// returns whether it already was.
 func (r *reassembler) checkDoneOrMark() bool {
 	r.mu.Lock()
 	prev := r.done
 	r.done = true
+	for _, f := range r.heap {
+		f.vv.Release()
+	}
+	r.heap = nil
 	r.mu.Unlock()
 	return prev
 }
@@ -9,6 +9,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/header"
 )
 
@@ -78,6 +79,34 @@ func IPv6FragmentHash(h header.IPv6, f header.IPv6Fragment) uint32 {
 	return Hash3Words(f.ID(), y, z, hashIV)
 }
 
+// IPv6FlowLabel computes the flow label of the packets of the flow identified
+// by the given addresses, transport protocol and ports, as suggested in RFC
+// 6437. The ports are packed in a single word, and may be zero for protocols
+// that don't have any. The label is never zero, since zero denotes packets that
+// aren't labeled.
+func IPv6FlowLabel(src, dst tcpip.Address, protocol tcpip.TransportProtocolNumber, ports uint32) uint32 {
+	// Up to two IPv6 addresses, the protocol and the ports, padded with
+	// zeroes to a multiple of 3 words.
+	var w [12]uint32
+	n := 0
+	for _, a := range []tcpip.Address{src, dst} {
+		for i := 0; i+4 <= len(a); i += 4 {
+			w[n] = uint32(a[i]) | uint32(a[i+1])<<8 | uint32(a[i+2])<<16 | uint32(a[i+3])<<24
+			n++
+		}
+	}
+	w[n], w[n+1] = uint32(protocol), ports
+
+	h := hashIV
+	for i := 0; i < n+2; i += 3 {
+		h = Hash3Words(w[i], w[i+1], w[i+2], h)
+	}
+	if l := h & header.IPv6FlowLabelMask; l != 0 {
+		return l
+	}
+	return 1
+}
+
 func rol32(v, shift uint32) uint32 {
 	return (v << shift) | (v >> ((-shift) & 31))
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
 	"github.com/google/netstack/tcpip/network/ipv4"
 	"github.com/google/netstack/tcpip/network/ipv6"
 	"github.com/google/netstack/tcpip/stack"
@@ -32,9 +33,15 @@ type testObject struct {
 	v4       bool
 	typ      stack.ControlType
 	extra    uint32
+	caps     stack.LinkEndpointCapabilities
 
 	dataCalls    int
 	controlCalls int
+
+	// csum and transport hold the partial checksum information and the
+	// transport header of the last packet written.
+	csum      *stack.PartialChecksum
+	transport []byte
 }
 
 // checkValues verifies that the transport protocol, data contents, src & dst
@@ -73,6 +80,11 @@ func (t *testObject) DeliverTransportPacket(r *stack.Route, protocol tcpip.Trans
 	t.dataCalls++
 }
 
+// DeliverRawPacket is only implemented to satisfy the TransportDispatcher
+// interface.
+func (*testObject) DeliverRawPacket(*stack.Route, tcpip.TransportProtocolNumber, buffer.View, *buffer.VectorisedView) {
+}
+
 // DeliverTransportControlPacket is called by network endpoints after parsing
 // incoming control (ICMP) packets. This is used by the test object to verify
 // that the results of the parsing are expected.
@@ -97,8 +109,8 @@ func (*testObject) MTU() uint32 {
 }
 
 // Capabilities implements stack.LinkEndpoint.Capabilities.
-func (*testObject) Capabilities() stack.LinkEndpointCapabilities {
-	return 0
+func (t *testObject) Capabilities() stack.LinkEndpointCapabilities {
+	return t.caps
 }
 
 // MaxHeaderLength is only implemented to satisfy the LinkEndpoint interface.
@@ -114,7 +126,7 @@ func (*testObject) LinkAddress() tcpip.LinkAddress {
 // WritePacket is called by network endpoints after producing a packet and
 // writing it to the link endpoint. This is used by the test object to verify
 // that the produced packet is as expected.
-func (t *testObject) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+func (t *testObject) WritePacket(_ *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
 	var prot tcpip.TransportProtocolNumber
 	var srcAddr tcpip.Address
 	var dstAddr tcpip.Address
@@ -124,13 +136,16 @@ func (t *testObject) WritePacket(_ *stack.Route, hdr *buffer.Prependable, payloa
 		prot = tcpip.TransportProtocolNumber(h.Protocol())
 		srcAddr = h.SourceAddress()
 		dstAddr = h.DestinationAddress()
+		t.transport = h[h.HeaderLength():]
 
 	} else {
 		h := header.IPv6(hdr.UsedBytes())
 		prot = tcpip.TransportProtocolNumber(h.NextHeader())
 		srcAddr = h.SourceAddress()
 		dstAddr = h.DestinationAddress()
+		t.transport = h[header.IPv6MinimumSize:]
 	}
+	t.csum = csum
 	var views [1]buffer.View
 	vv := payload.ToVectorisedView(views)
 	t.checkValues(prot, &vv, srcAddr, dstAddr)
@@ -164,11 +179,80 @@ func TestIPv4Send(t *testing.T) {
 		RemoteAddress: o.dstAddr,
 		LocalAddress:  o.srcAddr,
 	}
-	if err := ep.WritePacket(&r, &hdr, payload, 123); err != nil {
+	if err := ep.WritePacket(&r, nil, &hdr, payload, 123); err != nil {
 		t.Fatalf("WritePacket failed: %v", err)
 	}
 }
 
+func TestIPv4SendPartialChecksum(t *testing.T) {
+	cases := []struct {
+		name    string
+		caps    stack.LinkEndpointCapabilities
+		partial bool
+	}{
+		{"NoOffload", 0, false},
+		{"TXChecksumOffload", stack.CapabilityTXChecksumOffload, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o := testObject{t: t, v4: true, caps: c.caps}
+			proto := ipv4.NewProtocol()
+			ep, err := proto.NewEndpoint(1, "\x0a\x00\x00\x01", nil, nil, &o)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+
+			payload := buffer.NewView(101)
+			for i := range payload {
+				payload[i] = uint8(i)
+			}
+
+			// Build a UDP header holding only the pseudo-header
+			// checksum, as a transport endpoint would when the
+			// route advertises checksum offloading.
+			hdr := buffer.NewPrependable(int(ep.MaxHeaderLength()) + header.UDPMinimumSize)
+			udp := header.UDP(hdr.Prepend(header.UDPMinimumSize))
+			length := uint16(header.UDPMinimumSize + len(payload))
+			udp.Encode(&header.UDPFields{
+				SrcPort: 1,
+				DstPort: 2,
+				Length:  length,
+			})
+			xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, "\x0a\x00\x00\x01", "\x0a\x00\x00\x02")
+			xsum = header.PseudoHeaderChecksumWithLength(xsum, length)
+			udp.SetChecksum(xsum)
+
+			o.protocol = header.UDPProtocolNumber
+			o.srcAddr = "\x0a\x00\x00\x01"
+			o.dstAddr = "\x0a\x00\x00\x02"
+			o.contents = payload
+
+			r := stack.Route{
+				RemoteAddress: o.dstAddr,
+				LocalAddress:  o.srcAddr,
+			}
+			csum := &stack.PartialChecksum{ChecksumOffset: header.UDPChecksumOffset}
+			if err := ep.WritePacket(&r, csum, &hdr, payload, header.UDPProtocolNumber); err != nil {
+				t.Fatalf("WritePacket failed: %v", err)
+			}
+
+			if got := o.csum != nil; got != c.partial {
+				t.Fatalf("got partial checksum = %v, want %v", got, c.partial)
+			}
+			if c.partial {
+				if got, want := o.csum.TransportOffset, uint16(header.IPv4MinimumSize); got != want {
+					t.Fatalf("got TransportOffset = %v, want %v", got, want)
+				}
+				o.csum.Complete(o.transport, payload)
+			}
+
+			if got := header.Checksum(payload, header.Checksum(o.transport, xsum)); got != 0xffff {
+				t.Fatalf("Bad checksum: got 0x%x, want 0xffff", got)
+			}
+		})
+	}
+}
+
 func TestIPv4Receive(t *testing.T) {
 	o := testObject{t: t, v4: true}
 	proto := ipv4.NewProtocol()
@@ -188,6 +272,7 @@ func TestIPv4Receive(t *testing.T) {
 		SrcAddr:     "\x0a\x00\x00\x02",
 		DstAddr:     "\x0a\x00\x00\x01",
 	})
+	ip.SetChecksum(^ip.CalculateChecksum())
 
 	// Make payload be non-zero.
 	for i := header.IPv4MinimumSize; i < totalLen; i++ {
@@ -260,6 +345,7 @@ func TestIPv4ReceiveControl(t *testing.T) {
 				SrcAddr:     "\x0a\x00\x00\xbb",
 				DstAddr:     "\x0a\x00\x00\x01",
 			})
+			ip.SetChecksum(^ip.CalculateChecksum())
 
 			// Create the ICMP header.
 			icmp := header.ICMPv4(view[header.IPv4MinimumSize:])
@@ -325,6 +411,7 @@ func TestIPv4FragmentationReceive(t *testing.T) {
 		SrcAddr:        "\x0a\x00\x00\x02",
 		DstAddr:        "\x0a\x00\x00\x01",
 	})
+	ip1.SetChecksum(^ip1.CalculateChecksum())
 	// Make payload be non-zero.
 	for i := header.IPv4MinimumSize; i < totalLen; i++ {
 		frag1[i] = uint8(i)
@@ -341,6 +428,7 @@ func TestIPv4FragmentationReceive(t *testing.T) {
 		SrcAddr:        "\x0a\x00\x00\x02",
 		DstAddr:        "\x0a\x00\x00\x01",
 	})
+	ip2.SetChecksum(^ip2.CalculateChecksum())
 	// Make payload be non-zero.
 	for i := header.IPv4MinimumSize; i < totalLen; i++ {
 		frag2[i] = uint8(i)
@@ -375,6 +463,45 @@ func TestIPv4FragmentationReceive(t *testing.T) {
 	}
 }
 
+func TestIPv4ReassemblyAborted(t *testing.T) {
+	const maxFragments = 2
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, nil)
+	if err := s.SetNetworkProtocolOption(ipv4.ProtocolNumber, ipv4.MaxFragmentsOption(maxFragments)); err != nil {
+		t.Fatalf("SetNetworkProtocolOption failed: %v", err)
+	}
+	id, linkEP := channel.New(10, 1500, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, "\x0a\x00\x00\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	// Send one more 8-byte fragment of the same packet than allowed.
+	for i := 0; i <= maxFragments; i++ {
+		frag := buffer.NewView(header.IPv4MinimumSize + 8)
+		ip := header.IPv4(frag)
+		ip.Encode(&header.IPv4Fields{
+			IHL:            header.IPv4MinimumSize,
+			TotalLength:    uint16(len(frag)),
+			ID:             1,
+			TTL:            20,
+			Protocol:       10,
+			FragmentOffset: uint16(8 * i),
+			Flags:          header.IPv4FlagMoreFragments,
+			SrcAddr:        "\x0a\x00\x00\x02",
+			DstAddr:        "\x0a\x00\x00\x01",
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		vv := frag.ToVectorisedView([1]buffer.View{})
+		linkEP.Inject(ipv4.ProtocolNumber, &vv)
+	}
+
+	if got := s.MutableStats().IP.ReassemblyAborted.Value(); got != 1 {
+		t.Fatalf("got IP.ReassemblyAborted = %d, want 1", got)
+	}
+}
+
 func TestIPv6Send(t *testing.T) {
 	o := testObject{t: t}
 	proto := ipv6.NewProtocol()
@@ -402,7 +529,7 @@ func TestIPv6Send(t *testing.T) {
 		RemoteAddress: o.dstAddr,
 		LocalAddress:  o.srcAddr,
 	}
-	if err := ep.WritePacket(&r, &hdr, payload, 123); err != nil {
+	if err := ep.WritePacket(&r, nil, &hdr, payload, 123); err != nil {
 		t.Fatalf("WritePacket failed: %v", err)
 	}
 }
@@ -42,7 +42,7 @@ func (e *endpoint) handleControl(typ stack.ControlType, extra uint32, vv *buffer
 	// Skip the ip header, then deliver control message.
 	vv.TrimFront(hlen)
 	p := h.TransportProtocol()
-	e.dispatcher.DeliverTransportControlPacket(e.id.LocalAddress, h.DestinationAddress(), ProtocolNumber, p, typ, extra, vv)
+	e.dispatcher.DeliverTransportControlPacket(h.SourceAddress(), h.DestinationAddress(), ProtocolNumber, p, typ, extra, vv)
 }
 
 func (e *endpoint) handleICMP(r *stack.Route, vv *buffer.VectorisedView) {
@@ -57,6 +57,7 @@ func (e *endpoint) handleICMP(r *stack.Route, vv *buffer.VectorisedView) {
 		if len(v) < header.ICMPv4EchoMinimumSize {
 			return
 		}
+		r.Stats().ICMP.EchoRequestsReceived.Increment()
 		vv.TrimFront(header.ICMPv4MinimumSize)
 		req := echoRequest{r: r.Clone(), v: vv.ToView()}
 		select {
@@ -69,14 +70,19 @@ func (e *endpoint) handleICMP(r *stack.Route, vv *buffer.VectorisedView) {
 		if len(v) < header.ICMPv4EchoMinimumSize {
 			return
 		}
+		r.Stats().ICMP.EchoRepliesReceived.Increment()
 		e.dispatcher.DeliverTransportPacket(r, header.ICMPv4ProtocolNumber, vv)
 
 	case header.ICMPv4DstUnreachable:
 		if len(v) < header.ICMPv4DstUnreachableMinimumSize {
 			return
 		}
+		r.Stats().ICMP.DstUnreachableReceived.Increment()
 		vv.TrimFront(header.ICMPv4DstUnreachableMinimumSize)
 		switch h.Code() {
+		case header.ICMPv4NetUnreachable, header.ICMPv4HostUnreachable:
+			e.handleControl(stack.ControlHostUnreachable, 0, vv)
+
 		case header.ICMPv4PortUnreachable:
 			e.handleControl(stack.ControlPortUnreachable, 0, vv)
 
@@ -110,5 +116,5 @@ func sendPing4(r *stack.Route, code byte, data buffer.View) *tcpip.Error {
 	data = data[header.ICMPv4EchoMinimumSize-header.ICMPv4MinimumSize:]
 	icmpv4.SetChecksum(^header.Checksum(icmpv4, header.Checksum(data, 0)))
 
-	return r.WritePacket(&hdr, data, header.ICMPv4ProtocolNumber)
+	return r.WritePacket(nil, &hdr, data, header.ICMPv4ProtocolNumber)
 }
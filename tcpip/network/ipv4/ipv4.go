@@ -11,6 +11,7 @@
 package ipv4
 
 import (
+	"sync"
 	"sync/atomic"
 
 	"github.com/google/netstack/tcpip"
@@ -34,8 +35,18 @@ const (
 
 	// buckets is the number of identifier buckets.
 	buckets = 2048
+
+	// defaultTTL is the initial tcpip.DefaultTTLOption.
+	defaultTTL = 65
 )
 
+// MaxFragmentsOption is used by SetOption and Option to configure the maximum
+// number of fragments accepted when reassembling a single packet. It only
+// applies to endpoints created after it is set. A value of zero means no
+// limit. There is no IPv6 equivalent, as the ipv6 package doesn't reassemble
+// fragments.
+type MaxFragmentsOption int
+
 type address [header.IPv4AddressSize]byte
 
 type endpoint struct {
@@ -46,15 +57,19 @@ type endpoint struct {
 	dispatcher    stack.TransportDispatcher
 	echoRequests  chan echoRequest
 	fragmentation *fragmentation.Fragmentation
+	ids           *ids
+	protocol      *protocol
 }
 
-func newEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) *endpoint {
+func newEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint, maxFragments int, clock tcpip.Clock, ids *ids, p *protocol) *endpoint {
 	e := &endpoint{
+		protocol:      p,
 		nicid:         nicid,
 		linkEP:        linkEP,
 		dispatcher:    dispatcher,
+		ids:           ids,
 		echoRequests:  make(chan echoRequest, 10),
-		fragmentation: fragmentation.NewFragmentation(fragmentation.HighFragThreshold, fragmentation.LowFragThreshold, fragmentation.DefaultReassembleTimeout),
+		fragmentation: fragmentation.NewFragmentation(fragmentation.HighFragThreshold, fragmentation.LowFragThreshold, maxFragments, fragmentation.DefaultReassembleTimeout, clock),
 	}
 	copy(e.address[:], addr)
 	e.id = stack.NetworkEndpointID{tcpip.Address(e.address[:])}
@@ -92,27 +107,43 @@ func (e *endpoint) MaxHeaderLength() uint16 {
 }
 
 // WritePacket writes a packet to the given destination address and protocol.
-func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error {
+func (e *endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error {
+	if csum != nil {
+		if e.linkEP.Capabilities()&stack.CapabilityTXChecksumOffload == 0 {
+			// The link can't complete the transport checksum, so
+			// do it in software.
+			csum.Complete(hdr.UsedBytes(), payload)
+			csum = nil
+		} else {
+			csum.TransportOffset = header.IPv4MinimumSize
+		}
+	}
+
 	ip := header.IPv4(hdr.Prepend(header.IPv4MinimumSize))
 	length := uint16(hdr.UsedLength() + len(payload))
 	id := uint32(0)
 	if length > header.IPv4MaximumHeaderSize+8 {
 		// Packets of 68 bytes or less are required by RFC 791 to not be
 		// fragmented, so we only assign ids to larger packets.
-		id = atomic.AddUint32(&ids[hashRoute(r, protocol)%buckets], 1)
+		id = e.ids.next(r, protocol)
+	}
+	ttl := r.TTL
+	if ttl == 0 {
+		ttl = uint8(atomic.LoadUint32(&e.protocol.defaultTTL))
 	}
 	ip.Encode(&header.IPv4Fields{
 		IHL:         header.IPv4MinimumSize,
+		TOS:         r.TOS,
 		TotalLength: length,
 		ID:          uint16(id),
-		TTL:         65,
+		TTL:         ttl,
 		Protocol:    uint8(protocol),
 		SrcAddr:     tcpip.Address(e.address[:]),
 		DstAddr:     r.RemoteAddress,
 	})
 	ip.SetChecksum(^ip.CalculateChecksum())
 
-	return e.linkEP.WritePacket(r, hdr, payload, ProtocolNumber)
+	return e.linkEP.WritePacket(r, csum, hdr, payload, ProtocolNumber)
 }
 
 // HandlePacket is called by the link layer when new ipv4 packets arrive for
@@ -123,7 +154,25 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
 		return
 	}
 
+	// Verify the header checksum, unless the link already did.
+	if !r.ChecksumValidated && h.CalculateChecksum() != 0xffff {
+		r.Stats().MalformedRcvdPackets.Increment()
+		return
+	}
+
 	hlen := int(h.HeaderLength())
+	if hlen > header.IPv4MinimumSize {
+		sr, ok := h.SourceRoute()
+		if !ok {
+			r.Stats().MalformedRcvdPackets.Increment()
+			return
+		}
+		if sr != nil && (atomic.LoadUint32(&e.protocol.acceptSourceRoute) == 0 || !sr.Done()) {
+			r.Stats().IP.SourceRoutedPacketsDropped.Increment()
+			return
+		}
+	}
+
 	tlen := int(h.TotalLength())
 	vv.TrimFront(hlen)
 	vv.CapLength(tlen - hlen)
@@ -132,13 +181,29 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
 	if more || h.FragmentOffset() != 0 {
 		// The packet is a fragment, let's try to reassemble it.
 		last := h.FragmentOffset() + uint16(vv.Size()) - 1
-		tt, ready := e.fragmentation.Process(hash.IPv4FragmentHash(h), h.FragmentOffset(), last, more, vv)
+		tt, ready, aborted := e.fragmentation.Process(hash.IPv4FragmentHash(h), h.FragmentOffset(), last, more, vv)
+		if aborted {
+			r.Stats().IP.ReassemblyAborted.Increment()
+		}
 		if !ready {
 			return
 		}
 		vv = &tt
+
+		// Whatever the link said about the last fragment doesn't
+		// apply to the reassembled packet.
+		r.ChecksumValidated = false
+
+		// Raw endpoints see the header of the last fragment, fixed up
+		// to describe the reassembled packet.
+		h = append(header.IPv4(nil), h[:hlen]...)
+		h.SetTotalLength(uint16(hlen + vv.Size()))
+		h.SetFlagsFragmentOffset(0, 0)
+		h.SetChecksum(0)
+		h.SetChecksum(^h.CalculateChecksum())
 	}
 	p := h.TransportProtocol()
+	e.dispatcher.DeliverRawPacket(r, p, buffer.View(h[:hlen]), vv)
 	if p == header.ICMPv4ProtocolNumber {
 		e.handleICMP(r, vv)
 		return
@@ -151,14 +216,31 @@ func (e *endpoint) Close() {
 	close(e.echoRequests)
 }
 
-type protocol struct{}
+type protocol struct {
+	mu           sync.Mutex
+	maxFragments int
+
+	// ids is shared by all the endpoints of the protocol. It's created
+	// along with the first one, from the random numbers of its stack.
+	ids *ids
+
+	// defaultTTL is the tcpip.DefaultTTLOption. It is accessed atomically.
+	defaultTTL uint32
+
+	// acceptSourceRoute is non-zero if tcpip.AcceptSourceRouteOption is
+	// enabled. It is accessed atomically.
+	acceptSourceRoute uint32
+
+	// addrs interns the addresses of received packets.
+	addrs stack.AddressInterner
+}
 
 // NewProtocol creates a new protocol ipv4 protocol descriptor. This is exported
 // only for tests that short-circuit the stack. Regular use of the protocol is
 // done via the stack, which gets a protocol descriptor from the init() function
 // below.
 func NewProtocol() stack.NetworkProtocol {
-	return &protocol{}
+	return &protocol{maxFragments: fragmentation.DefaultMaxFragments, defaultTTL: defaultTTL}
 }
 
 // Number returns the ipv4 protocol number.
@@ -172,24 +254,88 @@ func (p *protocol) MinimumPacketSize() int {
 }
 
 // ParseAddresses implements NetworkProtocol.ParseAddresses.
-func (*protocol) ParseAddresses(v buffer.View) (src, dst tcpip.Address) {
+func (p *protocol) ParseAddresses(v buffer.View) (src, dst tcpip.Address) {
 	h := header.IPv4(v)
-	return h.SourceAddress(), h.DestinationAddress()
+	return p.addrs.Address(h.SourceAddressSlice()), p.addrs.Address(h.DestinationAddressSlice())
 }
 
 // NewEndpoint creates a new ipv4 endpoint.
 func (p *protocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache stack.LinkAddressCache, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, *tcpip.Error) {
-	return newEndpoint(nicid, addr, dispatcher, linkEP), nil
+	// The stack passes itself as the link address cache, and is also the
+	// clock to time reassemblies with and the source of the random
+	// identifiers.
+	clock, ok := linkAddrCache.(tcpip.Clock)
+	if !ok {
+		clock = &tcpip.StdClock{}
+	}
+
+	p.mu.Lock()
+	maxFragments := p.maxFragments
+	if p.ids == nil {
+		var rng tcpip.Rand = &tcpip.CryptoRand{}
+		if s, ok := linkAddrCache.(interface{ Rand() tcpip.Rand }); ok {
+			rng = s.Rand()
+		}
+		p.ids = newIDs(rng)
+	}
+	ids := p.ids
+	p.mu.Unlock()
+
+	return newEndpoint(nicid, addr, dispatcher, linkEP, maxFragments, clock, ids, p), nil
 }
 
 // SetOption implements NetworkProtocol.SetOption.
 func (p *protocol) SetOption(option interface{}) *tcpip.Error {
-	return tcpip.ErrUnknownProtocolOption
+	switch v := option.(type) {
+	case MaxFragmentsOption:
+		if v < 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		p.mu.Lock()
+		p.maxFragments = int(v)
+		p.mu.Unlock()
+		return nil
+
+	case tcpip.DefaultTTLOption:
+		if v == 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		atomic.StoreUint32(&p.defaultTTL, uint32(v))
+		return nil
+
+	case tcpip.AcceptSourceRouteOption:
+		var b uint32
+		if v {
+			b = 1
+		}
+		atomic.StoreUint32(&p.acceptSourceRoute, b)
+		return nil
+
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
 }
 
 // Option implements NetworkProtocol.Option.
 func (p *protocol) Option(option interface{}) *tcpip.Error {
-	return tcpip.ErrUnknownProtocolOption
+	switch v := option.(type) {
+	case *MaxFragmentsOption:
+		p.mu.Lock()
+		*v = MaxFragmentsOption(p.maxFragments)
+		p.mu.Unlock()
+		return nil
+
+	case *tcpip.DefaultTTLOption:
+		*v = tcpip.DefaultTTLOption(atomic.LoadUint32(&p.defaultTTL))
+		return nil
+
+	case *tcpip.AcceptSourceRouteOption:
+		*v = atomic.LoadUint32(&p.acceptSourceRoute) != 0
+		return nil
+
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
 }
 
 // calculateMTU calculates the network-layer payload MTU based on the link-layer
@@ -201,33 +347,42 @@ func calculateMTU(mtu uint32) uint32 {
 	return mtu - header.IPv4MinimumSize
 }
 
+// ids holds the buckets of identifiers assigned to outgoing packets, which
+// routes are hashed into.
+type ids struct {
+	buckets []uint32
+	hashIV  uint32
+}
+
+// newIDs creates the identifier buckets, randomly initializing them and the
+// hash initial value with rng.
+func newIDs(rng tcpip.Rand) *ids {
+	i := &ids{buckets: make([]uint32, buckets)}
+	for b := range i.buckets {
+		i.buckets[b] = rng.Uint32()
+	}
+	i.hashIV = rng.Uint32()
+	return i
+}
+
+// next returns the next identifier of the bucket the given route hashes into.
+func (i *ids) next(r *stack.Route, protocol tcpip.TransportProtocolNumber) uint32 {
+	return atomic.AddUint32(&i.buckets[i.hashRoute(r, protocol)%buckets], 1)
+}
+
 // hashRoute calculates a hash value for the given route. It uses the source &
 // destination address, the transport protocol number, and a random initial
 // value (generated once on initialization) to generate the hash.
-func hashRoute(r *stack.Route, protocol tcpip.TransportProtocolNumber) uint32 {
+func (i *ids) hashRoute(r *stack.Route, protocol tcpip.TransportProtocolNumber) uint32 {
 	t := r.LocalAddress
 	a := uint32(t[0]) | uint32(t[1])<<8 | uint32(t[2])<<16 | uint32(t[3])<<24
 	t = r.RemoteAddress
 	b := uint32(t[0]) | uint32(t[1])<<8 | uint32(t[2])<<16 | uint32(t[3])<<24
-	return hash.Hash3Words(a, b, uint32(protocol), hashIV)
+	return hash.Hash3Words(a, b, uint32(protocol), i.hashIV)
 }
 
-var (
-	ids    []uint32
-	hashIV uint32
-)
-
 func init() {
-	ids = make([]uint32, buckets)
-
-	// Randomly initialize hashIV and the ids.
-	r := hash.RandN32(1 + buckets)
-	for i := range ids {
-		ids[i] = r[i]
-	}
-	hashIV = r[buckets]
-
 	stack.RegisterNetworkProtocolFactory(ProtocolName, func() stack.NetworkProtocol {
-		return &protocol{}
+		return &protocol{maxFragments: fragmentation.DefaultMaxFragments, defaultTTL: defaultTTL}
 	})
 }
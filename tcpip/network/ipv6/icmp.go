@@ -7,6 +7,7 @@ package ipv6
 import (
 	"encoding/binary"
 
+	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/stack"
@@ -48,10 +49,10 @@ func (e *endpoint) handleControl(typ stack.ControlType, extra uint32, vv *buffer
 	}
 
 	// Deliver the control packet to the transport endpoint.
-	e.dispatcher.DeliverTransportControlPacket(e.id.LocalAddress, h.DestinationAddress(), ProtocolNumber, p, typ, extra, vv)
+	e.dispatcher.DeliverTransportControlPacket(h.SourceAddress(), h.DestinationAddress(), ProtocolNumber, p, typ, extra, vv)
 }
 
-func (e *endpoint) handleICMP(r *stack.Route, vv *buffer.VectorisedView) {
+func (e *endpoint) handleICMP(r *stack.Route, netHeader header.IPv6, vv *buffer.VectorisedView) {
 	v := vv.First()
 	if len(v) < header.ICMPv6MinimumSize {
 		return
@@ -67,14 +68,83 @@ func (e *endpoint) handleICMP(r *stack.Route, vv *buffer.VectorisedView) {
 		mtu := binary.BigEndian.Uint32(v[header.ICMPv6MinimumSize:])
 		e.handleControl(stack.ControlPacketTooBig, calculateMTU(mtu), vv)
 
+	case header.ICMPv6EchoRequest:
+		if len(v) < header.ICMPv6EchoMinimumSize {
+			return
+		}
+		r.Stats().ICMP.EchoRequestsReceived.Increment()
+		vv.TrimFront(header.ICMPv6EchoMinimumSize)
+		sendEchoReply(r, h[:header.ICMPv6EchoMinimumSize], vv.ToView())
+
+	case header.ICMPv6EchoReply:
+		if len(v) < header.ICMPv6EchoMinimumSize {
+			return
+		}
+		r.Stats().ICMP.EchoRepliesReceived.Increment()
+		e.dispatcher.DeliverTransportPacket(r, header.ICMPv6ProtocolNumber, vv)
+
 	case header.ICMPv6DstUnreachable:
 		if len(v) < header.ICMPv6DstUnreachableMinimumSize {
 			return
 		}
+		r.Stats().ICMP.DstUnreachableReceived.Increment()
 		vv.TrimFront(header.ICMPv6DstUnreachableMinimumSize)
 		switch h.Code() {
+		case header.ICMPv6NoRoute, header.ICMPv6AddressUnreachable:
+			e.handleControl(stack.ControlHostUnreachable, 0, vv)
 		case header.ICMPv6PortUnreachable:
 			e.handleControl(stack.ControlPortUnreachable, 0, vv)
 		}
+
+	case header.ICMPv6RouterAdvert:
+		if len(v) < header.ICMPv6RouterAdvertMinimumSize {
+			return
+		}
+		e.handleRouterAdvert(r, netHeader.HopLimit(), header.ICMPv6(vv.ToView()))
+	}
+}
+
+// handleRouterAdvert autoconfigures addresses from the prefixes advertised by
+// the router advertisement msg, if the NIC does address autoconfiguration.
+func (e *endpoint) handleRouterAdvert(r *stack.Route, hopLimit uint8, msg header.ICMPv6) {
+	a, ok := e.dispatcher.(stack.AddressAutoconfigurator)
+	if !ok {
+		return
+	}
+
+	// Advertisements must come from a router on the link, and not have
+	// been forwarded, as per RFC 4861 section 6.1.2.
+	if hopLimit != 255 || msg.Code() != 0 || !header.IsV6LinkLocalAddress(r.RemoteAddress) {
+		return
+	}
+	if !r.ChecksumValidated && header.ICMPv6Checksum(msg, r.RemoteAddress, r.LocalAddress, nil) != 0 {
+		return
+	}
+
+	pis, ok := header.NDPRouterAdvert(msg.Payload()).Options().PrefixInformation()
+	if !ok {
+		return
+	}
+	for _, pi := range pis {
+		if !pi.AutonomousAddressConfigurationFlag() {
+			continue
+		}
+		if sn, ok := pi.Subnet(); ok {
+			a.AutoconfigurePrefix(ProtocolNumber, sn, pi.ValidLifetime(), pi.PreferredLifetime())
+		}
 	}
 }
+
+// sendEchoReply replies to the echo request whose header is req, and whose
+// data is data, through the route it was received on.
+func sendEchoReply(r *stack.Route, req header.ICMPv6, data buffer.View) *tcpip.Error {
+	hdr := buffer.NewPrependable(header.ICMPv6EchoMinimumSize + int(r.MaxHeaderLength()))
+
+	icmpv6 := header.ICMPv6(hdr.Prepend(header.ICMPv6EchoMinimumSize))
+	copy(icmpv6, req)
+	icmpv6.SetType(header.ICMPv6EchoReply)
+	icmpv6.SetChecksum(0)
+	icmpv6.SetChecksum(header.ICMPv6Checksum(icmpv6, r.LocalAddress, r.RemoteAddress, data))
+
+	return r.WritePacket(nil, &hdr, data, header.ICMPv6ProtocolNumber)
+}
@@ -0,0 +1,245 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipv6_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/testutil"
+)
+
+const (
+	linkAddr = tcpip.LinkAddress("\x02\x00\x5e\x00\x53\x01")
+
+	routerAddr = tcpip.Address("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	prefix     = tcpip.Address("\x20\x01\x0d\xb8\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	remoteAddr = tcpip.Address("\x20\x01\x0d\xb8\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+
+	// stableAddr is the address formed from prefix and linkAddr.
+	stableAddr = tcpip.Address("\x20\x01\x0d\xb8\x00\x01\x00\x00\x00\x00\x5e\xff\xfe\x00\x53\x01")
+)
+
+// routerAdvert returns a router advertisement of prefix/64 with the given
+// lifetimes, sent by routerAddr to all the nodes.
+func routerAdvert(validLifetime, preferredLifetime time.Duration) buffer.View {
+	const icmpSize = header.ICMPv6RouterAdvertMinimumSize + header.NDPPrefixInformationSize
+	v := buffer.NewView(header.IPv6MinimumSize + icmpSize)
+	header.IPv6(v).Encode(&header.IPv6Fields{
+		PayloadLength: icmpSize,
+		NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+		HopLimit:      255,
+		SrcAddr:       routerAddr,
+		DstAddr:       header.IPv6AllNodesMulticastAddress,
+	})
+
+	icmp := header.ICMPv6(v[header.IPv6MinimumSize:])
+	icmp.SetType(header.ICMPv6RouterAdvert)
+	header.NDPPrefixInformation(icmp[header.ICMPv6RouterAdvertMinimumSize:]).Encode(&header.NDPPrefixInformationFields{
+		PrefixLength:      64,
+		OnLink:            true,
+		Autonomous:        true,
+		ValidLifetime:     validLifetime,
+		PreferredLifetime: preferredLifetime,
+		Prefix:            prefix,
+	})
+	icmp.SetChecksum(header.ICMPv6Checksum(icmp, routerAddr, header.IPv6AllNodesMulticastAddress, nil))
+	return v
+}
+
+func TestSLAACTempAddresses(t *testing.T) {
+	clock := testutil.NewManualClock()
+	s := stack.New(clock, []string{ipv6.ProtocolName}, nil)
+	id, linkEP := channel.New(10, 1280, linkAddr)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: tcpip.Address(make([]byte, header.IPv6AddressSize)),
+		Mask:        tcpip.Address(make([]byte, header.IPv6AddressSize)),
+		NIC:         1,
+	}})
+
+	config := stack.DefaultSLAACConfig
+	config.TempAddresses = true
+	config.TempValidLifetime = 3 * time.Hour
+	config.TempPreferredLifetime = time.Hour
+	config.MaxDesyncFactor = 0
+	if err := s.SetSLAAC(1, &config); err != nil {
+		t.Fatalf("SetSLAAC failed: %v", err)
+	}
+
+	// addresses returns the addresses of the NIC, and whether the stable
+	// address is one of them.
+	addresses := func() (map[tcpip.Address]bool, bool) {
+		addrs := make(map[tcpip.Address]bool)
+		for _, a := range s.NICInfo()[1].ProtocolAddresses {
+			addrs[a.Address] = true
+		}
+		return addrs, addrs[stableAddr]
+	}
+	// newTempAddress returns the only address of the NIC that isn't in
+	// known.
+	newTempAddress := func(known map[tcpip.Address]bool) tcpip.Address {
+		t.Helper()
+		addrs, ok := addresses()
+		if !ok {
+			t.Fatalf("stable address %s missing", stableAddr)
+		}
+		var added []tcpip.Address
+		for a := range addrs {
+			if !known[a] && a != stableAddr {
+				added = append(added, a)
+			}
+		}
+		if len(added) != 1 {
+			t.Fatalf("got new addresses %v, want a single one", added)
+		}
+		a := added[0]
+		if a[:8] != prefix[:8] || a[8]&0x02 != 0 {
+			t.Fatalf("got temporary address %s, want one in %s/64 with the universal bit cleared", a, prefix)
+		}
+		return a
+	}
+	checkSource := func(want tcpip.Address) {
+		t.Helper()
+		r, err := s.FindRoute(1, "", remoteAddr, ipv6.ProtocolNumber)
+		if err != nil {
+			t.Fatalf("FindRoute failed: %v", err)
+		}
+		defer r.Release()
+		if r.LocalAddress != want {
+			t.Fatalf("got source address %s, want %s", r.LocalAddress, want)
+		}
+	}
+
+	v := routerAdvert(24*time.Hour, 12*time.Hour)
+	vv := v.ToVectorisedView([1]buffer.View{})
+	linkEP.Inject(ipv6.ProtocolNumber, &vv)
+
+	// A temporary address is generated along the stable one, and preferred.
+	known := map[tcpip.Address]bool{}
+	temp1 := newTempAddress(known)
+	known[temp1] = true
+	checkSource(temp1)
+
+	// It's regenerated RegenAdvance before it's deprecated, and its
+	// replacement is preferred.
+	clock.Advance(time.Hour - config.RegenAdvance - time.Second)
+	if addrs, _ := addresses(); len(addrs) != 2 {
+		t.Fatalf("got addresses %v before regeneration, want 2", addrs)
+	}
+	clock.Advance(time.Second)
+	temp2 := newTempAddress(known)
+	known[temp2] = true
+	checkSource(temp2)
+
+	// It's regenerated again an hour later, and the first one is removed
+	// at the end of its valid lifetime.
+	clock.Advance(time.Hour)
+	temp3 := newTempAddress(known)
+	known[temp3] = true
+	checkSource(temp3)
+
+	clock.Advance(3*time.Hour - 2*time.Hour + config.RegenAdvance - time.Second)
+	if addrs, _ := addresses(); !addrs[temp1] {
+		t.Fatalf("temporary address %s removed before the end of its valid lifetime", temp1)
+	}
+	clock.Advance(time.Second)
+	addrs, _ := addresses()
+	if addrs[temp1] {
+		t.Fatalf("temporary address %s not removed at the end of its valid lifetime", temp1)
+	}
+	var temp4 tcpip.Address
+	for a := range addrs {
+		if !known[a] && a != stableAddr {
+			temp4 = a
+		}
+	}
+	if temp4 == "" || len(addrs) != 4 {
+		t.Fatalf("got addresses %v, want the stable one and 3 temporary ones", addrs)
+	}
+	checkSource(temp4)
+
+	// The other temporary addresses are deprecated, so that the stable one
+	// is used without temp4.
+	if err := s.RemoveAddress(1, temp4); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+	checkSource(stableAddr)
+
+	// Disabling autoconfiguration removes the addresses.
+	if err := s.SetSLAAC(1, nil); err != nil {
+		t.Fatalf("SetSLAAC failed: %v", err)
+	}
+	if addrs, _ := addresses(); len(addrs) != 0 {
+		t.Fatalf("got addresses %v after disabling SLAAC, want none", addrs)
+	}
+	if n := clock.PendingTimers(); n != 0 {
+		t.Fatalf("got %d pending timers after disabling SLAAC, want none", n)
+	}
+}
+
+func TestSLAACLinkAddressChange(t *testing.T) {
+	const (
+		newLinkAddr = tcpip.LinkAddress("\x02\x00\x5e\x00\x53\x02")
+
+		// newStableAddr is the address formed from prefix and
+		// newLinkAddr.
+		newStableAddr = tcpip.Address("\x20\x01\x0d\xb8\x00\x01\x00\x00\x00\x00\x5e\xff\xfe\x00\x53\x02")
+	)
+
+	clock := testutil.NewManualClock()
+	s := stack.New(clock, []string{ipv6.ProtocolName}, nil)
+	id, linkEP := channel.New(10, 1280, linkAddr)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	config := stack.DefaultSLAACConfig
+	if err := s.SetSLAAC(1, &config); err != nil {
+		t.Fatalf("SetSLAAC failed: %v", err)
+	}
+
+	addresses := func() []tcpip.Address {
+		var addrs []tcpip.Address
+		for _, a := range s.NICInfo()[1].ProtocolAddresses {
+			addrs = append(addrs, a.Address)
+		}
+		return addrs
+	}
+
+	v := routerAdvert(24*time.Hour, 12*time.Hour)
+	vv := v.ToVectorisedView([1]buffer.View{})
+	linkEP.Inject(ipv6.ProtocolNumber, &vv)
+	if got := addresses(); len(got) != 1 || got[0] != stableAddr {
+		t.Fatalf("got addresses %v, want [%s]", got, stableAddr)
+	}
+
+	// The address formed from the previous link address is replaced, and
+	// keeps its lifetime.
+	if err := s.SetLinkAddress(1, newLinkAddr); err != nil {
+		t.Fatalf("SetLinkAddress failed: %v", err)
+	}
+	if got := addresses(); len(got) != 1 || got[0] != newStableAddr {
+		t.Fatalf("got addresses %v after SetLinkAddress, want [%s]", got, newStableAddr)
+	}
+	clock.Advance(24*time.Hour - time.Second)
+	if got := addresses(); len(got) != 1 {
+		t.Fatalf("got addresses %v before the end of the valid lifetime, want [%s]", got, newStableAddr)
+	}
+	clock.Advance(time.Second)
+	if got := addresses(); len(got) != 0 {
+		t.Fatalf("got addresses %v at the end of the valid lifetime, want none", got)
+	}
+	if n := clock.PendingTimers(); n != 0 {
+		t.Fatalf("got %d pending timers, want none", n)
+	}
+}
@@ -11,9 +11,13 @@
 package ipv6
 
 import (
+	"encoding/binary"
+	"sync/atomic"
+
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/network/hash"
 	"github.com/google/netstack/tcpip/stack"
 )
 
@@ -27,8 +31,16 @@ const (
 	// maxTotalSize is maximum size that can be encoded in the 16-bit
 	// PayloadLength field of the ipv6 header.
 	maxPayloadSize = 0xffff
+
+	// defaultHopLimit is the initial tcpip.DefaultTTLOption.
+	defaultHopLimit = 65
 )
 
+// AutoFlowLabelOption is used by SetOption and Option to configure whether
+// packets sent without an explicit flow label get one computed from their flow.
+// It is enabled by default; when disabled, such packets carry a zero label.
+type AutoFlowLabelOption bool
+
 type address [header.IPv6AddressSize]byte
 
 type endpoint struct {
@@ -37,10 +49,11 @@ type endpoint struct {
 	address    address
 	linkEP     stack.LinkEndpoint
 	dispatcher stack.TransportDispatcher
+	protocol   *protocol
 }
 
-func newEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) *endpoint {
-	e := &endpoint{nicid: nicid, linkEP: linkEP, dispatcher: dispatcher}
+func newEndpoint(nicid tcpip.NICID, addr tcpip.Address, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint, p *protocol) *endpoint {
+	e := &endpoint{nicid: nicid, linkEP: linkEP, dispatcher: dispatcher, protocol: p}
 	copy(e.address[:], addr)
 	e.id = stack.NetworkEndpointID{tcpip.Address(e.address[:])}
 	return e
@@ -74,21 +87,57 @@ func (e *endpoint) MaxHeaderLength() uint16 {
 }
 
 // WritePacket writes a packet to the given destination address and protocol.
-func (e *endpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error {
+func (e *endpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error {
+	if csum != nil {
+		if e.linkEP.Capabilities()&stack.CapabilityTXChecksumOffload == 0 {
+			// The link can't complete the transport checksum, so
+			// do it in software.
+			csum.Complete(hdr.UsedBytes(), payload)
+			csum = nil
+		} else {
+			csum.TransportOffset = header.IPv6MinimumSize
+		}
+	}
+
 	length := uint16(hdr.UsedLength())
 	if payload != nil {
 		length += uint16(len(payload))
 	}
+	flowLabel := r.FlowLabel
+	if flowLabel == 0 && atomic.LoadUint32(&e.protocol.autoFlowLabel) != 0 {
+		flowLabel = e.flowLabel(r, hdr.UsedBytes(), protocol)
+	}
+	hopLimit := r.TTL
+	if hopLimit == 0 {
+		hopLimit = uint8(atomic.LoadUint32(&e.protocol.defaultHopLimit))
+	}
 	ip := header.IPv6(hdr.Prepend(header.IPv6MinimumSize))
 	ip.Encode(&header.IPv6Fields{
 		PayloadLength: length,
+		TrafficClass:  r.TOS,
+		FlowLabel:     flowLabel,
 		NextHeader:    uint8(protocol),
-		HopLimit:      65,
+		HopLimit:      hopLimit,
 		SrcAddr:       tcpip.Address(e.address[:]),
 		DstAddr:       r.RemoteAddress,
 	})
 
-	return e.linkEP.WritePacket(r, hdr, payload, ProtocolNumber)
+	return e.linkEP.WritePacket(r, csum, hdr, payload, ProtocolNumber)
+}
+
+// flowLabel computes the flow label of a packet with the given transport
+// header, from the addresses, protocol and, for TCP and UDP, ports of its flow.
+// All packets of a connection thus carry the same label.
+func (e *endpoint) flowLabel(r *stack.Route, transportHeader []byte, protocol tcpip.TransportProtocolNumber) uint32 {
+	var ports uint32
+	switch protocol {
+	case header.TCPProtocolNumber, header.UDPProtocolNumber:
+		// Both headers start with the source and destination ports.
+		if len(transportHeader) >= 4 {
+			ports = binary.BigEndian.Uint32(transportHeader)
+		}
+	}
+	return hash.IPv6FlowLabel(tcpip.Address(e.address[:]), r.RemoteAddress, protocol, ports)
 }
 
 // HandlePacket is called by the link layer when new ipv6 packets arrive for
@@ -103,8 +152,26 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
 	vv.CapLength(int(h.PayloadLength()))
 
 	p := h.TransportProtocol()
+	if p == header.IPv6RoutingHeader {
+		// Packets that still have nodes to visit aren't forwarded, and
+		// type 0 routing headers are only accepted when enabled, per
+		// RFC 5095. Otherwise the header is skipped, as required at the
+		// final destination.
+		rh := header.IPv6Routing(vv.First())
+		if !rh.IsValid() {
+			r.Stats().MalformedRcvdPackets.Increment()
+			return
+		}
+		if rh.SegmentsLeft() != 0 || (rh.RoutingType() == header.IPv6RoutingType0 && atomic.LoadUint32(&e.protocol.acceptSourceRoute) == 0) {
+			r.Stats().IP.SourceRoutedPacketsDropped.Increment()
+			return
+		}
+		vv.TrimFront(rh.Length())
+		p = tcpip.TransportProtocolNumber(rh.NextHeader())
+	}
+	e.dispatcher.DeliverRawPacket(r, p, buffer.View(h[:header.IPv6MinimumSize]), vv)
 	if p == header.ICMPv6ProtocolNumber {
-		e.handleICMP(r, vv)
+		e.handleICMP(r, h, vv)
 		return
 	}
 
@@ -114,14 +181,29 @@ func (e *endpoint) HandlePacket(r *stack.Route, vv *buffer.VectorisedView) {
 // Close cleans up resources associated with the endpoint.
 func (*endpoint) Close() {}
 
-type protocol struct{}
+type protocol struct {
+	// autoFlowLabel is non-zero if AutoFlowLabelOption is enabled. It is
+	// accessed atomically.
+	autoFlowLabel uint32
+
+	// defaultHopLimit is the tcpip.DefaultTTLOption. It is accessed
+	// atomically.
+	defaultHopLimit uint32
+
+	// acceptSourceRoute is non-zero if tcpip.AcceptSourceRouteOption is
+	// enabled. It is accessed atomically.
+	acceptSourceRoute uint32
+
+	// addrs interns the addresses of received packets.
+	addrs stack.AddressInterner
+}
 
 // NewProtocol creates a new protocol ipv6 protocol descriptor. This is exported
 // only for tests that short-circuit the stack. Regular use of the protocol is
 // done via the stack, which gets a protocol descriptor from the init() function
 // below.
 func NewProtocol() stack.NetworkProtocol {
-	return &protocol{}
+	return &protocol{autoFlowLabel: 1, defaultHopLimit: defaultHopLimit}
 }
 
 // Number returns the ipv6 protocol number.
@@ -135,24 +217,65 @@ func (p *protocol) MinimumPacketSize() int {
 }
 
 // ParseAddresses implements NetworkProtocol.ParseAddresses.
-func (*protocol) ParseAddresses(v buffer.View) (src, dst tcpip.Address) {
+func (p *protocol) ParseAddresses(v buffer.View) (src, dst tcpip.Address) {
 	h := header.IPv6(v)
-	return h.SourceAddress(), h.DestinationAddress()
+	return p.addrs.Address(h.SourceAddressSlice()), p.addrs.Address(h.DestinationAddressSlice())
 }
 
 // NewEndpoint creates a new ipv6 endpoint.
 func (p *protocol) NewEndpoint(nicid tcpip.NICID, addr tcpip.Address, linkAddrCache stack.LinkAddressCache, dispatcher stack.TransportDispatcher, linkEP stack.LinkEndpoint) (stack.NetworkEndpoint, *tcpip.Error) {
-	return newEndpoint(nicid, addr, dispatcher, linkEP), nil
+	return newEndpoint(nicid, addr, dispatcher, linkEP, p), nil
 }
 
 // SetOption implements NetworkProtocol.SetOption.
 func (p *protocol) SetOption(option interface{}) *tcpip.Error {
-	return tcpip.ErrUnknownProtocolOption
+	switch v := option.(type) {
+	case AutoFlowLabelOption:
+		var b uint32
+		if v {
+			b = 1
+		}
+		atomic.StoreUint32(&p.autoFlowLabel, b)
+		return nil
+
+	case tcpip.DefaultTTLOption:
+		if v == 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		atomic.StoreUint32(&p.defaultHopLimit, uint32(v))
+		return nil
+
+	case tcpip.AcceptSourceRouteOption:
+		var b uint32
+		if v {
+			b = 1
+		}
+		atomic.StoreUint32(&p.acceptSourceRoute, b)
+		return nil
+
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
 }
 
 // Option implements NetworkProtocol.Option.
 func (p *protocol) Option(option interface{}) *tcpip.Error {
-	return tcpip.ErrUnknownProtocolOption
+	switch v := option.(type) {
+	case *AutoFlowLabelOption:
+		*v = atomic.LoadUint32(&p.autoFlowLabel) != 0
+		return nil
+
+	case *tcpip.DefaultTTLOption:
+		*v = tcpip.DefaultTTLOption(atomic.LoadUint32(&p.defaultHopLimit))
+		return nil
+
+	case *tcpip.AcceptSourceRouteOption:
+		*v = atomic.LoadUint32(&p.acceptSourceRoute) != 0
+		return nil
+
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
 }
 
 // calculateMTU calculates the network-layer payload MTU based on the link-layer
@@ -167,6 +290,6 @@ func calculateMTU(mtu uint32) uint32 {
 
 func init() {
 	stack.RegisterNetworkProtocolFactory(ProtocolName, func() stack.NetworkProtocol {
-		return &protocol{}
+		return &protocol{autoFlowLabel: 1, defaultHopLimit: defaultHopLimit}
 	})
 }
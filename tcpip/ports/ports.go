@@ -7,16 +7,18 @@ package ports
 
 import (
 	"math"
-	"math/rand"
 	"sync"
 
 	"github.com/google/netstack/tcpip"
 )
 
 const (
-	// firstEphemeral is the first ephemeral port.
+	// firstEphemeral is the first ephemeral port by default.
 	firstEphemeral uint16 = 16000
 
+	// lastEphemeral is the last ephemeral port by default.
+	lastEphemeral uint16 = math.MaxUint16
+
 	anyIPAddress = tcpip.Address("")
 )
 
@@ -30,44 +32,175 @@ type portDescriptor struct {
 type PortManager struct {
 	mu             sync.RWMutex
 	allocatedPorts map[portDescriptor]bindAddresses
+
+	// rangeMu protects the ephemeral port range, [first, last]. It is
+	// separate from mu because PickEphemeralPort is called both with and
+	// without mu held.
+	rangeMu sync.RWMutex
+	first   uint16
+	last    uint16
+
+	// rand picks the port PickEphemeralPort starts from.
+	rand tcpip.Rand
 }
 
-// bindAddresses is a set of IP addresses.
-type bindAddresses map[tcpip.Address]struct{}
+// Flags are the options of a port reservation that determine whether it may
+// share its port with other reservations whose addresses and NICs overlap with
+// its own.
+type Flags struct {
+	// ReuseAddr, as set by SO_REUSEADDR, lets the reservation share its
+	// port with reservations that all have ReuseAddr.
+	ReuseAddr bool
 
-// isAvailable checks whether an IP address is available to bind to.
-func (b bindAddresses) isAvailable(addr tcpip.Address) bool {
-	if addr == anyIPAddress {
-		return len(b) == 0
-	}
+	// ReusePort, as set by SO_REUSEPORT, lets the reservation share its
+	// port with reservations that all have ReusePort.
+	ReusePort bool
+}
 
-	// If all addresses for this portDescriptor are already bound, no
-	// address is available.
-	if _, ok := b[anyIPAddress]; ok {
+// Binding describes a reservation of a port, or a group of reservations of the
+// same port, address and NIC, in which case Flags are the flags they all have.
+type Binding struct {
+	// Addr is the bound address, the empty address standing for all
+	// addresses.
+	Addr tcpip.Address
+
+	// NIC is the NIC the port is bound on, the zero NICID standing for all
+	// NICs.
+	NIC tcpip.NICID
+
+	Flags Flags
+}
+
+// Conflicts returns whether bindings b and o of the same port can't coexist.
+// They can if their addresses differ and neither is the wildcard address, if
+// they are on different NICs, or if their flags agree on reusing the port:
+// both have ReuseAddr, or both have ReusePort.
+func (b Binding) Conflicts(o Binding) bool {
+	if b.Addr != anyIPAddress && o.Addr != anyIPAddress && b.Addr != o.Addr {
 		return false
 	}
-
-	if _, ok := b[addr]; ok {
+	if b.NIC != 0 && o.NIC != 0 && b.NIC != o.NIC {
 		return false
 	}
+	if b.Flags.ReuseAddr && o.Flags.ReuseAddr {
+		return false
+	}
+	return !b.Flags.ReusePort || !o.Flags.ReusePort
+}
+
+// FlagCounter counts the flags of a group of reservations of the same port,
+// address and NIC.
+type FlagCounter struct {
+	total     int
+	reuseAddr int
+	reusePort int
+}
+
+// Add adds a reservation with the given flags to the group.
+func (c *FlagCounter) Add(f Flags) {
+	c.total++
+	if f.ReuseAddr {
+		c.reuseAddr++
+	}
+	if f.ReusePort {
+		c.reusePort++
+	}
+}
+
+// Remove removes a reservation with the given flags from the group.
+func (c *FlagCounter) Remove(f Flags) {
+	c.total--
+	if f.ReuseAddr {
+		c.reuseAddr--
+	}
+	if f.ReusePort {
+		c.reusePort--
+	}
+}
+
+// Empty returns whether the group has no reservations left.
+func (c *FlagCounter) Empty() bool {
+	return c.total == 0
+}
+
+// Flags returns the flags all the reservations of the group have.
+func (c *FlagCounter) Flags() Flags {
+	return Flags{
+		ReuseAddr: c.reuseAddr == c.total,
+		ReusePort: c.reusePort == c.total,
+	}
+}
+
+// bindAddresses maps IP addresses to the NICs they are bound on.
+type bindAddresses map[tcpip.Address]bindNICs
+
+// bindNICs maps NICs, the zero NICID standing for all NICs, to the flags of the
+// reservations on them.
+type bindNICs map[tcpip.NICID]*FlagCounter
+
+// isAvailable checks whether an IP address is available to bind to on the
+// given NIC, with the given flags.
+func (b bindAddresses) isAvailable(addr tcpip.Address, flags Flags, nic tcpip.NICID) bool {
+	want := Binding{Addr: addr, NIC: nic, Flags: flags}
+	for a, nics := range b {
+		for n, c := range nics {
+			if want.Conflicts(Binding{Addr: a, NIC: n, Flags: c.Flags()}) {
+				return false
+			}
+		}
+	}
 	return true
 }
 
 // NewPortManager creates new PortManager.
 func NewPortManager() *PortManager {
-	return &PortManager{allocatedPorts: make(map[portDescriptor]bindAddresses)}
+	return NewPortManagerWithRand(&tcpip.CryptoRand{})
+}
+
+// NewPortManagerWithRand creates a new PortManager that draws the ephemeral
+// ports it picks from rng.
+func NewPortManagerWithRand(rng tcpip.Rand) *PortManager {
+	return &PortManager{
+		allocatedPorts: make(map[portDescriptor]bindAddresses),
+		first:          firstEphemeral,
+		last:           lastEphemeral,
+		rand:           rng,
+	}
+}
+
+// SetPortRange restricts the ephemeral ports to the inclusive range
+// [first, last]. Ports already reserved, ephemeral or not, are unaffected.
+func (s *PortManager) SetPortRange(first, last uint16) *tcpip.Error {
+	if first == 0 || first > last {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	s.rangeMu.Lock()
+	s.first = first
+	s.last = last
+	s.rangeMu.Unlock()
+	return nil
+}
+
+// PortRange returns the inclusive range of ephemeral ports.
+func (s *PortManager) PortRange() (first, last uint16) {
+	s.rangeMu.RLock()
+	defer s.rangeMu.RUnlock()
+	return s.first, s.last
 }
 
 // PickEphemeralPort randomly chooses a starting point and iterates over all
 // possible ephemeral ports, allowing the caller to decide whether a given port
 // is suitable for its needs, and stopping when a port is found or an error
-// occurs.
+// occurs. It returns ErrNoPortAvailable once all ports of the range have been
+// tried.
 func (s *PortManager) PickEphemeralPort(testPort func(p uint16) (bool, *tcpip.Error)) (port uint16, err *tcpip.Error) {
-	count := uint16(math.MaxUint16 - firstEphemeral + 1)
-	offset := uint16(rand.Int31n(int32(count)))
+	first, last := s.PortRange()
+	count := int32(last-first) + 1
+	offset := int32(s.rand.Uint32() % uint32(count))
 
-	for i := uint16(0); i < count; i++ {
-		port = firstEphemeral + (offset+i)%count
+	for i := int32(0); i < count; i++ {
+		port = first + uint16((offset+i)%count)
 		ok, err := testPort(port)
 		if err != nil {
 			return 0, err
@@ -81,41 +214,65 @@ func (s *PortManager) PickEphemeralPort(testPort func(p uint16) (bool, *tcpip.Er
 	return 0, tcpip.ErrNoPortAvailable
 }
 
+// IsPortAvailable returns whether the given port/IP combination could be
+// reserved on the given NIC with the given flags, for all network protocols.
+func (s *PortManager) IsPortAvailable(network []tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16, flags Flags, nic tcpip.NICID) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.isPortAvailableLocked(network, transport, addr, port, flags, nic)
+}
+
+func (s *PortManager) isPortAvailableLocked(network []tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16, flags Flags, nic tcpip.NICID) bool {
+	desc := portDescriptor{0, transport, port}
+	for _, n := range network {
+		desc.network = n
+		if addrs, ok := s.allocatedPorts[desc]; ok {
+			if !addrs.isAvailable(addr, flags, nic) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 // ReservePort marks a port/IP combination as reserved so that it cannot be
-// reserved by another endpoint. If port is zero, ReservePort will search for
-// an unreserved ephemeral port and reserve it, returning its value in the
-// "port" return value.
-func (s *PortManager) ReservePort(network []tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16) (reservedPort uint16, err *tcpip.Error) {
+// reserved by another endpoint, unless the flags of both reservations allow
+// them to share it (see Binding.Conflicts). If port is zero, ReservePort will
+// search for an unreserved ephemeral port and reserve it, returning its value
+// in the "port" return value.
+//
+// A non-zero nic restricts the reservation to that NIC, so that the same
+// port/IP combination can be reserved on other NICs.
+func (s *PortManager) ReservePort(network []tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16, flags Flags, nic tcpip.NICID) (reservedPort uint16, err *tcpip.Error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// If a port is specified, just try to reserve it for all network
 	// protocols.
 	if port != 0 {
-		if !s.reserveSpecificPort(network, transport, addr, port) {
+		if !s.reserveSpecificPort(network, transport, addr, port, flags, nic) {
 			return 0, tcpip.ErrPortInUse
 		}
 		return port, nil
 	}
 
-	// A port wasn't specified, so try to find one.
+	// A port wasn't specified, so try to find one. Ephemeral ports are
+	// never shared, whatever the flags.
 	return s.PickEphemeralPort(func(p uint16) (bool, *tcpip.Error) {
-		return s.reserveSpecificPort(network, transport, addr, p), nil
+		if !s.isPortAvailableLocked(network, transport, anyIPAddress, p, Flags{}, 0) {
+			return false, nil
+		}
+		return s.reserveSpecificPort(network, transport, addr, p, flags, nic), nil
 	})
 }
 
 // reserveSpecificPort tries to reserve the given port on all given protocols.
-func (s *PortManager) reserveSpecificPort(network []tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16) bool {
+func (s *PortManager) reserveSpecificPort(network []tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16, flags Flags, nic tcpip.NICID) bool {
 	// Check that the port is available on all network protocols.
-	desc := portDescriptor{0, transport, port}
-	for _, n := range network {
-		desc.network = n
-		if addrs, ok := s.allocatedPorts[desc]; ok {
-			if !addrs.isAvailable(addr) {
-				return false
-			}
-		}
+	if !s.isPortAvailableLocked(network, transport, addr, port, flags, nic) {
+		return false
 	}
+	desc := portDescriptor{0, transport, port}
 
 	// Reserve port on all network protocols.
 	for _, n := range network {
@@ -125,22 +282,43 @@ func (s *PortManager) reserveSpecificPort(network []tcpip.NetworkProtocolNumber,
 			m = make(bindAddresses)
 			s.allocatedPorts[desc] = m
 		}
-		m[addr] = struct{}{}
+		nics, ok := m[addr]
+		if !ok {
+			nics = make(bindNICs)
+			m[addr] = nics
+		}
+		c, ok := nics[nic]
+		if !ok {
+			c = &FlagCounter{}
+			nics[nic] = c
+		}
+		c.Add(flags)
 	}
 
 	return true
 }
 
-// ReleasePort releases the reservation on a port/IP combination so that it can
-// be reserved by other endpoints.
-func (s *PortManager) ReleasePort(network []tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16) {
+// ReleasePort releases a reservation on a port/IP combination so that it can
+// be reserved by other endpoints. The flags and nic must be the ones the port
+// was reserved with.
+func (s *PortManager) ReleasePort(network []tcpip.NetworkProtocolNumber, transport tcpip.TransportProtocolNumber, addr tcpip.Address, port uint16, flags Flags, nic tcpip.NICID) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for _, n := range network {
 		desc := portDescriptor{n, transport, port}
 		m := s.allocatedPorts[desc]
-		delete(m, addr)
+		if nics, ok := m[addr]; ok {
+			if c, ok := nics[nic]; ok {
+				c.Remove(flags)
+				if c.Empty() {
+					delete(nics, nic)
+				}
+			}
+			if len(nics) == 0 {
+				delete(m, addr)
+			}
+		}
 		if len(m) == 0 {
 			delete(s.allocatedPorts, desc)
 		}
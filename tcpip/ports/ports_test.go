@@ -64,7 +64,7 @@ func TestPortReservation(t *testing.T) {
 			want: nil,
 		},
 	} {
-		gotPort, err := pm.ReservePort(net, fakeTransNumber, test.ip, test.port)
+		gotPort, err := pm.ReservePort(net, fakeTransNumber, test.ip, test.port, Flags{}, 0)
 		if err != test.want {
 			t.Fatalf("ReservePort(.., .., %s, %d) = %v, want %v", test.ip, test.port, err, test.want)
 		}
@@ -75,13 +75,88 @@ func TestPortReservation(t *testing.T) {
 
 	// Release port 22 from any IP address, then try to reserve fake IP
 	// address on 22.
-	pm.ReleasePort(net, fakeTransNumber, anyIPAddress, 22)
+	pm.ReleasePort(net, fakeTransNumber, anyIPAddress, 22, Flags{}, 0)
 
-	if port, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 22); port != 22 || err != nil {
+	if port, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 22, Flags{}, 0); port != 22 || err != nil {
 		t.Fatalf("ReservePort(.., .., .., %d) = (port %d, err %v), want (22, nil); failed to reserve port after it should have been released", 22, port, err)
 	}
 }
 
+func TestPortReservationOnNIC(t *testing.T) {
+	pm := NewPortManager()
+	net := []tcpip.NetworkProtocolNumber{fakeNetworkNumber}
+
+	for _, test := range []struct {
+		port uint16
+		ip   tcpip.Address
+		nic  tcpip.NICID
+		want *tcpip.Error
+	}{
+		{
+			port: 80,
+			ip:   anyIPAddress,
+			nic:  1,
+			want: nil,
+		},
+		{
+			port: 80,
+			ip:   anyIPAddress,
+			nic:  2,
+			want: nil,
+		},
+		{
+			port: 80,
+			ip:   fakeIPAddress,
+			nic:  1,
+			want: tcpip.ErrPortInUse,
+		},
+		{
+			port: 80,
+			ip:   fakeIPAddress,
+			nic:  3,
+			want: nil,
+		},
+		{
+			/* N.B. Order of tests matters! */
+			port: 80,
+			ip:   anyIPAddress,
+			nic:  0,
+			want: tcpip.ErrPortInUse,
+		},
+		{
+			port: 22,
+			ip:   fakeIPAddress,
+			nic:  0,
+			want: nil,
+		},
+		{
+			port: 22,
+			ip:   fakeIPAddress,
+			nic:  1,
+			want: tcpip.ErrPortInUse,
+		},
+		{
+			port: 22,
+			ip:   fakeIPAddress1,
+			nic:  1,
+			want: nil,
+		},
+	} {
+		if _, err := pm.ReservePort(net, fakeTransNumber, test.ip, test.port, Flags{}, test.nic); err != test.want {
+			t.Fatalf("ReservePort(.., .., %s, %d, %d) = %v, want %v", test.ip, test.port, test.nic, err, test.want)
+		}
+	}
+
+	// Releasing the reservation on NIC 3 leaves the others in place.
+	pm.ReleasePort(net, fakeTransNumber, fakeIPAddress, 80, Flags{}, 3)
+	if _, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 80, Flags{}, 2); err != tcpip.ErrPortInUse {
+		t.Fatalf("ReservePort(.., .., %s, 80, 2) = %v, want %v", fakeIPAddress, err, tcpip.ErrPortInUse)
+	}
+	if _, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 80, Flags{}, 3); err != nil {
+		t.Fatalf("ReservePort(.., .., %s, 80, 3) = %v, want nil", fakeIPAddress, err)
+	}
+}
+
 func TestPickEphemeralPort(t *testing.T) {
 	pm := NewPortManager()
 	customErr := &tcpip.Error{}
@@ -133,3 +208,214 @@ func TestPickEphemeralPort(t *testing.T) {
 		})
 	}
 }
+
+func TestSetPortRange(t *testing.T) {
+	pm := NewPortManager()
+	net := []tcpip.NetworkProtocolNumber{fakeNetworkNumber}
+
+	for _, r := range [][2]uint16{{0, 10}, {20, 10}} {
+		if err := pm.SetPortRange(r[0], r[1]); err != tcpip.ErrInvalidOptionValue {
+			t.Errorf("SetPortRange(%d, %d) = %v, want %v", r[0], r[1], err, tcpip.ErrInvalidOptionValue)
+		}
+	}
+	if first, last := pm.PortRange(); first != firstEphemeral || last != lastEphemeral {
+		t.Fatalf("got PortRange() = %d, %d, want %d, %d", first, last, firstEphemeral, lastEphemeral)
+	}
+
+	// A port reserved before the range is changed stays reserved.
+	old, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 0, Flags{}, 0)
+	if err != nil {
+		t.Fatalf("ReservePort failed: %v", err)
+	}
+
+	const first, last = 60000, 60009
+	if err := pm.SetPortRange(first, last); err != nil {
+		t.Fatalf("SetPortRange(%d, %d) failed: %v", first, last, err)
+	}
+	if _, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, old, Flags{}, 0); err != tcpip.ErrPortInUse {
+		t.Fatalf("got ReservePort(.., %d, ..) = %v, want %v", old, err, tcpip.ErrPortInUse)
+	}
+
+	reserved := make(map[uint16]bool)
+	for i := 0; i < last-first+1; i++ {
+		port, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 0, Flags{}, 0)
+		if err != nil {
+			t.Fatalf("ReservePort failed: %v", err)
+		}
+		if port < first || port > last || reserved[port] {
+			t.Fatalf("got port %d, want an unreserved port in [%d, %d]", port, first, last)
+		}
+		reserved[port] = true
+	}
+	if port, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 0, Flags{}, 0); err != tcpip.ErrNoPortAvailable {
+		t.Fatalf("got ReservePort() = %d, %v, want %v", port, err, tcpip.ErrNoPortAvailable)
+	}
+
+	// A single-port range at the top of the port space works too.
+	if err := pm.SetPortRange(65535, 65535); err != nil {
+		t.Fatalf("SetPortRange(65535, 65535) failed: %v", err)
+	}
+	if port, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 0, Flags{}, 0); err != nil || port != 65535 {
+		t.Fatalf("got ReservePort() = %d, %v, want 65535, nil", port, err)
+	}
+}
+
+func TestBindingConflicts(t *testing.T) {
+	reuseAddr := Flags{ReuseAddr: true}
+	reusePort := Flags{ReusePort: true}
+	both := Flags{ReuseAddr: true, ReusePort: true}
+
+	for _, test := range []struct {
+		name string
+		a, b Binding
+		want bool
+	}{
+		{"same address", Binding{Addr: fakeIPAddress}, Binding{Addr: fakeIPAddress}, true},
+		{"different addresses", Binding{Addr: fakeIPAddress}, Binding{Addr: fakeIPAddress1}, false},
+		{"wildcard and specific address", Binding{Addr: anyIPAddress}, Binding{Addr: fakeIPAddress}, true},
+		{"wildcard addresses", Binding{Addr: anyIPAddress}, Binding{Addr: anyIPAddress}, true},
+		{"different NICs", Binding{Addr: fakeIPAddress, NIC: 1}, Binding{Addr: fakeIPAddress, NIC: 2}, false},
+		{"same NIC", Binding{Addr: fakeIPAddress, NIC: 1}, Binding{Addr: fakeIPAddress, NIC: 1}, true},
+		{"all NICs and a NIC", Binding{Addr: fakeIPAddress}, Binding{Addr: fakeIPAddress, NIC: 1}, true},
+		{"both reuse address", Binding{Addr: fakeIPAddress, Flags: reuseAddr}, Binding{Addr: fakeIPAddress, Flags: reuseAddr}, false},
+		{"one reuses address", Binding{Addr: fakeIPAddress, Flags: reuseAddr}, Binding{Addr: fakeIPAddress}, true},
+		{"both reuse port", Binding{Addr: fakeIPAddress, Flags: reusePort}, Binding{Addr: fakeIPAddress, Flags: reusePort}, false},
+		{"one reuses port", Binding{Addr: fakeIPAddress}, Binding{Addr: fakeIPAddress, Flags: reusePort}, true},
+		{"reuse address and reuse port", Binding{Addr: fakeIPAddress, Flags: reuseAddr}, Binding{Addr: fakeIPAddress, Flags: reusePort}, true},
+		{"both flags and reuse port", Binding{Addr: fakeIPAddress, Flags: both}, Binding{Addr: fakeIPAddress, Flags: reusePort}, false},
+		{"both flags and reuse address", Binding{Addr: fakeIPAddress, Flags: both}, Binding{Addr: fakeIPAddress, Flags: reuseAddr}, false},
+		{"wildcard and specific address reusing address", Binding{Addr: anyIPAddress, Flags: reuseAddr}, Binding{Addr: fakeIPAddress, Flags: reuseAddr}, false},
+		{"wildcard and specific address reusing port", Binding{Addr: anyIPAddress, Flags: reusePort}, Binding{Addr: fakeIPAddress, Flags: reusePort}, false},
+	} {
+		if got := test.a.Conflicts(test.b); got != test.want {
+			t.Errorf("%s: %+v.Conflicts(%+v) = %t, want %t", test.name, test.a, test.b, got, test.want)
+		}
+		if got := test.b.Conflicts(test.a); got != test.want {
+			t.Errorf("%s: %+v.Conflicts(%+v) = %t, want %t", test.name, test.b, test.a, got, test.want)
+		}
+	}
+}
+
+func TestReservationFlags(t *testing.T) {
+	net := []tcpip.NetworkProtocolNumber{fakeNetworkNumber}
+	reuseAddr := Flags{ReuseAddr: true}
+	reusePort := Flags{ReusePort: true}
+	both := Flags{ReuseAddr: true, ReusePort: true}
+
+	type reservation struct {
+		addr  tcpip.Address
+		flags Flags
+		nic   tcpip.NICID
+		want  *tcpip.Error
+	}
+
+	for _, test := range []struct {
+		name         string
+		reservations []reservation
+	}{
+		{
+			name: "reuse address on the same address",
+			reservations: []reservation{
+				{addr: fakeIPAddress, flags: reuseAddr},
+				{addr: fakeIPAddress, flags: reuseAddr},
+				{addr: fakeIPAddress, want: tcpip.ErrPortInUse},
+				{addr: fakeIPAddress, flags: reusePort, want: tcpip.ErrPortInUse},
+			},
+		},
+		{
+			name: "reuse port on the same address",
+			reservations: []reservation{
+				{addr: fakeIPAddress, flags: reusePort},
+				{addr: fakeIPAddress, flags: both},
+				{addr: fakeIPAddress, flags: reusePort},
+				{addr: fakeIPAddress, flags: reuseAddr, want: tcpip.ErrPortInUse},
+				{addr: fakeIPAddress, want: tcpip.ErrPortInUse},
+			},
+		},
+		{
+			name: "a member without reuse port closes the group",
+			reservations: []reservation{
+				{addr: fakeIPAddress, flags: both},
+				{addr: fakeIPAddress, flags: reuseAddr},
+				{addr: fakeIPAddress, flags: reusePort, want: tcpip.ErrPortInUse},
+				{addr: fakeIPAddress, flags: both},
+			},
+		},
+		{
+			name: "wildcard and specific addresses",
+			reservations: []reservation{
+				{addr: anyIPAddress, flags: reuseAddr},
+				{addr: fakeIPAddress, want: tcpip.ErrPortInUse},
+				{addr: fakeIPAddress, flags: reuseAddr},
+				{addr: fakeIPAddress1, flags: reusePort, want: tcpip.ErrPortInUse},
+				{addr: anyIPAddress, flags: reuseAddr},
+			},
+		},
+		{
+			name: "specific addresses and wildcard",
+			reservations: []reservation{
+				{addr: fakeIPAddress, flags: reusePort},
+				{addr: fakeIPAddress1},
+				{addr: anyIPAddress, flags: reusePort, want: tcpip.ErrPortInUse},
+				{addr: fakeIPAddress, flags: reusePort},
+			},
+		},
+		{
+			name: "NICs",
+			reservations: []reservation{
+				{addr: fakeIPAddress, nic: 1},
+				{addr: fakeIPAddress, nic: 2},
+				{addr: fakeIPAddress, nic: 1, flags: both, want: tcpip.ErrPortInUse},
+				{addr: anyIPAddress, nic: 3, flags: reuseAddr},
+				{addr: fakeIPAddress, nic: 3, flags: reuseAddr},
+				{addr: fakeIPAddress, flags: reuseAddr, want: tcpip.ErrPortInUse},
+			},
+		},
+	} {
+		pm := NewPortManager()
+		for i, r := range test.reservations {
+			if _, err := pm.ReservePort(net, fakeTransNumber, r.addr, 80, r.flags, r.nic); err != r.want {
+				t.Fatalf("%s: reservation %d: ReservePort(.., .., %s, 80, %+v, %d) = %v, want %v", test.name, i, r.addr, r.flags, r.nic, err, r.want)
+			}
+		}
+
+		// Releasing all the successful reservations makes the port
+		// available again, whatever the flags.
+		for _, r := range test.reservations {
+			if r.want == nil {
+				pm.ReleasePort(net, fakeTransNumber, r.addr, 80, r.flags, r.nic)
+			}
+		}
+		if !pm.IsPortAvailable(net, fakeTransNumber, anyIPAddress, 80, Flags{}, 0) {
+			t.Errorf("%s: port 80 unavailable after releasing all the reservations", test.name)
+		}
+	}
+}
+
+func TestReleaseRestoresGroupFlags(t *testing.T) {
+	pm := NewPortManager()
+	net := []tcpip.NetworkProtocolNumber{fakeNetworkNumber}
+
+	if _, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 80, Flags{ReusePort: true}, 0); err != nil {
+		t.Fatalf("ReservePort failed: %v", err)
+	}
+	if _, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 80, Flags{ReuseAddr: true, ReusePort: true}, 0); err != nil {
+		t.Fatalf("ReservePort failed: %v", err)
+	}
+	if pm.IsPortAvailable(net, fakeTransNumber, fakeIPAddress, 80, Flags{ReuseAddr: true}, 0) {
+		t.Fatalf("port available with ReuseAddr while a member of the group doesn't reuse the address")
+	}
+
+	// Once the member without ReuseAddr is gone, the group reuses the
+	// address.
+	pm.ReleasePort(net, fakeTransNumber, fakeIPAddress, 80, Flags{ReusePort: true}, 0)
+	if !pm.IsPortAvailable(net, fakeTransNumber, fakeIPAddress, 80, Flags{ReuseAddr: true}, 0) {
+		t.Fatalf("port unavailable with ReuseAddr after releasing the member without it")
+	}
+
+	// Ephemeral ports are only picked among unreserved ones.
+	pm.SetPortRange(80, 81)
+	if port, err := pm.ReservePort(net, fakeTransNumber, fakeIPAddress, 0, Flags{ReuseAddr: true, ReusePort: true}, 0); err != nil || port != 81 {
+		t.Fatalf("ReservePort(.., .., %s, 0, ..) = %d, %v, want 81, nil", fakeIPAddress, port, err)
+	}
+}
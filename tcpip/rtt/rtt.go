@@ -0,0 +1,105 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package rtt provides an estimator of round-trip time and jitter for
+// applications that measure them themselves, for example request/response
+// protocols or RTP over UDP.
+//
+// The smoothed round-trip time and its variation are computed as TCP does
+// (RFC 6298), and the jitter as the interarrival jitter of RTP (RFC 3550
+// section 6.4.1), using the difference between consecutive samples.
+package rtt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// Estimator maintains exponentially weighted moving averages of round-trip
+// time samples. It is safe for concurrent use.
+type Estimator struct {
+	clock tcpip.Clock
+
+	mu      sync.Mutex
+	samples int
+	last    time.Duration
+	srtt    time.Duration
+	rttvar  time.Duration
+	jitter  time.Duration
+}
+
+// NewEstimator creates a new estimator that uses clock, usually the Stack, to
+// time responses passed to Observe.
+func NewEstimator(clock tcpip.Clock) *Estimator {
+	return &Estimator{clock: clock}
+}
+
+// Observe adds a sample for a response received now to a request sent at the
+// given time, in nanoseconds as returned by the estimator's clock.
+func (e *Estimator) Observe(sent int64) {
+	e.AddSample(sent, e.clock.NowNanoseconds())
+}
+
+// AddSample adds a sample for a request sent and a response received at the
+// given times, in nanoseconds. Samples where the response precedes the
+// request are ignored.
+func (e *Estimator) AddSample(sent, received int64) {
+	if received < sent {
+		return
+	}
+	rtt := time.Duration(received - sent)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.samples == 0 {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+	} else {
+		e.rttvar = (3*e.rttvar + abs(e.srtt-rtt)) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+		e.jitter += (abs(rtt-e.last) - e.jitter) / 16
+	}
+	e.last = rtt
+	e.samples++
+}
+
+// Samples returns the number of samples added so far.
+func (e *Estimator) Samples() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.samples
+}
+
+// SRTT returns the smoothed round-trip time, or zero if no samples were added.
+func (e *Estimator) SRTT() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt
+}
+
+// RTTVar returns the round-trip time variation, or zero if no samples were
+// added.
+func (e *Estimator) RTTVar() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.rttvar
+}
+
+// Jitter returns the smoothed difference between consecutive samples, which
+// is zero until at least two samples were added.
+func (e *Estimator) Jitter() time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.jitter
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,56 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rtt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip/testutil"
+)
+
+func TestEstimator(t *testing.T) {
+	clock := testutil.NewManualClock()
+	e := NewEstimator(clock)
+
+	if got := e.SRTT(); got != 0 {
+		t.Fatalf("got SRTT() = %v before any sample, want 0", got)
+	}
+
+	testCases := []struct {
+		sent, received time.Duration
+		srtt           time.Duration
+		rttvar         time.Duration
+		jitter         time.Duration
+	}{
+		// The first sample initializes the estimates.
+		{0, 100 * time.Millisecond, 100 * time.Millisecond, 50 * time.Millisecond, 0},
+		{1 * time.Second, 1120 * time.Millisecond, 102500 * time.Microsecond, 42500 * time.Microsecond, 1250 * time.Microsecond},
+		{2 * time.Second, 2080 * time.Millisecond, 99687500 * time.Nanosecond, 37500 * time.Microsecond, 3671875 * time.Nanosecond},
+	}
+	for i, tc := range testCases {
+		clock.Advance(tc.received - time.Duration(clock.NowNanoseconds()))
+		e.Observe(int64(tc.sent))
+
+		if got := e.Samples(); got != i+1 {
+			t.Fatalf("sample %d: got Samples() = %d, want %d", i, got, i+1)
+		}
+		if got := e.SRTT(); got != tc.srtt {
+			t.Errorf("sample %d: got SRTT() = %v, want %v", i, got, tc.srtt)
+		}
+		if got := e.RTTVar(); got != tc.rttvar {
+			t.Errorf("sample %d: got RTTVar() = %v, want %v", i, got, tc.rttvar)
+		}
+		if got := e.Jitter(); got != tc.jitter {
+			t.Errorf("sample %d: got Jitter() = %v, want %v", i, got, tc.jitter)
+		}
+	}
+
+	// Responses that precede their requests are ignored.
+	e.AddSample(int64(3*time.Second), int64(2*time.Second))
+	if got := e.Samples(); got != len(testCases) {
+		t.Fatalf("got Samples() = %d after invalid sample, want %d", got, len(testCases))
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// addressInternerSlots is the number of addresses an AddressInterner
+// remembers. It must be a power of 2.
+const addressInternerSlots = 256
+
+// AddressInterner turns the addresses found in received packets into
+// tcpip.Addresses. Converting bytes to an Address allocates, so the interner
+// remembers the addresses it returned recently, and returns them again instead
+// of converting the same bytes over and over. Packets exchanged with the same
+// peers are then parsed without allocating.
+//
+// The zero value is ready to use, and it's safe for concurrent use.
+type AddressInterner struct {
+	// slots hold the remembered addresses, indexed by the hash of their
+	// bytes. Colliding addresses just replace each other.
+	slots [addressInternerSlots]atomic.Value
+}
+
+// Address returns the address made of the bytes of b.
+func (a *AddressInterner) Address(b []byte) tcpip.Address {
+	// FNV-1a.
+	h := uint32(2166136261)
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	slot := &a.slots[h&(addressInternerSlots-1)]
+
+	if addr, ok := slot.Load().(tcpip.Address); ok && string(addr) == string(b) {
+		return addr
+	}
+	addr := tcpip.Address(b)
+	slot.Store(addr)
+	return addr
+}
@@ -0,0 +1,159 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// Bridge joins NICs at the link layer: the frames a port of the bridge receives
+// that aren't sent to it are written, unchanged, through the other ports. It is
+// created by Stack.Bridge.
+//
+// Only the frames delivered by link endpoints that know their destination link
+// address, with DeliverFrame, are bridged.
+type Bridge struct {
+	// forwarded is the number of frames written through a port other than
+	// the one they were received by. It is accessed atomically, so it is
+	// kept first for alignment.
+	forwarded uint64
+
+	ports    []*NIC
+	learning bool
+
+	// mu protects fdb, the ports through which the learned link
+	// addresses are reachable.
+	mu  sync.RWMutex
+	fdb map[tcpip.LinkAddress]*NIC
+}
+
+// Bridge joins the given NICs with a new bridge. If learning is true, the
+// bridge learns the port through which each link address is reachable from the
+// source of the frames it receives, and only writes frames sent to these
+// addresses through their port; otherwise, frames are flooded through all the
+// other ports. A NIC can only be a port of one bridge.
+func (s *Stack) Bridge(nicA, nicB tcpip.NICID, learning bool) (*Bridge, *tcpip.Error) {
+	if nicA == nicB {
+		return nil, tcpip.ErrInvalidOptionValue
+	}
+
+	s.mu.RLock()
+	a, b := s.nics[nicA], s.nics[nicB]
+	s.mu.RUnlock()
+	if a == nil || b == nil {
+		return nil, tcpip.ErrUnknownNICID
+	}
+
+	br := &Bridge{
+		ports:    []*NIC{a, b},
+		learning: learning,
+		fdb:      make(map[tcpip.LinkAddress]*NIC),
+	}
+	for i, n := range br.ports {
+		n.mu.Lock()
+		if n.bridge != nil {
+			n.mu.Unlock()
+			for _, p := range br.ports[:i] {
+				p.mu.Lock()
+				p.bridge = nil
+				p.mu.Unlock()
+			}
+			return nil, tcpip.ErrPortInUse
+		}
+		n.bridge = br
+		n.mu.Unlock()
+	}
+	return br, nil
+}
+
+// Close removes the ports from the bridge, which stops bridging frames.
+func (b *Bridge) Close() {
+	for _, n := range b.ports {
+		n.mu.Lock()
+		if n.bridge == b {
+			n.bridge = nil
+		}
+		n.mu.Unlock()
+	}
+}
+
+// Port returns the NIC through which the bridge learned that the given link
+// address is reachable, if any.
+func (b *Bridge) Port(addr tcpip.LinkAddress) (tcpip.NICID, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	n, ok := b.fdb[addr]
+	if !ok {
+		return 0, false
+	}
+	return n.id, true
+}
+
+// Forwarded returns the number of frames the bridge wrote through a port other
+// than the one they were received by. A flooded frame is counted once per
+// port.
+func (b *Bridge) Forwarded() uint64 {
+	return atomic.LoadUint64(&b.forwarded)
+}
+
+// handleFrame bridges a frame received by the port in, and returns whether
+// the frame is also meant for in itself.
+func (b *Bridge) handleFrame(in *NIC, src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) bool {
+	if b.learning && src != "" && !header.IsMulticastEthernetAddress(src) {
+		b.mu.Lock()
+		b.fdb[src] = in
+		b.mu.Unlock()
+	}
+
+	if dst == in.link().LinkAddress() {
+		return true
+	}
+
+	multicast := header.IsMulticastEthernetAddress(dst)
+	var out *NIC
+	if !multicast {
+		for _, p := range b.ports {
+			if p != in && dst == p.link().LinkAddress() {
+				// The frame is for another port, which receives it
+				// as if it were sent to it directly.
+				p.deliverNetworkPacket(p.link(), src, protocol, vv, false, nil)
+				return false
+			}
+		}
+		b.mu.RLock()
+		out = b.fdb[dst]
+		b.mu.RUnlock()
+		if out == in {
+			// The destination is on the segment the frame came from.
+			return false
+		}
+	}
+
+	// The frame may also be delivered to in, which can modify it.
+	payload := append(buffer.View(nil), vv.ToView()...)
+	for _, p := range b.ports {
+		if p == in || (out != nil && p != out) {
+			continue
+		}
+		linkEP := p.link()
+		r := Route{
+			NetProto:          protocol,
+			LocalLinkAddress:  src,
+			RemoteLinkAddress: dst,
+		}
+		hdr := buffer.NewPrependable(int(linkEP.MaxHeaderLength()))
+		if err := linkEP.WritePacket(&r, nil, &hdr, payload, protocol); err == nil {
+			atomic.AddUint64(&b.forwarded, 1)
+		}
+	}
+
+	// Broadcast and multicast frames are for every port.
+	return multicast
+}
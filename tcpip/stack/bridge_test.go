@@ -0,0 +1,140 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+const (
+	bridgeMACA = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x0a")
+	bridgeMACB = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x0b")
+	hostMACA   = tcpip.LinkAddress("\x02\x00\x00\x00\x01\x0a")
+	hostMACB   = tcpip.LinkAddress("\x02\x00\x00\x00\x01\x0b")
+	bcastMAC   = tcpip.LinkAddress("\xff\xff\xff\xff\xff\xff")
+)
+
+// bridgedFrame returns a fake network packet sent to the given address.
+func bridgedFrame(dst byte, payload byte) *buffer.VectorisedView {
+	buf := buffer.NewView(30)
+	buf[0] = dst
+	buf[1] = 3
+	buf[fakeNetHeaderLen] = payload
+	vv := buf.ToVectorisedView([1]buffer.View{})
+	return &vv
+}
+
+// checkBridged checks that the frame with the given payload was written
+// unchanged through ep.
+func checkBridged(t *testing.T, ep *channel.Endpoint, src, dst tcpip.LinkAddress, payload byte) {
+	t.Helper()
+	select {
+	case p := <-ep.C:
+		if p.LocalLinkAddress != src || p.RemoteLinkAddress != dst {
+			t.Errorf("got frame from %q to %q, want from %q to %q", p.LocalLinkAddress, p.RemoteLinkAddress, src, dst)
+		}
+		if p.Proto != fakeNetNumber {
+			t.Errorf("got protocol %d, want %d", p.Proto, fakeNetNumber)
+		}
+		if data := append(p.Header, p.Payload...); len(data) != 30 || data[fakeNetHeaderLen] != payload {
+			t.Errorf("got frame %v, want 30 bytes with payload %d", data, payload)
+		}
+	default:
+		t.Fatalf("Frame with payload %d wasn't bridged", payload)
+	}
+}
+
+func checkNotBridged(t *testing.T, ep *channel.Endpoint) {
+	t.Helper()
+	select {
+	case p := <-ep.C:
+		t.Fatalf("got unexpected frame %+v", p)
+	default:
+	}
+}
+
+func TestBridge(t *testing.T) {
+	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, nil)
+	idA, linkA := channel.New(10, defaultMTU, bridgeMACA)
+	if err := s.CreateNIC(1, idA); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	idB, linkB := channel.New(10, defaultMTU, bridgeMACB)
+	if err := s.CreateNIC(2, idB); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	if _, err := s.Bridge(1, 3, true); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("got Bridge(1, 3) = %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+	b, err := s.Bridge(1, 2, true)
+	if err != nil {
+		t.Fatalf("Bridge failed: %v", err)
+	}
+	defer b.Close()
+	if _, err := s.Bridge(2, 1, true); err != tcpip.ErrPortInUse {
+		t.Fatalf("got second Bridge(2, 1) = %v, want %v", err, tcpip.ErrPortInUse)
+	}
+
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+
+	// A broadcast frame is flooded through B, and delivered to A.
+	linkA.InjectFrame(hostMACA, bcastMAC, fakeNetNumber, bridgedFrame(1, 1))
+	checkBridged(t, linkB, hostMACA, bcastMAC, 1)
+	checkNotBridged(t, linkA)
+	if got := fakeNet.packetCount[1]; got != 1 {
+		t.Fatalf("got %d packets delivered to A, want 1", got)
+	}
+
+	// A frame for an unknown address is flooded, and not delivered.
+	linkA.InjectFrame(hostMACA, hostMACB, fakeNetNumber, bridgedFrame(1, 2))
+	checkBridged(t, linkB, hostMACA, hostMACB, 2)
+	if got := fakeNet.packetCount[1]; got != 1 {
+		t.Fatalf("got %d packets delivered to A, want 1", got)
+	}
+
+	// Once the bridge learns that the host is reachable through B, frames
+	// from A are forwarded through B only.
+	linkB.InjectFrame(hostMACB, bcastMAC, fakeNetNumber, bridgedFrame(2, 3))
+	checkBridged(t, linkA, hostMACB, bcastMAC, 3)
+	if port, ok := b.Port(hostMACB); !ok || port != 2 {
+		t.Fatalf("got Port(%q) = %d, %t, want 2, true", hostMACB, port, ok)
+	}
+	linkA.InjectFrame(hostMACA, hostMACB, fakeNetNumber, bridgedFrame(1, 4))
+	checkBridged(t, linkB, hostMACA, hostMACB, 4)
+	checkNotBridged(t, linkA)
+
+	// Frames between hosts on the same segment aren't bridged.
+	linkA.InjectFrame(hostMACB, hostMACA, fakeNetNumber, bridgedFrame(1, 5))
+	linkA.InjectFrame(hostMACA, hostMACB, fakeNetNumber, bridgedFrame(1, 6))
+	checkNotBridged(t, linkA)
+	checkNotBridged(t, linkB)
+
+	// Frames sent to A itself are delivered and not bridged.
+	linkA.InjectFrame(hostMACA, bridgeMACA, fakeNetNumber, bridgedFrame(1, 7))
+	checkNotBridged(t, linkB)
+	if got := fakeNet.packetCount[1]; got != 2 {
+		t.Fatalf("got %d packets delivered to A, want 2", got)
+	}
+	if got := b.Forwarded(); got != 4 {
+		t.Errorf("got Forwarded() = %d, want 4", got)
+	}
+
+	// Once the bridge is closed, frames are only delivered to A.
+	b.Close()
+	linkA.InjectFrame(hostMACA, bcastMAC, fakeNetNumber, bridgedFrame(1, 8))
+	checkNotBridged(t, linkB)
+	if got := fakeNet.packetCount[1]; got != 3 {
+		t.Fatalf("got %d packets delivered to A, want 3", got)
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// DADConfig holds the timing parameters of duplicate address detection, as
+// described in RFC 5227 section 1.1.
+type DADConfig struct {
+	// ProbeWait is the maximum random delay before the first probe.
+	ProbeWait time.Duration
+
+	// ProbeNum is the number of probes sent.
+	ProbeNum int
+
+	// ProbeMin and ProbeMax bound the random delay between probes.
+	ProbeMin time.Duration
+	ProbeMax time.Duration
+
+	// AnnounceWait is the delay between the last probe and the assignment
+	// of the address.
+	AnnounceWait time.Duration
+
+	// AnnounceNum is the number of announcements sent once the address is
+	// assigned.
+	AnnounceNum int
+
+	// AnnounceInterval is the time between announcements.
+	AnnounceInterval time.Duration
+}
+
+// DefaultDADConfig is the duplicate address detection configuration
+// recommended by RFC 5227.
+var DefaultDADConfig = DADConfig{
+	ProbeWait:        1 * time.Second,
+	ProbeNum:         3,
+	ProbeMin:         1 * time.Second,
+	ProbeMax:         2 * time.Second,
+	AnnounceWait:     2 * time.Second,
+	AnnounceNum:      2,
+	AnnounceInterval: 2 * time.Second,
+}
+
+// DADCallback is called when duplicate address detection for addr on the NIC
+// with the given id completes. err is nil if the address was assigned, and
+// tcpip.ErrDuplicateAddress if another host was found to use it, in which case
+// the address was abandoned.
+type DADCallback func(nicid tcpip.NICID, addr tcpip.Address, err *tcpip.Error)
+
+// AddressOptions specify how an address is added to a NIC.
+type AddressOptions struct {
+	// DAD enables duplicate address detection. The address is then only
+	// assigned once probes sent to the local network went unanswered.
+	// It requires a link that does address resolution and a resolver for
+	// the network protocol that implements DuplicateAddressDetector.
+	DAD bool
+
+	// DADConfig holds the timing of duplicate address detection. If nil,
+	// DefaultDADConfig is used.
+	DADConfig *DADConfig
+
+	// DADCallback, if not nil, is called once duplicate address detection
+	// completes.
+	DADCallback DADCallback
+
+	// PrefixLen is the length in bits of the prefix of the subnet the
+	// address belongs to. Zero stands for the full length of the address.
+	PrefixLen int
+}
+
+// dadState holds the state of duplicate address detection for a single
+// tentative address. It is protected by the NIC's mutex.
+type dadState struct {
+	protocol tcpip.NetworkProtocolNumber
+	addr     tcpip.Address
+	config   DADConfig
+	detector DuplicateAddressDetector
+	callback DADCallback
+	timer    tcpip.Timer
+
+	// prefixLen is the prefix length the address is assigned with.
+	prefixLen int
+
+	// probes is the number of probes sent so far.
+	probes int
+
+	// announcements is the number of announcements sent so far. It only
+	// becomes non-zero once the address is assigned.
+	announcements int
+}
+
+// randomDelay returns a random duration in [min, max), drawn from rng.
+func randomDelay(rng tcpip.Rand, min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	r := uint64(rng.Uint32())<<32 | uint64(rng.Uint32())
+	return min + time.Duration(r%uint64(max-min))
+}
+
+// startDAD starts duplicate address detection for addr. The address is only
+// added to n once detection completes without conflicts.
+func (n *NIC) startDAD(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, opts AddressOptions) *tcpip.Error {
+	if _, ok := n.stack.networkProtocols[protocol]; !ok {
+		return tcpip.ErrUnknownProtocol
+	}
+
+	detector, ok := n.stack.linkAddrResolvers[protocol].(DuplicateAddressDetector)
+	if !ok || n.link().Capabilities()&CapabilityResolutionRequired == 0 {
+		return tcpip.ErrNotSupported
+	}
+
+	config := DefaultDADConfig
+	if opts.DADConfig != nil {
+		config = *opts.DADConfig
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.endpoints[NetworkEndpointID{addr}]; ok {
+		return tcpip.ErrDuplicateAddress
+	}
+	if _, ok := n.dad[addr]; ok {
+		return tcpip.ErrDuplicateAddress
+	}
+
+	s := &dadState{
+		protocol:  protocol,
+		addr:      addr,
+		config:    config,
+		detector:  detector,
+		callback:  opts.DADCallback,
+		prefixLen: opts.PrefixLen,
+	}
+	s.timer = n.stack.AfterFunc(randomDelay(n.stack.rand, 0, config.ProbeWait), func() {
+		n.dadTimerExpired(s)
+	})
+	n.dad[addr] = s
+
+	return nil
+}
+
+// dadTimerExpired drives the probe and announce sequence of s.
+func (n *NIC) dadTimerExpired(s *dadState) {
+	n.mu.Lock()
+	if n.dad[s.addr] != s {
+		// Detection was aborted.
+		n.mu.Unlock()
+		return
+	}
+
+	// Still probing.
+	if s.probes < s.config.ProbeNum {
+		s.probes++
+		if s.probes < s.config.ProbeNum {
+			s.timer.Reset(randomDelay(n.stack.rand, s.config.ProbeMin, s.config.ProbeMax))
+		} else {
+			s.timer.Reset(s.config.AnnounceWait)
+		}
+		n.mu.Unlock()
+
+		s.detector.LinkAddressProbe(s.addr, n.tapEP)
+		return
+	}
+
+	// Announcing an assigned address.
+	if s.announcements > 0 {
+		s.announcements++
+		if s.announcements < s.config.AnnounceNum {
+			s.timer.Reset(s.config.AnnounceInterval)
+		} else {
+			delete(n.dad, s.addr)
+		}
+		n.mu.Unlock()
+
+		s.detector.LinkAddressAnnounce(s.addr, n.tapEP)
+		return
+	}
+
+	// No conflicts were detected, assign the address.
+	ref, err := n.addAddressLocked(s.protocol, s.addr, false)
+	if err == nil {
+		ref.prefixLen = s.prefixLen
+	}
+	announce := err == nil && s.config.AnnounceNum > 0
+	if announce {
+		s.announcements++
+	}
+	if announce && s.announcements < s.config.AnnounceNum {
+		s.timer.Reset(s.config.AnnounceInterval)
+	} else {
+		delete(n.dad, s.addr)
+	}
+	n.mu.Unlock()
+
+	if err == nil {
+		n.stack.invalidateRoutes()
+	}
+	if announce {
+		s.detector.LinkAddressAnnounce(s.addr, n.tapEP)
+	}
+	if s.callback != nil {
+		s.callback(n.id, s.addr, err)
+	}
+}
+
+// stopDADLocked aborts duplicate address detection for addr, if in progress.
+// It returns the state of the aborted detection, or nil if there was none.
+//
+// Precondition: n.mu must be write-locked.
+func (n *NIC) stopDADLocked(addr tcpip.Address) *dadState {
+	s := n.dad[addr]
+	if s == nil {
+		return nil
+	}
+	s.timer.Stop()
+	delete(n.dad, addr)
+	return s
+}
+
+// addressConflict is called when another host is found to use addr. If addr is
+// still tentative, it is abandoned.
+func (n *NIC) addressConflict(addr tcpip.Address) {
+	n.mu.Lock()
+	s := n.dad[addr]
+	if s == nil || s.announcements > 0 {
+		// Only tentative addresses are abandoned.
+		n.mu.Unlock()
+		return
+	}
+	n.stopDADLocked(addr)
+	n.mu.Unlock()
+
+	if s.callback != nil {
+		s.callback(n.id, addr, tcpip.ErrDuplicateAddress)
+	}
+}
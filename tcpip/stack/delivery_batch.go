@@ -0,0 +1,123 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+// deliveryBatch holds the state shared by the packets of a batch delivered by
+// NIC.DeliverNetworkPackets.
+//
+// The network endpoints the packets are sent to are looked up again only when
+// the destination changes, and referenced until the end of the batch. The
+// packets sent to transport endpoints that handle batches are queued, and
+// handed to them once all the packets went through the network layer.
+type deliveryBatch struct {
+	// refs holds a reference to each of the network endpoints the packets
+	// were sent to. The last one was looked up for the protocol and
+	// address of lastProto and lastDst.
+	refs      []*referencedNetworkEndpoint
+	lastProto tcpip.NetworkProtocolNumber
+	lastDst   tcpip.Address
+
+	// queued holds the packets queued for transport endpoints, in order.
+	queued []queuedPacket
+
+	// pkts is the scratch slice the packets of an endpoint are passed in.
+	pkts []TransportPacket
+}
+
+// queuedPacket is a packet queued for a transport endpoint by a deliveryBatch.
+type queuedPacket struct {
+	ep    BatchTransportEndpoint
+	route Route
+	id    TransportEndpointID
+	vv    buffer.VectorisedView
+	views [2]buffer.View
+}
+
+// maxBatchedPackets is the number of packets a deliveryBatch queues for
+// transport endpoints before handing them over, so that the memory the
+// batches keep is bounded.
+const maxBatchedPackets = 64
+
+var deliveryBatchPool = sync.Pool{
+	New: func() interface{} {
+		return &deliveryBatch{queued: make([]queuedPacket, 0, maxBatchedPackets)}
+	},
+}
+
+// lookup returns the network endpoint the previous packet of the batch was
+// sent to, if the current one is sent to the same address, and nil otherwise.
+func (b *deliveryBatch) lookup(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address) *referencedNetworkEndpoint {
+	if len(b.refs) == 0 || b.lastProto != protocol || b.lastDst != dst {
+		return nil
+	}
+	return b.refs[len(b.refs)-1]
+}
+
+// hold keeps the reference to ref the caller looked up for the packets sent to
+// dst until the end of the batch.
+func (b *deliveryBatch) hold(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address, ref *referencedNetworkEndpoint) {
+	b.refs = append(b.refs, ref)
+	b.lastProto = protocol
+	b.lastDst = dst
+}
+
+// queue queues the packet for ep. The route is copied without taking a
+// reference, which the batch holds until it's done.
+func (b *deliveryBatch) queue(ep BatchTransportEndpoint, r *Route, id TransportEndpointID, vv *buffer.VectorisedView) {
+	if len(b.queued) == cap(b.queued) {
+		b.flush()
+	}
+	b.queued = append(b.queued, queuedPacket{ep: ep, route: *r, id: id})
+	q := &b.queued[len(b.queued)-1]
+	q.route.batch = nil
+	q.vv = vv.Clone(q.views[:])
+}
+
+// flush hands the queued packets to their endpoints, those of each endpoint
+// at once.
+func (b *deliveryBatch) flush() {
+	for i := range b.queued {
+		ep := b.queued[i].ep
+		if ep == nil {
+			continue
+		}
+		pkts := b.pkts[:0]
+		for j := i; j < len(b.queued); j++ {
+			if q := &b.queued[j]; q.ep == ep {
+				pkts = append(pkts, TransportPacket{Route: &q.route, ID: q.id, VV: &q.vv})
+				q.ep = nil
+			}
+		}
+		ep.HandlePackets(pkts)
+		for j := range pkts {
+			pkts[j] = TransportPacket{}
+		}
+		b.pkts = pkts[:0]
+	}
+	for i := range b.queued {
+		b.queued[i].vv.Release()
+		b.queued[i] = queuedPacket{}
+	}
+	b.queued = b.queued[:0]
+}
+
+// release flushes the queued packets and releases the network endpoints of the
+// batch.
+func (b *deliveryBatch) release() {
+	b.flush()
+	for i, ref := range b.refs {
+		ref.decRef()
+		b.refs[i] = nil
+	}
+	b.refs = b.refs[:0]
+	b.lastDst = ""
+}
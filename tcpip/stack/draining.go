@@ -0,0 +1,155 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// drainingHook is a function periodically called with the endpoints that have
+// been draining for longer than a threshold.
+type drainingHook struct {
+	mu        sync.Mutex
+	fn        func([]RegisteredEndpoint)
+	threshold time.Duration
+	interval  time.Duration
+	timer     tcpip.Timer
+
+	// generation is incremented every time the hook is set, so that the
+	// timers of the previous hooks don't rearm themselves.
+	generation uint64
+}
+
+// SetTransportEndpointDraining marks the given endpoint, registered with the
+// given nic, protocols and id, as draining from now on: it has been closed,
+// and will unregister itself once it's done with its remaining work. The
+// endpoint is listed as draining, along with how long it has been, until it's
+// unregistered.
+func (s *Stack) SetTransportEndpointDraining(nicID tcpip.NICID, netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) {
+	now := s.NowNanoseconds()
+	if nicID == 0 {
+		s.demux.setDraining(netProtos, protocol, id, ep, now)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if nic := s.nics[nicID]; nic != nil {
+		nic.demux.setDraining(netProtos, protocol, id, ep, now)
+	}
+}
+
+// DrainingEndpoints returns the number of endpoints of the given transport
+// protocol marked as draining with SetTransportEndpointDraining, and how long
+// the first of them has been draining. An endpoint registered for several
+// network protocols is counted once per protocol.
+func (s *Stack) DrainingEndpoints(protocol tcpip.TransportProtocolNumber) (int, time.Duration) {
+	s.mu.RLock()
+	nics := make([]*NIC, 0, len(s.nics))
+	for _, nic := range s.nics {
+		nics = append(nics, nic)
+	}
+	s.mu.RUnlock()
+
+	n, oldest := s.demux.drainingEndpoints(protocol)
+	for _, nic := range nics {
+		nn, o := nic.demux.drainingEndpoints(protocol)
+		if nn != 0 && (n == 0 || o < oldest) {
+			oldest = o
+		}
+		n += nn
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return n, time.Duration(s.NowNanoseconds() - oldest)
+}
+
+// SetDrainingEndpointHook sets a function that is called every interval with
+// the endpoints that have been draining for longer than threshold, if there
+// are any, so that they can be logged. Endpoints stuck draining usually are
+// leaked, e.g., because they are waiting for work that never completes. A nil
+// function removes the hook.
+func (s *Stack) SetDrainingEndpointHook(threshold, interval time.Duration, fn func([]RegisteredEndpoint)) {
+	h := &s.drainingHook
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	h.generation++
+	h.fn = fn
+	h.threshold = threshold
+	h.interval = interval
+	if fn != nil {
+		generation := h.generation
+		h.timer = s.AfterFunc(interval, func() {
+			s.checkDrainingEndpoints(generation)
+		})
+	}
+}
+
+// checkDrainingEndpoints calls the draining hook set by the given generation
+// of SetDrainingEndpointHook with the endpoints that have been draining for
+// too long, and rearms its timer.
+func (s *Stack) checkDrainingEndpoints(generation uint64) {
+	h := &s.drainingHook
+	h.mu.Lock()
+	if h.generation != generation {
+		h.mu.Unlock()
+		return
+	}
+	fn := h.fn
+	threshold := h.threshold
+	h.mu.Unlock()
+
+	eps, _ := s.RegisteredEndpoints()
+	var stuck []RegisteredEndpoint
+	for _, e := range eps {
+		if e.Draining && e.DrainingFor > threshold {
+			stuck = append(stuck, e)
+		}
+	}
+	if len(stuck) != 0 {
+		fn(stuck)
+	}
+
+	h.mu.Lock()
+	if h.generation == generation {
+		h.timer.Reset(h.interval)
+	}
+	h.mu.Unlock()
+}
+
+// CheckNoLeakedEndpoints returns an error describing the transport endpoints
+// still registered with the stack, if any. It's meant to be called by tests
+// once all the endpoints they created are closed and done with their work.
+func (s *Stack) CheckNoLeakedEndpoints() error {
+	eps, _ := s.RegisteredEndpoints()
+	if len(eps) == 0 {
+		return nil
+	}
+
+	leaked := make([]string, 0, len(eps))
+	for _, e := range eps {
+		d := fmt.Sprintf("protocols %d/%d, NIC %d, %+v", e.NetworkProtocol, e.TransportProtocol, e.NIC, e.ID)
+		if e.State != "" {
+			d += ", state " + e.State
+		}
+		if e.Draining {
+			d += fmt.Sprintf(", draining for %v", e.DrainingFor)
+		}
+		leaked = append(leaked, d)
+	}
+	return fmt.Errorf("%d leaked endpoints: %s", len(eps), strings.Join(leaked, "; "))
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/gate"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/testutil"
+)
+
+// wedgedEndpoint is a transport endpoint whose HandlePacket blocks until
+// unwedge is closed. Closing it waits for the packets being handled before it
+// unregisters itself, like endpoints that protect their state with a gate.
+type wedgedEndpoint struct {
+	stack *stack.Stack
+	id    stack.TransportEndpointID
+	gate  gate.Gate
+
+	// entered is signaled when HandlePacket blocks.
+	entered chan struct{}
+	unwedge chan struct{}
+
+	// closed is closed once the endpoint is unregistered.
+	closed chan struct{}
+}
+
+func (e *wedgedEndpoint) HandlePacket(*stack.Route, stack.TransportEndpointID, *buffer.VectorisedView) {
+	if !e.gate.Enter() {
+		return
+	}
+	defer e.gate.Leave()
+	e.entered <- struct{}{}
+	<-e.unwedge
+}
+
+func (*wedgedEndpoint) HandleControlPacket(stack.TransportEndpointID, stack.ControlType, uint32, *buffer.VectorisedView) {
+}
+
+func (e *wedgedEndpoint) close() {
+	netProtos := []tcpip.NetworkProtocolNumber{fakeNetNumber}
+	e.stack.SetTransportEndpointDraining(0, netProtos, fakeTransNumber, e.id, e)
+	go func() {
+		e.gate.Close()
+		e.stack.UnregisterTransportEndpoint(0, netProtos, fakeTransNumber, e.id, e)
+		close(e.closed)
+	}()
+}
+
+func TestWedgedEndpointDiagnostics(t *testing.T) {
+	clock := testutil.NewManualClock()
+	s := stack.New(clock, []string{"fakeNet"}, []string{"fakeTrans"})
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	var logged [][]stack.RegisteredEndpoint
+	s.SetDrainingEndpointHook(10*time.Second, time.Second, func(eps []stack.RegisteredEndpoint) {
+		logged = append(logged, eps)
+	})
+
+	ep := &wedgedEndpoint{
+		stack:   s,
+		id:      stack.TransportEndpointID{LocalAddress: "\x01", RemoteAddress: "\x02"},
+		entered: make(chan struct{}),
+		unwedge: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	if err := s.RegisterTransportEndpoint(0, []tcpip.NetworkProtocolNumber{fakeNetNumber}, fakeTransNumber, ep.id, ep, false); err != nil {
+		t.Fatalf("RegisterTransportEndpoint failed: %v", err)
+	}
+
+	// Wedge HandlePacket, then close the endpoint.
+	go func() {
+		buf := buffer.NewView(30)
+		buf[0] = 1
+		buf[1] = 2
+		buf[2] = byte(fakeTransNumber)
+		vv := buf.ToVectorisedView([1]buffer.View{})
+		linkEP.Inject(fakeNetNumber, &vv)
+	}()
+	select {
+	case <-ep.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the packet to be handled")
+	}
+	ep.close()
+
+	clock.Advance(5 * time.Second)
+	if len(logged) != 0 {
+		t.Fatalf("got endpoints %+v logged after 5s, want none", logged)
+	}
+	if n, d := s.DrainingEndpoints(fakeTransNumber); n != 1 || d != 5*time.Second {
+		t.Fatalf("got DrainingEndpoints() = %d, %v, want 1, 5s", n, d)
+	}
+
+	clock.Advance(6 * time.Second)
+	if len(logged) != 1 {
+		t.Fatalf("got %d calls to the draining hook after 11s, want 1", len(logged))
+	}
+	want := stack.RegisteredEndpoint{
+		NetworkProtocol:   fakeNetNumber,
+		TransportProtocol: fakeTransNumber,
+		ID:                ep.id,
+		Draining:          true,
+		DrainingFor:       11 * time.Second,
+	}
+	if eps := logged[0]; len(eps) != 1 || eps[0] != want {
+		t.Fatalf("got endpoints %+v logged, want %+v", eps, want)
+	}
+	eps, draining := s.RegisteredEndpoints()
+	if len(eps) != 1 || eps[0] != want || draining != 1 {
+		t.Fatalf("got RegisteredEndpoints() = %+v, %d, want %+v, 1", eps, draining, want)
+	}
+	if err := s.CheckNoLeakedEndpoints(); err == nil {
+		t.Fatalf("CheckNoLeakedEndpoints succeeded with a wedged endpoint")
+	}
+
+	close(ep.unwedge)
+	select {
+	case <-ep.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the endpoint to unregister")
+	}
+	if err := s.CheckNoLeakedEndpoints(); err != nil {
+		t.Fatalf("CheckNoLeakedEndpoints failed: %v", err)
+	}
+	if n, d := s.DrainingEndpoints(fakeTransNumber); n != 0 || d != 0 {
+		t.Fatalf("got DrainingEndpoints() = %d, %v, want 0, 0", n, d)
+	}
+
+	// The hook isn't called once no endpoint is draining, nor once it's
+	// removed.
+	clock.Advance(2 * time.Second)
+	s.SetDrainingEndpointHook(0, 0, nil)
+	clock.Advance(time.Minute)
+	if len(logged) != 1 {
+		t.Fatalf("got %d calls to the draining hook, want 1", len(logged))
+	}
+	if got := clock.PendingTimers(); got != 0 {
+		t.Fatalf("got %d pending timers, want 0", got)
+	}
+}
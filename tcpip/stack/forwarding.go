@@ -0,0 +1,100 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// setForwarding enables or disables forwarding of the packets received by n,
+// and of the packets received by other NICs through n.
+func (n *NIC) setForwarding(enable bool) {
+	n.mu.Lock()
+	n.forwarding = enable
+	n.mu.Unlock()
+}
+
+// forwards returns whether n forwards packets.
+func (n *NIC) forwards() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.forwarding
+}
+
+// forward forwards a packet received by n to dst, an address n doesn't
+// accept, through the route the stack has to dst. It returns false if the
+// packet isn't meant to be forwarded, either because n or the NIC of the route
+// don't forward packets or because there is no such route, in which case the
+// caller drops it.
+//
+// Packets are forwarded as they are, except for their TTL or hop limit, and
+// those that don't fit in the MTU of the route are dropped.
+func (n *NIC) forward(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address, vv *buffer.VectorisedView) bool {
+	if !n.forwards() || isBroadcastAddress(protocol, dst) || isMulticastAddress(protocol, dst) {
+		return false
+	}
+	if protocol != header.IPv4ProtocolNumber && protocol != header.IPv6ProtocolNumber {
+		return false
+	}
+
+	r, err := n.stack.FindRoute(0, "", dst, protocol)
+	if err != nil {
+		return false
+	}
+	defer r.Release()
+
+	// Packets to addresses of other NICs aren't forwarded.
+	out := r.ref.nic
+	if r.loop || !out.forwards() {
+		return false
+	}
+
+	// The packet is copied since its TTL is modified, and it's only
+	// forwarded if its headers are valid.
+	v := vv.ToView()
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		h := header.IPv4(v)
+		if !h.IsValid(len(v)) {
+			return false
+		}
+		if h.TTL() <= 1 {
+			return true
+		}
+		h.SetTTL(h.TTL() - 1)
+		h.SetChecksum(0)
+		h.SetChecksum(^h.CalculateChecksum())
+
+	case header.IPv6ProtocolNumber:
+		h := header.IPv6(v)
+		if !h.IsValid(len(v)) {
+			return false
+		}
+		if h.HopLimit() <= 1 {
+			return true
+		}
+		h.SetHopLimit(h.HopLimit() - 1)
+	}
+
+	if uint32(len(v)) > out.link().MTU() {
+		return true
+	}
+
+	// Packets that need their next hop resolved are dropped while
+	// resolution is in progress.
+	if err := r.Resolve(nil); err != nil {
+		return true
+	}
+
+	if err := r.WriteHeaderIncludedPacket(v); err == nil {
+		atomic.AddUint64(&out.stats.ForwardedPackets, 1)
+		atomic.AddUint64(&out.stats.ForwardedBytes, uint64(len(v)))
+	}
+	return true
+}
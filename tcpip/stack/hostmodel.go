@@ -0,0 +1,83 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// HostModel is the host model a NIC receives packets with, see RFC 1122
+// section 3.3.4.2.
+//
+// In the strong host model, a NIC only accepts the packets addressed to its
+// own addresses. In the weak host model, it also accepts the packets addressed
+// to the other NICs of the stack, as if it had their addresses while routes
+// through it use them; the replies to these packets are sent through the NIC
+// that received them, from the address they were sent to. The addresses of
+// loopback NICs are never accepted from other NICs.
+//
+// Packets accepted in the weak host model are delivered rather than forwarded.
+// In the strong host model they're dropped even if the NIC forwards packets,
+// since packets to local addresses are never forwarded. The source addresses
+// of the packets aren't checked in either model.
+type HostModel uint32
+
+const (
+	// DefaultHostModel stands for the host model of the stack, set with
+	// Stack.SetHostModel.
+	DefaultHostModel HostModel = iota
+
+	// StrongHostModel is the strong host model. It's the default host
+	// model of the stack.
+	StrongHostModel
+
+	// WeakHostModel is the weak host model.
+	WeakHostModel
+)
+
+// setHostModel sets the host model of n.
+func (n *NIC) setHostModel(m HostModel) {
+	n.mu.Lock()
+	n.hostModel = m
+	n.mu.Unlock()
+
+	n.stack.invalidateRoutes()
+}
+
+// weakHostLocked returns whether n receives packets in the weak host model.
+// n.mu must be held.
+func (n *NIC) weakHostLocked() bool {
+	m := n.hostModel
+	if m == DefaultHostModel {
+		m = HostModel(atomic.LoadUint32(&n.stack.hostModel))
+	}
+	return m == WeakHostModel
+}
+
+// otherNICHasAddress returns whether a NIC of the stack other than n has the
+// given address, as far as the weak host model is concerned.
+func (s *Stack) otherNICHasAddress(n *NIC, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.otherNICHasAddressLocked(n, protocol, addr)
+}
+
+// otherNICHasAddressLocked is like otherNICHasAddress. s.mu must be held.
+func (s *Stack) otherNICHasAddressLocked(n *NIC, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	if isBroadcastAddress(protocol, addr) || isMulticastAddress(protocol, addr) {
+		return false
+	}
+	for _, nic := range s.nics {
+		if nic == n || nic.link().Capabilities()&CapabilityLoopback != 0 {
+			continue
+		}
+		if nic.hasAddress(protocol, addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -13,14 +13,19 @@ import (
 	"github.com/google/netstack/tcpip"
 )
 
-const linkAddrCacheSize = 512 // max cache entries
+const linkAddrCacheSize = 512 // default max cache entries
 
-// linkAddrCache is a fixed-sized cache mapping IP addresses to link addresses.
+// linkAddrCache is a bounded cache mapping IP addresses to link addresses.
 //
-// The entries are stored in a ring buffer, oldest entry replaced first.
+// When it's full, the least recently used entry is evicted to make room for a
+// new one. Static entries, and entries whose resolution is in progress and may
+// have packets waiting for it, are never evicted.
 //
 // This struct is safe for concurrent use.
 type linkAddrCache struct {
+	// clock is used to age entries and time out resolutions.
+	clock tcpip.Clock
+
 	// ageLimit is how long a cache entry is valid for.
 	ageLimit time.Duration
 
@@ -32,10 +37,19 @@ type linkAddrCache struct {
 	// resolved before failing.
 	resolutionAttempts int
 
-	mu      sync.Mutex
-	cache   map[tcpip.FullAddress]*linkAddrEntry
-	next    int // array index of next available entry
-	entries [linkAddrCacheSize]linkAddrEntry
+	// resolvers counts the goroutines resolving addresses.
+	resolvers sync.WaitGroup
+
+	mu    sync.Mutex
+	cache map[tcpip.FullAddress]*linkAddrEntry
+
+	// lru holds the entries of cache that aren't static, most recently
+	// used first.
+	lru linkAddrEntryList
+
+	// size is the maximum number of entries of cache. It's exceeded when
+	// no entry can be evicted.
+	size int
 }
 
 // entryState controls the state of a single entry in the cache.
@@ -74,11 +88,17 @@ func (s entryState) String() string {
 // A linkAddrEntry is an entry in the linkAddrCache.
 // This struct is thread-compatible.
 type linkAddrEntry struct {
+	linkAddrEntryEntry
+
 	addr       tcpip.FullAddress
 	linkAddr   tcpip.LinkAddress
 	expiration time.Time
 	s          entryState
 
+	// static is set for the entries added with addStatic. They never
+	// expire, and are neither evicted nor replaced by resolutions.
+	static bool
+
 	// wakers is a set of waiters for address resolution result. Anytime
 	// state transitions out of 'incomplete' these waiters are notified.
 	wakers map[*sleep.Waker]struct{}
@@ -86,8 +106,9 @@ type linkAddrEntry struct {
 	cancel chan struct{}
 }
 
-func (e *linkAddrEntry) state() entryState {
-	if e.s != expired && time.Now().After(e.expiration) {
+// state returns the state of the entry at the given time.
+func (e *linkAddrEntry) state(now time.Time) entryState {
+	if !e.static && e.s != expired && now.After(e.expiration) {
 		// Force the transition to ensure waiters are notified.
 		e.changeState(expired)
 	}
@@ -126,28 +147,37 @@ func (e *linkAddrEntry) changeState(ns entryState) {
 }
 
 func (e *linkAddrEntry) addWaker(w *sleep.Waker) {
-	e.wakers[w] = struct{}{}
+	if w != nil {
+		e.wakers[w] = struct{}{}
+	}
 }
 
 func (e *linkAddrEntry) removeWaker(w *sleep.Waker) {
 	delete(e.wakers, w)
 }
 
-// add adds a k -> v mapping to the cache.
-func (c *linkAddrCache) add(k tcpip.FullAddress, v tcpip.LinkAddress) {
+// add adds a k -> v mapping to the cache. It returns true if it replaces a
+// resolved mapping of k to another address.
+func (c *linkAddrCache) add(k tcpip.FullAddress, v tcpip.LinkAddress) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	changed := false
 	entry := c.cache[k]
 	if entry != nil {
-		s := entry.state()
+		if entry.static {
+			return false
+		}
+		s := entry.state(c.now())
 		if s != expired && entry.linkAddr == v {
 			// Disregard repeated calls.
-			return
+			return false
 		}
+		changed = s == ready
 		// Check if entry is waiting for address resolution.
 		if s == incomplete {
 			entry.linkAddr = v
+			c.touchLocked(entry)
 		} else {
 			// Otherwise create a new entry to replace it.
 			entry = c.makeAndAddEntry(k, v)
@@ -157,40 +187,116 @@ func (c *linkAddrCache) add(k tcpip.FullAddress, v tcpip.LinkAddress) {
 	}
 
 	entry.changeState(ready)
+	return changed
+}
+
+// addStatic adds a static k -> v mapping to the cache, replacing any entry
+// for k. It returns true if it replaces a resolved mapping of k to another
+// address.
+func (c *linkAddrCache) addStatic(k tcpip.FullAddress, v tcpip.LinkAddress) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := false
+	if entry := c.cache[k]; entry != nil {
+		if entry.static && entry.linkAddr == v {
+			return false
+		}
+		changed = entry.linkAddr != v && (entry.static || entry.state(c.now()) == ready)
+		c.removeLocked(entry)
+	}
+	c.evictLocked(c.size - 1)
+
+	c.cache[k] = &linkAddrEntry{
+		addr:     k,
+		linkAddr: v,
+		s:        ready,
+		static:   true,
+	}
+	return changed
+}
+
+// removeStatic removes the static entry for k, if there is one.
+func (c *linkAddrCache) removeStatic(k tcpip.FullAddress) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := c.cache[k]
+	if entry == nil || !entry.static {
+		return false
+	}
+	c.removeLocked(entry)
+	return true
+}
+
+// setSize sets the maximum number of entries of the cache, evicting entries as
+// needed.
+func (c *linkAddrCache) setSize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = size
+	c.evictLocked(size)
 }
 
 // makeAndAddEntry is a helper function to create and add a new
 // entry to the cache map and evict older entry as needed.
 func (c *linkAddrCache) makeAndAddEntry(k tcpip.FullAddress, v tcpip.LinkAddress) *linkAddrEntry {
-	// Take over the next entry.
-	entry := &c.entries[c.next]
-	if c.cache[entry.addr] == entry {
-		delete(c.cache, entry.addr)
-	}
-
-	// Mark the soon-to-be-replaced entry as expired, just in case there is
-	// someone waiting for address resolution on it.
-	entry.changeState(expired)
-	if entry.cancel != nil {
-		entry.cancel <- struct{}{}
+	if entry := c.cache[k]; entry != nil {
+		c.removeLocked(entry)
 	}
+	c.evictLocked(c.size - 1)
 
-	*entry = linkAddrEntry{
+	entry := &linkAddrEntry{
 		addr:       k,
 		linkAddr:   v,
-		expiration: time.Now().Add(c.ageLimit),
+		expiration: c.now().Add(c.ageLimit),
 		wakers:     make(map[*sleep.Waker]struct{}),
 		cancel:     make(chan struct{}, 1),
 	}
 
 	c.cache[k] = entry
-	c.next++
-	if c.next == len(c.entries) {
-		c.next = 0
-	}
+	c.lru.PushFront(entry)
 	return entry
 }
 
+// evictLocked evicts the least recently used entries until there are at most
+// n entries left, or none of the others can be evicted.
+func (c *linkAddrCache) evictLocked(n int) {
+	now := c.now()
+	for entry := c.lru.Back(); entry != nil && len(c.cache) > n; {
+		prev := entry.Prev()
+		if entry.state(now) != incomplete {
+			c.removeLocked(entry)
+		}
+		entry = prev
+	}
+}
+
+// removeLocked removes entry from the cache.
+func (c *linkAddrCache) removeLocked(entry *linkAddrEntry) {
+	delete(c.cache, entry.addr)
+	if !entry.static {
+		c.lru.Remove(entry)
+	}
+
+	// Mark the entry as expired, just in case there is someone waiting
+	// for address resolution on it.
+	entry.changeState(expired)
+	select {
+	case entry.cancel <- struct{}{}:
+	default:
+	}
+}
+
+// touchLocked marks entry as the most recently used one.
+func (c *linkAddrCache) touchLocked(entry *linkAddrEntry) {
+	if !entry.static {
+		c.lru.Remove(entry)
+		c.lru.PushFront(entry)
+	}
+}
+
 // get reports any known link address for k.
 func (c *linkAddrCache) get(k tcpip.FullAddress, linkRes LinkAddressResolver, localAddr tcpip.Address, linkEP LinkEndpoint, waker *sleep.Waker) (tcpip.LinkAddress, *tcpip.Error) {
 	if linkRes != nil {
@@ -201,7 +307,7 @@ func (c *linkAddrCache) get(k tcpip.FullAddress, linkRes LinkAddressResolver, lo
 
 	c.mu.Lock()
 	entry := c.cache[k]
-	if entry == nil || entry.state() == expired {
+	if entry == nil || entry.state(c.now()) == expired {
 		c.mu.Unlock()
 		if linkRes == nil {
 			return "", tcpip.ErrNoLinkAddress
@@ -211,12 +317,13 @@ func (c *linkAddrCache) get(k tcpip.FullAddress, linkRes LinkAddressResolver, lo
 	}
 	defer c.mu.Unlock()
 
-	switch s := entry.state(); s {
+	switch s := entry.state(c.now()); s {
 	case expired:
 		// It's possible that entry expired between state() call above and here
 		// in that case it's safe to consider it ready.
 		fallthrough
 	case ready:
+		c.touchLocked(entry)
 		return entry.linkAddr, nil
 	case failed:
 		return "", tcpip.ErrNoLinkAddress
@@ -244,7 +351,7 @@ func (c *linkAddrCache) startAddressResolution(k tcpip.FullAddress, linkRes Link
 	defer c.mu.Unlock()
 
 	// Look up again with lock held to ensure entry wasn't added by someone else.
-	if e := c.cache[k]; e != nil && e.state() != expired {
+	if e := c.cache[k]; e != nil && e.state(c.now()) != expired {
 		return
 	}
 
@@ -252,7 +359,9 @@ func (c *linkAddrCache) startAddressResolution(k tcpip.FullAddress, linkRes Link
 	e := c.makeAndAddEntry(k, "")
 	e.addWaker(waker)
 
+	c.resolvers.Add(1)
 	go func() {
+		defer c.resolvers.Done()
 		for i := 0; ; i++ {
 			// Send link request, then wait for the timeout limit and check
 			// whether the request succeeded.
@@ -261,18 +370,44 @@ func (c *linkAddrCache) startAddressResolution(k tcpip.FullAddress, linkRes Link
 			cancel := e.cancel
 			c.mu.Unlock()
 
+			timeout := make(chan struct{})
+			t := c.clock.AfterFunc(c.resolutionTimeout, func() {
+				close(timeout)
+			})
 			select {
-			case <-time.After(c.resolutionTimeout):
+			case <-timeout:
 				if stop := c.checkLinkRequest(k, i); stop {
 					return
 				}
 			case <-cancel:
+				t.Stop()
 				return
 			}
 		}
 	}()
 }
 
+// cancelResolutions fails the resolutions in progress, and waits for the
+// goroutines resolving them to exit.
+func (c *linkAddrCache) cancelResolutions() {
+	c.mu.Lock()
+	for k, e := range c.cache {
+		if e.s != incomplete {
+			continue
+		}
+		e.changeState(failed)
+		delete(c.cache, k)
+		c.lru.Remove(e)
+		select {
+		case e.cancel <- struct{}{}:
+		default:
+		}
+	}
+	c.mu.Unlock()
+
+	c.resolvers.Wait()
+}
+
 // checkLinkRequest checks whether previous attempt to resolve address has succeeded
 // and mark the entry accordingly, e.g. ready, failed, etc. Return true if request
 // can stop, false if another request should be sent.
@@ -286,7 +421,7 @@ func (c *linkAddrCache) checkLinkRequest(k tcpip.FullAddress, attempt int) bool
 		return true
 	}
 
-	switch s := entry.state(); s {
+	switch s := entry.state(c.now()); s {
 	case ready, failed, expired:
 		// Entry was made ready by resolver or failed. Either way we're done.
 		return true
@@ -303,11 +438,18 @@ func (c *linkAddrCache) checkLinkRequest(k tcpip.FullAddress, attempt int) bool
 	}
 }
 
-func newLinkAddrCache(ageLimit, resolutionTimeout time.Duration, resolutionAttempts int) *linkAddrCache {
+// now returns the current time according to the clock of the cache.
+func (c *linkAddrCache) now() time.Time {
+	return time.Unix(0, c.clock.NowNanoseconds())
+}
+
+func newLinkAddrCache(clock tcpip.Clock, ageLimit, resolutionTimeout time.Duration, resolutionAttempts int) *linkAddrCache {
 	return &linkAddrCache{
+		clock:              clock,
 		ageLimit:           ageLimit,
 		resolutionTimeout:  resolutionTimeout,
 		resolutionAttempts: resolutionAttempts,
 		cache:              make(map[tcpip.FullAddress]*linkAddrEntry, linkAddrCacheSize),
+		size:               linkAddrCacheSize,
 	}
 }
@@ -12,6 +12,7 @@ import (
 
 	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/testutil"
 )
 
 type testaddr struct {
@@ -81,7 +82,7 @@ func init() {
 }
 
 func TestCacheOverflow(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, 1*time.Second, 3)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 1*time.Second, 3)
 	for i := len(testaddrs) - 1; i >= 0; i-- {
 		e := testaddrs[i]
 		c.add(e.addr, e.linkAddr)
@@ -114,7 +115,7 @@ func TestCacheOverflow(t *testing.T) {
 }
 
 func TestCacheConcurrent(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, 1*time.Second, 3)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 1*time.Second, 3)
 
 	var wg sync.WaitGroup
 	for r := 0; r < 16; r++ {
@@ -148,17 +149,18 @@ func TestCacheConcurrent(t *testing.T) {
 }
 
 func TestCacheAgeLimit(t *testing.T) {
-	c := newLinkAddrCache(1*time.Millisecond, 1*time.Second, 3)
+	clock := testutil.NewManualClock()
+	c := newLinkAddrCache(clock, 1*time.Millisecond, 1*time.Second, 3)
 	e := testaddrs[0]
 	c.add(e.addr, e.linkAddr)
-	time.Sleep(50 * time.Millisecond)
+	clock.Advance(2 * time.Millisecond)
 	if _, err := c.get(e.addr, nil, "", nil, nil); err != tcpip.ErrNoLinkAddress {
 		t.Errorf("c.get(%q), got error: %v, want: error ErrNoLinkAddress", string(e.addr.Addr), err)
 	}
 }
 
 func TestCacheReplace(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, 1*time.Second, 3)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 1*time.Second, 3)
 	e := testaddrs[0]
 	l2 := e.linkAddr + "2"
 	c.add(e.addr, e.linkAddr)
@@ -181,7 +183,7 @@ func TestCacheReplace(t *testing.T) {
 }
 
 func TestCacheResolution(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, 250*time.Millisecond, 1)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 250*time.Millisecond, 1)
 	linkRes := &testLinkAddressResolver{cache: c}
 	for i, ta := range testaddrs {
 		got, err := getBlocking(c, ta.addr, linkRes)
@@ -207,7 +209,7 @@ func TestCacheResolution(t *testing.T) {
 }
 
 func TestCacheResolutionFailed(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, 10*time.Millisecond, 5)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 10*time.Millisecond, 5)
 	linkRes := &testLinkAddressResolver{cache: c}
 
 	// First, sanity check that resolution is working...
@@ -229,7 +231,7 @@ func TestCacheResolutionFailed(t *testing.T) {
 func TestCacheResolutionTimeout(t *testing.T) {
 	resolverDelay := 50 * time.Millisecond
 	expiration := resolverDelay / 2
-	c := newLinkAddrCache(expiration, 1*time.Millisecond, 3)
+	c := newLinkAddrCache(&tcpip.StdClock{}, expiration, 1*time.Millisecond, 3)
 	linkRes := &testLinkAddressResolver{cache: c, delay: resolverDelay}
 
 	e := testaddrs[0]
@@ -238,10 +240,72 @@ func TestCacheResolutionTimeout(t *testing.T) {
 	}
 }
 
+// silentLinkAddressResolver never answers link address requests.
+type silentLinkAddressResolver struct {
+	testLinkAddressResolver
+}
+
+func (*silentLinkAddressResolver) LinkAddressRequest(tcpip.Address, tcpip.Address, LinkEndpoint) *tcpip.Error {
+	return nil
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, 10*time.Millisecond, 100)
+	defer c.cancelResolutions()
+	c.setSize(4)
+
+	static, pending, e1, e2, e3 := testaddrs[0], testaddrs[1], testaddrs[2], testaddrs[3], testaddrs[4]
+	c.addStatic(static.addr, static.linkAddr)
+	if _, err := c.get(pending.addr, &silentLinkAddressResolver{}, "", nil, nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("c.get(%q), got error: %v, want: error ErrWouldBlock", string(pending.addr.Addr), err)
+	}
+	c.add(e1.addr, e1.linkAddr)
+	c.add(e2.addr, e2.linkAddr)
+
+	// The cache is full. Using e1 leaves e2 as the least recently used
+	// entry that can be evicted, so it makes room for e3.
+	if _, err := c.get(e1.addr, nil, "", nil, nil); err != nil {
+		t.Fatalf("c.get(%q), got error: %v", string(e1.addr.Addr), err)
+	}
+	c.add(e3.addr, e3.linkAddr)
+
+	if _, err := c.get(e2.addr, nil, "", nil, nil); err != tcpip.ErrNoLinkAddress {
+		t.Errorf("c.get(%q), got error: %v, want: error ErrNoLinkAddress", string(e2.addr.Addr), err)
+	}
+	for _, e := range []testaddr{static, e1, e3} {
+		got, err := c.get(e.addr, nil, "", nil, nil)
+		if err != nil {
+			t.Errorf("c.get(%q)=%q, got error: %v", string(e.addr.Addr), got, err)
+		}
+		if got != e.linkAddr {
+			t.Errorf("c.get(%q)=%q, want %q", string(e.addr.Addr), got, e.linkAddr)
+		}
+	}
+	if _, err := c.get(pending.addr, nil, "", nil, nil); err != tcpip.ErrWouldBlock {
+		t.Errorf("c.get(%q), got error: %v, want: error ErrWouldBlock", string(pending.addr.Addr), err)
+	}
+
+	// The evicted address is resolved again when it's needed.
+	linkRes := &testLinkAddressResolver{cache: c}
+	got, err := getBlocking(c, e2.addr, linkRes)
+	if err != nil {
+		t.Errorf("c.get(%q)=%q, got error: %v", string(e2.addr.Addr), got, err)
+	}
+	if got != e2.linkAddr {
+		t.Errorf("c.get(%q)=%q, want %q", string(e2.addr.Addr), got, e2.linkAddr)
+	}
+
+	// Static entries aren't replaced by resolutions.
+	c.add(static.addr, static.linkAddr+"2")
+	if got, _ := c.get(static.addr, nil, "", nil, nil); got != static.linkAddr {
+		t.Errorf("c.get(%q)=%q after resolution, want %q", string(static.addr.Addr), got, static.linkAddr)
+	}
+}
+
 // TestStaticResolution checks that static link addresses are resolved immediately and don't
 // send resolution requests.
 func TestStaticResolution(t *testing.T) {
-	c := newLinkAddrCache(1<<63-1, time.Millisecond, 1)
+	c := newLinkAddrCache(&tcpip.StdClock{}, 1<<63-1, time.Millisecond, 1)
 	linkRes := &testLinkAddressResolver{cache: c, delay: time.Minute}
 
 	addr := tcpip.Address("broadcast")
@@ -12,42 +12,258 @@ import (
 	"github.com/google/netstack/ilist"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
 )
 
+// headerBufferSize is the size of the buffers the headers of outbound packets
+// are built into, when recycled. It fits the headers of any TCP or UDP packet
+// over ethernet.
+const headerBufferSize = 256
+
 // NIC represents a "network interface card" to which the networking stack is
 // attached.
 type NIC struct {
-	stack  *Stack
-	id     tcpip.NICID
-	name   string
+	// stats holds the traffic counters of the NIC. They're accessed
+	// atomically, so stats is kept first for alignment.
+	stats tcpip.NICStats
+
+	stack *Stack
+	id    tcpip.NICID
+	name  string
+
+	// linkMu protects linkEP, the link endpoint the NIC is attached to,
+	// and the state of the attachment. It is only held to access them,
+	// not while using linkEP, which is done through link.
+	linkMu sync.RWMutex
 	linkEP LinkEndpoint
 
+	// attachment is the dispatcher linkEP was attached with, if it was.
+	attachment *linkAttachment
+
+	// detached is set by detachLinkEndpoint, until another link endpoint
+	// is attached.
+	detached bool
+
+	// tapEP forwards to linkEP, delivering outbound packets to the packet
+	// taps. It is the link endpoint used by network endpoints, so that
+	// they keep working when linkEP is replaced.
+	tapEP *tapLinkEndpoint
+
+	// headers recycles the buffers the headers of the packets sent through
+	// the NIC are built into, see Route.NewHeader.
+	headers *buffer.HeaderPool
+
 	demux *transportDemuxer
 
 	mu          sync.RWMutex
 	spoofing    bool
 	promiscuous bool
+	forwarding  bool
+	hostModel   HostModel
 	primary     map[tcpip.NetworkProtocolNumber]*ilist.List
 	endpoints   map[NetworkEndpointID]*referencedNetworkEndpoint
 	subnets     []tcpip.Subnet
+
+	// dad holds the state of duplicate address detection for addresses
+	// that are still tentative or being announced.
+	dad map[tcpip.Address]*dadState
+
+	// slaac is the state of stateless address autoconfiguration, nil if
+	// it's disabled.
+	slaac *slaacState
+
+	// mcastJoins counts the joins of each multicast group, and
+	// mcastFilters counts the joined groups that map to each multicast
+	// link address, so that filters are only removed from the link
+	// endpoint once no group needs them anymore.
+	mcastJoins   map[tcpip.Address]int
+	mcastFilters map[tcpip.LinkAddress]int
+
+	// bridge is the bridge the NIC is a port of, if any.
+	bridge *Bridge
+
+	// tapMu protects taps, the packet taps attached to the NIC.
+	tapMu sync.RWMutex
+	taps  []*PacketTap
+
+	// packetMu protects packetEPs, the packet endpoints bound to the NIC
+	// indexed by network protocol, zero being the index of those bound to
+	// all protocols. The slices are never modified once stored, so they
+	// may be used after releasing packetMu.
+	packetMu  sync.RWMutex
+	packetEPs map[tcpip.NetworkProtocolNumber][]PacketEndpoint
 }
 
 func newNIC(stack *Stack, id tcpip.NICID, name string, ep LinkEndpoint) *NIC {
-	return &NIC{
+	n := &NIC{
 		stack:     stack,
 		id:        id,
 		name:      name,
 		linkEP:    ep,
+		headers:   buffer.NewHeaderPool(headerBufferSize),
 		demux:     newTransportDemuxer(stack),
 		primary:   make(map[tcpip.NetworkProtocolNumber]*ilist.List),
 		endpoints: make(map[NetworkEndpointID]*referencedNetworkEndpoint),
+		dad:       make(map[tcpip.Address]*dadState),
+
+		mcastJoins:   make(map[tcpip.Address]int),
+		mcastFilters: make(map[tcpip.LinkAddress]int),
 	}
+	n.tapEP = &tapLinkEndpoint{nic: n}
+	return n
+}
+
+// link returns the link endpoint of n.
+func (n *NIC) link() LinkEndpoint {
+	n.linkMu.RLock()
+	ep := n.linkEP
+	n.linkMu.RUnlock()
+	return ep
+}
+
+// linkAttachment is the dispatcher a link endpoint is attached to. It stops
+// delivering the endpoint's packets to the NIC once the endpoint is detached.
+type linkAttachment struct {
+	nic *NIC
+
+	// detached is set atomically when the endpoint is detached.
+	detached uint32
+}
+
+// DeliverNetworkPacket implements NetworkDispatcher.DeliverNetworkPacket.
+func (a *linkAttachment) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
+	if atomic.LoadUint32(&a.detached) != 0 {
+		return
+	}
+	a.nic.DeliverNetworkPacket(linkEP, remoteLinkAddr, protocol, vv, checksumValidated)
+}
+
+// DeliverNetworkPackets implements BatchNetworkDispatcher.DeliverNetworkPackets.
+func (a *linkAttachment) DeliverNetworkPackets(linkEP LinkEndpoint, pkts []InboundPacket) {
+	if atomic.LoadUint32(&a.detached) != 0 {
+		return
+	}
+	a.nic.DeliverNetworkPackets(linkEP, pkts)
+}
+
+// DeliverFrame implements FrameDispatcher.DeliverFrame. Frames received by a
+// bridged NIC are handed to its bridge, which decides whether they are also
+// delivered to the NIC.
+func (a *linkAttachment) DeliverFrame(linkEP LinkEndpoint, src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
+	if atomic.LoadUint32(&a.detached) != 0 {
+		return
+	}
+	a.nic.mu.RLock()
+	b := a.nic.bridge
+	a.nic.mu.RUnlock()
+	if b != nil && !b.handleFrame(a.nic, src, dst, protocol, vv) {
+		return
+	}
+	a.nic.DeliverNetworkPacket(linkEP, src, protocol, vv, checksumValidated)
+}
+
+// Clock returns the clock of the stack, for link endpoints to time things with
+// it.
+func (a *linkAttachment) Clock() tcpip.Clock {
+	return a.nic.stack.clock
 }
 
 // attachLinkEndpoint attaches the NIC to the endpoint, which will enable it
 // to start delivering packets.
 func (n *NIC) attachLinkEndpoint() {
-	n.linkEP.Attach(n)
+	n.linkMu.Lock()
+	if n.attachment == nil {
+		n.attachment = &linkAttachment{nic: n}
+	}
+	ep, a := n.linkEP, n.attachment
+	n.linkMu.Unlock()
+
+	ep.Attach(a)
+}
+
+// detachLinkEndpoint stops n from using its link endpoint: its packets are no
+// longer delivered, and packets written through n are dropped until another
+// link endpoint is attached with replaceLinkEndpoint.
+func (n *NIC) detachLinkEndpoint() *tcpip.Error {
+	n.linkMu.Lock()
+	defer n.linkMu.Unlock()
+
+	if n.detached {
+		return tcpip.ErrInvalidEndpointState
+	}
+	if n.attachment != nil {
+		atomic.StoreUint32(&n.attachment.detached, 1)
+		n.attachment = nil
+	}
+	n.detached = true
+	return nil
+}
+
+// replaceLinkEndpoint attaches n to ep in place of the link endpoint that was
+// detached with detachLinkEndpoint. The multicast filters of the joined groups
+// are programmed in ep.
+func (n *NIC) replaceLinkEndpoint(ep LinkEndpoint) *tcpip.Error {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	n.linkMu.Lock()
+	if !n.detached {
+		n.linkMu.Unlock()
+		return tcpip.ErrInvalidEndpointState
+	}
+	n.linkEP = ep
+	n.detached = false
+	n.linkMu.Unlock()
+
+	if mep, ok := ep.(MulticastLinkEndpoint); ok {
+		for addr := range n.mcastFilters {
+			if err := mep.AddMulticastFilter(addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	n.attachLinkEndpoint()
+	return nil
+}
+
+// closeLinkEndpoint closes the endpoint the NIC is attached to, if it can be
+// closed. A detached endpoint is left to its owner.
+func (n *NIC) closeLinkEndpoint() {
+	n.linkMu.RLock()
+	ep, detached := n.linkEP, n.detached
+	n.linkMu.RUnlock()
+
+	if detached {
+		return
+	}
+	if ep, ok := ep.(LinkEndpointCloser); ok {
+		ep.Close()
+	}
+}
+
+// info returns the information of n. Its addresses and state are read while
+// holding n.mu, so that they're consistent.
+func (n *NIC) info() NICInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	n.linkMu.RLock()
+	ep, detached := n.linkEP, n.detached
+	n.linkMu.RUnlock()
+
+	return NICInfo{
+		Name:              n.name,
+		LinkAddress:       ep.LinkAddress(),
+		ProtocolAddresses: n.addressesLocked(),
+		MTU:               ep.MTU(),
+		Flags: NICStateFlags{
+			Up:          !detached,
+			Loopback:    ep.Capabilities()&CapabilityLoopback != 0,
+			Promiscuous: n.promiscuous,
+		},
+		Stats: n.Stats(),
+	}
 }
 
 // setPromiscuousMode enables or disables promiscuous mode.
@@ -62,6 +278,8 @@ func (n *NIC) setSpoofing(enable bool) {
 	n.mu.Lock()
 	n.spoofing = enable
 	n.mu.Unlock()
+
+	n.stack.invalidateRoutes()
 }
 
 // primaryEndpoint returns the primary endpoint of n for the given network
@@ -77,7 +295,15 @@ func (n *NIC) primaryEndpoint(protocol tcpip.NetworkProtocolNumber) *referencedN
 
 	for e := list.Front(); e != nil; e = e.Next() {
 		r := e.(*referencedNetworkEndpoint)
-		if r.tryIncRef() {
+		if !r.deprecated && r.tryIncRef() {
+			return r
+		}
+	}
+
+	// Deprecated addresses are only used if there are no others.
+	for e := list.Front(); e != nil; e = e.Next() {
+		r := e.(*referencedNetworkEndpoint)
+		if r.deprecated && r.tryIncRef() {
 			return r
 		}
 	}
@@ -85,7 +311,10 @@ func (n *NIC) primaryEndpoint(protocol tcpip.NetworkProtocolNumber) *referencedN
 	return nil
 }
 
-// findEndpoint finds the endpoint, if any, with the given address.
+// findEndpoint finds the endpoint, if any, with the given address. Addresses
+// within the subnets of n, any address in spoofing mode, and the addresses of
+// the other NICs in the weak host model, get a temporary endpoint. n.stack.mu
+// must be held.
 func (n *NIC) findEndpoint(protocol tcpip.NetworkProtocolNumber, address tcpip.Address) *referencedNetworkEndpoint {
 	id := NetworkEndpointID{address}
 
@@ -94,9 +323,17 @@ func (n *NIC) findEndpoint(protocol tcpip.NetworkProtocolNumber, address tcpip.A
 	if ref != nil && !ref.tryIncRef() {
 		ref = nil
 	}
-	spoofing := n.spoofing
+	spoofing := ref == nil && (n.spoofing || n.inSubnetLocked(address))
+	weak := ref == nil && !spoofing && n.weakHostLocked()
 	n.mu.RUnlock()
 
+	// In the weak host model, the addresses of the other NICs can be used
+	// too. n.mu isn't held while looking them up, since the NICs are
+	// locked in no particular order.
+	if weak {
+		spoofing = n.stack.otherNICHasAddressLocked(n, protocol, address)
+	}
+
 	if ref != nil || !spoofing {
 		return ref
 	}
@@ -116,6 +353,16 @@ func (n *NIC) findEndpoint(protocol tcpip.NetworkProtocolNumber, address tcpip.A
 	return ref
 }
 
+// hasAddress returns whether n has the given address, not counting the
+// temporary endpoints created in promiscuous or spoofing mode.
+func (n *NIC) hasAddress(protocol tcpip.NetworkProtocolNumber, address tcpip.Address) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	ref := n.endpoints[NetworkEndpointID{address}]
+	return ref != nil && ref.protocol == protocol && ref.holdsInsertRef
+}
+
 func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, replace bool) (*referencedNetworkEndpoint, *tcpip.Error) {
 	netProto, ok := n.stack.networkProtocols[protocol]
 	if !ok {
@@ -123,7 +370,7 @@ func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.
 	}
 
 	// Create the new network endpoint.
-	ep, err := netProto.NewEndpoint(n.id, addr, n.stack, n, n.linkEP)
+	ep, err := netProto.NewEndpoint(n.id, addr, n.stack, n, n.tapEP)
 	if err != nil {
 		return nil, err
 	}
@@ -146,7 +393,7 @@ func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.
 	}
 
 	// Set up cache if link address resolution exists for this protocol.
-	if n.linkEP.Capabilities()&CapabilityResolutionRequired != 0 {
+	if n.link().Capabilities()&CapabilityResolutionRequired != 0 {
 		if linkRes := n.stack.linkAddrResolvers[protocol]; linkRes != nil {
 			ref.linkCache = n.stack
 		}
@@ -168,23 +415,162 @@ func (n *NIC) addAddressLocked(protocol tcpip.NetworkProtocolNumber, addr tcpip.
 // AddAddress adds a new address to n, so that it starts accepting packets
 // targeted at the given address (and network protocol).
 func (n *NIC) AddAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *tcpip.Error {
+	return n.AddAddressWithOptions(protocol, addr, AddressOptions{})
+}
+
+// AddAddressWithOptions adds a new address to n like AddAddress, but allows the
+// caller to set the prefix length of the address, and to request duplicate
+// address detection before the address is assigned.
+func (n *NIC) AddAddressWithOptions(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, opts AddressOptions) *tcpip.Error {
+	if opts.PrefixLen < 0 || opts.PrefixLen > len(addr)*8 {
+		return tcpip.ErrBadAddress
+	}
+	if opts.DAD {
+		return n.startDAD(protocol, addr, opts)
+	}
+
 	// Add the endpoint.
 	n.mu.Lock()
-	_, err := n.addAddressLocked(protocol, addr, false)
+	ref, err := n.addAddressLocked(protocol, addr, false)
+	if err == nil {
+		ref.prefixLen = opts.PrefixLen
+	}
 	n.mu.Unlock()
 
+	if err == nil {
+		n.stack.invalidateRoutes()
+	}
 	return err
 }
 
+// setLinkAddress changes the link address of n's link endpoint, reforms the
+// addresses autoconfigured from it, then announces n's addresses whose link
+// address resolver can, so that neighbors update their caches.
+func (n *NIC) setLinkAddress(addr tcpip.LinkAddress) *tcpip.Error {
+	ep, ok := n.link().(LinkAddressSetter)
+	if !ok {
+		return tcpip.ErrNotSupported
+	}
+	old := ep.LinkAddress()
+	if err := ep.SetLinkAddress(addr); err != nil {
+		return err
+	}
+
+	// Autoconfigured IPv6 addresses are formed from the link address.
+	if addr != old {
+		n.relinkSLAAC(addr)
+	}
+
+	if ep.Capabilities()&CapabilityResolutionRequired == 0 {
+		return nil
+	}
+	for _, a := range n.Addresses() {
+		if d, ok := n.stack.linkAddrResolvers[a.Protocol].(DuplicateAddressDetector); ok {
+			d.LinkAddressAnnounce(a.Address, n.tapEP)
+		}
+	}
+
+	return nil
+}
+
+// multicastLinkAddress returns the link address that frames sent to the given
+// multicast group are addressed to.
+func multicastLinkAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) (tcpip.LinkAddress, *tcpip.Error) {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		if header.IsV4MulticastAddress(addr) {
+			return header.EthernetAddressFromMulticastIPv4Address(addr), nil
+		}
+	case header.IPv6ProtocolNumber:
+		if header.IsV6MulticastAddress(addr) {
+			return header.EthernetAddressFromMulticastIPv6Address(addr), nil
+		}
+	default:
+		return "", tcpip.ErrNotSupported
+	}
+	return "", tcpip.ErrBadAddress
+}
+
+// JoinGroup joins the given multicast group on n, so that it starts accepting
+// packets sent to it. Groups may be joined several times; they're only left
+// once LeaveGroup has been called as many times.
+func (n *NIC) JoinGroup(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *tcpip.Error {
+	linkAddr, err := multicastLinkAddress(protocol, addr)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.mcastJoins[addr] == 0 {
+		if n.mcastFilters[linkAddr] == 0 {
+			if ep, ok := n.link().(MulticastLinkEndpoint); ok {
+				if err := ep.AddMulticastFilter(linkAddr); err != nil {
+					return err
+				}
+			}
+		}
+		n.mcastFilters[linkAddr]++
+	}
+	n.mcastJoins[addr]++
+
+	return nil
+}
+
+// LeaveGroup undoes one call to JoinGroup for the given multicast group.
+func (n *NIC) LeaveGroup(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *tcpip.Error {
+	linkAddr, err := multicastLinkAddress(protocol, addr)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	joins := n.mcastJoins[addr]
+	if joins == 0 {
+		return tcpip.ErrBadLocalAddress
+	}
+	if joins > 1 {
+		n.mcastJoins[addr]--
+		return nil
+	}
+	delete(n.mcastJoins, addr)
+
+	if n.mcastFilters[linkAddr] > 1 {
+		n.mcastFilters[linkAddr]--
+		return nil
+	}
+	delete(n.mcastFilters, linkAddr)
+
+	if ep, ok := n.link().(MulticastLinkEndpoint); ok {
+		return ep.RemoveMulticastFilter(linkAddr)
+	}
+	return nil
+}
+
 // Addresses returns the addresses associated with this NIC.
 func (n *NIC) Addresses() []tcpip.ProtocolAddress {
 	n.mu.RLock()
 	defer n.mu.RUnlock()
+	return n.addressesLocked()
+}
+
+// addressesLocked returns the addresses associated with n.
+//
+// Precondition: n.mu must be read-locked.
+func (n *NIC) addressesLocked() []tcpip.ProtocolAddress {
 	addrs := make([]tcpip.ProtocolAddress, 0, len(n.endpoints))
 	for nid, ep := range n.endpoints {
+		prefixLen := ep.prefixLen
+		if prefixLen == 0 {
+			prefixLen = len(nid.LocalAddress) * 8
+		}
 		addrs = append(addrs, tcpip.ProtocolAddress{
-			Protocol: ep.protocol,
-			Address:  nid.LocalAddress,
+			Protocol:  ep.protocol,
+			Address:   nid.LocalAddress,
+			PrefixLen: prefixLen,
 		})
 	}
 	return addrs
@@ -196,6 +582,20 @@ func (n *NIC) AddSubnet(protocol tcpip.NetworkProtocolNumber, subnet tcpip.Subne
 	n.mu.Lock()
 	n.subnets = append(n.subnets, subnet)
 	n.mu.Unlock()
+
+	n.stack.invalidateRoutes()
+}
+
+// inSubnetLocked returns true if addr is within one of the subnets of n.
+//
+// Precondition: n.mu must be held.
+func (n *NIC) inSubnetLocked(addr tcpip.Address) bool {
+	for i := range n.subnets {
+		if n.subnets[i].Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 // Subnets returns the Subnets associated with this NIC.
@@ -239,10 +639,16 @@ func (n *NIC) removeEndpoint(r *referencedNetworkEndpoint) {
 	n.mu.Unlock()
 }
 
-// RemoveAddress removes an address from n.
+// RemoveAddress removes an address from n. Duplicate address detection of the
+// address, if in progress, is aborted.
 func (n *NIC) RemoveAddress(addr tcpip.Address) *tcpip.Error {
 	n.mu.Lock()
+	tentative := n.stopDADLocked(addr) != nil
 	r := n.endpoints[NetworkEndpointID{addr}]
+	if r == nil && tentative {
+		n.mu.Unlock()
+		return nil
+	}
 	if r == nil || !r.holdsInsertRef {
 		n.mu.Unlock()
 		return tcpip.ErrBadLocalAddress
@@ -251,30 +657,166 @@ func (n *NIC) RemoveAddress(addr tcpip.Address) *tcpip.Error {
 	r.holdsInsertRef = false
 	n.mu.Unlock()
 
+	n.stack.invalidateRoutes()
 	r.decRef()
 
 	return nil
 }
 
+// removeAddresses removes all the addresses of n, including tentative ones.
+// Address autoconfiguration is disabled so that it doesn't add new ones.
+func (n *NIC) removeAddresses() {
+	n.setSLAAC(nil)
+
+	n.mu.RLock()
+	addrs := make([]tcpip.Address, 0, len(n.endpoints)+len(n.dad))
+	for id, r := range n.endpoints {
+		if r.holdsInsertRef {
+			addrs = append(addrs, id.LocalAddress)
+		}
+	}
+	for addr := range n.dad {
+		addrs = append(addrs, addr)
+	}
+	n.mu.RUnlock()
+
+	for _, addr := range addrs {
+		n.RemoveAddress(addr)
+	}
+}
+
 // DeliverNetworkPacket finds the appropriate network protocol endpoint and
 // hands the packet over for further processing. This function is called when
 // the NIC receives a packet from the physical interface.
 // Note that the ownership of the slice backing vv is retained by the caller.
 // This rule applies only to the slice itself, not to the items of the slice;
-// the ownership of the items is not retained by the caller.
-func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+// the ownership of the items is not retained by the caller, unless vv has a
+// PacketBuffer, see NetworkDispatcher.
+func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
+	if !n.admitPacket(vv) {
+		return
+	}
+	n.deliverNetworkPacket(linkEP, remoteLinkAddr, protocol, vv, checksumValidated, nil)
+}
+
+// DeliverNetworkPackets is like DeliverNetworkPacket, for a batch of packets
+// received together. The network endpoints the packets are sent to are looked
+// up once for consecutive packets sent to the same address, and the transport
+// endpoints that implement BatchTransportEndpoint get their packets at once,
+// after all the packets went through the network layer.
+func (n *NIC) DeliverNetworkPackets(linkEP LinkEndpoint, pkts []InboundPacket) {
+	b := deliveryBatchPool.Get().(*deliveryBatch)
+	for i := range pkts {
+		p := &pkts[i]
+		if !n.admitPacket(&p.VV) {
+			continue
+		}
+		n.deliverNetworkPacket(linkEP, p.RemoteLinkAddress, p.Protocol, &p.VV, p.ChecksumValidated, b)
+	}
+	b.release()
+	deliveryBatchPool.Put(b)
+}
+
+// admitPacket returns whether a packet received from the link is within the
+// receive rate limit of the stack, and counts it as dropped otherwise.
+func (n *NIC) admitPacket(vv *buffer.VectorisedView) bool {
+	if l := &n.stack.rcvLimiter; l.active() && !l.admit(vv.Size()) {
+		n.stack.stats.RateLimitedRcvdPackets.Increment()
+		return false
+	}
+	return true
+}
+
+// deliverNetworkPacket delivers a packet as DeliverNetworkPacket does, as part
+// of the batch b if it's not nil.
+func (n *NIC) deliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool, b *deliveryBatch) {
+	if n.stack.isPaused() || n.stack.isClosed() {
+		n.stack.stats.DroppedPackets.Increment()
+		return
+	}
+
+	n.tracePacket(PacketInbound, protocol, vv.Views()...)
+	n.deliverToTaps(PacketInbound, protocol, nil, vv.Views()...)
+	n.deliverToPacketEndpoints(PacketInbound, remoteLinkAddr, "", protocol, vv)
+
+	atomic.AddUint64(&n.stats.RxPackets, 1)
+	atomic.AddUint64(&n.stats.RxBytes, uint64(vv.Size()))
+
+	if caps := linkEP.Capabilities(); caps&CapabilityLoopback != 0 && n.stack.LoopbackChecksums() {
+		checksumValidated = false
+	} else if caps&CapabilityRXChecksumOffload != 0 {
+		checksumValidated = true
+	}
+	if checksumValidated {
+		atomic.AddUint64(&n.stats.RxChecksumTrustedPackets, 1)
+	}
+
 	netProto, ok := n.stack.networkProtocols[protocol]
 	if !ok {
-		atomic.AddUint64(&n.stack.stats.UnknownProtocolRcvdPackets, 1)
+		n.stack.stats.UnknownProtocolRcvdPackets.Increment()
+		atomic.AddUint64(&n.stats.RxUnknownProtocolPackets, 1)
 		return
 	}
 
+	isIP := protocol == header.IPv4ProtocolNumber || protocol == header.IPv6ProtocolNumber
+	if isIP {
+		n.stack.stats.IP.PacketsReceived.Increment()
+	}
+
 	if len(vv.First()) < netProto.MinimumPacketSize() {
-		atomic.AddUint64(&n.stack.stats.MalformedRcvdPackets, 1)
+		n.stack.stats.MalformedRcvdPackets.Increment()
+		atomic.AddUint64(&n.stats.RxMalformedPackets, 1)
 		return
 	}
 
 	src, dst := netProto.ParseAddresses(vv.First())
+	switch {
+	case isBroadcastAddress(protocol, dst):
+		atomic.AddUint64(&n.stats.RxBroadcastPackets, 1)
+	case isMulticastAddress(protocol, dst):
+		atomic.AddUint64(&n.stats.RxMulticastPackets, 1)
+	}
+	var ref *referencedNetworkEndpoint
+	if b != nil {
+		ref = b.lookup(protocol, dst)
+	}
+	if ref == nil {
+		if ref = n.findNetworkEndpoint(protocol, dst, vv, isIP); ref == nil {
+			return
+		}
+		if b != nil {
+			b.hold(protocol, dst, ref)
+		}
+	}
+
+	// Endpoints only borrow the route for the duration of the call, so it's
+	// recycled for the next packet.
+	r := inboundRoutePool.Get().(*Route)
+	*r = makeRoute(protocol, dst, src, ref)
+	r.LocalLinkAddress = linkEP.LinkAddress()
+	r.RemoteLinkAddress = remoteLinkAddr
+	r.ChecksumValidated = checksumValidated
+	r.batch = b
+	ref.ep.HandlePacket(r, vv)
+	if b == nil {
+		ref.decRef()
+	}
+	*r = Route{}
+	inboundRoutePool.Put(r)
+}
+
+// inboundRoutePool recycles the routes of received packets.
+var inboundRoutePool = sync.Pool{
+	New: func() interface{} {
+		return new(Route)
+	},
+}
+
+// findNetworkEndpoint returns a reference to the network endpoint of the given
+// protocol that packets sent to dst are delivered to. If there is none, it
+// forwards the packet in vv if it should be, or accounts for it being dropped,
+// and returns nil.
+func (n *NIC) findNetworkEndpoint(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address, vv *buffer.VectorisedView, isIP bool) *referencedNetworkEndpoint {
 	id := NetworkEndpointID{dst}
 
 	n.mu.RLock()
@@ -282,8 +824,9 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.Lin
 	if ref != nil && !ref.tryIncRef() {
 		ref = nil
 	}
-	promiscuous := n.promiscuous
+	promiscuous := n.promiscuous || n.mcastJoins[dst] != 0
 	subnets := n.subnets
+	weak := n.weakHostLocked()
 	n.mu.RUnlock()
 
 	if ref == nil {
@@ -296,6 +839,11 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.Lin
 				}
 			}
 		}
+		// In the weak host model, packets to the other NICs are
+		// accepted too.
+		if !promiscuous && weak {
+			promiscuous = n.stack.otherNICHasAddress(n, protocol, dst)
+		}
 		if promiscuous {
 			// Try again with the lock in exclusive mode. If we still can't
 			// get the endpoint, create a new "temporary" one. It will only
@@ -312,45 +860,67 @@ func (n *NIC) DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.Lin
 		}
 	}
 
-	if ref == nil {
-		atomic.AddUint64(&n.stack.stats.UnknownNetworkEndpointRcvdPackets, 1)
-		return
+	if ref == nil && n.forward(protocol, dst, vv) {
+		return nil
 	}
 
-	r := makeRoute(protocol, dst, src, ref)
-	r.LocalLinkAddress = linkEP.LinkAddress()
-	r.RemoteLinkAddress = remoteLinkAddr
-	ref.ep.HandlePacket(&r, vv)
-	ref.decRef()
+	if ref == nil {
+		n.stack.stats.UnknownNetworkEndpointRcvdPackets.Increment()
+		if isIP {
+			n.stack.stats.IP.InvalidAddressesReceived.Increment()
+			if !weak && n.stack.otherNICHasAddress(n, protocol, dst) {
+				n.stack.stats.IP.StrongHostDrops.Increment()
+			}
+		}
+		atomic.AddUint64(&n.stats.RxNoEndpointPackets, 1)
+		return nil
+	}
+	return ref
 }
 
 // DeliverTransportPacket delivers the packets to the appropriate transport
 // protocol endpoint.
 func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView) {
+	n.stack.stats.IP.PacketsDelivered.Increment()
+
 	state, ok := n.stack.transportProtocols[protocol]
 	if !ok {
-		atomic.AddUint64(&n.stack.stats.UnknownProtocolRcvdPackets, 1)
+		n.stack.stats.UnknownProtocolRcvdPackets.Increment()
+		atomic.AddUint64(&n.stats.RxUnknownProtocolPackets, 1)
 		return
 	}
 
 	transProto := state.proto
 	if len(vv.First()) < transProto.MinimumPacketSize() {
-		atomic.AddUint64(&n.stack.stats.MalformedRcvdPackets, 1)
+		n.stack.stats.MalformedRcvdPackets.Increment()
+		atomic.AddUint64(&state.stats.MalformedRcvdPackets, 1)
+		atomic.AddUint64(&n.stats.RxMalformedPackets, 1)
 		return
 	}
 
 	srcPort, dstPort, err := transProto.ParsePorts(vv.First())
 	if err != nil {
-		atomic.AddUint64(&n.stack.stats.MalformedRcvdPackets, 1)
+		n.stack.stats.MalformedRcvdPackets.Increment()
+		atomic.AddUint64(&state.stats.MalformedRcvdPackets, 1)
+		atomic.AddUint64(&n.stats.RxMalformedPackets, 1)
 		return
 	}
 
 	id := TransportEndpointID{dstPort, r.LocalAddress, srcPort, r.RemoteAddress}
-	if n.demux.deliverPacket(r, protocol, vv, id) {
-		return
-	}
-	if n.stack.demux.deliverPacket(r, protocol, vv, id) {
-		return
+	if isBroadcastAddress(r.NetProto, r.LocalAddress) || isMulticastAddress(r.NetProto, r.LocalAddress) {
+		// Broadcast and multicast packets go to all the endpoints they
+		// match, those of the NIC as well as those of the stack.
+		delivered := n.demux.deliverMulticastPacket(r, protocol, vv, id)
+		if n.stack.demux.deliverMulticastPacket(r, protocol, vv, id) || delivered {
+			return
+		}
+	} else {
+		if n.demux.deliverPacket(r, protocol, vv, id) {
+			return
+		}
+		if n.stack.demux.deliverPacket(r, protocol, vv, id) {
+			return
+		}
 	}
 
 	// Try to deliver to per-stack default handler.
@@ -360,13 +930,27 @@ func (n *NIC) DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolN
 		}
 	}
 
+	n.stack.stats.UnknownPortRcvdPackets.Increment()
+	if protocol == header.UDPProtocolNumber {
+		n.stack.stats.UDP.UnknownPortErrors.Increment()
+	}
+	atomic.AddUint64(&state.stats.UnknownPortRcvdPackets, 1)
+	n.stack.unknownPortHook.call(n.stack.NowNanoseconds(), protocol, id)
+
 	// We could not find an appropriate destination for this packet, so
 	// deliver it to the global handler.
 	if !transProto.HandleUnknownDestinationPacket(r, id, vv) {
-		atomic.AddUint64(&n.stack.stats.MalformedRcvdPackets, 1)
+		n.stack.stats.MalformedRcvdPackets.Increment()
+		atomic.AddUint64(&n.stats.RxMalformedPackets, 1)
 	}
 }
 
+// DeliverRawPacket delivers a copy of the packet to the raw endpoints of its
+// transport protocol.
+func (n *NIC) DeliverRawPacket(r *Route, protocol tcpip.TransportProtocolNumber, netHeader buffer.View, vv *buffer.VectorisedView) {
+	n.stack.demux.deliverRawPacket(r, protocol, netHeader, vv)
+}
+
 // DeliverTransportControlPacket delivers control packets to the appropriate
 // transport protocol endpoint.
 func (n *NIC) DeliverTransportControlPacket(local, remote tcpip.Address, net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ ControlType, extra uint32, vv *buffer.VectorisedView) {
@@ -389,6 +973,9 @@ func (n *NIC) DeliverTransportControlPacket(local, remote tcpip.Address, net tcp
 		return
 	}
 
+	// The quoted packet was sent by the endpoint, so its source is the
+	// local end of the endpoint's ID and its destination the remote end,
+	// the reverse of the packets the endpoint receives.
 	id := TransportEndpointID{srcPort, local, dstPort, remote}
 	if n.demux.deliverControlPacket(net, trans, typ, extra, vv, id) {
 		return
@@ -403,6 +990,63 @@ func (n *NIC) ID() tcpip.NICID {
 	return n.id
 }
 
+// Stats returns a snapshot of the traffic counters of n.
+func (n *NIC) Stats() tcpip.NICStats {
+	return tcpip.NICStats{
+		TxPackets:                atomic.LoadUint64(&n.stats.TxPackets),
+		TxBytes:                  atomic.LoadUint64(&n.stats.TxBytes),
+		TxErrors:                 atomic.LoadUint64(&n.stats.TxErrors),
+		TxMulticastPackets:       atomic.LoadUint64(&n.stats.TxMulticastPackets),
+		TxBroadcastPackets:       atomic.LoadUint64(&n.stats.TxBroadcastPackets),
+		RxPackets:                atomic.LoadUint64(&n.stats.RxPackets),
+		RxBytes:                  atomic.LoadUint64(&n.stats.RxBytes),
+		RxMulticastPackets:       atomic.LoadUint64(&n.stats.RxMulticastPackets),
+		RxBroadcastPackets:       atomic.LoadUint64(&n.stats.RxBroadcastPackets),
+		RxUnknownProtocolPackets: atomic.LoadUint64(&n.stats.RxUnknownProtocolPackets),
+		RxMalformedPackets:       atomic.LoadUint64(&n.stats.RxMalformedPackets),
+		RxNoEndpointPackets:      atomic.LoadUint64(&n.stats.RxNoEndpointPackets),
+		RxChecksumTrustedPackets: atomic.LoadUint64(&n.stats.RxChecksumTrustedPackets),
+		ForwardedPackets:         atomic.LoadUint64(&n.stats.ForwardedPackets),
+		ForwardedBytes:           atomic.LoadUint64(&n.stats.ForwardedBytes),
+	}
+}
+
+// countWrite updates the traffic counters of n after a packet of the given
+// size was written to the given destination.
+func (n *NIC) countWrite(protocol tcpip.NetworkProtocolNumber, dst tcpip.Address, size int, err *tcpip.Error) {
+	if err != nil {
+		atomic.AddUint64(&n.stats.TxErrors, 1)
+		return
+	}
+
+	atomic.AddUint64(&n.stats.TxPackets, 1)
+	atomic.AddUint64(&n.stats.TxBytes, uint64(size))
+	switch {
+	case isBroadcastAddress(protocol, dst):
+		atomic.AddUint64(&n.stats.TxBroadcastPackets, 1)
+	case isMulticastAddress(protocol, dst):
+		atomic.AddUint64(&n.stats.TxMulticastPackets, 1)
+	}
+}
+
+// isBroadcastAddress returns whether addr is the broadcast address of the given
+// network protocol.
+func isBroadcastAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	return protocol == header.IPv4ProtocolNumber && addr == header.IPv4Broadcast
+}
+
+// isMulticastAddress returns whether addr is a multicast address of the given
+// network protocol.
+func isMulticastAddress(protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
+	switch protocol {
+	case header.IPv4ProtocolNumber:
+		return header.IsV4MulticastAddress(addr)
+	case header.IPv6ProtocolNumber:
+		return header.IsV6MulticastAddress(addr)
+	}
+	return false
+}
+
 type referencedNetworkEndpoint struct {
 	ilist.Entry
 	refs     int32
@@ -419,6 +1063,16 @@ type referencedNetworkEndpoint struct {
 	// endpoint. It is reset to false when RemoveAddress is called on the
 	// NIC.
 	holdsInsertRef bool
+
+	// prefixLen is the length of the prefix of the subnet of the address,
+	// zero standing for the full length of the address. It is protected
+	// by the NIC's mutex.
+	prefixLen int
+
+	// deprecated is protected by the NIC's mutex. It indicates whether
+	// the address is deprecated, in which case it's only used as the
+	// source address of new connections if there is no other.
+	deprecated bool
 }
 
 // decRef decrements the ref count and cleans up the endpoint once it reaches
@@ -0,0 +1,287 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+// RateLimit is a token bucket limit on the number of bytes going through the
+// NICs of a stack, see Stack.SetSendRateLimit and Stack.SetReceiveRateLimit.
+// The bytes of a packet are those of its network headers and payload.
+type RateLimit struct {
+	// Rate is the number of bytes per second the bucket is refilled with.
+	// Zero disables the limit.
+	Rate uint64
+
+	// Burst is the capacity of the bucket, i.e., the number of bytes that
+	// can go through at once after the link was idle. A packet larger
+	// than Burst goes through once the bucket is full.
+	Burst uint64
+
+	// QueueLimit is the number of sent packets exceeding the limit that are
+	// queued until the bucket is refilled; the packets that don't fit in
+	// the queue are dropped. Received packets exceeding the limit are
+	// always dropped.
+	QueueLimit int
+}
+
+// rateLimiter enforces a RateLimit on the packets of a stack.
+type rateLimiter struct {
+	// enabled is set atomically to 1 while the limit has a rate, so that
+	// the packets of stacks without limits don't take mu.
+	enabled uint32
+
+	clock tcpip.Clock
+
+	mu    sync.Mutex
+	limit RateLimit
+
+	// tokens is the number of bytes left in the bucket, as of last. It's
+	// negative when a packet larger than what was left went through.
+	tokens int64
+	last   int64
+
+	// queue holds the sent packets waiting for tokens, in order. timer
+	// expires when the first one can be written if scheduled is set, and
+	// draining is set while the packets are written, so that the packets
+	// sent meanwhile are queued behind them.
+	queue     []limitedPacket
+	timer     tcpip.Timer
+	scheduled bool
+	draining  bool
+}
+
+// limitedPacket is a packet queued by a rateLimiter, with the arguments of the
+// WritePacket call that sent it.
+type limitedPacket struct {
+	ep       *tapLinkEndpoint
+	route    Route
+	checksum *PartialChecksum
+	header   buffer.Prependable
+	payload  buffer.View
+	protocol tcpip.NetworkProtocolNumber
+}
+
+func (p *limitedPacket) size() int {
+	return p.header.UsedLength() + len(p.payload)
+}
+
+// active returns whether the limiter has a limit to enforce.
+func (l *rateLimiter) active() bool {
+	return atomic.LoadUint32(&l.enabled) != 0
+}
+
+// set replaces the limit of l, with a full bucket.
+func (l *rateLimiter) set(clock tcpip.Clock, limit RateLimit) *tcpip.Error {
+	if limit.QueueLimit < 0 || (limit.Rate != 0 && limit.Burst == 0) {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	l.mu.Lock()
+	l.clock = clock
+	l.limit = limit
+	l.tokens = int64(limit.Burst)
+	l.last = clock.NowNanoseconds()
+	enabled := uint32(0)
+	if limit.Rate != 0 {
+		enabled = 1
+	}
+	atomic.StoreUint32(&l.enabled, enabled)
+	flush := len(l.queue) != 0
+	l.mu.Unlock()
+
+	// The packets queued under the previous limit go out under the new
+	// one, right away if it allows it.
+	if flush {
+		l.drain()
+	}
+	return nil
+}
+
+// get returns the limit of l.
+func (l *rateLimiter) get() RateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// refillLocked adds the tokens earned since the last refill to the bucket.
+//
+// Precondition: l.mu must be held.
+func (l *rateLimiter) refillLocked() {
+	if l.limit.Rate == 0 {
+		return
+	}
+	now := l.clock.NowNanoseconds()
+	elapsed := now - l.last
+	if elapsed <= 0 {
+		return
+	}
+	// Only the time the tokens were earned for is accounted for, so that
+	// fractions of tokens aren't lost between refills.
+	earned := uint64(elapsed) * l.limit.Rate / uint64(time.Second)
+	if l.tokens+int64(earned) >= int64(l.limit.Burst) {
+		l.tokens = int64(l.limit.Burst)
+		l.last = now
+		return
+	}
+	l.tokens += int64(earned)
+	l.last += int64(earned * uint64(time.Second) / l.limit.Rate)
+}
+
+// takeLocked takes the tokens needed by a packet of the given size from the
+// bucket, and returns whether it can go through.
+//
+// Precondition: l.mu must be held.
+func (l *rateLimiter) takeLocked(size int) bool {
+	if l.limit.Rate == 0 {
+		return true
+	}
+	l.refillLocked()
+	need := int64(size)
+	if need > int64(l.limit.Burst) {
+		need = int64(l.limit.Burst)
+	}
+	if l.tokens < need {
+		return false
+	}
+	l.tokens -= int64(size)
+	return true
+}
+
+// delayLocked returns how long it takes for the bucket to hold the tokens
+// needed by a packet of the given size.
+//
+// Precondition: l.mu must be held.
+func (l *rateLimiter) delayLocked(size int) time.Duration {
+	need := int64(size)
+	if need > int64(l.limit.Burst) {
+		need = int64(l.limit.Burst)
+	}
+	missing := need - l.tokens
+	if missing <= 0 || l.limit.Rate == 0 {
+		return 0
+	}
+	// Round up, so that the timer doesn't expire a bit too soon.
+	return time.Duration((uint64(missing)*uint64(time.Second) + l.limit.Rate - 1) / l.limit.Rate)
+}
+
+// admit returns whether a received packet of the given size goes through.
+func (l *rateLimiter) admit(size int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.takeLocked(size)
+}
+
+// send returns whether the packet sent by ep.WritePacket can be written right
+// away. If it can't, the packet is either queued, to be written once the
+// bucket is refilled, or dropped.
+func (l *rateLimiter) send(ep *tapLinkEndpoint, r *Route, csum *PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) bool {
+	size := hdr.UsedLength() + len(payload)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queue) == 0 && !l.draining && l.takeLocked(size) {
+		return true
+	}
+	if len(l.queue) >= l.limit.QueueLimit {
+		ep.nic.stack.stats.RateLimitedSentPackets.Increment()
+		return false
+	}
+
+	p := limitedPacket{
+		ep:       ep,
+		checksum: csum,
+		header:   *hdr,
+		payload:  payload,
+		protocol: protocol,
+	}
+	// Keep the route and headers until the packet is written.
+	if r != nil {
+		p.route = r.Clone()
+	}
+	if b := hdr.Buffer(); b != nil {
+		b.IncRef()
+	}
+	l.queue = append(l.queue, p)
+	if !l.draining {
+		l.scheduleLocked()
+	}
+	return false
+}
+
+// scheduleLocked sets the timer to expire when the first queued packet can be
+// written.
+//
+// Precondition: l.mu must be held, and l.queue must not be empty.
+func (l *rateLimiter) scheduleLocked() {
+	if l.scheduled {
+		return
+	}
+	l.refillLocked()
+	d := l.delayLocked(l.queue[0].size())
+	l.scheduled = true
+	if l.timer == nil {
+		l.timer = l.clock.AfterFunc(d, l.expire)
+	} else {
+		l.timer.Reset(d)
+	}
+}
+
+// expire is called when the timer of l expires.
+func (l *rateLimiter) expire() {
+	l.mu.Lock()
+	l.scheduled = false
+	l.mu.Unlock()
+	l.drain()
+}
+
+// drain writes the queued packets the bucket has tokens for, and schedules the
+// timer for the rest.
+func (l *rateLimiter) drain() {
+	l.mu.Lock()
+	if l.draining {
+		l.mu.Unlock()
+		return
+	}
+	l.draining = true
+	for {
+		n := 0
+		for n < len(l.queue) && l.takeLocked(l.queue[n].size()) {
+			n++
+		}
+		if n == 0 {
+			break
+		}
+		batch := make([]limitedPacket, n)
+		copy(batch, l.queue)
+		copy(l.queue, l.queue[n:])
+		for i := len(l.queue) - n; i < len(l.queue); i++ {
+			l.queue[i] = limitedPacket{}
+		}
+		l.queue = l.queue[:len(l.queue)-n]
+		l.mu.Unlock()
+
+		for i := range batch {
+			p := &batch[i]
+			p.ep.writeToLink(&p.route, p.checksum, &p.header, p.payload, p.protocol)
+			p.header.Release()
+			p.route.Release()
+		}
+
+		l.mu.Lock()
+	}
+	l.draining = false
+	if len(l.queue) != 0 {
+		l.scheduleLocked()
+	}
+	l.mu.Unlock()
+}
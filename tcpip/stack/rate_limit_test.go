@@ -0,0 +1,215 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/testutil"
+)
+
+// limitedPacketSize is the size of the packets sent and received by the rate
+// limit tests, network header included.
+const limitedPacketSize = 100
+
+func newRateLimitedStack(t *testing.T) (*stack.Stack, *channel.Endpoint, *testutil.ManualClock) {
+	clock := testutil.NewManualClock()
+	id, linkEP := channel.New(100, defaultMTU, "")
+	s := stack.New(clock, []string{"fakeNet"}, nil)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	return s, linkEP, clock
+}
+
+// sendLimited sends n packets of limitedPacketSize bytes to addr.
+func sendLimited(t *testing.T, s *stack.Stack, addr tcpip.Address, n int) {
+	r, err := s.FindRoute(0, "", addr, fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+
+	for i := 0; i < n; i++ {
+		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+		payload := buffer.NewView(limitedPacketSize - fakeNetHeaderLen)
+		if err := r.WritePacket(nil, &hdr, payload, fakeTransNumber); err != nil {
+			t.Fatalf("WritePacket failed: %v", err)
+		}
+	}
+}
+
+// receiveLimited injects n packets of limitedPacketSize bytes addressed to
+// addr.
+func receiveLimited(linkEP *channel.Endpoint, addr tcpip.Address, n int) {
+	for i := 0; i < n; i++ {
+		buf := buffer.NewView(limitedPacketSize)
+		buf[0] = addr[0]
+		vv := buf.ToVectorisedView([1]buffer.View{})
+		linkEP.Inject(fakeNetNumber, &vv)
+	}
+}
+
+func TestRateLimitOptions(t *testing.T) {
+	s, _, _ := newRateLimitedStack(t)
+
+	for _, l := range []stack.RateLimit{
+		{Rate: 1000},
+		{Rate: 1000, Burst: 100, QueueLimit: -1},
+	} {
+		if err := s.SetSendRateLimit(l); err != tcpip.ErrInvalidOptionValue {
+			t.Errorf("got SetSendRateLimit(%+v) = %v, want %v", l, err, tcpip.ErrInvalidOptionValue)
+		}
+	}
+	l := stack.RateLimit{Rate: 1000, Burst: 100, QueueLimit: 1}
+	if err := s.SetReceiveRateLimit(l); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("got SetReceiveRateLimit(%+v) = %v, want %v", l, err, tcpip.ErrInvalidOptionValue)
+	}
+
+	if err := s.SetSendRateLimit(l); err != nil {
+		t.Fatalf("SetSendRateLimit(%+v) failed: %v", l, err)
+	}
+	if got := s.SendRateLimit(); got != l {
+		t.Errorf("got SendRateLimit() = %+v, want %+v", got, l)
+	}
+	if got := s.ReceiveRateLimit(); got != (stack.RateLimit{}) {
+		t.Errorf("got ReceiveRateLimit() = %+v, want %+v", got, stack.RateLimit{})
+	}
+}
+
+func TestSendRateLimitQueue(t *testing.T) {
+	s, linkEP, clock := newRateLimitedStack(t)
+	if err := s.SetSendRateLimit(stack.RateLimit{
+		Rate:       10 * limitedPacketSize,
+		Burst:      3 * limitedPacketSize,
+		QueueLimit: 5,
+	}); err != nil {
+		t.Fatalf("SetSendRateLimit failed: %v", err)
+	}
+
+	// The burst goes out right away, the queue fills up, and the rest is
+	// dropped.
+	sendLimited(t, s, "\x03", 10)
+	if got := linkEP.Drain(); got != 3 {
+		t.Errorf("got %d packets sent right away, want 3", got)
+	}
+	stats := s.Stats()
+	if got := stats.RateLimitedSentPackets.Value(); got != 2 {
+		t.Errorf("got RateLimitedSentPackets = %d, want 2", got)
+	}
+
+	// The queued packets are paced at the rate.
+	for i := 0; i < 5; i++ {
+		clock.Advance(99 * time.Millisecond)
+		if got := linkEP.Drain(); got != 0 {
+			t.Fatalf("got %d packets sent after 99ms, want 0", got)
+		}
+		clock.Advance(time.Millisecond)
+		if got := linkEP.Drain(); got != 1 {
+			t.Fatalf("got %d packets sent after 100ms, want 1", got)
+		}
+	}
+	if got := clock.PendingTimers(); got != 0 {
+		t.Errorf("got %d pending timers with an empty queue, want 0", got)
+	}
+
+	// Packets sent while others are queued wait for their turn.
+	sendLimited(t, s, "\x03", 1)
+	if got := linkEP.Drain(); got != 0 {
+		t.Errorf("got %d packets sent with an empty bucket, want 0", got)
+	}
+	clock.Advance(100 * time.Millisecond)
+	if got := linkEP.Drain(); got != 1 {
+		t.Errorf("got %d packets sent after 100ms, want 1", got)
+	}
+
+	// Removing the limit flushes the queue.
+	sendLimited(t, s, "\x03", 3)
+	if err := s.SetSendRateLimit(stack.RateLimit{}); err != nil {
+		t.Fatalf("SetSendRateLimit failed: %v", err)
+	}
+	if got := linkEP.Drain(); got != 3 {
+		t.Errorf("got %d packets sent after the limit was removed, want 3", got)
+	}
+	sendLimited(t, s, "\x03", 10)
+	if got := linkEP.Drain(); got != 10 {
+		t.Errorf("got %d packets sent without a limit, want 10", got)
+	}
+}
+
+func TestSendRateLimitDrop(t *testing.T) {
+	s, linkEP, clock := newRateLimitedStack(t)
+	if err := s.SetSendRateLimit(stack.RateLimit{
+		Rate:  10 * limitedPacketSize,
+		Burst: 3 * limitedPacketSize,
+	}); err != nil {
+		t.Fatalf("SetSendRateLimit failed: %v", err)
+	}
+
+	sendLimited(t, s, "\x03", 5)
+	if got := linkEP.Drain(); got != 3 {
+		t.Errorf("got %d packets sent, want 3", got)
+	}
+
+	// The bucket holds no more than the burst, however long it's idle.
+	clock.Advance(time.Second)
+	sendLimited(t, s, "\x03", 5)
+	if got := linkEP.Drain(); got != 3 {
+		t.Errorf("got %d packets sent after 1s, want 3", got)
+	}
+
+	stats := s.Stats()
+	if got := stats.RateLimitedSentPackets.Value(); got != 4 {
+		t.Errorf("got RateLimitedSentPackets = %d, want 4", got)
+	}
+	if got := clock.PendingTimers(); got != 0 {
+		t.Errorf("got %d pending timers without a queue, want 0", got)
+	}
+}
+
+func TestReceiveRateLimit(t *testing.T) {
+	s, linkEP, clock := newRateLimitedStack(t)
+	if err := s.SetReceiveRateLimit(stack.RateLimit{
+		Rate:  10 * limitedPacketSize,
+		Burst: 3 * limitedPacketSize,
+	}); err != nil {
+		t.Fatalf("SetReceiveRateLimit failed: %v", err)
+	}
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+
+	receiveLimited(linkEP, "\x01", 5)
+	if got := fakeNet.packetCount[1]; got != 3 {
+		t.Errorf("got %d packets received, want 3", got)
+	}
+
+	// Tokens earned over half a packet's time aren't lost.
+	clock.Advance(150 * time.Millisecond)
+	receiveLimited(linkEP, "\x01", 2)
+	clock.Advance(50 * time.Millisecond)
+	receiveLimited(linkEP, "\x01", 2)
+	if got := fakeNet.packetCount[1]; got != 5 {
+		t.Errorf("got %d packets received after 200ms, want 5", got)
+	}
+
+	stats := s.Stats()
+	if got := stats.RateLimitedRcvdPackets.Value(); got != 4 {
+		t.Errorf("got RateLimitedRcvdPackets = %d, want 4", got)
+	}
+
+	// Sending isn't limited.
+	sendLimited(t, s, "\x03", 5)
+	if got := linkEP.Drain(); got != 5 {
+		t.Errorf("got %d packets sent, want 5", got)
+	}
+}
@@ -5,11 +5,14 @@
 package stack
 
 import (
+	"encoding/binary"
 	"sync"
+	"time"
 
 	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/waiter"
 )
 
@@ -44,6 +47,7 @@ type ControlType int
 const (
 	ControlPacketTooBig ControlType = iota
 	ControlPortUnreachable
+	ControlHostUnreachable
 	ControlUnknown
 )
 
@@ -51,7 +55,10 @@ const (
 // protocol (e.g., tcp, udp) endpoints that can handle packets.
 type TransportEndpoint interface {
 	// HandlePacket is called by the stack when new packets arrive to
-	// this transport endpoint.
+	// this transport endpoint. vv is only borrowed for the duration of
+	// the call: the views it keeps must be cloned with vv.Clone, and the
+	// clone released once they're no longer used. So is r, which must be
+	// cloned with r.Clone to be kept.
 	HandlePacket(r *Route, id TransportEndpointID, vv *buffer.VectorisedView)
 
 	// HandleControlPacket is called by the stack when new control (e.g.,
@@ -59,6 +66,123 @@ type TransportEndpoint interface {
 	HandleControlPacket(id TransportEndpointID, typ ControlType, extra uint32, vv *buffer.VectorisedView)
 }
 
+// TransportPacket is a packet delivered to a transport endpoint, as passed to
+// BatchTransportEndpoint.HandlePackets.
+type TransportPacket struct {
+	Route *Route
+	ID    TransportEndpointID
+	VV    *buffer.VectorisedView
+}
+
+// BatchTransportEndpoint is an optional interface implemented by transport
+// endpoints that handle the packets of a batch delivered by
+// BatchNetworkDispatcher.DeliverNetworkPackets at once, e.g., to queue them
+// while holding a lock only once.
+type BatchTransportEndpoint interface {
+	TransportEndpoint
+
+	// HandlePackets is like HandlePacket, for the packets of a batch sent
+	// to the endpoint, in the order they were received. The endpoint may
+	// reuse pkts as scratch space.
+	HandlePackets(pkts []TransportPacket)
+}
+
+// TransportEndpointStateReporter is an optional interface implemented by
+// transport endpoints that can describe their state, so that it can be
+// included in snapshots of the stack.
+type TransportEndpointStateReporter interface {
+	TransportEndpoint
+
+	// State returns a short description of the state of the endpoint, e.g.,
+	// "LISTEN".
+	State() string
+}
+
+// TransportEndpointDrainReporter is an optional interface implemented by
+// transport endpoints that can remain registered after they are closed, e.g.,
+// while a TCP connection is being shut down.
+type TransportEndpointDrainReporter interface {
+	TransportEndpoint
+
+	// Draining returns true if the endpoint has been closed but is still
+	// registered until it's done with its remaining work.
+	Draining() bool
+}
+
+// TransportEndpointAcceptQueueReporter is an optional interface implemented by
+// transport endpoints that queue the connections they accept, so that the
+// occupancy of the queues of listening endpoints can be monitored.
+type TransportEndpointAcceptQueueReporter interface {
+	TransportEndpoint
+
+	// AcceptQueue returns the number of connections waiting to be accepted
+	// and the maximum number of them, the backlog, if the endpoint is
+	// listening. ok is false otherwise.
+	AcceptQueue() (queued, backlog int, ok bool)
+}
+
+// PausableTransportEndpoint is an optional interface implemented by transport
+// endpoints that do work in the background, so that Stack.Pause can quiesce
+// them.
+type PausableTransportEndpoint interface {
+	TransportEndpoint
+
+	// Pause stops the background work of the endpoint, including its
+	// timers, and returns once it's stopped.
+	Pause()
+
+	// Resume restarts the work stopped by Pause.
+	Resume()
+}
+
+// StoppableTransportEndpoint is an optional interface implemented by transport
+// endpoints that do work in the background, so that Stack.Close can stop them.
+type StoppableTransportEndpoint interface {
+	TransportEndpoint
+
+	// Stop shuts the connection of the endpoint down, if it has one, and
+	// stops its background work, including its timers. If opts.Linger is
+	// positive, the connection is first given that long to be shut down
+	// gracefully; it's reset otherwise, or dropped silently if opts.Silent
+	// is set. Stop returns once the work is stopped, but the endpoint must
+	// still be closed by its user.
+	Stop(opts CloseOptions)
+}
+
+// RoutedTransportEndpoint is an optional interface implemented by transport
+// endpoints that keep a route, so that they can stop using it when its NIC is
+// removed with Stack.DeleteNIC.
+type RoutedTransportEndpoint interface {
+	TransportEndpoint
+
+	// HandleNICRemoved is called once the given NIC is removed. Endpoints
+	// whose route goes through it must fail, as it can't be used anymore.
+	HandleNICRemoved(id tcpip.NICID)
+}
+
+// RawTransportEndpoint is the interface that needs to be implemented by raw
+// transport endpoints, which receive a copy of every packet of their transport
+// protocol, whether or not it's also delivered to a regular endpoint.
+type RawTransportEndpoint interface {
+	// HandlePacket is called by the stack when a packet of the endpoint's
+	// network and transport protocols arrives. netHeader holds the
+	// network-layer header and vv the rest of the packet. Neither may be
+	// modified, as the packet is also delivered to other endpoints, and
+	// netHeader must be copied to be retained, and vv cloned, as for
+	// TransportEndpoint.HandlePacket.
+	HandlePacket(r *Route, netHeader buffer.View, vv *buffer.VectorisedView)
+}
+
+// PacketEndpoint is the interface that needs to be implemented by packet
+// endpoints, which receive a copy of every packet sent or received by the NICs
+// they're bound to, before it's handled by the network layer.
+type PacketEndpoint interface {
+	// HandlePacket is called by the NIC for each packet of the endpoint's
+	// network protocol it sends or receives. vv holds the network-layer
+	// packet; it may not be modified, and must be copied to be retained.
+	HandlePacket(nicid tcpip.NICID, info tcpip.LinkPacketInfo, vv *buffer.VectorisedView)
+}
+
 // TransportProtocol is the interface that needs to be implemented by transport
 // protocols (e.g., tcp, udp) that want to be part of the networking stack.
 type TransportProtocol interface {
@@ -104,11 +228,27 @@ type TransportDispatcher interface {
 	// transport protocol endpoint.
 	DeliverTransportPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView)
 
+	// DeliverRawPacket delivers a copy of packets to the raw endpoints of
+	// their transport protocol. It must be called before the packet is
+	// delivered with DeliverTransportPacket, which may consume it.
+	DeliverRawPacket(r *Route, protocol tcpip.TransportProtocolNumber, netHeader buffer.View, vv *buffer.VectorisedView)
+
 	// DeliverTransportControlPacket delivers control packets to the
-	// appropriate transport protocol endpoint.
+	// appropriate transport protocol endpoint. local and remote are the
+	// source and destination addresses of the packet quoted by the control
+	// packet, which was sent by the endpoint.
 	DeliverTransportControlPacket(local, remote tcpip.Address, net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ ControlType, extra uint32, vv *buffer.VectorisedView)
 }
 
+// AddressAutoconfigurator is implemented by TransportDispatchers that
+// configure addresses from the prefixes advertised by routers, as described in
+// RFC 4862.
+type AddressAutoconfigurator interface {
+	// AutoconfigurePrefix handles a prefix advertised for autonomous
+	// address configuration, valid and preferred for the given lifetimes.
+	AutoconfigurePrefix(protocol tcpip.NetworkProtocolNumber, prefix tcpip.Subnet, validLifetime, preferredLifetime time.Duration)
+}
+
 // NetworkEndpoint is the interface that needs to be implemented by endpoints
 // of network layer protocols (e.g., ipv4, ipv6).
 type NetworkEndpoint interface {
@@ -128,8 +268,14 @@ type NetworkEndpoint interface {
 	MaxHeaderLength() uint16
 
 	// WritePacket writes a packet to the given destination address and
-	// protocol.
-	WritePacket(r *Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error
+	// protocol. If csum is not nil, the transport checksum of the packet
+	// is only partially computed; the network endpoint must either pass
+	// csum down to a link endpoint that supports
+	// CapabilityTXChecksumOffload or complete the checksum itself.
+	//
+	// hdr and payload are only borrowed for the duration of the call, as
+	// by LinkEndpoint.WritePacket.
+	WritePacket(r *Route, csum *PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error
 
 	// ID returns the network protocol endpoint ID.
 	ID() *NetworkEndpointID
@@ -138,7 +284,8 @@ type NetworkEndpoint interface {
 	NICID() tcpip.NICID
 
 	// HandlePacket is called by the link layer when new packets arrive to
-	// this network endpoint.
+	// this network endpoint. r and vv are only borrowed for the duration
+	// of the call, as for TransportEndpoint.HandlePacket.
 	HandlePacket(r *Route, vv *buffer.VectorisedView)
 
 	// Close is called when the endpoint is reomved from a stack.
@@ -180,7 +327,78 @@ type NetworkProtocol interface {
 type NetworkDispatcher interface {
 	// DeliverNetworkPacket finds the appropriate network protocol
 	// endpoint and hands the packet over for further processing.
-	DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView)
+	//
+	// checksumValidated indicates that the link endpoint (or the device
+	// behind it) has already verified the transport checksum of the
+	// packet, so transport protocols don't need to verify it again.
+	//
+	// The stack only borrows vv for the duration of the call, and takes
+	// references to its PacketBuffer to keep its views. Link endpoints may
+	// reuse the memory of a packet once its PacketBuffer is released; that
+	// of packets without a PacketBuffer must never be reused, as the stack
+	// may keep it.
+	DeliverNetworkPacket(linkEP LinkEndpoint, remoteLinkAddr tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool)
+}
+
+// FrameDispatcher is an optional interface implemented by network dispatchers
+// that take the destination link address of inbound frames into account, e.g.,
+// to bridge the frames that aren't sent to the NIC. Link endpoints that know
+// the link addresses of the frames they receive deliver them with
+// DeliverFrame.
+type FrameDispatcher interface {
+	NetworkDispatcher
+
+	// DeliverFrame is like DeliverNetworkPacket, for a frame sent from
+	// the src link address to the dst one.
+	DeliverFrame(linkEP LinkEndpoint, src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool)
+}
+
+// DeliverFrame delivers an inbound frame sent from the src link address to the
+// dst one to the given dispatcher, with FrameDispatcher.DeliverFrame if it
+// implements it, or DeliverNetworkPacket otherwise.
+func DeliverFrame(d NetworkDispatcher, linkEP LinkEndpoint, src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView, checksumValidated bool) {
+	if fd, ok := d.(FrameDispatcher); ok {
+		fd.DeliverFrame(linkEP, src, dst, protocol, vv, checksumValidated)
+		return
+	}
+	d.DeliverNetworkPacket(linkEP, src, protocol, vv, checksumValidated)
+}
+
+// InboundPacket is a packet received by a link endpoint, as delivered in a
+// batch by BatchNetworkDispatcher.DeliverNetworkPackets. Its fields are the
+// arguments of NetworkDispatcher.DeliverNetworkPacket.
+type InboundPacket struct {
+	RemoteLinkAddress tcpip.LinkAddress
+	Protocol          tcpip.NetworkProtocolNumber
+	VV                buffer.VectorisedView
+	ChecksumValidated bool
+}
+
+// BatchNetworkDispatcher is an optional interface implemented by network
+// dispatchers that deliver the packets a link endpoint receives together, e.g.,
+// those read by a single system call, as a batch. The work shared by the
+// packets is then done once per batch, e.g., looking up the network endpoint
+// they're sent to.
+type BatchNetworkDispatcher interface {
+	NetworkDispatcher
+
+	// DeliverNetworkPackets is like DeliverNetworkPacket, for several
+	// packets. The stack only borrows them, and their views, for the
+	// duration of the call.
+	DeliverNetworkPackets(linkEP LinkEndpoint, pkts []InboundPacket)
+}
+
+// DeliverNetworkPackets delivers the packets received by linkEP with d, as a
+// batch if d is a BatchNetworkDispatcher, one by one otherwise.
+func DeliverNetworkPackets(d NetworkDispatcher, linkEP LinkEndpoint, pkts []InboundPacket) {
+	if bd, ok := d.(BatchNetworkDispatcher); ok {
+		bd.DeliverNetworkPackets(linkEP, pkts)
+		return
+	}
+	for i := range pkts {
+		p := &pkts[i]
+		d.DeliverNetworkPacket(linkEP, p.RemoteLinkAddress, p.Protocol, &p.VV, p.ChecksumValidated)
+	}
 }
 
 // LinkEndpointCapabilities is the type associated with the capabilities
@@ -191,8 +409,46 @@ type LinkEndpointCapabilities uint
 const (
 	CapabilityChecksumOffload LinkEndpointCapabilities = 1 << iota
 	CapabilityResolutionRequired
+	CapabilityTXChecksumOffload
+
+	// CapabilityRXChecksumOffload indicates that the link validates the
+	// checksums of all received packets, so the stack doesn't verify them
+	// again, whatever the link passes to DeliverNetworkPacket.
+	CapabilityRXChecksumOffload
+
+	// CapabilityLoopback indicates that the link loops the packets sent
+	// through it back to the stack.
+	CapabilityLoopback
 )
 
+// checksumOffloadCapabilities are the capabilities that let the stack skip
+// computing or verifying checksums.
+const checksumOffloadCapabilities = CapabilityChecksumOffload | CapabilityTXChecksumOffload | CapabilityRXChecksumOffload
+
+// PartialChecksum holds the information link endpoints need to complete the
+// transport checksum of an outbound packet. Transport endpoints only produce
+// such packets when the route advertises CapabilityTXChecksumOffload; in that
+// case the checksum field holds the pseudo-header checksum (including the
+// length), and the rest is left to the link endpoint or the device behind it.
+type PartialChecksum struct {
+	// TransportOffset is the offset of the transport header from the start
+	// of the network header. It is filled in by network endpoints.
+	TransportOffset uint16
+
+	// ChecksumOffset is the offset of the checksum field from the start of
+	// the transport header.
+	ChecksumOffset uint16
+}
+
+// Complete finishes computing the transport checksum in software. transport
+// must start at the transport header, and payload holds the remainder of the
+// transport segment.
+func (c *PartialChecksum) Complete(transport []byte, payload buffer.View) {
+	xsum := header.Checksum(transport, 0)
+	xsum = header.Checksum(payload, xsum)
+	binary.BigEndian.PutUint16(transport[c.ChecksumOffset:], ^xsum)
+}
+
 // LinkEndpoint is the interface implemented by data link layer protocols (e.g.,
 // ethernet, loopback, raw) and used by network layer protocols to send packets
 // out through the implementer's data link endpoint.
@@ -218,14 +474,76 @@ type LinkEndpoint interface {
 	LinkAddress() tcpip.LinkAddress
 
 	// WritePacket writes a packet with the given protocol through the given
-	// route.
-	WritePacket(r *Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error
+	// route. csum is only ever non-nil for endpoints that advertise
+	// CapabilityTXChecksumOffload, in which case the endpoint is
+	// responsible for completing the transport checksum.
+	//
+	// The endpoint only borrows hdr for the duration of the call: its
+	// memory may be reused for another packet as soon as the call returns,
+	// so endpoints that write packets synchronously, e.g., with a system
+	// call, need nothing more. Endpoints that keep the headers afterwards,
+	// e.g., to write them later or to deliver the packet to a stack, either
+	// copy them, or take a reference to hdr.Buffer() if it isn't nil and
+	// release it once done with them. hdr.ToVectorisedView builds packets
+	// to deliver to a stack. The memory of payload is never reused.
+	WritePacket(r *Route, csum *PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error
 
 	// Attach attaches the data link layer endpoint to the network-layer
 	// dispatcher of the stack.
 	Attach(dispatcher NetworkDispatcher)
 }
 
+// MulticastLinkEndpoint is an extension to LinkEndpoint implemented by link
+// endpoints that only receive frames sent to multicast link addresses they
+// have been told about. NICs program the filters of such endpoints as
+// multicast groups are joined and left. Endpoints that receive all the frames
+// of their link, such as loopback and sharedmem endpoints, don't implement it.
+type MulticastLinkEndpoint interface {
+	LinkEndpoint
+
+	// AddMulticastFilter starts accepting frames sent to the given
+	// multicast link address.
+	AddMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error
+
+	// RemoveMulticastFilter stops accepting frames sent to the given
+	// multicast link address.
+	RemoveMulticastFilter(addr tcpip.LinkAddress) *tcpip.Error
+}
+
+// LinkAddressSetter is an extension to LinkEndpoint implemented by link
+// endpoints whose link address can be changed at runtime.
+type LinkAddressSetter interface {
+	LinkEndpoint
+
+	// SetLinkAddress changes the link address of the endpoint. Packets
+	// written after it returns use addr as their source link address.
+	SetLinkAddress(addr tcpip.LinkAddress) *tcpip.Error
+}
+
+// LinkMTUSetter is an extension to LinkEndpoint implemented by link endpoints
+// whose MTU can be changed at runtime, e.g. to follow the MTU of the device
+// they're backed by.
+type LinkMTUSetter interface {
+	LinkEndpoint
+
+	// SetMTU changes the MTU of the endpoint. Packets received after it
+	// returns may be as large as the new MTU.
+	SetMTU(mtu uint32) *tcpip.Error
+}
+
+// LinkEndpointCloser is an extension to LinkEndpoint implemented by link
+// endpoints that hold resources, such as goroutines reading from a file
+// descriptor, that must be released when the endpoint is no longer used.
+type LinkEndpointCloser interface {
+	LinkEndpoint
+
+	// Close stops the delivery of inbound packets, and waits for the
+	// packets being delivered to be done with before returning. Packets
+	// written afterwards are dropped with tcpip.ErrClosedForSend. Close
+	// must not be called while delivering a packet from the endpoint.
+	Close()
+}
+
 // A LinkAddressResolver is an extension to a NetworkProtocol that
 // can resolve link addresses.
 type LinkAddressResolver interface {
@@ -248,6 +566,21 @@ type LinkAddressResolver interface {
 	LinkAddressProtocol() tcpip.NetworkProtocolNumber
 }
 
+// DuplicateAddressDetector is implemented by LinkAddressResolvers that can
+// detect conflicting uses of an address on the local network, as described in
+// RFC 5227.
+//
+// Network endpoints of the discovery protocol are expected to call
+// AddressConflict when they see another host using an address.
+type DuplicateAddressDetector interface {
+	// LinkAddressProbe sends a probe on linkEP asking whether any other
+	// host uses addr.
+	LinkAddressProbe(addr tcpip.Address, linkEP LinkEndpoint) *tcpip.Error
+
+	// LinkAddressAnnounce announces on linkEP that addr is now in use.
+	LinkAddressAnnounce(addr tcpip.Address, linkEP LinkEndpoint) *tcpip.Error
+}
+
 // A LinkAddressCache caches link addresses.
 type LinkAddressCache interface {
 	// CheckLocalAddress determines if the given local address exists, and if it
@@ -257,6 +590,11 @@ type LinkAddressCache interface {
 	// AddLinkAddress adds a link address to the cache.
 	AddLinkAddress(nicid tcpip.NICID, addr tcpip.Address, linkAddr tcpip.LinkAddress)
 
+	// AddressConflict reports that another host on the local network of
+	// the given NIC uses addr. If duplicate address detection is in
+	// progress for addr, the address is abandoned.
+	AddressConflict(nicid tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address)
+
 	// GetLinkAddress looks up the cache to translate address to link address (e.g. IP -> MAC).
 	// If the LinkEndpoint requests address resolution and there is a LinkAddressResolver
 	// registered with the network protocol, the cache attempts to resolve the address
@@ -272,13 +610,22 @@ type LinkAddressCache interface {
 // transport protocols.
 type TransportProtocolFactory func() TransportProtocol
 
+// RawEndpointFactory functions are used by the stack to create raw endpoints.
+type RawEndpointFactory func(stack *Stack, netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error)
+
+// PacketEndpointFactory functions are used by the stack to create packet
+// endpoints.
+type PacketEndpointFactory func(stack *Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error)
+
 // NetworkProtocolFactory provides methods to be used by the stack to
 // instantiate network protocols.
 type NetworkProtocolFactory func() NetworkProtocol
 
 var (
-	transportProtocols = make(map[string]TransportProtocolFactory)
-	networkProtocols   = make(map[string]NetworkProtocolFactory)
+	transportProtocols    = make(map[string]TransportProtocolFactory)
+	networkProtocols      = make(map[string]NetworkProtocolFactory)
+	rawEndpointFactory    RawEndpointFactory
+	packetEndpointFactory PacketEndpointFactory
 
 	linkEPMu           sync.RWMutex
 	nextLinkEndpointID tcpip.LinkEndpointID = 1
@@ -299,6 +646,20 @@ func RegisterNetworkProtocolFactory(name string, p NetworkProtocolFactory) {
 	networkProtocols[name] = p
 }
 
+// RegisterRawEndpointFactory registers the factory used by Stack.NewRawEndpoint
+// to create raw endpoints. This function is intended to be called by the init()
+// function of the raw endpoint implementation.
+func RegisterRawEndpointFactory(f RawEndpointFactory) {
+	rawEndpointFactory = f
+}
+
+// RegisterPacketEndpointFactory registers the factory used by
+// Stack.NewPacketEndpoint to create packet endpoints. This function is intended
+// to be called by the init() function of the packet endpoint implementation.
+func RegisterPacketEndpointFactory(f PacketEndpointFactory) {
+	packetEndpointFactory = f
+}
+
 // RegisterLinkEndpoint register a link-layer protocol endpoint and returns an
 // ID that can be used to refer to it.
 func RegisterLinkEndpoint(linkEP LinkEndpoint) tcpip.LinkEndpointID {
@@ -5,6 +5,8 @@
 package stack
 
 import (
+	"sync/atomic"
+
 	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
@@ -33,9 +35,45 @@ type Route struct {
 	// NetProto is the network-layer protocol.
 	NetProto tcpip.NetworkProtocolNumber
 
+	// FlowLabel is the IPv6 flow label of packets sent through the route.
+	// Zero lets the network endpoint compute one for each flow.
+	FlowLabel uint32
+
+	// TOS is the IPv4 type of service, or the IPv6 traffic class, of packets
+	// sent through the route.
+	TOS uint8
+
+	// TTL is the IPv4 time to live, or the IPv6 hop limit, of packets sent
+	// through the route. Zero stands for the tcpip.DefaultTTLOption of the
+	// network protocol.
+	TTL uint8
+
+	// Priority is the tcpip.PriorityOption of the endpoint sending packets
+	// through the route, for link endpoints that schedule them.
+	Priority uint8
+
+	// ChecksumValidated is only meaningful for routes of inbound packets.
+	// It indicates that the transport checksum of the packet was already
+	// verified by the link endpoint that received it.
+	ChecksumValidated bool
+
+	// loop is set on routes to one of the stack's own addresses. Packets
+	// written through them are delivered locally instead of being sent
+	// out.
+	loop bool
+
 	// ref a reference to the network endpoint through which the route
 	// starts.
 	ref *referencedNetworkEndpoint
+
+	// generation is the route generation of the stack when the route was
+	// made, see IsValid.
+	generation uint64
+
+	// batch is set on the routes of inbound packets delivered as part of
+	// a batch, to queue them for the transport endpoints that handle
+	// batches.
+	batch *deliveryBatch
 }
 
 // makeRoute initializes a new route. It takes ownership of the provided
@@ -46,6 +84,7 @@ func makeRoute(netProto tcpip.NetworkProtocolNumber, localAddr, remoteAddr tcpip
 		LocalAddress:  localAddr,
 		RemoteAddress: remoteAddr,
 		ref:           ref,
+		generation:    atomic.LoadUint64(&ref.nic.stack.routeGeneration),
 	}
 }
 
@@ -59,15 +98,29 @@ func (r *Route) MaxHeaderLength() uint16 {
 	return r.ref.ep.MaxHeaderLength()
 }
 
+// NewHeader returns a buffer to build the headers of a packet sent through r
+// into, with room for reserve bytes of transport headers on top of those of the
+// lower layers. Its memory is recycled once the packet is written, so it must
+// be released with Release after the call to WritePacket.
+func (r *Route) NewHeader(reserve int) buffer.Prependable {
+	return r.ref.nic.headers.NewPrependable(reserve + int(r.MaxHeaderLength()))
+}
+
 // PseudoHeaderChecksum forwards the call to the network endpoint's
 // implementation.
 func (r *Route) PseudoHeaderChecksum(protocol tcpip.TransportProtocolNumber) uint16 {
 	return header.PseudoHeaderChecksum(protocol, r.LocalAddress, r.RemoteAddress)
 }
 
-// Capabilities returns the link-layer capabilities of the route.
+// Capabilities returns the link-layer capabilities of the route. Routes that
+// loop packets back to the stack don't offer checksum offloads when
+// Stack.SetLoopbackChecksums is enabled.
 func (r *Route) Capabilities() LinkEndpointCapabilities {
-	return r.ref.ep.Capabilities()
+	caps := r.ref.ep.Capabilities()
+	if (r.loop || caps&CapabilityLoopback != 0) && r.ref.nic.stack.LoopbackChecksums() {
+		caps &^= checksumOffloadCapabilities
+	}
+	return caps
 }
 
 // Resolve attempts to resolve the link address if necessary. Returns ErrWouldBlock in
@@ -104,12 +157,39 @@ func (r *Route) RemoveWaker(waker *sleep.Waker) {
 // IsResolutionRequired returns true if Resolve() must be called to resolve
 // the link address before the this route can be written to.
 func (r *Route) IsResolutionRequired() bool {
-	return r.ref.linkCache != nil && r.RemoteLinkAddress == ""
+	return !r.loop && r.ref.linkCache != nil && r.RemoteLinkAddress == ""
+}
+
+// WritePacket writes the packet through the given route. csum must be nil
+// unless the transport checksum was only partially computed, see
+// PartialChecksum.
+func (r *Route) WritePacket(csum *PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error {
+	err := r.ref.ep.WritePacket(r, csum, hdr, payload, protocol)
+	if err != nil {
+		r.Stats().IP.OutgoingPacketErrors.Increment()
+	} else {
+		r.Stats().IP.PacketsSent.Increment()
+	}
+	return err
+}
+
+// Stats returns the stats of the stack the route belongs to, so that protocols
+// can increment them. Routes built outside of a stack, e.g., by tests, get
+// stats that are discarded.
+func (r *Route) Stats() *tcpip.Stats {
+	if r.ref == nil {
+		return &tcpip.Stats{}
+	}
+	return &r.ref.nic.stack.stats
 }
 
-// WritePacket writes the packet through the given route.
-func (r *Route) WritePacket(hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error {
-	return r.ref.ep.WritePacket(r, hdr, payload, protocol)
+// WriteHeaderIncludedPacket writes a packet that already holds its
+// network-layer header through the given route, bypassing the network
+// endpoint.
+func (r *Route) WriteHeaderIncludedPacket(payload buffer.View) *tcpip.Error {
+	linkEP := r.ref.nic.tapEP
+	hdr := buffer.NewPrependable(int(linkEP.MaxHeaderLength()))
+	return linkEP.WritePacket(r, nil, &hdr, payload, r.NetProto)
 }
 
 // MTU returns the MTU of the underlying network endpoint.
@@ -117,6 +197,38 @@ func (r *Route) MTU() uint32 {
 	return r.ref.ep.MTU()
 }
 
+// IsValid returns whether neither the route table nor the addresses of the
+// stack's NICs have changed since the route was made, so that it's still the
+// route FindRoute would return. It's cheap enough to be checked before every
+// packet sent through a cached route.
+func (r *Route) IsValid() bool {
+	return r.ref != nil && atomic.LoadUint64(&r.ref.nic.stack.routeGeneration) == r.generation
+}
+
+// Refresh replaces r, which is no longer valid, with the route FindRoute finds
+// from its local address to its remote address, leaving through the given NIC
+// if not zero. FlowLabel, TOS, TTL and Priority are kept. If the remote address can't be
+// reached from the local address anymore, r is left as is and an error is
+// returned.
+//
+// The link address of the new route may need to be resolved.
+func (r *Route) Refresh(nicid tcpip.NICID) *tcpip.Error {
+	if r.ref == nil {
+		return tcpip.ErrNoRoute
+	}
+	nr, err := r.ref.nic.stack.FindRoute(nicid, r.LocalAddress, r.RemoteAddress, r.NetProto)
+	if err != nil {
+		return err
+	}
+	nr.FlowLabel = r.FlowLabel
+	nr.TOS = r.TOS
+	nr.TTL = r.TTL
+	nr.Priority = r.Priority
+	r.Release()
+	*r = nr
+	return nil
+}
+
 // Release frees all resources associated with the route.
 func (r *Route) Release() {
 	if r.ref != nil {
@@ -128,6 +240,10 @@ func (r *Route) Release() {
 // Clone Clone a route such that the original one can be released and the new
 // one will remain valid.
 func (r *Route) Clone() Route {
-	r.ref.incRef()
-	return *r
+	if r.ref != nil {
+		r.ref.incRef()
+	}
+	c := *r
+	c.batch = nil
+	return c
 }
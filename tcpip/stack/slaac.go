@@ -0,0 +1,431 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// SLAACConfig holds the parameters of stateless address autoconfiguration, as
+// described in RFC 4862.
+type SLAACConfig struct {
+	// TempAddresses enables temporary addresses, as described in RFC 4941.
+	// Besides the address formed from the link address, an address with a
+	// random interface identifier is then generated for each prefix. It
+	// is preferred as the source address of new connections, and replaced
+	// by a new one before it gets deprecated.
+	TempAddresses bool
+
+	// TempValidLifetime and TempPreferredLifetime bound the lifetimes of
+	// temporary addresses.
+	TempValidLifetime     time.Duration
+	TempPreferredLifetime time.Duration
+
+	// RegenAdvance is how long before a temporary address is deprecated
+	// its replacement is generated.
+	RegenAdvance time.Duration
+
+	// MaxDesyncFactor bounds the random time by which the preferred
+	// lifetime of temporary addresses is shortened, so that hosts don't
+	// regenerate them all at once.
+	MaxDesyncFactor time.Duration
+}
+
+// DefaultSLAACConfig is the stateless address autoconfiguration configuration
+// with the lifetimes recommended by RFC 4941. Temporary addresses are disabled.
+var DefaultSLAACConfig = SLAACConfig{
+	TempValidLifetime:     7 * 24 * time.Hour,
+	TempPreferredLifetime: 24 * time.Hour,
+	RegenAdvance:          5 * time.Second,
+	MaxDesyncFactor:       10 * time.Minute,
+}
+
+const (
+	// slaacMinValidLifetime is the valid lifetime that router
+	// advertisements can't shorten the lifetime of a prefix below, as per
+	// RFC 4862 section 5.5.3 (e).
+	slaacMinValidLifetime = 2 * time.Hour
+
+	// slaacTempAttempts is the number of random interface identifiers that
+	// are tried to generate a temporary address.
+	slaacTempAttempts = 3
+)
+
+// slaacState holds the state of stateless address autoconfiguration of a NIC.
+// It is protected by the NIC's mutex.
+type slaacState struct {
+	config SLAACConfig
+
+	// desyncFactor is the time by which the preferred lifetime of
+	// temporary addresses is shortened. It's drawn once, when
+	// autoconfiguration is enabled.
+	desyncFactor time.Duration
+
+	prefixes map[tcpip.Subnet]*slaacPrefix
+}
+
+// slaacPrefix holds the state of a prefix addresses are autoconfigured from.
+// Times are in nanoseconds of the stack's clock, math.MaxInt64 standing for
+// an infinite lifetime.
+type slaacPrefix struct {
+	subnet         tcpip.Subnet
+	validUntil     int64
+	preferredUntil int64
+
+	// addrs holds the addresses formed from the prefix: the one formed
+	// from the link address if any, then the temporary ones, oldest first.
+	addrs []*slaacAddress
+}
+
+// slaacAddress holds the state of an autoconfigured address.
+type slaacAddress struct {
+	addr      tcpip.Address
+	ref       *referencedNetworkEndpoint
+	temporary bool
+
+	created        int64
+	validUntil     int64
+	preferredUntil int64
+
+	// regenerated is set once the replacement of a temporary address has
+	// been generated.
+	regenerated bool
+
+	// removed is set once the address is no longer autoconfigured, so that
+	// its timer stops driving it.
+	removed bool
+
+	// timer expires at the next change of state of the address. It's nil
+	// until the address has a finite lifetime.
+	timer tcpip.Timer
+}
+
+// slaacDeadline returns the time at which a lifetime d starting at now ends.
+func slaacDeadline(now int64, d time.Duration) int64 {
+	if d < 0 {
+		d = 0
+	}
+	if int64(d) > math.MaxInt64-now {
+		return math.MaxInt64
+	}
+	return now + int64(d)
+}
+
+func minTime(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// slaacAddressFrom returns the address made of the 64-bit prefix of sn followed
+// by the interface identifier id.
+func slaacAddressFrom(sn tcpip.Subnet, id [8]byte) tcpip.Address {
+	return sn.ID()[:8] + tcpip.Address(id[:])
+}
+
+// setSLAAC enables stateless address autoconfiguration on n with config, or
+// disables it if config is nil. The addresses autoconfigured before are
+// removed.
+func (n *NIC) setSLAAC(config *SLAACConfig) *tcpip.Error {
+	n.mu.Lock()
+	old := n.slaac
+	n.slaac = nil
+	if config != nil {
+		n.slaac = &slaacState{
+			config:       *config,
+			desyncFactor: randomDelay(n.stack.rand, 0, config.MaxDesyncFactor),
+			prefixes:     make(map[tcpip.Subnet]*slaacPrefix),
+		}
+	}
+	var addrs []tcpip.Address
+	if old != nil {
+		for _, p := range old.prefixes {
+			for _, a := range p.addrs {
+				n.dropSLAACAddressLocked(a)
+				addrs = append(addrs, a.addr)
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	for _, addr := range addrs {
+		n.RemoveAddress(addr)
+	}
+
+	// Router advertisements are sent to all the nodes of the link.
+	switch {
+	case old == nil && config != nil:
+		return n.JoinGroup(header.IPv6ProtocolNumber, header.IPv6AllNodesMulticastAddress)
+	case old != nil && config == nil:
+		return n.LeaveGroup(header.IPv6ProtocolNumber, header.IPv6AllNodesMulticastAddress)
+	}
+	return nil
+}
+
+// AutoconfigurePrefix implements AddressAutoconfigurator.AutoconfigurePrefix.
+func (n *NIC) AutoconfigurePrefix(protocol tcpip.NetworkProtocolNumber, prefix tcpip.Subnet, validLifetime, preferredLifetime time.Duration) {
+	// Addresses are formed from 64-bit interface identifiers, so only /64
+	// prefixes are usable. Link-local addresses aren't autoconfigured from
+	// advertisements.
+	if protocol != header.IPv6ProtocolNumber || prefix.Prefix() != 64 || header.IsV6LinkLocalAddress(prefix.ID()) || preferredLifetime > validLifetime {
+		return
+	}
+
+	n.mu.Lock()
+	s := n.slaac
+	if s == nil {
+		n.mu.Unlock()
+		return
+	}
+
+	now := n.stack.NowNanoseconds()
+	if p := s.prefixes[prefix]; p != nil {
+		n.updateSLAACPrefixLocked(s, p, now, validLifetime, preferredLifetime)
+	} else if validLifetime > 0 {
+		p := &slaacPrefix{
+			subnet:         prefix,
+			validUntil:     slaacDeadline(now, validLifetime),
+			preferredUntil: slaacDeadline(now, preferredLifetime),
+		}
+		if linkAddr := n.link().LinkAddress(); len(linkAddr) == header.EthernetAddressSize {
+			n.addSLAACAddressLocked(s, p, slaacAddressFrom(prefix, header.EthernetAddressToEUI64(linkAddr)), false, now, p.validUntil, p.preferredUntil)
+		}
+		if s.config.TempAddresses {
+			n.addTempAddressLocked(s, p, now)
+		}
+		if len(p.addrs) != 0 {
+			s.prefixes[prefix] = p
+		}
+	}
+	n.mu.Unlock()
+
+	n.stack.invalidateRoutes()
+}
+
+// relinkSLAAC replaces the autoconfigured addresses formed from the previous
+// link address of n by ones formed from linkAddr, with the same lifetimes.
+// Temporary addresses are kept.
+func (n *NIC) relinkSLAAC(linkAddr tcpip.LinkAddress) {
+	n.mu.Lock()
+	s := n.slaac
+	if s == nil {
+		n.mu.Unlock()
+		return
+	}
+	now := n.stack.NowNanoseconds()
+	var removed []tcpip.Address
+	for _, p := range s.prefixes {
+		if len(p.addrs) != 0 && !p.addrs[0].temporary {
+			a := p.addrs[0]
+			n.dropSLAACAddressLocked(a)
+			p.addrs = p.addrs[1:]
+			removed = append(removed, a.addr)
+		}
+		if len(linkAddr) != header.EthernetAddressSize {
+			continue
+		}
+		addr := slaacAddressFrom(p.subnet, header.EthernetAddressToEUI64(linkAddr))
+		if n.addSLAACAddressLocked(s, p, addr, false, now, p.validUntil, p.preferredUntil) {
+			// The address formed from the link address comes first.
+			a := p.addrs[len(p.addrs)-1]
+			copy(p.addrs[1:], p.addrs[:len(p.addrs)-1])
+			p.addrs[0] = a
+		}
+	}
+	n.mu.Unlock()
+
+	for _, addr := range removed {
+		n.RemoveAddress(addr)
+	}
+	n.stack.invalidateRoutes()
+}
+
+// updateSLAACPrefixLocked updates the lifetimes of p and its addresses from a
+// new advertisement of the prefix, and generates a temporary address if there
+// is no preferred one left.
+//
+// Precondition: n.mu must be write-locked.
+func (n *NIC) updateSLAACPrefixLocked(s *slaacState, p *slaacPrefix, now int64, validLifetime, preferredLifetime time.Duration) {
+	// Advertisements can only shorten the valid lifetime down to
+	// slaacMinValidLifetime, so that spoofed ones can't invalidate the
+	// addresses at once.
+	validUntil := slaacDeadline(now, validLifetime)
+	switch {
+	case validLifetime > slaacMinValidLifetime || validUntil > p.validUntil:
+		p.validUntil = validUntil
+	case p.validUntil-now > int64(slaacMinValidLifetime):
+		p.validUntil = now + int64(slaacMinValidLifetime)
+	}
+	p.preferredUntil = minTime(slaacDeadline(now, preferredLifetime), p.validUntil)
+
+	preferredTemp := false
+	for _, a := range p.addrs {
+		if a.temporary {
+			// Temporary addresses keep their own lifetimes, bounded by
+			// the prefix's.
+			a.validUntil = minTime(slaacDeadline(a.created, s.config.TempValidLifetime), p.validUntil)
+			a.preferredUntil = minTime(slaacDeadline(a.created, s.config.TempPreferredLifetime-s.desyncFactor), p.preferredUntil)
+			if !a.ref.deprecated && now < a.preferredUntil {
+				preferredTemp = true
+			}
+		} else {
+			a.validUntil = p.validUntil
+			a.preferredUntil = p.preferredUntil
+			if now < a.preferredUntil {
+				a.ref.deprecated = false
+			}
+		}
+		n.scheduleSLAACLocked(s, p, a, now)
+	}
+
+	if s.config.TempAddresses && !preferredTemp {
+		n.addTempAddressLocked(s, p, now)
+	}
+}
+
+// addTempAddressLocked generates a temporary address from p, as described in
+// RFC 4941 section 3.3. No address is generated if it wouldn't be preferred for
+// longer than RegenAdvance.
+//
+// Precondition: n.mu must be write-locked.
+func (n *NIC) addTempAddressLocked(s *slaacState, p *slaacPrefix, now int64) {
+	validUntil := minTime(slaacDeadline(now, s.config.TempValidLifetime), p.validUntil)
+	preferredUntil := minTime(slaacDeadline(now, s.config.TempPreferredLifetime-s.desyncFactor), p.preferredUntil)
+	if preferredUntil-now <= int64(s.config.RegenAdvance) {
+		return
+	}
+
+	for i := 0; i < slaacTempAttempts; i++ {
+		var id [8]byte
+		binary.BigEndian.PutUint32(id[:], n.stack.rand.Uint32())
+		binary.BigEndian.PutUint32(id[4:], n.stack.rand.Uint32())
+		// The identifier isn't globally unique.
+		id[0] &^= 0x02
+		if n.addSLAACAddressLocked(s, p, slaacAddressFrom(p.subnet, id), true, now, validUntil, preferredUntil) {
+			return
+		}
+	}
+}
+
+// addSLAACAddressLocked adds addr to n as an address autoconfigured from p. It
+// returns false if n already has the address.
+//
+// Precondition: n.mu must be write-locked.
+func (n *NIC) addSLAACAddressLocked(s *slaacState, p *slaacPrefix, addr tcpip.Address, temporary bool, now, validUntil, preferredUntil int64) bool {
+	ref, err := n.addAddressLocked(header.IPv6ProtocolNumber, addr, false)
+	if err != nil {
+		return false
+	}
+	ref.prefixLen = p.subnet.Prefix()
+	if temporary {
+		// Temporary addresses are preferred as source addresses, the
+		// newest first.
+		l := n.primary[ref.protocol]
+		l.Remove(ref)
+		l.PushFront(ref)
+	}
+
+	a := &slaacAddress{
+		addr:           addr,
+		ref:            ref,
+		temporary:      temporary,
+		created:        now,
+		validUntil:     validUntil,
+		preferredUntil: preferredUntil,
+	}
+	p.addrs = append(p.addrs, a)
+	n.scheduleSLAACLocked(s, p, a, now)
+	return true
+}
+
+// scheduleSLAACLocked sets the timer of a to expire at its next change of
+// state: its regeneration, deprecation or invalidation.
+//
+// Precondition: n.mu must be write-locked.
+func (n *NIC) scheduleSLAACLocked(s *slaacState, p *slaacPrefix, a *slaacAddress, now int64) {
+	next := a.validUntil
+	if !a.ref.deprecated {
+		next = minTime(next, a.preferredUntil)
+	}
+	if a.temporary && !a.regenerated && a.preferredUntil != math.MaxInt64 {
+		next = minTime(next, a.preferredUntil-int64(s.config.RegenAdvance))
+	}
+
+	if next == math.MaxInt64 {
+		if a.timer != nil {
+			a.timer.Stop()
+		}
+		return
+	}
+
+	d := time.Duration(next - now)
+	if d < 0 {
+		d = 0
+	}
+	if a.timer == nil {
+		a.timer = n.stack.AfterFunc(d, func() {
+			n.slaacTimerExpired(p, a)
+		})
+	} else {
+		a.timer.Reset(d)
+	}
+}
+
+// slaacTimerExpired drives the lifetime of a.
+func (n *NIC) slaacTimerExpired(p *slaacPrefix, a *slaacAddress) {
+	n.mu.Lock()
+	if a.removed {
+		n.mu.Unlock()
+		return
+	}
+	s := n.slaac
+	now := n.stack.NowNanoseconds()
+
+	if now >= a.validUntil {
+		n.dropSLAACAddressLocked(a)
+		for i, b := range p.addrs {
+			if b == a {
+				p.addrs = append(p.addrs[:i], p.addrs[i+1:]...)
+				break
+			}
+		}
+		if len(p.addrs) == 0 {
+			delete(s.prefixes, p.subnet)
+		}
+		n.mu.Unlock()
+
+		n.RemoveAddress(a.addr)
+		return
+	}
+
+	if a.temporary && !a.regenerated && now >= a.preferredUntil-int64(s.config.RegenAdvance) {
+		a.regenerated = true
+		n.addTempAddressLocked(s, p, now)
+	}
+	if now >= a.preferredUntil {
+		a.ref.deprecated = true
+	}
+	n.scheduleSLAACLocked(s, p, a, now)
+	n.mu.Unlock()
+
+	n.stack.invalidateRoutes()
+}
+
+// dropSLAACAddressLocked stops driving the lifetime of a. The address itself
+// is left to the caller to remove.
+//
+// Precondition: n.mu must be write-locked.
+func (n *NIC) dropSLAACAddressLocked(a *slaacAddress) {
+	a.removed = true
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sort"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// Snapshot is a description of the whole stack, as returned by
+// Stack.Snapshot. Addresses are formatted as strings so that snapshots can be
+// serialized, e.g. to JSON.
+type Snapshot struct {
+	// NICs holds the NICs of the stack, sorted by ID.
+	NICs []NICSnapshot
+
+	// Routes is the route table of the stack.
+	Routes []RouteSnapshot
+
+	// Endpoints holds the transport endpoints registered with the stack.
+	Endpoints []EndpointSnapshot
+
+	// Stats holds the counters of the stack.
+	Stats tcpip.Stats
+}
+
+// NICSnapshot is a description of a NIC in a Snapshot.
+type NICSnapshot struct {
+	ID          tcpip.NICID
+	Name        string
+	LinkAddress string
+	Promiscuous bool
+	Forwarding  bool
+	Addresses   []AddressSnapshot
+	Stats       tcpip.NICStats
+}
+
+// AddressSnapshot is a description of an address of a NIC in a Snapshot.
+type AddressSnapshot struct {
+	Protocol tcpip.NetworkProtocolNumber
+	Address  string
+}
+
+// RouteSnapshot is a description of a route in a Snapshot.
+type RouteSnapshot struct {
+	Destination string
+	Mask        string
+	Gateway     string
+	NIC         tcpip.NICID
+}
+
+// EndpointSnapshot is a description of a transport endpoint in a Snapshot.
+type EndpointSnapshot struct {
+	NetworkProtocol   tcpip.NetworkProtocolNumber
+	TransportProtocol tcpip.TransportProtocolNumber
+
+	// NIC is the NIC the endpoint is registered with, or 0 if it is
+	// registered with the whole stack.
+	NIC tcpip.NICID
+
+	LocalAddress  string
+	LocalPort     uint16
+	RemoteAddress string
+	RemotePort    uint16
+
+	// State is the state of the endpoint, if it implements
+	// TransportEndpointStateReporter.
+	State string
+
+	// Draining is true if the endpoint has been closed but is still
+	// registered, see TransportEndpointDrainReporter.
+	Draining bool
+
+	// DrainingFor is how long the endpoint has been draining, if it was
+	// marked with Stack.SetTransportEndpointDraining.
+	DrainingFor time.Duration
+
+	// Listening is true if the endpoint is listening, and reports the
+	// occupancy of its accept queue with
+	// TransportEndpointAcceptQueueReporter. AcceptQueued is then the number
+	// of connections waiting to be accepted, and AcceptBacklog the maximum.
+	Listening     bool
+	AcceptQueued  int
+	AcceptBacklog int
+}
+
+// RegisteredEndpoint is a description of a transport endpoint registered with
+// the stack, as returned by Stack.RegisteredEndpoints.
+type RegisteredEndpoint struct {
+	NetworkProtocol   tcpip.NetworkProtocolNumber
+	TransportProtocol tcpip.TransportProtocolNumber
+
+	// NIC is the NIC the endpoint is registered with, or 0 if it is
+	// registered with the whole stack.
+	NIC tcpip.NICID
+
+	// ID is the ID the endpoint is registered with. Bound endpoints only
+	// have the local part set.
+	ID TransportEndpointID
+
+	// State is the state of the endpoint, if it implements
+	// TransportEndpointStateReporter.
+	State string
+
+	// Draining is true if the endpoint has been closed but is still
+	// registered, see TransportEndpointDrainReporter and
+	// Stack.SetTransportEndpointDraining.
+	Draining bool
+
+	// DrainingFor is how long the endpoint has been draining, if it was
+	// marked with Stack.SetTransportEndpointDraining.
+	DrainingFor time.Duration
+
+	// Listening is true if the endpoint is listening, and reports the
+	// occupancy of its accept queue with
+	// TransportEndpointAcceptQueueReporter. AcceptQueued is then the number
+	// of connections waiting to be accepted, and AcceptBacklog the maximum.
+	Listening     bool
+	AcceptQueued  int
+	AcceptBacklog int
+}
+
+// RegisteredEndpoints returns the transport endpoints registered with the
+// stack, sorted by protocols, NIC and ID, along with the number of them that
+// are draining. An endpoint registered for several network protocols is listed
+// once per protocol.
+//
+// Like Snapshot, the endpoints are only described after the demuxers' locks
+// have been released, so the listing doesn't hold up the delivery of packets,
+// and endpoints may be registered or unregistered while it's being built.
+func (s *Stack) RegisteredEndpoints() ([]RegisteredEndpoint, int) {
+	_, eps := s.registeredEndpoints()
+	return describeEndpoints(eps, s.NowNanoseconds())
+}
+
+// describeEndpoints describes the given endpoints at time now, and counts the
+// ones that are draining. It must be called without holding any demuxer lock,
+// as it calls into the endpoints.
+func describeEndpoints(eps []registeredEndpoint, now int64) ([]RegisteredEndpoint, int) {
+	res := make([]RegisteredEndpoint, 0, len(eps))
+	draining := 0
+	for _, e := range eps {
+		re := RegisteredEndpoint{
+			NetworkProtocol:   e.protocols.network,
+			TransportProtocol: e.protocols.transport,
+			NIC:               e.nic,
+			ID:                e.id,
+		}
+		if r, ok := e.ep.(TransportEndpointStateReporter); ok {
+			re.State = r.State()
+		}
+		if e.marked {
+			re.Draining = true
+			re.DrainingFor = time.Duration(now - e.drainingSince)
+		} else if r, ok := e.ep.(TransportEndpointDrainReporter); ok {
+			re.Draining = r.Draining()
+		}
+		if re.Draining {
+			draining++
+		}
+		if r, ok := e.ep.(TransportEndpointAcceptQueueReporter); ok {
+			re.AcceptQueued, re.AcceptBacklog, re.Listening = r.AcceptQueue()
+		}
+		res = append(res, re)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := &res[i], &res[j]
+		switch {
+		case a.NetworkProtocol != b.NetworkProtocol:
+			return a.NetworkProtocol < b.NetworkProtocol
+		case a.TransportProtocol != b.TransportProtocol:
+			return a.TransportProtocol < b.TransportProtocol
+		case a.NIC != b.NIC:
+			return a.NIC < b.NIC
+		case a.ID.LocalPort != b.ID.LocalPort:
+			return a.ID.LocalPort < b.ID.LocalPort
+		case a.ID.LocalAddress != b.ID.LocalAddress:
+			return a.ID.LocalAddress < b.ID.LocalAddress
+		case a.ID.RemotePort != b.ID.RemotePort:
+			return a.ID.RemotePort < b.ID.RemotePort
+		default:
+			return a.ID.RemoteAddress < b.ID.RemoteAddress
+		}
+	})
+
+	return res, draining
+}
+
+// registeredEndpoints returns the NICs of the stack, sorted by ID, and the
+// transport endpoints registered with the stack and its NICs. Only the
+// demuxers' locks are held while the endpoints are collected, and no endpoint
+// is called into.
+func (s *Stack) registeredEndpoints() ([]*NIC, []registeredEndpoint) {
+	s.mu.RLock()
+	nics := make([]*NIC, 0, len(s.nics))
+	for _, nic := range s.nics {
+		nics = append(nics, nic)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(nics, func(i, j int) bool { return nics[i].id < nics[j].id })
+
+	eps := s.demux.registeredEndpoints(nil, 0)
+	for _, nic := range nics {
+		eps = nic.demux.registeredEndpoints(eps, nic.id)
+	}
+
+	return nics, eps
+}
+
+// Snapshot returns a description of the NICs, routes and transport endpoints
+// of the stack, along with its counters.
+//
+// The stack's mutex is only held while the NICs and routes are copied, and the
+// endpoints are described once the demuxers' locks have been released, so
+// taking a snapshot doesn't hold up the delivery of packets. As a result, the
+// snapshot doesn't represent the state of the stack at any single point in
+// time.
+func (s *Stack) Snapshot() Snapshot {
+	var snap Snapshot
+
+	s.mu.RLock()
+	for _, r := range s.routeTable {
+		snap.Routes = append(snap.Routes, RouteSnapshot{
+			Destination: r.Destination.String(),
+			Mask:        r.Mask.String(),
+			Gateway:     r.Gateway.String(),
+			NIC:         r.NIC,
+		})
+	}
+	s.mu.RUnlock()
+
+	nics, reps := s.registeredEndpoints()
+	for _, nic := range nics {
+		snap.NICs = append(snap.NICs, nic.snapshot())
+	}
+
+	eps, _ := describeEndpoints(reps, s.NowNanoseconds())
+	for _, e := range eps {
+		snap.Endpoints = append(snap.Endpoints, EndpointSnapshot{
+			NetworkProtocol:   e.NetworkProtocol,
+			TransportProtocol: e.TransportProtocol,
+			NIC:               e.NIC,
+			LocalAddress:      e.ID.LocalAddress.String(),
+			LocalPort:         e.ID.LocalPort,
+			RemoteAddress:     e.ID.RemoteAddress.String(),
+			RemotePort:        e.ID.RemotePort,
+			State:             e.State,
+			Draining:          e.Draining,
+			DrainingFor:       e.DrainingFor,
+			Listening:         e.Listening,
+			AcceptQueued:      e.AcceptQueued,
+			AcceptBacklog:     e.AcceptBacklog,
+		})
+	}
+	sort.Slice(snap.Endpoints, func(i, j int) bool {
+		a, b := &snap.Endpoints[i], &snap.Endpoints[j]
+		switch {
+		case a.NetworkProtocol != b.NetworkProtocol:
+			return a.NetworkProtocol < b.NetworkProtocol
+		case a.TransportProtocol != b.TransportProtocol:
+			return a.TransportProtocol < b.TransportProtocol
+		case a.NIC != b.NIC:
+			return a.NIC < b.NIC
+		case a.LocalPort != b.LocalPort:
+			return a.LocalPort < b.LocalPort
+		case a.LocalAddress != b.LocalAddress:
+			return a.LocalAddress < b.LocalAddress
+		case a.RemotePort != b.RemotePort:
+			return a.RemotePort < b.RemotePort
+		default:
+			return a.RemoteAddress < b.RemoteAddress
+		}
+	})
+
+	snap.Stats = s.Stats()
+
+	return snap
+}
+
+// snapshot returns a description of n.
+func (n *NIC) snapshot() NICSnapshot {
+	n.mu.RLock()
+	promiscuous := n.promiscuous
+	forwarding := n.forwarding
+	n.mu.RUnlock()
+
+	ns := NICSnapshot{
+		ID:          n.id,
+		Name:        n.name,
+		LinkAddress: n.link().LinkAddress().String(),
+		Promiscuous: promiscuous,
+		Forwarding:  forwarding,
+		Stats:       n.Stats(),
+	}
+	for _, a := range n.Addresses() {
+		ns.Addresses = append(ns.Addresses, AddressSnapshot{
+			Protocol: a.Protocol,
+			Address:  a.Address.String(),
+		})
+	}
+	sort.Slice(ns.Addresses, func(i, j int) bool {
+		a, b := &ns.Addresses[i], &ns.Addresses[j]
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		return a.Address < b.Address
+	})
+
+	return ns
+}
@@ -0,0 +1,343 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+func TestSnapshot(t *testing.T) {
+	const (
+		loopbackAddr = tcpip.Address("\x7f\x00\x00\x01")
+		ethAddr      = tcpip.Address("\x0a\x00\x00\x01")
+		gateway      = tcpip.Address("\x0a\x00\x00\x02")
+		linkAddr     = tcpip.LinkAddress("\x02\x03\x04\x05\x06\x07")
+		port         = 80
+	)
+
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+	if err := s.CreateNamedNIC(1, "lo", loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, loopbackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	id, _ := channel.New(10, defaultMTU, linkAddr)
+	if err := s.CreateNamedNIC(2, "eth0", id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(2, ipv4.ProtocolNumber, ethAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x7f\x00\x00\x00", Mask: "\xff\x00\x00\x00", NIC: 1},
+		{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Gateway: gateway, NIC: 2},
+	})
+
+	// Set up a TCP listener, connected to over loopback, and a bound UDP
+	// endpoint.
+	var listenWQ waiter.Queue
+	listener, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &listenWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Port: port}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := listener.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	var clientWQ waiter.Queue
+	client, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &clientWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer client.Close()
+
+	we, ch := waiter.NewChannelEntry(nil)
+	listenWQ.EventRegister(&we, waiter.EventIn)
+	defer listenWQ.EventUnregister(&we)
+	if err := client.Connect(tcpip.FullAddress{Addr: loopbackAddr, Port: port}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for connection")
+	}
+	accepted, _, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer accepted.Close()
+	clientAddr, err := client.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress failed: %v", err)
+	}
+
+	var udpWQ waiter.Queue
+	udpEP, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &udpWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer udpEP.Close()
+	if err := udpEP.Bind(tcpip.FullAddress{Addr: ethAddr, Port: 53}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// Wait for the client to see the connection as established too.
+	for client.Readiness(waiter.EventOut) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	snap := s.Snapshot()
+
+	if len(snap.NICs) != 2 {
+		t.Fatalf("got %d NICs, want 2", len(snap.NICs))
+	}
+	for i, want := range []struct {
+		id       tcpip.NICID
+		name     string
+		linkAddr tcpip.LinkAddress
+		addr     tcpip.Address
+	}{
+		{1, "lo", "", loopbackAddr},
+		{2, "eth0", linkAddr, ethAddr},
+	} {
+		nic := snap.NICs[i]
+		if nic.ID != want.id || nic.Name != want.name || nic.LinkAddress != want.linkAddr.String() {
+			t.Errorf("got NIC %+v, want ID %d, Name %q and LinkAddress %q", nic, want.id, want.name, want.linkAddr)
+		}
+		wantAddrs := []stack.AddressSnapshot{{Protocol: ipv4.ProtocolNumber, Address: want.addr.String()}}
+		if !reflect.DeepEqual(nic.Addresses, wantAddrs) {
+			t.Errorf("got NIC %d addresses %+v, want %+v", nic.ID, nic.Addresses, wantAddrs)
+		}
+	}
+	if snap.NICs[0].Stats.RxPackets == 0 {
+		t.Errorf("got no received packets on the loopback NIC")
+	}
+	if got := snap.Stats.TCP.ActiveConnectionOpenings.Value(); got != 1 {
+		t.Errorf("got TCP.ActiveConnectionOpenings = %d, want 1", got)
+	}
+	if got := snap.Stats.TCP.PassiveConnectionOpenings.Value(); got != 1 {
+		t.Errorf("got TCP.PassiveConnectionOpenings = %d, want 1", got)
+	}
+	if snap.Stats.IP.PacketsSent.Value() == 0 || snap.Stats.IP.PacketsReceived.Value() == 0 {
+		t.Errorf("got IP stats %+v, want packets sent and received", snap.Stats.IP)
+	}
+
+	wantRoutes := []stack.RouteSnapshot{
+		{Destination: "127.0.0.0", Mask: "255.0.0.0", Gateway: "", NIC: 1},
+		{Destination: "0.0.0.0", Mask: "0.0.0.0", Gateway: "10.0.0.2", NIC: 2},
+	}
+	if !reflect.DeepEqual(snap.Routes, wantRoutes) {
+		t.Errorf("got routes %+v, want %+v", snap.Routes, wantRoutes)
+	}
+
+	wantEndpoints := []stack.EndpointSnapshot{
+		{
+			NetworkProtocol:   ipv4.ProtocolNumber,
+			TransportProtocol: tcp.ProtocolNumber,
+			LocalPort:         port,
+			State:             "LISTEN",
+			Listening:         true,
+			AcceptBacklog:     10,
+		},
+		{
+			NetworkProtocol:   ipv4.ProtocolNumber,
+			TransportProtocol: tcp.ProtocolNumber,
+			LocalAddress:      loopbackAddr.String(),
+			LocalPort:         clientAddr.Port,
+			RemoteAddress:     loopbackAddr.String(),
+			RemotePort:        port,
+			State:             "CONNECTED",
+		},
+		// Accepted endpoints are registered with the NIC the connection
+		// came through.
+		{
+			NetworkProtocol:   ipv4.ProtocolNumber,
+			TransportProtocol: tcp.ProtocolNumber,
+			NIC:               1,
+			LocalAddress:      loopbackAddr.String(),
+			LocalPort:         port,
+			RemoteAddress:     loopbackAddr.String(),
+			RemotePort:        clientAddr.Port,
+			State:             "CONNECTED",
+		},
+		{
+			NetworkProtocol:   ipv4.ProtocolNumber,
+			TransportProtocol: udp.ProtocolNumber,
+			LocalAddress:      ethAddr.String(),
+			LocalPort:         53,
+			State:             "BOUND",
+		},
+	}
+	if !reflect.DeepEqual(snap.Endpoints, wantEndpoints) {
+		t.Errorf("got endpoints %+v, want %+v", snap.Endpoints, wantEndpoints)
+	}
+
+	if _, err := json.Marshal(snap); err != nil {
+		t.Errorf("json.Marshal failed: %v", err)
+	}
+}
+
+func TestSnapshotEmpty(t *testing.T) {
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	snap := s.Snapshot()
+	if len(snap.NICs) != 0 || len(snap.Routes) != 0 || len(snap.Endpoints) != 0 {
+		t.Fatalf("got snapshot %+v of an empty stack", snap)
+	}
+	if snap.Stats != (tcpip.Stats{}) {
+		t.Fatalf("got stats %+v, want zero", snap.Stats)
+	}
+}
+
+func TestRegisteredEndpoints(t *testing.T) {
+	const (
+		loopbackAddr = tcpip.Address("\x7f\x00\x00\x01")
+		port         = 80
+	)
+
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, loopbackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", NIC: 1},
+	})
+
+	if eps, draining := s.RegisteredEndpoints(); len(eps) != 0 || draining != 0 {
+		t.Fatalf("got RegisteredEndpoints() = %+v, %d, want none", eps, draining)
+	}
+
+	var listenWQ waiter.Queue
+	listener, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &listenWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Port: port}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := listener.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	var clientWQ waiter.Queue
+	client, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &clientWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer client.Close()
+
+	we, ch := waiter.NewChannelEntry(nil)
+	listenWQ.EventRegister(&we, waiter.EventIn)
+	defer listenWQ.EventUnregister(&we)
+	if err := client.Connect(tcpip.FullAddress{Addr: loopbackAddr, Port: port}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for connection")
+	}
+	accepted, _, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer accepted.Close()
+	clientAddr, err := client.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress failed: %v", err)
+	}
+	for client.Readiness(waiter.EventOut) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var udpWQ waiter.Queue
+	udpEP, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &udpWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer udpEP.Close()
+	if err := udpEP.Bind(tcpip.FullAddress{Port: 53}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	clientID := stack.TransportEndpointID{
+		LocalPort:     clientAddr.Port,
+		LocalAddress:  loopbackAddr,
+		RemotePort:    port,
+		RemoteAddress: loopbackAddr,
+	}
+	want := []stack.RegisteredEndpoint{
+		{
+			NetworkProtocol:   ipv4.ProtocolNumber,
+			TransportProtocol: tcp.ProtocolNumber,
+			ID:                stack.TransportEndpointID{LocalPort: port},
+			State:             "LISTEN",
+			Listening:         true,
+			AcceptBacklog:     10,
+		},
+		{
+			NetworkProtocol:   ipv4.ProtocolNumber,
+			TransportProtocol: tcp.ProtocolNumber,
+			ID:                clientID,
+			State:             "CONNECTED",
+		},
+		{
+			NetworkProtocol:   ipv4.ProtocolNumber,
+			TransportProtocol: tcp.ProtocolNumber,
+			NIC:               1,
+			ID: stack.TransportEndpointID{
+				LocalPort:     port,
+				LocalAddress:  loopbackAddr,
+				RemotePort:    clientAddr.Port,
+				RemoteAddress: loopbackAddr,
+			},
+			State: "CONNECTED",
+		},
+		{
+			NetworkProtocol:   ipv4.ProtocolNumber,
+			TransportProtocol: udp.ProtocolNumber,
+			ID:                stack.TransportEndpointID{LocalPort: 53},
+			State:             "BOUND",
+		},
+	}
+	eps, draining := s.RegisteredEndpoints()
+	if !reflect.DeepEqual(eps, want) || draining != 0 {
+		t.Fatalf("got RegisteredEndpoints() = %+v, %d, want %+v, 0", eps, draining, want)
+	}
+
+	// Closing the client leaves it registered until the peer closes its side
+	// of the connection too.
+	client.Close()
+	eps, draining = s.RegisteredEndpoints()
+	if draining != 1 {
+		t.Fatalf("got %d draining endpoints, want 1", draining)
+	}
+	for _, e := range eps {
+		if got, wantDraining := e.Draining, e.ID == clientID; got != wantDraining {
+			t.Errorf("got Draining = %t for endpoint %+v, want %t", got, e, wantDraining)
+		}
+	}
+}
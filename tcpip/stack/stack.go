@@ -40,6 +40,33 @@ const (
 type transportProtocolState struct {
 	proto          TransportProtocol
 	defaultHandler func(*Route, TransportEndpointID, *buffer.VectorisedView) bool
+
+	// stats holds the counters of the protocol, updated atomically.
+	stats tcpip.TransportProtocolStats
+}
+
+// unknownPortHook is a function called with the IDs of packets that match no
+// endpoint, at most once per interval.
+type unknownPortHook struct {
+	mu       sync.Mutex
+	fn       func(tcpip.TransportProtocolNumber, TransportEndpointID)
+	interval int64
+	last     int64
+}
+
+// call calls the hook function, if any, unless it was already called less than
+// an interval ago.
+func (h *unknownPortHook) call(now int64, protocol tcpip.TransportProtocolNumber, id TransportEndpointID) {
+	h.mu.Lock()
+	fn := h.fn
+	if fn == nil || (h.last != 0 && now-h.last < h.interval) {
+		h.mu.Unlock()
+		return
+	}
+	h.last = now
+	h.mu.Unlock()
+
+	fn(protocol, id)
 }
 
 // TCPProbeFunc is the expected function type for a TCP probe function to be
@@ -262,35 +289,114 @@ type Stack struct {
 
 	// route is the route table passed in by the user via SetRouteTable(),
 	// it is used by FindRoute() to build a route for a specific
-	// destination.
+	// destination. It's never modified in place, updates replace it with
+	// a new slice.
 	routeTable []tcpip.Route
 
+	// routeGeneration is incremented every time routeTable, or the
+	// addresses routes may start from, change. It's accessed atomically,
+	// so that routes can be checked against it without taking mu.
+	routeGeneration uint64
+
 	*ports.PortManager
 
 	// If not nil, then any new endpoints will have this probe function
 	// invoked everytime they receive a TCP segment.
 	tcpProbeFunc TCPProbeFunc
 
-	// clock is used to generate user-visible times.
+	// rawDisabled is set when the creation of raw endpoints is forbidden,
+	// see SetRawEndpointsAllowed. It's protected by mu.
+	rawDisabled bool
+
+	// clock is used to generate user-visible times and for all the
+	// timekeeping of the stack.
 	clock tcpip.Clock
+
+	// rand is the source of all the random numbers drawn by the stack and
+	// its protocols.
+	rand tcpip.Rand
+
+	// unknownPortHook is set with SetUnknownPortHook.
+	unknownPortHook unknownPortHook
+
+	// drainingHook is set with SetDrainingEndpointHook.
+	drainingHook drainingHook
+
+	// packetHooks are set with SetPacketHook.
+	packetHooks packetHooks
+
+	// hostModel is the HostModel of the NICs that don't have their own.
+	// It's accessed atomically.
+	hostModel uint32
+
+	// loopbackChecksums is set atomically to 1 when checksums are computed
+	// and verified on loopback links too, see SetLoopbackChecksums.
+	loopbackChecksums uint32
+
+	// sendLimiter and rcvLimiter enforce the limits set with
+	// SetSendRateLimit and SetReceiveRateLimit.
+	sendLimiter rateLimiter
+	rcvLimiter  rateLimiter
+
+	// paused is set atomically to 1 while the stack is paused, see Pause.
+	paused uint32
+
+	// pauseMu serializes Pause and Resume, and protects pausedEPs, the
+	// endpoints paused by Pause.
+	pauseMu   sync.Mutex
+	pausedEPs []PausableTransportEndpoint
+
+	// closed is set atomically to 1 when the stack is closed, see Close.
+	closed uint32
+}
+
+// CloseOptions specify how Stack.Close shuts the stack down.
+type CloseOptions struct {
+	// Linger is how long connections are given to be shut down
+	// gracefully. Connections still open after Linger are reset; if it's
+	// zero, they're all reset right away.
+	Linger time.Duration
+
+	// Silent makes the connections still open be dropped without telling
+	// their peers, instead of being reset, e.g., when the stack is torn
+	// down along with the network it's attached to.
+	Silent bool
 }
 
 // New allocates a new networking stack with only the requested networking and
-// transport protocols configured with default options.
+// transport protocols configured with default options. A nil clock stands for
+// tcpip.StdClock.
 //
 // Protocol options can be changed by calling the
 // SetNetworkProtocolOption/SetTransportProtocolOption methods provided by the
 // stack. Please refer to individual protocol implementations as to what options
 // are supported.
 func New(clock tcpip.Clock, network []string, transport []string) *Stack {
+	return NewWithRand(clock, nil, network, transport)
+}
+
+// NewWithRand is like New, but the stack draws its random numbers, e.g., for
+// initial sequence numbers, ephemeral ports and IP identifiers, from rng. Two
+// stacks given sources that yield the same numbers behave identically for the
+// same sequence of operations, which makes for reproducible tests. A nil rng
+// stands for tcpip.CryptoRand.
+func NewWithRand(clock tcpip.Clock, rng tcpip.Rand, network []string, transport []string) *Stack {
+	if clock == nil {
+		clock = &tcpip.StdClock{}
+	}
+	if rng == nil {
+		rng = &tcpip.CryptoRand{}
+	}
+
 	s := &Stack{
 		transportProtocols: make(map[tcpip.TransportProtocolNumber]*transportProtocolState),
 		networkProtocols:   make(map[tcpip.NetworkProtocolNumber]NetworkProtocol),
 		linkAddrResolvers:  make(map[tcpip.NetworkProtocolNumber]LinkAddressResolver),
 		nics:               make(map[tcpip.NICID]*NIC),
-		linkAddrCache:      newLinkAddrCache(ageLimit, resolutionTimeout, resolutionAttempts),
-		PortManager:        ports.NewPortManager(),
+		linkAddrCache:      newLinkAddrCache(clock, ageLimit, resolutionTimeout, resolutionAttempts),
+		PortManager:        ports.NewPortManagerWithRand(rng),
 		clock:              clock,
+		rand:               rng,
 	}
 
 	// Add specified network protocols.
@@ -353,6 +459,21 @@ func (s *Stack) NetworkProtocolOption(network tcpip.NetworkProtocolNumber, optio
 	return netProto.Option(option)
 }
 
+// SetDefaultTTL sets the tcpip.DefaultTTLOption of all the network protocols of
+// the stack that support it. It applies to the packets sent afterwards by the
+// endpoints that don't set their own TTL.
+func (s *Stack) SetDefaultTTL(ttl uint8) *tcpip.Error {
+	if ttl == 0 {
+		return tcpip.ErrInvalidOptionValue
+	}
+	for _, netProto := range s.networkProtocols {
+		if err := netProto.SetOption(tcpip.DefaultTTLOption(ttl)); err != nil && err != tcpip.ErrUnknownProtocolOption {
+			return err
+		}
+	}
+	return nil
+}
+
 // SetTransportProtocolOption allows configuring individual protocol level
 // options. This method returns an error if the protocol is not supported or
 // option is not supported by the protocol implementation or the provided value
@@ -392,11 +513,22 @@ func (s *Stack) SetTransportProtocolHandler(p tcpip.TransportProtocolNumber, h f
 	}
 }
 
+// Rand returns the source of random numbers of the stack, which protocols
+// draw from as well.
+func (s *Stack) Rand() tcpip.Rand {
+	return s.rand
+}
+
 // NowNanoseconds implements tcpip.Clock.NowNanoseconds.
 func (s *Stack) NowNanoseconds() int64 {
 	return s.clock.NowNanoseconds()
 }
 
+// AfterFunc implements tcpip.Clock.AfterFunc.
+func (s *Stack) AfterFunc(d time.Duration, f func()) tcpip.Timer {
+	return s.clock.AfterFunc(d, f)
+}
+
 // Stats returns a snapshot of the current stats.
 //
 // NOTE: The underlying stats are updated using atomic instructions as a result
@@ -404,15 +536,152 @@ func (s *Stack) NowNanoseconds() int64 {
 // single given point of time.
 // TODO: Make stats available in sentry for debugging/diag.
 func (s *Stack) Stats() tcpip.Stats {
-	return tcpip.Stats{
-		UnknownProtocolRcvdPackets:        atomic.LoadUint64(&s.stats.UnknownProtocolRcvdPackets),
-		UnknownNetworkEndpointRcvdPackets: atomic.LoadUint64(&s.stats.UnknownNetworkEndpointRcvdPackets),
-		MalformedRcvdPackets:              atomic.LoadUint64(&s.stats.MalformedRcvdPackets),
-		DroppedPackets:                    atomic.LoadUint64(&s.stats.DroppedPackets),
+	return s.stats.Clone()
+}
+
+// TransportProtocolStats returns a snapshot of the current stats of the given
+// transport protocol.
+func (s *Stack) TransportProtocolStats(protocol tcpip.TransportProtocolNumber) (tcpip.TransportProtocolStats, *tcpip.Error) {
+	state, ok := s.transportProtocols[protocol]
+	if !ok {
+		return tcpip.TransportProtocolStats{}, tcpip.ErrUnknownProtocol
+	}
+
+	return tcpip.TransportProtocolStats{
+		UnknownPortRcvdPackets: atomic.LoadUint64(&state.stats.UnknownPortRcvdPackets),
+		MalformedRcvdPackets:   atomic.LoadUint64(&state.stats.MalformedRcvdPackets),
+	}, nil
+}
+
+// SetUnknownPortHook sets a function that is called with the protocols and IDs
+// of received packets that match no transport endpoint, so that they can be
+// logged. It is called at most once per interval, the other packets are only
+// counted in the stats. A nil function removes the hook.
+func (s *Stack) SetUnknownPortHook(interval time.Duration, fn func(tcpip.TransportProtocolNumber, TransportEndpointID)) {
+	h := &s.unknownPortHook
+	h.mu.Lock()
+	h.fn = fn
+	h.interval = int64(interval)
+	h.last = 0
+	h.mu.Unlock()
+}
+
+// Pause quiesces the stack so that its state can be saved consistently, e.g.,
+// while checkpointing a running container. Packets received or written by the
+// NICs are dropped, and the transport endpoints that do work in the
+// background, which implement PausableTransportEndpoint, stop that work and
+// their timers. Pause returns once all of them have stopped; it does nothing
+// if the stack is already paused.
+//
+// Users are expected to stop using the stack's endpoints while it's paused.
+// Endpoints registered while the stack is paused aren't paused.
+func (s *Stack) Pause() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	if atomic.LoadUint32(&s.paused) != 0 {
+		return
+	}
+	atomic.StoreUint32(&s.paused, 1)
+
+	// An endpoint registered with several protocols or NICs is listed
+	// several times, but must only be paused once.
+	_, eps := s.registeredEndpoints()
+	seen := make(map[TransportEndpoint]struct{}, len(eps))
+	for _, e := range eps {
+		if _, ok := seen[e.ep]; ok {
+			continue
+		}
+		seen[e.ep] = struct{}{}
+		if p, ok := e.ep.(PausableTransportEndpoint); ok {
+			p.Pause()
+			s.pausedEPs = append(s.pausedEPs, p)
+		}
+	}
+}
+
+// Resume resumes a stack paused with Pause. The timers of the paused
+// endpoints are pushed back by the duration of the pause, so that it doesn't
+// count towards their timeouts.
+func (s *Stack) Resume() {
+	s.pauseMu.Lock()
+	defer s.pauseMu.Unlock()
+
+	atomic.StoreUint32(&s.paused, 0)
+	for _, p := range s.pausedEPs {
+		p.Resume()
+	}
+	s.pausedEPs = nil
+}
+
+// isPaused returns true if the stack is paused, see Pause.
+func (s *Stack) isPaused() bool {
+	return atomic.LoadUint32(&s.paused) != 0
+}
+
+// Close shuts the stack down, releasing everything it owns. It does nothing if
+// the stack is already closed.
+//
+// The transport endpoints that do work in the background, which implement
+// StoppableTransportEndpoint, are stopped as set by opts; they must still be
+// closed by their users. All the NICs are then deleted, as with DeleteNIC, and
+// the pending link address resolutions are canceled. Close returns once the
+// goroutines of the stack have exited.
+//
+// Methods of the stack that can fail return tcpip.ErrInvalidEndpointState once
+// it's closed.
+func (s *Stack) Close(opts CloseOptions) {
+	if !atomic.CompareAndSwapUint32(&s.closed, 0, 1) {
+		return
+	}
+
+	// Paused endpoints can't be stopped.
+	s.Resume()
+	s.SetDrainingEndpointHook(0, 0, nil)
+
+	// An endpoint registered with several protocols or NICs is listed
+	// several times, but must only be stopped once. Endpoints are stopped
+	// concurrently so that their linger times don't add up.
+	_, eps := s.registeredEndpoints()
+	seen := make(map[TransportEndpoint]struct{}, len(eps))
+	var wg sync.WaitGroup
+	for _, e := range eps {
+		if _, ok := seen[e.ep]; ok {
+			continue
+		}
+		seen[e.ep] = struct{}{}
+		if ep, ok := e.ep.(StoppableTransportEndpoint); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ep.Stop(opts)
+			}()
+		}
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	nics := s.nics
+	s.nics = make(map[tcpip.NICID]*NIC)
+	s.routeTable = nil
+	s.invalidateRoutes()
+	s.mu.Unlock()
+
+	for _, nic := range nics {
+		nic.closeLinkEndpoint()
+		nic.removeAddresses()
 	}
+
+	s.linkAddrCache.cancelResolutions()
+}
+
+// isClosed returns true if the stack is closed, see Close.
+func (s *Stack) isClosed() bool {
+	return atomic.LoadUint32(&s.closed) != 0
 }
 
-// MutableStats returns a mutable copy of the current stats.
+// MutableStats returns the stats of the stack, so that protocols can increment
+// them, and users can reset them with tcpip.Stats.Reset.
 //
 // This is not generally exported via the public interface, but is available
 // internally.
@@ -427,10 +696,72 @@ func (s *Stack) SetRouteTable(table []tcpip.Route) {
 	defer s.mu.Unlock()
 
 	s.routeTable = table
+	s.invalidateRoutes()
+}
+
+// AddRoute appends a route to the route table, so it's only used for the
+// destinations that don't match the routes already in the table. Concurrent
+// calls to FindRoute see either the old or the new table.
+func (s *Stack) AddRoute(route tcpip.Route) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The table may be shared with the user or with previous tables, so
+	// a new one is built.
+	table := make([]tcpip.Route, 0, len(s.routeTable)+1)
+	table = append(table, s.routeTable...)
+	s.routeTable = append(table, route)
+	s.invalidateRoutes()
+	return nil
+}
+
+// RemoveRoute removes the first route equal to the given one from the route
+// table. It returns tcpip.ErrNoRoute if there is no such route.
+func (s *Stack) RemoveRoute(route tcpip.Route) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, r := range s.routeTable {
+		if r != route {
+			continue
+		}
+		table := make([]tcpip.Route, 0, len(s.routeTable)-1)
+		table = append(table, s.routeTable[:i]...)
+		s.routeTable = append(table, s.routeTable[i+1:]...)
+		s.invalidateRoutes()
+		return nil
+	}
+	return tcpip.ErrNoRoute
+}
+
+// RouteTableGeneration returns the generation of the route table, which is
+// incremented every time the table or the addresses of the NICs change. Routes
+// found with FindRoute may be stale once the generation differs from the one
+// returned before finding them, see Route.IsValid.
+func (s *Stack) RouteTableGeneration() uint64 {
+	return atomic.LoadUint64(&s.routeGeneration)
+}
+
+// invalidateRoutes increments the route generation, so that all the routes
+// found before are no longer valid.
+func (s *Stack) invalidateRoutes() {
+	atomic.AddUint64(&s.routeGeneration, 1)
 }
 
 // NewEndpoint creates a new transport layer endpoint of the given protocol.
 func (s *Stack) NewEndpoint(transport tcpip.TransportProtocolNumber, network tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	if s.isClosed() {
+		return nil, tcpip.ErrInvalidEndpointState
+	}
+
 	t, ok := s.transportProtocols[transport]
 	if !ok {
 		return nil, tcpip.ErrUnknownProtocol
@@ -439,6 +770,136 @@ func (s *Stack) NewEndpoint(transport tcpip.TransportProtocolNumber, network tcp
 	return t.proto.NewEndpoint(s, network, waiterQueue)
 }
 
+// NewRawEndpoint creates a new raw endpoint of the given network protocol,
+// which sends and receives packets of the given transport protocol. Raw
+// endpoints require the raw endpoint implementation (the transport/raw
+// package) to be linked in, and can be disabled with SetRawEndpointsAllowed.
+func (s *Stack) NewRawEndpoint(transport tcpip.TransportProtocolNumber, network tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	if s.isClosed() {
+		return nil, tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	disabled := s.rawDisabled
+	s.mu.RUnlock()
+
+	if disabled {
+		return nil, tcpip.ErrNotPermitted
+	}
+	if rawEndpointFactory == nil {
+		return nil, tcpip.ErrNotSupported
+	}
+	if _, ok := s.networkProtocols[network]; !ok {
+		return nil, tcpip.ErrUnknownProtocol
+	}
+
+	return rawEndpointFactory(s, network, transport, waiterQueue)
+}
+
+// NewPacketEndpoint creates a new packet endpoint, which sends and receives
+// packets of the given network protocol, or of all protocols if it's zero,
+// directly over NICs. Packet endpoints require the packet endpoint
+// implementation (the transport/packet package) to be linked in, and are
+// disabled along with raw endpoints by SetRawEndpointsAllowed.
+func (s *Stack) NewPacketEndpoint(network tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	if s.isClosed() {
+		return nil, tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	disabled := s.rawDisabled
+	s.mu.RUnlock()
+
+	if disabled {
+		return nil, tcpip.ErrNotPermitted
+	}
+	if packetEndpointFactory == nil {
+		return nil, tcpip.ErrNotSupported
+	}
+
+	return packetEndpointFactory(s, network, waiterQueue)
+}
+
+// SetRawEndpointsAllowed sets whether NewRawEndpoint and NewPacketEndpoint may
+// create raw and packet endpoints, which can send arbitrary packets and see
+// the packets of other endpoints. They are allowed by default. Endpoints
+// created earlier are unaffected.
+func (s *Stack) SetRawEndpointsAllowed(allowed bool) {
+	s.mu.Lock()
+	s.rawDisabled = !allowed
+	s.mu.Unlock()
+}
+
+// RegisterRawTransportEndpoint registers the given raw endpoint with the stack
+// transport dispatcher, so that it receives a copy of all packets of the given
+// protocols.
+func (s *Stack) RegisterRawTransportEndpoint(netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, ep RawTransportEndpoint) {
+	s.demux.registerRawEndpoint(netProto, transProto, ep)
+}
+
+// UnregisterRawTransportEndpoint removes the given raw endpoint from the stack
+// transport dispatcher.
+func (s *Stack) UnregisterRawTransportEndpoint(netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, ep RawTransportEndpoint) {
+	s.demux.unregisterRawEndpoint(netProto, transProto, ep)
+}
+
+// RegisterPacketEndpoint registers the given packet endpoint with the given
+// NIC, so that it receives a copy of all packets of the given network protocol
+// sent or received by the NIC, or of all packets if the protocol is zero.
+func (s *Stack) RegisterPacketEndpoint(nicID tcpip.NICID, netProto tcpip.NetworkProtocolNumber, ep PacketEndpoint) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.registerPacketEndpoint(netProto, ep)
+	return nil
+}
+
+// UnregisterPacketEndpoint removes the given packet endpoint from the given
+// NIC.
+func (s *Stack) UnregisterPacketEndpoint(nicID tcpip.NICID, netProto tcpip.NetworkProtocolNumber, ep PacketEndpoint) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if nic := s.nics[nicID]; nic != nil {
+		nic.unregisterPacketEndpoint(netProto, ep)
+	}
+}
+
+// WriteLinkPacket writes a network-layer packet of the given protocol to the
+// link endpoint of the given NIC, bypassing the network layer. The packet is
+// sent to the given link address; the link endpoint adds its own header, if
+// any.
+func (s *Stack) WriteLinkPacket(nicID tcpip.NICID, remote tcpip.LinkAddress, netProto tcpip.NetworkProtocolNumber, payload buffer.View) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	nic := s.nics[nicID]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	r := Route{
+		NetProto:          netProto,
+		LocalLinkAddress:  nic.link().LinkAddress(),
+		RemoteLinkAddress: remote,
+	}
+	hdr := buffer.NewPrependable(int(nic.link().MaxHeaderLength()))
+	return nic.tapEP.WritePacket(&r, nil, &hdr, payload, netProto)
+}
+
 // createNIC creates a NIC with the provided id and link-layer endpoint, and
 // optionally enable it.
 func (s *Stack) createNIC(id tcpip.NICID, name string, linkEP tcpip.LinkEndpointID, enabled bool) *tcpip.Error {
@@ -450,6 +911,12 @@ func (s *Stack) createNIC(id tcpip.NICID, name string, linkEP tcpip.LinkEndpoint
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// The stack is checked with the lock held so that Close doesn't miss
+	// the NIC.
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
 	// Make sure id is unique.
 	if _, ok := s.nics[id]; ok {
 		return tcpip.ErrDuplicateNICID
@@ -492,6 +959,10 @@ func (s *Stack) CreateDisabledNamedNIC(id tcpip.NICID, name string, linkEP tcpip
 // EnableNIC enables the given NIC so that the link-layer endpoint can start
 // delivering packets to it.
 func (s *Stack) EnableNIC(id tcpip.NICID) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -505,6 +976,106 @@ func (s *Stack) EnableNIC(id tcpip.NICID) *tcpip.Error {
 	return nil
 }
 
+// DetachLinkEndpoint detaches the given NIC from its link endpoint, without
+// closing it. Packets received by the endpoint are no longer delivered, and
+// packets sent through the NIC are dropped, until another link endpoint is
+// attached with AttachLinkEndpoint. The addresses, routes and neighbors of the
+// NIC are kept.
+func (s *Stack) DetachLinkEndpoint(id tcpip.NICID) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.detachLinkEndpoint()
+}
+
+// AttachLinkEndpoint attaches the given NIC, which must have been detached with
+// DetachLinkEndpoint, to a new link endpoint. The NIC then sends and receives
+// packets through it as it did through the previous one. The new endpoint
+// should have the same maximum header length as the previous one, as packets
+// being built when they're swapped may be written to it.
+func (s *Stack) AttachLinkEndpoint(id tcpip.NICID, linkEP tcpip.LinkEndpointID) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	ep := FindLinkEndpoint(linkEP)
+	if ep == nil {
+		return tcpip.ErrBadLinkEndpoint
+	}
+
+	s.mu.RLock()
+	nic := s.nics[id]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.replaceLinkEndpoint(ep)
+}
+
+// DeleteNIC removes the NIC with the given id from the stack, after which the
+// id may be used by a new NIC. The link endpoint of the NIC is closed if it
+// implements LinkEndpointCloser, which stops its inbound packets from being
+// delivered and waits for those in progress before returning. The addresses of
+// the NIC and the routes through it are then removed, and the transport
+// endpoints that implement RoutedTransportEndpoint are told about the removal,
+// so that connections through the NIC fail.
+func (s *Stack) DeleteNIC(id tcpip.NICID) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.Lock()
+	nic := s.nics[id]
+	if nic == nil {
+		s.mu.Unlock()
+		return tcpip.ErrUnknownNICID
+	}
+	delete(s.nics, id)
+
+	// The table may be shared with the user, so it's copied.
+	table := make([]tcpip.Route, 0, len(s.routeTable))
+	for _, r := range s.routeTable {
+		if r.NIC != id {
+			table = append(table, r)
+		}
+	}
+	s.routeTable = table
+	s.invalidateRoutes()
+	s.mu.Unlock()
+
+	// The link endpoint is closed without holding the lock, as packets
+	// being delivered may need it.
+	nic.closeLinkEndpoint()
+	nic.removeAddresses()
+
+	// Endpoints bound to other NICs can't be routed through this one.
+	eps := s.demux.registeredEndpoints(nil, 0)
+	eps = nic.demux.registeredEndpoints(eps, id)
+	seen := make(map[TransportEndpoint]struct{}, len(eps))
+	for _, e := range eps {
+		if _, ok := seen[e.ep]; ok {
+			continue
+		}
+		seen[e.ep] = struct{}{}
+		if ep, ok := e.ep.(RoutedTransportEndpoint); ok {
+			ep.HandleNICRemoved(id)
+		}
+	}
+
+	return nil
+}
+
 // NICSubnets returns a map of NICIDs to their associated subnets.
 func (s *Stack) NICSubnets() map[tcpip.NICID][]tcpip.Subnet {
 	s.mu.RLock()
@@ -518,31 +1089,99 @@ func (s *Stack) NICSubnets() map[tcpip.NICID][]tcpip.Subnet {
 	return nics
 }
 
-// NICInfo captures the name and addresses assigned to a NIC.
+// NICStateFlags holds the state of a NIC.
+type NICStateFlags struct {
+	// Up is set while the NIC is attached to a link endpoint, see
+	// DetachLinkEndpoint.
+	Up bool
+
+	// Loopback is set if the link endpoint of the NIC loops the packets
+	// sent through it back to the stack.
+	Loopback bool
+
+	// Promiscuous is set if the NIC accepts packets sent to any address,
+	// see SetPromiscuousMode.
+	Promiscuous bool
+}
+
+// NICInfo captures the name, state, addresses and traffic counters of a NIC.
 type NICInfo struct {
 	Name              string
 	LinkAddress       tcpip.LinkAddress
 	ProtocolAddresses []tcpip.ProtocolAddress
+
+	// MTU is the MTU of the link endpoint of the NIC.
+	MTU uint32
+
+	Flags NICStateFlags
+	Stats tcpip.NICStats
 }
 
-// NICInfo returns a map of NICIDs to their associated information.
+// NICInfo returns a map of NICIDs to their associated information. The
+// addresses and state of each NIC are read at once, so that they're consistent
+// even while they're being changed.
 func (s *Stack) NICInfo() map[tcpip.NICID]NICInfo {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	nics := make(map[tcpip.NICID]NICInfo)
 	for id, nic := range s.nics {
-		nics[id] = NICInfo{
-			Name:              nic.name,
-			LinkAddress:       nic.linkEP.LinkAddress(),
-			ProtocolAddresses: nic.Addresses(),
+		nics[id] = nic.info()
+	}
+	return nics
+}
+
+// NICAddressRanges returns a map of NICIDs to the subnets of their addresses,
+// as given by the prefix lengths they were added with.
+func (s *Stack) NICAddressRanges() map[tcpip.NICID][]tcpip.Subnet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nics := make(map[tcpip.NICID][]tcpip.Subnet)
+	for id, nic := range s.nics {
+		var sns []tcpip.Subnet
+		seen := make(map[tcpip.Subnet]struct{})
+		for _, a := range nic.Addresses() {
+			sn, err := tcpip.NewSubnetFromPrefix(a.Address, a.PrefixLen)
+			if err != nil {
+				panic("Invalid address prefix: " + err.Error())
+			}
+			if _, ok := seen[sn]; !ok {
+				seen[sn] = struct{}{}
+				sns = append(sns, sn)
+			}
 		}
+		nics[id] = sns
 	}
 	return nics
 }
 
+// NICStats returns a snapshot of the traffic counters of the specified NIC.
+//
+// As with Stats, the counters are updated atomically, so the snapshot doesn't
+// represent their values at any single point in time.
+func (s *Stack) NICStats(id tcpip.NICID) (tcpip.NICStats, *tcpip.Error) {
+	if s.isClosed() {
+		return tcpip.NICStats{}, tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return tcpip.NICStats{}, tcpip.ErrUnknownNICID
+	}
+
+	return nic.Stats(), nil
+}
+
 // AddAddress adds a new network-layer address to the specified NIC.
 func (s *Stack) AddAddress(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -554,8 +1193,74 @@ func (s *Stack) AddAddress(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber,
 	return nic.AddAddress(protocol, addr)
 }
 
+// AddAddressWithOptions adds a new network-layer address to the specified NIC,
+// optionally running duplicate address detection first. In that case the
+// address is assigned asynchronously, and opts.DADCallback is called once
+// detection completes.
+func (s *Stack) AddAddressWithOptions(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address, opts AddressOptions) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[id]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.AddAddressWithOptions(protocol, addr, opts)
+}
+
+// JoinGroup joins the given multicast group on the specified NIC. The NIC
+// programs the matching multicast filter on its link endpoint, if the endpoint
+// supports it.
+func (s *Stack) JoinGroup(protocol tcpip.NetworkProtocolNumber, nicID tcpip.NICID, multicastAddr tcpip.Address) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.JoinGroup(protocol, multicastAddr)
+}
+
+// LeaveGroup leaves the given multicast group on the specified NIC. Groups
+// joined several times must be left as many times.
+func (s *Stack) LeaveGroup(protocol tcpip.NetworkProtocolNumber, nicID tcpip.NICID, multicastAddr tcpip.Address) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.LeaveGroup(protocol, multicastAddr)
+}
+
 // AddSubnet adds a subnet range to the specified NIC.
+//
+// The NIC then accepts packets to any address within the subnet, and routes
+// through the NIC can be found from such addresses, as if the NIC had them. As
+// opposed to promiscuous mode, which does the same for any address, only the
+// addresses within the subnets of the NIC are accepted.
 func (s *Stack) AddSubnet(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber, subnet tcpip.Subnet) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -571,6 +1276,10 @@ func (s *Stack) AddSubnet(id tcpip.NICID, protocol tcpip.NetworkProtocolNumber,
 // RemoveAddress removes an existing network-layer address from the specified
 // NIC.
 func (s *Stack) RemoveAddress(id tcpip.NICID, addr tcpip.Address) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -583,11 +1292,27 @@ func (s *Stack) RemoveAddress(id tcpip.NICID, addr tcpip.Address) *tcpip.Error {
 }
 
 // FindRoute creates a route to the given destination address, leaving through
-// the given nic and local address (if provided).
+// the given nic and local address (if provided). Routes to an address of one of
+// the stack's NICs go through that NIC and loop packets back to it.
 func (s *Stack) FindRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) (Route, *tcpip.Error) {
+	if s.isClosed() {
+		return Route{}, tcpip.ErrInvalidEndpointState
+	}
+
+	s.stats.RouteLookups.Increment()
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	// The generation is loaded first, so that the route is invalidated by
+	// the address changes that race with finding it.
+	generation := atomic.LoadUint64(&s.routeGeneration)
+
+	if r, ok := s.findLoopRouteLocked(id, localAddr, remoteAddr, netProto); ok {
+		r.generation = generation
+		return r, nil
+	}
+
 	for i := range s.routeTable {
 		if (id != 0 && id != s.routeTable[i].NIC) || (len(remoteAddr) != 0 && !s.routeTable[i].Match(remoteAddr)) {
 			continue
@@ -616,12 +1341,45 @@ func (s *Stack) FindRoute(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, n
 
 		r := makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, ref)
 		r.NextHop = s.routeTable[i].Gateway
+		r.generation = generation
 		return r, nil
 	}
 
 	return Route{}, tcpip.ErrNoRoute
 }
 
+// findLoopRouteLocked returns a route looping back to the NIC that has
+// remoteAddr, if any. s.mu must be held.
+func (s *Stack) findLoopRouteLocked(id tcpip.NICID, localAddr, remoteAddr tcpip.Address, netProto tcpip.NetworkProtocolNumber) (Route, bool) {
+	if len(remoteAddr) == 0 || isBroadcastAddress(netProto, remoteAddr) || isMulticastAddress(netProto, remoteAddr) {
+		return Route{}, false
+	}
+
+	for _, nic := range s.nics {
+		if (id != 0 && id != nic.id) || !nic.hasAddress(netProto, remoteAddr) {
+			continue
+		}
+
+		// Packets are sent from the destination address itself unless
+		// another address of the NIC is requested.
+		if len(localAddr) == 0 {
+			localAddr = remoteAddr
+		}
+		ref := nic.findEndpoint(netProto, localAddr)
+		if ref == nil {
+			return Route{}, false
+		}
+
+		r := makeRoute(netProto, ref.ep.ID().LocalAddress, remoteAddr, ref)
+		r.LocalLinkAddress = nic.link().LinkAddress()
+		r.RemoteLinkAddress = r.LocalLinkAddress
+		r.loop = true
+		return r, true
+	}
+
+	return Route{}, false
+}
+
 // CheckNetworkProtocol checks if a given network protocol is enabled in the
 // stack.
 func (s *Stack) CheckNetworkProtocol(protocol tcpip.NetworkProtocolNumber) bool {
@@ -629,6 +1387,15 @@ func (s *Stack) CheckNetworkProtocol(protocol tcpip.NetworkProtocolNumber) bool
 	return ok
 }
 
+// CheckNIC checks if a NIC with the given id exists.
+func (s *Stack) CheckNIC(id tcpip.NICID) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.nics[id]
+	return ok
+}
+
 // CheckLocalAddress determines if the given local address exists, and if it
 // does, returns the id of the NIC it's bound to. Returns 0 if the address
 // does not exist.
@@ -666,7 +1433,17 @@ func (s *Stack) CheckLocalAddress(nicid tcpip.NICID, protocol tcpip.NetworkProto
 }
 
 // SetPromiscuousMode enables or disables promiscuous mode in the given NIC.
+//
+// In promiscuous mode, the NIC accepts packets to any destination address, as
+// if it had that address while routes through it are in use. The routes handed
+// to transport endpoints keep the actual destination as their local address,
+// so connections accepted by listeners bound to the wildcard address report it
+// as their local address and send their responses from it.
 func (s *Stack) SetPromiscuousMode(nicID tcpip.NICID, enable bool) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -680,9 +1457,208 @@ func (s *Stack) SetPromiscuousMode(nicID tcpip.NICID, enable bool) *tcpip.Error
 	return nil
 }
 
+// SetLinkAddress changes the link address of the given NIC, for example to
+// take over a virtual MAC address. The NIC's IPv4 addresses are announced with
+// the new link address via gratuitous ARP; IPv6 addresses aren't announced, as
+// the stack doesn't implement neighbor discovery, but those autoconfigured
+// from the link address are replaced by ones formed from the new one. It
+// returns tcpip.ErrNotSupported if the link endpoint can't change its address.
+func (s *Stack) SetLinkAddress(nicID tcpip.NICID, addr tcpip.LinkAddress) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.setLinkAddress(addr)
+}
+
+// SetLinkMTU changes the MTU of the given NIC's link endpoint, for example to
+// follow a change of the MTU of the device backing it. It returns
+// tcpip.ErrNotSupported if the link endpoint can't change its MTU. Connections
+// established before the change keep the maximum segment size they negotiated.
+func (s *Stack) SetLinkMTU(nicID tcpip.NICID, mtu uint32) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	ep, ok := nic.link().(LinkMTUSetter)
+	if !ok {
+		return tcpip.ErrNotSupported
+	}
+	return ep.SetMTU(mtu)
+}
+
+// AttachPacketTap attaches a new packet tap to the given NIC. The tap receives
+// copies of all packets sent and received by the NIC, truncated to snaplen
+// bytes unless snaplen is zero, until it is detached. Attaching and detaching
+// taps doesn't disturb the traffic of the NIC.
+//
+// Taps capture network-layer packets, without their link-layer headers, which
+// are added and removed by the link endpoint out of sight of the NIC.
+func (s *Stack) AttachPacketTap(nicID tcpip.NICID, snaplen int) (*PacketTap, *tcpip.Error) {
+	if s.isClosed() {
+		return nil, tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return nil, tcpip.ErrUnknownNICID
+	}
+
+	return nic.attachPacketTap(snaplen), nil
+}
+
+// SetForwarding enables or disables forwarding in the given NIC.
+//
+// Packets received by a NIC that forwards packets, to an address the NIC
+// doesn't accept, are forwarded through the route the stack has to their
+// destination, if the NIC of the route also forwards packets.
+func (s *Stack) SetForwarding(nicID tcpip.NICID, enable bool) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setForwarding(enable)
+
+	return nil
+}
+
+// SetForwardingAll enables or disables forwarding in all the NICs of the
+// stack, see SetForwarding. NICs created later don't forward packets until
+// SetForwarding enables it.
+func (s *Stack) SetForwardingAll(enable bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, nic := range s.nics {
+		nic.setForwarding(enable)
+	}
+}
+
+// Forwarding returns whether the given NIC forwards packets.
+func (s *Stack) Forwarding(nicID tcpip.NICID) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	return nic != nil && nic.forwards()
+}
+
+// SetLoopbackChecksums sets whether packets going through loopback links, or
+// addressed to the stack itself, have their checksums computed and verified.
+// Such packets never leave the host and loopback links advertise full
+// checksum offload, so the checksums are skipped by default; forcing them is
+// mostly useful to exercise the checksum code.
+func (s *Stack) SetLoopbackChecksums(enable bool) {
+	v := uint32(0)
+	if enable {
+		v = 1
+	}
+	atomic.StoreUint32(&s.loopbackChecksums, v)
+}
+
+// LoopbackChecksums returns whether checksums are computed and verified on
+// loopback links, see SetLoopbackChecksums.
+func (s *Stack) LoopbackChecksums() bool {
+	return atomic.LoadUint32(&s.loopbackChecksums) != 0
+}
+
+// SetSendRateLimit limits the number of bytes per second sent through the NICs
+// of the stack, all together. The packets exceeding the limit are queued or
+// dropped as specified by l, as if lost on the link; packets addressed to the
+// stack itself aren't limited. A zero Rate removes the limit.
+func (s *Stack) SetSendRateLimit(l RateLimit) *tcpip.Error {
+	return s.sendLimiter.set(s.clock, l)
+}
+
+// SendRateLimit returns the limit set with SetSendRateLimit.
+func (s *Stack) SendRateLimit() RateLimit {
+	return s.sendLimiter.get()
+}
+
+// SetReceiveRateLimit limits the number of bytes per second received from the
+// links of the NICs of the stack, all together. The packets exceeding the
+// limit are dropped, so l.QueueLimit must be zero. A zero Rate removes the
+// limit.
+func (s *Stack) SetReceiveRateLimit(l RateLimit) *tcpip.Error {
+	if l.QueueLimit != 0 {
+		return tcpip.ErrInvalidOptionValue
+	}
+	return s.rcvLimiter.set(s.clock, l)
+}
+
+// ReceiveRateLimit returns the limit set with SetReceiveRateLimit.
+func (s *Stack) ReceiveRateLimit() RateLimit {
+	return s.rcvLimiter.get()
+}
+
+// SetHostModel sets the host model of the NICs that don't have their own, see
+// HostModel. It's StrongHostModel by default.
+func (s *Stack) SetHostModel(m HostModel) *tcpip.Error {
+	if m != StrongHostModel && m != WeakHostModel {
+		return tcpip.ErrInvalidOptionValue
+	}
+	atomic.StoreUint32(&s.hostModel, uint32(m))
+	s.invalidateRoutes()
+	return nil
+}
+
+// SetNICHostModel sets the host model of the given NIC, see HostModel.
+// DefaultHostModel makes it use the host model of the stack again.
+func (s *Stack) SetNICHostModel(nicID tcpip.NICID, m HostModel) *tcpip.Error {
+	if m != DefaultHostModel && m != StrongHostModel && m != WeakHostModel {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	s.mu.RLock()
+	nic := s.nics[nicID]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	nic.setHostModel(m)
+	return nil
+}
+
 // SetSpoofing enables or disables address spoofing in the given NIC, allowing
 // endpoints to bind to any address in the NIC.
+//
+// With spoofing enabled, routes through the NIC can be found from any local
+// address, which is then used as the source address of the packets sent
+// through them. Link addresses are still resolved as usual.
 func (s *Stack) SetSpoofing(nicID tcpip.NICID, enable bool) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -696,17 +1672,90 @@ func (s *Stack) SetSpoofing(nicID tcpip.NICID, enable bool) *tcpip.Error {
 	return nil
 }
 
+// SetSLAAC enables stateless address autoconfiguration (RFC 4862) of IPv6
+// addresses on the given NIC with config, or disables it if config is nil. The
+// NIC then forms addresses from the prefixes advertised by routers, and removes
+// them once the advertised lifetimes end. The addresses autoconfigured before
+// are removed.
+func (s *Stack) SetSLAAC(nicID tcpip.NICID, config *SLAACConfig) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	s.mu.RLock()
+	nic := s.nics[nicID]
+	s.mu.RUnlock()
+
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.setSLAAC(config)
+}
+
 // AddLinkAddress adds a link address to the stack link cache.
 func (s *Stack) AddLinkAddress(nicid tcpip.NICID, addr tcpip.Address, linkAddr tcpip.LinkAddress) {
 	fullAddr := tcpip.FullAddress{NIC: nicid, Addr: addr}
-	s.linkAddrCache.add(fullAddr, linkAddr)
+	if s.linkAddrCache.add(fullAddr, linkAddr) {
+		// Cached routes may hold the previous link address.
+		s.invalidateRoutes()
+	}
 	// TODO: provide a way for a
 	// transport endpoint to receive a signal that AddLinkAddress
 	// for a particular address has been called.
 }
 
+// AddStaticLinkAddress adds a static link address to the stack link cache. It
+// replaces any link address of addr, and is neither replaced by the ones that
+// are resolved later nor evicted.
+func (s *Stack) AddStaticLinkAddress(nicid tcpip.NICID, addr tcpip.Address, linkAddr tcpip.LinkAddress) {
+	fullAddr := tcpip.FullAddress{NIC: nicid, Addr: addr}
+	if s.linkAddrCache.addStatic(fullAddr, linkAddr) {
+		s.invalidateRoutes()
+	}
+}
+
+// RemoveStaticLinkAddress removes a static link address added with
+// AddStaticLinkAddress. The link address of addr is resolved again the next
+// time it's needed.
+func (s *Stack) RemoveStaticLinkAddress(nicid tcpip.NICID, addr tcpip.Address) *tcpip.Error {
+	fullAddr := tcpip.FullAddress{NIC: nicid, Addr: addr}
+	if !s.linkAddrCache.removeStatic(fullAddr) {
+		return tcpip.ErrBadAddress
+	}
+	s.invalidateRoutes()
+	return nil
+}
+
+// SetLinkAddressCacheSize sets the maximum number of link addresses that the
+// stack link cache holds, 512 by default. When it's full, the least recently
+// used link address is evicted to make room for a new one; static link
+// addresses and the ones being resolved are never evicted.
+func (s *Stack) SetLinkAddressCacheSize(size int) *tcpip.Error {
+	if size < 1 {
+		return tcpip.ErrInvalidOptionValue
+	}
+	s.linkAddrCache.setSize(size)
+	return nil
+}
+
+// AddressConflict implements LinkAddressCache.AddressConflict.
+func (s *Stack) AddressConflict(nicid tcpip.NICID, protocol tcpip.NetworkProtocolNumber, addr tcpip.Address) {
+	s.mu.RLock()
+	nic := s.nics[nicid]
+	s.mu.RUnlock()
+
+	if nic != nil {
+		nic.addressConflict(addr)
+	}
+}
+
 // GetLinkAddress implements LinkAddressCache.GetLinkAddress.
 func (s *Stack) GetLinkAddress(nicid tcpip.NICID, addr, localAddr tcpip.Address, protocol tcpip.NetworkProtocolNumber, waker *sleep.Waker) (tcpip.LinkAddress, *tcpip.Error) {
+	if s.isClosed() {
+		return "", tcpip.ErrInvalidEndpointState
+	}
+
 	s.mu.RLock()
 	nic := s.nics[nicid]
 	if nic == nil {
@@ -717,7 +1766,7 @@ func (s *Stack) GetLinkAddress(nicid tcpip.NICID, addr, localAddr tcpip.Address,
 
 	fullAddr := tcpip.FullAddress{NIC: nicid, Addr: addr}
 	linkRes := s.linkAddrResolvers[protocol]
-	return s.linkAddrCache.get(fullAddr, linkRes, localAddr, nic.linkEP, waker)
+	return s.linkAddrCache.get(fullAddr, linkRes, localAddr, nic.tapEP, waker)
 }
 
 // RemoveWaker implements LinkAddressCache.RemoveWaker.
@@ -734,10 +1783,17 @@ func (s *Stack) RemoveWaker(nicid tcpip.NICID, addr tcpip.Address, waker *sleep.
 // RegisterTransportEndpoint registers the given endpoint with the stack
 // transport dispatcher. Received packets that match the provided id will be
 // delivered to the given endpoint; specifying a nic is optional, but
-// nic-specific IDs have precedence over global ones.
-func (s *Stack) RegisterTransportEndpoint(nicID tcpip.NICID, netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) *tcpip.Error {
+// nic-specific IDs have precedence over global ones. If reuse is true, an id
+// without remote part may be shared with other endpoints registered with
+// reuse; they all receive broadcast and multicast packets, and only one of
+// them the other packets.
+func (s *Stack) RegisterTransportEndpoint(nicID tcpip.NICID, netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint, reuse bool) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
 	if nicID == 0 {
-		return s.demux.registerEndpoint(netProtos, protocol, id, ep)
+		return s.demux.registerEndpoint(netProtos, protocol, id, ep, reuse)
 	}
 
 	s.mu.RLock()
@@ -748,14 +1804,14 @@ func (s *Stack) RegisterTransportEndpoint(nicID tcpip.NICID, netProtos []tcpip.N
 		return tcpip.ErrUnknownNICID
 	}
 
-	return nic.demux.registerEndpoint(netProtos, protocol, id, ep)
+	return nic.demux.registerEndpoint(netProtos, protocol, id, ep, reuse)
 }
 
-// UnregisterTransportEndpoint removes the endpoint with the given id from the
-// stack transport dispatcher.
-func (s *Stack) UnregisterTransportEndpoint(nicID tcpip.NICID, netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID) {
+// UnregisterTransportEndpoint removes the given endpoint, registered with the
+// given id, from the stack transport dispatcher.
+func (s *Stack) UnregisterTransportEndpoint(nicID tcpip.NICID, netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) {
 	if nicID == 0 {
-		s.demux.unregisterEndpoint(netProtos, protocol, id)
+		s.demux.unregisterEndpoint(netProtos, protocol, id, ep)
 		return
 	}
 
@@ -764,10 +1820,35 @@ func (s *Stack) UnregisterTransportEndpoint(nicID tcpip.NICID, netProtos []tcpip
 
 	nic := s.nics[nicID]
 	if nic != nil {
-		nic.demux.unregisterEndpoint(netProtos, protocol, id)
+		nic.demux.unregisterEndpoint(netProtos, protocol, id, ep)
 	}
 }
 
+// MoveTransportEndpoint atomically moves the given endpoint from oldID to newID
+// in the stack transport dispatcher, such that received packets that match
+// newID are delivered to it, and packets that match oldID no longer are. The
+// nic, network protocols and reuse must be those the endpoint was registered
+// with.
+func (s *Stack) MoveTransportEndpoint(nicID tcpip.NICID, netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, oldID, newID TransportEndpointID, ep TransportEndpoint, reuse bool) *tcpip.Error {
+	if s.isClosed() {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	if nicID == 0 {
+		return s.demux.moveEndpoint(netProtos, protocol, oldID, newID, ep, reuse)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	nic := s.nics[nicID]
+	if nic == nil {
+		return tcpip.ErrUnknownNICID
+	}
+
+	return nic.demux.moveEndpoint(netProtos, protocol, oldID, newID, ep, reuse)
+}
+
 // NetworkProtocolInstance returns the protocol instance in the stack for the
 // specified network protocol. This method is public for protocol implementers
 // and tests to use.
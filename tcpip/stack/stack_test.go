@@ -9,12 +9,24 @@ package stack_test
 
 import (
 	"math"
+	"reflect"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/checker"
+	"github.com/google/netstack/tcpip/header"
 	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/testutil"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
 )
 
 const (
@@ -94,7 +106,7 @@ func (f *fakeNetworkEndpoint) Capabilities() stack.LinkEndpointCapabilities {
 	return f.linkEP.Capabilities()
 }
 
-func (f *fakeNetworkEndpoint) WritePacket(r *stack.Route, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error {
+func (f *fakeNetworkEndpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.TransportProtocolNumber) *tcpip.Error {
 	// Increment the sent packet count in the protocol descriptor.
 	f.proto.sendPacketCount[int(r.RemoteAddress[0])%len(f.proto.sendPacketCount)]++
 
@@ -104,7 +116,7 @@ func (f *fakeNetworkEndpoint) WritePacket(r *stack.Route, hdr *buffer.Prependabl
 	b[0] = r.RemoteAddress[0]
 	b[1] = f.id.LocalAddress[0]
 	b[2] = byte(protocol)
-	return f.linkEP.WritePacket(r, hdr, payload, fakeNetNumber)
+	return f.linkEP.WritePacket(r, csum, hdr, payload, fakeNetNumber)
 }
 
 func (*fakeNetworkEndpoint) Close() {}
@@ -258,7 +270,7 @@ func sendTo(t *testing.T, s *stack.Stack, addr tcpip.Address) {
 	defer r.Release()
 
 	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
-	err = r.WritePacket(&hdr, nil, fakeTransNumber)
+	err = r.WritePacket(nil, &hdr, nil, fakeTransNumber)
 	if err != nil {
 		t.Errorf("WritePacket failed: %v", err)
 		return
@@ -434,6 +446,120 @@ func TestRoutes(t *testing.T) {
 	testNoRoute(t, s, 1, "\x03", "\x06")
 }
 
+// newTwoNICStack creates a stack with the fake network protocol and two NICs,
+// the first one with address 1 and the second one with address 2.
+func newTwoNICStack(t *testing.T) *stack.Stack {
+	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, nil)
+	for _, nic := range []tcpip.NICID{1, 2} {
+		id, _ := channel.New(10, defaultMTU, "")
+		if err := s.CreateNIC(nic, id); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+		if err := s.AddAddress(nic, fakeNetNumber, tcpip.Address([]byte{byte(nic)})); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+	}
+	return s
+}
+
+func TestAddRemoveRoute(t *testing.T) {
+	s := newTwoNICStack(t)
+	odd := tcpip.Route{Destination: "\x01", Mask: "\x01", Gateway: "\x00", NIC: 1}
+	even := tcpip.Route{Destination: "\x00", Mask: "\x01", Gateway: "\x00", NIC: 2}
+	gen := s.RouteTableGeneration()
+
+	if err := s.AddRoute(odd); err != nil {
+		t.Fatalf("AddRoute failed: %v", err)
+	}
+	if err := s.AddRoute(even); err != nil {
+		t.Fatalf("AddRoute failed: %v", err)
+	}
+	testRoute(t, s, 0, "", "\x05", "\x01")
+	testRoute(t, s, 0, "", "\x06", "\x02")
+
+	if err := s.RemoveRoute(odd); err != nil {
+		t.Fatalf("RemoveRoute failed: %v", err)
+	}
+	testNoRoute(t, s, 0, "", "\x05")
+	testRoute(t, s, 0, "", "\x06", "\x02")
+
+	if err := s.RemoveRoute(odd); err != tcpip.ErrNoRoute {
+		t.Fatalf("RemoveRoute of a missing route = %v, want %v", err, tcpip.ErrNoRoute)
+	}
+	if got, want := s.RouteTableGeneration(), gen+3; got != want {
+		t.Fatalf("got RouteTableGeneration() = %d, want %d", got, want)
+	}
+
+	// Tables passed to SetRouteTable aren't modified.
+	table := []tcpip.Route{odd, even}
+	s.SetRouteTable(table)
+	if err := s.RemoveRoute(odd); err != nil {
+		t.Fatalf("RemoveRoute failed: %v", err)
+	}
+	if table[0] != odd || table[1] != even {
+		t.Fatalf("RemoveRoute modified the table passed to SetRouteTable: %v", table)
+	}
+}
+
+func TestRouteChurn(t *testing.T) {
+	s := newTwoNICStack(t)
+	odd := tcpip.Route{Destination: "\x01", Mask: "\x01", Gateway: "\x00", NIC: 1}
+	even := tcpip.Route{Destination: "\x00", Mask: "\x01", Gateway: "\x00", NIC: 2}
+	s.SetRouteTable([]tcpip.Route{odd})
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := s.AddRoute(even); err != nil {
+				t.Errorf("AddRoute failed: %v", err)
+				return
+			}
+			if err := s.RemoveRoute(even); err != nil {
+				t.Errorf("RemoveRoute failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 10000; i++ {
+		// The route to odd addresses is never affected by the churn.
+		r, err := s.FindRoute(0, "", "\x05", fakeNetNumber)
+		if err != nil {
+			t.Fatalf("FindRoute to an odd address failed: %v", err)
+		}
+		if r.LocalAddress != "\x01" {
+			t.Fatalf("got route to an odd address from %v, want \\x01", r.LocalAddress)
+		}
+		r.Release()
+
+		// The route to even addresses is either there or not.
+		r, err = s.FindRoute(0, "", "\x06", fakeNetNumber)
+		switch err {
+		case nil:
+			if r.LocalAddress != "\x02" {
+				t.Fatalf("got route to an even address from %v, want \\x02", r.LocalAddress)
+			}
+			r.Release()
+		case tcpip.ErrNoRoute:
+		default:
+			t.Fatalf("FindRoute to an even address failed: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	testRoute(t, s, 0, "", "\x05", "\x01")
+	testNoRoute(t, s, 0, "", "\x06")
+}
+
 func TestAddressRemoval(t *testing.T) {
 	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, nil)
 
@@ -603,6 +729,499 @@ func TestPromiscuousMode(t *testing.T) {
 	}
 }
 
+// forwardPackets injects the packets written to each of the given link
+// endpoints into the other one, until done is closed.
+func forwardPackets(a, b *channel.Endpoint, done <-chan struct{}) {
+	for {
+		var p channel.PacketInfo
+		var to *channel.Endpoint
+		select {
+		case p = <-a.C:
+			to = b
+		case p = <-b.C:
+			to = a
+		case <-done:
+			return
+		}
+		vv := buffer.NewVectorisedView(len(p.Header)+len(p.Payload), []buffer.View{p.Header, p.Payload})
+		to.Inject(p.Proto, &vv)
+	}
+}
+
+const (
+	tcpClientAddr = tcpip.Address("\x0a\x00\x00\x01")
+	tcpServerPort = 80
+)
+
+// tcpTestbed is a pair of IPv4 stacks whose NICs are linked, the client one
+// with address tcpClientAddr, and the server one with no address but with a
+// TCP endpoint listening on tcpServerPort.
+type tcpTestbed struct {
+	client, server *stack.Stack
+	listener       tcpip.Endpoint
+	listenerCh     chan struct{}
+	listenerWQ     waiter.Queue
+	listenerWE     waiter.Entry
+	done           chan struct{}
+}
+
+func newTCPTestbed(t *testing.T) *tcpTestbed {
+	t.Helper()
+
+	route := []tcpip.Route{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Gateway: "", NIC: 1}}
+	tb := &tcpTestbed{
+		client: stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName}),
+		server: stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName}),
+		done:   make(chan struct{}),
+	}
+	clientID, clientEP := channel.New(10, defaultMTU, "")
+	if err := tb.client.CreateNIC(1, clientID); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := tb.client.AddAddress(1, ipv4.ProtocolNumber, tcpClientAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	tb.client.SetRouteTable(route)
+
+	serverID, serverEP := channel.New(10, defaultMTU, "")
+	if err := tb.server.CreateNIC(1, serverID); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	tb.server.SetRouteTable(route)
+
+	go forwardPackets(clientEP, serverEP, tb.done)
+
+	var err *tcpip.Error
+	tb.listener, err = tb.server.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &tb.listenerWQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := tb.listener.Bind(tcpip.FullAddress{Port: tcpServerPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := tb.listener.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	tb.listenerWE, tb.listenerCh = waiter.NewChannelEntry(nil)
+	tb.listenerWQ.EventRegister(&tb.listenerWE, waiter.EventIn)
+	return tb
+}
+
+func (tb *tcpTestbed) close() {
+	tb.listenerWQ.EventUnregister(&tb.listenerWE)
+	tb.listener.Close()
+	close(tb.done)
+}
+
+// connect connects a client endpoint to addr, and returns it along with the
+// server endpoint accepting the connection. The caller must close both.
+func (tb *tcpTestbed) connect(t *testing.T, addr tcpip.Address) (c tcpip.Endpoint, cwq *waiter.Queue, n tcpip.Endpoint, nwq *waiter.Queue) {
+	t.Helper()
+
+	cwq = &waiter.Queue{}
+	c, err := tb.client.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, cwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	we, ch := waiter.NewChannelEntry(nil)
+	cwq.EventRegister(&we, waiter.EventOut)
+	defer cwq.EventUnregister(&we)
+	if err := c.Connect(tcpip.FullAddress{Addr: addr, Port: tcpServerPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Connect = %v, want %v", err, tcpip.ErrConnectStarted)
+	}
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the connection to %v", addr)
+	}
+	if err := c.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+		t.Fatalf("Connect to %v failed: %v", addr, err)
+	}
+
+	for {
+		n, nwq, err = tb.listener.Accept()
+		if err != tcpip.ErrWouldBlock {
+			break
+		}
+		select {
+		case <-tb.listenerCh:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the connection to %v to be accepted", addr)
+		}
+	}
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+
+	// The accepted connection uses the address it was made to.
+	local, err := n.GetLocalAddress()
+	if err != nil {
+		t.Fatalf("GetLocalAddress failed: %v", err)
+	}
+	if want := (tcpip.FullAddress{NIC: 1, Addr: addr, Port: tcpServerPort}); local != want {
+		t.Errorf("got GetLocalAddress() = %+v, want %+v", local, want)
+	}
+	remote, err := n.GetRemoteAddress()
+	if err != nil {
+		t.Fatalf("GetRemoteAddress failed: %v", err)
+	}
+	if remote.Addr != tcpClientAddr {
+		t.Errorf("got GetRemoteAddress().Addr = %v, want %v", remote.Addr, tcpClientAddr)
+	}
+	return c, cwq, n, nwq
+}
+
+// checkUnanswered checks that a connection attempt to addr gets no response.
+func (tb *tcpTestbed) checkUnanswered(t *testing.T, addr tcpip.Address) {
+	t.Helper()
+
+	before := tb.server.MutableStats().UnknownNetworkEndpointRcvdPackets.Value()
+	var wq waiter.Queue
+	c, err := tb.client.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer c.Close()
+	if err := c.Connect(tcpip.FullAddress{Addr: addr, Port: tcpServerPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Connect = %v, want %v", err, tcpip.ErrConnectStarted)
+	}
+	for end := time.Now().Add(5 * time.Second); tb.server.MutableStats().UnknownNetworkEndpointRcvdPackets.Value() == before; time.Sleep(time.Millisecond) {
+		if time.Now().After(end) {
+			t.Fatalf("timed out waiting for the SYN to %v to be dropped", addr)
+		}
+	}
+	if n, _, err := tb.listener.Accept(); err != tcpip.ErrWouldBlock {
+		n.Close()
+		t.Fatalf("Accept = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestPromiscuousModeAcceptsConnections(t *testing.T) {
+	const madeUpAddr = tcpip.Address("\x0a\x00\x00\x63")
+
+	tb := newTCPTestbed(t)
+	defer tb.close()
+	if err := tb.server.SetPromiscuousMode(1, true); err != nil {
+		t.Fatalf("SetPromiscuousMode failed: %v", err)
+	}
+
+	c, cwq, n, nwq := tb.connect(t, madeUpAddr)
+	defer c.Close()
+	defer n.Close()
+
+	// Responses are sent from the address the connection was made to, so
+	// they reach the client.
+	cwe, cch := waiter.NewChannelEntry(nil)
+	cwq.EventRegister(&cwe, waiter.EventIn)
+	defer cwq.EventUnregister(&cwe)
+	nwe, nch := waiter.NewChannelEntry(nil)
+	nwq.EventRegister(&nwe, waiter.EventIn)
+	defer nwq.EventUnregister(&nwe)
+	data := []byte("hello")
+	if _, err := c.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case <-nch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the request")
+	}
+	if v, _, err := n.Read(nil); err != nil || string(v) != string(data) {
+		t.Fatalf("Read = %q, %v, want %q, nil", v, err, data)
+	}
+	if _, err := n.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case <-cch:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the response")
+	}
+	if v, _, err := c.Read(nil); err != nil || string(v) != string(data) {
+		t.Fatalf("Read = %q, %v, want %q, nil", v, err, data)
+	}
+}
+
+func TestSubnetAcceptsConnections(t *testing.T) {
+	tb := newTCPTestbed(t)
+	defer tb.close()
+	subnet, nerr := tcpip.NewSubnet("\x0a\x00\x01\x00", "\xff\xff\xff\x00")
+	if nerr != nil {
+		t.Fatalf("NewSubnet failed: %v", nerr)
+	}
+	if err := tb.server.AddSubnet(1, ipv4.ProtocolNumber, subnet); err != nil {
+		t.Fatalf("AddSubnet failed: %v", err)
+	}
+
+	// The single listener accepts connections to any address within the
+	// subnet.
+	for _, addr := range []tcpip.Address{"\x0a\x00\x01\x01", "\x0a\x00\x01\x05", "\x0a\x00\x01\xfe"} {
+		c, _, n, _ := tb.connect(t, addr)
+		c.Close()
+		n.Close()
+	}
+
+	// Addresses within the subnet can also be bound to.
+	var wq waiter.Queue
+	ep, err := tb.server.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Addr: "\x0a\x00\x02\x07"}, nil); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("Bind to an address outside the subnet = %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Addr: "\x0a\x00\x01\x07"}, nil); err != nil {
+		t.Fatalf("Bind to an address within the subnet failed: %v", err)
+	}
+
+	// Unlike promiscuous mode, subnets are scoped.
+	const outside = "\x0a\x00\x02\x01"
+	tb.checkUnanswered(t, outside)
+	if err := tb.server.SetPromiscuousMode(1, true); err != nil {
+		t.Fatalf("SetPromiscuousMode failed: %v", err)
+	}
+	c, _, n, _ := tb.connect(t, outside)
+	c.Close()
+	n.Close()
+}
+
+// ipv4Packet builds an IPv4 packet with the given addresses, TTL and payload.
+func ipv4Packet(src, dst tcpip.Address, ttl uint8, payload string) buffer.View {
+	v := buffer.NewView(header.IPv4MinimumSize + len(payload))
+	ip := header.IPv4(v)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(v)),
+		TTL:         ttl,
+		Protocol:    uint8(header.UDPProtocolNumber),
+		SrcAddr:     src,
+		DstAddr:     dst,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	copy(v[header.IPv4MinimumSize:], payload)
+	return v
+}
+
+func TestForwarding(t *testing.T) {
+	// NIC i has address 10.0.i.1, and the route to 10.0.i.0/24.
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, nil)
+	linkEPs := make(map[tcpip.NICID]*channel.Endpoint)
+	var routes []tcpip.Route
+	for nic := tcpip.NICID(1); nic <= 3; nic++ {
+		id, linkEP := channel.New(10, defaultMTU, "")
+		if err := s.CreateNIC(nic, id); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+		if err := s.AddAddress(nic, ipv4.ProtocolNumber, tcpip.Address([]byte{10, 0, byte(nic), 1})); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+		linkEPs[nic] = linkEP
+		routes = append(routes, tcpip.Route{
+			Destination: tcpip.Address([]byte{10, 0, byte(nic), 0}),
+			Mask:        "\xff\xff\xff\x00",
+			NIC:         nic,
+		})
+	}
+	s.SetRouteTable(routes)
+
+	// Only the first two NICs forward packets.
+	for _, nic := range []tcpip.NICID{1, 2} {
+		if err := s.SetForwarding(nic, true); err != nil {
+			t.Fatalf("SetForwarding(%d) failed: %v", nic, err)
+		}
+	}
+	if err := s.SetForwarding(4, true); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("SetForwarding(4) = %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+	if !s.Forwarding(1) || s.Forwarding(3) {
+		t.Fatalf("got Forwarding(1) = %t, Forwarding(3) = %t, want true, false", s.Forwarding(1), s.Forwarding(3))
+	}
+
+	// send injects a packet from host 10.0.from.2 to host 10.0.to.2, and
+	// returns whether it was forwarded.
+	send := func(from, to tcpip.NICID, ttl uint8) bool {
+		t.Helper()
+		src := tcpip.Address([]byte{10, 0, byte(from), 2})
+		dst := tcpip.Address([]byte{10, 0, byte(to), 2})
+		v := ipv4Packet(src, dst, ttl, "payload")
+		vv := v.ToVectorisedView([1]buffer.View{})
+		linkEPs[from].Inject(ipv4.ProtocolNumber, &vv)
+
+		for nic, linkEP := range linkEPs {
+			select {
+			case p := <-linkEP.C:
+				if nic != to {
+					t.Fatalf("packet from NIC %d to NIC %d forwarded through NIC %d", from, to, nic)
+				}
+				b := append(append(buffer.View(nil), p.Header...), p.Payload...)
+				checker.IPv4(t, b, checker.SrcAddr(src), checker.DstAddr(dst), checker.TTL(ttl-1))
+				if got := string(b[header.IPv4MinimumSize:]); got != "payload" {
+					t.Fatalf("got forwarded payload %q, want %q", got, "payload")
+				}
+				return true
+			default:
+			}
+		}
+		return false
+	}
+
+	for _, test := range []struct {
+		from, to tcpip.NICID
+		want     bool
+	}{
+		{1, 2, true},
+		{2, 1, true},
+		{1, 3, false},
+		{3, 1, false},
+	} {
+		if got := send(test.from, test.to, 64); got != test.want {
+			t.Errorf("got packet from NIC %d to NIC %d forwarded = %t, want %t", test.from, test.to, got, test.want)
+		}
+	}
+
+	// Packets whose TTL would expire aren't forwarded.
+	if send(1, 2, 1) {
+		t.Errorf("packet with TTL 1 forwarded")
+	}
+
+	stats := s.NICInfo()[2].Stats
+	if want := uint64(header.IPv4MinimumSize + len("payload")); stats.ForwardedPackets != 1 || stats.ForwardedBytes != want {
+		t.Errorf("got NIC 2 forwarded %d packets and %d bytes, want 1 and %d", stats.ForwardedPackets, stats.ForwardedBytes, want)
+	}
+
+	s.SetForwardingAll(true)
+	if !send(1, 3, 64) || !send(3, 1, 64) {
+		t.Errorf("packets between NIC 1 and NIC 3 not forwarded after SetForwardingAll(true)")
+	}
+	s.SetForwardingAll(false)
+	if send(1, 2, 64) {
+		t.Errorf("packet forwarded after SetForwardingAll(false)")
+	}
+}
+
+func TestHostModel(t *testing.T) {
+	// NIC i has address 10.0.i.1, and the route to 10.0.i.0/24. They both
+	// forward packets, which doesn't matter for packets to one another.
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	linkEPs := make(map[tcpip.NICID]*channel.Endpoint)
+	var routes []tcpip.Route
+	for nic := tcpip.NICID(1); nic <= 2; nic++ {
+		id, linkEP := channel.New(10, defaultMTU, "")
+		if err := s.CreateNIC(nic, id); err != nil {
+			t.Fatalf("CreateNIC failed: %v", err)
+		}
+		if err := s.AddAddress(nic, ipv4.ProtocolNumber, tcpip.Address([]byte{10, 0, byte(nic), 1})); err != nil {
+			t.Fatalf("AddAddress failed: %v", err)
+		}
+		linkEPs[nic] = linkEP
+		routes = append(routes, tcpip.Route{
+			Destination: tcpip.Address([]byte{10, 0, byte(nic), 0}),
+			Mask:        "\xff\xff\xff\x00",
+			NIC:         nic,
+		})
+	}
+	s.SetRouteTable(routes)
+	s.SetForwardingAll(true)
+
+	// The endpoint has the address of NIC 2, and host 10.0.1.2 sends
+	// packets to it through NIC 1.
+	const port = 1234
+	localAddr := tcpip.FullAddress{Addr: "\x0a\x00\x02\x01", Port: port}
+	remoteAddr := tcpip.FullAddress{Addr: "\x0a\x00\x01\x02", Port: port}
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(localAddr, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// receive injects a packet from the remote host through NIC 1, and
+	// returns whether it was delivered to the endpoint.
+	receive := func() bool {
+		t.Helper()
+		u := make(buffer.View, header.UDPMinimumSize)
+		header.UDP(u).Encode(&header.UDPFields{
+			SrcPort: port,
+			DstPort: port,
+			Length:  header.UDPMinimumSize,
+		})
+		v := ipv4Packet(remoteAddr.Addr, localAddr.Addr, 64, string(u))
+		vv := v.ToVectorisedView([1]buffer.View{})
+		linkEPs[1].Inject(ipv4.ProtocolNumber, &vv)
+
+		for nic, linkEP := range linkEPs {
+			select {
+			case <-linkEP.C:
+				t.Fatalf("packet to a local address forwarded through NIC %d", nic)
+			default:
+			}
+		}
+		_, _, err := ep.Read(nil)
+		return err == nil
+	}
+
+	// The strong host model is the default one.
+	if receive() {
+		t.Fatalf("packet to NIC 2 delivered through NIC 1 in the strong host model")
+	}
+	if got := s.MutableStats().IP.StrongHostDrops.Value(); got != 1 {
+		t.Fatalf("got StrongHostDrops = %d, want 1", got)
+	}
+	if _, err := ep.Write(tcpip.SlicePayload("reply"), tcpip.WriteOptions{To: &remoteAddr}); err != tcpip.ErrNoRoute {
+		t.Fatalf("got Write error %v in the strong host model, want %v", err, tcpip.ErrNoRoute)
+	}
+
+	// NICs follow the host model of the stack unless they have their own.
+	if err := s.SetHostModel(stack.WeakHostModel); err != nil {
+		t.Fatalf("SetHostModel failed: %v", err)
+	}
+	if !receive() {
+		t.Fatalf("packet to NIC 2 not delivered through NIC 1 in the weak host model of the stack")
+	}
+	if err := s.SetNICHostModel(1, stack.StrongHostModel); err != nil {
+		t.Fatalf("SetNICHostModel failed: %v", err)
+	}
+	if receive() {
+		t.Fatalf("packet to NIC 2 delivered through NIC 1 in the strong host model of the NIC")
+	}
+	if got := s.MutableStats().IP.StrongHostDrops.Value(); got != 2 {
+		t.Fatalf("got StrongHostDrops = %d, want 2", got)
+	}
+
+	// In the weak host model, the packet is delivered, and the reply is sent
+	// through NIC 1 from the address of NIC 2.
+	if err := s.SetHostModel(stack.StrongHostModel); err != nil {
+		t.Fatalf("SetHostModel failed: %v", err)
+	}
+	if err := s.SetNICHostModel(1, stack.WeakHostModel); err != nil {
+		t.Fatalf("SetNICHostModel failed: %v", err)
+	}
+	if !receive() {
+		t.Fatalf("packet to NIC 2 not delivered through NIC 1 in the weak host model of the NIC")
+	}
+	if _, err := ep.Write(tcpip.SlicePayload("reply"), tcpip.WriteOptions{To: &remoteAddr}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case p := <-linkEPs[1].C:
+		b := append(append(buffer.View(nil), p.Header...), p.Payload...)
+		checker.IPv4(t, b, checker.SrcAddr(localAddr.Addr), checker.DstAddr(remoteAddr.Addr))
+	default:
+		t.Fatalf("reply not sent through NIC 1")
+	}
+
+	if err := s.SetHostModel(stack.DefaultHostModel); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("got SetHostModel(DefaultHostModel) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := s.SetNICHostModel(3, stack.WeakHostModel); err != tcpip.ErrUnknownNICID {
+		t.Errorf("got SetNICHostModel(3) = %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+}
+
 func TestAddressSpoofing(t *testing.T) {
 	srcAddr := tcpip.Address("\x01")
 	dstAddr := tcpip.Address("\x02")
@@ -713,6 +1332,723 @@ func TestSubnetRejectsNonmatchingPacket(t *testing.T) {
 	}
 }
 
+func checkMulticastFilters(t *testing.T, linkEP *channel.Endpoint, want ...tcpip.LinkAddress) {
+	t.Helper()
+	got := linkEP.MulticastFilters()
+	if len(got) != len(want) {
+		t.Fatalf("MulticastFilters() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("MulticastFilters() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestMulticastGroups(t *testing.T) {
+	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, nil)
+
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	const (
+		// group1 and group2 map to the same link address.
+		group1 = tcpip.Address("\xe0\x01\x01\x01")
+		group2 = tcpip.Address("\xe1\x01\x01\x01")
+		group3 = tcpip.Address("\xff\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xff\x00\x00\x01")
+
+		mac12 = tcpip.LinkAddress("\x01\x00\x5e\x01\x01\x01")
+		mac3  = tcpip.LinkAddress("\x33\x33\xff\x00\x00\x01")
+	)
+
+	// Non-multicast addresses and non-IP protocols can't be joined.
+	if err := s.JoinGroup(header.IPv4ProtocolNumber, 1, "\x0a\x00\x00\x01"); err != tcpip.ErrBadAddress {
+		t.Fatalf("JoinGroup(unicast) = %v, want %v", err, tcpip.ErrBadAddress)
+	}
+	if err := s.JoinGroup(fakeNetNumber, 1, group1); err != tcpip.ErrNotSupported {
+		t.Fatalf("JoinGroup(fakeNet) = %v, want %v", err, tcpip.ErrNotSupported)
+	}
+	if err := s.JoinGroup(header.IPv4ProtocolNumber, 2, group1); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("JoinGroup(nic 2) = %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+	checkMulticastFilters(t, linkEP)
+
+	// Join all groups, group1 twice.
+	for _, g := range []struct {
+		protocol tcpip.NetworkProtocolNumber
+		addr     tcpip.Address
+	}{
+		{header.IPv4ProtocolNumber, group1},
+		{header.IPv4ProtocolNumber, group1},
+		{header.IPv4ProtocolNumber, group2},
+		{header.IPv6ProtocolNumber, group3},
+	} {
+		if err := s.JoinGroup(g.protocol, 1, g.addr); err != nil {
+			t.Fatalf("JoinGroup(%v) failed: %v", g.addr, err)
+		}
+	}
+	checkMulticastFilters(t, linkEP, mac12, mac3)
+
+	// group1 is still joined once, and group2 still needs the same filter.
+	if err := s.LeaveGroup(header.IPv4ProtocolNumber, 1, group1); err != nil {
+		t.Fatalf("LeaveGroup(group1) failed: %v", err)
+	}
+	if err := s.LeaveGroup(header.IPv4ProtocolNumber, 1, group2); err != nil {
+		t.Fatalf("LeaveGroup(group2) failed: %v", err)
+	}
+	checkMulticastFilters(t, linkEP, mac12, mac3)
+
+	// Leaving the last group using a filter removes it.
+	if err := s.LeaveGroup(header.IPv4ProtocolNumber, 1, group1); err != nil {
+		t.Fatalf("LeaveGroup(group1) failed: %v", err)
+	}
+	checkMulticastFilters(t, linkEP, mac3)
+
+	if err := s.LeaveGroup(header.IPv6ProtocolNumber, 1, group3); err != nil {
+		t.Fatalf("LeaveGroup(group3) failed: %v", err)
+	}
+	checkMulticastFilters(t, linkEP)
+
+	// Groups that aren't joined can't be left.
+	if err := s.LeaveGroup(header.IPv4ProtocolNumber, 1, group1); err != tcpip.ErrBadLocalAddress {
+		t.Fatalf("LeaveGroup(group1) = %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+}
+
+func TestNICInfo(t *testing.T) {
+	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, nil)
+
+	const linkAddr = tcpip.LinkAddress("\x01\x02\x03\x04\x05\x06")
+	id, _ := channel.New(10, defaultMTU, linkAddr)
+	if err := s.CreateNamedNIC(1, "eth0", id); err != nil {
+		t.Fatalf("CreateNamedNIC failed: %v", err)
+	}
+	if err := s.CreateNamedNIC(2, "lo", loopback.New()); err != nil {
+		t.Fatalf("CreateNamedNIC failed: %v", err)
+	}
+
+	if err := s.AddAddressWithOptions(1, fakeNetNumber, "\x0a", stack.AddressOptions{PrefixLen: 4}); err != nil {
+		t.Fatalf("AddAddressWithOptions failed: %v", err)
+	}
+	if err := s.AddAddressWithOptions(1, fakeNetNumber, "\x0b", stack.AddressOptions{PrefixLen: 9}); err != tcpip.ErrBadAddress {
+		t.Fatalf("AddAddressWithOptions with an invalid prefix length = %v, want %v", err, tcpip.ErrBadAddress)
+	}
+	if err := s.AddAddress(2, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.SetPromiscuousMode(1, true); err != nil {
+		t.Fatalf("SetPromiscuousMode failed: %v", err)
+	}
+
+	want := map[tcpip.NICID]stack.NICInfo{
+		1: {
+			Name:              "eth0",
+			LinkAddress:       linkAddr,
+			ProtocolAddresses: []tcpip.ProtocolAddress{{Protocol: fakeNetNumber, Address: "\x0a", PrefixLen: 4}},
+			MTU:               defaultMTU,
+			Flags:             stack.NICStateFlags{Up: true, Promiscuous: true},
+		},
+		2: {
+			Name:              "lo",
+			ProtocolAddresses: []tcpip.ProtocolAddress{{Protocol: fakeNetNumber, Address: "\x01", PrefixLen: 8}},
+			MTU:               65536,
+			Flags:             stack.NICStateFlags{Up: true, Loopback: true},
+		},
+	}
+	if got := s.NICInfo(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got NICInfo() = %+v, want %+v", got, want)
+	}
+
+	wantRanges := map[tcpip.NICID][]tcpip.Subnet{
+		1: {mustSubnet(t, "\x00", "\xf0")},
+		2: {mustSubnet(t, "\x01", "\xff")},
+	}
+	if got := s.NICAddressRanges(); !reflect.DeepEqual(got, wantRanges) {
+		t.Fatalf("got NICAddressRanges() = %v, want %v", got, wantRanges)
+	}
+
+	// The report follows address changes and detaching.
+	if err := s.RemoveAddress(1, "\x0a"); err != nil {
+		t.Fatalf("RemoveAddress failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x0b"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.DetachLinkEndpoint(1); err != nil {
+		t.Fatalf("DetachLinkEndpoint failed: %v", err)
+	}
+	info := want[1]
+	info.ProtocolAddresses = []tcpip.ProtocolAddress{{Protocol: fakeNetNumber, Address: "\x0b", PrefixLen: 8}}
+	info.Flags.Up = false
+	want[1] = info
+	if got := s.NICInfo(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got NICInfo() = %+v, want %+v", got, want)
+	}
+	wantRanges[1] = []tcpip.Subnet{mustSubnet(t, "\x0b", "\xff")}
+	if got := s.NICAddressRanges(); !reflect.DeepEqual(got, wantRanges) {
+		t.Fatalf("got NICAddressRanges() = %v, want %v", got, wantRanges)
+	}
+
+	// Reports taken while an address is being added and removed have it
+	// or not, along the other one.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.AddAddress(1, fakeNetNumber, "\x0c")
+			s.RemoveAddress(1, "\x0c")
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		addrs := s.NICInfo()[1].ProtocolAddresses
+		if len(addrs) == 0 || len(addrs) > 2 {
+			t.Fatalf("got addresses %v, want 1 or 2", addrs)
+		}
+	}
+}
+
+func mustSubnet(t *testing.T, addr tcpip.Address, mask tcpip.AddressMask) tcpip.Subnet {
+	t.Helper()
+	sn, err := tcpip.NewSubnet(addr, mask)
+	if err != nil {
+		t.Fatalf("NewSubnet(%v, %v) failed: %v", addr, mask, err)
+	}
+	return sn
+}
+
+func TestSetLinkAddress(t *testing.T) {
+	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, nil)
+
+	id, linkEP := channel.New(10, defaultMTU, "\x01\x02\x03\x04\x05\x06")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.CreateNIC(2, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	const addr = tcpip.LinkAddress("\x01\x02\x03\x04\x05\x07")
+	if err := s.SetLinkAddress(1, addr); err != nil {
+		t.Fatalf("SetLinkAddress(1) failed: %v", err)
+	}
+	if got := linkEP.LinkAddress(); got != addr {
+		t.Fatalf("got LinkAddress() = %q, want %q", got, addr)
+	}
+	if got := s.NICInfo()[1].LinkAddress; got != addr {
+		t.Fatalf("got NICInfo()[1].LinkAddress = %q, want %q", got, addr)
+	}
+
+	if err := s.SetLinkAddress(2, addr); err != tcpip.ErrNotSupported {
+		t.Fatalf("SetLinkAddress(2) = %v, want %v", err, tcpip.ErrNotSupported)
+	}
+	if err := s.SetLinkAddress(3, addr); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("SetLinkAddress(3) = %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+}
+
+func TestSetLinkMTU(t *testing.T) {
+	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, nil)
+
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.CreateNIC(2, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	const mtu = 9000
+	if err := s.SetLinkMTU(1, mtu); err != nil {
+		t.Fatalf("SetLinkMTU(1) failed: %v", err)
+	}
+	if got := linkEP.MTU(); got != mtu {
+		t.Fatalf("got MTU() = %d, want %d", got, mtu)
+	}
+
+	if err := s.SetLinkMTU(2, mtu); err != tcpip.ErrNotSupported {
+		t.Fatalf("SetLinkMTU(2) = %v, want %v", err, tcpip.ErrNotSupported)
+	}
+	if err := s.SetLinkMTU(3, mtu); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("SetLinkMTU(3) = %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+}
+
+func TestDeleteNIC(t *testing.T) {
+	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, nil)
+
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	if err := s.DeleteNIC(1); err != nil {
+		t.Fatalf("DeleteNIC failed: %v", err)
+	}
+	if _, ok := s.NICInfo()[1]; ok {
+		t.Fatalf("NIC 1 still exists after DeleteNIC")
+	}
+	if _, err := s.FindRoute(1, "\x01", "\x02", fakeNetNumber); err != tcpip.ErrNoRoute {
+		t.Fatalf("FindRoute after DeleteNIC = %v, want %v", err, tcpip.ErrNoRoute)
+	}
+
+	// The link endpoint was closed.
+	hdr := buffer.NewPrependable(0)
+	if err := linkEP.WritePacket(&stack.Route{}, nil, &hdr, nil, fakeNetNumber); err != tcpip.ErrClosedForSend {
+		t.Fatalf("WritePacket after DeleteNIC = %v, want %v", err, tcpip.ErrClosedForSend)
+	}
+
+	if err := s.DeleteNIC(1); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("DeleteNIC(1) = %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+
+	// The id can be reused.
+	id, _ = channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC after DeleteNIC failed: %v", err)
+	}
+}
+
+// closedStack creates a stack with a listening and a connecting TCP endpoint,
+// then closes it. The endpoints are closed after the stack, as users would.
+func closedStack(t *testing.T) *stack.Stack {
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	id, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, "\x0a\x00\x00\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	var wq waiter.Queue
+	listener, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Port: 80}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := listener.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	conn, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.Connect(tcpip.FullAddress{Addr: "\x0a\x00\x00\x02", Port: 80}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Connect = %v, want %v", err, tcpip.ErrConnectStarted)
+	}
+
+	s.Close(stack.CloseOptions{})
+	return s
+}
+
+func TestClose(t *testing.T) {
+	s := closedStack(t)
+
+	if _, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{}); err != tcpip.ErrInvalidEndpointState {
+		t.Errorf("NewEndpoint after Close = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+	id, _ := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(2, id); err != tcpip.ErrInvalidEndpointState {
+		t.Errorf("CreateNIC after Close = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, "\x0a\x00\x00\x03"); err != tcpip.ErrInvalidEndpointState {
+		t.Errorf("AddAddress after Close = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+	if _, err := s.FindRoute(0, "", "\x0a\x00\x00\x02", ipv4.ProtocolNumber); err != tcpip.ErrInvalidEndpointState {
+		t.Errorf("FindRoute after Close = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+	if got := len(s.NICInfo()); got != 0 {
+		t.Errorf("got %d NICs after Close, want 0", got)
+	}
+
+	// Closing again does nothing.
+	s.Close(stack.CloseOptions{})
+}
+
+func TestCloseLeaksNoGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		closedStack(t)
+	}
+
+	// Goroutines that were told to exit may not have been scheduled yet.
+	var after int
+	for end := time.Now().Add(5 * time.Second); time.Now().Before(end); time.Sleep(10 * time.Millisecond) {
+		if after = runtime.NumGoroutine(); after <= before {
+			return
+		}
+	}
+	t.Fatalf("got %d goroutines after closing 100 stacks, want at most %d", after, before)
+}
+
+func TestAttachLinkEndpoint(t *testing.T) {
+	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, nil)
+
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	const (
+		group = tcpip.Address("\xe0\x01\x01\x01")
+		mac   = tcpip.LinkAddress("\x01\x00\x5e\x01\x01\x01")
+	)
+	if err := s.JoinGroup(header.IPv4ProtocolNumber, 1, group); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+
+	r, err := s.FindRoute(0, "", "\x03", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+	send := func() *tcpip.Error {
+		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+		return r.WritePacket(nil, &hdr, nil, fakeTransNumber)
+	}
+
+	fakeNet := s.NetworkProtocolInstance(fakeNetNumber).(*fakeNetworkProtocol)
+	receive := func(linkEP *channel.Endpoint) int {
+		before := fakeNet.packetCount[1]
+		buf := buffer.NewView(30)
+		buf[0] = 1
+		var views [1]buffer.View
+		vv := buf.ToVectorisedView(views)
+		linkEP.Inject(fakeNetNumber, &vv)
+		return fakeNet.packetCount[1] - before
+	}
+
+	if err := send(); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	if c := linkEP.Drain(); c != 1 {
+		t.Fatalf("got %d packets on the link, want 1", c)
+	}
+	if got := receive(linkEP); got != 1 {
+		t.Fatalf("got %d packets delivered, want 1", got)
+	}
+
+	// The NIC can only be attached once detached.
+	newID, newLinkEP := channel.New(10, defaultMTU, "")
+	if err := s.AttachLinkEndpoint(1, newID); err != tcpip.ErrInvalidEndpointState {
+		t.Fatalf("AttachLinkEndpoint before detaching = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+
+	// While detached, nothing goes through the NIC.
+	if err := s.DetachLinkEndpoint(1); err != nil {
+		t.Fatalf("DetachLinkEndpoint failed: %v", err)
+	}
+	if err := s.DetachLinkEndpoint(1); err != tcpip.ErrInvalidEndpointState {
+		t.Fatalf("DetachLinkEndpoint twice = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+	if err := send(); err != tcpip.ErrNoRoute {
+		t.Fatalf("WritePacket while detached = %v, want %v", err, tcpip.ErrNoRoute)
+	}
+	if got := receive(linkEP); got != 0 {
+		t.Fatalf("got %d packets delivered from the detached link, want 0", got)
+	}
+
+	// Traffic resumes over the new link, with the same route, addresses
+	// and groups.
+	if err := s.AttachLinkEndpoint(1, newID); err != nil {
+		t.Fatalf("AttachLinkEndpoint failed: %v", err)
+	}
+	if err := send(); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	if c := newLinkEP.Drain(); c != 1 {
+		t.Fatalf("got %d packets on the new link, want 1", c)
+	}
+	if c := linkEP.Drain(); c != 0 {
+		t.Fatalf("got %d packets on the old link, want 0", c)
+	}
+	if got := receive(newLinkEP); got != 1 {
+		t.Fatalf("got %d packets delivered from the new link, want 1", got)
+	}
+	if got := receive(linkEP); got != 0 {
+		t.Fatalf("got %d packets delivered from the old link, want 0", got)
+	}
+	checkMulticastFilters(t, newLinkEP, mac)
+
+	// The detached link endpoint isn't closed with the NIC.
+	if err := s.DeleteNIC(1); err != nil {
+		t.Fatalf("DeleteNIC failed: %v", err)
+	}
+	hdr := buffer.NewPrependable(0)
+	if err := linkEP.WritePacket(&stack.Route{}, nil, &hdr, nil, fakeNetNumber); err != nil {
+		t.Fatalf("WritePacket on the detached link failed: %v", err)
+	}
+}
+
+// failingLinkEndpoint is a link endpoint whose writes fail when fail is set.
+type failingLinkEndpoint struct {
+	stack.LinkEndpoint
+	fail bool
+}
+
+func (e *failingLinkEndpoint) WritePacket(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if e.fail {
+		return tcpip.ErrClosedForSend
+	}
+	return e.LinkEndpoint.WritePacket(r, csum, hdr, payload, protocol)
+}
+
+func TestNICStats(t *testing.T) {
+	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, nil)
+
+	_, linkEP := channel.New(10, defaultMTU, "")
+	ep := &failingLinkEndpoint{LinkEndpoint: linkEP}
+	if err := s.CreateNIC(1, stack.RegisterLinkEndpoint(ep)); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	var views [1]buffer.View
+	buf := buffer.NewView(30)
+
+	// A packet for the NIC's address. No transport protocol is registered,
+	// so it's dropped once it gets there.
+	buf[0] = 1
+	vv := buf.ToVectorisedView(views)
+	linkEP.Inject(fakeNetNumber, &vv)
+
+	// A packet for an address the NIC doesn't have.
+	buf[0] = 5
+	vv = buf.ToVectorisedView(views)
+	linkEP.Inject(fakeNetNumber, &vv)
+
+	// A packet of an unknown network protocol.
+	vv = buf.ToVectorisedView(views)
+	linkEP.Inject(fakeNetNumber-1, &vv)
+
+	// A packet too short to hold a header.
+	short := buf[:fakeNetHeaderLen-1]
+	vv = short.ToVectorisedView(views)
+	linkEP.Inject(fakeNetNumber, &vv)
+
+	// One packet is sent successfully, and one isn't.
+	sendTo(t, s, "\x03")
+	ep.fail = true
+	r, err := s.FindRoute(0, "", "\x03", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+	if err := r.WritePacket(nil, &hdr, nil, fakeTransNumber); err != tcpip.ErrClosedForSend {
+		t.Fatalf("WritePacket = %v, want %v", err, tcpip.ErrClosedForSend)
+	}
+	r.Release()
+
+	want := tcpip.NICStats{
+		TxPackets:                1,
+		TxBytes:                  fakeNetHeaderLen,
+		TxErrors:                 1,
+		RxPackets:                4,
+		RxBytes:                  3*30 + fakeNetHeaderLen - 1,
+		RxUnknownProtocolPackets: 2,
+		RxMalformedPackets:       1,
+		RxNoEndpointPackets:      1,
+	}
+	got, err := s.NICStats(1)
+	if err != nil {
+		t.Fatalf("NICStats failed: %v", err)
+	}
+	if got != want {
+		t.Fatalf("got NICStats(1) = %+v, want %+v", got, want)
+	}
+	if got := s.NICInfo()[1].Stats; got != want {
+		t.Fatalf("got NICInfo()[1].Stats = %+v, want %+v", got, want)
+	}
+
+	if _, err := s.NICStats(2); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("NICStats(2) = %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+}
+
+func TestNICStatsMulticastBroadcast(t *testing.T) {
+	const (
+		localAddr = tcpip.Address("\x0a\x00\x00\x01")
+		group     = tcpip.Address("\xe0\x00\x00\x01")
+		protocol  = 99
+	)
+
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, nil)
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Gateway: "", NIC: 1}})
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	if err := s.JoinGroup(ipv4.ProtocolNumber, 1, group); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+
+	// Receive a unicast, a multicast and a broadcast packet.
+	var views [1]buffer.View
+	for _, dst := range []tcpip.Address{localAddr, group, header.IPv4Broadcast} {
+		buf := buffer.NewView(header.IPv4MinimumSize)
+		ip := header.IPv4(buf)
+		ip.Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: header.IPv4MinimumSize,
+			TTL:         64,
+			Protocol:    protocol,
+			SrcAddr:     "\x0a\x00\x00\x02",
+			DstAddr:     dst,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+		vv := buf.ToVectorisedView(views)
+		linkEP.Inject(ipv4.ProtocolNumber, &vv)
+	}
+
+	// Send the same kinds of packets.
+	for _, dst := range []tcpip.Address{"\x0a\x00\x00\x02", group, header.IPv4Broadcast} {
+		r, err := s.FindRoute(1, localAddr, dst, ipv4.ProtocolNumber)
+		if err != nil {
+			t.Fatalf("FindRoute(%v) failed: %v", dst, err)
+		}
+		hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+		if err := r.WritePacket(nil, &hdr, nil, protocol); err != nil {
+			t.Fatalf("WritePacket(%v) failed: %v", dst, err)
+		}
+		r.Release()
+	}
+	if c := linkEP.Drain(); c != 3 {
+		t.Fatalf("got %d outbound packets, want 3", c)
+	}
+
+	want := tcpip.NICStats{
+		TxPackets:                3,
+		TxBytes:                  3 * header.IPv4MinimumSize,
+		TxMulticastPackets:       1,
+		TxBroadcastPackets:       1,
+		RxPackets:                3,
+		RxBytes:                  3 * header.IPv4MinimumSize,
+		RxMulticastPackets:       1,
+		RxBroadcastPackets:       1,
+		RxUnknownProtocolPackets: 2,
+		RxNoEndpointPackets:      1,
+	}
+	got, err := s.NICStats(1)
+	if err != nil {
+		t.Fatalf("NICStats failed: %v", err)
+	}
+	if got != want {
+		t.Fatalf("got NICStats(1) = %+v, want %+v", got, want)
+	}
+}
+
+// randomValues are the values drawn by a stack from its random source that
+// are visible on the wire.
+type randomValues struct {
+	tcpPort uint16
+	iss     uint32
+	udpPort uint16
+	ipID    uint16
+}
+
+// seededRandomValues connects a TCP endpoint and then writes a UDP datagram
+// from a stack seeded with the given seed, and returns the random values of
+// the packets sent.
+func seededRandomValues(t *testing.T, seed int64) randomValues {
+	t.Helper()
+
+	s := stack.NewWithRand(nil, testutil.NewSeededRand(seed), []string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+	defer s.Close(stack.CloseOptions{})
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, "\x0a\x00\x00\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Gateway: "", NIC: 1}})
+	remote := tcpip.FullAddress{Addr: "\x0a\x00\x00\x02", Port: 80}
+
+	nextPacket := func() buffer.View {
+		t.Helper()
+		select {
+		case p := <-linkEP.C:
+			return append(append(buffer.View(nil), p.Header...), p.Payload...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a packet")
+			return nil
+		}
+	}
+
+	var v randomValues
+	var wq waiter.Queue
+	tcpEP, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer tcpEP.Close()
+	if err := tcpEP.Connect(remote); err != tcpip.ErrConnectStarted {
+		t.Fatalf("got Connect = %v, want %v", err, tcpip.ErrConnectStarted)
+	}
+	syn := header.TCP(header.IPv4(nextPacket()).Payload())
+	v.tcpPort = syn.SourcePort()
+	v.iss = syn.SequenceNumber()
+
+	udpEP, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer udpEP.Close()
+	// The datagram is large enough for an IP identifier to be assigned.
+	if _, err := udpEP.Write(tcpip.SlicePayload(make([]byte, 100)), tcpip.WriteOptions{To: &remote}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	for {
+		ip := header.IPv4(nextPacket())
+		if ip.TransportProtocol() != udp.ProtocolNumber {
+			// Skip SYN retransmissions.
+			continue
+		}
+		v.udpPort = header.UDP(ip.Payload()).SourcePort()
+		v.ipID = ip.ID()
+		return v
+	}
+}
+
+func TestSeededRand(t *testing.T) {
+	first := seededRandomValues(t, 1)
+	if second := seededRandomValues(t, 1); second != first {
+		t.Errorf("got %+v from the second stack seeded with 1, want %+v as from the first one", second, first)
+	}
+	if other := seededRandomValues(t, 2); other == first {
+		t.Errorf("got %+v from stacks seeded with 1 and 2, want different values", first)
+	}
+}
+
 func TestNetworkOptions(t *testing.T) {
 	s := stack.New(&tcpip.StdClock{}, []string{"fakeNet"}, []string{})
 
@@ -0,0 +1,364 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/bpf"
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+// PacketTapQueueLen is the number of captured packets a packet tap buffers.
+// Packets captured while the buffer is full are dropped.
+const PacketTapQueueLen = 256
+
+// broadcastMAC is the link address of broadcast frames.
+const broadcastMAC = tcpip.LinkAddress("\xff\xff\xff\xff\xff\xff")
+
+// PacketDirection is the direction of a packet relative to the NIC.
+type PacketDirection int
+
+const (
+	// PacketInbound is the direction of packets received by the NIC.
+	PacketInbound PacketDirection = iota
+
+	// PacketOutbound is the direction of packets sent by the NIC.
+	PacketOutbound
+)
+
+// TappedPacket is a copy of a packet captured by a packet tap.
+type TappedPacket struct {
+	// Direction is the direction of the packet.
+	Direction PacketDirection
+
+	// Timestamp is the time at which the packet was captured, as returned
+	// by the stack's clock.
+	Timestamp int64
+
+	// Protocol is the network protocol of the packet.
+	Protocol tcpip.NetworkProtocolNumber
+
+	// Data holds the network-layer packet, truncated to the snap length of
+	// the tap.
+	Data buffer.View
+
+	// Length is the length of the packet before truncation.
+	Length int
+}
+
+// PacketTap receives copies of the packets sent and received by a NIC. It is
+// created by Stack.AttachPacketTap.
+type PacketTap struct {
+	// dropped is the number of packets dropped because C was full. It is
+	// accessed atomically, so it is kept first for alignment.
+	dropped uint64
+
+	// C receives the captured packets. It is closed when the tap is
+	// detached.
+	C <-chan TappedPacket
+
+	c       chan TappedPacket
+	nic     *NIC
+	snaplen int
+
+	// filter selects the captured packets, if set. It is protected by
+	// nic.tapMu.
+	filter *bpf.Program
+}
+
+// Dropped returns the number of captured packets that were dropped because the
+// tap's buffer was full.
+func (t *PacketTap) Dropped() uint64 {
+	return atomic.LoadUint64(&t.dropped)
+}
+
+// SetFilter sets the filter that selects the packets captured by t, replacing
+// the previous one, if any. Packets are captured if the filter accepts them,
+// truncated to the number of bytes it returns and to the snap length of t.
+// A nil filter captures all packets, which is the default.
+func (t *PacketTap) SetFilter(f *bpf.Program) {
+	t.nic.tapMu.Lock()
+	t.filter = f
+	t.nic.tapMu.Unlock()
+}
+
+// Detach stops the delivery of packets to t and closes t.C. Packets already in
+// t.C can still be read. Detach may be called several times.
+func (t *PacketTap) Detach() {
+	n := t.nic
+	n.tapMu.Lock()
+	defer n.tapMu.Unlock()
+
+	for i, tap := range n.taps {
+		if tap == t {
+			n.taps = append(n.taps[:i], n.taps[i+1:]...)
+			close(t.c)
+			return
+		}
+	}
+}
+
+// deliver queues a copy of the given packet, if there is room for it.
+func (t *PacketTap) deliver(p TappedPacket) {
+	select {
+	case t.c <- p:
+	default:
+		atomic.AddUint64(&t.dropped, 1)
+	}
+}
+
+// attachPacketTap creates a new packet tap on n.
+func (n *NIC) attachPacketTap(snaplen int) *PacketTap {
+	c := make(chan TappedPacket, PacketTapQueueLen)
+	t := &PacketTap{
+		C:       c,
+		c:       c,
+		nic:     n,
+		snaplen: snaplen,
+	}
+
+	n.tapMu.Lock()
+	n.taps = append(n.taps, t)
+	n.tapMu.Unlock()
+
+	return t
+}
+
+// deliverToTaps delivers a copy of the packet made of the given views to all
+// taps attached to n. If csum isn't nil, the packet is made of its headers and
+// payload, and its transport checksum is yet to be completed.
+func (n *NIC) deliverToTaps(dir PacketDirection, protocol tcpip.NetworkProtocolNumber, csum *PartialChecksum, views ...buffer.View) {
+	n.tapMu.RLock()
+	defer n.tapMu.RUnlock()
+
+	if len(n.taps) == 0 {
+		return
+	}
+
+	if csum != nil {
+		// The checksum will only be completed further down, so the
+		// taps get a copy of the headers with the full checksum in
+		// place, as the packet will appear on the wire.
+		hdr := append(buffer.View(nil), views[0]...)
+		csum.Complete(hdr[csum.TransportOffset:], views[1])
+		views = []buffer.View{hdr, views[1]}
+	}
+
+	length := 0
+	for _, v := range views {
+		length += len(v)
+	}
+	now := n.stack.clock.NowNanoseconds()
+
+	// flat holds the packet in a single view, for filters to run over. It
+	// is only built if a tap has a filter.
+	var flat buffer.View
+
+	for _, t := range n.taps {
+		size := length
+		if t.filter != nil {
+			if flat == nil {
+				flat = make(buffer.View, 0, length)
+				for _, v := range views {
+					flat = append(flat, v...)
+				}
+			}
+			accepted := t.filter.Run(flat, protocol)
+			if accepted == 0 {
+				continue
+			}
+			if uint64(accepted) < uint64(size) {
+				size = int(accepted)
+			}
+		}
+		if t.snaplen > 0 && size > t.snaplen {
+			size = t.snaplen
+		}
+		data := make(buffer.View, 0, size)
+		for _, v := range views {
+			if len(data)+len(v) > size {
+				v = v[:size-len(data)]
+			}
+			data = append(data, v...)
+		}
+
+		t.deliver(TappedPacket{
+			Direction: dir,
+			Timestamp: now,
+			Protocol:  protocol,
+			Data:      data,
+			Length:    length,
+		})
+	}
+}
+
+// registerPacketEndpoint registers a packet endpoint receiving the packets of
+// the given protocol sent or received by n, or all of them if it's zero.
+func (n *NIC) registerPacketEndpoint(protocol tcpip.NetworkProtocolNumber, ep PacketEndpoint) {
+	n.packetMu.Lock()
+	defer n.packetMu.Unlock()
+
+	if n.packetEPs == nil {
+		n.packetEPs = make(map[tcpip.NetworkProtocolNumber][]PacketEndpoint)
+	}
+	eps := n.packetEPs[protocol]
+	n.packetEPs[protocol] = append(eps[:len(eps):len(eps)], ep)
+}
+
+// unregisterPacketEndpoint removes a packet endpoint registered with
+// registerPacketEndpoint.
+func (n *NIC) unregisterPacketEndpoint(protocol tcpip.NetworkProtocolNumber, ep PacketEndpoint) {
+	n.packetMu.Lock()
+	defer n.packetMu.Unlock()
+
+	eps := n.packetEPs[protocol]
+	for i, e := range eps {
+		if e != ep {
+			continue
+		}
+		if len(eps) == 1 {
+			delete(n.packetEPs, protocol)
+			return
+		}
+		rest := make([]PacketEndpoint, 0, len(eps)-1)
+		n.packetEPs[protocol] = append(append(rest, eps[:i]...), eps[i+1:]...)
+		return
+	}
+}
+
+// hasPacketEndpoints returns whether packet endpoints are bound to n.
+func (n *NIC) hasPacketEndpoints() bool {
+	n.packetMu.RLock()
+	defer n.packetMu.RUnlock()
+	return len(n.packetEPs) != 0
+}
+
+// deliverToPacketEndpoints delivers the given packet to the packet endpoints
+// bound to n and its protocol. The destination of inbound packets is inferred.
+func (n *NIC) deliverToPacketEndpoints(dir PacketDirection, src, dst tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, vv *buffer.VectorisedView) {
+	n.packetMu.RLock()
+	all, eps := n.packetEPs[0], n.packetEPs[protocol]
+	n.packetMu.RUnlock()
+
+	if len(all) == 0 && len(eps) == 0 {
+		return
+	}
+
+	info := tcpip.LinkPacketInfo{
+		Protocol:               protocol,
+		Type:                   tcpip.PacketOutgoing,
+		SourceLinkAddress:      src,
+		DestinationLinkAddress: dst,
+	}
+	if dir == PacketInbound {
+		info.Type, info.DestinationLinkAddress = n.inboundPacketType(protocol, vv.First())
+	}
+
+	for _, ep := range all {
+		ep.HandlePacket(n.id, info, vv)
+	}
+	if protocol != 0 {
+		for _, ep := range eps {
+			ep.HandlePacket(n.id, info, vv)
+		}
+	}
+}
+
+// inboundPacketType returns the type of an inbound packet of the given
+// protocol, along with the link address it was most likely sent to, based on
+// its network-layer destination.
+func (n *NIC) inboundPacketType(protocol tcpip.NetworkProtocolNumber, h buffer.View) (tcpip.PacketType, tcpip.LinkAddress) {
+	if netProto, ok := n.stack.networkProtocols[protocol]; ok && len(h) >= netProto.MinimumPacketSize() {
+		_, dst := netProto.ParseAddresses(h)
+		switch {
+		case isBroadcastAddress(protocol, dst):
+			return tcpip.PacketBroadcast, broadcastMAC
+		case isMulticastAddress(protocol, dst):
+			addr, _ := multicastLinkAddress(protocol, dst)
+			return tcpip.PacketMulticast, addr
+		}
+	}
+	return tcpip.PacketHost, n.link().LinkAddress()
+}
+
+// tapLinkEndpoint is the link endpoint used by a NIC's network endpoints. It
+// forwards to the current link endpoint of the NIC, delivers copies of outbound
+// packets to the taps attached to the NIC, and accounts for them in the NIC's
+// stats.
+type tapLinkEndpoint struct {
+	nic *NIC
+}
+
+// MTU implements LinkEndpoint.MTU.
+func (e *tapLinkEndpoint) MTU() uint32 {
+	return e.nic.link().MTU()
+}
+
+// Capabilities implements LinkEndpoint.Capabilities.
+func (e *tapLinkEndpoint) Capabilities() LinkEndpointCapabilities {
+	return e.nic.link().Capabilities()
+}
+
+// MaxHeaderLength implements LinkEndpoint.MaxHeaderLength.
+func (e *tapLinkEndpoint) MaxHeaderLength() uint16 {
+	return e.nic.link().MaxHeaderLength()
+}
+
+// LinkAddress implements LinkEndpoint.LinkAddress.
+func (e *tapLinkEndpoint) LinkAddress() tcpip.LinkAddress {
+	return e.nic.link().LinkAddress()
+}
+
+// Attach implements LinkEndpoint.Attach. The NIC attaches its link endpoint
+// itself, so it does nothing.
+func (*tapLinkEndpoint) Attach(NetworkDispatcher) {}
+
+// WritePacket implements LinkEndpoint.WritePacket.
+func (e *tapLinkEndpoint) WritePacket(r *Route, csum *PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	if e.nic.stack.isPaused() {
+		// The packet is dropped as if lost on the link.
+		e.nic.stack.stats.DroppedPackets.Increment()
+		return nil
+	}
+
+	if r.loop {
+		// As with loopback link endpoints, the packet is delivered
+		// inline and its checksums are trusted unless forced.
+		vv := hdr.ToVectorisedView(payload)
+		e.nic.deliverNetworkPacket(e.nic.link(), "", protocol, &vv, !e.nic.stack.LoopbackChecksums(), nil)
+		return nil
+	}
+
+	if l := &e.nic.stack.sendLimiter; l.active() && !l.send(e, r, csum, hdr, payload, protocol) {
+		// The packet is queued, or dropped as if lost on the link.
+		return nil
+	}
+	return e.writeToLink(r, csum, hdr, payload, protocol)
+}
+
+// writeToLink writes a packet sent through e to the link endpoint of its NIC.
+func (e *tapLinkEndpoint) writeToLink(r *Route, csum *PartialChecksum, hdr *buffer.Prependable, payload buffer.View, protocol tcpip.NetworkProtocolNumber) *tcpip.Error {
+	e.nic.linkMu.RLock()
+	linkEP, detached := e.nic.linkEP, e.nic.detached
+	e.nic.linkMu.RUnlock()
+	if detached {
+		// There is no link to send the packet on.
+		e.nic.countWrite(protocol, r.RemoteAddress, 0, tcpip.ErrNoRoute)
+		return tcpip.ErrNoRoute
+	}
+
+	e.nic.tracePacket(PacketOutbound, protocol, hdr.UsedBytes(), payload)
+	e.nic.deliverToTaps(PacketOutbound, protocol, csum, hdr.UsedBytes(), payload)
+	if e.nic.hasPacketEndpoints() {
+		vv := hdr.ToVectorisedView(payload)
+		e.nic.deliverToPacketEndpoints(PacketOutbound, linkEP.LinkAddress(), r.RemoteLinkAddress, protocol, &vv)
+	}
+	size := len(hdr.UsedBytes()) + len(payload)
+	err := linkEP.WritePacket(r, csum, hdr, payload, protocol)
+	e.nic.countWrite(protocol, r.RemoteAddress, size, err)
+	return err
+}
@@ -0,0 +1,318 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/bpf"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/testutil"
+)
+
+const tapTestTime = 1234567890
+
+// newTapTestClock returns a clock that stays at tapTestTime.
+func newTapTestClock() tcpip.Clock {
+	c := testutil.NewManualClock()
+	c.Advance(tapTestTime)
+	return c
+}
+
+// receiveTapped waits for the next packet captured by tap.
+func receiveTapped(t *testing.T, tap *stack.PacketTap) stack.TappedPacket {
+	t.Helper()
+	select {
+	case p, ok := <-tap.C:
+		if !ok {
+			t.Fatalf("Tap was closed")
+		}
+		return p
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for captured packet")
+	}
+	return stack.TappedPacket{}
+}
+
+func TestPacketTap(t *testing.T) {
+	s := stack.New(newTapTestClock(), []string{"fakeNet"}, nil)
+
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	if _, err := s.AttachPacketTap(2, 0); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("AttachPacketTap(2) = %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+
+	// Keep injecting packets while taps are attached and detached.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var views [1]buffer.View
+		buf := buffer.NewView(30)
+		buf[0] = 1
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			vv := buf.ToVectorisedView(views)
+			linkEP.Inject(fakeNetNumber, &vv)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	full, err := s.AttachPacketTap(1, 0)
+	if err != nil {
+		t.Fatalf("AttachPacketTap failed: %v", err)
+	}
+	short, err := s.AttachPacketTap(1, 4)
+	if err != nil {
+		t.Fatalf("AttachPacketTap failed: %v", err)
+	}
+
+	want := stack.TappedPacket{
+		Direction: stack.PacketInbound,
+		Timestamp: tapTestTime,
+		Protocol:  fakeNetNumber,
+		Length:    30,
+	}
+	for _, tc := range []struct {
+		tap     *stack.PacketTap
+		dataLen int
+	}{
+		{full, 30},
+		{short, 4},
+	} {
+		p := receiveTapped(t, tc.tap)
+		if len(p.Data) != tc.dataLen || p.Data[0] != 1 {
+			t.Fatalf("got captured data %v, want %d bytes starting with 1", p.Data, tc.dataLen)
+		}
+		p.Data = nil
+		if !reflect.DeepEqual(p, want) {
+			t.Fatalf("got captured packet %+v, want %+v", p, want)
+		}
+	}
+
+	// Detaching one tap doesn't affect the other one, nor the traffic.
+	short.Detach()
+	short.Detach()
+	for range short.C {
+	}
+
+	close(stop)
+	wg.Wait()
+	for len(full.C) != 0 {
+		<-full.C
+	}
+	if c := linkEP.Drain(); c != 0 {
+		t.Fatalf("got %d unexpected outbound packets", c)
+	}
+
+	// Outbound packets are captured too.
+	sendTo(t, s, "\x03")
+	if c := linkEP.Drain(); c != 1 {
+		t.Fatalf("got %d outbound packets, want 1", c)
+	}
+	p := receiveTapped(t, full)
+	if p.Direction != stack.PacketOutbound || p.Protocol != fakeNetNumber {
+		t.Fatalf("got captured packet %+v, want outbound fakeNet packet", p)
+	}
+	if got := tcpip.Address(p.Data[0:1]); got != "\x03" {
+		t.Fatalf("got captured destination %v, want %v", got, tcpip.Address("\x03"))
+	}
+
+	full.Detach()
+	if _, ok := <-full.C; ok {
+		t.Fatalf("Tap wasn't closed by Detach")
+	}
+
+	// Traffic still flows once all taps are detached.
+	sendTo(t, s, "\x03")
+	if c := linkEP.Drain(); c != 1 {
+		t.Fatalf("got %d outbound packets after detach, want 1", c)
+	}
+}
+
+func TestPacketTapChecksumOffload(t *testing.T) {
+	s := stack.New(newTapTestClock(), []string{"fakeNet"}, nil)
+
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	tap, err := s.AttachPacketTap(1, 0)
+	if err != nil {
+		t.Fatalf("AttachPacketTap failed: %v", err)
+	}
+	defer tap.Detach()
+
+	r, err := s.FindRoute(0, "", "\x03", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+
+	// The transport header starts with its checksum, which is left for
+	// the link to complete.
+	hdr := buffer.NewPrependable(int(r.MaxHeaderLength()) + 4)
+	transport := hdr.Prepend(4)
+	transport[2], transport[3] = 0x12, 0x34
+	payload := buffer.View{1, 2, 3, 4, 5}
+	want := ^header.Checksum(payload, header.Checksum(transport, 0))
+	csum := &stack.PartialChecksum{TransportOffset: fakeNetHeaderLen}
+	if err := r.WritePacket(csum, &hdr, payload, fakeTransNumber); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+
+	p := receiveTapped(t, tap)
+	if got := uint16(p.Data[fakeNetHeaderLen])<<8 | uint16(p.Data[fakeNetHeaderLen+1]); got != want {
+		t.Errorf("got captured checksum 0x%04x, want 0x%04x", got, want)
+	}
+
+	// The packet itself is left for the link to complete.
+	pkt := <-linkEP.C
+	if got := pkt.Header[fakeNetHeaderLen : fakeNetHeaderLen+2]; got[0] != 0 || got[1] != 0 {
+		t.Errorf("got sent checksum %x, want 0000", got)
+	}
+}
+
+func TestPacketTapDrops(t *testing.T) {
+	s := stack.New(newTapTestClock(), []string{"fakeNet"}, nil)
+
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	tap, err := s.AttachPacketTap(1, 0)
+	if err != nil {
+		t.Fatalf("AttachPacketTap failed: %v", err)
+	}
+	defer tap.Detach()
+
+	const extra = 10
+	var views [1]buffer.View
+	buf := buffer.NewView(30)
+	for i := 0; i < stack.PacketTapQueueLen+extra; i++ {
+		vv := buf.ToVectorisedView(views)
+		linkEP.Inject(fakeNetNumber, &vv)
+	}
+
+	if got := len(tap.C); got != stack.PacketTapQueueLen {
+		t.Fatalf("got %d queued packets, want %d", got, stack.PacketTapQueueLen)
+	}
+	if got := tap.Dropped(); got != extra {
+		t.Fatalf("got Dropped() = %d, want %d", got, extra)
+	}
+}
+
+func TestPacketTapFilter(t *testing.T) {
+	s := stack.New(newTapTestClock(), []string{"fakeNet"}, nil)
+
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	arpOnly, err := s.AttachPacketTap(1, 0)
+	if err != nil {
+		t.Fatalf("AttachPacketTap failed: %v", err)
+	}
+	defer arpOnly.Detach()
+	all, err := s.AttachPacketTap(1, 0)
+	if err != nil {
+		t.Fatalf("AttachPacketTap failed: %v", err)
+	}
+	defer all.Detach()
+
+	filter, compileErr := bpf.Compile([]bpf.Instruction{
+		bpf.Stmt(bpf.Ld|bpf.H|bpf.Abs, bpf.AncillaryOffset+bpf.AncillaryProtocol),
+		bpf.Jump(bpf.Jmp|bpf.Jeq|bpf.K, uint32(header.ARPProtocolNumber), 0, 1),
+		bpf.Stmt(bpf.Ret|bpf.K, 0xffff),
+		bpf.Stmt(bpf.Ret|bpf.K, 0),
+	})
+	if compileErr != nil {
+		t.Fatalf("Compile failed: %v", compileErr)
+	}
+	arpOnly.SetFilter(filter)
+
+	ipv4 := func(proto uint8) buffer.View {
+		v := buffer.NewView(header.IPv4MinimumSize + 20)
+		header.IPv4(v).Encode(&header.IPv4Fields{
+			IHL:         header.IPv4MinimumSize,
+			TotalLength: uint16(len(v)),
+			TTL:         64,
+			Protocol:    proto,
+			SrcAddr:     "\x0a\x00\x00\x02",
+			DstAddr:     "\x0a\x00\x00\x01",
+		})
+		return v
+	}
+	packets := []struct {
+		protocol tcpip.NetworkProtocolNumber
+		data     buffer.View
+	}{
+		{header.IPv4ProtocolNumber, ipv4(6)},
+		{header.ARPProtocolNumber, buffer.NewView(header.ARPSize)},
+		{header.IPv4ProtocolNumber, ipv4(17)},
+		{header.ARPProtocolNumber, buffer.NewView(header.ARPSize)},
+	}
+	var views [1]buffer.View
+	for _, p := range packets {
+		vv := p.data.ToVectorisedView(views)
+		linkEP.Inject(p.protocol, &vv)
+	}
+
+	// The filtered tap only captures the ARP packets, whole.
+	for i := 0; i < 2; i++ {
+		p := receiveTapped(t, arpOnly)
+		if p.Protocol != header.ARPProtocolNumber || len(p.Data) != header.ARPSize {
+			t.Fatalf("got captured packet with protocol %#x and %d bytes, want an ARP packet of %d bytes", p.Protocol, len(p.Data), header.ARPSize)
+		}
+	}
+	if got := len(arpOnly.C); got != 0 {
+		t.Fatalf("got %d more packets captured by the filtered tap, want 0", got)
+	}
+	if got := arpOnly.Dropped(); got != 0 {
+		t.Fatalf("got Dropped() = %d for the filtered tap, want 0", got)
+	}
+
+	// Other taps are unaffected by the filter.
+	for _, want := range packets {
+		if p := receiveTapped(t, all); p.Protocol != want.protocol {
+			t.Fatalf("got captured packet with protocol %#x, want %#x", p.Protocol, want.protocol)
+		}
+	}
+
+	// Removing the filter captures all packets again.
+	arpOnly.SetFilter(nil)
+	tcp := ipv4(6)
+	vv := tcp.ToVectorisedView(views)
+	linkEP.Inject(header.IPv4ProtocolNumber, &vv)
+	if p := receiveTapped(t, arpOnly); p.Protocol != header.IPv4ProtocolNumber {
+		t.Fatalf("got captured packet with protocol %#x after removing the filter, want %#x", p.Protocol, header.IPv4ProtocolNumber)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+)
+
+// PacketHook is a function called with the packets received or sent by the
+// NICs of a stack, see Stack.SetPacketHook.
+type PacketHook func(p *TracedPacket)
+
+// TracedPacket is a packet passed to a PacketHook. Its contents can only be
+// copied out with CopyTo, and only until the hook returns, so that hooks can
+// neither modify the packet nor hold on to its buffers.
+type TracedPacket struct {
+	// NIC is the NIC that received or sent the packet.
+	NIC tcpip.NICID
+
+	// Direction is the direction of the packet.
+	Direction PacketDirection
+
+	// NetworkProtocol is the network protocol of the packet.
+	NetworkProtocol tcpip.NetworkProtocolNumber
+
+	// TransportProtocol is the transport protocol of IPv4 and IPv6
+	// packets, as found in their header, or 0 for other packets.
+	TransportProtocol tcpip.TransportProtocolNumber
+
+	// Timestamp is the time at which the hook is called, as returned by
+	// the stack's clock.
+	Timestamp int64
+
+	size  int
+	views []buffer.View
+}
+
+// Size returns the length of the network-layer packet.
+func (p *TracedPacket) Size() int {
+	return p.size
+}
+
+// CopyTo copies the beginning of the network-layer packet to b, and returns
+// the number of bytes copied. Outbound packets are copied before the link
+// endpoint completes any checksum it offloads. CopyTo returns 0 once the
+// hook has returned.
+func (p *TracedPacket) CopyTo(b []byte) int {
+	n := 0
+	for _, v := range p.views {
+		if n == len(b) {
+			break
+		}
+		n += copy(b[n:], v)
+	}
+	return n
+}
+
+// packetHooks holds the hooks set with Stack.SetPacketHook.
+type packetHooks struct {
+	// enabled has bit 1<<dir set while a hook is set for direction dir.
+	// It is accessed atomically, so that the packet path only pays for a
+	// load and a branch when no hook is set.
+	enabled uint32
+
+	mu sync.RWMutex
+	fn [PacketOutbound + 1]PacketHook
+}
+
+// SetPacketHook sets the function called with every packet received by the
+// NICs of the stack, once the link endpoint has parsed it, if dir is
+// PacketInbound, or with every packet they send, right before it's written to
+// the link endpoint, if dir is PacketOutbound. A nil function removes the hook.
+//
+// Hooks are called synchronously on the packet path, so they must be fast and
+// must not call back into the stack.
+func (s *Stack) SetPacketHook(dir PacketDirection, fn PacketHook) {
+	h := &s.packetHooks
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.fn[dir] = fn
+	enabled := atomic.LoadUint32(&h.enabled) &^ (1 << uint(dir))
+	if fn != nil {
+		enabled |= 1 << uint(dir)
+	}
+	atomic.StoreUint32(&h.enabled, enabled)
+}
+
+// tracePacket calls the packet hook of the stack for direction dir, if any,
+// with the packet made of the given views.
+func (n *NIC) tracePacket(dir PacketDirection, protocol tcpip.NetworkProtocolNumber, views ...buffer.View) {
+	if atomic.LoadUint32(&n.stack.packetHooks.enabled)&(1<<uint(dir)) == 0 {
+		return
+	}
+	n.callPacketHook(dir, protocol, views)
+}
+
+// callPacketHook is the slow path of tracePacket, kept apart so that
+// tracePacket can be inlined.
+func (n *NIC) callPacketHook(dir PacketDirection, protocol tcpip.NetworkProtocolNumber, views []buffer.View) {
+	h := &n.stack.packetHooks
+	h.mu.RLock()
+	fn := h.fn[dir]
+	h.mu.RUnlock()
+	if fn == nil {
+		return
+	}
+
+	// views is copied so that it doesn't escape, and the callers of
+	// tracePacket don't allocate it when no hook is set.
+	p := TracedPacket{
+		NIC:             n.id,
+		Direction:       dir,
+		NetworkProtocol: protocol,
+		Timestamp:       n.stack.clock.NowNanoseconds(),
+		views:           append([]buffer.View(nil), views...),
+	}
+	for _, v := range views {
+		p.size += len(v)
+	}
+	if len(views) != 0 {
+		switch v := views[0]; protocol {
+		case header.IPv4ProtocolNumber:
+			if len(v) >= header.IPv4MinimumSize {
+				p.TransportProtocol = header.IPv4(v).TransportProtocol()
+			}
+		case header.IPv6ProtocolNumber:
+			if len(v) >= header.IPv6MinimumSize {
+				p.TransportProtocol = header.IPv6(v).TransportProtocol()
+			}
+		}
+	}
+
+	fn(&p)
+
+	// The hook may have kept p, but not the packet.
+	p.views = nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack_test
+
+import (
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// tracedPacket is a copy of a packet passed to a packet hook.
+type tracedPacket struct {
+	stack.TracedPacket
+	data buffer.View
+}
+
+func newTraceTestStack(t *testing.T) (*stack.Stack, *channel.Endpoint) {
+	s := stack.New(newTapTestClock(), []string{"fakeNet"}, nil)
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00", Mask: "\x00", Gateway: "\x00", NIC: 1}})
+	if err := s.AddAddress(1, fakeNetNumber, "\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	return s, linkEP
+}
+
+func TestPacketHook(t *testing.T) {
+	s, linkEP := newTraceTestStack(t)
+
+	var traced []tracedPacket
+	var kept *stack.TracedPacket
+	hook := func(p *stack.TracedPacket) {
+		data := make(buffer.View, p.Size())
+		if n := p.CopyTo(data); n != p.Size() {
+			t.Errorf("got CopyTo() = %d, want %d", n, p.Size())
+		}
+		traced = append(traced, tracedPacket{*p, data})
+		kept = p
+	}
+	s.SetPacketHook(stack.PacketInbound, hook)
+	s.SetPacketHook(stack.PacketOutbound, hook)
+
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	buf[1] = 2
+	for i := 0; i < 2; i++ {
+		vv := buf.ToVectorisedView([1]buffer.View{})
+		linkEP.Inject(fakeNetNumber, &vv)
+	}
+	sendTo(t, s, "\x03")
+	if got := linkEP.Drain(); got != 1 {
+		t.Fatalf("got %d packets written, want 1", got)
+	}
+
+	if len(traced) != 3 {
+		t.Fatalf("got %d traced packets, want 3", len(traced))
+	}
+	for i, want := range []struct {
+		dir  stack.PacketDirection
+		size int
+		dst  byte
+	}{
+		{stack.PacketInbound, len(buf), 1},
+		{stack.PacketInbound, len(buf), 1},
+		{stack.PacketOutbound, fakeNetHeaderLen, 3},
+	} {
+		p := traced[i]
+		if p.NIC != 1 || p.Direction != want.dir || p.NetworkProtocol != fakeNetNumber || p.TransportProtocol != 0 || p.Timestamp != tapTestTime {
+			t.Errorf("got traced packet %d %+v, want NIC 1, direction %d, protocols %d/0 at %d", i, p.TracedPacket, want.dir, fakeNetNumber, tapTestTime)
+		}
+		if len(p.data) != want.size || p.data[0] != want.dst {
+			t.Errorf("got traced packet %d data %v, want %d bytes sent to %d", i, p.data, want.size, want.dst)
+		}
+	}
+
+	// The packet can't be read once the hook has returned.
+	if n := kept.CopyTo(make([]byte, 10)); n != 0 {
+		t.Errorf("got CopyTo() = %d after the hook returned, want 0", n)
+	}
+
+	// Once removed, the hooks aren't called anymore.
+	s.SetPacketHook(stack.PacketInbound, nil)
+	vv := buf.ToVectorisedView([1]buffer.View{})
+	linkEP.Inject(fakeNetNumber, &vv)
+	sendTo(t, s, "\x03")
+	if len(traced) != 4 || traced[3].Direction != stack.PacketOutbound {
+		t.Fatalf("got %d traced packets, want 4 with the last one outbound", len(traced))
+	}
+	s.SetPacketHook(stack.PacketOutbound, nil)
+	sendTo(t, s, "\x03")
+	if len(traced) != 4 {
+		t.Fatalf("got %d traced packets, want 4", len(traced))
+	}
+}
+
+func TestPacketHookDisabledAllocs(t *testing.T) {
+	s, linkEP := newTraceTestStack(t)
+	r, err := s.FindRoute(0, "", "\x03", fakeNetNumber)
+	if err != nil {
+		t.Fatalf("FindRoute failed: %v", err)
+	}
+	defer r.Release()
+
+	buf := buffer.NewView(30)
+	buf[0] = 1
+	allocs := func() float64 {
+		return testing.AllocsPerRun(100, func() {
+			vv := buf.ToVectorisedView([1]buffer.View{})
+			linkEP.Inject(fakeNetNumber, &vv)
+			hdr := buffer.NewPrependable(int(r.MaxHeaderLength()))
+			r.WritePacket(nil, &hdr, nil, fakeTransNumber)
+			linkEP.Drain()
+		})
+	}
+
+	before := allocs()
+	hook := func(*stack.TracedPacket) {}
+	s.SetPacketHook(stack.PacketInbound, hook)
+	s.SetPacketHook(stack.PacketOutbound, hook)
+	if enabled := allocs(); enabled <= before {
+		t.Errorf("got %v allocations per packet pair with hooks, want more than %v", enabled, before)
+	}
+	s.SetPacketHook(stack.PacketInbound, nil)
+	s.SetPacketHook(stack.PacketOutbound, nil)
+	if after := allocs(); after != before {
+		t.Errorf("got %v allocations per packet pair once the hooks are removed, want %v", after, before)
+	}
+}
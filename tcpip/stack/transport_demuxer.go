@@ -6,9 +6,11 @@ package stack
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/ports"
 )
 
 type protocolIDs struct {
@@ -18,9 +20,302 @@ type protocolIDs struct {
 
 // transportEndpoints manages all endpoints of a given protocol. It has its own
 // mutex so as to reduce interference between protocols.
+//
+// Endpoints whose IDs have a remote part are kept apart from the endpoints that
+// are only bound to a local port and possibly address, so that packets of
+// established connections are matched with a single lookup.
+//
+// Packets are delivered without taking mu: it only serializes the changes to
+// the tables, which can be read concurrently with them.
 type transportEndpoints struct {
-	mu        sync.RWMutex
-	endpoints map[TransportEndpointID]TransportEndpoint
+	mu sync.RWMutex
+
+	// connected holds the endpoints whose IDs have a remote part.
+	connected endpointTable
+
+	// anyLocal is the number of endpoints in connected whose IDs have no
+	// local address. The lookup of IDs without a local address is skipped
+	// when there are none. It's accessed atomically.
+	anyLocal int32
+
+	// bound holds the other endpoints, keyed by their IDs, i.e., local
+	// port and address, the empty address standing for all addresses.
+	bound endpointTable
+
+	// draining holds the time at which the registered endpoints marked
+	// with setDraining started draining. It's protected by mu.
+	draining map[drainingEndpoint]int64
+}
+
+// drainingEndpoint is the key of an endpoint in transportEndpoints.draining.
+type drainingEndpoint struct {
+	id TransportEndpointID
+	ep TransportEndpoint
+}
+
+func newTransportEndpoints(seed uint32) *transportEndpoints {
+	return &transportEndpoints{
+		connected: endpointTable{seed: seed},
+		bound:     endpointTable{seed: seed},
+		draining:  make(map[drainingEndpoint]int64),
+	}
+}
+
+// isConnectedID returns whether id has a remote part.
+func isConnectedID(id TransportEndpointID) bool {
+	return id.RemotePort != 0 || id.RemoteAddress != ""
+}
+
+// add registers ep with the given id. If the id has no remote part, ep may
+// share it with other endpoints, as decided by ports.Binding.Conflicts given
+// their flags. Whether endpoints bound to the wildcard and to a specific
+// address may share a port is left to the port manager, which endpoints go
+// through when binding. eps.mu must be held for writing.
+func (eps *transportEndpoints) add(id TransportEndpointID, ep TransportEndpoint, flags ports.Flags) *tcpip.Error {
+	if isConnectedID(id) {
+		if eps.connected.get(id) != nil {
+			return tcpip.ErrPortInUse
+		}
+		eps.connected.put(&endpointEntry{id: id, eps: []TransportEndpoint{ep}})
+		if id.LocalAddress == "" {
+			atomic.AddInt32(&eps.anyLocal, 1)
+		}
+		return nil
+	}
+
+	n := &endpointEntry{id: id}
+	if b := eps.bound.get(id); b != nil {
+		if (ports.Binding{Addr: id.LocalAddress, Flags: flags}).Conflicts(ports.Binding{Addr: id.LocalAddress, Flags: b.counter.Flags()}) {
+			return tcpip.ErrPortInUse
+		}
+		n.eps = append([]TransportEndpoint(nil), b.eps...)
+		n.flags = append([]ports.Flags(nil), b.flags...)
+		n.counter = b.counter
+	}
+	n.eps = append(n.eps, ep)
+	n.flags = append(n.flags, flags)
+	n.counter.Add(flags)
+	eps.bound.put(n)
+	return nil
+}
+
+// remove unregisters ep from the given id, if it is registered with it.
+// eps.mu must be held for writing.
+func (eps *transportEndpoints) remove(id TransportEndpointID, ep TransportEndpoint) {
+	delete(eps.draining, drainingEndpoint{id, ep})
+
+	if isConnectedID(id) {
+		if eps.connected.remove(id) && id.LocalAddress == "" {
+			atomic.AddInt32(&eps.anyLocal, -1)
+		}
+		return
+	}
+
+	b := eps.bound.get(id)
+	if b == nil {
+		return
+	}
+	for i, e := range b.eps {
+		if e != ep {
+			continue
+		}
+		if len(b.eps) == 1 {
+			eps.bound.remove(id)
+			return
+		}
+		n := &endpointEntry{id: id, counter: b.counter}
+		n.eps = append(append(n.eps, b.eps[:i]...), b.eps[i+1:]...)
+		n.flags = append(append(n.flags, b.flags[:i]...), b.flags[i+1:]...)
+		n.counter.Remove(b.flags[i])
+		eps.bound.put(n)
+		return
+	}
+}
+
+// endpointEntry holds the endpoints registered with the same ID. There are
+// several only if the ID has no remote part and their flags allow them to
+// share it. flags holds the flags of each endpoint of eps, and counter counts
+// them.
+//
+// Entries aren't modified once they're added to an endpointTable, they're
+// replaced.
+type endpointEntry struct {
+	id      TransportEndpointID
+	eps     []TransportEndpoint
+	flags   []ports.Flags
+	counter ports.FlagCounter
+
+	// next is the next entry in the same bucket, if any.
+	next *endpointEntry
+}
+
+// endpointTable is a hash table of endpoint entries, keyed by their IDs. It
+// hashes IDs itself, which is cheaper than hashing them as map keys.
+//
+// Lookups don't take any lock: the chains of entries of the buckets are copied
+// rather than modified, and their heads, like the buckets, are replaced
+// atomically. Changes must be serialized by the caller.
+type endpointTable struct {
+	// seed is mixed into the hashes, so that remote hosts can't predict
+	// which IDs collide.
+	seed uint32
+
+	// buckets holds the endpointBuckets of the table, nil once it's
+	// empty.
+	buckets atomic.Value
+
+	// size is the number of entries of the table.
+	size int
+}
+
+// endpointBuckets holds the heads of the chains of entries of an endpointTable,
+// as *endpointEntry. An entry is in the bucket given by the hash of its ID
+// modulo the number of buckets, which is a power of two.
+type endpointBuckets []atomic.Value
+
+// minEndpointBuckets is the number of buckets of an endpointTable once its
+// first entry is added. The table doubles its buckets when it has more entries
+// than buckets.
+const minEndpointBuckets = 16
+
+// hashAddress mixes the bytes of addr into h, with FNV-1a.
+func hashAddress(h uint32, addr tcpip.Address) uint32 {
+	for i := 0; i < len(addr); i++ {
+		h = (h ^ uint32(addr[i])) * 16777619
+	}
+	return h
+}
+
+func (t *endpointTable) hash(id TransportEndpointID) uint32 {
+	h := (t.seed ^ (uint32(id.LocalPort)<<16 | uint32(id.RemotePort))) * 16777619
+	h = hashAddress(h, id.LocalAddress)
+	h = hashAddress(h, id.RemoteAddress)
+
+	// The buckets are picked by the low bits of the hash, which the
+	// multiplications above don't carry the high bits of the ports to, so
+	// they're mixed in as in the finalizer of MurmurHash3.
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	return h ^ h>>16
+}
+
+// load returns the current buckets of t.
+func (t *endpointTable) load() endpointBuckets {
+	b, _ := t.buckets.Load().(endpointBuckets)
+	return b
+}
+
+// head returns the first entry of the bucket v.
+func head(v *atomic.Value) *endpointEntry {
+	e, _ := v.Load().(*endpointEntry)
+	return e
+}
+
+// bucket returns the bucket of the given id in b, which must not be empty.
+func (t *endpointTable) bucket(b endpointBuckets, id TransportEndpointID) *atomic.Value {
+	return &b[t.hash(id)&uint32(len(b)-1)]
+}
+
+// get returns the entry with the given id, or nil if there is none.
+func (t *endpointTable) get(id TransportEndpointID) *endpointEntry {
+	b := t.load()
+	if b == nil {
+		return nil
+	}
+	for e := head(t.bucket(b, id)); e != nil; e = e.next {
+		if e.id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// put adds n to t, replacing the entry with the same ID if any. n must not be
+// in a table already.
+func (t *endpointTable) put(n *endpointEntry) {
+	b := t.load()
+	if t.get(n.id) == nil {
+		t.size++
+		if t.size > len(b) {
+			b = t.resize(len(b) * 2)
+		}
+	}
+	v := t.bucket(b, n.id)
+	n.next, _ = without(head(v), n.id)
+	v.Store(n)
+}
+
+// remove removes the entry with the given id, and returns whether there was
+// one.
+func (t *endpointTable) remove(id TransportEndpointID) bool {
+	b := t.load()
+	if b == nil {
+		return false
+	}
+	v := t.bucket(b, id)
+	rest, ok := without(head(v), id)
+	if !ok {
+		return false
+	}
+	t.size--
+	if t.size == 0 {
+		t.buckets.Store(endpointBuckets(nil))
+		return true
+	}
+	v.Store(rest)
+	return true
+}
+
+// resize replaces the buckets of t with n new ones, at least
+// minEndpointBuckets, and returns them. The entries are copied, as their next
+// fields change.
+func (t *endpointTable) resize(n int) endpointBuckets {
+	if n < minEndpointBuckets {
+		n = minEndpointBuckets
+	}
+	old := t.load()
+	b := make(endpointBuckets, n)
+	for i := range old {
+		for e := head(&old[i]); e != nil; e = e.next {
+			c := *e
+			v := t.bucket(b, c.id)
+			c.next = head(v)
+			v.Store(&c)
+		}
+	}
+	t.buckets.Store(b)
+	return b
+}
+
+// forEach calls f with each entry of t.
+func (t *endpointTable) forEach(f func(*endpointEntry)) {
+	b := t.load()
+	for i := range b {
+		for e := head(&b[i]); e != nil; e = e.next {
+			f(e)
+		}
+	}
+}
+
+// without returns the chain of entries starting at e minus the one with the
+// given id, and whether there was one. The entries ahead of it are copied, so
+// that the chain, which may be being read, is left untouched.
+func without(e *endpointEntry, id TransportEndpointID) (*endpointEntry, bool) {
+	if e == nil {
+		return nil, false
+	}
+	if e.id == id {
+		return e.next, true
+	}
+	next, ok := without(e.next, id)
+	if !ok {
+		return e, false
+	}
+	c := *e
+	c.next = next
+	return &c, true
 }
 
 // transportDemuxer demultiplexes packets targeted at a transport endpoint
@@ -29,15 +324,25 @@ type transportEndpoints struct {
 // based on endpoints IDs.
 type transportDemuxer struct {
 	protocol map[protocolIDs]*transportEndpoints
+
+	// rawMu protects raw, which holds the raw endpoints of each network
+	// and transport protocol pair. The slices are never modified once
+	// stored, so they may be used after releasing rawMu.
+	rawMu sync.RWMutex
+	raw   map[protocolIDs][]RawTransportEndpoint
 }
 
 func newTransportDemuxer(stack *Stack) *transportDemuxer {
 	d := &transportDemuxer{protocol: make(map[protocolIDs]*transportEndpoints)}
 
-	// Add each network and transport pair to the demuxer.
+	// Add each network and transport pair to the demuxer. They all hash
+	// connected endpoints with the same seed, drawn once so that the
+	// random numbers drawn by the stack don't depend on map iteration
+	// order.
+	seed := stack.rand.Uint32()
 	for netProto := range stack.networkProtocols {
 		for proto := range stack.transportProtocols {
-			d.protocol[protocolIDs{netProto, proto}] = &transportEndpoints{endpoints: make(map[TransportEndpointID]TransportEndpoint)}
+			d.protocol[protocolIDs{netProto, proto}] = newTransportEndpoints(seed)
 		}
 	}
 
@@ -45,11 +350,13 @@ func newTransportDemuxer(stack *Stack) *transportDemuxer {
 }
 
 // registerEndpoint registers the given endpoint with the dispatcher such that
-// packets that match the endpoint ID are delivered to it.
-func (d *transportDemuxer) registerEndpoint(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) *tcpip.Error {
+// packets that match the endpoint ID are delivered to it. If reuse is true, the
+// endpoint may share an ID without remote part with other endpoints registered
+// with reuse.
+func (d *transportDemuxer) registerEndpoint(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint, reuse bool) *tcpip.Error {
 	for i, n := range netProtos {
-		if err := d.singleRegisterEndpoint(n, protocol, id, ep); err != nil {
-			d.unregisterEndpoint(netProtos[:i], protocol, id)
+		if err := d.singleRegisterEndpoint(n, protocol, id, ep, reuse); err != nil {
+			d.unregisterEndpoint(netProtos[:i], protocol, id, ep)
 			return err
 		}
 	}
@@ -57,7 +364,14 @@ func (d *transportDemuxer) registerEndpoint(netProtos []tcpip.NetworkProtocolNum
 	return nil
 }
 
-func (d *transportDemuxer) singleRegisterEndpoint(netProto tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) *tcpip.Error {
+// reuseFlags returns the flags of an endpoint registered with the given reuse
+// argument. Reusing an ID without a remote part has the semantics of
+// SO_REUSEADDR for UDP, which lets sockets share it entirely.
+func reuseFlags(reuse bool) ports.Flags {
+	return ports.Flags{ReuseAddr: reuse}
+}
+
+func (d *transportDemuxer) singleRegisterEndpoint(netProto tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint, reuse bool) *tcpip.Error {
 	eps, ok := d.protocol[protocolIDs{netProto, protocol}]
 	if !ok {
 		return nil
@@ -66,27 +380,118 @@ func (d *transportDemuxer) singleRegisterEndpoint(netProto tcpip.NetworkProtocol
 	eps.mu.Lock()
 	defer eps.mu.Unlock()
 
-	if _, ok := eps.endpoints[id]; ok {
-		return tcpip.ErrPortInUse
-	}
-
-	eps.endpoints[id] = ep
-
-	return nil
+	return eps.add(id, ep, reuseFlags(reuse))
 }
 
-// unregisterEndpoint unregisters the endpoint with the given id such that it
-// won't receive any more packets.
-func (d *transportDemuxer) unregisterEndpoint(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID) {
+// unregisterEndpoint unregisters the given endpoint from the given id such
+// that it won't receive any more packets.
+func (d *transportDemuxer) unregisterEndpoint(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint) {
 	for _, n := range netProtos {
 		if eps, ok := d.protocol[protocolIDs{n, protocol}]; ok {
 			eps.mu.Lock()
-			delete(eps.endpoints, id)
+			eps.remove(id, ep)
 			eps.mu.Unlock()
 		}
 	}
 }
 
+// setDraining marks the given endpoint, registered with the given id, as
+// draining since now, unless it already is.
+func (d *transportDemuxer) setDraining(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, id TransportEndpointID, ep TransportEndpoint, now int64) {
+	for _, n := range netProtos {
+		eps, ok := d.protocol[protocolIDs{n, protocol}]
+		if !ok {
+			continue
+		}
+		eps.mu.Lock()
+		key := drainingEndpoint{id, ep}
+		if _, ok := eps.draining[key]; !ok && eps.registered(id, ep) {
+			eps.draining[key] = now
+		}
+		eps.mu.Unlock()
+	}
+}
+
+// registered returns true if ep is registered with the given id. eps.mu must
+// be held.
+func (eps *transportEndpoints) registered(id TransportEndpointID, ep TransportEndpoint) bool {
+	t := &eps.bound
+	if isConnectedID(id) {
+		t = &eps.connected
+	}
+	if b := t.get(id); b != nil {
+		for _, e := range b.eps {
+			if e == ep {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// drainingEndpoints returns the number of endpoints of the given transport
+// protocol marked as draining, and the time at which the first of them started
+// draining.
+func (d *transportDemuxer) drainingEndpoints(protocol tcpip.TransportProtocolNumber) (int, int64) {
+	n := 0
+	var oldest int64
+	for protocols, eps := range d.protocol {
+		if protocols.transport != protocol {
+			continue
+		}
+		eps.mu.RLock()
+		for _, since := range eps.draining {
+			if n == 0 || since < oldest {
+				oldest = since
+			}
+			n++
+		}
+		eps.mu.RUnlock()
+	}
+	return n, oldest
+}
+
+// moveEndpoint atomically moves the registration of the given endpoint from
+// oldID to newID, such that packets that match newID are delivered to it
+// instead of packets that match oldID. reuse is as for registerEndpoint, for
+// both IDs.
+func (d *transportDemuxer) moveEndpoint(netProtos []tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, oldID, newID TransportEndpointID, ep TransportEndpoint, reuse bool) *tcpip.Error {
+	if oldID == newID {
+		return nil
+	}
+
+	for i, n := range netProtos {
+		if err := d.singleMoveEndpoint(n, protocol, oldID, newID, ep, reuse); err != nil {
+			// Move the registrations that were already moved
+			// back, the old IDs are still free.
+			for _, n := range netProtos[:i] {
+				d.singleMoveEndpoint(n, protocol, newID, oldID, ep, reuse)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *transportDemuxer) singleMoveEndpoint(netProto tcpip.NetworkProtocolNumber, protocol tcpip.TransportProtocolNumber, oldID, newID TransportEndpointID, ep TransportEndpoint, reuse bool) *tcpip.Error {
+	eps, ok := d.protocol[protocolIDs{netProto, protocol}]
+	if !ok {
+		return nil
+	}
+
+	eps.mu.Lock()
+	defer eps.mu.Unlock()
+
+	eps.remove(oldID, ep)
+	if err := eps.add(newID, ep, reuseFlags(reuse)); err != nil {
+		// The endpoint can always take its old place back.
+		eps.add(oldID, ep, reuseFlags(reuse))
+		return err
+	}
+	return nil
+}
+
 // deliverPacket attempts to deliver the given packet. Returns true if it found
 // an endpoint, false otherwise.
 func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView, id TransportEndpointID) bool {
@@ -95,21 +500,94 @@ func (d *transportDemuxer) deliverPacket(r *Route, protocol tcpip.TransportProto
 		return false
 	}
 
-	eps.mu.RLock()
-	ep := d.findEndpointLocked(eps, vv, id)
-	eps.mu.RUnlock()
+	ep := d.findEndpoint(eps, vv, id)
 
 	// Fail if we didn't find one.
 	if ep == nil {
 		return false
 	}
 
-	// Deliver the packet.
+	// Deliver the packet, or queue it if it's part of a batch the
+	// endpoint handles at once.
+	if r.batch != nil {
+		if bep, ok := ep.(BatchTransportEndpoint); ok {
+			r.batch.queue(bep, r, id, vv)
+			return true
+		}
+	}
 	ep.HandlePacket(r, id, vv)
 
 	return true
 }
 
+// deliverMulticastPacket delivers a copy of the given broadcast or multicast
+// packet to every endpoint that it matches, instead of only the most specific
+// one. Returns true if it found any, false otherwise.
+func (d *transportDemuxer) deliverMulticastPacket(r *Route, protocol tcpip.TransportProtocolNumber, vv *buffer.VectorisedView, id TransportEndpointID) bool {
+	eps, ok := d.protocol[protocolIDs{r.NetProto, protocol}]
+	if !ok {
+		return false
+	}
+
+	destEps := d.findAllEndpoints(eps, id)
+
+	// Each endpoint gets its own copy of vv, as they trim it.
+	for _, ep := range destEps {
+		c := vv.Clone(nil)
+		ep.HandlePacket(r, id, &c)
+		c.Release()
+	}
+
+	return len(destEps) != 0
+}
+
+// registerRawEndpoint registers the given raw endpoint such that it receives a
+// copy of all packets of the given protocols.
+func (d *transportDemuxer) registerRawEndpoint(netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, ep RawTransportEndpoint) {
+	d.rawMu.Lock()
+	defer d.rawMu.Unlock()
+
+	if d.raw == nil {
+		d.raw = make(map[protocolIDs][]RawTransportEndpoint)
+	}
+	ids := protocolIDs{netProto, transProto}
+	eps := d.raw[ids]
+	d.raw[ids] = append(eps[:len(eps):len(eps)], ep)
+}
+
+// unregisterRawEndpoint removes the given raw endpoint.
+func (d *transportDemuxer) unregisterRawEndpoint(netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, ep RawTransportEndpoint) {
+	d.rawMu.Lock()
+	defer d.rawMu.Unlock()
+
+	ids := protocolIDs{netProto, transProto}
+	eps := d.raw[ids]
+	for i, e := range eps {
+		if e != ep {
+			continue
+		}
+		if len(eps) == 1 {
+			delete(d.raw, ids)
+			return
+		}
+		n := make([]RawTransportEndpoint, 0, len(eps)-1)
+		d.raw[ids] = append(append(n, eps[:i]...), eps[i+1:]...)
+		return
+	}
+}
+
+// deliverRawPacket delivers a copy of the given packet to all raw endpoints of
+// its protocols.
+func (d *transportDemuxer) deliverRawPacket(r *Route, protocol tcpip.TransportProtocolNumber, netHeader buffer.View, vv *buffer.VectorisedView) {
+	d.rawMu.RLock()
+	eps := d.raw[protocolIDs{r.NetProto, protocol}]
+	d.rawMu.RUnlock()
+
+	for _, ep := range eps {
+		ep.HandlePacket(r, netHeader, vv)
+	}
+}
+
 // deliverControlPacket attempts to deliver the given control packet. Returns
 // true if it found an endpoint, false otherwise.
 func (d *transportDemuxer) deliverControlPacket(net tcpip.NetworkProtocolNumber, trans tcpip.TransportProtocolNumber, typ ControlType, extra uint32, vv *buffer.VectorisedView, id TransportEndpointID) bool {
@@ -119,9 +597,7 @@ func (d *transportDemuxer) deliverControlPacket(net tcpip.NetworkProtocolNumber,
 	}
 
 	// Try to find the endpoint.
-	eps.mu.RLock()
-	ep := d.findEndpointLocked(eps, vv, id)
-	eps.mu.RUnlock()
+	ep := d.findEndpoint(eps, vv, id)
 
 	// Fail if we didn't find one.
 	if ep == nil {
@@ -134,29 +610,110 @@ func (d *transportDemuxer) deliverControlPacket(net tcpip.NetworkProtocolNumber,
 	return true
 }
 
-func (d *transportDemuxer) findEndpointLocked(eps *transportEndpoints, vv *buffer.VectorisedView, id TransportEndpointID) TransportEndpoint {
+// registeredEndpoint is an endpoint registered with a demuxer, as returned by
+// registeredEndpoints.
+type registeredEndpoint struct {
+	protocols protocolIDs
+	nic       tcpip.NICID
+	id        TransportEndpointID
+	ep        TransportEndpoint
+
+	// marked is true if the endpoint is marked as draining, since
+	// drainingSince.
+	marked        bool
+	drainingSince int64
+}
+
+// makeRegisteredEndpoint returns the description of ep, registered with tep.
+// tep.mu must be held.
+func makeRegisteredEndpoint(protocols protocolIDs, nic tcpip.NICID, tep *transportEndpoints, id TransportEndpointID, ep TransportEndpoint) registeredEndpoint {
+	since, marked := tep.draining[drainingEndpoint{id, ep}]
+	return registeredEndpoint{
+		protocols:     protocols,
+		nic:           nic,
+		id:            id,
+		ep:            ep,
+		marked:        marked,
+		drainingSince: since,
+	}
+}
+
+// registeredEndpoints appends the endpoints registered with d to eps, and
+// returns the result. The endpoints are described as belonging to the given
+// NIC.
+func (d *transportDemuxer) registeredEndpoints(eps []registeredEndpoint, nic tcpip.NICID) []registeredEndpoint {
+	for protocols, tep := range d.protocol {
+		add := func(e *endpointEntry) {
+			for _, ep := range e.eps {
+				eps = append(eps, makeRegisteredEndpoint(protocols, nic, tep, e.id, ep))
+			}
+		}
+		tep.mu.RLock()
+		tep.connected.forEach(add)
+		tep.bound.forEach(add)
+		tep.mu.RUnlock()
+	}
+	return eps
+}
+
+// findEndpoint returns the endpoint that packets with the given id are
+// delivered to, if any. In order of precedence, it is the endpoint registered
+// with the id as provided, the id minus the local address, the id minus the
+// remote part, or only the local port.
+func (d *transportDemuxer) findEndpoint(eps *transportEndpoints, vv *buffer.VectorisedView, id TransportEndpointID) TransportEndpoint {
 	// Try to find a match with the id as provided.
-	if ep := eps.endpoints[id]; ep != nil {
-		return ep
+	if e := eps.connected.get(id); e != nil {
+		return e.eps[0]
 	}
 
 	// Try to find a match with the id minus the local address.
-	nid := id
+	if id.LocalAddress != "" && atomic.LoadInt32(&eps.anyLocal) != 0 {
+		nid := id
+		nid.LocalAddress = ""
+		if e := eps.connected.get(nid); e != nil {
+			return e.eps[0]
+		}
+	}
 
-	nid.LocalAddress = ""
-	if ep := eps.endpoints[nid]; ep != nil {
-		return ep
+	// Try to find a match with the id minus the remote part, then with
+	// only the local port.
+	nid := TransportEndpointID{LocalPort: id.LocalPort, LocalAddress: id.LocalAddress}
+	if e := eps.bound.get(nid); e != nil {
+		return e.eps[0]
+	}
+	if id.LocalAddress != "" {
+		nid.LocalAddress = ""
+		if e := eps.bound.get(nid); e != nil {
+			return e.eps[0]
+		}
 	}
+	return nil
+}
 
-	// Try to find a match with the id minus the remote part.
-	nid.LocalAddress = id.LocalAddress
-	nid.RemoteAddress = ""
-	nid.RemotePort = 0
-	if ep := eps.endpoints[nid]; ep != nil {
-		return ep
+// findAllEndpoints returns all the endpoints that findEndpoint chooses from for
+// packets with the given id, including all the endpoints sharing an id.
+func (d *transportDemuxer) findAllEndpoints(eps *transportEndpoints, id TransportEndpointID) []TransportEndpoint {
+	var destEps []TransportEndpoint
+	if e := eps.connected.get(id); e != nil {
+		destEps = append(destEps, e.eps...)
+	}
+	if id.LocalAddress != "" && atomic.LoadInt32(&eps.anyLocal) != 0 {
+		nid := id
+		nid.LocalAddress = ""
+		if e := eps.connected.get(nid); e != nil {
+			destEps = append(destEps, e.eps...)
+		}
 	}
 
-	// Try to find a match with only the local port.
-	nid.LocalAddress = ""
-	return eps.endpoints[nid]
+	nid := TransportEndpointID{LocalPort: id.LocalPort, LocalAddress: id.LocalAddress}
+	if e := eps.bound.get(nid); e != nil {
+		destEps = append(destEps, e.eps...)
+	}
+	if id.LocalAddress != "" {
+		nid.LocalAddress = ""
+		if e := eps.bound.get(nid); e != nil {
+			destEps = append(destEps, e.eps...)
+		}
+	}
+	return destEps
 }
@@ -0,0 +1,422 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stack
+
+import (
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+)
+
+const (
+	demuxNetProto   = tcpip.NetworkProtocolNumber(1)
+	demuxTransProto = tcpip.TransportProtocolNumber(2)
+
+	demuxLocalAddr  = tcpip.Address("\x0a\x00\x00\x01")
+	demuxOtherAddr  = tcpip.Address("\x0a\x00\x00\x03")
+	demuxRemoteAddr = tcpip.Address("\x0a\x00\x00\x02")
+)
+
+// demuxEndpoint is a transport endpoint that counts the packets delivered to
+// it.
+type demuxEndpoint struct {
+	packets int
+}
+
+func (e *demuxEndpoint) HandlePacket(*Route, TransportEndpointID, *buffer.VectorisedView) {
+	e.packets++
+}
+
+func (*demuxEndpoint) HandleControlPacket(TransportEndpointID, ControlType, uint32, *buffer.VectorisedView) {
+}
+
+func newTestDemuxer() *transportDemuxer {
+	return &transportDemuxer{protocol: map[protocolIDs]*transportEndpoints{
+		{demuxNetProto, demuxTransProto}: newTransportEndpoints(0),
+	}}
+}
+
+func TestDemuxPrecedence(t *testing.T) {
+	d := newTestDemuxer()
+	netProtos := []tcpip.NetworkProtocolNumber{demuxNetProto}
+
+	full := TransportEndpointID{80, demuxLocalAddr, 1000, demuxRemoteAddr}
+	anyLocal := TransportEndpointID{80, "", 1001, demuxRemoteAddr}
+	localOnly := TransportEndpointID{80, demuxLocalAddr, 0, ""}
+	portOnly := TransportEndpointID{80, "", 0, ""}
+
+	eps := make(map[TransportEndpointID]*demuxEndpoint)
+	for _, id := range []TransportEndpointID{full, anyLocal, localOnly, portOnly} {
+		ep := &demuxEndpoint{}
+		if err := d.registerEndpoint(netProtos, demuxTransProto, id, ep, false); err != nil {
+			t.Fatalf("registerEndpoint(%+v) failed: %v", id, err)
+		}
+		eps[id] = ep
+	}
+
+	// The same ID can't be registered twice.
+	if err := d.registerEndpoint(netProtos, demuxTransProto, localOnly, &demuxEndpoint{}, false); err != tcpip.ErrPortInUse {
+		t.Fatalf("registerEndpoint(%+v) = %v, want %v", localOnly, err, tcpip.ErrPortInUse)
+	}
+
+	tests := []struct {
+		name string
+		id   TransportEndpointID
+		want TransportEndpointID
+	}{
+		{"exact match", full, full},
+		{"any local address", TransportEndpointID{80, demuxLocalAddr, 1001, demuxRemoteAddr}, anyLocal},
+		{"any local address on another address", TransportEndpointID{80, demuxOtherAddr, 1001, demuxRemoteAddr}, anyLocal},
+		{"bound to local address", TransportEndpointID{80, demuxLocalAddr, 1002, demuxRemoteAddr}, localOnly},
+		{"bound to port", TransportEndpointID{80, demuxOtherAddr, 1002, demuxRemoteAddr}, portOnly},
+		{"other remote address", TransportEndpointID{80, demuxLocalAddr, 1000, demuxOtherAddr}, localOnly},
+	}
+	tep := d.protocol[protocolIDs{demuxNetProto, demuxTransProto}]
+	for _, test := range tests {
+		if got := d.findEndpoint(tep, nil, test.id); got != TransportEndpoint(eps[test.want]) {
+			t.Errorf("%s: findEndpoint(%+v) = %v, want the endpoint registered as %+v", test.name, test.id, got, test.want)
+		}
+	}
+
+	// Removing the more specific endpoints makes the less specific ones
+	// match.
+	d.unregisterEndpoint(netProtos, demuxTransProto, full, eps[full])
+	d.unregisterEndpoint(netProtos, demuxTransProto, localOnly, eps[localOnly])
+	if got := d.findEndpoint(tep, nil, full); got != TransportEndpoint(eps[portOnly]) {
+		t.Errorf("findEndpoint(%+v) = %v after unregistering, want the port-only endpoint", full, got)
+	}
+	d.unregisterEndpoint(netProtos, demuxTransProto, portOnly, eps[portOnly])
+	if got := d.findEndpoint(tep, nil, full); got != nil {
+		t.Errorf("findEndpoint(%+v) = %v after unregistering all but %+v, want nil", full, got, anyLocal)
+	}
+	if got := d.findEndpoint(tep, nil, TransportEndpointID{81, demuxLocalAddr, 1001, demuxRemoteAddr}); got != nil {
+		t.Errorf("findEndpoint on another port = %v, want nil", got)
+	}
+}
+
+func TestDemuxMove(t *testing.T) {
+	d := newTestDemuxer()
+	netProtos := []tcpip.NetworkProtocolNumber{demuxNetProto}
+	tep := d.protocol[protocolIDs{demuxNetProto, demuxTransProto}]
+
+	bound := TransportEndpointID{80, demuxLocalAddr, 0, ""}
+	connected := TransportEndpointID{80, demuxLocalAddr, 1000, demuxRemoteAddr}
+	other := TransportEndpointID{80, demuxLocalAddr, 1001, demuxRemoteAddr}
+
+	ep, otherEP := &demuxEndpoint{}, &demuxEndpoint{}
+	if err := d.registerEndpoint(netProtos, demuxTransProto, bound, ep, false); err != nil {
+		t.Fatalf("registerEndpoint failed: %v", err)
+	}
+	if err := d.registerEndpoint(netProtos, demuxTransProto, other, otherEP, false); err != nil {
+		t.Fatalf("registerEndpoint failed: %v", err)
+	}
+
+	// Moving from a bound ID to a connected one.
+	if err := d.moveEndpoint(netProtos, demuxTransProto, bound, connected, ep, false); err != nil {
+		t.Fatalf("moveEndpoint failed: %v", err)
+	}
+	if got := d.findEndpoint(tep, nil, connected); got != TransportEndpoint(ep) {
+		t.Errorf("findEndpoint(%+v) = %v, want %v", connected, got, ep)
+	}
+	if got := d.findEndpoint(tep, nil, TransportEndpointID{80, demuxLocalAddr, 1002, demuxRemoteAddr}); got != nil {
+		t.Errorf("findEndpoint matched the old bound ID, got %v", got)
+	}
+
+	// Moving to a registered ID fails and leaves the registrations as is.
+	if err := d.moveEndpoint(netProtos, demuxTransProto, connected, other, ep, false); err != tcpip.ErrPortInUse {
+		t.Fatalf("moveEndpoint to a registered ID = %v, want %v", err, tcpip.ErrPortInUse)
+	}
+	if got := d.findEndpoint(tep, nil, connected); got != TransportEndpoint(ep) {
+		t.Errorf("findEndpoint(%+v) = %v, want %v", connected, got, ep)
+	}
+	if got := d.findEndpoint(tep, nil, other); got != TransportEndpoint(otherEP) {
+		t.Errorf("findEndpoint(%+v) = %v, want %v", other, got, otherEP)
+	}
+
+	if got := len(d.registeredEndpoints(nil, 1)); got != 2 {
+		t.Errorf("got %d registered endpoints, want 2", got)
+	}
+}
+
+func TestDemuxReuse(t *testing.T) {
+	d := newTestDemuxer()
+	netProtos := []tcpip.NetworkProtocolNumber{demuxNetProto}
+
+	portOnly := TransportEndpointID{80, "", 0, ""}
+	var eps []*demuxEndpoint
+	for i := 0; i < 3; i++ {
+		ep := &demuxEndpoint{}
+		if err := d.registerEndpoint(netProtos, demuxTransProto, portOnly, ep, true); err != nil {
+			t.Fatalf("registerEndpoint(%+v) with reuse failed: %v", portOnly, err)
+		}
+		eps = append(eps, ep)
+	}
+
+	// The ID can only be shared by endpoints that all reuse it.
+	if err := d.registerEndpoint(netProtos, demuxTransProto, portOnly, &demuxEndpoint{}, false); err != tcpip.ErrPortInUse {
+		t.Fatalf("registerEndpoint(%+v) without reuse = %v, want %v", portOnly, err, tcpip.ErrPortInUse)
+	}
+	localOnly := TransportEndpointID{80, demuxLocalAddr, 0, ""}
+	localEP := &demuxEndpoint{}
+	if err := d.registerEndpoint(netProtos, demuxTransProto, localOnly, localEP, false); err != nil {
+		t.Fatalf("registerEndpoint(%+v) failed: %v", localOnly, err)
+	}
+
+	check := func(want ...int) {
+		t.Helper()
+		for i, ep := range append(eps, localEP) {
+			if ep.packets != want[i] {
+				t.Errorf("endpoint %d got %d packets, want %d", i, ep.packets, want[i])
+			}
+			ep.packets = 0
+		}
+	}
+
+	r := &Route{NetProto: demuxNetProto}
+	id := TransportEndpointID{80, demuxLocalAddr, 1000, demuxRemoteAddr}
+	v := buffer.NewView(1)
+	vv := v.ToVectorisedView([1]buffer.View{})
+
+	// Unicast packets go to the most specific endpoint only, and multicast
+	// ones to all the endpoints they match.
+	d.deliverPacket(r, demuxTransProto, &vv, id)
+	check(0, 0, 0, 1)
+	d.deliverMulticastPacket(r, demuxTransProto, &vv, id)
+	check(1, 1, 1, 1)
+	id.LocalAddress = demuxOtherAddr
+	d.deliverPacket(r, demuxTransProto, &vv, id)
+	check(1, 0, 0, 0)
+	d.deliverMulticastPacket(r, demuxTransProto, &vv, id)
+	check(1, 1, 1, 0)
+
+	d.unregisterEndpoint(netProtos, demuxTransProto, portOnly, eps[0])
+	d.deliverPacket(r, demuxTransProto, &vv, id)
+	d.deliverMulticastPacket(r, demuxTransProto, &vv, id)
+	check(0, 2, 1, 0)
+	if got := len(d.registeredEndpoints(nil, 1)); got != 3 {
+		t.Errorf("got %d registered endpoints, want 3", got)
+	}
+}
+
+func TestEndpointTableCollisions(t *testing.T) {
+	var c endpointTable
+
+	// Find two IDs with the same hash.
+	seen := make(map[uint32]TransportEndpointID)
+	var a, b TransportEndpointID
+	rng := rand.New(rand.NewSource(1))
+	for {
+		var addr [4]byte
+		rng.Read(addr[:])
+		id := TransportEndpointID{uint16(rng.Uint32()), demuxLocalAddr, uint16(rng.Uint32()), tcpip.Address(addr[:])}
+		h := c.hash(id)
+		if other, ok := seen[h]; ok && other != id {
+			a, b = other, id
+			break
+		}
+		seen[h] = id
+	}
+
+	epA, epB := &demuxEndpoint{}, &demuxEndpoint{}
+	get := func(id TransportEndpointID) TransportEndpoint {
+		if e := c.get(id); e != nil {
+			return e.eps[0]
+		}
+		return nil
+	}
+	check := func(wantA, wantB TransportEndpoint) {
+		t.Helper()
+		if got := get(a); got != wantA {
+			t.Fatalf("get(%+v) = %v, want %v", a, got, wantA)
+		}
+		if got := get(b); got != wantB {
+			t.Fatalf("get(%+v) = %v, want %v", b, got, wantB)
+		}
+	}
+	put := func(id TransportEndpointID, ep TransportEndpoint) {
+		c.put(&endpointEntry{id: id, eps: []TransportEndpoint{ep}})
+	}
+
+	put(a, epA)
+	put(b, epB)
+	check(epA, epB)
+
+	// Replace the endpoint at the end of the chain.
+	epC := &demuxEndpoint{}
+	put(a, epC)
+	check(epC, epB)
+	put(a, epA)
+
+	// Remove the endpoint at the end of the chain, then at its start.
+	if !c.remove(a) {
+		t.Fatalf("remove(%+v) = false, want true", a)
+	}
+	check(nil, epB)
+	put(a, epA)
+	if !c.remove(a) {
+		t.Fatalf("remove(%+v) = false, want true", a)
+	}
+	if c.remove(a) {
+		t.Fatalf("remove(%+v) = true after removing it, want false", a)
+	}
+	check(nil, epB)
+
+	if !c.remove(b) {
+		t.Fatalf("remove(%+v) = false, want true", b)
+	}
+	check(nil, nil)
+	if c.size != 0 || len(c.load()) != 0 {
+		t.Fatalf("got %d endpoints in %d buckets after removing all, want none", c.size, len(c.load()))
+	}
+}
+
+// TestDemuxConcurrentChanges checks that packets are delivered while endpoints
+// are registered and unregistered, growing and emptying the tables.
+func TestDemuxConcurrentChanges(t *testing.T) {
+	d := newTestDemuxer()
+	netProtos := []tcpip.NetworkProtocolNumber{demuxNetProto}
+	tep := d.protocol[protocolIDs{demuxNetProto, demuxTransProto}]
+
+	connected := TransportEndpointID{80, demuxLocalAddr, 1000, demuxRemoteAddr}
+	bound := TransportEndpointID{81, "", 0, ""}
+	connectedEP, boundEP := &demuxEndpoint{}, &demuxEndpoint{}
+	if err := d.registerEndpoint(netProtos, demuxTransProto, connected, connectedEP, false); err != nil {
+		t.Fatalf("registerEndpoint(%+v) failed: %v", connected, err)
+	}
+	if err := d.registerEndpoint(netProtos, demuxTransProto, bound, boundEP, true); err != nil {
+		t.Fatalf("registerEndpoint(%+v) failed: %v", bound, err)
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if got := d.findEndpoint(tep, nil, connected); got != TransportEndpoint(connectedEP) {
+					t.Errorf("findEndpoint(%+v) = %v, want %v", connected, got, connectedEP)
+					return
+				}
+				id := TransportEndpointID{81, demuxLocalAddr, 1000, demuxRemoteAddr}
+				if got := d.findEndpoint(tep, nil, id); got != TransportEndpoint(boundEP) {
+					t.Errorf("findEndpoint(%+v) = %v, want %v", id, got, boundEP)
+					return
+				}
+			}
+		}()
+	}
+
+	for round := 0; round < 10; round++ {
+		var ids []TransportEndpointID
+		for i := 0; i < 1000; i++ {
+			id := TransportEndpointID{uint16(82 + i%10), demuxLocalAddr, uint16(1024 + i), demuxRemoteAddr}
+			if err := d.registerEndpoint(netProtos, demuxTransProto, id, &demuxEndpoint{}, false); err != nil {
+				t.Fatalf("registerEndpoint(%+v) failed: %v", id, err)
+			}
+			ids = append(ids, id)
+		}
+		other := &demuxEndpoint{}
+		if err := d.registerEndpoint(netProtos, demuxTransProto, bound, other, true); err != nil {
+			t.Fatalf("registerEndpoint(%+v) failed: %v", bound, err)
+		}
+		d.unregisterEndpoint(netProtos, demuxTransProto, bound, other)
+		for _, id := range ids {
+			d.unregisterEndpoint(netProtos, demuxTransProto, id, nil)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	if got := len(d.registeredEndpoints(nil, 1)); got != 2 {
+		t.Errorf("got %d registered endpoints, want 2", got)
+	}
+}
+
+// BenchmarkDemux measures the rate at which packets are delivered by a demuxer
+// with 10k connected endpoints and a few listening ones.
+func BenchmarkDemux(b *testing.B) {
+	const connections = 10000
+
+	d := newTestDemuxer()
+	netProtos := []tcpip.NetworkProtocolNumber{demuxNetProto}
+	ep := &demuxEndpoint{}
+	for i := 0; i < connections; i++ {
+		id := TransportEndpointID{uint16(1 + i%100), demuxLocalAddr, uint16(1024 + i/100), demuxRemoteAddr}
+		if err := d.registerEndpoint(netProtos, demuxTransProto, id, ep, false); err != nil {
+			b.Fatalf("registerEndpoint failed: %v", err)
+		}
+	}
+	for port := uint16(1); port <= 100; port++ {
+		if err := d.registerEndpoint(netProtos, demuxTransProto, TransportEndpointID{port, "", 0, ""}, ep, false); err != nil {
+			b.Fatalf("registerEndpoint failed: %v", err)
+		}
+	}
+	r := &Route{NetProto: demuxNetProto}
+
+	for _, bm := range []struct {
+		name string
+		id   TransportEndpointID
+	}{
+		{"Connected", TransportEndpointID{50, demuxLocalAddr, 1050, demuxRemoteAddr}},
+		{"Listening", TransportEndpointID{50, demuxLocalAddr, 60000, demuxRemoteAddr}},
+		{"Unbound", TransportEndpointID{200, demuxLocalAddr, 60000, demuxRemoteAddr}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d.deliverPacket(r, demuxTransProto, nil, bm.id)
+			}
+		})
+	}
+}
+
+// nopEndpoint is a transport endpoint that ignores the packets delivered to
+// it, so that it can be delivered to concurrently.
+type nopEndpoint struct {
+	demuxEndpoint
+}
+
+func (*nopEndpoint) HandlePacket(*Route, TransportEndpointID, *buffer.VectorisedView) {
+}
+
+// BenchmarkDemuxParallel measures the rate at which packets are delivered by a
+// demuxer to a few endpoints bound to a port, like UDP servers, from several
+// goroutines at once. Run with -cpu to see how it scales.
+func BenchmarkDemuxParallel(b *testing.B) {
+	const hot = 4
+
+	d := newTestDemuxer()
+	netProtos := []tcpip.NetworkProtocolNumber{demuxNetProto}
+	for i := 0; i < 1000; i++ {
+		id := TransportEndpointID{uint16(1 + i%100), demuxLocalAddr, uint16(1024 + i/100), demuxRemoteAddr}
+		if err := d.registerEndpoint(netProtos, demuxTransProto, id, &demuxEndpoint{}, false); err != nil {
+			b.Fatalf("registerEndpoint failed: %v", err)
+		}
+	}
+	for port := uint16(1); port <= hot; port++ {
+		if err := d.registerEndpoint(netProtos, demuxTransProto, TransportEndpointID{port, "", 0, ""}, &nopEndpoint{}, false); err != nil {
+			b.Fatalf("registerEndpoint failed: %v", err)
+		}
+	}
+	r := &Route{NetProto: demuxNetProto}
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		id := TransportEndpointID{1, demuxLocalAddr, 60000, demuxRemoteAddr}
+		for i := 0; pb.Next(); i++ {
+			id.LocalPort = uint16(1 + i%hot)
+			d.deliverPacket(r, demuxTransProto, nil, id)
+		}
+	})
+}
@@ -60,7 +60,7 @@ func (f *fakeTransportEndpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions)
 	if err != nil {
 		return 0, err
 	}
-	if err := f.route.WritePacket(&hdr, v, fakeTransNumber); err != nil {
+	if err := f.route.WritePacket(nil, &hdr, v, fakeTransNumber); err != nil {
 		return 0, err
 	}
 
@@ -97,7 +97,7 @@ func (f *fakeTransportEndpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 
 	// Try to register so that we can start receiving packets.
 	f.id.RemoteAddress = addr.Addr
-	err = f.stack.RegisterTransportEndpoint(0, []tcpip.NetworkProtocolNumber{fakeNetNumber}, fakeTransNumber, f.id, f)
+	err = f.stack.RegisterTransportEndpoint(0, []tcpip.NetworkProtocolNumber{fakeNetNumber}, fakeTransNumber, f.id, f, false)
 	if err != nil {
 		return err
 	}
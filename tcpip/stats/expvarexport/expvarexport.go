@@ -0,0 +1,57 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package expvarexport publishes the statistics of a tcpip stack with the
+// expvar package, so that they are served along with the other variables of
+// the program, e.g., on /debug/vars.
+package expvarexport
+
+import (
+	"expvar"
+	"strconv"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// snapshot is the value published for a stack. The counters of tcpip.Stats
+// are serialized as a nested object mirroring its structure, so counters added
+// to it later are published as well.
+type snapshot struct {
+	tcpip.Stats
+
+	// NICs holds the traffic counters of each NIC, keyed by NIC name, or
+	// by NIC ID for unnamed NICs.
+	NICs map[string]tcpip.NICStats
+}
+
+// PublishStats publishes the statistics of s as an expvar variable named
+// prefix. The statistics are read every time the variable is, so they're
+// always current.
+//
+// As with expvar.Publish, it panics if a variable named prefix is already
+// published.
+func PublishStats(prefix string, s *stack.Stack) {
+	expvar.Publish(prefix, expvar.Func(func() interface{} {
+		return stats(s)
+	}))
+}
+
+// stats returns a snapshot of the statistics of s, which expvar serializes with
+// encoding/json.
+func stats(s *stack.Stack) snapshot {
+	infos := s.NICInfo()
+	snap := snapshot{
+		Stats: s.Stats(),
+		NICs:  make(map[string]tcpip.NICStats, len(infos)),
+	}
+	for id, info := range infos {
+		name := info.Name
+		if name == "" {
+			name = strconv.Itoa(int(id))
+		}
+		snap.NICs[name] = info.Stats
+	}
+	return snap
+}
@@ -0,0 +1,86 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package expvarexport_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/stats/expvarexport"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+func TestPublishStats(t *testing.T) {
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+	if err := s.CreateNamedNIC(1, "lo", loopback.New()); err != nil {
+		t.Fatalf("CreateNamedNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, "\x7f\x00\x00\x01"); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	expvarexport.PublishStats("netstack", s)
+
+	// Send a datagram to a port nobody listens on.
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	to := tcpip.FullAddress{Addr: "\x7f\x00\x00\x01", Port: 1234}
+	if _, err := ep.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{To: &to}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	v := expvar.Get("netstack")
+	if v == nil {
+		t.Fatalf("Stats weren't published")
+	}
+	var got struct {
+		UDP struct {
+			PacketsSent       uint64
+			UnknownPortErrors uint64
+		}
+		IP struct {
+			PacketsSent uint64
+		}
+		NICs map[string]map[string]uint64
+	}
+	if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+		t.Fatalf("Unmarshal(%s) failed: %v", v, err)
+	}
+	if got.UDP.PacketsSent != 1 || got.UDP.UnknownPortErrors != 1 {
+		t.Errorf("got UDP stats %+v, want 1 packet sent and 1 unknown port error", got.UDP)
+	}
+	if got.IP.PacketsSent != 1 {
+		t.Errorf("got IP.PacketsSent = %d, want 1", got.IP.PacketsSent)
+	}
+	if n := got.NICs["lo"]["RxPackets"]; n != 1 {
+		t.Errorf("got %d packets received by NIC lo, want 1 (stats %s)", n, v)
+	}
+
+	// The variable is read lazily, so it reflects later traffic.
+	if _, err := ep.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{To: &to}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := json.Unmarshal([]byte(v.String()), &got); err != nil {
+		t.Fatalf("Unmarshal(%s) failed: %v", v, err)
+	}
+	if got.UDP.PacketsSent != 2 {
+		t.Errorf("got UDP.PacketsSent = %d, want 2", got.UDP.PacketsSent)
+	}
+}
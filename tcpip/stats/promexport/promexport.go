@@ -0,0 +1,183 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build promexport
+// +build promexport
+
+// Package promexport provides a Prometheus collector for the statistics of a
+// tcpip stack. It is kept apart from the stack so that only the programs using
+// it depend on the Prometheus client.
+//
+// The package requires github.com/prometheus/client_golang, which netstack does
+// not vendor, and is therefore only built with the promexport build tag:
+//
+//	go get github.com/prometheus/client_golang/prometheus
+//	go build -tags promexport ...
+package promexport
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "netstack"
+
+// statDesc describes the metric exported for a field of a stats structure.
+type statDesc struct {
+	// index is the index sequence of the field, for reflect.FieldByIndex.
+	index []int
+	desc  *prometheus.Desc
+}
+
+// Collector is a prometheus.Collector exporting the statistics of a stack. The
+// counters of tcpip.Stats are exported as counters such as
+// netstack_tcp_segments_sent_total, and those of the tcpip.NICStats of each NIC
+// as counters such as netstack_nic_rx_packets_total, labeled with the name of
+// the NIC, or its ID if it has none. Optionally, the occupancy of the accept
+// queues of TCP listeners is exported as the netstack_tcp_accept_queue_length
+// and netstack_tcp_accept_queue_backlog gauges.
+//
+// Metric names are derived from the names of the fields of the stats
+// structures, so counters added to them are exported as well.
+//
+// The metrics are gathered from snapshots of the stack's statistics and
+// endpoints, so no lock of the stack is held while they are collected.
+type Collector struct {
+	stack     *stack.Stack
+	listeners bool
+
+	stats         []statDesc
+	nicStats      []statDesc
+	acceptQueued  *prometheus.Desc
+	acceptBacklog *prometheus.Desc
+}
+
+// NewCollector returns a collector of the statistics of s. If listeners is
+// true, the accept queues of the TCP listeners of s are exported too, with
+// one series per listener.
+func NewCollector(s *stack.Stack, listeners bool) *Collector {
+	listenerLabels := []string{"address", "network_protocol", "nic", "port"}
+	c := &Collector{
+		stack:     s,
+		listeners: listeners,
+		acceptQueued: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "tcp", "accept_queue_length"),
+			"Number of connections waiting to be accepted by a TCP listener.",
+			listenerLabels, nil),
+		acceptBacklog: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "tcp", "accept_queue_backlog"),
+			"Maximum number of connections waiting to be accepted by a TCP listener.",
+			listenerLabels, nil),
+	}
+	c.stats = counterDescs(nil, reflect.TypeOf(tcpip.Stats{}), nil, "", "tcpip.Stats", nil)
+	c.nicStats = counterDescs(nil, reflect.TypeOf(tcpip.NICStats{}), nil, "nic", "tcpip.NICStats", []string{"nic"})
+	return c
+}
+
+// counterDescs appends the descriptions of the counters of the struct type t,
+// found at the given index sequence and path in the top-level stats
+// structure, to descs and returns the result. Counters are either
+// tcpip.StatCounter or uint64 fields. The names of the metrics start with
+// prefix.
+func counterDescs(descs []statDesc, t reflect.Type, index []int, prefix, path string, labels []string) []statDesc {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fIndex := append(append([]int(nil), index...), i)
+		fPath := path + "." + f.Name
+		name := snakeCase(f.Name)
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+		if f.Type == reflect.TypeOf(tcpip.StatCounter{}) || f.Type.Kind() == reflect.Uint64 {
+			descs = append(descs, statDesc{
+				index: fIndex,
+				desc: prometheus.NewDesc(
+					prometheus.BuildFQName(namespace, "", name+"_total"),
+					"Value of the "+fPath+" counter.",
+					labels, nil),
+			})
+		} else if f.Type.Kind() == reflect.Struct {
+			descs = counterDescs(descs, f.Type, fIndex, name, fPath, labels)
+		}
+	}
+	return descs
+}
+
+// snakeCase converts a Go identifier, e.g., "TCPSegmentsSent", to snake case,
+// e.g., "tcp_segments_sent".
+func snakeCase(s string) string {
+	r := []rune(s)
+	var b strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) {
+			prev := r[i-1]
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(c))
+	}
+	return b.String()
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range c.stats {
+		ch <- d.desc
+	}
+	for _, d := range c.nicStats {
+		ch <- d.desc
+	}
+	if c.listeners {
+		ch <- c.acceptQueued
+		ch <- c.acceptBacklog
+	}
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stack.Stats()
+	v := reflect.ValueOf(&stats).Elem()
+	for _, d := range c.stats {
+		sc := v.FieldByIndex(d.index).Addr().Interface().(*tcpip.StatCounter)
+		ch <- prometheus.MustNewConstMetric(d.desc, prometheus.CounterValue, float64(sc.Value()))
+	}
+
+	for id, info := range c.stack.NICInfo() {
+		name := info.Name
+		if name == "" {
+			name = strconv.Itoa(int(id))
+		}
+		v := reflect.ValueOf(info.Stats)
+		for _, d := range c.nicStats {
+			ch <- prometheus.MustNewConstMetric(d.desc, prometheus.CounterValue, float64(v.FieldByIndex(d.index).Uint()), name)
+		}
+	}
+
+	if !c.listeners {
+		return
+	}
+	eps, _ := c.stack.RegisteredEndpoints()
+	for _, e := range eps {
+		if e.TransportProtocol != tcp.ProtocolNumber || !e.Listening {
+			continue
+		}
+		labels := []string{
+			e.ID.LocalAddress.String(),
+			strconv.Itoa(int(e.NetworkProtocol)),
+			strconv.Itoa(int(e.NIC)),
+			strconv.Itoa(int(e.ID.LocalPort)),
+		}
+		ch <- prometheus.MustNewConstMetric(c.acceptQueued, prometheus.GaugeValue, float64(e.AcceptQueued), labels...)
+		ch <- prometheus.MustNewConstMetric(c.acceptBacklog, prometheus.GaugeValue, float64(e.AcceptBacklog), labels...)
+	}
+}
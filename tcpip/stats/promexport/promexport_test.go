@@ -0,0 +1,134 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build promexport
+// +build promexport
+
+package promexport_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/stats/promexport"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const localhost = "\x7f\x00\x00\x01"
+
+func newStack(t *testing.T) *stack.Stack {
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName, udp.ProtocolName})
+	if err := s.CreateNamedNIC(1, "lo", loopback.New()); err != nil {
+		t.Fatalf("CreateNamedNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, localhost); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+	return s
+}
+
+// scrape returns the metrics served by a handler for reg.
+func scrape(t *testing.T, reg *prometheus.Registry) string {
+	srv := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	return string(b)
+}
+
+func TestCollector(t *testing.T) {
+	s := newStack(t)
+
+	var wq waiter.Queue
+	listener, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Addr: localhost, Port: 80}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := listener.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	// Send a datagram to a port nobody listens on.
+	ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	to := tcpip.FullAddress{Addr: localhost, Port: 1234}
+	if _, err := ep.Write(tcpip.SlicePayload("hello"), tcpip.WriteOptions{To: &to}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(promexport.NewCollector(s, true))
+	metrics := scrape(t, reg)
+	for _, want := range []string{
+		"netstack_udp_packets_sent_total 1\n",
+		"netstack_udp_unknown_port_errors_total 1\n",
+		"netstack_ip_packets_sent_total 1\n",
+		"netstack_tcp_segments_sent_total 0\n",
+		`netstack_nic_rx_packets_total{nic="lo"} 1` + "\n",
+		`netstack_tcp_accept_queue_length{address="127.0.0.1",network_protocol="2048",nic="1",port="80"} 0` + "\n",
+		`netstack_tcp_accept_queue_backlog{address="127.0.0.1",network_protocol="2048",nic="1",port="80"} 10` + "\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("got metrics:\n%s\nwant series %q", metrics, want)
+		}
+	}
+}
+
+func TestCollectorWithoutListeners(t *testing.T) {
+	s := newStack(t)
+
+	var wq waiter.Queue
+	listener, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Port: 80}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := listener.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(promexport.NewCollector(s, false))
+	metrics := scrape(t, reg)
+	if strings.Contains(metrics, "netstack_tcp_accept_queue") {
+		t.Errorf("got metrics:\n%s\nwant no accept queue series", metrics)
+	}
+	if !strings.Contains(metrics, "netstack_dropped_packets_total 0\n") {
+		t.Errorf("got metrics:\n%s\nwant netstack_dropped_packets_total", metrics)
+	}
+}
@@ -19,10 +19,14 @@
 package tcpip
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/netstack/tcpip/buffer"
@@ -76,22 +80,42 @@ var (
 	ErrInvalidOptionValue    = &Error{"invalid option value specified"}
 	ErrNoLinkAddress         = &Error{"no remote link address"}
 	ErrBadAddress            = &Error{"bad address"}
+	ErrNotPermitted          = &Error{"operation not permitted"}
 )
 
 // Errors related to Subnet
 var (
 	errSubnetLengthMismatch = errors.New("subnet length of address and mask differ")
 	errSubnetAddressMasked  = errors.New("subnet address has bits set outside the mask")
+	errSubnetPrefixLength   = errors.New("subnet prefix longer than the address")
 )
 
-// A Clock provides the current time.
+// A Clock provides the current time and timers.
 //
-// Times returned by a Clock should always be used for application-visible
-// time, but never for netstack internal timekeeping.
+// The stack uses its Clock for application-visible times as well as for all its
+// internal timekeeping, so that tests can control the passing of time.
 type Clock interface {
 	// NowNanoseconds returns the current real time as a number of
 	// nanoseconds since some epoch.
 	NowNanoseconds() int64
+
+	// AfterFunc waits for the duration to elapse according to the clock
+	// and then calls f in its own goroutine, as time.AfterFunc does. The
+	// returned Timer can be used to cancel the call.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer created by Clock.AfterFunc. *time.Timer implements it.
+type Timer interface {
+	// Stop prevents the timer from firing. It returns true if the call
+	// stops the timer, false if the timer has already expired or been
+	// stopped.
+	Stop() bool
+
+	// Reset changes the timer to expire after duration d. It returns true
+	// if the timer had been active, false if it had expired or been
+	// stopped.
+	Reset(d time.Duration) bool
 }
 
 // StdClock implements Clock with the time package.
@@ -102,6 +126,31 @@ func (*StdClock) NowNanoseconds() int64 {
 	return time.Now().UnixNano()
 }
 
+// AfterFunc implements Clock.AfterFunc.
+func (*StdClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// Rand is a source of random numbers, used by the networking stack for its
+// initial sequence numbers, ephemeral ports and IP identifiers among others.
+// It must be safe for concurrent use.
+type Rand interface {
+	// Uint32 returns a random 32-bit value.
+	Uint32() uint32
+}
+
+// CryptoRand implements Rand with the crypto/rand package.
+type CryptoRand struct{}
+
+// Uint32 implements Rand.Uint32.
+func (*CryptoRand) Uint32() uint32 {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("unable to get random numbers: " + err.Error())
+	}
+	return binary.LittleEndian.Uint32(b[:])
+}
+
 // Address is a byte slice cast as a string that represents the address of a
 // network node. Or, in the case of unix endpoints, it may represent a path.
 type Address string
@@ -128,6 +177,28 @@ func NewSubnet(a Address, m AddressMask) (Subnet, error) {
 	return Subnet{a, m}, nil
 }
 
+// NewSubnetFromPrefix creates the Subnet made of the first prefixLen bits of
+// a, the others being cleared.
+func NewSubnetFromPrefix(a Address, prefixLen int) (Subnet, error) {
+	if prefixLen < 0 || prefixLen > len(a)*8 {
+		return Subnet{}, errSubnetPrefixLength
+	}
+	addr := []byte(a)
+	mask := make([]byte, len(a))
+	for i := range mask {
+		switch {
+		case prefixLen >= 8:
+			mask[i] = 0xff
+			prefixLen -= 8
+		case prefixLen > 0:
+			mask[i] = ^byte(0xff >> uint(prefixLen))
+			prefixLen = 0
+		}
+		addr[i] &= mask[i]
+	}
+	return Subnet{Address(addr), AddressMask(mask)}, nil
+}
+
 // Contains returns true iff the address is of the same length and matches the
 // subnet address and mask.
 func (s *Subnet) Contains(a Address) bool {
@@ -216,7 +287,9 @@ type Payload interface {
 	Size() int
 }
 
-// SlicePayload implements Payload on top of slices for convenience.
+// SlicePayload implements Payload on top of slices for convenience. The slices
+// Get returns are the payload itself rather than copies, so writing a
+// SlicePayload hands its data over to the endpoint, see Endpoint.Write.
 type SlicePayload []byte
 
 // Get implements Payload.
@@ -334,6 +407,80 @@ type Endpoint interface {
 	GetSockOpt(opt interface{}) *Error
 }
 
+// CloneableEndpoint is an Endpoint that can be shared between several owners,
+// much like a file descriptor duplicated with dup(2).
+type CloneableEndpoint interface {
+	Endpoint
+
+	// Clone returns a new reference to the endpoint. All references share
+	// the same state, including the port reservation and registration of
+	// the endpoint, which are only released once the endpoint and all its
+	// clones are closed. Closing a reference only affects the endpoint if
+	// it is its last reference.
+	Clone() (Endpoint, *Error)
+}
+
+// ViewEndpoint is an Endpoint whose received data can be read in place, without
+// copying it out of the buffers it was received into.
+type ViewEndpoint interface {
+	Endpoint
+
+	// ReadView reads data like Read, but returns the views holding it
+	// rather than a copy. Stream endpoints return at most n bytes, which
+	// may be fewer than are available; message endpoints return a whole
+	// message regardless of n.
+	//
+	// The caller owns the returned VectorisedView, and must release it
+	// with Release once done with its views, which it must not modify.
+	ReadView(n int, addr *FullAddress) (buffer.VectorisedView, ControlMessages, *Error)
+
+	// PeekView is like ReadView, but doesn't consume the data.
+	PeekView(n int) (buffer.VectorisedView, ControlMessages, *Error)
+}
+
+// PacketType is the type of a packet seen by a packet endpoint, relative to the
+// host, as with the sll_pkttype field of Linux's struct sockaddr_ll.
+type PacketType int
+
+const (
+	// PacketHost is the type of inbound unicast packets.
+	PacketHost PacketType = iota
+
+	// PacketBroadcast is the type of inbound broadcast packets.
+	PacketBroadcast
+
+	// PacketMulticast is the type of inbound multicast packets.
+	PacketMulticast
+
+	// PacketOutgoing is the type of packets sent by the host.
+	PacketOutgoing
+)
+
+// LinkPacketInfo holds the link-layer information of a packet read from a
+// packet endpoint.
+type LinkPacketInfo struct {
+	// Protocol is the network protocol of the packet, i.e., its EtherType.
+	Protocol NetworkProtocolNumber
+
+	// Type is the type of the packet.
+	Type PacketType
+
+	// SourceLinkAddress and DestinationLinkAddress are the link-layer
+	// addresses of the packet, when known.
+	SourceLinkAddress      LinkAddress
+	DestinationLinkAddress LinkAddress
+}
+
+// PacketEndpoint is an Endpoint that sends and receives network-layer packets
+// directly over a NIC, as with AF_PACKET sockets of type SOCK_DGRAM.
+type PacketEndpoint interface {
+	Endpoint
+
+	// ReadPacket reads a packet like Read, and also returns its link-layer
+	// information in info, if not nil.
+	ReadPacket(addr *FullAddress, info *LinkPacketInfo) (buffer.View, ControlMessages, *Error)
+}
+
 // WriteOptions contains options for Endpoint.Write.
 type WriteOptions struct {
 	// If To is not nil, write to the given address instead of the endpoint's
@@ -345,6 +492,12 @@ type WriteOptions struct {
 
 	// EndOfRecord has the same semantics as Linux's MSG_EOR.
 	EndOfRecord bool
+
+	// Push requests that the segment carrying the end of the written data
+	// have the TCP PSH flag set, e.g., at the end of a message, so that the
+	// peer delivers it promptly. Otherwise, PSH is only set on segments that
+	// empty the send queue.
+	Push bool
 }
 
 // ErrorOption is used in GetSockOpt to specify that the last error reported by
@@ -355,6 +508,14 @@ type ErrorOption struct{}
 // buffer size option.
 type SendBufferSizeOption int
 
+// SendBufferWatermarksOption is used by SetSockOpt/GetSockOpt to specify the
+// send buffer occupancy, in bytes, at which waiter.EventSndHigh and
+// waiter.EventSndLow are notified. A High of zero disables the notifications.
+type SendBufferWatermarksOption struct {
+	High int
+	Low  int
+}
+
 // ReceiveBufferSizeOption is used by SetSockOpt/GetSockOpt to specify the
 // receive buffer size option.
 type ReceiveBufferSizeOption int
@@ -376,10 +537,94 @@ type V6OnlyOption int
 // Nagle algorithm is on or off.
 type NoDelayOption int
 
+// DelayedAckOption is used by SetSockOpt/GetSockOpt to specify whether the
+// transport protocol may delay the acknowledgement of received data, so that
+// it can be combined with the acknowledgement of further data, or with data
+// sent in the other direction. Delayed acknowledgements are disabled by
+// default.
+type DelayedAckOption int
+
+// QuickAckOption is used by SetSockOpt/GetSockOpt to request that the next
+// received data be acknowledged immediately, even if delayed acknowledgements
+// are enabled. The option is cleared once that acknowledgement is sent.
+type QuickAckOption int
+
+// TCPUserTimeoutOption is used by SetSockOpt/GetSockOpt to specify how long
+// transmitted data may remain unacknowledged before the connection is reset, as
+// with TCP_USER_TIMEOUT. It overrides the default, which is to give up after a
+// number of retransmissions. Zero restores the default.
+type TCPUserTimeoutOption time.Duration
+
+// MaxSegOption is used by SetSockOpt/GetSockOpt to cap the maximum segment
+// size of a TCP endpoint, as with TCP_MAXSEG. Segments sent by the endpoint
+// carry at most this many bytes of payload, and if it's set before the
+// connection is established, the MSS advertised to the peer is capped too.
+// Zero, the default, leaves the MSS to the path MTU.
+type MaxSegOption int
+
+// IPv6FlowInfoOption is used by SetSockOpt/GetSockOpt to specify the flow label
+// of the IPv6 packets sent by an endpoint, as with IPV6_FLOWINFO. Only the low
+// 20 bits may be set. Zero, the default, lets the stack compute a stable label
+// for each flow, as recommended by RFC 6437. The label takes effect when the
+// endpoint connects, or on the next send for unconnected endpoints.
+type IPv6FlowInfoOption uint32
+
+// TOSOption is used by SetSockOpt/GetSockOpt to specify the IPv4 type of
+// service, or the IPv6 traffic class, of the packets sent by an endpoint, as
+// with IP_TOS and IPV6_TCLASS. Its upper six bits are the DSCP of the packets.
+type TOSOption uint8
+
+// PriorityOption is used by SetSockOpt/GetSockOpt to specify the priority of
+// the packets sent by an endpoint, as with SO_PRIORITY. It isn't sent on the
+// wire: link endpoints that queue outbound packets, such as those of package
+// prio, use it to choose the queue of each packet. For TCP, it takes effect
+// when the endpoint connects.
+type PriorityOption uint8
+
+// TTLOption is used by SetSockOpt/GetSockOpt to specify the IPv4 time to live,
+// or the IPv6 hop limit, of the packets sent by an endpoint, as with IP_TTL and
+// IPV6_UNICAST_HOPS. Zero, the default, stands for the DefaultTTLOption of the
+// network protocol at the time packets are sent.
+type TTLOption uint8
+
+// DefaultTTLOption is used by stack.(*Stack).SetNetworkProtocolOption and
+// stack.(*Stack).NetworkProtocolOption to specify the IPv4 time to live, or the
+// IPv6 hop limit, of the packets whose endpoint doesn't set its own with
+// TTLOption. It must be between 1 and 255.
+type DefaultTTLOption uint8
+
+// AcceptSourceRouteOption is used by stack.(*Stack).SetNetworkProtocolOption
+// and stack.(*Stack).NetworkProtocolOption to specify whether packets routed
+// by their source, with an IPv4 loose or strict source route option or an IPv6
+// type 0 routing header, are accepted. It's disabled by default, since those
+// can be used to amplify traffic and get around filters; they're then dropped
+// and counted in IPStats.SourceRoutedPacketsDropped.
+type AcceptSourceRouteOption bool
+
+// IPHdrIncludedOption is used by SetSockOpt/GetSockOpt to specify whether the
+// data read from and written to a raw endpoint includes the network-layer
+// header, as with IP_HDRINCL. When it's disabled, the default, the header is
+// stripped from received packets and built from the route on sends.
+type IPHdrIncludedOption int
+
+// ICMPv6FilterOption is used by SetSockOpt/GetSockOpt to specify the types of
+// the ICMPv6 messages delivered to a raw ICMPv6 endpoint, as with
+// ICMPV6_FILTER. Messages of type t are blocked if bit t%32 of DenyType[t/32]
+// is set. All messages are delivered by default.
+type ICMPv6FilterOption struct {
+	DenyType [8]uint32
+}
+
 // ReuseAddressOption is used by SetSockOpt/GetSockOpt to specify whether Bind()
 // should allow reuse of local address.
 type ReuseAddressOption int
 
+// BindToDeviceOption is used by SetSockOpt/GetSockOpt to specify the NIC an
+// endpoint is bound to, as with SO_BINDTODEVICE. A bound endpoint only
+// receives packets that arrived on that NIC and only sends packets through it.
+// Zero means no NIC. It must be set before the endpoint is bound or connected.
+type BindToDeviceOption NICID
+
 // PasscredOption is used by SetSockOpt/GetSockOpt to specify whether
 // SCM_CREDENTIALS socket control messages are enabled.
 //
@@ -390,10 +635,58 @@ type PasscredOption int
 // SO_TIMESTAMP socket control messages are enabled.
 type TimestampOption int
 
-// TCPInfoOption is used by GetSockOpt to expose TCP statistics.
+// TCPMD5SigOption is used by SetSockOpt to set the key used to sign the TCP
+// segments exchanged with the peer at Addr, as described in RFC 2385. An empty
+// Key removes the key of the peer.
+type TCPMD5SigOption struct {
+	Addr Address
+	Key  []byte
+}
+
+// MigrateRemoteOption is used by SetSockOpt to move a connected endpoint to a
+// new remote address and port, for example when the peer roams to another
+// network, without disturbing the state of the connection. Once it's set,
+// packets from the new remote are delivered to the endpoint and packets from
+// the old one no longer are. Support for TCP endpoints is experimental.
+type MigrateRemoteOption struct {
+	Remote FullAddress
+}
+
+// PacketStatisticsOption is used by GetSockOpt to retrieve the number of
+// packets queued and dropped by a packet endpoint, as with PACKET_STATISTICS.
+// Unlike on Linux, reading the counters doesn't reset them.
+type PacketStatisticsOption struct {
+	// Packets is the number of packets queued for reading.
+	Packets uint64
+
+	// Drops is the number of packets dropped because the receive buffer
+	// was full.
+	Drops uint64
+}
+
+// TCPInfoOption is used by GetSockOpt to expose TCP statistics. The options
+// negotiated by the handshake are only reported once the connection is
+// established.
 //
 // TODO: Add and populate stat fields.
-type TCPInfoOption struct{}
+type TCPInfoOption struct {
+	// SndWndScale is the window scale, as defined in RFC 7323, of the
+	// windows announced by the peer. It's zero if the peer doesn't scale
+	// its window.
+	SndWndScale uint8
+
+	// RcvWndScale is the window scale of the windows announced to the
+	// peer. It's zero if the peer doesn't support window scaling.
+	RcvWndScale uint8
+
+	// SACKPermitted is true if selective acknowledgements, as defined in
+	// RFC 2018, were negotiated.
+	SACKPermitted bool
+
+	// Timestamps is true if the timestamps option, as defined in RFC 7323,
+	// was negotiated.
+	Timestamps bool
+}
 
 // Route is a row in the routing table. It specifies through which NIC (and
 // gateway) sets of packets should be routed. A row is considered viable if the
@@ -438,23 +731,351 @@ type TransportProtocolNumber uint32
 // NetworkProtocolNumber is the number of a network protocol.
 type NetworkProtocolNumber uint32
 
+// StatCounter is a counter of the networking stack. Counters are safe for
+// concurrent use, and the zero value is a counter at zero.
+type StatCounter struct {
+	count uint64
+}
+
+// Increment adds one to the counter.
+func (s *StatCounter) Increment() {
+	s.IncrementBy(1)
+}
+
+// IncrementBy adds v to the counter.
+func (s *StatCounter) IncrementBy(v uint64) {
+	atomic.AddUint64(&s.count, v)
+}
+
+// Value returns the current value of the counter.
+func (s *StatCounter) Value() uint64 {
+	return atomic.LoadUint64(&s.count)
+}
+
+// String implements fmt.Stringer.String.
+func (s *StatCounter) String() string {
+	return strconv.FormatUint(s.Value(), 10)
+}
+
+// MarshalJSON implements json.Marshaler.MarshalJSON, so that counters are
+// serialized as plain numbers. It is meant for snapshots returned by
+// Stats.Clone, as it doesn't read the counter atomically.
+func (s StatCounter) MarshalJSON() ([]byte, error) {
+	return strconv.AppendUint(nil, s.count, 10), nil
+}
+
 // Stats holds statistics about the networking stack.
+//
+// The counters of a live stack are updated concurrently, so they must only be
+// read through their Value method. A consistent copy of all of them can be
+// taken with Clone, and the activity between two copies computed with Delta:
+//
+//	before := s.Stats()
+//	...
+//	after := s.Stats()
+//	delta := after.Delta(&before)
 type Stats struct {
 	// UnknownProtocolRcvdPackets is the number of packets received by the
 	// stack that were for an unknown or unsupported protocol.
-	UnknownProtocolRcvdPackets uint64
+	UnknownProtocolRcvdPackets StatCounter
 
 	// UnknownNetworkEndpointRcvdPackets is the number of packets received
 	// by the stack that were for a supported network protocol, but whose
 	// destination address didn't having a matching endpoint.
-	UnknownNetworkEndpointRcvdPackets uint64
+	UnknownNetworkEndpointRcvdPackets StatCounter
 
 	// MalformedRcvPackets is the number of packets received by the stack
 	// that were deemed malformed.
-	MalformedRcvdPackets uint64
+	MalformedRcvdPackets StatCounter
 
 	// DroppedPackets is the number of packets dropped due to full queues.
-	DroppedPackets uint64
+	DroppedPackets StatCounter
+
+	// RateLimitedSentPackets is the number of packets dropped because they
+	// exceeded the send rate limit of the stack.
+	RateLimitedSentPackets StatCounter
+
+	// RateLimitedRcvdPackets is the number of packets dropped because they
+	// exceeded the receive rate limit of the stack.
+	RateLimitedRcvdPackets StatCounter
+
+	// ChecksumSkippedRcvdPackets is the number of packets received by
+	// transport endpoints whose checksum wasn't verified because the link
+	// had already validated it.
+	ChecksumSkippedRcvdPackets StatCounter
+
+	// ChecksumVerifiedRcvdPackets is the number of packets received by
+	// transport endpoints whose checksum was verified in software.
+	ChecksumVerifiedRcvdPackets StatCounter
+
+	// UnknownPortRcvdPackets is the number of packets received by the
+	// stack for a supported transport protocol that matched no endpoint.
+	UnknownPortRcvdPackets StatCounter
+
+	// ClosedEndpointRcvdPackets is the number of packets that matched a
+	// transport endpoint which no longer accepted them, because it was
+	// closed or shut down for reading.
+	ClosedEndpointRcvdPackets StatCounter
+
+	// RouteLookups is the number of times the route table was searched for
+	// a route, which endpoints avoid by caching their routes.
+	RouteLookups StatCounter
+
+	// IP holds the counters of IPv4 and IPv6.
+	IP IPStats
+
+	// ICMP holds the counters of ICMPv4 and ICMPv6.
+	ICMP ICMPStats
+
+	// TCP holds the counters of TCP.
+	TCP TCPStats
+
+	// UDP holds the counters of UDP.
+	UDP UDPStats
+}
+
+// IPStats holds the counters of the IP protocols.
+type IPStats struct {
+	// PacketsReceived is the number of IP packets received from the link
+	// layer.
+	PacketsReceived StatCounter
+
+	// InvalidAddressesReceived is the number of IP packets received with
+	// a destination address the stack doesn't accept.
+	InvalidAddressesReceived StatCounter
+
+	// StrongHostDrops is the number of the IP packets counted in
+	// InvalidAddressesReceived that are addressed to another NIC than the
+	// one that received them, which would accept them in the weak host
+	// model.
+	StrongHostDrops StatCounter
+
+	// SourceRoutedPacketsDropped is the number of IP packets dropped
+	// because they're routed by their source: all of them unless
+	// AcceptSourceRouteOption is enabled, and those that still have
+	// nodes to visit otherwise, since the stack doesn't forward them.
+	SourceRoutedPacketsDropped StatCounter
+
+	// ReassemblyAborted is the number of fragmented IP packets whose
+	// reassembly was given up because they had too many fragments.
+	ReassemblyAborted StatCounter
+
+	// PacketsDelivered is the number of IP packets handed over to the
+	// transport layer.
+	PacketsDelivered StatCounter
+
+	// PacketsSent is the number of IP packets written to the link layer.
+	PacketsSent StatCounter
+
+	// OutgoingPacketErrors is the number of IP packets that couldn't be
+	// written to the link layer.
+	OutgoingPacketErrors StatCounter
+}
+
+// ICMPStats holds the counters of the ICMP protocols.
+type ICMPStats struct {
+	// EchoRequestsReceived is the number of echo requests received.
+	EchoRequestsReceived StatCounter
+
+	// EchoRepliesReceived is the number of echo replies received.
+	EchoRepliesReceived StatCounter
+
+	// DstUnreachableReceived is the number of destination unreachable
+	// messages received.
+	DstUnreachableReceived StatCounter
+}
+
+// TCPStats holds the counters of TCP.
+type TCPStats struct {
+	// ActiveConnectionOpenings is the number of connections initiated by
+	// the stack that completed their handshake.
+	ActiveConnectionOpenings StatCounter
+
+	// PassiveConnectionOpenings is the number of connections initiated by
+	// peers that completed their handshake.
+	PassiveConnectionOpenings StatCounter
+
+	// FailedConnectionAttempts is the number of connections initiated by
+	// the stack whose handshake failed.
+	FailedConnectionAttempts StatCounter
+
+	// SegmentsReceived is the number of valid segments received.
+	SegmentsReceived StatCounter
+
+	// SegmentsSent is the number of segments sent, including
+	// retransmissions.
+	SegmentsSent StatCounter
+
+	// ResetsSent is the number of segments sent with the RST flag.
+	ResetsSent StatCounter
+
+	// Retransmits is the number of segments retransmitted before the
+	// retransmit timer expired, e.g., by fast retransmit.
+	Retransmits StatCounter
+
+	// Timeouts is the number of times the retransmit timer expired.
+	Timeouts StatCounter
+
+	// TailLossProbes is the number of tail loss probes sent.
+	TailLossProbes StatCounter
+
+	// SpuriousTimeouts is the number of retransmission timeouts that F-RTO
+	// found to be spurious.
+	SpuriousTimeouts StatCounter
+
+	// ListenOverflows is the number of handshakes completed by peers while
+	// the accept queue of the listening endpoint was full, and that were
+	// dropped or reset as set by the accept queue overflow policy.
+	ListenOverflows StatCounter
+}
+
+// UDPStats holds the counters of UDP.
+type UDPStats struct {
+	// PacketsReceived is the number of datagrams queued to endpoints.
+	PacketsReceived StatCounter
+
+	// UnknownPortErrors is the number of datagrams that matched no
+	// endpoint.
+	UnknownPortErrors StatCounter
+
+	// ReceiveBufferErrors is the number of datagrams dropped because the
+	// receive buffer of their endpoint was full.
+	ReceiveBufferErrors StatCounter
+
+	// MalformedPacketsReceived is the number of datagrams whose length or
+	// checksum was invalid.
+	MalformedPacketsReceived StatCounter
+
+	// PacketsSent is the number of datagrams sent.
+	PacketsSent StatCounter
+}
+
+// Clone returns a copy of s. Each counter is read atomically, but the copy
+// doesn't represent the stats at any single point in time if they are being
+// updated concurrently.
+func (s *Stats) Clone() Stats {
+	var c Stats
+	dst := c.counters()
+	for i, sc := range s.counters() {
+		dst[i].count = sc.Value()
+	}
+	return c
+}
+
+// Delta returns the difference between the counters of s and those of prev,
+// which must have been taken earlier from the same stats, e.g., with Clone.
+func (s *Stats) Delta(prev *Stats) Stats {
+	var d Stats
+	dst, pcs := d.counters(), prev.counters()
+	for i, sc := range s.counters() {
+		dst[i].count = sc.Value() - pcs[i].Value()
+	}
+	return d
+}
+
+// Reset sets all the counters of s back to zero. Counters incremented while
+// s is being reset may or may not be reset.
+func (s *Stats) Reset() {
+	for _, c := range s.counters() {
+		atomic.StoreUint64(&c.count, 0)
+	}
+}
+
+// counters returns pointers to all the counters of s, in a fixed order.
+func (s *Stats) counters() []*StatCounter {
+	return appendCounters(nil, reflect.ValueOf(s).Elem())
+}
+
+// appendCounters appends pointers to the counters of the struct v, which must
+// be addressable, to cs and returns the result. Counters in nested structs are
+// included.
+func appendCounters(cs []*StatCounter, v reflect.Value) []*StatCounter {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if c, ok := f.Addr().Interface().(*StatCounter); ok {
+			cs = append(cs, c)
+		} else {
+			cs = appendCounters(cs, f)
+		}
+	}
+	return cs
+}
+
+// TransportProtocolStats holds the counters of a single transport protocol.
+type TransportProtocolStats struct {
+	// UnknownPortRcvdPackets is the number of packets of the protocol
+	// that matched no endpoint.
+	UnknownPortRcvdPackets uint64
+
+	// MalformedRcvdPackets is the number of packets of the protocol whose
+	// header was too short or couldn't be parsed.
+	MalformedRcvdPackets uint64
+}
+
+// NICStats holds the traffic counters of a single NIC. Packet sizes are
+// network-layer sizes, that is, they don't include link-layer headers.
+//
+// Multicast and broadcast packets are identified by their destination network
+// address; they're also included in the total packet counts.
+type NICStats struct {
+	// TxPackets is the number of packets successfully written to the link
+	// endpoint.
+	TxPackets uint64
+
+	// TxBytes is the number of bytes in the packets counted by TxPackets.
+	TxBytes uint64
+
+	// TxErrors is the number of packets that the link endpoint failed to
+	// write.
+	TxErrors uint64
+
+	// TxMulticastPackets is the number of multicast packets counted by
+	// TxPackets.
+	TxMulticastPackets uint64
+
+	// TxBroadcastPackets is the number of broadcast packets counted by
+	// TxPackets.
+	TxBroadcastPackets uint64
+
+	// RxPackets is the number of packets received from the link endpoint,
+	// including those that were dropped.
+	RxPackets uint64
+
+	// RxBytes is the number of bytes in the packets counted by RxPackets.
+	RxBytes uint64
+
+	// RxMulticastPackets is the number of multicast packets counted by
+	// RxPackets.
+	RxMulticastPackets uint64
+
+	// RxBroadcastPackets is the number of broadcast packets counted by
+	// RxPackets.
+	RxBroadcastPackets uint64
+
+	// RxUnknownProtocolPackets is the number of received packets dropped
+	// because their network or transport protocol is unknown.
+	RxUnknownProtocolPackets uint64
+
+	// RxMalformedPackets is the number of received packets dropped because
+	// they were malformed.
+	RxMalformedPackets uint64
+
+	// RxNoEndpointPackets is the number of received packets dropped because
+	// no network endpoint of the NIC matched their destination address.
+	RxNoEndpointPackets uint64
+
+	// RxChecksumTrustedPackets is the number of received packets whose
+	// checksums were validated by the link, and thus trusted by the stack.
+	RxChecksumTrustedPackets uint64
+
+	// ForwardedPackets is the number of packets received by other NICs
+	// that were forwarded through this one. They are also counted by
+	// TxPackets.
+	ForwardedPackets uint64
+
+	// ForwardedBytes is the number of bytes in the packets counted by
+	// ForwardedPackets.
+	ForwardedBytes uint64
 }
 
 // String implements the fmt.Stringer interface.
@@ -539,4 +1160,8 @@ type ProtocolAddress struct {
 
 	// Address is a network address.
 	Address Address
+
+	// PrefixLen is the length in bits of the prefix of the subnet the
+	// address belongs to.
+	PrefixLen int
 }
@@ -5,6 +5,8 @@
 package tcpip
 
 import (
+	"encoding/json"
+	"sync"
 	"testing"
 )
 
@@ -109,6 +111,28 @@ func TestSubnetCreation(t *testing.T) {
 	}
 }
 
+func TestSubnetFromPrefix(t *testing.T) {
+	tests := []struct {
+		a       Address
+		l       int
+		want    Subnet
+		wantErr error
+	}{
+		{"\xab", 0, Subnet{"\x00", "\x00"}, nil},
+		{"\xab", 4, Subnet{"\xa0", "\xf0"}, nil},
+		{"\xab", 8, Subnet{"\xab", "\xff"}, nil},
+		{"\xab\xcd", 12, Subnet{"\xab\xc0", "\xff\xf0"}, nil},
+		{"\xab", 9, Subnet{}, errSubnetPrefixLength},
+		{"\xab", -1, Subnet{}, errSubnetPrefixLength},
+	}
+	for _, tt := range tests {
+		got, err := NewSubnetFromPrefix(tt.a, tt.l)
+		if got != tt.want || err != tt.wantErr {
+			t.Errorf("NewSubnetFromPrefix(%x, %d) = %+v, %v, want %+v, %v", tt.a, tt.l, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
 func TestRouteMatch(t *testing.T) {
 	tests := []struct {
 		d    Address
@@ -128,3 +152,104 @@ func TestRouteMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestStatsConcurrentUpdates(t *testing.T) {
+	const (
+		goroutines = 8
+		increments = 1000
+	)
+
+	var s Stats
+	counters := []*StatCounter{
+		&s.DroppedPackets,
+		&s.IP.PacketsReceived,
+		&s.TCP.SegmentsSent,
+		&s.UDP.PacketsReceived,
+	}
+
+	// Snapshot the stats while they are being incremented, checking that
+	// the snapshots never go backwards.
+	done := make(chan struct{})
+	snapshotted := make(chan struct{})
+	go func() {
+		defer close(snapshotted)
+		var prev Stats
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cur := s.Clone()
+			d := cur.Delta(&prev)
+			for i, c := range d.counters() {
+				if v := c.Value(); v > goroutines*increments {
+					t.Errorf("got delta %d for counter %d, it went backwards", v, i)
+					return
+				}
+			}
+			prev = cur
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				for _, c := range counters {
+					c.Increment()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	<-snapshotted
+
+	snap := s.Clone()
+	for i, c := range counters {
+		if got, want := c.Value(), uint64(goroutines*increments); got != want {
+			t.Errorf("got counter %d = %d, want %d", i, got, want)
+		}
+	}
+	if got, want := snap.TCP.SegmentsSent.Value(), uint64(goroutines*increments); got != want {
+		t.Errorf("got cloned TCP.SegmentsSent = %d, want %d", got, want)
+	}
+}
+
+func TestStatsDeltaAndReset(t *testing.T) {
+	var s Stats
+	s.UDP.PacketsSent.IncrementBy(3)
+	before := s.Clone()
+
+	s.UDP.PacketsSent.Increment()
+	s.ICMP.EchoRequestsReceived.Increment()
+	after := s.Clone()
+
+	d := after.Delta(&before)
+	if got := d.UDP.PacketsSent.Value(); got != 1 {
+		t.Errorf("got UDP.PacketsSent delta = %d, want 1", got)
+	}
+	if got := d.ICMP.EchoRequestsReceived.Value(); got != 1 {
+		t.Errorf("got ICMP.EchoRequestsReceived delta = %d, want 1", got)
+	}
+
+	b, err := json.Marshal(&d)
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %v", err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("json.Unmarshal failed: %v", err)
+	}
+	if got := m["UDP"].(map[string]interface{})["PacketsSent"]; got != float64(1) {
+		t.Errorf("got UDP.PacketsSent = %v in JSON %s, want 1", got, b)
+	}
+
+	s.Reset()
+	if got := s.Clone(); got != (Stats{}) {
+		t.Errorf("got stats %+v after Reset, want zero", got)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package testutil provides helpers for the tests of the networking stack.
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+)
+
+// ManualClock is a tcpip.Clock whose time only moves forward when advanced
+// with Advance, which also runs the functions of the timers that expire.
+//
+// It is safe for concurrent use.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    int64
+	timers map[*manualTimer]struct{}
+}
+
+// NewManualClock creates a ManualClock whose time starts at zero.
+func NewManualClock() *ManualClock {
+	return &ManualClock{timers: make(map[*manualTimer]struct{})}
+}
+
+// NowNanoseconds implements tcpip.Clock.NowNanoseconds.
+func (c *ManualClock) NowNanoseconds() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// AfterFunc implements tcpip.Clock.AfterFunc. f is called from Advance, in
+// the goroutine that advances the clock past the expiration time of the timer.
+func (c *ManualClock) AfterFunc(d time.Duration, f func()) tcpip.Timer {
+	t := &manualTimer{clock: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the time of the clock forward by d, then calls the functions of
+// the timers that have expired in the order of their expiration times. Timers
+// set by these functions expire relative to the new time.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now += int64(d)
+	for {
+		var next *manualTimer
+		for t := range c.timers {
+			if t.target <= c.now && (next == nil || t.target < next.target) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		delete(c.timers, next)
+
+		c.mu.Unlock()
+		next.f()
+		c.mu.Lock()
+	}
+	c.mu.Unlock()
+}
+
+// PendingTimers returns the number of timers that are set to expire.
+func (c *ManualClock) PendingTimers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// NextExpiration returns the time left until the first of the timers set to
+// expire does, or false if there are none.
+func (c *ManualClock) NextExpiration() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var next *manualTimer
+	for t := range c.timers {
+		if next == nil || t.target < next.target {
+			next = t
+		}
+	}
+	if next == nil {
+		return 0, false
+	}
+	return time.Duration(next.target - c.now), true
+}
+
+// manualTimer is a tcpip.Timer created by ManualClock.AfterFunc.
+type manualTimer struct {
+	clock *ManualClock
+	f     func()
+
+	// target is the expiration time of the timer. It's protected by
+	// clock.mu.
+	target int64
+}
+
+// Stop implements tcpip.Timer.Stop.
+func (t *manualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return active
+}
+
+// Reset implements tcpip.Timer.Reset.
+func (t *manualTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	_, active := t.clock.timers[t]
+	t.target = t.clock.now + int64(d)
+	t.clock.timers[t] = struct{}{}
+	return active
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testutil
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	c := NewManualClock()
+
+	var fired []string
+	record := func(name string) func() {
+		return func() {
+			fired = append(fired, name)
+		}
+	}
+	c.AfterFunc(3*time.Second, record("3s"))
+	c.AfterFunc(1*time.Second, record("1s"))
+	stopped := c.AfterFunc(2*time.Second, record("stopped"))
+	reset := c.AfterFunc(time.Second, record("reset"))
+
+	if !stopped.Stop() {
+		t.Errorf("Stop() = false on an active timer, want true")
+	}
+	if stopped.Stop() {
+		t.Errorf("Stop() = true on a stopped timer, want false")
+	}
+	if !reset.Reset(4 * time.Second) {
+		t.Errorf("Reset() = false on an active timer, want true")
+	}
+
+	c.Advance(500 * time.Millisecond)
+	if len(fired) != 0 {
+		t.Fatalf("got timers %v fired after 500ms, want none", fired)
+	}
+	if got, want := c.NowNanoseconds(), int64(500*time.Millisecond); got != want {
+		t.Fatalf("got NowNanoseconds() = %d, want %d", got, want)
+	}
+
+	// Timers set by expiring ones are relative to the new time.
+	c.AfterFunc(0, func() {
+		fired = append(fired, "0s")
+		c.AfterFunc(time.Second, record("chained"))
+	})
+
+	c.Advance(3 * time.Second)
+	if want := []string{"0s", "1s", "3s"}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("got timers %v fired after 3.5s, want %v", fired, want)
+	}
+	if got, want := c.PendingTimers(), 2; got != want {
+		t.Fatalf("got PendingTimers() = %d, want %d", got, want)
+	}
+	if d, ok := c.NextExpiration(); !ok || d != 500*time.Millisecond {
+		t.Fatalf("got NextExpiration() = %v, %t, want %v, true", d, ok, 500*time.Millisecond)
+	}
+
+	fired = nil
+	c.Advance(time.Second)
+	if want := []string{"reset", "chained"}; !reflect.DeepEqual(fired, want) {
+		t.Fatalf("got timers %v fired after 4.5s, want %v", fired, want)
+	}
+	if d, ok := c.NextExpiration(); ok {
+		t.Fatalf("got NextExpiration() = %v, true with no timers, want false", d)
+	}
+}
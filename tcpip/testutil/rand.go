@@ -0,0 +1,31 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package testutil
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// SeededRand is a tcpip.Rand whose sequence of numbers is determined by the
+// seed it's created with, so that stacks using it behave reproducibly.
+//
+// It is safe for concurrent use.
+type SeededRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// NewSeededRand creates a SeededRand from the given seed.
+func NewSeededRand(seed int64) *SeededRand {
+	return &SeededRand{rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Uint32 implements tcpip.Rand.Uint32.
+func (r *SeededRand) Uint32() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rnd.Uint32()
+}
@@ -0,0 +1,394 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package packet provides the implementation of packet endpoints, which send
+// and receive network-layer packets directly over a NIC, like AF_PACKET
+// sockets of type SOCK_DGRAM. They're meant for diagnostics and link-level
+// protocols such as LLDP.
+//
+// To use it in the networking stack, this package must be added to the
+// project. Packet endpoints can then be created by calling
+// Stack.NewPacketEndpoint(), unless they were disabled with
+// Stack.SetRawEndpointsAllowed().
+//
+// A packet endpoint receives packets once it's bound to a NIC. It then gets a
+// copy of every packet of its protocol sent or received by the NIC, including
+// the ones delivered to other endpoints, along with their link-layer
+// information, which can be read with ReadPacket.
+package packet
+
+import (
+	"sync"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+type packet struct {
+	packetEntry
+	nicID     tcpip.NICID
+	info      tcpip.LinkPacketInfo
+	data      buffer.View
+	timestamp int64
+}
+
+// endpoint represents a packet endpoint. This struct serves as the interface
+// between users of the endpoint and the stack; it is legal to have concurrent
+// goroutines make calls into the endpoint, they are properly synchronized.
+type endpoint struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the endpoint.
+	stack       *stack.Stack
+	netProto    tcpip.NetworkProtocolNumber
+	waiterQueue *waiter.Queue
+
+	// The following fields are used to manage the receive queue, and are
+	// protected by rcvMu.
+	rcvMu         sync.Mutex
+	rcvList       packetList
+	rcvBufSizeMax int
+	rcvBufSize    int
+	rcvClosed     bool
+	rcvTimestamp  bool
+	rcvPackets    uint64
+	rcvDrops      uint64
+
+	// The following fields are protected by the mu mutex.
+	mu        sync.RWMutex
+	bound     bool
+	closed    bool
+	bindNICID tcpip.NICID
+}
+
+func newEndpoint(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	return &endpoint{
+		stack:         s,
+		netProto:      netProto,
+		waiterQueue:   waiterQueue,
+		rcvBufSizeMax: 32 * 1024,
+	}, nil
+}
+
+// Close puts the endpoint in a closed state and frees all resources
+// associated with it.
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed {
+		return
+	}
+
+	if e.bound {
+		e.stack.UnregisterPacketEndpoint(e.bindNICID, e.netProto, e)
+	}
+
+	// Close the receive list and drain it.
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvBufSize = 0
+	for !e.rcvList.Empty() {
+		p := e.rcvList.Front()
+		e.rcvList.Remove(p)
+	}
+	e.rcvMu.Unlock()
+
+	e.closed = true
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+}
+
+// Read reads a packet from the endpoint. This method does not block if there
+// is no packet pending. As with struct sockaddr_ll, the address holds the NIC
+// of the packet and, as Addr, its source link address.
+func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, tcpip.ControlMessages, *tcpip.Error) {
+	return e.ReadPacket(addr, nil)
+}
+
+// ReadPacket implements tcpip.PacketEndpoint.ReadPacket.
+func (e *endpoint) ReadPacket(addr *tcpip.FullAddress, info *tcpip.LinkPacketInfo) (buffer.View, tcpip.ControlMessages, *tcpip.Error) {
+	e.rcvMu.Lock()
+
+	if e.rcvList.Empty() {
+		err := tcpip.ErrWouldBlock
+		if e.rcvClosed {
+			err = tcpip.ErrClosedForReceive
+		}
+		e.rcvMu.Unlock()
+		return buffer.View{}, tcpip.ControlMessages{}, err
+	}
+
+	p := e.rcvList.Front()
+	e.rcvList.Remove(p)
+	e.rcvBufSize -= len(p.data)
+	ts := e.rcvTimestamp
+
+	e.rcvMu.Unlock()
+
+	if addr != nil {
+		*addr = tcpip.FullAddress{
+			NIC:  p.nicID,
+			Addr: tcpip.Address(p.info.SourceLinkAddress),
+		}
+	}
+	if info != nil {
+		*info = p.info
+	}
+
+	if ts && p.timestamp == 0 {
+		// Linux uses the current time.
+		p.timestamp = e.stack.NowNanoseconds()
+	}
+
+	return p.data, tcpip.ControlMessages{HasTimestamp: ts, Timestamp: p.timestamp}, nil
+}
+
+// Write sends a packet of the endpoint's protocol through the NIC it's bound
+// to, or the one of the destination if it isn't bound. The address of the
+// destination is the link address the packet is sent to.
+func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, *tcpip.Error) {
+	// MSG_MORE is unimplemented. (This also means that MSG_EOR is a no-op.)
+	if opts.More {
+		return 0, tcpip.ErrInvalidOptionValue
+	}
+
+	to := opts.To
+	if to == nil {
+		return 0, tcpip.ErrDestinationRequired
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return 0, tcpip.ErrInvalidEndpointState
+	}
+
+	// Packets are sent with the endpoint's protocol, so endpoints of all
+	// protocols can't send.
+	if e.netProto == 0 {
+		return 0, tcpip.ErrUnknownProtocol
+	}
+
+	nicid := to.NIC
+	if e.bound {
+		if nicid != 0 && nicid != e.bindNICID {
+			return 0, tcpip.ErrNoRoute
+		}
+
+		nicid = e.bindNICID
+	}
+	if nicid == 0 {
+		return 0, tcpip.ErrDestinationRequired
+	}
+
+	v, err := p.Get(p.Size())
+	if err != nil {
+		return 0, err
+	}
+
+	if err := e.stack.WriteLinkPacket(nicid, tcpip.LinkAddress(to.Addr), e.netProto, v); err != nil {
+		return 0, err
+	}
+
+	return uintptr(len(v)), nil
+}
+
+// Peek only returns data from a single datagram, so do nothing here.
+func (e *endpoint) Peek([][]byte) (uintptr, tcpip.ControlMessages, *tcpip.Error) {
+	return 0, tcpip.ControlMessages{}, nil
+}
+
+// SetSockOpt sets a socket option.
+func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
+	switch v := opt.(type) {
+	case tcpip.ReceiveBufferSizeOption:
+		if v <= 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		e.rcvMu.Lock()
+		e.rcvBufSizeMax = int(v)
+		e.rcvMu.Unlock()
+
+	case tcpip.TimestampOption:
+		e.rcvMu.Lock()
+		e.rcvTimestamp = v != 0
+		e.rcvMu.Unlock()
+	}
+	return nil
+}
+
+// GetSockOpt implements tcpip.Endpoint.GetSockOpt.
+func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
+	switch o := opt.(type) {
+	case tcpip.ErrorOption:
+		return nil
+
+	case *tcpip.ReceiveBufferSizeOption:
+		e.rcvMu.Lock()
+		*o = tcpip.ReceiveBufferSizeOption(e.rcvBufSizeMax)
+		e.rcvMu.Unlock()
+		return nil
+
+	case *tcpip.ReceiveQueueSizeOption:
+		e.rcvMu.Lock()
+		if e.rcvList.Empty() {
+			*o = 0
+		} else {
+			p := e.rcvList.Front()
+			*o = tcpip.ReceiveQueueSizeOption(len(p.data))
+		}
+		e.rcvMu.Unlock()
+		return nil
+
+	case *tcpip.PacketStatisticsOption:
+		e.rcvMu.Lock()
+		*o = tcpip.PacketStatisticsOption{
+			Packets: e.rcvPackets,
+			Drops:   e.rcvDrops,
+		}
+		e.rcvMu.Unlock()
+		return nil
+
+	case *tcpip.TimestampOption:
+		e.rcvMu.Lock()
+		*o = 0
+		if e.rcvTimestamp {
+			*o = 1
+		}
+		e.rcvMu.Unlock()
+		return nil
+	}
+
+	return tcpip.ErrUnknownProtocolOption
+}
+
+// Connect is not supported by packet endpoints.
+func (*endpoint) Connect(tcpip.FullAddress) *tcpip.Error {
+	return tcpip.ErrNotSupported
+}
+
+// Shutdown is not supported by packet endpoints.
+func (*endpoint) Shutdown(tcpip.ShutdownFlags) *tcpip.Error {
+	return tcpip.ErrNotSupported
+}
+
+// Listen is not supported by packet endpoints, it just fails.
+func (*endpoint) Listen(int) *tcpip.Error {
+	return tcpip.ErrNotSupported
+}
+
+// Accept is not supported by packet endpoints, it just fails.
+func (*endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+	return nil, nil, tcpip.ErrNotSupported
+}
+
+// Bind binds the endpoint to the NIC of the given address, so that it starts
+// receiving the packets sent and received by it. The rest of the address is
+// ignored.
+func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() *tcpip.Error) *tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.closed || e.bound {
+		return tcpip.ErrInvalidEndpointState
+	}
+	if addr.NIC == 0 {
+		return tcpip.ErrUnknownNICID
+	}
+
+	if err := e.stack.RegisterPacketEndpoint(addr.NIC, e.netProto, e); err != nil {
+		return err
+	}
+	if commit != nil {
+		if err := commit(); err != nil {
+			// Unregister, the commit failed.
+			e.stack.UnregisterPacketEndpoint(addr.NIC, e.netProto, e)
+			return err
+		}
+	}
+
+	e.bound = true
+	e.bindNICID = addr.NIC
+
+	return nil
+}
+
+// GetLocalAddress returns the NIC to which the endpoint is bound.
+func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, *tcpip.Error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return tcpip.FullAddress{NIC: e.bindNICID}, nil
+}
+
+// GetRemoteAddress is not supported by packet endpoints, which can't be
+// connected.
+func (*endpoint) GetRemoteAddress() (tcpip.FullAddress, *tcpip.Error) {
+	return tcpip.FullAddress{}, tcpip.ErrNotConnected
+}
+
+// Readiness returns the current readiness of the endpoint. For example, if
+// waiter.EventIn is set, the endpoint is immediately readable.
+func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	// The endpoint is always writable.
+	result := waiter.EventOut & mask
+
+	// Determine if the endpoint is readable if requested.
+	if (mask & waiter.EventIn) != 0 {
+		e.rcvMu.Lock()
+		if !e.rcvList.Empty() || e.rcvClosed {
+			result |= waiter.EventIn
+		}
+		e.rcvMu.Unlock()
+	}
+
+	return result
+}
+
+// HandlePacket implements stack.PacketEndpoint.HandlePacket.
+func (e *endpoint) HandlePacket(nicid tcpip.NICID, info tcpip.LinkPacketInfo, vv *buffer.VectorisedView) {
+	e.rcvMu.Lock()
+
+	if e.rcvClosed {
+		e.rcvMu.Unlock()
+		return
+	}
+
+	// Drop the packet if our buffer is currently full.
+	if e.rcvBufSize >= e.rcvBufSizeMax {
+		e.rcvDrops++
+		e.rcvMu.Unlock()
+		return
+	}
+
+	wasEmpty := e.rcvBufSize == 0
+
+	// Push a copy of the packet into the receive list, as it's also
+	// delivered to other endpoints, and increment the buffer size.
+	pkt := &packet{
+		nicID: nicid,
+		info:  info,
+		data:  vv.ToView(),
+	}
+	if e.rcvTimestamp {
+		pkt.timestamp = e.stack.NowNanoseconds()
+	}
+	e.rcvList.PushBack(pkt)
+	e.rcvBufSize += len(pkt.data)
+	e.rcvPackets++
+
+	e.rcvMu.Unlock()
+
+	// Notify any waiters that there's data to be read now.
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventIn)
+	}
+}
+
+func init() {
+	stack.RegisterPacketEndpointFactory(newEndpoint)
+}
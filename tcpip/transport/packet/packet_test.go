@@ -0,0 +1,322 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	_ "github.com/google/netstack/tcpip/transport/packet"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// lldpProtocolNumber is the EtherType of LLDP, which has no network
+	// protocol implementation in the stack.
+	lldpProtocolNumber = 0x88cc
+
+	addrA = tcpip.Address("\x0a\x00\x00\x01")
+	addrB = tcpip.Address("\x0a\x00\x00\x02")
+
+	linkAddrA = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	linkAddrB = tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+)
+
+type host struct {
+	s      *stack.Stack
+	linkEP *channel.Endpoint
+}
+
+func newHost(t *testing.T, addr tcpip.Address, linkAddr tcpip.LinkAddress) *host {
+	t.Helper()
+
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	id, linkEP := channel.New(256, 1500, linkAddr)
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+
+	return &host{s: s, linkEP: linkEP}
+}
+
+// relay moves the packets sent by from to to until done is closed.
+func relay(from, to *channel.Endpoint, done <-chan struct{}) {
+	for {
+		select {
+		case p := <-from.C:
+			v := append(append(buffer.View(nil), p.Header...), p.Payload...)
+			vv := v.ToVectorisedView([1]buffer.View{})
+			to.Inject(p.Proto, &vv)
+		case <-done:
+			return
+		}
+	}
+}
+
+func newPacketEndpoint(t *testing.T, s *stack.Stack, netProto tcpip.NetworkProtocolNumber) tcpip.PacketEndpoint {
+	t.Helper()
+
+	var wq waiter.Queue
+	ep, err := s.NewPacketEndpoint(netProto, &wq)
+	if err != nil {
+		t.Fatalf("NewPacketEndpoint failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{NIC: 1}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	return ep.(tcpip.PacketEndpoint)
+}
+
+// wait waits for ep to be ready for the given events, and fails the test if it
+// isn't within a second.
+func wait(t *testing.T, ep tcpip.Endpoint, wq *waiter.Queue, mask waiter.EventMask) {
+	t.Helper()
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, mask)
+	defer wq.EventUnregister(&we)
+
+	if ep.Readiness(mask) != 0 {
+		return
+	}
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for events %#x", mask)
+	}
+}
+
+func TestTCPConnection(t *testing.T) {
+	a, b := newHost(t, addrA, linkAddrA), newHost(t, addrB, linkAddrB)
+	done := make(chan struct{})
+	defer close(done)
+	go relay(a.linkEP, b.linkEP, done)
+	go relay(b.linkEP, a.linkEP, done)
+
+	pep := newPacketEndpoint(t, a.s, ipv4.ProtocolNumber)
+	defer pep.Close()
+
+	// Connect from B to a listener on A, then exchange data both ways.
+	var lwq, cwq waiter.Queue
+	listener, err := a.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &lwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer listener.Close()
+	if err := listener.Bind(tcpip.FullAddress{Port: 80}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := listener.Listen(1); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	client, err := b.s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &cwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer client.Close()
+	if err := client.Connect(tcpip.FullAddress{Addr: addrA, Port: 80}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Connect = %v, want %v", err, tcpip.ErrConnectStarted)
+	}
+	wait(t, client, &cwq, waiter.EventOut)
+	wait(t, listener, &lwq, waiter.EventIn)
+	server, swq, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer server.Close()
+
+	request, response := buffer.View("request"), buffer.View("response")
+	if _, err := client.Write(tcpip.SlicePayload(request), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wait(t, server, swq, waiter.EventIn)
+	if v, _, err := server.Read(nil); err != nil || !bytes.Equal(v, request) {
+		t.Fatalf("Read = %q, %v, want %q, nil", v, err, request)
+	}
+	if _, err := server.Write(tcpip.SlicePayload(response), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wait(t, client, &cwq, waiter.EventIn)
+	if v, _, err := client.Read(nil); err != nil || !bytes.Equal(v, response) {
+		t.Fatalf("Read = %q, %v, want %q, nil", v, err, response)
+	}
+
+	// The packet endpoint saw the handshake and the data in both
+	// directions.
+	const (
+		syn = iota
+		synAck
+		requestData
+		responseData
+	)
+	var seen [4]bool
+	for {
+		var addr tcpip.FullAddress
+		var info tcpip.LinkPacketInfo
+		v, _, err := pep.ReadPacket(&addr, &info)
+		if err == tcpip.ErrWouldBlock {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+		if addr.NIC != 1 || info.Protocol != ipv4.ProtocolNumber {
+			t.Fatalf("got packet of protocol %#x on NIC %d, want %#x on NIC 1", info.Protocol, addr.NIC, ipv4.ProtocolNumber)
+		}
+
+		ip := header.IPv4(v)
+		if !ip.IsValid(len(v)) || ip.TransportProtocol() != tcp.ProtocolNumber {
+			t.Fatalf("got an invalid TCP/IPv4 packet: %x", v)
+		}
+		inbound := info.Type == tcpip.PacketHost
+		switch {
+		case inbound && ip.SourceAddress() == addrB:
+		case info.Type == tcpip.PacketOutgoing && ip.SourceAddress() == addrA:
+			if info.SourceLinkAddress != linkAddrA {
+				t.Errorf("got outgoing packet from %v, want %v", info.SourceLinkAddress, linkAddrA)
+			}
+		default:
+			t.Fatalf("got packet of type %d from %v", info.Type, ip.SourceAddress())
+		}
+
+		tcpHdr := header.TCP(ip.Payload())
+		payload := buffer.View(tcpHdr.Payload())
+		switch {
+		case tcpHdr.Flags() == header.TCPFlagSyn:
+			seen[syn] = inbound
+		case tcpHdr.Flags() == header.TCPFlagSyn|header.TCPFlagAck:
+			seen[synAck] = !inbound
+		case bytes.Equal(payload, request):
+			seen[requestData] = inbound
+		case bytes.Equal(payload, response):
+			seen[responseData] = !inbound
+		}
+	}
+	for i, name := range []string{"inbound SYN", "outgoing SYN-ACK", "inbound request", "outgoing response"} {
+		if !seen[i] {
+			t.Errorf("%s wasn't seen by the packet endpoint", name)
+		}
+	}
+}
+
+func TestProtocolFilterAndWrite(t *testing.T) {
+	h := newHost(t, addrA, linkAddrA)
+	lldp := newPacketEndpoint(t, h.s, lldpProtocolNumber)
+	defer lldp.Close()
+	all := newPacketEndpoint(t, h.s, 0)
+	defer all.Close()
+
+	// An LLDP frame is received by both endpoints.
+	frame := buffer.View("lldp frame")
+	vv := frame.ToVectorisedView([1]buffer.View{})
+	h.linkEP.Inject(lldpProtocolNumber, &vv)
+
+	// A broadcast IPv4 packet is only received by the endpoint of all
+	// protocols.
+	pkt := buffer.NewView(header.IPv4MinimumSize)
+	header.IPv4(pkt).Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: header.IPv4MinimumSize,
+		TTL:         64,
+		Protocol:    uint8(tcp.ProtocolNumber),
+		SrcAddr:     addrB,
+		DstAddr:     header.IPv4Broadcast,
+	})
+	vv = pkt.ToVectorisedView([1]buffer.View{})
+	h.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+
+	for _, want := range []struct {
+		ep    tcpip.PacketEndpoint
+		data  buffer.View
+		proto tcpip.NetworkProtocolNumber
+		typ   tcpip.PacketType
+	}{
+		{lldp, frame, lldpProtocolNumber, tcpip.PacketHost},
+		{all, frame, lldpProtocolNumber, tcpip.PacketHost},
+		{all, pkt, ipv4.ProtocolNumber, tcpip.PacketBroadcast},
+	} {
+		var info tcpip.LinkPacketInfo
+		v, _, err := want.ep.ReadPacket(nil, &info)
+		if err != nil {
+			t.Fatalf("ReadPacket failed: %v", err)
+		}
+		if !bytes.Equal(v, want.data) || info.Protocol != want.proto || info.Type != want.typ {
+			t.Errorf("got packet %x of protocol %#x and type %d, want %x of protocol %#x and type %d", v, info.Protocol, info.Type, want.data, want.proto, want.typ)
+		}
+	}
+	if _, _, err := lldp.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Errorf("Read = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+
+	// Frames are sent to the given link address with the endpoint's
+	// protocol.
+	dst := tcpip.LinkAddress("\x01\x80\xc2\x00\x00\x0e")
+	if _, err := lldp.Write(tcpip.SlicePayload(frame), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: tcpip.Address(dst)}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case p := <-h.linkEP.C:
+		if p.Proto != lldpProtocolNumber || !bytes.Equal(p.Payload, frame) {
+			t.Errorf("got sent packet %x of protocol %#x, want %x of protocol %#x", p.Payload, p.Proto, frame, lldpProtocolNumber)
+		}
+	default:
+		t.Fatalf("no packet was sent")
+	}
+
+	// The endpoints see the outgoing frame.
+	var info tcpip.LinkPacketInfo
+	if _, _, err := all.ReadPacket(nil, &info); err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if info.Type != tcpip.PacketOutgoing || info.DestinationLinkAddress != dst {
+		t.Errorf("got outgoing packet of type %d to %v, want type %d to %v", info.Type, info.DestinationLinkAddress, tcpip.PacketOutgoing, dst)
+	}
+
+	// Endpoints of all protocols can't send.
+	if _, err := all.Write(tcpip.SlicePayload(frame), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: tcpip.Address(dst)}}); err == nil {
+		t.Errorf("Write on an endpoint of all protocols succeeded")
+	}
+}
+
+func TestDrops(t *testing.T) {
+	h := newHost(t, addrA, linkAddrA)
+	ep := newPacketEndpoint(t, h.s, lldpProtocolNumber)
+	defer ep.Close()
+
+	// The buffer only has room for one packet.
+	if err := ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	frame := buffer.View("frame")
+	for i := 0; i < 3; i++ {
+		vv := frame.ToVectorisedView([1]buffer.View{})
+		h.linkEP.Inject(lldpProtocolNumber, &vv)
+	}
+
+	var stats tcpip.PacketStatisticsOption
+	if err := ep.GetSockOpt(&stats); err != nil {
+		t.Fatalf("GetSockOpt failed: %v", err)
+	}
+	if want := (tcpip.PacketStatisticsOption{Packets: 1, Drops: 2}); stats != want {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+}
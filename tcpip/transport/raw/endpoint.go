@@ -0,0 +1,639 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package raw provides the implementation of raw endpoints, which send and
+// receive the packets of an arbitrary transport protocol directly over a
+// network protocol, e.g., to implement routing protocols such as OSPF or VRRP.
+//
+// To use it in the networking stack, this package must be added to the
+// project. Raw endpoints can then be created by calling Stack.NewRawEndpoint(),
+// unless they were disabled with Stack.SetRawEndpointsAllowed().
+//
+// Raw endpoints receive a copy of every inbound packet of their network and
+// transport protocols, including the ones also delivered to regular endpoints.
+// Binding or connecting a raw endpoint restricts the packets it receives to
+// those sent to the bound address or from the connected one, respectively.
+package raw
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/netstack/sleep"
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+type rawPacket struct {
+	rawPacketEntry
+	senderAddress tcpip.FullAddress
+	data          buffer.VectorisedView
+	timestamp     int64
+	hasTimestamp  bool
+	// views is used as buffer for data when its length is large
+	// enough to store a VectorisedView.
+	views [8]buffer.View
+}
+
+type endpointState int
+
+const (
+	stateInitial endpointState = iota
+	stateBound
+	stateConnected
+	stateClosed
+)
+
+// endpoint represents a raw endpoint. This struct serves as the interface
+// between users of the endpoint and the stack; it is legal to have concurrent
+// goroutines make calls into the endpoint, they are properly synchronized.
+type endpoint struct {
+	// The following fields are initialized at creation time and do not
+	// change throughout the lifetime of the endpoint.
+	stack       *stack.Stack
+	netProto    tcpip.NetworkProtocolNumber
+	transProto  tcpip.TransportProtocolNumber
+	waiterQueue *waiter.Queue
+
+	// hdrIncluded is set when IPHdrIncludedOption is enabled. It is
+	// accessed atomically.
+	hdrIncluded uint32
+
+	// The following fields are used to manage the receive queue, and are
+	// protected by rcvMu.
+	rcvMu         sync.Mutex
+	rcvList       rawPacketList
+	rcvBufSizeMax int
+	rcvBufSize    int
+	rcvClosed     bool
+	rcvTimestamp  bool
+
+	// icmpv6Filter selects the types of the ICMPv6 messages delivered, see
+	// tcpip.ICMPv6FilterOption. It is protected by rcvMu.
+	icmpv6Filter tcpip.ICMPv6FilterOption
+
+	// The following fields select the packets delivered to the endpoint,
+	// they are protected by rcvMu and only modified while also holding mu.
+	rcvNICID      tcpip.NICID
+	rcvLocalAddr  tcpip.Address
+	rcvRemoteAddr tcpip.Address
+
+	// The following fields are protected by the mu mutex.
+	mu         sync.RWMutex
+	sndBufSize int
+	state      endpointState
+	bindNICID  tcpip.NICID
+	bindAddr   tcpip.Address
+	route      stack.Route
+}
+
+func newEndpoint(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	switch netProto {
+	case header.IPv4ProtocolNumber, header.IPv6ProtocolNumber:
+	default:
+		return nil, tcpip.ErrUnknownProtocol
+	}
+
+	e := &endpoint{
+		stack:         s,
+		netProto:      netProto,
+		transProto:    transProto,
+		waiterQueue:   waiterQueue,
+		rcvBufSizeMax: 32 * 1024,
+		sndBufSize:    32 * 1024,
+	}
+	s.RegisterRawTransportEndpoint(netProto, transProto, e)
+	return e, nil
+}
+
+// Close puts the endpoint in a closed state and frees all resources
+// associated with it.
+func (e *endpoint) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state == stateClosed {
+		return
+	}
+
+	e.stack.UnregisterRawTransportEndpoint(e.netProto, e.transProto, e)
+
+	// Close the receive list and drain it.
+	e.rcvMu.Lock()
+	e.rcvClosed = true
+	e.rcvBufSize = 0
+	for !e.rcvList.Empty() {
+		p := e.rcvList.Front()
+		e.rcvList.Remove(p)
+		p.data.Release()
+	}
+	e.rcvMu.Unlock()
+
+	e.route.Release()
+
+	// Update the state.
+	e.state = stateClosed
+
+	e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
+}
+
+// Read reads data from the endpoint. This method does not block if
+// there is no data pending.
+func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, tcpip.ControlMessages, *tcpip.Error) {
+	e.rcvMu.Lock()
+
+	if e.rcvList.Empty() {
+		err := tcpip.ErrWouldBlock
+		if e.rcvClosed {
+			err = tcpip.ErrClosedForReceive
+		}
+		e.rcvMu.Unlock()
+		return buffer.View{}, tcpip.ControlMessages{}, err
+	}
+
+	p := e.rcvList.Front()
+	e.rcvList.Remove(p)
+	e.rcvBufSize -= p.data.Size()
+	ts := e.rcvTimestamp
+
+	e.rcvMu.Unlock()
+
+	if addr != nil {
+		*addr = p.senderAddress
+	}
+
+	if ts && !p.hasTimestamp {
+		// Linux uses the current time.
+		p.timestamp = e.stack.NowNanoseconds()
+	}
+
+	v := p.data.ToView()
+	p.data.Release()
+	return v, tcpip.ControlMessages{HasTimestamp: ts, Timestamp: p.timestamp}, nil
+}
+
+// Write writes data to the endpoint's peer. This method does not block
+// if the data cannot be written.
+func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, *tcpip.Error) {
+	// MSG_MORE is unimplemented. (This also means that MSG_EOR is a no-op.)
+	if opts.More {
+		return 0, tcpip.ErrInvalidOptionValue
+	}
+
+	to := opts.To
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state == stateClosed {
+		return 0, tcpip.ErrInvalidEndpointState
+	}
+
+	var route *stack.Route
+	if to == nil {
+		if e.state != stateConnected {
+			return 0, tcpip.ErrDestinationRequired
+		}
+		route = &e.route
+
+		if route.IsResolutionRequired() {
+			// Promote lock to exclusive if using a shared route, given that it may
+			// need to change in Route.Resolve() call below.
+			e.mu.RUnlock()
+			defer e.mu.RLock()
+
+			e.mu.Lock()
+			defer e.mu.Unlock()
+
+			// Recheck state after lock was re-acquired.
+			if e.state != stateConnected {
+				return 0, tcpip.ErrInvalidEndpointState
+			}
+		}
+	} else {
+		// Reject destination address if it goes through a different
+		// NIC than the endpoint was bound to.
+		nicid := to.NIC
+		if e.bindNICID != 0 {
+			if nicid != 0 && nicid != e.bindNICID {
+				return 0, tcpip.ErrNoRoute
+			}
+
+			nicid = e.bindNICID
+		}
+
+		r, err := e.stack.FindRoute(nicid, e.bindAddr, to.Addr, e.netProto)
+		if err != nil {
+			return 0, err
+		}
+		defer r.Release()
+
+		route = &r
+	}
+
+	if route.IsResolutionRequired() {
+		waker := &sleep.Waker{}
+		if err := route.Resolve(waker); err != nil {
+			if err == tcpip.ErrWouldBlock {
+				// Link address needs to be resolved. Resolution was triggered the
+				// background. Better luck next time.
+				route.RemoveWaker(waker)
+				return 0, tcpip.ErrNoLinkAddress
+			}
+			return 0, err
+		}
+	}
+
+	v, err := p.Get(p.Size())
+	if err != nil {
+		return 0, err
+	}
+
+	if atomic.LoadUint32(&e.hdrIncluded) == 0 {
+		if e.isICMPv6() && len(v) >= header.ICMPv6MinimumSize {
+			// As on Linux, the stack computes the checksum of
+			// ICMPv6 messages, which covers the addresses of the
+			// route. The user's buffer is left untouched.
+			v = append(buffer.View(nil), v...)
+			h := header.ICMPv6(v)
+			h.SetChecksum(0)
+			h.SetChecksum(header.ICMPv6Checksum(h, route.LocalAddress, route.RemoteAddress, nil))
+		}
+		hdr := buffer.NewPrependable(int(route.MaxHeaderLength()))
+		err = route.WritePacket(nil, &hdr, v, e.transProto)
+	} else {
+		err = e.writeHeaderIncluded(route, v)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return uintptr(len(v)), nil
+}
+
+// writeHeaderIncluded sends v, which holds a network-layer header provided by
+// the user, through the given route. The packet is sent as is, except that the
+// length and IPv4 header checksum fields are filled in if they're zero.
+func (e *endpoint) writeHeaderIncluded(r *stack.Route, v buffer.View) *tcpip.Error {
+	switch e.netProto {
+	case header.IPv4ProtocolNumber:
+		if len(v) < header.IPv4MinimumSize || len(v) > math.MaxUint16 {
+			return tcpip.ErrInvalidEndpointState
+		}
+		ip := header.IPv4(v)
+		if ip.TotalLength() == 0 || ip.Checksum() == 0 {
+			// The user's buffer is left untouched.
+			v = append(buffer.View(nil), v...)
+			ip = header.IPv4(v)
+			if ip.TotalLength() == 0 {
+				ip.SetTotalLength(uint16(len(v)))
+			}
+			if ip.Checksum() == 0 {
+				ip.SetChecksum(^ip.CalculateChecksum())
+			}
+		}
+		if !ip.IsValid(len(v)) {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+	case header.IPv6ProtocolNumber:
+		if len(v) < header.IPv6MinimumSize || len(v)-header.IPv6MinimumSize > math.MaxUint16 {
+			return tcpip.ErrInvalidEndpointState
+		}
+		if header.IPv6(v).PayloadLength() == 0 {
+			v = append(buffer.View(nil), v...)
+			header.IPv6(v).SetPayloadLength(uint16(len(v) - header.IPv6MinimumSize))
+		}
+		if !header.IPv6(v).IsValid(len(v)) {
+			return tcpip.ErrInvalidEndpointState
+		}
+	}
+
+	return r.WriteHeaderIncludedPacket(v)
+}
+
+// Peek only returns data from a single datagram, so do nothing here.
+func (e *endpoint) Peek([][]byte) (uintptr, tcpip.ControlMessages, *tcpip.Error) {
+	return 0, tcpip.ControlMessages{}, nil
+}
+
+// SetSockOpt sets a socket option.
+func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
+	switch v := opt.(type) {
+	case tcpip.IPHdrIncludedOption:
+		var b uint32
+		if v != 0 {
+			b = 1
+		}
+		atomic.StoreUint32(&e.hdrIncluded, b)
+
+	case tcpip.TimestampOption:
+		e.rcvMu.Lock()
+		e.rcvTimestamp = v != 0
+		e.rcvMu.Unlock()
+
+	case tcpip.ICMPv6FilterOption:
+		if !e.isICMPv6() {
+			return tcpip.ErrUnknownProtocolOption
+		}
+		e.rcvMu.Lock()
+		e.icmpv6Filter = v
+		e.rcvMu.Unlock()
+	}
+	return nil
+}
+
+// isICMPv6 returns true if e is a raw ICMPv6 endpoint.
+func (e *endpoint) isICMPv6() bool {
+	return e.netProto == header.IPv6ProtocolNumber && e.transProto == header.ICMPv6ProtocolNumber
+}
+
+// GetSockOpt implements tcpip.Endpoint.GetSockOpt.
+func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
+	switch o := opt.(type) {
+	case tcpip.ErrorOption:
+		return nil
+
+	case *tcpip.IPHdrIncludedOption:
+		*o = tcpip.IPHdrIncludedOption(atomic.LoadUint32(&e.hdrIncluded))
+		return nil
+
+	case *tcpip.SendBufferSizeOption:
+		e.mu.Lock()
+		*o = tcpip.SendBufferSizeOption(e.sndBufSize)
+		e.mu.Unlock()
+		return nil
+
+	case *tcpip.ReceiveBufferSizeOption:
+		e.rcvMu.Lock()
+		*o = tcpip.ReceiveBufferSizeOption(e.rcvBufSizeMax)
+		e.rcvMu.Unlock()
+		return nil
+
+	case *tcpip.ReceiveQueueSizeOption:
+		e.rcvMu.Lock()
+		if e.rcvList.Empty() {
+			*o = 0
+		} else {
+			p := e.rcvList.Front()
+			*o = tcpip.ReceiveQueueSizeOption(p.data.Size())
+		}
+		e.rcvMu.Unlock()
+		return nil
+
+	case *tcpip.TimestampOption:
+		e.rcvMu.Lock()
+		*o = 0
+		if e.rcvTimestamp {
+			*o = 1
+		}
+		e.rcvMu.Unlock()
+		return nil
+
+	case *tcpip.ICMPv6FilterOption:
+		if !e.isICMPv6() {
+			return tcpip.ErrUnknownProtocolOption
+		}
+		e.rcvMu.Lock()
+		*o = e.icmpv6Filter
+		e.rcvMu.Unlock()
+		return nil
+	}
+
+	return tcpip.ErrUnknownProtocolOption
+}
+
+// Connect connects the endpoint to its peer, so that it only receives packets
+// sent by it, and that it can send packets without specifying a destination.
+// Specifying a NIC is optional.
+func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state == stateClosed {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	nicid := addr.NIC
+	if e.bindNICID != 0 {
+		if nicid != 0 && nicid != e.bindNICID {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+		nicid = e.bindNICID
+	}
+
+	// Find a route to the desired destination.
+	r, err := e.stack.FindRoute(nicid, e.bindAddr, addr.Addr, e.netProto)
+	if err != nil {
+		return err
+	}
+
+	e.route.Release()
+	e.route = r
+	e.state = stateConnected
+
+	e.rcvMu.Lock()
+	e.rcvRemoteAddr = r.RemoteAddress
+	e.rcvMu.Unlock()
+
+	return nil
+}
+
+// Shutdown closes the read and/or write end of the endpoint connection
+// to its peer.
+func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) *tcpip.Error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return tcpip.ErrNotConnected
+	}
+
+	if flags&tcpip.ShutdownRead != 0 {
+		e.rcvMu.Lock()
+		wasClosed := e.rcvClosed
+		e.rcvClosed = true
+		e.rcvMu.Unlock()
+
+		if !wasClosed {
+			e.waiterQueue.Notify(waiter.EventIn)
+		}
+	}
+
+	return nil
+}
+
+// Listen is not supported by raw endpoints, it just fails.
+func (*endpoint) Listen(int) *tcpip.Error {
+	return tcpip.ErrNotSupported
+}
+
+// Accept is not supported by raw endpoints, it just fails.
+func (*endpoint) Accept() (tcpip.Endpoint, *waiter.Queue, *tcpip.Error) {
+	return nil, nil, tcpip.ErrNotSupported
+}
+
+// Bind binds the endpoint to a specific local address, so that it only
+// receives packets sent to it. Ports are ignored. Specifying a NIC is
+// optional.
+func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() *tcpip.Error) *tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Don't allow binding once endpoint is not in the initial state
+	// anymore.
+	if e.state != stateInitial {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	if len(addr.Addr) != 0 {
+		// A local address was specified, verify that it's valid.
+		if e.stack.CheckLocalAddress(addr.NIC, e.netProto, addr.Addr) == 0 {
+			return tcpip.ErrBadLocalAddress
+		}
+	}
+
+	if commit != nil {
+		if err := commit(); err != nil {
+			return err
+		}
+	}
+
+	e.bindNICID = addr.NIC
+	e.bindAddr = addr.Addr
+	e.state = stateBound
+
+	e.rcvMu.Lock()
+	e.rcvNICID = addr.NIC
+	e.rcvLocalAddr = addr.Addr
+	e.rcvMu.Unlock()
+
+	return nil
+}
+
+// GetLocalAddress returns the address to which the endpoint is bound.
+func (e *endpoint) GetLocalAddress() (tcpip.FullAddress, *tcpip.Error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	addr := e.bindAddr
+	if e.state == stateConnected {
+		addr = e.route.LocalAddress
+	}
+
+	return tcpip.FullAddress{
+		NIC:  e.bindNICID,
+		Addr: addr,
+	}, nil
+}
+
+// GetRemoteAddress returns the address to which the endpoint is connected.
+func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, *tcpip.Error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected {
+		return tcpip.FullAddress{}, tcpip.ErrNotConnected
+	}
+
+	return tcpip.FullAddress{
+		NIC:  e.route.NICID(),
+		Addr: e.route.RemoteAddress,
+	}, nil
+}
+
+// Readiness returns the current readiness of the endpoint. For example, if
+// waiter.EventIn is set, the endpoint is immediately readable.
+func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
+	// The endpoint is always writable.
+	result := waiter.EventOut & mask
+
+	// Determine if the endpoint is readable if requested.
+	if (mask & waiter.EventIn) != 0 {
+		e.rcvMu.Lock()
+		if !e.rcvList.Empty() || e.rcvClosed {
+			result |= waiter.EventIn
+		}
+		e.rcvMu.Unlock()
+	}
+
+	return result
+}
+
+// HandlePacket implements stack.RawTransportEndpoint.HandlePacket.
+func (e *endpoint) HandlePacket(r *stack.Route, netHeader buffer.View, vv *buffer.VectorisedView) {
+	e.rcvMu.Lock()
+
+	// Drop the packet if it doesn't match the bound or connected addresses,
+	// or if our buffer is currently full.
+	if e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax || e.icmpv6FilteredLocked(vv) ||
+		(e.rcvNICID != 0 && e.rcvNICID != r.NICID()) ||
+		(e.rcvLocalAddr != "" && e.rcvLocalAddr != r.LocalAddress) ||
+		(e.rcvRemoteAddr != "" && e.rcvRemoteAddr != r.RemoteAddress) {
+		e.rcvMu.Unlock()
+		return
+	}
+
+	wasEmpty := e.rcvBufSize == 0
+
+	// Push new packet into receive list and increment the buffer size.
+	pkt := &rawPacket{
+		senderAddress: tcpip.FullAddress{
+			NIC:  r.NICID(),
+			Addr: r.RemoteAddress,
+		},
+	}
+	if atomic.LoadUint32(&e.hdrIncluded) == 0 {
+		pkt.data = vv.Clone(pkt.views[:])
+	} else {
+		// The header can't be retained, so it's copied, and the rest of
+		// the packet is kept through a reference to its buffer.
+		views := append(pkt.views[:0], append(buffer.View(nil), netHeader...))
+		views = append(views, vv.Views()...)
+		pkt.data = buffer.NewVectorisedView(len(netHeader)+vv.Size(), views)
+		if b := vv.Buffer(); b != nil {
+			b.IncRef()
+			pkt.data.SetBuffer(b)
+		}
+	}
+	e.rcvList.PushBack(pkt)
+	e.rcvBufSize += pkt.data.Size()
+
+	if e.rcvTimestamp {
+		pkt.timestamp = e.stack.NowNanoseconds()
+		pkt.hasTimestamp = true
+	}
+
+	e.rcvMu.Unlock()
+
+	// Notify any waiters that there's data to be read now.
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventIn)
+	}
+}
+
+// icmpv6FilteredLocked returns true if the given packet is an ICMPv6 message
+// blocked by the ICMPv6 filter of e.
+//
+// Precondition: e.rcvMu must be held.
+func (e *endpoint) icmpv6FilteredLocked(vv *buffer.VectorisedView) bool {
+	if !e.isICMPv6() {
+		return false
+	}
+	v := vv.First()
+	if len(v) < header.ICMPv6MinimumSize {
+		return true
+	}
+	t := header.ICMPv6(v).Type()
+	return e.icmpv6Filter.DenyType[t/32]&(1<<(t%32)) != 0
+}
+
+func init() {
+	stack.RegisterRawEndpointFactory(newEndpoint)
+}
@@ -0,0 +1,444 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package raw_test
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/network/ipv6"
+	"github.com/google/netstack/tcpip/stack"
+	_ "github.com/google/netstack/tcpip/transport/raw"
+	"github.com/google/netstack/tcpip/transport/udp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	// vrrpProtocolNumber is the protocol number of VRRP, which has no
+	// transport protocol implementation in the stack.
+	vrrpProtocolNumber = 112
+
+	addrA = tcpip.Address("\x0a\x00\x00\x01")
+	addrB = tcpip.Address("\x0a\x00\x00\x02")
+	addrC = tcpip.Address("\x0a\x00\x00\x03")
+
+	addr6A = tcpip.Address("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01")
+	addr6B = tcpip.Address("\xfe\x80\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02")
+)
+
+type host struct {
+	s      *stack.Stack
+	linkEP *channel.Endpoint
+}
+
+func newHost(t *testing.T, addr tcpip.Address) *host {
+	t.Helper()
+
+	netProto, netProtoName := ipv4.ProtocolNumber, ipv4.ProtocolName
+	if len(addr) == header.IPv6AddressSize {
+		netProto, netProtoName = ipv6.ProtocolNumber, ipv6.ProtocolName
+	}
+
+	s := stack.New(&tcpip.StdClock{}, []string{netProtoName}, []string{udp.ProtocolName})
+	id, linkEP := channel.New(256, 1500, "")
+	if err := s.CreateNIC(1, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, netProto, addr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	zero := tcpip.Address(make([]byte, len(addr)))
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: zero,
+		Mask:        zero,
+		NIC:         1,
+	}})
+
+	return &host{s: s, linkEP: linkEP}
+}
+
+// forward moves the next packet sent by h to dst.
+func (h *host) forward(t *testing.T, dst *host) {
+	t.Helper()
+
+	select {
+	case p := <-h.linkEP.C:
+		v := append(append(buffer.View(nil), p.Header...), p.Payload...)
+		vv := v.ToVectorisedView([1]buffer.View{})
+		dst.linkEP.Inject(p.Proto, &vv)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for packet")
+	}
+}
+
+func (h *host) newRawEndpoint(t *testing.T, transProto tcpip.TransportProtocolNumber) (tcpip.Endpoint, *waiter.Queue) {
+	t.Helper()
+
+	var wq waiter.Queue
+	ep, err := h.s.NewRawEndpoint(transProto, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewRawEndpoint failed: %v", err)
+	}
+	return ep, &wq
+}
+
+func read(t *testing.T, ep tcpip.Endpoint) (buffer.View, tcpip.FullAddress) {
+	t.Helper()
+
+	var addr tcpip.FullAddress
+	v, _, err := ep.Read(&addr)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return v, addr
+}
+
+func TestVRRP(t *testing.T) {
+	a, b := newHost(t, addrA), newHost(t, addrB)
+	epA, _ := a.newRawEndpoint(t, vrrpProtocolNumber)
+	defer epA.Close()
+	epB, _ := b.newRawEndpoint(t, vrrpProtocolNumber)
+	defer epB.Close()
+
+	// Send from A, the header is built by the stack.
+	advert := buffer.View("vrrp advertisement")
+	if _, err := epA.Write(tcpip.SlicePayload(advert), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addrB}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	a.forward(t, b)
+
+	v, from := read(t, epB)
+	if !bytes.Equal(v, advert) {
+		t.Errorf("got Read(...) = %q, want %q", v, advert)
+	}
+	if from.Addr != addrA {
+		t.Errorf("got sender address %v, want %v", from.Addr, addrA)
+	}
+
+	// With IPHdrIncludedOption, received packets include the header.
+	if err := epB.SetSockOpt(tcpip.IPHdrIncludedOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var opt tcpip.IPHdrIncludedOption
+	if err := epB.GetSockOpt(&opt); err != nil || opt != 1 {
+		t.Fatalf("GetSockOpt(&IPHdrIncludedOption) = %d, %v, want 1, nil", opt, err)
+	}
+	if _, err := epA.Write(tcpip.SlicePayload(advert), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addrB}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	a.forward(t, b)
+
+	v, _ = read(t, epB)
+	ip := header.IPv4(v)
+	if !ip.IsValid(len(v)) {
+		t.Fatalf("received an invalid IPv4 packet: %x", v)
+	}
+	if got := ip.TransportProtocol(); got != vrrpProtocolNumber {
+		t.Errorf("got protocol %d, want %d", got, vrrpProtocolNumber)
+	}
+	if got := ip.SourceAddress(); got != addrA {
+		t.Errorf("got source address %v, want %v", got, addrA)
+	}
+	if got := buffer.View(ip.Payload()); !bytes.Equal(got, advert) {
+		t.Errorf("got payload %q, want %q", got, advert)
+	}
+
+	// And sent packets are made of the header provided by the user. VRRP
+	// requires a TTL of 255, which the stack doesn't use.
+	reply := buffer.View("vrrp reply")
+	pkt := buffer.NewView(header.IPv4MinimumSize + len(reply))
+	ip = header.IPv4(pkt)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(pkt)),
+		TTL:         255,
+		Protocol:    vrrpProtocolNumber,
+		SrcAddr:     addrB,
+		DstAddr:     addrA,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	copy(pkt[header.IPv4MinimumSize:], reply)
+	if _, err := epB.Write(tcpip.SlicePayload(pkt), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addrA}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	select {
+	case p := <-b.linkEP.C:
+		sent := append(append(buffer.View(nil), p.Header...), p.Payload...)
+		if !bytes.Equal(sent, pkt) {
+			t.Fatalf("got sent packet %x, want %x", sent, pkt)
+		}
+		vv := sent.ToVectorisedView([1]buffer.View{})
+		a.linkEP.Inject(p.Proto, &vv)
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for packet")
+	}
+
+	v, from = read(t, epA)
+	if !bytes.Equal(v, reply) {
+		t.Errorf("got Read(...) = %q, want %q", v, reply)
+	}
+	if from.Addr != addrB {
+		t.Errorf("got sender address %v, want %v", from.Addr, addrB)
+	}
+
+	// Malformed headers are rejected.
+	if _, err := epB.Write(tcpip.SlicePayload(reply), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addrA}}); err == nil {
+		t.Errorf("Write of a packet without a valid header succeeded")
+	}
+}
+
+func TestHeaderIncludedWrite(t *testing.T) {
+	a := newHost(t, addrA)
+	ep, _ := a.newRawEndpoint(t, vrrpProtocolNumber)
+	defer ep.Close()
+	if err := ep.SetSockOpt(tcpip.IPHdrIncludedOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	// The source address isn't one of the stack's, and the ID and TTL
+	// aren't what the stack would use.
+	payload := buffer.View("crafted")
+	want := buffer.NewView(header.IPv4MinimumSize + len(payload))
+	ip := header.IPv4(want)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TOS:         0xb8,
+		TotalLength: uint16(len(want)),
+		ID:          0x1234,
+		TTL:         7,
+		Protocol:    vrrpProtocolNumber,
+		SrcAddr:     addrC,
+		DstAddr:     addrB,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	copy(want[header.IPv4MinimumSize:], payload)
+
+	for _, test := range []struct {
+		name string
+		pkt  func() buffer.View
+	}{
+		{"Complete", func() buffer.View { return append(buffer.View(nil), want...) }},
+		{"ZeroLengthAndChecksum", func() buffer.View {
+			pkt := append(buffer.View(nil), want...)
+			header.IPv4(pkt).SetTotalLength(0)
+			header.IPv4(pkt).SetChecksum(0)
+			return pkt
+		}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			pkt := test.pkt()
+			if _, err := ep.Write(tcpip.SlicePayload(pkt), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addrB}}); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+
+			select {
+			case p := <-a.linkEP.C:
+				sent := append(append(buffer.View(nil), p.Header...), p.Payload...)
+				if !bytes.Equal(sent, want) {
+					t.Fatalf("got sent packet %x, want %x", sent, want)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for packet")
+			}
+		})
+	}
+
+	// A checksum that isn't zero is sent as is, even if it's wrong.
+	pkt := append(buffer.View(nil), want...)
+	header.IPv4(pkt).SetChecksum(0xbad)
+	if _, err := ep.Write(tcpip.SlicePayload(pkt), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addrB}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case p := <-a.linkEP.C:
+		sent := append(append(buffer.View(nil), p.Header...), p.Payload...)
+		if !bytes.Equal(sent, pkt) {
+			t.Fatalf("got sent packet %x, want %x", sent, pkt)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for packet")
+	}
+}
+
+func TestICMPv6Filter(t *testing.T) {
+	a, b := newHost(t, addr6A), newHost(t, addr6B)
+
+	var wq waiter.Queue
+	ep, err := a.s.NewRawEndpoint(header.ICMPv6ProtocolNumber, ipv6.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewRawEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+
+	// Only let echo replies through.
+	var filter tcpip.ICMPv6FilterOption
+	for i := range filter.DenyType {
+		filter.DenyType[i] = math.MaxUint32
+	}
+	filter.DenyType[header.ICMPv6EchoReply/32] &^= 1 << (header.ICMPv6EchoReply % 32)
+	if err := ep.SetSockOpt(filter); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var got tcpip.ICMPv6FilterOption
+	if err := ep.GetSockOpt(&got); err != nil || got != filter {
+		t.Fatalf("GetSockOpt(&ICMPv6FilterOption) = %+v, %v, want %+v, nil", got, err, filter)
+	}
+
+	// Ping B, the checksum is computed by the stack.
+	data := buffer.View("ping")
+	req := buffer.NewView(header.ICMPv6EchoMinimumSize + len(data))
+	header.ICMPv6(req).SetType(header.ICMPv6EchoRequest)
+	copy(req[4:], []byte{0x12, 0x34, 0x00, 0x01})
+	copy(req[header.ICMPv6EchoMinimumSize:], data)
+	if _, err := ep.Write(tcpip.SlicePayload(req), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addr6B}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	a.forward(t, b)
+
+	// B sends a neighbor advertisement, which A filters out, before
+	// replying.
+	na := buffer.NewView(header.IPv6MinimumSize + header.ICMPv6NeighborAdvertSize)
+	header.IPv6(na).Encode(&header.IPv6Fields{
+		PayloadLength: header.ICMPv6NeighborAdvertSize,
+		NextHeader:    uint8(header.ICMPv6ProtocolNumber),
+		HopLimit:      255,
+		SrcAddr:       addr6B,
+		DstAddr:       addr6A,
+	})
+	icmp := header.ICMPv6(na[header.IPv6MinimumSize:])
+	icmp.SetType(header.ICMPv6NeighborAdvert)
+	icmp.SetChecksum(header.ICMPv6Checksum(icmp, addr6B, addr6A, nil))
+	vv := na.ToVectorisedView([1]buffer.View{})
+	a.linkEP.Inject(ipv6.ProtocolNumber, &vv)
+
+	b.forward(t, a)
+
+	v, from := read(t, ep)
+	if from.Addr != addr6B {
+		t.Errorf("got sender address %v, want %v", from.Addr, addr6B)
+	}
+	reply := header.ICMPv6(v)
+	if len(reply) != len(req) {
+		t.Fatalf("got %d bytes message, want %d: %x", len(reply), len(req), v)
+	}
+	if got := reply.Type(); got != header.ICMPv6EchoReply {
+		t.Errorf("got message of type %d, want %d", got, header.ICMPv6EchoReply)
+	}
+	if !bytes.Equal(v[4:], req[4:]) {
+		t.Errorf("got echo reply %x, want the identifier, sequence number and data of %x", v, req)
+	}
+	xsum := reply.Checksum()
+	reply.SetChecksum(0)
+	if want := header.ICMPv6Checksum(reply, addr6B, addr6A, nil); xsum != want {
+		t.Errorf("got checksum %x, want %x", xsum, want)
+	}
+
+	if _, _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("second Read = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+
+	// The filter only applies to ICMPv6 endpoints.
+	epv4, _ := newHost(t, addrA).newRawEndpoint(t, vrrpProtocolNumber)
+	defer epv4.Close()
+	if err := epv4.SetSockOpt(filter); err != tcpip.ErrUnknownProtocolOption {
+		t.Errorf("SetSockOpt on a VRRP endpoint = %v, want %v", err, tcpip.ErrUnknownProtocolOption)
+	}
+}
+
+func TestCoexistence(t *testing.T) {
+	a, b := newHost(t, addrA), newHost(t, addrB)
+
+	var wq waiter.Queue
+	udpEP, err := b.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer udpEP.Close()
+	if err := udpEP.Bind(tcpip.FullAddress{Port: 1234}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	rawEP, _ := b.newRawEndpoint(t, udp.ProtocolNumber)
+	defer rawEP.Close()
+
+	data := buffer.View("payload")
+	sender, err := a.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer sender.Close()
+	if _, err := sender.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addrB, Port: 1234}}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	a.forward(t, b)
+
+	// Both endpoints get a copy of the packet.
+	if v, _ := read(t, udpEP); !bytes.Equal(v, data) {
+		t.Errorf("got UDP Read(...) = %q, want %q", v, data)
+	}
+	v, _ := read(t, rawEP)
+	if len(v) != header.UDPMinimumSize+len(data) {
+		t.Fatalf("got raw Read(...) of %d bytes, want %d", len(v), header.UDPMinimumSize+len(data))
+	}
+	if got := header.UDP(v).DestinationPort(); got != 1234 {
+		t.Errorf("got destination port %d, want 1234", got)
+	}
+	if got := buffer.View(v[header.UDPMinimumSize:]); !bytes.Equal(got, data) {
+		t.Errorf("got raw payload %q, want %q", got, data)
+	}
+}
+
+func TestConnectFilters(t *testing.T) {
+	a, b := newHost(t, addrA), newHost(t, addrB)
+	epA, _ := a.newRawEndpoint(t, vrrpProtocolNumber)
+	defer epA.Close()
+	epB, _ := b.newRawEndpoint(t, vrrpProtocolNumber)
+	defer epB.Close()
+
+	// Without a connected endpoint, writes need a destination.
+	if _, err := epA.Write(tcpip.SlicePayload("x"), tcpip.WriteOptions{}); err != tcpip.ErrDestinationRequired {
+		t.Fatalf("Write without a destination = %v, want %v", err, tcpip.ErrDestinationRequired)
+	}
+
+	if err := epB.Connect(tcpip.FullAddress{Addr: addrC}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := epA.Connect(tcpip.FullAddress{Addr: addrB}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if _, err := epA.Write(tcpip.SlicePayload("x"), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	a.forward(t, b)
+
+	// epB is connected to another host, so it doesn't get the packet.
+	if _, _, err := epB.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Read = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestRawEndpointsNotAllowed(t *testing.T) {
+	h := newHost(t, addrA)
+	h.s.SetRawEndpointsAllowed(false)
+
+	var wq waiter.Queue
+	if _, err := h.s.NewRawEndpoint(vrrpProtocolNumber, ipv4.ProtocolNumber, &wq); err != tcpip.ErrNotPermitted {
+		t.Fatalf("NewRawEndpoint = %v, want %v", err, tcpip.ErrNotPermitted)
+	}
+
+	h.s.SetRawEndpointsAllowed(true)
+	ep, err := h.s.NewRawEndpoint(vrrpProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewRawEndpoint failed: %v", err)
+	}
+	ep.Close()
+}
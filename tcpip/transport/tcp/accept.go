@@ -5,12 +5,12 @@
 package tcp
 
 import (
-	"crypto/rand"
 	"crypto/sha1"
 	"encoding/binary"
 	"hash"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/netstack/sleep"
@@ -84,6 +84,10 @@ type listenContext struct {
 	hasher   hash.Hash
 	v6only   bool
 	netProto tcpip.NetworkProtocolNumber
+
+	// listenEP is the listening endpoint that accepts the connections, or
+	// nil if connections are handled by a forwarder.
+	listenEP *endpoint
 }
 
 // timeStamp returns an 8-bit timestamp with a granularity of 64 seconds.
@@ -118,17 +122,22 @@ func decSynRcvdCount() {
 }
 
 // newListenContext creates a new listen context.
-func newListenContext(stack *stack.Stack, rcvWnd seqnum.Size, v6only bool, netProto tcpip.NetworkProtocolNumber) *listenContext {
+func newListenContext(stack *stack.Stack, listenEP *endpoint, rcvWnd seqnum.Size, v6only bool, netProto tcpip.NetworkProtocolNumber) *listenContext {
 	l := &listenContext{
 		stack:    stack,
 		rcvWnd:   rcvWnd,
 		hasher:   sha1.New(),
 		v6only:   v6only,
 		netProto: netProto,
+		listenEP: listenEP,
 	}
 
-	rand.Read(l.nonce[0][:])
-	rand.Read(l.nonce[1][:])
+	rng := stack.Rand()
+	for i := range l.nonce {
+		for j := 0; j < len(l.nonce[i]); j += 4 {
+			binary.LittleEndian.PutUint32(l.nonce[i][j:], rng.Uint32())
+		}
+	}
 
 	return l
 }
@@ -200,9 +209,20 @@ func (l *listenContext) createConnectedEndpoint(s *segment, iss seqnum.Value, ir
 
 	n.maybeEnableTimestamp(rcvdSynOpts)
 	n.maybeEnableSACKPermitted(rcvdSynOpts)
+	if l.listenEP != nil {
+		n.inheritMD5Keys(l.listenEP)
+		n.acceptMPTCP(rcvdSynOpts)
+		n.flowLabel = atomic.LoadUint32(&l.listenEP.flowLabel)
+		n.priority = atomic.LoadUint32(&l.listenEP.priority)
+		n.userTimeout = atomic.LoadInt64(&l.listenEP.userTimeout)
+		n.userMSS = atomic.LoadUint32(&l.listenEP.userMSS)
+		n.bindToDevice = l.listenEP.bindToDevice
+		n.route.FlowLabel = n.flowLabel
+		n.route.Priority = uint8(n.priority)
+	}
 
 	// Register new endpoint so that packets are routed to it.
-	if err := n.stack.RegisterTransportEndpoint(n.boundNICID, n.effectiveNetProtos, ProtocolNumber, n.id, n); err != nil {
+	if err := n.stack.RegisterTransportEndpoint(n.boundNICID, n.effectiveNetProtos, ProtocolNumber, n.id, n, false); err != nil {
 		n.Close()
 		return nil, err
 	}
@@ -239,6 +259,7 @@ func (l *listenContext) createEndpointAndPerformHandshake(s *segment, opts *head
 	}
 
 	h.resetToSynRcvd(cookie, irs, opts)
+	h.listenEP = l.listenEP
 	if err := h.execute(); err != nil {
 		ep.Close()
 		return nil, err
@@ -249,9 +270,37 @@ func (l *listenContext) createEndpointAndPerformHandshake(s *segment, opts *head
 	// scaling.
 	ep.rcv.rcvWndScale = h.effectiveRcvWndScale()
 
+	// The data carried by the SYN, if any, is consumed once the
+	// connection is accepted.
+	if s.data.Size() != 0 {
+		ep.synData = s.clone()
+		ep.synData.flags = 0
+		ep.synData.sequenceNumber++
+	}
+
+	ep.stack.MutableStats().TCP.PassiveConnectionOpenings.Increment()
+
 	return ep, nil
 }
 
+// receiveSynData consumes the data carried by the SYN that opened the passive
+// connection, as with TCP Fast Open, ahead of anything received since. The
+// SYN-ACK didn't acknowledge it, as RFC 793 lets data received in SYN-RCVD be
+// queued until the connection is established, so it's acknowledged now; a
+// peer retransmitting it anyway sees its copy dropped as a duplicate.
+//
+// It's called by the protocol goroutine when it starts.
+func (e *endpoint) receiveSynData() {
+	s := e.synData
+	if s == nil {
+		return
+	}
+	e.synData = nil
+	e.rcv.handleRcvdSegment(s)
+	s.decRef()
+	e.snd.sendAck()
+}
+
 // deliverAccepted delivers the newly-accepted endpoint to the listener. If the
 // endpoint has transitioned out of the listen state, the new endpoint is closed
 // instead.
@@ -266,6 +315,31 @@ func (e *endpoint) deliverAccepted(n *endpoint) {
 	e.mu.RUnlock()
 }
 
+// acceptQueueOverflow is called with the segment s that completes a handshake
+// with the listening endpoint e. If the accept queue of e is full, it returns
+// the policy set by AcceptQueueOverflowOption, having replied to s with a
+// reset if needed; the segment must then not be processed unless the policy is
+// AcceptQueueOverflowWait, which is also returned if the queue has room.
+func (e *endpoint) acceptQueueOverflow(s *segment) AcceptQueueOverflowOption {
+	e.mu.RLock()
+	full := len(e.acceptedChan) >= cap(e.acceptedChan)
+	e.mu.RUnlock()
+	if !full {
+		return AcceptQueueOverflowWait
+	}
+
+	var policy AcceptQueueOverflowOption
+	if err := e.stack.TransportProtocolOption(ProtocolNumber, &policy); err != nil || policy == AcceptQueueOverflowWait {
+		return AcceptQueueOverflowWait
+	}
+
+	e.stack.MutableStats().TCP.ListenOverflows.Increment()
+	if policy == AcceptQueueOverflowReset {
+		replyWithReset(s)
+	}
+	return policy
+}
+
 // handleSynSegment is called in its own goroutine once the listening endpoint
 // receives a SYN segment. It is responsible for completing the handshake and
 // queueing the new endpoint for acceptance.
@@ -281,6 +355,10 @@ func (e *endpoint) handleSynSegment(ctx *listenContext, s *segment, opts *header
 		return
 	}
 
+	if n.mptcp != nil && n.mptcp.join {
+		n.mptcp.conn.accept(n)
+		return
+	}
 	e.deliverAccepted(n)
 }
 
@@ -290,6 +368,14 @@ func (e *endpoint) handleListenSegment(ctx *listenContext, s *segment) {
 	switch s.flags {
 	case flagSyn:
 		opts := parseSynSegmentOptions(s)
+		if mp := &opts.MPTCP; mp.Present && mp.Subtype == header.MPTCPSubtypeJoin {
+			// Subflows can only join the connections they know the
+			// token of, see RFC 6824 section 3.2.
+			if e.stack.TransportProtocolInstance(ProtocolNumber).(*protocol).lookupMPTCPConn(mp.Token) == nil {
+				replyWithReset(s)
+				return
+			}
+		}
 		if incSynRcvdCount() {
 			s.incRef()
 			go e.handleSynSegment(ctx, s, &opts)
@@ -301,16 +387,21 @@ func (e *endpoint) handleListenSegment(ctx *listenContext, s *segment) {
 			// Enable Timestamp option if the original syn did have
 			// the timestamp option specified.
 			synOpts := header.TCPSynOptions{
+				MSS:   e.advertisedMSS(&s.route),
 				WS:    -1,
 				TS:    opts.TS,
-				TSVal: tcpTimeStamp(timeStampOffset()),
+				TSVal: tcpTimeStamp(timeStampOffset(e.stack.Rand())),
 				TSEcr: opts.TSVal,
 			}
-			sendSynTCP(&s.route, s.id, flagSyn|flagAck, cookie, s.sequenceNumber+1, ctx.rcvWnd, synOpts)
+			sendSynTCP(&s.route, s.id, flagSyn|flagAck, cookie, s.sequenceNumber+1, ctx.rcvWnd, synOpts, e.md5Key(s.id.RemoteAddress))
 		}
 
 	case flagAck:
 		if data, ok := ctx.isCookieValid(s.id, s.ackNumber-1, s.sequenceNumber-1); ok && int(data) < len(mssTable) {
+			if e.acceptQueueOverflow(s) != AcceptQueueOverflowWait {
+				return
+			}
+
 			// Create newly accepted endpoint and deliver it.
 			rcvdSynOptions := &header.TCPSynOptions{
 				MSS: mssTable[data],
@@ -334,6 +425,7 @@ func (e *endpoint) handleListenSegment(ctx *listenContext, s *segment) {
 				// randomly offset when the original SYN-ACK was
 				// sent above.
 				n.tsOffset = 0
+				e.stack.MutableStats().TCP.PassiveConnectionOpenings.Increment()
 				e.deliverAccepted(n)
 			}
 		}
@@ -362,7 +454,7 @@ func (e *endpoint) protocolListenLoop(rcvWnd seqnum.Size) *tcpip.Error {
 	v6only := e.v6only
 	e.mu.Unlock()
 
-	ctx := newListenContext(e.stack, rcvWnd, v6only, e.netProto)
+	ctx := newListenContext(e.stack, e, rcvWnd, v6only, e.netProto)
 
 	s := sleep.Sleeper{}
 	s.AddWaker(&e.notificationWaker, wakerForNotification)
@@ -371,7 +463,7 @@ func (e *endpoint) protocolListenLoop(rcvWnd seqnum.Size) *tcpip.Error {
 		switch index, _ := s.Fetch(true); index {
 		case wakerForNotification:
 			n := e.fetchNotifications()
-			if n&notifyClose != 0 {
+			if n&(notifyClose|notifyAbort|notifyAbortSilently) != 0 {
 				return nil
 			}
 			if n&notifyDrain != 0 {
@@ -379,8 +471,7 @@ func (e *endpoint) protocolListenLoop(rcvWnd seqnum.Size) *tcpip.Error {
 					e.handleListenSegment(ctx, s)
 					s.decRef()
 				}
-				close(e.drainDone)
-				<-e.undrain
+				e.drain()
 			}
 
 		case wakerForNewSegment:
@@ -5,9 +5,7 @@
 package tcp
 
 import (
-	"crypto/rand"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/google/netstack/sleep"
@@ -75,6 +73,10 @@ type handshake struct {
 
 	// rcvWndScale is the receive window scale, as defined in RFC 1323.
 	rcvWndScale int
+
+	// listenEP is the listening endpoint the connection is accepted by, if
+	// the handshake is a passive one.
+	listenEP *endpoint
 }
 
 func newHandshake(ep *endpoint, rcvWnd seqnum.Size) (handshake, *tcpip.Error) {
@@ -111,16 +113,11 @@ func FindWndScale(wnd seqnum.Size) int {
 // resetState resets the state of the handshake object such that it becomes
 // ready for a new 3-way handshake.
 func (h *handshake) resetState() *tcpip.Error {
-	b := make([]byte, 4)
-	if _, err := rand.Read(b); err != nil {
-		panic(err)
-	}
-
 	h.state = handshakeSynSent
 	h.flags = flagSyn
 	h.ackNum = 0
 	h.mss = 0
-	h.iss = seqnum.Value(uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24)
+	h.iss = seqnum.Value(h.ep.stack.Rand().Uint32())
 
 	return nil
 }
@@ -157,7 +154,7 @@ func (h *handshake) checkAck(s *segment) bool {
 		// incoming segment acknowledges something not yet sent. The
 		// connection remains in the same state.
 		ack := s.sequenceNumber.Add(s.logicalLen())
-		h.ep.sendRaw(nil, flagRst|flagAck, s.ackNumber, ack, 0)
+		h.ep.sendRaw(nil, flagRst|flagAck, s.ackNumber, ack, 0, nil)
 		return false
 	}
 
@@ -205,15 +202,28 @@ func (h *handshake) synSentState(s *segment) *tcpip.Error {
 	// and the handshake is completed.
 	if s.flagIsSet(flagAck) {
 		h.state = handshakeCompleted
-		h.ep.sendRaw(nil, flagAck, h.iss+1, h.ackNum, h.rcvWnd>>h.effectiveRcvWndScale())
+		if h.ep.mptcp != nil {
+			return h.mptcpSynAckReceived(s, &rcvSynOpts)
+		}
+		h.ep.sendRaw(nil, flagAck, h.iss+1, h.ackNum, h.rcvWnd>>h.effectiveRcvWndScale(), nil)
 		return nil
 	}
 
+	// Multipath TCP isn't negotiated by simultaneous opens, which subflows
+	// joining a connection can't go on without.
+	if h.ep.mptcp != nil {
+		if h.ep.mptcp.join {
+			return tcpip.ErrConnectionRefused
+		}
+		h.ep.mptcp = nil
+	}
+
 	// A SYN segment was received, but no ACK in it. We acknowledge the SYN
 	// but resend our own SYN and wait for it to be acknowledged in the
 	// SYN-RCVD state.
 	h.state = handshakeSynRcvd
 	synOpts := header.TCPSynOptions{
+		MSS:   h.ep.advertisedMSS(&s.route),
 		WS:    h.rcvWndScale,
 		TS:    rcvSynOpts.TS,
 		TSVal: h.ep.timestamp(),
@@ -224,7 +234,7 @@ func (h *handshake) synSentState(s *segment) *tcpip.Error {
 		// this is the behaviour implemented by Linux.
 		SACKPermitted: rcvSynOpts.SACKPermitted,
 	}
-	sendSynTCP(&s.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+	sendSynTCP(&s.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts, h.ep.md5Key(h.ep.id.RemoteAddress))
 
 	return nil
 }
@@ -254,7 +264,7 @@ func (h *handshake) synRcvdState(s *segment) *tcpip.Error {
 		if s.flagIsSet(flagAck) {
 			seq = s.ackNumber
 		}
-		h.ep.sendRaw(nil, flagRst|flagAck, seq, ack, 0)
+		h.ep.sendRaw(nil, flagRst|flagAck, seq, ack, 0, nil)
 
 		if !h.active {
 			return tcpip.ErrInvalidEndpointState
@@ -264,13 +274,14 @@ func (h *handshake) synRcvdState(s *segment) *tcpip.Error {
 			return err
 		}
 		synOpts := header.TCPSynOptions{
+			MSS:           h.ep.advertisedMSS(&s.route),
 			WS:            h.rcvWndScale,
 			TS:            h.ep.sendTSOk,
 			TSVal:         h.ep.timestamp(),
 			TSEcr:         h.ep.recentTS,
 			SACKPermitted: h.ep.sackPermitted,
 		}
-		sendSynTCP(&s.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+		sendSynTCP(&s.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts, h.ep.md5Key(h.ep.id.RemoteAddress))
 		return nil
 	}
 
@@ -282,10 +293,28 @@ func (h *handshake) synRcvdState(s *segment) *tcpip.Error {
 		// not carry a timestamp option then the segment must be dropped
 		// as per https://tools.ietf.org/html/rfc7323#section-3.2.
 		if h.ep.sendTSOk && !s.parsedOptions.TS {
-			atomic.AddUint64(&h.ep.stack.MutableStats().DroppedPackets, 1)
+			h.ep.stack.MutableStats().DroppedPackets.Increment()
 			return nil
 		}
 
+		// The connection can't be completed while the listening
+		// endpoint has no room for it, unless it's a subflow joining a
+		// Multipath TCP connection, which isn't accepted.
+		if h.listenEP != nil && (h.ep.mptcp == nil || !h.ep.mptcp.join) {
+			switch h.listenEP.acceptQueueOverflow(s) {
+			case AcceptQueueOverflowDrop:
+				return nil
+			case AcceptQueueOverflowReset:
+				return tcpip.ErrConnectionAborted
+			}
+		}
+
+		if h.ep.mptcp != nil {
+			if err := h.mptcpAckReceived(s); err != nil {
+				return err
+			}
+		}
+
 		// Update timestamp if required. See RFC7323, section-4.3.
 		h.ep.updateRecentTimestamp(s.parsedOptions.TSVal, h.ackNum, s.sequenceNumber)
 
@@ -364,13 +393,16 @@ func (h *handshake) resolveRoute() *tcpip.Error {
 
 		case wakerForNotification:
 			n := h.ep.fetchNotifications()
-			if n&notifyClose != 0 {
+			if n&notifyNICRemoved != 0 {
+				h.ep.route.RemoveWaker(resolutionWaker)
+				return tcpip.ErrNoRoute
+			}
+			if n&(notifyClose|notifyAbort|notifyAbortSilently) != 0 {
 				h.ep.route.RemoveWaker(resolutionWaker)
 				return tcpip.ErrAborted
 			}
 			if n&notifyDrain != 0 {
-				close(h.ep.drainDone)
-				<-h.ep.undrain
+				h.ep.drain()
 			}
 		}
 
@@ -390,7 +422,7 @@ func (h *handshake) execute() *tcpip.Error {
 	// Initialize the resend timer.
 	resendWaker := sleep.Waker{}
 	timeOut := time.Duration(time.Second)
-	rt := time.AfterFunc(timeOut, func() {
+	rt := h.ep.stack.AfterFunc(timeOut, func() {
 		resendWaker.Assert()
 	})
 	defer rt.Stop()
@@ -412,6 +444,7 @@ func (h *handshake) execute() *tcpip.Error {
 	// Send the initial SYN segment and loop until the handshake is
 	// completed.
 	synOpts := header.TCPSynOptions{
+		MSS:           h.ep.advertisedMSS(&h.ep.route),
 		WS:            h.rcvWndScale,
 		TS:            true,
 		TSVal:         h.ep.timestamp(),
@@ -426,7 +459,9 @@ func (h *handshake) execute() *tcpip.Error {
 		synOpts.TS = h.ep.sendTSOk
 		synOpts.SACKPermitted = h.ep.sackPermitted && bool(sackEnabled)
 	}
-	sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+	md5Key := h.ep.md5Key(h.ep.id.RemoteAddress)
+	synOpts.MPTCP = h.mptcpSynOption(md5Key != nil)
+	sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts, md5Key)
 	for h.state != handshakeCompleted {
 		switch index, _ := s.Fetch(true); index {
 		case wakerForResend:
@@ -435,13 +470,22 @@ func (h *handshake) execute() *tcpip.Error {
 				return tcpip.ErrTimeout
 			}
 			rt.Reset(timeOut)
-			sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts)
+			sendSynTCP(&h.ep.route, h.ep.id, h.flags, h.iss, h.ackNum, h.rcvWnd, synOpts, md5Key)
 
 		case wakerForNotification:
 			n := h.ep.fetchNotifications()
-			if n&notifyClose != 0 {
+			if n&notifyNICRemoved != 0 {
+				return tcpip.ErrNoRoute
+			}
+			if n&(notifyClose|notifyAbort|notifyAbortSilently) != 0 {
 				return tcpip.ErrAborted
 			}
+			if n&notifyUnreachable != 0 {
+				h.ep.sndBufMu.Lock()
+				err := h.ep.unreachableErr
+				h.ep.sndBufMu.Unlock()
+				return err
+			}
 			if n&notifyDrain != 0 {
 				for s := h.ep.segmentQueue.dequeue(); s != nil; s = h.ep.segmentQueue.dequeue() {
 					err := h.handleSegment(s)
@@ -453,8 +497,7 @@ func (h *handshake) execute() *tcpip.Error {
 						return nil
 					}
 				}
-				close(h.ep.drainDone)
-				<-h.ep.undrain
+				h.ep.drain()
 			}
 
 		case wakerForNewSegment:
@@ -491,7 +534,7 @@ func putOptions(options []byte) {
 	optionPool.Put(options[0:cap(options)])
 }
 
-func makeSynOptions(opts header.TCPSynOptions) []byte {
+func makeSynOptions(opts header.TCPSynOptions, md5 bool) []byte {
 	// Emulate linux option order. This is as follows:
 	//
 	// if md5: NOP NOP MD5SIG 18 md5sig(16)
@@ -501,6 +544,7 @@ func makeSynOptions(opts header.TCPSynOptions) []byte {
 	// elif ts: NOP NOP TIMESTAMP 10 timestamp(8)
 	// elif sack: NOP NOP SACK 2
 	// if wscale: NOP WINDOW 3 ws(1)
+	// if mptcp: MPTCP (12 or 16) mptcp(variable)
 	// if sack_blocks: NOP NOP SACK ((2 + (#blocks * 8))
 	//	[for each block] start_seq(4) end_seq(4)
 	// if fastopen_cookie:
@@ -509,9 +553,17 @@ func makeSynOptions(opts header.TCPSynOptions) []byte {
 	//	cookie(variable) [padding to four bytes]
 	//
 	options := getOptions()
+	offset := 0
+
+	// The MD5 signature is filled in once the segment is complete.
+	if md5 {
+		offset += header.EncodeNOP(options[offset:])
+		offset += header.EncodeNOP(options[offset:])
+		offset += header.EncodeMD5Option(options[offset:])
+	}
 
 	// Always encode the mss.
-	offset := header.EncodeMSSOption(uint32(opts.MSS), options)
+	offset += header.EncodeMSSOption(uint32(opts.MSS), options[offset:])
 
 	// Special ordering is required here. If both TS and SACK are enabled,
 	// then the SACK option precedes TS, with no padding. If they are
@@ -535,6 +587,11 @@ func makeSynOptions(opts header.TCPSynOptions) []byte {
 		offset += header.EncodeWSOption(opts.WS, options[offset:])
 	}
 
+	// The Multipath TCP options sent in SYNs are quad aligned.
+	if opts.MPTCP.Present {
+		offset += encodeMPTCPOption(&opts.MPTCP, options[offset:])
+	}
+
 	// Padding to the end; note that this never apply unless we add a
 	// fastopen option, we always expect the offset to remain the same.
 	if delta := header.AddTCPOptionPadding(options, offset); delta != 0 {
@@ -544,26 +601,30 @@ func makeSynOptions(opts header.TCPSynOptions) []byte {
 	return options[:offset]
 }
 
-func sendSynTCP(r *stack.Route, id stack.TransportEndpointID, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts header.TCPSynOptions) *tcpip.Error {
+func sendSynTCP(r *stack.Route, id stack.TransportEndpointID, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts header.TCPSynOptions, md5Key []byte) *tcpip.Error {
 	// The MSS in opts is automatically calculated as this function is
 	// called from many places and we don't want every call point being
-	// embedded with the MSS calculation.
+	// embedded with the MSS calculation. Endpoints pass their own, which
+	// may be capped by MaxSegOption, see advertisedMSS.
 	if opts.MSS == 0 {
 		opts.MSS = uint16(r.MTU() - header.TCPMinimumSize)
 	}
 
-	options := makeSynOptions(opts)
-	err := sendTCPWithOptions(r, id, nil, flags, seq, ack, rcvWnd, options)
+	options := makeSynOptions(opts, md5Key != nil)
+	err := sendTCPWithOptions(r, id, nil, flags, seq, ack, rcvWnd, options, md5Key)
 	putOptions(options)
 	return err
 }
 
 // sendTCPWithOptions sends a TCP segment with the provided options via the
-// provided network endpoint and under the provided identity.
-func sendTCPWithOptions(r *stack.Route, id stack.TransportEndpointID, data buffer.View, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts []byte) *tcpip.Error {
+// provided network endpoint and under the provided identity. If md5Key is not
+// nil, the options must include an MD5 signature option, which is filled in
+// with the signature of the segment.
+func sendTCPWithOptions(r *stack.Route, id stack.TransportEndpointID, data buffer.View, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, opts []byte, md5Key []byte) *tcpip.Error {
 	optLen := len(opts)
-	// Allocate a buffer for the TCP header.
-	hdr := buffer.NewPrependable(header.TCPMinimumSize + int(r.MaxHeaderLength()) + optLen)
+	// Get a buffer for the TCP header.
+	hdr := r.NewHeader(header.TCPMinimumSize + optLen)
+	defer hdr.Release()
 
 	if rcvWnd > 0xffff {
 		rcvWnd = 0xffff
@@ -582,26 +643,21 @@ func sendTCPWithOptions(r *stack.Route, id stack.TransportEndpointID, data buffe
 	})
 	copy(tcp[header.TCPMinimumSize:], opts)
 
-	// Only calculate the checksum if offloading isn't supported.
-	if r.Capabilities()&stack.CapabilityChecksumOffload == 0 {
-		length := uint16(hdr.UsedLength())
-		xsum := r.PseudoHeaderChecksum(ProtocolNumber)
-		if data != nil {
-			length += uint16(len(data))
-			xsum = header.Checksum(data, xsum)
-		}
-
-		tcp.SetChecksum(^tcp.CalculateChecksum(xsum, length))
+	if md5Key != nil {
+		signMD5(r, tcp, data, md5Key)
 	}
 
-	return r.WritePacket(&hdr, data, ProtocolNumber)
+	csum := setTCPChecksum(r, tcp, uint16(hdr.UsedLength()), data)
+
+	return writeSegment(r, csum, &hdr, data, flags)
 }
 
 // sendTCP sends a TCP segment via the provided network endpoint and under the
 // provided identity.
 func sendTCP(r *stack.Route, id stack.TransportEndpointID, data buffer.View, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size) *tcpip.Error {
-	// Allocate a buffer for the TCP header.
-	hdr := buffer.NewPrependable(header.TCPMinimumSize + int(r.MaxHeaderLength()))
+	// Get a buffer for the TCP header.
+	hdr := r.NewHeader(header.TCPMinimumSize)
+	defer hdr.Release()
 
 	if rcvWnd > 0xffff {
 		rcvWnd = 0xffff
@@ -619,29 +675,67 @@ func sendTCP(r *stack.Route, id stack.TransportEndpointID, data buffer.View, fla
 		WindowSize: uint16(rcvWnd),
 	})
 
-	// Only calculate the checksum if offloading isn't supported.
-	if r.Capabilities()&stack.CapabilityChecksumOffload == 0 {
-		length := uint16(hdr.UsedLength())
-		xsum := r.PseudoHeaderChecksum(ProtocolNumber)
-		if data != nil {
-			length += uint16(len(data))
-			xsum = header.Checksum(data, xsum)
-		}
+	csum := setTCPChecksum(r, tcp, uint16(hdr.UsedLength()), data)
+
+	return writeSegment(r, csum, &hdr, data, flags)
+}
 
-		tcp.SetChecksum(^tcp.CalculateChecksum(xsum, length))
+// writeSegment writes a segment with the given flags through r, and counts it
+// in the stats of the stack.
+func writeSegment(r *stack.Route, csum *stack.PartialChecksum, hdr *buffer.Prependable, data buffer.View, flags byte) *tcpip.Error {
+	if err := r.WritePacket(csum, hdr, data, ProtocolNumber); err != nil {
+		return err
 	}
 
-	return r.WritePacket(&hdr, data, ProtocolNumber)
+	stats := r.Stats()
+	stats.TCP.SegmentsSent.Increment()
+	if flags&flagRst != 0 {
+		stats.TCP.ResetsSent.Increment()
+	}
+	return nil
 }
 
-// makeOptions makes an options slice.
-func (e *endpoint) makeOptions(sackBlocks []header.SACKBlock) []byte {
+// setTCPChecksum fills in the checksum of the given TCP header according to
+// the capabilities of the route. If the link endpoint can complete the
+// checksum, only the pseudo-header checksum is computed and a non-nil
+// PartialChecksum is returned to be passed down along with the packet.
+func setTCPChecksum(r *stack.Route, tcp header.TCP, hdrLen uint16, data buffer.View) *stack.PartialChecksum {
+	caps := r.Capabilities()
+
+	// Don't calculate the checksum at all if offloading is fully
+	// supported.
+	if caps&stack.CapabilityChecksumOffload != 0 {
+		return nil
+	}
+
+	length := hdrLen + uint16(len(data))
+	xsum := r.PseudoHeaderChecksum(ProtocolNumber)
+	if caps&stack.CapabilityTXChecksumOffload != 0 {
+		tcp.SetChecksum(header.PseudoHeaderChecksumWithLength(xsum, length))
+		return &stack.PartialChecksum{ChecksumOffset: header.TCPChecksumOffset}
+	}
+
+	if data != nil {
+		xsum = header.Checksum(data, xsum)
+	}
+	tcp.SetChecksum(^tcp.CalculateChecksum(xsum, length))
+	return nil
+}
+
+// makeOptions makes an options slice. The DSS option of Multipath TCP subflows
+// is included along with the data mapped by mapping, if not nil.
+func (e *endpoint) makeOptions(sackBlocks []header.SACKBlock, md5 bool, mapping *mptcpMapping) []byte {
 	options := getOptions()
 	offset := 0
 
 	// N.B. the ordering here matches the ordering used by Linux internally
 	// and described in the raw makeOptions function. We don't include
 	// unnecessary cases here (post connection.)
+	if md5 {
+		offset += header.EncodeNOP(options[offset:])
+		offset += header.EncodeNOP(options[offset:])
+		offset += header.EncodeMD5Option(options[offset:])
+	}
 	if e.sendTSOk {
 		// Embed the timestamp if timestamp has been enabled.
 		//
@@ -659,7 +753,19 @@ func (e *endpoint) makeOptions(sackBlocks []header.SACKBlock) []byte {
 		offset += header.EncodeNOP(options[offset:])
 		offset += header.EncodeTSOption(e.timestamp(), uint32(e.recentTS), options[offset:])
 	}
-	if e.sackPermitted && len(sackBlocks) > 0 {
+	if mapping != nil && e.mptcp != nil {
+		// The data acknowledgement is only known once the handshake is
+		// completed, but options are sized before.
+		var dataAck uint64
+		if e.mptcp.conn != nil {
+			dataAck = e.mptcp.conn.dataAck()
+		}
+		offset += header.EncodeNOP(options[offset:])
+		offset += header.EncodeNOP(options[offset:])
+		offset += header.EncodeMPTCPDSSOption(dataAck, true, mapping.dataSeq, mapping.subflowSeq, mapping.dataLen, options[offset:])
+	}
+	// SACK blocks are only sent if there is room for at least one.
+	if e.sackPermitted && len(sackBlocks) > 0 && maxOptionSize-offset >= 2+2+8 {
 		offset += header.EncodeNOP(options[offset:])
 		offset += header.EncodeNOP(options[offset:])
 		offset += header.EncodeSACKBlocks(sackBlocks, options[offset:])
@@ -673,15 +779,17 @@ func (e *endpoint) makeOptions(sackBlocks []header.SACKBlock) []byte {
 	return options[:offset]
 }
 
-// sendRaw sends a TCP segment to the endpoint's peer.
-func (e *endpoint) sendRaw(data buffer.View, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size) *tcpip.Error {
+// sendRaw sends a TCP segment to the endpoint's peer. The data of Multipath TCP
+// subflows is sent along with its mapping.
+func (e *endpoint) sendRaw(data buffer.View, flags byte, seq, ack seqnum.Value, rcvWnd seqnum.Size, mapping *mptcpMapping) *tcpip.Error {
 	var sackBlocks []header.SACKBlock
 	if e.state == stateConnected && e.rcv.pendingBufSize > 0 && (flags&flagAck != 0) {
 		sackBlocks = e.sack.Blocks[:e.sack.NumBlocks]
 	}
-	options := e.makeOptions(sackBlocks)
+	md5Key := e.md5Key(e.id.RemoteAddress)
+	options := e.makeOptions(sackBlocks, md5Key != nil, mapping)
 	if len(options) > 0 {
-		err := sendTCPWithOptions(&e.route, e.id, data, flags, seq, ack, rcvWnd, options)
+		err := sendTCPWithOptions(&e.route, e.id, data, flags, seq, ack, rcvWnd, options, md5Key)
 		putOptions(options)
 		return err
 	}
@@ -731,7 +839,7 @@ func (e *endpoint) handleClose() bool {
 // with the given error code.
 // This method must only be called from the protocol goroutine.
 func (e *endpoint) resetConnection(err *tcpip.Error) {
-	e.sendRaw(nil, flagAck|flagRst, e.snd.sndUna, e.rcv.rcvNxt, 0)
+	e.sendRaw(nil, flagAck|flagRst, e.snd.sndUna, e.rcv.rcvNxt, 0, nil)
 
 	e.mu.Lock()
 	e.state = stateError
@@ -739,6 +847,49 @@ func (e *endpoint) resetConnection(err *tcpip.Error) {
 	e.mu.Unlock()
 }
 
+// refreshRoute finds the route to the peer again after the routing
+// configuration of the stack changed, and resolves its link address if needed.
+// The connection goes on if the peer is still reachable from the local address
+// of the endpoint; otherwise it fails with tcpip.ErrNoRoute and false is
+// returned.
+// This method must only be called from the protocol goroutine.
+func (e *endpoint) refreshRoute() bool {
+	e.mu.Lock()
+	if !e.route.IsValid() {
+		if err := e.route.Refresh(e.boundNICID); err != nil {
+			// The peer can't be told without a route.
+			e.state = stateError
+			e.hardError = tcpip.ErrNoRoute
+			e.mu.Unlock()
+			return false
+		}
+	}
+	// Segments are sent without a link address until it's resolved; the
+	// resolution is retried every time the worker wakes up.
+	e.route.Resolve(nil)
+	e.mu.Unlock()
+
+	e.snd.updateMaxPayloadSize(int(e.route.MTU()), 0)
+	return true
+}
+
+// drain is called by the worker goroutine when notified by Pause. It tells
+// Pause that the worker is stopped, then blocks until Resume is called.
+func (e *endpoint) drain() {
+	e.mu.RLock()
+	done, undrain := e.drainDone, e.undrain
+	e.mu.RUnlock()
+
+	// The notification may be left over from a pause the worker already
+	// drained for.
+	if done == nil {
+		return
+	}
+
+	close(done)
+	<-undrain
+}
+
 // completeWorker is called by the worker goroutine when it's about to exit. It
 // marks the worker as completed and performs cleanup work if requested by
 // Close().
@@ -747,6 +898,20 @@ func (e *endpoint) completeWorker() {
 	defer e.mu.Unlock()
 
 	e.workerRunning = false
+
+	if e.workerDone != nil {
+		close(e.workerDone)
+		e.workerDone = nil
+	}
+
+	// Let a Pause call waiting for the worker go, as it won't get to
+	// drain.
+	if e.drainDone != nil {
+		close(e.drainDone)
+		e.drainDone = nil
+		e.undrain = nil
+	}
+
 	if e.workerCleanup {
 		e.cleanup()
 	}
@@ -791,11 +956,18 @@ func (e *endpoint) handleSegments() bool {
 			// must be dropped as per
 			// https://tools.ietf.org/html/rfc7323#section-3.2.
 			if e.sendTSOk && !s.parsedOptions.TS {
-				atomic.AddUint64(&e.stack.MutableStats().DroppedPackets, 1)
+				e.stack.MutableStats().DroppedPackets.Increment()
 				s.decRef()
 				continue
 			}
 
+			// A subflow joining a Multipath TCP connection can
+			// carry data once the peer acknowledges the handshake.
+			if e.mptcp != nil && e.mptcp.waitingForAck {
+				e.mptcp.waitingForAck = false
+				e.mptcp.conn.confirm(e)
+			}
+
 			// RFC 793, page 41 states that "once in the ESTABLISHED
 			// state all segments must carry current acknowledgment
 			// information."
@@ -812,9 +984,7 @@ func (e *endpoint) handleSegments() bool {
 	}
 
 	// Send an ACK for all processed packets if needed.
-	if e.rcv.rcvNxt != e.snd.maxSentAck {
-		e.snd.sendAck()
-	}
+	e.rcv.sendAckIfNeeded()
 
 	return true
 }
@@ -823,20 +993,14 @@ func (e *endpoint) handleSegments() bool {
 // goroutine and is responsible for sending segments and handling received
 // segments.
 func (e *endpoint) protocolMainLoop(passive bool) *tcpip.Error {
-	var closeTimer *time.Timer
+	var closeTimer timer
 	var closeWaker sleep.Waker
+	closeTimer.init(&e.timers, &closeWaker)
 
 	defer func() {
 		e.waiterQueue.Notify(waiter.EventIn | waiter.EventOut)
 		e.completeWorker()
-
-		if e.snd != nil {
-			e.snd.resendTimer.cleanup()
-		}
-
-		if closeTimer != nil {
-			closeTimer.Stop()
-		}
+		e.timers.cleanup()
 	}()
 
 	if !passive {
@@ -848,6 +1012,8 @@ func (e *endpoint) protocolMainLoop(passive bool) *tcpip.Error {
 			err = h.execute()
 		}
 		if err != nil {
+			e.stack.MutableStats().TCP.FailedConnectionAttempts.Increment()
+
 			e.lastErrorMu.Lock()
 			e.lastError = err
 			e.lastErrorMu.Unlock()
@@ -858,8 +1024,7 @@ func (e *endpoint) protocolMainLoop(passive bool) *tcpip.Error {
 			drained := e.drainDone != nil
 			e.mu.Unlock()
 			if drained {
-				close(e.drainDone)
-				<-e.undrain
+				e.drain()
 			}
 
 			return err
@@ -873,6 +1038,8 @@ func (e *endpoint) protocolMainLoop(passive bool) *tcpip.Error {
 		e.rcvListMu.Lock()
 		e.rcv = newReceiver(e, h.ackNum-1, h.rcvWnd, h.effectiveRcvWndScale())
 		e.rcvListMu.Unlock()
+
+		e.stack.MutableStats().TCP.ActiveConnectionOpenings.Increment()
 	}
 
 	// Tell waiters that the endpoint is connected and writable.
@@ -881,8 +1048,7 @@ func (e *endpoint) protocolMainLoop(passive bool) *tcpip.Error {
 	drained := e.drainDone != nil
 	e.mu.Unlock()
 	if drained {
-		close(e.drainDone)
-		<-e.undrain
+		e.drain()
 	}
 
 	e.waiterQueue.Notify(waiter.EventOut)
@@ -890,6 +1056,8 @@ func (e *endpoint) protocolMainLoop(passive bool) *tcpip.Error {
 	// When the protocol loop exits we should wake up our waiters with EventHUp.
 	defer e.waiterQueue.Notify(waiter.EventHUp)
 
+	e.receiveSynData()
+
 	// Set up the functions that will be called when the main protocol loop
 	// wakes up.
 	funcs := []struct {
@@ -908,9 +1076,19 @@ func (e *endpoint) protocolMainLoop(passive bool) *tcpip.Error {
 			w: &e.newSegmentWaker,
 			f: e.handleSegments,
 		},
+		{
+			w: &e.timers.waker,
+			f: func() bool {
+				e.timers.fire()
+				return true
+			},
+		},
 		{
 			w: &closeWaker,
 			f: func() bool {
+				if !closeTimer.checkExpiration() {
+					return true
+				}
 				e.resetConnection(tcpip.ErrConnectionAborted)
 				return false
 			},
@@ -925,10 +1103,40 @@ func (e *endpoint) protocolMainLoop(passive bool) *tcpip.Error {
 				return true
 			},
 		},
+		{
+			w: &e.rcv.ackWaker,
+			f: func() bool {
+				e.rcv.ackTimerExpired()
+				return true
+			},
+		},
 		{
 			w: &e.notificationWaker,
 			f: func() bool {
 				n := e.fetchNotifications()
+				if n&notifyAbort != 0 {
+					e.resetConnection(tcpip.ErrConnectionAborted)
+					return false
+				}
+
+				if n&notifyAbortSilently != 0 {
+					e.mu.Lock()
+					e.state = stateError
+					e.hardError = tcpip.ErrConnectionAborted
+					e.mu.Unlock()
+					return false
+				}
+
+				if n&notifyNICRemoved != 0 {
+					// The peer can't be told without a
+					// route.
+					e.mu.Lock()
+					e.state = stateError
+					e.hardError = tcpip.ErrNoRoute
+					e.mu.Unlock()
+					return false
+				}
+
 				if n&notifyNonZeroReceiveWindow != 0 {
 					e.rcv.nonZeroWindow()
 				}
@@ -947,12 +1155,38 @@ func (e *endpoint) protocolMainLoop(passive bool) *tcpip.Error {
 					e.snd.updateMaxPayloadSize(mtu, count)
 				}
 
-				if n&notifyClose != 0 && closeTimer == nil {
+				if n&notifyMigrate != 0 {
+					e.mu.Lock()
+					migrated := e.finishMigrationLocked()
+					e.mu.Unlock()
+
+					if migrated {
+						e.snd.updateMaxPayloadSize(int(e.route.MTU()), 0)
+					}
+				}
+
+				if n&notifyClose != 0 && !closeTimer.enabled() {
 					// Reset the connection 3 seconds after the
 					// endpoint has been closed.
-					closeTimer = time.AfterFunc(3*time.Second, func() {
-						closeWaker.Assert()
-					})
+					closeTimer.enable(3 * time.Second)
+				}
+
+				if n&notifyDrain != 0 {
+					// Process the segments received before the
+					// pause, then stop the timers until the
+					// endpoint is resumed.
+					for !e.segmentQueue.empty() {
+						if !e.handleSegments() {
+							return false
+						}
+					}
+
+					pausedAt := e.now()
+					e.timers.pause()
+
+					e.drain()
+
+					e.timers.resume(e.now().Sub(pausedAt))
 				}
 				return true
 			},
@@ -971,6 +1205,9 @@ func (e *endpoint) protocolMainLoop(passive bool) *tcpip.Error {
 		e.workMu.Unlock()
 		v, _ := s.Fetch(true)
 		e.workMu.Lock()
+		if (!e.route.IsValid() || e.route.IsResolutionRequired()) && !e.refreshRoute() {
+			return nil
+		}
 		if !funcs[v].f() {
 			return nil
 		}
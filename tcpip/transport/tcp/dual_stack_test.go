@@ -206,6 +206,54 @@ func TestV6Connect(t *testing.T) {
 	testV6Connect(t, c)
 }
 
+func TestV6ConnectFlowLabel(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateV6Endpoint(false)
+
+	if err := c.EP.Connect(tcpip.FullAddress{Addr: context.TestV6Addr, Port: context.TestPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+
+	// The SYN and the ACK completing the handshake carry the same label.
+	b := c.GetV6Packet()
+	_, label := header.IPv6(b).TOS()
+	if label == 0 {
+		t.Fatalf("got flow label 0 on SYN, want a computed label")
+	}
+	tcp := header.TCP(header.IPv6(b).Payload())
+	c.SendV6Packet(nil, &context.Headers{
+		SrcPort: tcp.DestinationPort(),
+		DstPort: tcp.SourcePort(),
+		Flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		SeqNum:  789,
+		AckNum:  seqnum.Value(tcp.SequenceNumber()).Add(1),
+		RcvWnd:  30000,
+	})
+	if _, got := header.IPv6(c.GetV6Packet()).TOS(); got != label {
+		t.Fatalf("got flow label %#x on ACK, want %#x", got, label)
+	}
+}
+
+func TestV6ConnectExplicitFlowLabel(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateV6Endpoint(false)
+
+	const label = 0xabcde
+	if err := c.EP.SetSockOpt(tcpip.IPv6FlowInfoOption(label)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := c.EP.Connect(tcpip.FullAddress{Addr: context.TestV6Addr, Port: context.TestPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	if _, got := header.IPv6(c.GetV6Packet()).TOS(); got != label {
+		t.Fatalf("got flow label %#x on SYN, want %#x", got, label)
+	}
+}
+
 func TestV6ConnectV6Only(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -5,7 +5,6 @@
 package tcp
 
 import (
-	"crypto/rand"
 	"math"
 	"sync"
 	"sync/atomic"
@@ -15,6 +14,7 @@ import (
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/ports"
 	"github.com/google/netstack/tcpip/seqnum"
 	"github.com/google/netstack/tcpip/stack"
 	"github.com/google/netstack/tmutex"
@@ -33,6 +33,28 @@ const (
 	stateError
 )
 
+// String implements fmt.Stringer.String.
+func (s endpointState) String() string {
+	switch s {
+	case stateInitial:
+		return "INITIAL"
+	case stateBound:
+		return "BOUND"
+	case stateListen:
+		return "LISTEN"
+	case stateConnecting:
+		return "CONNECTING"
+	case stateConnected:
+		return "CONNECTED"
+	case stateClosed:
+		return "CLOSED"
+	case stateError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
 // Reasons for notifying the protocol goroutine.
 const (
 	notifyNonZeroReceiveWindow = 1 << iota
@@ -40,6 +62,11 @@ const (
 	notifyClose
 	notifyMTUChanged
 	notifyDrain
+	notifyMigrate
+	notifyAbort
+	notifyNICRemoved
+	notifyAbortSilently
+	notifyUnreachable
 )
 
 // SACKInfo holds TCP SACK related information for a given endpoint.
@@ -82,11 +109,16 @@ type endpoint struct {
 	//
 	// Once the peer has closed its send side, rcvClosed is set to true
 	// to indicate to users that no more data is coming.
+	//
+	// The segments are queued as received, without copying their data:
+	// rcvBufUsed is the number of bytes left to read, and rcvMemUsed the
+	// memory the segments keep alive, see segment.rcvMem.
 	rcvListMu  sync.Mutex
 	rcvList    segmentList
 	rcvClosed  bool
 	rcvBufSize int
 	rcvBufUsed int
+	rcvMemUsed int
 
 	// The following fields are protected by the mutex.
 	mu                sync.RWMutex
@@ -95,6 +127,7 @@ type endpoint struct {
 	isPortReserved    bool
 	isRegistered      bool
 	boundNICID        tcpip.NICID
+	bindToDevice      tcpip.NICID
 	route             stack.Route
 	v6only            bool
 	isConnectNotified bool
@@ -107,6 +140,11 @@ type endpoint struct {
 	// address).
 	effectiveNetProtos []tcpip.NetworkProtocolNumber
 
+	// clones is the number of references to the endpoint returned by
+	// Clone that haven't been closed yet. The endpoint is only closed by
+	// its last reference.
+	clones int
+
 	// hardError is meaningful only when state is stateError, it stores the
 	// error to be returned when read/write syscalls are called and the
 	// endpoint is in this state.
@@ -120,6 +158,10 @@ type endpoint struct {
 	// also true, and they're both protected by the mutex.
 	workerCleanup bool
 
+	// workerDone, if not nil, is closed when the worker goroutine exits,
+	// so that Stop can wait for it. It's protected by the mutex.
+	workerDone chan struct{}
+
 	// sendTSOk is used to indicate when the TS Option has been negotiated.
 	// When sendTSOk is true every non-RST segment should carry a TS as per
 	// RFC7323#section-1.1
@@ -144,6 +186,40 @@ type endpoint struct {
 	// sack holds TCP SACK related information for this endpoint.
 	sack SACKInfo
 
+	// md5Keys holds the keys used to sign the segments exchanged with each
+	// peer, as described in RFC 2385. It is protected by md5Mu.
+	md5Mu   sync.RWMutex
+	md5Keys map[tcpip.Address][]byte
+
+	// mptcp holds the Multipath TCP state of the endpoint if it negotiates
+	// Multipath TCP or is a subflow of a Multipath TCP connection. It's
+	// only changed by the handshake.
+	mptcp *mptcpSubflow
+
+	// delayedAck and quickAck hold the values of DelayedAckOption and
+	// QuickAckOption. They're accessed atomically because the protocol
+	// goroutine checks them whenever it acknowledges received data.
+	delayedAck uint32
+	quickAck   uint32
+
+	// userTimeout holds the value of TCPUserTimeoutOption, in nanoseconds.
+	// It's accessed atomically because the protocol goroutine checks it
+	// whenever the retransmit timer expires.
+	userTimeout int64
+
+	// userMSS holds the value of MaxSegOption. It's accessed atomically
+	// because the protocol goroutine checks it whenever it sends data.
+	userMSS uint32
+
+	// flowLabel holds the value of IPv6FlowInfoOption. It's accessed
+	// atomically because listening endpoints pass it on to the endpoints
+	// they accept from the protocol goroutine.
+	flowLabel uint32
+
+	// priority holds the value of PriorityOption. It's accessed
+	// atomically for the same reason as flowLabel.
+	priority uint32
+
 	// The options below aren't implemented, but we remember the user
 	// settings because applications expect to be able to set/query these
 	// options.
@@ -155,6 +231,10 @@ type endpoint struct {
 	// and dropped when it is.
 	segmentQueue segmentQueue
 
+	// synData holds the data carried by the SYN of a passive connection,
+	// until the protocol goroutine consumes it, see receiveSynData.
+	synData *segment
+
 	// The following fields are used to manage the send buffer. When
 	// segments are ready to be sent, they are added to sndQueue and the
 	// protocol goroutine is signaled via sndWaker.
@@ -170,6 +250,14 @@ type endpoint struct {
 	sndWaker      sleep.Waker
 	sndCloseWaker sleep.Waker
 
+	// sndHighWat and sndLowWat are the send buffer watermarks set via
+	// SendBufferWatermarksOption, and sndAboveHigh records that the high
+	// one was reached and the low one hasn't been since. They are
+	// protected by sndBufMu.
+	sndHighWat   int
+	sndLowWat    int
+	sndAboveHigh bool
+
 	// The following are used when a "packet too big" control packet is
 	// received. They are protected by sndBufMu. They are used to
 	// communicate to the main protocol goroutine how many such control
@@ -178,6 +266,11 @@ type endpoint struct {
 	packetTooBigCount int
 	sndMTU            int
 
+	// unreachableErr is the error reported by the last control packet
+	// saying that the peer is unreachable. It's protected by sndBufMu, and
+	// only fails connections whose handshake is in progress.
+	unreachableErr *tcpip.Error
+
 	// newSegmentWaker is used to indicate to the protocol goroutine that
 	// it needs to wake up and handle new segments queued to it.
 	newSegmentWaker sleep.Waker
@@ -186,6 +279,10 @@ type endpoint struct {
 	// it needs to wake up and check for notifications.
 	notificationWaker sleep.Waker
 
+	// timers holds the timers of the protocol goroutine, which share a
+	// single runtime timer. It's protected by workMu.
+	timers timerGroup
+
 	// notifyFlags is a bitmask of flags used to indicate to the protocol
 	// goroutine what it was notified; this is only accessed atomically.
 	notifyFlags uint32
@@ -212,6 +309,18 @@ type endpoint struct {
 
 	// The following are only used to assist the restore run to re-connect.
 	connectingAddress tcpip.Address
+
+	// migration, if not nil, holds the ID and route a connected endpoint
+	// is moving to, as requested with MigrateRemoteOption. The protocol
+	// goroutine switches to them once it's notified. It is protected by
+	// the mutex.
+	migration *migration
+}
+
+// migration describes the move of a connected endpoint to a new remote.
+type migration struct {
+	id    stack.TransportEndpointID
+	route stack.Route
 }
 
 func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
@@ -236,6 +345,8 @@ func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waite
 		e.rcvBufSize = rs.Default
 	}
 
+	e.timers.init(stack)
+
 	if p := stack.GetTCPProbe(); p != nil {
 		e.probe = p
 	}
@@ -243,7 +354,7 @@ func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waite
 	e.segmentQueue.setLimit(2 * e.rcvBufSize)
 	e.workMu.Init()
 	e.workMu.Lock()
-	e.tsOffset = timeStampOffset()
+	e.tsOffset = timeStampOffset(stack.Rand())
 	return e
 }
 
@@ -281,6 +392,19 @@ func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 			e.sndBufMu.Unlock()
 		}
 
+		// Determine which send buffer watermark was last crossed.
+		if (mask & (waiter.EventSndHigh | waiter.EventSndLow)) != 0 {
+			e.sndBufMu.Lock()
+			if e.sndHighWat > 0 {
+				if e.sndAboveHigh {
+					result |= mask & waiter.EventSndHigh
+				} else {
+					result |= mask & waiter.EventSndLow
+				}
+			}
+			e.sndBufMu.Unlock()
+		}
+
 		// Determine if the endpoint is readable if requested.
 		if (mask & waiter.EventIn) != 0 {
 			e.rcvListMu.Lock()
@@ -322,6 +446,15 @@ func (e *endpoint) notifyProtocolGoroutine(n uint32) {
 // with it. It must be called only once and with no other concurrent calls to
 // the endpoint.
 func (e *endpoint) Close() {
+	// Only close the endpoint once it is its last reference.
+	e.mu.Lock()
+	if e.clones > 0 {
+		e.clones--
+		e.mu.Unlock()
+		return
+	}
+	e.mu.Unlock()
+
 	// Issue a shutdown so that the peer knows we won't send any more data
 	// if we're connected, or stop accepting if we're listening.
 	e.Shutdown(tcpip.ShutdownWrite | tcpip.ShutdownRead)
@@ -339,15 +472,20 @@ func (e *endpoint) Close() {
 	// is a listening socket, so we must unregister as well otherwise the
 	// next user would fail in Listen() when trying to register.
 	if e.isPortReserved {
-		e.stack.ReleasePort(e.effectiveNetProtos, ProtocolNumber, e.id.LocalAddress, e.id.LocalPort)
+		e.stack.ReleasePort(e.effectiveNetProtos, ProtocolNumber, e.id.LocalAddress, e.id.LocalPort, ports.Flags{}, e.boundNICID)
 		e.isPortReserved = false
 
 		if e.isRegistered {
-			e.stack.UnregisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id)
+			e.stack.UnregisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
 			e.isRegistered = false
 		}
 	}
 
+	// The worker unregisters the endpoint once it's done.
+	if worker && e.isRegistered {
+		e.stack.SetTransportEndpointDraining(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
+	}
+
 	e.mu.Unlock()
 
 	// Now that we don't hold the lock anymore, either perform the local
@@ -359,6 +497,36 @@ func (e *endpoint) Close() {
 	}
 }
 
+// Clone implements tcpip.CloneableEndpoint.Clone. Only bound and listening
+// endpoints can be cloned.
+func (e *endpoint) Clone() (tcpip.Endpoint, *tcpip.Error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state != stateBound && e.state != stateListen {
+		return nil, tcpip.ErrInvalidEndpointState
+	}
+
+	e.clones++
+	return &endpointClone{endpoint: e}, nil
+}
+
+// endpointClone is a reference to an endpoint returned by Clone.
+type endpointClone struct {
+	*endpoint
+
+	// closed is set atomically when the reference is closed, so that it
+	// only releases the endpoint once.
+	closed uint32
+}
+
+// Close implements tcpip.Endpoint.Close.
+func (c *endpointClone) Close() {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		c.endpoint.Close()
+	}
+}
+
 // cleanup frees all resources associated with the endpoint. It is called after
 // Close() is called and the worker goroutine (if any) is done with its work.
 func (e *endpoint) cleanup() {
@@ -372,13 +540,62 @@ func (e *endpoint) cleanup() {
 		}
 	}
 
+	// Complete a migration the protocol goroutine didn't get to, so that
+	// the right ID is unregistered.
+	e.finishMigrationLocked()
+
+	e.detachMPTCP()
+
 	if e.isRegistered {
-		e.stack.UnregisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id)
+		e.stack.UnregisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
 	}
 
+	e.releaseSegments()
+
 	e.route.Release()
 }
 
+// releaseSegments releases the segments the endpoint still holds once it's
+// closed, e.g., the data left unacknowledged or unread when the connection is
+// reset or aborted, so that they're recycled.
+func (e *endpoint) releaseSegments() {
+	for s := e.segmentQueue.dequeue(); s != nil; s = e.segmentQueue.dequeue() {
+		s.decRef()
+	}
+
+	e.sndBufMu.Lock()
+	for s := e.sndQueue.Front(); s != nil; s = e.sndQueue.Front() {
+		e.sndQueue.Remove(s)
+		s.decRef()
+	}
+	e.sndBufMu.Unlock()
+
+	if e.snd != nil {
+		for s := e.snd.writeList.Front(); s != nil; s = e.snd.writeList.Front() {
+			e.snd.writeList.Remove(s)
+			s.decRef()
+		}
+		e.snd.writeNext = nil
+	}
+
+	if e.rcv != nil {
+		for _, s := range e.rcv.pendingRcvdSegments {
+			s.decRef()
+		}
+		e.rcv.pendingRcvdSegments = nil
+		e.rcv.pendingBufUsed = 0
+	}
+
+	e.rcvListMu.Lock()
+	for s := e.rcvList.Front(); s != nil; s = e.rcvList.Front() {
+		e.rcvList.Remove(s)
+		s.decRef()
+	}
+	e.rcvBufUsed = 0
+	e.rcvMemUsed = 0
+	e.rcvListMu.Unlock()
+}
+
 // Read reads data from the endpoint.
 func (e *endpoint) Read(*tcpip.FullAddress) (buffer.View, tcpip.ControlMessages, *tcpip.Error) {
 	e.mu.RLock()
@@ -412,30 +629,155 @@ func (e *endpoint) readLocked() (buffer.View, *tcpip.Error) {
 	}
 
 	s := e.rcvList.Front()
-	views := s.data.Views()
-	v := views[s.viewToDeliver]
-	s.viewToDeliver++
+	v := s.data.Views()[s.viewToDeliver]
+
+	// The view is handed over to the caller, so it's copied if its memory
+	// is reused once the segment is released.
+	if s.data.Buffer() != nil {
+		v = append(buffer.View(nil), v...)
+	}
+
+	e.consumeLocked(len(v))
+
+	return v, nil
+}
+
+// ReadView implements tcpip.ViewEndpoint.ReadView.
+func (e *endpoint) ReadView(n int, _ *tcpip.FullAddress) (buffer.VectorisedView, tcpip.ControlMessages, *tcpip.Error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	// The endpoint can be read under the same conditions as with Read.
+	if s := e.state; s != stateConnected && s != stateClosed && e.rcvBufUsed == 0 {
+		if s == stateError {
+			return buffer.VectorisedView{}, tcpip.ControlMessages{}, e.hardError
+		}
+		return buffer.VectorisedView{}, tcpip.ControlMessages{}, tcpip.ErrInvalidEndpointState
+	}
+
+	e.rcvListMu.Lock()
+	defer e.rcvListMu.Unlock()
+
+	if e.rcvBufUsed == 0 {
+		if e.rcvClosed || e.state != stateConnected {
+			return buffer.VectorisedView{}, tcpip.ControlMessages{}, tcpip.ErrClosedForReceive
+		}
+		return buffer.VectorisedView{}, tcpip.ControlMessages{}, tcpip.ErrWouldBlock
+	}
+
+	vv := e.peekViewsLocked(n)
+	e.consumeLocked(vv.Size())
+
+	return vv, tcpip.ControlMessages{}, nil
+}
+
+// PeekView implements tcpip.ViewEndpoint.PeekView.
+func (e *endpoint) PeekView(n int) (buffer.VectorisedView, tcpip.ControlMessages, *tcpip.Error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	// The endpoint can be peeked at under the same conditions as with
+	// Peek.
+	if s := e.state; s != stateConnected && s != stateClosed {
+		if s == stateError {
+			return buffer.VectorisedView{}, tcpip.ControlMessages{}, e.hardError
+		}
+		return buffer.VectorisedView{}, tcpip.ControlMessages{}, tcpip.ErrInvalidEndpointState
+	}
+
+	e.rcvListMu.Lock()
+	defer e.rcvListMu.Unlock()
+
+	if e.rcvBufUsed == 0 {
+		if e.rcvClosed || e.state != stateConnected {
+			return buffer.VectorisedView{}, tcpip.ControlMessages{}, tcpip.ErrClosedForReceive
+		}
+		return buffer.VectorisedView{}, tcpip.ControlMessages{}, tcpip.ErrWouldBlock
+	}
+
+	return e.peekViewsLocked(n), tcpip.ControlMessages{}, nil
+}
 
-	if s.viewToDeliver >= len(views) {
+// peekViewsLocked returns the views holding up to n bytes from the front of the
+// receive queue, with a reference to the PacketBuffer backing them, if any.
+// As a VectorisedView holds a single PacketBuffer, the views stop short of a
+// segment received into another one.
+//
+// It must be called with rcvListMu held.
+func (e *endpoint) peekViewsLocked(n int) buffer.VectorisedView {
+	var views []buffer.View
+	var buf *buffer.PacketBuffer
+	size := 0
+	for s := e.rcvList.Front(); s != nil && size < n; s = s.Next() {
+		if b := s.data.Buffer(); b != nil {
+			if buf != nil && b != buf {
+				break
+			}
+			buf = b
+		}
+		for _, v := range s.data.Views()[s.viewToDeliver:] {
+			if len(v) > n-size {
+				v = v[:n-size]
+			}
+			if len(v) == 0 {
+				continue
+			}
+			views = append(views, v)
+			if size += len(v); size == n {
+				break
+			}
+		}
+	}
+
+	vv := buffer.NewVectorisedView(size, views)
+	if buf != nil {
+		buf.IncRef()
+		vv.SetBuffer(buf)
+	}
+	return vv
+}
+
+// consumeLocked removes the first n bytes from the receive queue, splitting the
+// view they end in if needed, and notifies the protocol goroutine if enough
+// space opens up in the receive buffer to announce a nonzero window.
+//
+// It must be called with rcvListMu held.
+func (e *endpoint) consumeLocked(n int) {
+	scale, mss := e.rcv.rcvWndScale, e.rcv.mss
+	wasZero := e.zeroReceiveWindow(scale, mss)
+	e.rcvBufUsed -= n
+
+	// The memory of a segment is only released along with the segment,
+	// once it's entirely read.
+	for s := e.rcvList.Front(); s != nil; s = e.rcvList.Front() {
+		views := s.data.Views()
+		for ; s.viewToDeliver < len(views); s.viewToDeliver++ {
+			if v := &views[s.viewToDeliver]; n < len(*v) {
+				v.TrimFront(n)
+				n = 0
+				break
+			}
+			n -= len(views[s.viewToDeliver])
+		}
+		if s.viewToDeliver < len(views) {
+			break
+		}
+		e.rcvMemUsed -= s.rcvMem
 		e.rcvList.Remove(s)
 		s.decRef()
 	}
 
-	scale := e.rcv.rcvWndScale
-	wasZero := e.zeroReceiveWindow(scale)
-	e.rcvBufUsed -= len(v)
-	if wasZero && !e.zeroReceiveWindow(scale) {
+	if wasZero && !e.zeroReceiveWindow(scale, mss) {
 		e.notifyProtocolGoroutine(notifyNonZeroReceiveWindow)
 	}
-
-	return v, nil
 }
 
 // Write writes data to the endpoint's peer.
 func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, *tcpip.Error) {
 	// Linux completely ignores any address passed to sendto(2) for TCP sockets
 	// (without the MSG_FASTOPEN flag). Corking is unimplemented, so opts.More
-	// and opts.EndOfRecord are also ignored.
+	// and opts.EndOfRecord are also ignored. opts.Push applies to the part
+	// of p that is actually written.
 
 	e.mu.RLock()
 	defer e.mu.RUnlock()
@@ -455,6 +797,18 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, *tc
 		return 0, nil
 	}
 
+	// The data of Multipath TCP connections is spread over their subflows.
+	if c := e.mptcpConn(); c != nil {
+		return c.write(p, opts)
+	}
+	return e.queueWrite(p, opts, nil)
+}
+
+// queueWrite queues the data of p for sending, mapped to the data sequence
+// space of the Multipath TCP connection c if not nil.
+//
+// The endpoint must be connected, and its mutex held for reading.
+func (e *endpoint) queueWrite(p tcpip.Payload, opts tcpip.WriteOptions, c *mptcpConn) (uintptr, *tcpip.Error) {
 	e.sndBufMu.Lock()
 
 	// Check if the connection has already been closed for sends.
@@ -482,20 +836,34 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, *tc
 	}
 	l := len(v)
 	s := newSegmentFromView(&e.route, e.id, v)
+	s.push = opts.Push
+	if c != nil {
+		s.dataSeq = c.allocDataSeq(l)
+	}
 
 	// Add data to the send queue.
 	e.sndBufUsed += l
 	e.sndBufInQueue += seqnum.Size(l)
 	e.sndQueue.PushBack(s)
 
+	notifyHigh := e.sndHighWat > 0 && !e.sndAboveHigh && e.sndBufUsed >= e.sndHighWat
+	if notifyHigh {
+		e.sndAboveHigh = true
+	}
+
 	e.sndBufMu.Unlock()
 
-	if e.workMu.TryLock() {
+	if notifyHigh {
+		e.waiterQueue.Notify(waiter.EventSndHigh)
+	}
+
+	if e.route.IsValid() && e.workMu.TryLock() {
 		// Do the work inline.
 		e.handleWrite()
 		e.workMu.Unlock()
 	} else {
-		// Let the protocol goroutine do the work.
+		// Let the protocol goroutine do the work. It also finds the
+		// route to the peer again if it's no longer valid.
 		e.sndWaker.Assert()
 	}
 	return uintptr(l), err
@@ -559,15 +927,31 @@ func (e *endpoint) Peek(vec [][]byte) (uintptr, tcpip.ControlMessages, *tcpip.Er
 }
 
 // zeroReceiveWindow checks if the receive window to be announced now would be
-// zero, based on the amount of available buffer and the receive window scaling.
+// zero, based on the amount of available buffer, the receive window scaling and
+// the window update threshold for segments of mss bytes.
 //
 // It must be called with rcvListMu held.
-func (e *endpoint) zeroReceiveWindow(scale uint8) bool {
-	if e.rcvBufUsed >= e.rcvBufSize {
-		return true
-	}
+func (e *endpoint) zeroReceiveWindow(scale uint8, mss int) bool {
+	avail := e.receiveBufferAvailableLocked()
+	return avail>>scale == 0 || avail < windowUpdateThreshold(e.rcvBufSize, mss)
+}
+
+// delayedAckEnabled returns whether the acknowledgement of received data may
+// be delayed.
+func (e *endpoint) delayedAckEnabled() bool {
+	return atomic.LoadUint32(&e.delayedAck) != 0
+}
 
-	return ((e.rcvBufSize - e.rcvBufUsed) >> scale) == 0
+// takeQuickAck returns whether quickack was requested, and clears the request.
+func (e *endpoint) takeQuickAck() bool {
+	return atomic.SwapUint32(&e.quickAck, 0) != 0
+}
+
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 // SetSockOpt sets a socket option.
@@ -585,6 +969,28 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 		e.mu.Unlock()
 		return nil
 
+	case tcpip.DelayedAckOption:
+		atomic.StoreUint32(&e.delayedAck, boolToUint32(v != 0))
+		return nil
+
+	case tcpip.QuickAckOption:
+		atomic.StoreUint32(&e.quickAck, boolToUint32(v != 0))
+		return nil
+
+	case tcpip.TCPUserTimeoutOption:
+		if v < 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		atomic.StoreInt64(&e.userTimeout, int64(v))
+		return nil
+
+	case tcpip.MaxSegOption:
+		if v < 0 || v > math.MaxUint16 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		atomic.StoreUint32(&e.userMSS, uint32(v))
+		return nil
+
 	case tcpip.ReceiveBufferSizeOption:
 		// Make sure the receive buffer size is within the min and max
 		// allowed.
@@ -605,9 +1011,9 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 
 		// Make sure the receive buffer size allows us to send a
 		// non-zero window size.
-		scale := uint8(0)
+		scale, mss := uint8(0), 0
 		if e.rcv != nil {
-			scale = e.rcv.rcvWndScale
+			scale, mss = e.rcv.rcvWndScale, e.rcv.mss
 		}
 		if size>>scale == 0 {
 			size = 1 << scale
@@ -618,9 +1024,9 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 			size = math.MaxInt32 / 2
 		}
 
-		wasZero := e.zeroReceiveWindow(scale)
+		wasZero := e.zeroReceiveWindow(scale, mss)
 		e.rcvBufSize = size
-		if wasZero && !e.zeroReceiveWindow(scale) {
+		if wasZero && !e.zeroReceiveWindow(scale, mss) {
 			mask |= notifyNonZeroReceiveWindow
 		}
 		e.rcvListMu.Unlock()
@@ -650,6 +1056,22 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 
 		return nil
 
+	case tcpip.SendBufferWatermarksOption:
+		if v.High < 0 || v.Low < 0 || v.Low > v.High {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		e.sndBufMu.Lock()
+		e.sndHighWat = v.High
+		e.sndLowWat = v.Low
+		e.sndAboveHigh = v.High > 0 && e.sndBufUsed >= v.High
+		e.sndBufMu.Unlock()
+
+		return nil
+
+	case tcpip.TCPMD5SigOption:
+		return e.setMD5Key(v.Addr, v.Key)
+
 	case tcpip.V6OnlyOption:
 		// We only recognize this option on v6 endpoints.
 		if e.netProto != header.IPv6ProtocolNumber {
@@ -665,11 +1087,54 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 		}
 
 		e.v6only = v != 0
+
+	case tcpip.BindToDeviceOption:
+		nicid := tcpip.NICID(v)
+		if nicid != 0 && !e.stack.CheckNIC(nicid) {
+			return tcpip.ErrUnknownNICID
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		// We only allow this to be set when we're in the initial state.
+		if e.state != stateInitial {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+		e.bindToDevice = nicid
+
+	case tcpip.IPv6FlowInfoOption:
+		// We only recognize this option on v6 endpoints.
+		if e.netProto != header.IPv6ProtocolNumber {
+			return tcpip.ErrInvalidEndpointState
+		}
+		if v&^header.IPv6FlowLabelMask != 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+		atomic.StoreUint32(&e.flowLabel, uint32(v))
+
+	case tcpip.PriorityOption:
+		atomic.StoreUint32(&e.priority, uint32(v))
+
+	case tcpip.MigrateRemoteOption:
+		return e.migrate(v.Remote)
 	}
 
 	return nil
 }
 
+// advertisedMSS returns the MSS to advertise in the SYN segments sent through
+// r: the largest one its MTU allows, capped by MaxSegOption. The MTU of the
+// route already excludes the IPv4 or IPv6 header.
+func (e *endpoint) advertisedMSS(r *stack.Route) uint16 {
+	mss := r.MTU() - header.TCPMinimumSize
+	if user := atomic.LoadUint32(&e.userMSS); user != 0 && user < mss {
+		mss = user
+	}
+	return uint16(mss)
+}
+
 // readyReceiveSize returns the number of bytes ready to be received.
 func (e *endpoint) readyReceiveSize() (int, *tcpip.Error) {
 	e.mu.RLock()
@@ -702,6 +1167,12 @@ func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
 		e.sndBufMu.Unlock()
 		return nil
 
+	case *tcpip.SendBufferWatermarksOption:
+		e.sndBufMu.Lock()
+		*o = tcpip.SendBufferWatermarksOption{High: e.sndHighWat, Low: e.sndLowWat}
+		e.sndBufMu.Unlock()
+		return nil
+
 	case *tcpip.ReceiveBufferSizeOption:
 		e.rcvListMu.Lock()
 		*o = tcpip.ReceiveBufferSizeOption(e.rcvBufSize)
@@ -728,6 +1199,22 @@ func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
 		}
 		return nil
 
+	case *tcpip.DelayedAckOption:
+		*o = tcpip.DelayedAckOption(atomic.LoadUint32(&e.delayedAck))
+		return nil
+
+	case *tcpip.QuickAckOption:
+		*o = tcpip.QuickAckOption(atomic.LoadUint32(&e.quickAck))
+		return nil
+
+	case *tcpip.TCPUserTimeoutOption:
+		*o = tcpip.TCPUserTimeoutOption(atomic.LoadInt64(&e.userTimeout))
+		return nil
+
+	case *tcpip.MaxSegOption:
+		*o = tcpip.MaxSegOption(atomic.LoadUint32(&e.userMSS))
+		return nil
+
 	case *tcpip.ReuseAddressOption:
 		e.mu.RLock()
 		v := e.reuseAddr
@@ -739,6 +1226,12 @@ func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
 		}
 		return nil
 
+	case *tcpip.BindToDeviceOption:
+		e.mu.RLock()
+		*o = tcpip.BindToDeviceOption(e.bindToDevice)
+		e.mu.RUnlock()
+		return nil
+
 	case *tcpip.V6OnlyOption:
 		// We only recognize this option on v6 endpoints.
 		if e.netProto != header.IPv6ProtocolNumber {
@@ -755,8 +1248,30 @@ func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
 		}
 		return nil
 
+	case *tcpip.IPv6FlowInfoOption:
+		// We only recognize this option on v6 endpoints.
+		if e.netProto != header.IPv6ProtocolNumber {
+			return tcpip.ErrUnknownProtocolOption
+		}
+		*o = tcpip.IPv6FlowInfoOption(atomic.LoadUint32(&e.flowLabel))
+		return nil
+
+	case *tcpip.PriorityOption:
+		*o = tcpip.PriorityOption(atomic.LoadUint32(&e.priority))
+		return nil
+
 	case *tcpip.TCPInfoOption:
 		*o = tcpip.TCPInfoOption{}
+		e.mu.RLock()
+		// The negotiated options are recorded by the protocol goroutine
+		// before it marks the endpoint connected, and no longer change.
+		if s := e.state; (s == stateConnected || s == stateClosed) && e.snd != nil {
+			o.SndWndScale = e.snd.sndWndScale
+			o.RcvWndScale = e.rcv.rcvWndScale
+			o.SACKPermitted = e.sackPermitted
+			o.Timestamps = e.sendTSOk
+		}
+		e.mu.RUnlock()
 		return nil
 	}
 
@@ -800,6 +1315,13 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 	}
 
 	nicid := addr.NIC
+	if e.bindToDevice != 0 {
+		if nicid != 0 && nicid != e.bindToDevice {
+			return tcpip.ErrNoRoute
+		}
+		nicid = e.bindToDevice
+	}
+
 	switch e.state {
 	case stateBound:
 		// If we're already bound to a NIC but the caller is requesting
@@ -855,7 +1377,7 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 
 	if e.id.LocalPort != 0 {
 		// The endpoint is bound to a port, attempt to register it.
-		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, e.id, e)
+		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, e.id, e, false)
 		if err != nil {
 			return err
 		}
@@ -871,7 +1393,7 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 			}
 
 			e.id.LocalPort = p
-			err := e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, e.id, e)
+			err := e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, e.id, e, false)
 			switch err {
 			case nil:
 				return true, nil
@@ -890,13 +1412,15 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 	// before Connect: in such a case we don't want to hold on to
 	// reservations anymore.
 	if e.isPortReserved {
-		e.stack.ReleasePort(e.effectiveNetProtos, ProtocolNumber, origID.LocalAddress, origID.LocalPort)
+		e.stack.ReleasePort(e.effectiveNetProtos, ProtocolNumber, origID.LocalAddress, origID.LocalPort, ports.Flags{}, e.boundNICID)
 		e.isPortReserved = false
 	}
 
 	e.isRegistered = true
 	e.state = stateConnecting
 	e.route = r.Clone()
+	e.route.FlowLabel = atomic.LoadUint32(&e.flowLabel)
+	e.route.Priority = uint8(atomic.LoadUint32(&e.priority))
 	e.boundNICID = nicid
 	e.effectiveNetProtos = netProtos
 	e.connectingAddress = connectingAddr
@@ -907,6 +1431,88 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 	return tcpip.ErrConnectStarted
 }
 
+// migrate moves the connected endpoint to a new remote address and port. The
+// registration with the stack is moved right away, while the protocol goroutine
+// is notified to start sending to the new remote.
+//
+// This is experimental: the congestion control and RTT state are kept as is,
+// even though the path to the new remote may be very different.
+func (e *endpoint) migrate(addr tcpip.FullAddress) *tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state != stateConnected {
+		return tcpip.ErrNotConnected
+	}
+
+	nicid := addr.NIC
+	if e.boundNICID != 0 {
+		if nicid != 0 && nicid != e.boundNICID {
+			return tcpip.ErrNoRoute
+		}
+		nicid = e.boundNICID
+	}
+
+	netProto, err := e.checkV4Mapped(&addr)
+	if err != nil {
+		return err
+	}
+
+	// The local address is kept, so the network protocol can't change.
+	if netProto != e.route.NetProto {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	r, err := e.stack.FindRoute(nicid, e.id.LocalAddress, addr.Addr, netProto)
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+
+	// The endpoint is registered with the ID of the previous migration if
+	// the protocol goroutine hasn't switched to it yet.
+	oldID := e.id
+	if e.migration != nil {
+		oldID = e.migration.id
+	}
+
+	id := oldID
+	id.RemoteAddress = r.RemoteAddress
+	id.RemotePort = addr.Port
+
+	if err := e.stack.MoveTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, oldID, id, e, false); err != nil {
+		return err
+	}
+
+	if e.migration != nil {
+		e.migration.route.Release()
+	}
+	e.migration = &migration{id: id, route: r.Clone()}
+	e.migration.route.FlowLabel = atomic.LoadUint32(&e.flowLabel)
+	e.migration.route.Priority = uint8(atomic.LoadUint32(&e.priority))
+
+	e.notifyProtocolGoroutine(notifyMigrate)
+
+	return nil
+}
+
+// finishMigrationLocked switches the endpoint to the ID and route of the
+// pending migration, if any, and reports whether it did. It must only be called
+// by the protocol goroutine, or once it has stopped, with the mutex held.
+func (e *endpoint) finishMigrationLocked() bool {
+	m := e.migration
+	if m == nil {
+		return false
+	}
+
+	e.migration = nil
+	e.route.Release()
+	e.route = m.route
+	e.id = m.id
+
+	return true
+}
+
 // ConnectEndpoint is not supported.
 func (*endpoint) ConnectEndpoint(tcpip.Endpoint) *tcpip.Error {
 	return tcpip.ErrInvalidEndpointState
@@ -989,7 +1595,7 @@ func (e *endpoint) Listen(backlog int) *tcpip.Error {
 	}
 
 	// Register the endpoint.
-	if err := e.stack.RegisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e); err != nil {
+	if err := e.stack.RegisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e, false); err != nil {
 		return err
 	}
 
@@ -1068,8 +1674,25 @@ func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() *tcpip.Error) (ret
 		}
 	}
 
-	// Reserve the port.
-	port, err := e.stack.ReservePort(netProtos, ProtocolNumber, addr.Addr, addr.Port)
+	nic := addr.NIC
+	if e.bindToDevice != 0 {
+		if nic != 0 && nic != e.bindToDevice {
+			return tcpip.ErrInvalidEndpointState
+		}
+		nic = e.bindToDevice
+	}
+
+	// If an address is specified, we must ensure that it's one of our
+	// local addresses.
+	if len(addr.Addr) != 0 {
+		nic = e.stack.CheckLocalAddress(nic, netProto, addr.Addr)
+		if nic == 0 {
+			return tcpip.ErrBadLocalAddress
+		}
+	}
+
+	// Reserve the port on the NIC the endpoint is bound to, if any.
+	port, err := e.stack.ReservePort(netProtos, ProtocolNumber, addr.Addr, addr.Port, ports.Flags{}, nic)
 	if err != nil {
 		return err
 	}
@@ -1077,11 +1700,13 @@ func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() *tcpip.Error) (ret
 	e.isPortReserved = true
 	e.effectiveNetProtos = netProtos
 	e.id.LocalPort = port
+	e.id.LocalAddress = addr.Addr
+	e.boundNICID = nic
 
 	// Any failures beyond this point must remove the port registration.
 	defer func() {
 		if retErr != nil {
-			e.stack.ReleasePort(netProtos, ProtocolNumber, addr.Addr, port)
+			e.stack.ReleasePort(netProtos, ProtocolNumber, addr.Addr, port, ports.Flags{}, nic)
 			e.isPortReserved = false
 			e.effectiveNetProtos = nil
 			e.id.LocalPort = 0
@@ -1090,18 +1715,6 @@ func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() *tcpip.Error) (ret
 		}
 	}()
 
-	// If an address is specified, we must ensure that it's one of our
-	// local addresses.
-	if len(addr.Addr) != 0 {
-		nic := e.stack.CheckLocalAddress(addr.NIC, netProto, addr.Addr)
-		if nic == 0 {
-			return tcpip.ErrBadLocalAddress
-		}
-
-		e.boundNICID = nic
-		e.id.LocalAddress = addr.Addr
-	}
-
 	// Check the commit function.
 	if commit != nil {
 		if err := commit(); err != nil {
@@ -1137,9 +1750,14 @@ func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, *tcpip.Error) {
 		return tcpip.FullAddress{}, tcpip.ErrNotConnected
 	}
 
+	id := e.id
+	if e.migration != nil {
+		id = e.migration.id
+	}
+
 	return tcpip.FullAddress{
-		Addr: e.id.RemoteAddress,
-		Port: e.id.RemotePort,
+		Addr: id.RemoteAddress,
+		Port: id.RemotePort,
 		NIC:  e.boundNICID,
 	}, nil
 }
@@ -1147,23 +1765,48 @@ func (e *endpoint) GetRemoteAddress() (tcpip.FullAddress, *tcpip.Error) {
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
 func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv *buffer.VectorisedView) {
+	if !e.checksumValid(r, vv) {
+		e.stack.MutableStats().MalformedRcvdPackets.Increment()
+		return
+	}
+
+	if !e.md5Valid(r, vv) {
+		e.stack.MutableStats().DroppedPackets.Increment()
+		return
+	}
+
 	s := newSegment(r, id, vv)
 	if !s.parse() {
-		atomic.AddUint64(&e.stack.MutableStats().MalformedRcvdPackets, 1)
+		e.stack.MutableStats().MalformedRcvdPackets.Increment()
 		s.decRef()
 		return
 	}
 
+	e.stack.MutableStats().TCP.SegmentsReceived.Increment()
+
 	// Send packet to worker goroutine.
 	if e.segmentQueue.enqueue(s) {
 		e.newSegmentWaker.Assert()
 	} else {
 		// The queue is full, so we drop the segment.
-		atomic.AddUint64(&e.stack.MutableStats().DroppedPackets, 1)
+		e.stack.MutableStats().DroppedPackets.Increment()
 		s.decRef()
 	}
 }
 
+// checksumValid verifies the checksum of the segment in vv, unless the link has
+// already validated it.
+func (e *endpoint) checksumValid(r *stack.Route, vv *buffer.VectorisedView) bool {
+	if r.ChecksumValidated {
+		e.stack.MutableStats().ChecksumSkippedRcvdPackets.Increment()
+		return true
+	}
+
+	e.stack.MutableStats().ChecksumVerifiedRcvdPackets.Increment()
+	xsum := header.PseudoHeaderChecksumWithLength(r.PseudoHeaderChecksum(ProtocolNumber), uint16(vv.Size()))
+	return header.ChecksumVV(*vv, xsum) == 0xffff
+}
+
 // HandleControlPacket implements stack.TransportEndpoint.HandleControlPacket.
 func (e *endpoint) HandleControlPacket(id stack.TransportEndpointID, typ stack.ControlType, extra uint32, vv *buffer.VectorisedView) {
 	switch typ {
@@ -1176,7 +1819,128 @@ func (e *endpoint) HandleControlPacket(id stack.TransportEndpointID, typ stack.C
 		e.sndBufMu.Unlock()
 
 		e.notifyProtocolGoroutine(notifyMTUChanged)
+
+	case stack.ControlHostUnreachable, stack.ControlPortUnreachable:
+		// Like Linux, only fail connections that are still being
+		// established, as unreachable errors are transient once
+		// they are, see RFC 1122 section 4.2.3.9.
+		err := tcpip.ErrNoRoute
+		if typ == stack.ControlPortUnreachable {
+			err = tcpip.ErrConnectionRefused
+		}
+		e.sndBufMu.Lock()
+		e.unreachableErr = err
+		e.sndBufMu.Unlock()
+
+		e.notifyProtocolGoroutine(notifyUnreachable)
+	}
+}
+
+// HandleNICRemoved implements stack.RoutedTransportEndpoint.HandleNICRemoved.
+// Connections through the removed NIC fail with tcpip.ErrNoRoute.
+func (e *endpoint) HandleNICRemoved(id tcpip.NICID) {
+	e.mu.RLock()
+	routed := e.state == stateConnecting || e.state == stateConnected
+	affected := routed && e.route.NICID() == id
+	e.mu.RUnlock()
+
+	if affected {
+		e.notifyProtocolGoroutine(notifyNICRemoved)
+	}
+}
+
+// State implements stack.TransportEndpointStateReporter.State.
+func (e *endpoint) State() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.state.String()
+}
+
+// AcceptQueue implements
+// stack.TransportEndpointAcceptQueueReporter.AcceptQueue.
+func (e *endpoint) AcceptQueue() (int, int, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.state != stateListen {
+		return 0, 0, false
+	}
+	return len(e.acceptedChan), cap(e.acceptedChan), true
+}
+
+// Pause implements stack.PausableTransportEndpoint.Pause. It stops the worker
+// goroutine, if any, once it has processed the segments already received.
+func (e *endpoint) Pause() {
+	e.mu.Lock()
+	if !e.workerRunning || e.drainDone != nil {
+		e.mu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	e.drainDone = done
+	e.undrain = make(chan struct{})
+	e.mu.Unlock()
+
+	e.notifyProtocolGoroutine(notifyDrain)
+	<-done
+}
+
+// Resume implements stack.PausableTransportEndpoint.Resume.
+func (e *endpoint) Resume() {
+	e.mu.Lock()
+	undrain := e.undrain
+	e.drainDone = nil
+	e.undrain = nil
+	e.mu.Unlock()
+
+	if undrain != nil {
+		close(undrain)
+	}
+}
+
+// Stop implements stack.StoppableTransportEndpoint.Stop. A connected endpoint
+// that's given time to linger is shut down for writing, and reset if the
+// connection isn't done by then. Other endpoints are reset right away. With
+// opts.Silent, connections are aborted without sending the reset.
+func (e *endpoint) Stop(opts stack.CloseOptions) {
+	abort := uint32(notifyAbort)
+	if opts.Silent {
+		abort = notifyAbortSilently
+	}
+
+	e.mu.Lock()
+	if !e.workerRunning {
+		e.mu.Unlock()
+
+		// A passive handshake may be running in another goroutine.
+		e.notifyProtocolGoroutine(abort)
+		return
+	}
+	if e.workerDone == nil {
+		e.workerDone = make(chan struct{})
+	}
+	done := e.workerDone
+	graceful := opts.Linger > 0 && e.state == stateConnected
+	e.mu.Unlock()
+
+	if graceful {
+		e.Shutdown(tcpip.ShutdownWrite)
+		t := e.stack.AfterFunc(opts.Linger, func() {
+			e.notifyProtocolGoroutine(abort)
+		})
+		defer t.Stop()
+	} else {
+		e.notifyProtocolGoroutine(abort)
 	}
+	<-done
+}
+
+// Draining implements stack.TransportEndpointDrainReporter.Draining. An
+// endpoint is draining once it has been closed, until its worker goroutine is
+// done and the endpoint unregistered.
+func (e *endpoint) Draining() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.workerCleanup
 }
 
 // updateSndBufferUsage is called by the protocol goroutine when room opens up
@@ -1189,21 +1953,44 @@ func (e *endpoint) updateSndBufferUsage(v int) {
 	// a full buffer event occurs. This ensures that we don't wake up
 	// writers to queue just 1-2 segments and go back to sleep.
 	notify = notify && e.sndBufUsed < e.sndBufSize>>1
+
+	// The low watermark is only notified once after the high one.
+	notifyLow := e.sndAboveHigh && e.sndBufUsed <= e.sndLowWat
+	if notifyLow {
+		e.sndAboveHigh = false
+	}
 	e.sndBufMu.Unlock()
 
 	if notify {
 		e.waiterQueue.Notify(waiter.EventOut)
 	}
+	if notifyLow {
+		e.waiterQueue.Notify(waiter.EventSndLow)
+	}
 }
 
 // readyToRead is called by the protocol goroutine when a new segment is ready
 // to be read, or when the connection is closed for receiving (in which case
 // s will be nil).
 func (e *endpoint) readyToRead(s *segment) {
+	// The data received by Multipath TCP subflows is reassembled by their
+	// connection before being queued to the master.
+	if s != nil && e.mptcp != nil && e.mptcp.conn != nil {
+		e.mptcp.conn.receive(e, s)
+		return
+	}
+	e.queueReadable(s)
+}
+
+// queueReadable queues the data of s to be read, or marks the receive side as
+// closed if s is nil.
+func (e *endpoint) queueReadable(s *segment) {
 	e.rcvListMu.Lock()
 	if s != nil {
 		s.incRef()
+		s.rcvMem = s.memSize()
 		e.rcvBufUsed += s.data.Size()
+		e.rcvMemUsed += s.rcvMem
 		e.rcvList.PushBack(s)
 	} else {
 		e.rcvClosed = true
@@ -1217,17 +2004,30 @@ func (e *endpoint) readyToRead(s *segment) {
 // receive buffer.
 func (e *endpoint) receiveBufferAvailable() int {
 	e.rcvListMu.Lock()
-	size := e.rcvBufSize
-	used := e.rcvBufUsed
+	avail := e.receiveBufferAvailableLocked()
 	e.rcvListMu.Unlock()
+	return avail
+}
+
+// receiveBufferAvailableLocked is like receiveBufferAvailable. As the segments
+// queued to be read may keep more memory alive than their data, when they're
+// received into link buffers much larger than them, the memory they use is
+// limited to twice the size of the receive buffer, and the space available
+// shrinks when that limit is approached.
+//
+// It must be called with rcvListMu held.
+func (e *endpoint) receiveBufferAvailableLocked() int {
+	avail := e.rcvBufSize - e.rcvBufUsed
+	if mem := 2*e.rcvBufSize - e.rcvMemUsed; mem < avail {
+		avail = mem
+	}
 
 	// We may use more bytes than the buffer size when the receive buffer
 	// shrinks.
-	if used >= size {
+	if avail < 0 {
 		return 0
 	}
-
-	return size - used
+	return avail
 }
 
 func (e *endpoint) receiveBufferSize() int {
@@ -1262,6 +2062,11 @@ func (e *endpoint) timestamp() uint32 {
 	return tcpTimeStamp(e.tsOffset)
 }
 
+// now returns the current time according to the clock of the stack.
+func (e *endpoint) now() time.Time {
+	return time.Unix(0, e.stack.NowNanoseconds())
+}
+
 // tcpTimeStamp returns a timestamp offset by the provided offset. This is
 // not inlined above as it's used when SYN cookies are in use and endpoint
 // is not created at the time when the SYN cookie is sent.
@@ -1271,12 +2076,8 @@ func tcpTimeStamp(offset uint32) uint32 {
 }
 
 // timeStampOffset returns a randomized timestamp offset to be used when sending
-// timestamp values in a timestamp option for a TCP segment.
-func timeStampOffset() uint32 {
-	b := make([]byte, 4)
-	if _, err := rand.Read(b); err != nil {
-		panic(err)
-	}
+// timestamp values in a timestamp option for a TCP segment, drawn from rng.
+func timeStampOffset(rng tcpip.Rand) uint32 {
 	// Initialize a random tsOffset that will be added to the recentTS
 	// everytime the timestamp is sent when the Timestamp option is enabled.
 	//
@@ -1286,7 +2087,7 @@ func timeStampOffset() uint32 {
 	// NOTE: This is not completely to spec as normally this should be
 	// initialized in a manner analogous to how sequence numbers are
 	// randomized per connection basis. But for now this is sufficient.
-	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+	return rng.Uint32()
 }
 
 // maybeEnableSACKPermitted marks the SACKPermitted option enabled for this endpoint
@@ -1308,7 +2109,7 @@ func (e *endpoint) maybeEnableSACKPermitted(synOpts *header.TCPSynOptions) {
 // there are intervening syscalls when the state is being copied.
 func (e *endpoint) completeState() stack.TCPEndpointState {
 	var s stack.TCPEndpointState
-	s.SegTime = time.Now()
+	s.SegTime = e.now()
 
 	// Copy EndpointID.
 	e.mu.Lock()
@@ -43,7 +43,7 @@ func NewForwarder(s *stack.Stack, rcvWnd, maxInFlight int, handler func(*Forward
 		maxInFlight: maxInFlight,
 		handler:     handler,
 		inFlight:    make(map[stack.TransportEndpointID]struct{}),
-		listen:      newListenContext(s, seqnum.Size(rcvWnd), true, 0),
+		listen:      newListenContext(s, nil, seqnum.Size(rcvWnd), true, 0),
 	}
 }
 
@@ -0,0 +1,121 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/stack"
+)
+
+// MaxMD5KeyLen is the maximum length of the keys used to sign segments.
+const MaxMD5KeyLen = 80
+
+// setMD5Key sets the key used to sign the segments exchanged with addr, or
+// removes it if key is empty.
+func (e *endpoint) setMD5Key(addr tcpip.Address, key []byte) *tcpip.Error {
+	if len(key) > MaxMD5KeyLen {
+		return tcpip.ErrInvalidOptionValue
+	}
+
+	e.md5Mu.Lock()
+	defer e.md5Mu.Unlock()
+
+	if len(key) == 0 {
+		delete(e.md5Keys, addr)
+		return nil
+	}
+	if e.md5Keys == nil {
+		e.md5Keys = make(map[tcpip.Address][]byte)
+	}
+	e.md5Keys[addr] = append([]byte(nil), key...)
+	return nil
+}
+
+// md5Key returns the key used to sign the segments exchanged with addr, or nil
+// if they aren't signed.
+func (e *endpoint) md5Key(addr tcpip.Address) []byte {
+	e.md5Mu.RLock()
+	defer e.md5Mu.RUnlock()
+	return e.md5Keys[addr]
+}
+
+// inheritMD5Keys copies the keys of the listening endpoint l to e.
+func (e *endpoint) inheritMD5Keys(l *endpoint) {
+	l.md5Mu.RLock()
+	defer l.md5Mu.RUnlock()
+
+	for addr, key := range l.md5Keys {
+		e.setMD5Key(addr, key)
+	}
+}
+
+// md5Valid checks the MD5 signature of the segment in vv. Segments from peers
+// with a key must carry a valid signature.
+func (e *endpoint) md5Valid(r *stack.Route, vv *buffer.VectorisedView) bool {
+	key := e.md5Key(r.RemoteAddress)
+	if key == nil {
+		return true
+	}
+
+	h := header.TCP(vv.First())
+	offset := int(h.DataOffset())
+	if offset < header.TCPMinimumSize || offset > len(h) {
+		return false
+	}
+	digest := header.FindMD5Option(h.Options())
+	if digest == nil {
+		return false
+	}
+
+	payload := vv.Clone(nil)
+	defer payload.Release()
+	payload.TrimFront(offset)
+	want := md5Signature(r.RemoteAddress, r.LocalAddress, h, payload.Views(), key)
+	return subtle.ConstantTimeCompare(digest, want) == 1
+}
+
+// signMD5 fills in the digest of the MD5 signature option of the given
+// outbound segment, which must have one.
+func signMD5(r *stack.Route, tcp header.TCP, data buffer.View, key []byte) {
+	if digest := header.FindMD5Option(tcp.Options()); digest != nil {
+		copy(digest, md5Signature(r.LocalAddress, r.RemoteAddress, tcp, []buffer.View{data}, key))
+	}
+}
+
+// md5Signature computes the MD5 signature of a segment as described in RFC 2385
+// section 2.0, i.e., over the pseudo-header, the TCP header without options and
+// with a zero checksum, the payload and the key.
+func md5Signature(src, dst tcpip.Address, tcp header.TCP, payload []buffer.View, key []byte) []byte {
+	segLen := int(tcp.DataOffset())
+	for _, v := range payload {
+		segLen += len(v)
+	}
+
+	h := md5.New()
+	h.Write([]byte(src))
+	h.Write([]byte(dst))
+	if len(src) == header.IPv4AddressSize {
+		h.Write([]byte{0, uint8(ProtocolNumber), uint8(segLen >> 8), uint8(segLen)})
+	} else {
+		h.Write([]byte{uint8(segLen >> 24), uint8(segLen >> 16), uint8(segLen >> 8), uint8(segLen), 0, 0, 0, uint8(ProtocolNumber)})
+	}
+
+	var fixed [header.TCPMinimumSize]byte
+	copy(fixed[:], tcp)
+	header.TCP(fixed[:]).SetChecksum(0)
+	h.Write(fixed[:])
+
+	for _, v := range payload {
+		h.Write(v)
+	}
+	h.Write(key)
+
+	return h.Sum(nil)
+}
@@ -0,0 +1,669 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/seqnum"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+// This file implements an experimental subset of Multipath TCP v0, as described
+// in RFC 6824. A connection negotiated with the MP_CAPABLE option is made of the
+// endpoint that negotiated it, the master subflow, and of at most one
+// additional subflow, added with AddSubflow and MP_JOIN. There is no path
+// manager, so subflows are neither advertised nor added on their own. Data is
+// sent over the subflows in turn, and each segment carries a DSS option mapping
+// its data to the data sequence space, in which the data received over all the
+// subflows is reassembled before being queued to the master.
+//
+// Only what's needed to carry data over two subflows is implemented: the data
+// level is neither acknowledged nor flow controlled, data lost by a subflow
+// isn't sent over another one, DATA_FIN isn't used so that the connection ends
+// with its master, and the options of the ACK completing a handshake aren't
+// retransmitted.
+
+// mptcpMaxSubflows is the maximum number of subflows of a connection, the
+// master included.
+const mptcpMaxSubflows = 2
+
+// mptcpConn is a Multipath TCP connection.
+type mptcpConn struct {
+	proto  *protocol
+	master *endpoint
+
+	// localKey and remoteKey are the keys exchanged by the MP_CAPABLE
+	// handshake, and localToken and remoteToken the tokens derived from
+	// them, which identify the connection when a subflow joins it.
+	localKey    uint64
+	remoteKey   uint64
+	localToken  uint32
+	remoteToken uint32
+
+	mu sync.Mutex
+
+	// subflows holds the subflows of the connection, the master first.
+	subflows []*endpoint
+
+	// next is used to pick the subflows in turn.
+	next int
+
+	// sndNxt is the data sequence number of the next byte to be written.
+	sndNxt uint64
+
+	// rcvNxt is the data sequence number of the next byte to be queued to
+	// the master, and pending holds the segments received past it, in
+	// data sequence number order.
+	rcvNxt  uint64
+	pending []mptcpChunk
+
+	closed bool
+}
+
+// mptcpChunk is a segment received ahead of the data sequence number expected
+// next.
+type mptcpChunk struct {
+	dataSeq uint64
+	s       *segment
+}
+
+// mptcpSubflow is the Multipath TCP state of an endpoint.
+type mptcpSubflow struct {
+	// conn is the connection the endpoint is a subflow of. It's nil until
+	// the MP_CAPABLE handshake of a master is completed.
+	conn *mptcpConn
+
+	// join is set on subflows joining an existing connection.
+	join bool
+
+	// localKey and remoteKey are the keys of an MP_CAPABLE handshake in
+	// progress; remoteKey is only known yet on the passive side.
+	localKey  uint64
+	remoteKey uint64
+
+	// localNonce, remoteNonce and addressID are used by MP_JOIN handshakes.
+	localNonce  uint32
+	remoteNonce uint32
+	addressID   uint8
+
+	// iss and irs are the initial sequence numbers of the subflow, which
+	// subflow sequence numbers are relative to.
+	iss seqnum.Value
+	irs seqnum.Value
+
+	// confirmed is set once the subflow can carry data. It's protected by
+	// conn.mu.
+	confirmed bool
+
+	// waitingForAck is set on the active side of an MP_JOIN handshake
+	// until the peer acknowledges the ACK that completed it, as the
+	// subflow can't carry data before that.
+	waitingForAck bool
+
+	// rcvMapping is the last mapping received on the subflow, which
+	// applies to segments without one.
+	rcvMapping header.MPTCPOption
+}
+
+// mptcpMapping maps the data of a segment to the data sequence space.
+type mptcpMapping struct {
+	dataSeq    uint64
+	subflowSeq uint32
+	dataLen    uint16
+}
+
+// AddSubflow adds a subflow from the local address to the remote one to the
+// Multipath TCP connection of ep, which must be a connected TCP endpoint that
+// negotiated Multipath TCP, see MPTCPEnabled. The subflow is established in
+// the background; it carries data once it's counted by Subflows.
+func AddSubflow(ep tcpip.Endpoint, local tcpip.Address, remote tcpip.FullAddress) *tcpip.Error {
+	e, ok := ep.(*endpoint)
+	if !ok {
+		return tcpip.ErrNotSupported
+	}
+
+	e.mu.RLock()
+	c := e.mptcpConn()
+	connected := e.state == stateConnected
+	e.mu.RUnlock()
+	if !connected || c == nil {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	n := newEndpoint(e.stack, e.netProto, &waiter.Queue{})
+	n.priority = atomic.LoadUint32(&e.priority)
+	n.mptcp = &mptcpSubflow{
+		conn:       c,
+		join:       true,
+		localNonce: e.stack.Rand().Uint32(),
+		addressID:  1,
+	}
+	if !c.add(n, false) {
+		// The connection already has its additional subflow.
+		n.Close()
+		return tcpip.ErrAlreadyConnected
+	}
+	if err := n.Bind(tcpip.FullAddress{Addr: local}, nil); err != nil {
+		c.remove(n)
+		n.Close()
+		return err
+	}
+	if err := n.Connect(remote); err != nil && err != tcpip.ErrConnectStarted {
+		c.remove(n)
+		n.Close()
+		return err
+	}
+	return nil
+}
+
+// Subflows returns the number of subflows of the Multipath TCP connection of ep
+// that can carry data, the master included, or 0 if ep isn't the master of a
+// Multipath TCP connection.
+func Subflows(ep tcpip.Endpoint) int {
+	e, ok := ep.(*endpoint)
+	if !ok {
+		return 0
+	}
+
+	e.mu.RLock()
+	c := e.mptcpConn()
+	e.mu.RUnlock()
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, sf := range c.subflows {
+		if sf.mptcp.confirmed {
+			n++
+		}
+	}
+	return n
+}
+
+// mptcpEnabled returns whether MPTCPEnabled is set on the TCP protocol of s.
+func mptcpEnabled(s *stack.Stack) bool {
+	var v MPTCPEnabled
+	if err := s.TransportProtocolOption(ProtocolNumber, &v); err != nil {
+		return false
+	}
+	return bool(v)
+}
+
+// mptcpKey returns a random key for an MP_CAPABLE handshake.
+func mptcpKey(s *stack.Stack) uint64 {
+	r := s.Rand()
+	return uint64(r.Uint32())<<32 | uint64(r.Uint32())
+}
+
+// mptcpKeyDigest returns the token and initial data sequence number derived
+// from key, as described in RFC 6824 section 3.1.
+func mptcpKeyDigest(key uint64) (uint32, uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], key)
+	h := sha1.Sum(b[:])
+	return binary.BigEndian.Uint32(h[:]), binary.BigEndian.Uint64(h[sha1.Size-8:])
+}
+
+// mptcpHMAC returns the HMAC sent by a host of key keyA and nonce nonceA in an
+// MP_JOIN handshake with the host of key keyB and nonce nonceB, as described in
+// RFC 6824 section 3.2.
+func mptcpHMAC(keyA, keyB uint64, nonceA, nonceB uint32) []byte {
+	var key [16]byte
+	binary.BigEndian.PutUint64(key[:], keyA)
+	binary.BigEndian.PutUint64(key[8:], keyB)
+	var msg [8]byte
+	binary.BigEndian.PutUint32(msg[:], nonceA)
+	binary.BigEndian.PutUint32(msg[4:], nonceB)
+
+	h := hmac.New(sha1.New, key[:])
+	h.Write(msg[:])
+	return h.Sum(nil)
+}
+
+// encodeMPTCPOption encodes opt in the provided buffer. It returns the number
+// of bytes written to the provided buffer.
+func encodeMPTCPOption(opt *header.MPTCPOption, b []byte) int {
+	switch opt.Subtype {
+	case header.MPTCPSubtypeCapable:
+		return header.EncodeMPTCPCapableOption(opt.SenderKey, opt.ReceiverKey, opt.HasReceiverKey, b)
+	case header.MPTCPSubtypeJoin:
+		switch {
+		case opt.HMAC == nil:
+			return header.EncodeMPTCPJoinSynOption(opt.Token, opt.Nonce, opt.AddressID, b)
+		case len(opt.HMAC) == header.MPTCPJoinTruncatedHMACSize:
+			return header.EncodeMPTCPJoinSynAckOption(opt.HMAC, opt.Nonce, opt.AddressID, b)
+		default:
+			return header.EncodeMPTCPJoinAckOption(opt.HMAC, b)
+		}
+	}
+	return 0
+}
+
+// newMPTCPConn creates the connection whose master e completed the MP_CAPABLE
+// handshake.
+func newMPTCPConn(e *endpoint) *mptcpConn {
+	sf := e.mptcp
+	c := &mptcpConn{
+		proto:     e.stack.TransportProtocolInstance(ProtocolNumber).(*protocol),
+		master:    e,
+		localKey:  sf.localKey,
+		remoteKey: sf.remoteKey,
+		subflows:  []*endpoint{e},
+	}
+	var idsn uint64
+	c.localToken, idsn = mptcpKeyDigest(c.localKey)
+	c.sndNxt = idsn + 1
+	c.remoteToken, idsn = mptcpKeyDigest(c.remoteKey)
+	c.rcvNxt = idsn + 1
+	sf.conn = c
+	sf.confirmed = true
+
+	// Subflows can't join a connection whose token is already used.
+	c.proto.mptcpMu.Lock()
+	if _, ok := c.proto.mptcpConns[c.localToken]; !ok {
+		c.proto.mptcpConns[c.localToken] = c
+	}
+	c.proto.mptcpMu.Unlock()
+	return c
+}
+
+// lookupMPTCPConn returns the connection whose local token is token, or nil if
+// there is none.
+func (p *protocol) lookupMPTCPConn(token uint32) *mptcpConn {
+	p.mptcpMu.Lock()
+	defer p.mptcpMu.Unlock()
+	return p.mptcpConns[token]
+}
+
+// add adds the subflow n to c. It returns false if c is closed or has no room
+// for n.
+func (c *mptcpConn) add(n *endpoint, confirmed bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.subflows) >= mptcpMaxSubflows {
+		return false
+	}
+	n.mptcp.confirmed = confirmed
+	c.subflows = append(c.subflows, n)
+	return true
+}
+
+// remove removes the subflow n from c.
+func (c *mptcpConn) remove(n *endpoint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, sf := range c.subflows {
+		if sf == n {
+			c.subflows = append(c.subflows[:i], c.subflows[i+1:]...)
+			return
+		}
+	}
+}
+
+// confirm lets the subflow n carry data.
+func (c *mptcpConn) confirm(n *endpoint) {
+	c.mu.Lock()
+	n.mptcp.confirmed = true
+	c.mu.Unlock()
+}
+
+// accept starts the subflow n, which joined c with a passive handshake. Unlike
+// the master, it isn't accepted by the listening endpoint.
+func (c *mptcpConn) accept(n *endpoint) {
+	if !c.add(n, true) {
+		n.resetConnection(tcpip.ErrConnectionAborted)
+		n.Close()
+		return
+	}
+	n.startAcceptedLoop(&waiter.Queue{})
+}
+
+// close closes the subflows of c other than the master, and releases the data
+// held for reassembly.
+func (c *mptcpConn) close() {
+	c.proto.mptcpMu.Lock()
+	if c.proto.mptcpConns[c.localToken] == c {
+		delete(c.proto.mptcpConns, c.localToken)
+	}
+	c.proto.mptcpMu.Unlock()
+
+	c.mu.Lock()
+	subflows := c.subflows
+	c.subflows = nil
+	c.closed = true
+	for _, p := range c.pending {
+		p.s.decRef()
+	}
+	c.pending = nil
+	c.mu.Unlock()
+
+	for _, sf := range subflows {
+		if sf != c.master {
+			sf.Close()
+		}
+	}
+}
+
+// pick returns the subflow to write to next.
+func (c *mptcpConn) pick() *endpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var subflows [mptcpMaxSubflows]*endpoint
+	n := 0
+	for _, sf := range c.subflows {
+		if sf.mptcp.confirmed {
+			subflows[n] = sf
+			n++
+		}
+	}
+	if n == 0 {
+		return c.master
+	}
+	sf := subflows[c.next%n]
+	c.next++
+	return sf
+}
+
+// allocDataSeq returns the data sequence number of the n bytes written next.
+func (c *mptcpConn) allocDataSeq(n int) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dataSeq := c.sndNxt
+	c.sndNxt += uint64(n)
+	return dataSeq
+}
+
+// dataAck returns the data sequence number acknowledged by the subflows.
+func (c *mptcpConn) dataAck() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rcvNxt
+}
+
+// write writes p to one of the subflows of c. It's called by the master with
+// its mutex held for reading.
+func (c *mptcpConn) write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, *tcpip.Error) {
+	c.master.sndBufMu.Lock()
+	closed := c.master.sndClosed
+	c.master.sndBufMu.Unlock()
+	if closed {
+		return 0, tcpip.ErrClosedForSend
+	}
+
+	sf := c.pick()
+	if sf != c.master {
+		sf.mu.RLock()
+		defer sf.mu.RUnlock()
+		if sf.state != stateConnected {
+			sf = c.master
+		}
+	}
+	return sf.queueWrite(p, opts, c)
+}
+
+// receive maps the data of the segment s received by the subflow sf to the
+// data sequence space, and queues it to the master once it's in order.
+func (c *mptcpConn) receive(sf *endpoint, s *segment) {
+	m := &sf.mptcp.rcvMapping
+	if s.parsedOptions.MPTCP.HasMapping {
+		*m = s.parsedOptions.MPTCP
+	}
+	if !m.HasMapping {
+		return
+	}
+
+	// The data must be within the mapping, whose subflow sequence number
+	// is relative to the initial one.
+	offset := uint32(s.sequenceNumber-sf.mptcp.irs) - m.SubflowSeq
+	if uint64(offset)+uint64(s.data.Size()) > uint64(m.DataLen) {
+		return
+	}
+	dataSeq := m.DataSeq + uint64(offset)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || dataSeq+uint64(s.data.Size()) <= c.rcvNxt {
+		return
+	}
+
+	if dataSeq > c.rcvNxt {
+		// Hold on to the segment until the data ahead of it is
+		// received by another subflow.
+		i := len(c.pending)
+		for i > 0 && c.pending[i-1].dataSeq > dataSeq {
+			i--
+		}
+		s.incRef()
+		c.pending = append(c.pending, mptcpChunk{})
+		copy(c.pending[i+1:], c.pending[i:])
+		c.pending[i] = mptcpChunk{dataSeq, s}
+		return
+	}
+
+	c.deliverLocked(s, dataSeq)
+	for len(c.pending) > 0 && c.pending[0].dataSeq <= c.rcvNxt {
+		p := c.pending[0]
+		c.pending = c.pending[1:]
+		if p.dataSeq+uint64(p.s.data.Size()) > c.rcvNxt {
+			c.deliverLocked(p.s, p.dataSeq)
+		}
+		p.s.decRef()
+	}
+}
+
+// deliverLocked queues the data of the segment s, which starts at the data
+// sequence number dataSeq, to the master from rcvNxt on.
+//
+// c.mu must be held.
+func (c *mptcpConn) deliverLocked(s *segment, dataSeq uint64) {
+	if d := c.rcvNxt - dataSeq; d > 0 {
+		s.data.TrimFront(int(d))
+	}
+	c.rcvNxt += uint64(s.data.Size())
+	c.master.queueReadable(s)
+}
+
+// mptcpConn returns the Multipath TCP connection e is the master of, or nil if
+// there is none.
+func (e *endpoint) mptcpConn() *mptcpConn {
+	if e.mptcp == nil || e.mptcp.conn == nil || e.mptcp.conn.master != e {
+		return nil
+	}
+	return e.mptcp.conn
+}
+
+// mptcpMapping returns the mapping of the data of seg, or nil if it has none.
+func (e *endpoint) mptcpMapping(seg *segment) *mptcpMapping {
+	if e.mptcp == nil || e.mptcp.conn == nil || seg.data.Size() == 0 {
+		return nil
+	}
+	return &mptcpMapping{
+		dataSeq:    seg.dataSeq,
+		subflowSeq: uint32(seg.sequenceNumber - e.mptcp.iss),
+		dataLen:    uint16(seg.data.Size()),
+	}
+}
+
+// acceptMPTCP sets up the Multipath TCP state of e, which is being accepted in
+// response to a SYN with the given options.
+func (e *endpoint) acceptMPTCP(opts *header.TCPSynOptions) {
+	mp := &opts.MPTCP
+	if !mp.Present || !mptcpEnabled(e.stack) || e.md5Key(e.id.RemoteAddress) != nil {
+		return
+	}
+
+	switch mp.Subtype {
+	case header.MPTCPSubtypeCapable:
+		e.mptcp = &mptcpSubflow{
+			localKey:  mptcpKey(e.stack),
+			remoteKey: mp.SenderKey,
+		}
+
+	case header.MPTCPSubtypeJoin:
+		c := e.stack.TransportProtocolInstance(ProtocolNumber).(*protocol).lookupMPTCPConn(mp.Token)
+		if c == nil {
+			return
+		}
+		e.mptcp = &mptcpSubflow{
+			conn:        c,
+			join:        true,
+			localNonce:  e.stack.Rand().Uint32(),
+			remoteNonce: mp.Nonce,
+		}
+	}
+}
+
+// detachMPTCP closes the Multipath TCP connection of e if it's its master, or
+// else removes e from it.
+func (e *endpoint) detachMPTCP() {
+	if e.mptcp == nil || e.mptcp.conn == nil {
+		return
+	}
+	if c := e.mptcpConn(); c != nil {
+		c.close()
+		return
+	}
+	e.mptcp.conn.remove(e)
+}
+
+// sendMPTCPAck sends the ACK completing a handshake, with the Multipath TCP
+// option opt.
+func (e *endpoint) sendMPTCPAck(seq, ack seqnum.Value, rcvWnd seqnum.Size, opt header.MPTCPOption) {
+	options := e.makeOptions(nil, false, nil)
+	n := len(options)
+	options = options[:cap(options)]
+	n += encodeMPTCPOption(&opt, options[n:])
+	sendTCPWithOptions(&e.route, e.id, nil, flagAck, seq, ack, rcvWnd, options[:n], nil)
+	putOptions(options)
+}
+
+// mptcpSynOption returns the Multipath TCP option of the SYN or SYN-ACK sent by
+// h. Active endpoints of stacks enabling Multipath TCP are first set up to
+// negotiate it.
+func (h *handshake) mptcpSynOption(md5 bool) header.MPTCPOption {
+	e := h.ep
+	if h.active && e.mptcp == nil && !md5 && mptcpEnabled(e.stack) {
+		e.mptcp = &mptcpSubflow{localKey: mptcpKey(e.stack)}
+	}
+
+	sf := e.mptcp
+	switch {
+	case sf == nil:
+		return header.MPTCPOption{}
+	case !sf.join:
+		return header.MPTCPOption{
+			Present:   true,
+			Subtype:   header.MPTCPSubtypeCapable,
+			SenderKey: sf.localKey,
+		}
+	case h.active:
+		return header.MPTCPOption{
+			Present:   true,
+			Subtype:   header.MPTCPSubtypeJoin,
+			Token:     sf.conn.remoteToken,
+			Nonce:     sf.localNonce,
+			AddressID: sf.addressID,
+		}
+	default:
+		c := sf.conn
+		return header.MPTCPOption{
+			Present:   true,
+			Subtype:   header.MPTCPSubtypeJoin,
+			Nonce:     sf.localNonce,
+			AddressID: sf.addressID,
+			HMAC:      mptcpHMAC(c.localKey, c.remoteKey, sf.localNonce, sf.remoteNonce)[:header.MPTCPJoinTruncatedHMACSize],
+		}
+	}
+}
+
+// mptcpSynAckReceived completes the Multipath TCP side of an active handshake
+// on receipt of the SYN-ACK s with options opts, and sends the ACK completing
+// the handshake.
+func (h *handshake) mptcpSynAckReceived(s *segment, opts *header.TCPSynOptions) *tcpip.Error {
+	e := h.ep
+	sf := e.mptcp
+	mp := &opts.MPTCP
+	sf.iss, sf.irs = h.iss, s.sequenceNumber
+	wnd := h.rcvWnd >> h.effectiveRcvWndScale()
+
+	if sf.join {
+		// The peer must authenticate itself to join the connection.
+		c := sf.conn
+		if !mp.Present || mp.Subtype != header.MPTCPSubtypeJoin || len(mp.HMAC) != header.MPTCPJoinTruncatedHMACSize ||
+			!hmac.Equal(mp.HMAC, mptcpHMAC(c.remoteKey, c.localKey, mp.Nonce, sf.localNonce)[:header.MPTCPJoinTruncatedHMACSize]) {
+			e.sendRaw(nil, flagRst|flagAck, h.iss+1, h.ackNum, 0, nil)
+			return tcpip.ErrConnectionRefused
+		}
+		sf.remoteNonce = mp.Nonce
+		sf.waitingForAck = true
+		e.sendMPTCPAck(h.iss+1, h.ackNum, wnd, header.MPTCPOption{
+			Present: true,
+			Subtype: header.MPTCPSubtypeJoin,
+			HMAC:    mptcpHMAC(c.localKey, c.remoteKey, sf.localNonce, sf.remoteNonce),
+		})
+		return nil
+	}
+
+	if !mp.Present || mp.Subtype != header.MPTCPSubtypeCapable {
+		// The peer doesn't support Multipath TCP, go on with TCP.
+		e.mptcp = nil
+		e.sendRaw(nil, flagAck, h.iss+1, h.ackNum, wnd, nil)
+		return nil
+	}
+
+	sf.remoteKey = mp.SenderKey
+	newMPTCPConn(e)
+	e.sendMPTCPAck(h.iss+1, h.ackNum, wnd, header.MPTCPOption{
+		Present:        true,
+		Subtype:        header.MPTCPSubtypeCapable,
+		SenderKey:      sf.localKey,
+		ReceiverKey:    sf.remoteKey,
+		HasReceiverKey: true,
+	})
+	return nil
+}
+
+// mptcpAckReceived completes the Multipath TCP side of a passive handshake on
+// receipt of the ACK s.
+func (h *handshake) mptcpAckReceived(s *segment) *tcpip.Error {
+	e := h.ep
+	sf := e.mptcp
+	mp := &s.parsedOptions.MPTCP
+	sf.iss, sf.irs = h.iss, h.ackNum-1
+
+	if sf.join {
+		c := sf.conn
+		if !mp.Present || mp.Subtype != header.MPTCPSubtypeJoin || len(mp.HMAC) != header.MPTCPJoinHMACSize ||
+			!hmac.Equal(mp.HMAC, mptcpHMAC(c.remoteKey, c.localKey, sf.remoteNonce, sf.localNonce)) {
+			replyWithReset(s)
+			return tcpip.ErrConnectionAborted
+		}
+
+		// Let the peer know the subflow can carry data.
+		e.sendRaw(nil, flagAck, h.iss+1, h.ackNum, h.rcvWnd>>h.effectiveRcvWndScale(), nil)
+		return nil
+	}
+
+	if !mp.Present || mp.Subtype != header.MPTCPSubtypeCapable || !mp.HasReceiverKey || mp.SenderKey != sf.remoteKey || mp.ReceiverKey != sf.localKey {
+		// The peer didn't go on with Multipath TCP.
+		e.mptcp = nil
+		return nil
+	}
+	newMPTCPConn(e)
+	return nil
+}
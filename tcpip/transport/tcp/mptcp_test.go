@@ -0,0 +1,437 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/waiter"
+)
+
+const (
+	mptcpPort = 1234
+	mptcpMTU  = 1500
+)
+
+// The client and server are connected by two links, on which they have the
+// first and second address respectively.
+var (
+	mptcpClientAddrs = []tcpip.Address{"\x0a\x00\x00\x01", "\x0a\x00\x01\x01"}
+	mptcpServerAddrs = []tcpip.Address{"\x0a\x00\x00\x02", "\x0a\x00\x01\x02"}
+)
+
+// mptcpLink forwards the packets sent by each end of a link to the other. It
+// records the TCP segments it forwards, and can hold them back.
+type mptcpLink struct {
+	ends [2]*channel.Endpoint
+
+	mu       sync.Mutex
+	cond     sync.Cond
+	held     bool
+	pending  []channel.PacketInfo
+	segments [2][]header.TCP
+}
+
+func newMPTCPLink(client, server *channel.Endpoint, done <-chan struct{}) *mptcpLink {
+	l := &mptcpLink{ends: [2]*channel.Endpoint{client, server}}
+	l.cond.L = &l.mu
+	for from := range l.ends {
+		go func(from int) {
+			for {
+				select {
+				case p := <-l.ends[from].C:
+					l.forward(from, p)
+				case <-done:
+					return
+				}
+			}
+		}(from)
+	}
+	return l
+}
+
+// forward records the packet p sent by the end from, and passes it on to the
+// other end unless packets are held back.
+func (l *mptcpLink) forward(from int, p channel.PacketInfo) {
+	v := append(append(buffer.View(nil), p.Header...), p.Payload...)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.segments[from] = append(l.segments[from], header.TCP(header.IPv4(v).Payload()))
+	l.cond.Broadcast()
+	if l.held && from == 0 {
+		l.pending = append(l.pending, p)
+		return
+	}
+	l.inject(from, v)
+}
+
+// inject passes the packet v sent by the end from to the other end.
+func (l *mptcpLink) inject(from int, v buffer.View) {
+	vv := buffer.NewVectorisedView(len(v), []buffer.View{v})
+	l.ends[1-from].InjectInbound(ipv4.ProtocolNumber, &vv)
+}
+
+// hold holds back the packets sent by the client until release is called.
+func (l *mptcpLink) hold() {
+	l.mu.Lock()
+	l.held = true
+	l.mu.Unlock()
+}
+
+// release passes on the packets held back.
+func (l *mptcpLink) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held = false
+	for _, p := range l.pending {
+		l.inject(0, append(append(buffer.View(nil), p.Header...), p.Payload...))
+	}
+	l.pending = nil
+}
+
+// waitFor waits until the end from sends a segment for which match returns
+// true, and returns it.
+func (l *mptcpLink) waitFor(t *testing.T, from int, match func(header.TCP) bool) header.TCP {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	timer := time.AfterFunc(5*time.Second, func() {
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		for _, s := range l.segments[from] {
+			if match(s) {
+				return s
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for a segment")
+		}
+		l.cond.Wait()
+	}
+}
+
+// mptcpOption returns the Multipath TCP option of s.
+func mptcpOption(s header.TCP) header.MPTCPOption {
+	if s.Flags()&header.TCPFlagSyn != 0 {
+		return header.ParseSynOptions(s.Options(), s.Flags()&header.TCPFlagAck != 0).MPTCP
+	}
+	return header.ParseTCPOptions(s.Options()).MPTCP
+}
+
+// mptcpTest is a client and a server stack connected by two links. Multipath
+// TCP is enabled on the client, and on the server unless the test is about
+// falling back to TCP.
+type mptcpTest struct {
+	t      *testing.T
+	client *stack.Stack
+	server *stack.Stack
+	links  [2]*mptcpLink
+	done   chan struct{}
+	eps    []tcpip.Endpoint
+}
+
+func newMPTCPTest(t *testing.T, serverMPTCP bool) *mptcpTest {
+	m := &mptcpTest{t: t, done: make(chan struct{})}
+	var ends [2][2]*channel.Endpoint
+	addrs := [2][]tcpip.Address{mptcpClientAddrs, mptcpServerAddrs}
+	for i := range addrs {
+		s := stack.New(nil, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+		if i == 0 || serverMPTCP {
+			if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, tcp.MPTCPEnabled(true)); err != nil {
+				t.Fatalf("SetTransportProtocolOption failed: %v", err)
+			}
+		}
+		var routes []tcpip.Route
+		for j := range m.links {
+			nic := tcpip.NICID(j + 1)
+			id, ep := channel.New(256, mptcpMTU, "")
+			if err := s.CreateNIC(nic, id); err != nil {
+				t.Fatalf("CreateNIC failed: %v", err)
+			}
+			if err := s.AddAddress(nic, ipv4.ProtocolNumber, addrs[i][j]); err != nil {
+				t.Fatalf("AddAddress failed: %v", err)
+			}
+			routes = append(routes, tcpip.Route{
+				Destination: addrs[1-i][j],
+				Mask:        "\xff\xff\xff\xff",
+				NIC:         nic,
+			})
+			ends[j][i] = ep
+		}
+		s.SetRouteTable(routes)
+		if i == 0 {
+			m.client = s
+		} else {
+			m.server = s
+		}
+	}
+	for j := range m.links {
+		m.links[j] = newMPTCPLink(ends[j][0], ends[j][1], m.done)
+	}
+	return m
+}
+
+// cleanup closes the endpoints created by the test, and stops the links.
+func (m *mptcpTest) cleanup() {
+	for _, ep := range m.eps {
+		ep.Close()
+	}
+	close(m.done)
+}
+
+// connect connects an endpoint of the client to one of the server over the
+// first link, and returns them along with the waiter queue of the latter.
+func (m *mptcpTest) connect() (tcpip.Endpoint, tcpip.Endpoint, *waiter.Queue) {
+	t := m.t
+	t.Helper()
+
+	var lwq waiter.Queue
+	l, err := m.server.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &lwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	m.eps = append(m.eps, l)
+	if err := l.Bind(tcpip.FullAddress{Port: mptcpPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := l.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	var cwq waiter.Queue
+	c, err := m.client.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &cwq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	m.eps = append(m.eps, c)
+	we, ch := waiter.NewChannelEntry(nil)
+	cwq.EventRegister(&we, waiter.EventOut)
+	defer cwq.EventUnregister(&we)
+	if err := c.Connect(tcpip.FullAddress{Addr: mptcpServerAddrs[0], Port: mptcpPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	select {
+	case <-ch:
+		if err := c.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the connection")
+	}
+
+	lwe, lch := waiter.NewChannelEntry(nil)
+	lwq.EventRegister(&lwe, waiter.EventIn)
+	defer lwq.EventUnregister(&lwe)
+	s, wq, err := l.Accept()
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-lch:
+			s, wq, err = l.Accept()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the connection to be accepted")
+		}
+	}
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	m.eps = append(m.eps, s)
+	return c, s, wq
+}
+
+// addSubflow adds a subflow over the second link to the connection of client,
+// and waits until it's established on both ends.
+func (m *mptcpTest) addSubflow(client, server tcpip.Endpoint) {
+	t := m.t
+	t.Helper()
+	if err := tcp.AddSubflow(client, mptcpClientAddrs[1], tcpip.FullAddress{Addr: mptcpServerAddrs[1], Port: mptcpPort}); err != nil {
+		t.Fatalf("AddSubflow failed: %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); tcp.Subflows(client) != 2 || tcp.Subflows(server) != 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d client and %d server subflows, want 2", tcp.Subflows(client), tcp.Subflows(server))
+		}
+	}
+}
+
+// readAll reads n bytes from ep.
+func readAll(t *testing.T, ep tcpip.Endpoint, wq *waiter.Queue, n int) []byte {
+	t.Helper()
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	var b []byte
+	for len(b) < n {
+		v, _, err := ep.Read(nil)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-ch:
+				continue
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for data, got %d bytes, want %d", len(b), n)
+			}
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		b = append(b, v...)
+	}
+	return b
+}
+
+func TestMPTCPCapable(t *testing.T) {
+	m := newMPTCPTest(t, true)
+	defer m.cleanup()
+	c, s, wq := m.connect()
+	links := m.links
+
+	// Both keys are exchanged by the handshake.
+	syn := mptcpOption(links[0].waitFor(t, 0, func(s header.TCP) bool { return s.Flags() == header.TCPFlagSyn }))
+	synAck := mptcpOption(links[0].waitFor(t, 1, func(s header.TCP) bool { return s.Flags() == header.TCPFlagSyn|header.TCPFlagAck }))
+	ack := mptcpOption(links[0].waitFor(t, 0, func(s header.TCP) bool { return mptcpOption(s).HasReceiverKey }))
+	if !syn.Present || syn.Subtype != header.MPTCPSubtypeCapable {
+		t.Fatalf("got SYN option %+v, want MP_CAPABLE", syn)
+	}
+	if !synAck.Present || synAck.Subtype != header.MPTCPSubtypeCapable {
+		t.Fatalf("got SYN-ACK option %+v, want MP_CAPABLE", synAck)
+	}
+	if ack.SenderKey != syn.SenderKey || ack.ReceiverKey != synAck.SenderKey {
+		t.Errorf("got keys %d and %d in the ACK, want %d and %d", ack.SenderKey, ack.ReceiverKey, syn.SenderKey, synAck.SenderKey)
+	}
+	if got, want := tcp.Subflows(c), 1; got != want {
+		t.Errorf("got Subflows(client) = %d, want %d", got, want)
+	}
+	if got, want := tcp.Subflows(s), 1; got != want {
+		t.Errorf("got Subflows(server) = %d, want %d", got, want)
+	}
+
+	// Data is mapped to the data sequence space.
+	data := []byte("multipath")
+	if _, err := c.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := readAll(t, s, wq, len(data)); !bytes.Equal(got, data) {
+		t.Fatalf("got %q, want %q", got, data)
+	}
+	seg := links[0].waitFor(t, 0, func(s header.TCP) bool { return len(s.Payload()) > 0 })
+	if dss := mptcpOption(seg); !dss.HasMapping || dss.SubflowSeq != 1 || int(dss.DataLen) != len(data) {
+		t.Errorf("got DSS option %+v, want the mapping of %d bytes at subflow sequence number 1", dss, len(data))
+	}
+}
+
+func TestMPTCPFallback(t *testing.T) {
+	m := newMPTCPTest(t, false)
+	defer m.cleanup()
+	c, s, wq := m.connect()
+
+	if got := tcp.Subflows(c); got != 0 {
+		t.Errorf("got Subflows(client) = %d, want 0", got)
+	}
+	if err := tcp.AddSubflow(c, mptcpClientAddrs[1], tcpip.FullAddress{Addr: mptcpServerAddrs[1], Port: mptcpPort}); err != tcpip.ErrInvalidEndpointState {
+		t.Errorf("got AddSubflow(...) = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+
+	data := []byte("singlepath")
+	if _, err := c.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := readAll(t, s, wq, len(data)); !bytes.Equal(got, data) {
+		t.Fatalf("got %q, want %q", got, data)
+	}
+}
+
+func TestMPTCPJoin(t *testing.T) {
+	m := newMPTCPTest(t, true)
+	defer m.cleanup()
+	c, s, _ := m.connect()
+	m.addSubflow(c, s)
+	links := m.links
+
+	synAck := mptcpOption(links[0].waitFor(t, 1, func(s header.TCP) bool { return s.Flags() == header.TCPFlagSyn|header.TCPFlagAck }))
+	syn := mptcpOption(links[1].waitFor(t, 0, func(s header.TCP) bool { return s.Flags() == header.TCPFlagSyn }))
+	if !syn.Present || syn.Subtype != header.MPTCPSubtypeJoin {
+		t.Fatalf("got SYN option %+v, want MP_JOIN", syn)
+	}
+	// The token is derived from the key of the server.
+	var key [8]byte
+	binary.BigEndian.PutUint64(key[:], synAck.SenderKey)
+	digest := sha1.Sum(key[:])
+	if token := binary.BigEndian.Uint32(digest[:]); syn.Token != token {
+		t.Errorf("got token %d, want %d", syn.Token, token)
+	}
+
+	// There is room for a single additional subflow.
+	if err := tcp.AddSubflow(c, mptcpClientAddrs[1], tcpip.FullAddress{Addr: mptcpServerAddrs[1], Port: mptcpPort}); err != tcpip.ErrAlreadyConnected {
+		t.Errorf("got AddSubflow(...) = %v, want %v", err, tcpip.ErrAlreadyConnected)
+	}
+}
+
+func TestMPTCPReassembly(t *testing.T) {
+	m := newMPTCPTest(t, true)
+	defer m.cleanup()
+	c, s, wq := m.connect()
+	m.addSubflow(c, s)
+	links := m.links
+
+	// The first write goes over the master subflow, which is held back, and
+	// the second over the additional one. Writes are larger than a segment
+	// so that they are split.
+	a := bytes.Repeat([]byte("a"), 3000)
+	b := bytes.Repeat([]byte("b"), 3000)
+	links[0].hold()
+	for _, data := range [][]byte{a, b} {
+		if _, err := c.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	// Wait for the data sent over the additional subflow to be acked, and
+	// check that it isn't readable before the data ahead of it.
+	last := links[1].waitFor(t, 0, func(s header.TCP) bool { return s.Flags()&header.TCPFlagPsh != 0 })
+	end := last.SequenceNumber() + uint32(len(last.Payload()))
+	links[1].waitFor(t, 1, func(s header.TCP) bool { return s.AckNumber() == end })
+	if v, _, err := s.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got Read() = %q, %v, want %v", v, err, tcpip.ErrWouldBlock)
+	}
+
+	links[0].release()
+	want := append(append([]byte(nil), a...), b...)
+	if got := readAll(t, s, wq, len(want)); !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Each subflow carried the data written to it, mapped to consecutive
+	// data sequence numbers.
+	for i, data := range [][]byte{a, b} {
+		seg := links[i].waitFor(t, 0, func(s header.TCP) bool { return len(s.Payload()) > 0 })
+		if p := seg.Payload(); p[0] != data[0] {
+			t.Errorf("got data %q on link %d, want %q", p[0], i, data[0])
+		}
+	}
+	first := mptcpOption(links[0].waitFor(t, 0, func(s header.TCP) bool { return len(s.Payload()) > 0 }))
+	second := mptcpOption(links[1].waitFor(t, 0, func(s header.TCP) bool { return len(s.Payload()) > 0 }))
+	if got, want := second.DataSeq, first.DataSeq+uint64(len(a)); got != want {
+		t.Errorf("got data sequence number %d on the second subflow, want %d", got, want)
+	}
+}
@@ -42,6 +42,45 @@ const (
 // protocol. See: https://tools.ietf.org/html/rfc2018.
 type SACKEnabled bool
 
+// TailLossProbeEnabled option can be used to enable tail loss probes, which
+// retransmit the last segment sent when no ack arrives within about two
+// round-trip times, so that the loss of the last segments of a flow is
+// recovered from by fast retransmit instead of a retransmission timeout. See:
+// https://tools.ietf.org/html/rfc8985#section-7.
+type TailLossProbeEnabled bool
+
+// FRTOEnabled option can be used to enable Forward RTO-Recovery (F-RTO), which
+// sends new data after a retransmission timeout instead of retransmitting the
+// whole window, and tells from the acks that follow whether the timeout was
+// spurious, i.e., caused by delayed rather than lost segments or acks. See:
+// https://tools.ietf.org/html/rfc5682.
+type FRTOEnabled bool
+
+// MPTCPEnabled option can be used to enable the experimental support of
+// Multipath TCP, which lets a connection carry its data over an additional
+// subflow, e.g., over another interface. See: https://tools.ietf.org/html/rfc6824
+// and AddSubflow.
+type MPTCPEnabled bool
+
+// AcceptQueueOverflowOption sets what listening endpoints do with the
+// connections whose handshake is completed by the peer while their accept
+// queue is full.
+type AcceptQueueOverflowOption int
+
+const (
+	// AcceptQueueOverflowWait completes the handshake, and holds the new
+	// connection until the accept queue has room for it. It's the default.
+	AcceptQueueOverflowWait AcceptQueueOverflowOption = iota
+
+	// AcceptQueueOverflowDrop drops the segment completing the handshake,
+	// so that the peer retransmits it, maybe once the accept queue has
+	// room.
+	AcceptQueueOverflowDrop
+
+	// AcceptQueueOverflowReset resets the connection.
+	AcceptQueueOverflowReset
+)
+
 // SendBufferSizeOption allows the default, min and max send buffer sizes for
 // TCP endpoints to be queried or configured.
 type SendBufferSizeOption struct {
@@ -61,8 +100,18 @@ type ReceiveBufferSizeOption struct {
 type protocol struct {
 	mu             sync.Mutex
 	sackEnabled    bool
+	tlpEnabled     bool
+	frtoEnabled    bool
+	mptcpEnabled   bool
+	acceptOverflow AcceptQueueOverflowOption
 	sendBufferSize SendBufferSizeOption
 	recvBufferSize ReceiveBufferSizeOption
+
+	// mptcpConns holds the Multipath TCP connections by local token, so
+	// that the subflows joining them can be matched. It's protected by
+	// mptcpMu.
+	mptcpMu    sync.Mutex
+	mptcpConns map[uint32]*mptcpConn
 }
 
 // Number returns the tcp protocol number.
@@ -133,6 +182,33 @@ func (p *protocol) SetOption(option interface{}) *tcpip.Error {
 		p.mu.Unlock()
 		return nil
 
+	case TailLossProbeEnabled:
+		p.mu.Lock()
+		p.tlpEnabled = bool(v)
+		p.mu.Unlock()
+		return nil
+
+	case FRTOEnabled:
+		p.mu.Lock()
+		p.frtoEnabled = bool(v)
+		p.mu.Unlock()
+		return nil
+
+	case MPTCPEnabled:
+		p.mu.Lock()
+		p.mptcpEnabled = bool(v)
+		p.mu.Unlock()
+		return nil
+
+	case AcceptQueueOverflowOption:
+		if v < AcceptQueueOverflowWait || v > AcceptQueueOverflowReset {
+			return tcpip.ErrInvalidOptionValue
+		}
+		p.mu.Lock()
+		p.acceptOverflow = v
+		p.mu.Unlock()
+		return nil
+
 	case SendBufferSizeOption:
 		if v.Min <= 0 || v.Default < v.Min || v.Default > v.Max {
 			return tcpip.ErrInvalidOptionValue
@@ -165,6 +241,30 @@ func (p *protocol) Option(option interface{}) *tcpip.Error {
 		p.mu.Unlock()
 		return nil
 
+	case *TailLossProbeEnabled:
+		p.mu.Lock()
+		*v = TailLossProbeEnabled(p.tlpEnabled)
+		p.mu.Unlock()
+		return nil
+
+	case *FRTOEnabled:
+		p.mu.Lock()
+		*v = FRTOEnabled(p.frtoEnabled)
+		p.mu.Unlock()
+		return nil
+
+	case *MPTCPEnabled:
+		p.mu.Lock()
+		*v = MPTCPEnabled(p.mptcpEnabled)
+		p.mu.Unlock()
+		return nil
+
+	case *AcceptQueueOverflowOption:
+		p.mu.Lock()
+		*v = p.acceptOverflow
+		p.mu.Unlock()
+		return nil
+
 	case *SendBufferSizeOption:
 		p.mu.Lock()
 		*v = p.sendBufferSize
@@ -187,6 +287,7 @@ func init() {
 		return &protocol{
 			sendBufferSize: SendBufferSizeOption{minBufferSize, DefaultBufferSize, maxBufferSize},
 			recvBufferSize: ReceiveBufferSizeOption{minBufferSize, DefaultBufferSize, maxBufferSize},
+			mptcpConns:     make(map[uint32]*mptcpConn),
 		}
 	})
 }
@@ -6,10 +6,24 @@ package tcp
 
 import (
 	"container/heap"
+	"time"
 
+	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip/seqnum"
 )
 
+const (
+	// delayedAckTimeout is the longest time the acknowledgement of received
+	// data is delayed for when delayed ACKs are enabled. RFC 1122 section
+	// 4.2.3.2 requires it to be less than 0.5 seconds.
+	delayedAckTimeout = 200 * time.Millisecond
+
+	// maxDelayedAckSegments is the number of segments received after which
+	// an acknowledgement is sent even if delayed ACKs are enabled. RFC 1122
+	// section 4.2.3.2 requires an ACK for at least every second segment.
+	maxDelayedAckSegments = 2
+)
+
 // receiver holds the state necessary to receive TCP segments and turn them
 // into a stream of bytes.
 type receiver struct {
@@ -27,21 +41,36 @@ type receiver struct {
 
 	rcvWndScale uint8
 
+	// mss is the maximum segment size the peer sends, which bounds the
+	// window update threshold.
+	mss int
+
 	closed bool
 
 	pendingRcvdSegments segmentHeap
 	pendingBufUsed      seqnum.Size
 	pendingBufSize      seqnum.Size
+
+	// unackedSegments is the number of segments carrying data that were
+	// consumed since the last acknowledgement was sent. When delayed ACKs
+	// are enabled, ackTimer is enabled while an acknowledgement is being
+	// delayed, and asserts ackWaker once it must be sent.
+	unackedSegments int
+	ackTimer        timer
+	ackWaker        sleep.Waker
 }
 
 func newReceiver(ep *endpoint, irs seqnum.Value, rcvWnd seqnum.Size, rcvWndScale uint8) *receiver {
-	return &receiver{
+	r := &receiver{
 		ep:             ep,
 		rcvNxt:         irs + 1,
 		rcvAcc:         irs.Add(rcvWnd + 1),
 		rcvWndScale:    rcvWndScale,
+		mss:            ep.snd.mss(),
 		pendingBufSize: rcvWnd,
 	}
+	r.ackTimer.init(&ep.timers, &r.ackWaker)
+	return r
 }
 
 // acceptable checks if the segment sequence number range is acceptable
@@ -60,18 +89,21 @@ func (r *receiver) acceptable(segSeq seqnum.Value, segLen seqnum.Size) bool {
 // segments to send.
 func (r *receiver) getSendParams() (rcvNxt seqnum.Value, rcvWnd seqnum.Size) {
 	// Calculate the window size based on the current buffer size.
+	// The window is only grown once it can grow by a significant amount,
+	// to avoid the Silly Window Syndrome as described in RFC 1122 section
+	// 4.2.3.3.
 	n := r.ep.receiveBufferAvailable()
 	acc := r.rcvNxt.Add(seqnum.Size(n))
-	if r.rcvAcc.LessThan(acc) {
+	if r.rcvAcc.LessThan(acc) && int(r.rcvAcc.Size(acc)) >= windowUpdateThreshold(r.ep.receiveBufferSize(), r.mss) {
 		r.rcvAcc = acc
 	}
 
 	return r.rcvNxt, r.rcvNxt.Size(r.rcvAcc) >> r.rcvWndScale
 }
 
-// nonZeroWindow is called when the receive window grows from zero to nonzero;
-// in such cases we may need to send an ack to indicate to our peer that it can
-// resume sending data.
+// nonZeroWindow is called when enough of the receive buffer is freed up for
+// the receive window to grow from zero to nonzero; in such cases we may need to
+// send an ack to indicate to our peer that it can resume sending data.
 func (r *receiver) nonZeroWindow() {
 	if (r.rcvAcc-r.rcvNxt)>>r.rcvWndScale != 0 {
 		// We never got around to announcing a zero window size, so we
@@ -83,6 +115,20 @@ func (r *receiver) nonZeroWindow() {
 	r.ep.snd.sendAck()
 }
 
+// windowUpdateThreshold returns the amount by which the receive window must be
+// able to grow before it is grown: the smaller of one maximum-sized segment
+// and half the receive buffer.
+func windowUpdateThreshold(bufSize, mss int) int {
+	t := bufSize / 2
+	if mss < t {
+		t = mss
+	}
+	if t < 1 {
+		t = 1
+	}
+	return t
+}
+
 // consumeSegment attempts to consume a segment that was received by r. The
 // segment may have just been received or may have been received earlier but
 // wasn't ready to be consumed then.
@@ -106,20 +152,30 @@ func (r *receiver) consumeSegment(s *segment, segSeq seqnum.Value, segLen seqnum
 			s.sequenceNumber.UpdateForward(diff)
 			s.data.TrimFront(int(diff))
 		}
+	} else if segSeq != r.rcvNxt {
+		return false
+	}
+
+	r.consumeNextSegment(s, segLen)
+	return true
+}
 
+// consumeNextSegment consumes a segment that starts at rcvNxt.
+func (r *receiver) consumeNextSegment(s *segment, segLen seqnum.Size) {
+	if segLen > 0 {
 		// Move segment to ready-to-deliver list. Wakeup any waiters.
 		r.ep.readyToRead(s)
-
-	} else if segSeq != r.rcvNxt {
-		return false
+		r.unackedSegments++
 	}
 
 	// Update the segment that we're expecting to consume.
-	r.rcvNxt = segSeq.Add(segLen)
+	r.rcvNxt.UpdateForward(segLen)
 
 	// Trim SACK Blocks to remove any SACK information that covers
 	// sequence numbers that have been consumed.
-	TrimSACKBlockList(&r.ep.sack, r.rcvNxt)
+	if r.ep.sack.NumBlocks != 0 {
+		TrimSACKBlockList(&r.ep.sack, r.rcvNxt)
+	}
 
 	if s.flagIsSet(flagFin) {
 		r.rcvNxt++
@@ -144,8 +200,6 @@ func (r *receiver) consumeSegment(s *segment, segSeq seqnum.Value, segLen seqnum
 		}
 		r.pendingRcvdSegments = r.pendingRcvdSegments[:first]
 	}
-
-	return true
 }
 
 // handleRcvdSegment handles TCP segments directed at the connection managed by
@@ -160,6 +214,15 @@ func (r *receiver) handleRcvdSegment(s *segment) {
 	segLen := seqnum.Size(s.data.Size())
 	segSeq := s.sequenceNumber
 
+	// Fast path for the common case of the segment we're expecting when
+	// there is no out-of-order data: it's acceptable unless it carries data
+	// while the window is closed, and it can be consumed without checking
+	// whether it fills a gap.
+	if segSeq == r.rcvNxt && r.pendingRcvdSegments.Len() == 0 && (segLen == 0 || r.rcvNxt != r.rcvAcc) {
+		r.consumeNextSegment(s, segLen)
+		return
+	}
+
 	// If the sequence number range is outside the acceptable range, just
 	// send an ACK. This is according to RFC 793, page 37.
 	if !r.acceptable(segSeq, segLen) {
@@ -206,3 +269,43 @@ func (r *receiver) handleRcvdSegment(s *segment) {
 		s.decRef()
 	}
 }
+
+// sendAckIfNeeded acknowledges the segments consumed so far, unless it's
+// already been done, e.g., by a segment carrying data. It's called once a
+// batch of received segments has been handled.
+//
+// When delayed ACKs are enabled, the acknowledgement is only sent immediately
+// once maxDelayedAckSegments segments are left unacknowledged, or if quickack
+// was requested. Otherwise ackTimer is enabled so that it's sent later.
+func (r *receiver) sendAckIfNeeded() {
+	if r.rcvNxt == r.ep.snd.maxSentAck {
+		r.unackedSegments = 0
+		r.ackTimer.disable()
+		return
+	}
+
+	quickAck := r.ep.takeQuickAck()
+	if r.ep.delayedAckEnabled() && !quickAck && r.unackedSegments < maxDelayedAckSegments {
+		if !r.ackTimer.enabled() {
+			r.ackTimer.enable(delayedAckTimeout)
+		}
+		return
+	}
+
+	r.ep.snd.sendAck()
+	r.unackedSegments = 0
+	r.ackTimer.disable()
+}
+
+// ackTimerExpired is called when ackWaker is asserted. It sends the delayed
+// acknowledgement, if it hasn't been sent already.
+func (r *receiver) ackTimerExpired() {
+	if !r.ackTimer.checkExpiration() {
+		return
+	}
+
+	if r.rcvNxt != r.ep.snd.maxSentAck {
+		r.ep.snd.sendAck()
+	}
+	r.unackedSegments = 0
+}
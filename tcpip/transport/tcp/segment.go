@@ -5,6 +5,7 @@
 package tcp
 
 import (
+	"sync"
 	"sync/atomic"
 
 	"github.com/google/netstack/tcpip/buffer"
@@ -25,7 +26,12 @@ const (
 
 // segment represents a TCP segment. It holds the payload and parsed TCP segment
 // information, and can be added to intrusive lists.
-// segment is mostly immutable, the only field allowed to change is viewToDeliver.
+// segment is mostly immutable, the only field allowed to change is viewToDeliver,
+// along with the view it designates, which is trimmed as it's partially read.
+//
+// Segments are reference counted and recycled once their last reference is
+// released, so a segment must not be used after calling decRef unless another
+// reference to it is held.
 type segment struct {
 	segmentEntry
 	refCnt int32
@@ -37,49 +43,84 @@ type segment struct {
 	views [8]buffer.View
 	// viewToDeliver keeps track of the next View that should be
 	// delivered by the Read endpoint.
-	viewToDeliver  int
+	viewToDeliver int
+	// rcvMem is the memory accounted for the segment while it's queued to
+	// be read, see memSize.
+	rcvMem         int
 	sequenceNumber seqnum.Value
 	ackNumber      seqnum.Value
 	flags          uint8
 	window         seqnum.Size
 
+	// push is set on outgoing segments whose last byte was written with
+	// the Push option, so that it's sent with the PSH flag.
+	push bool
+
+	// dataSeq is the data sequence number of outgoing segments written to
+	// the subflows of a Multipath TCP connection.
+	dataSeq uint64
+
 	// parsedOptions stores the parsed values from the options in the segment.
 	parsedOptions header.TCPOptions
 	options       []byte
+
+	// sackBlocks holds the SACK blocks of parsedOptions.
+	sackBlocks [header.TCPMaxSACKBlocks]header.SACKBlock
 }
 
-func newSegment(r *stack.Route, id stack.TransportEndpointID, vv *buffer.VectorisedView) *segment {
-	s := &segment{
-		refCnt: 1,
-		id:     id,
-		route:  r.Clone(),
+// segmentPool recycles the segments of all the endpoints of the protocol, so
+// that receiving and sending data doesn't allocate one per packet.
+var segmentPool = sync.Pool{
+	New: func() interface{} {
+		return &segment{}
+	},
+}
+
+// allocSegment returns a zeroed segment holding a single reference.
+func allocSegment() *segment {
+	s := segmentPool.Get().(*segment)
+	s.refCnt = 1
+	return s
+}
+
+// memSize returns the memory kept alive by the data of s: the memory it was
+// received into, which is much larger than the data when small segments are
+// received into recycled link buffers sized for the MTU.
+func (s *segment) memSize() int {
+	if b := s.data.Buffer(); b != nil && b.Size() > s.data.Size() {
+		return b.Size()
 	}
+	return s.data.Size()
+}
+
+func newSegment(r *stack.Route, id stack.TransportEndpointID, vv *buffer.VectorisedView) *segment {
+	s := allocSegment()
+	s.id = id
+	s.route = r.Clone()
 	s.data = vv.Clone(s.views[:])
 	return s
 }
 
 func newSegmentFromView(r *stack.Route, id stack.TransportEndpointID, v buffer.View) *segment {
-	s := &segment{
-		refCnt: 1,
-		id:     id,
-		route:  r.Clone(),
-	}
+	s := allocSegment()
+	s.id = id
+	s.route = r.Clone()
 	s.views[0] = v
 	s.data = buffer.NewVectorisedView(len(v), s.views[:1])
 	return s
 }
 
 func (s *segment) clone() *segment {
-	t := &segment{
-		refCnt:         1,
-		id:             s.id,
-		sequenceNumber: s.sequenceNumber,
-		ackNumber:      s.ackNumber,
-		flags:          s.flags,
-		window:         s.window,
-		route:          s.route.Clone(),
-		viewToDeliver:  s.viewToDeliver,
-	}
+	t := allocSegment()
+	t.id = s.id
+	t.sequenceNumber = s.sequenceNumber
+	t.ackNumber = s.ackNumber
+	t.flags = s.flags
+	t.window = s.window
+	t.push = s.push
+	t.dataSeq = s.dataSeq
+	t.route = s.route.Clone()
+	t.viewToDeliver = s.viewToDeliver
 	t.data = s.data.Clone(t.views[:])
 	return t
 }
@@ -88,9 +129,19 @@ func (s *segment) flagIsSet(flag uint8) bool {
 	return (s.flags & flag) != 0
 }
 
+// decRef releases a reference to s, recycling it once it's the last one.
 func (s *segment) decRef() {
-	if atomic.AddInt32(&s.refCnt, -1) == 0 {
+	switch refs := atomic.AddInt32(&s.refCnt, -1); {
+	case refs == 0:
 		s.route.Release()
+		s.data.Release()
+
+		// Clear everything, views included, so that the recycled
+		// segment doesn't keep the memory of this one alive.
+		*s = segment{}
+		segmentPool.Put(s)
+	case refs < 0:
+		panic("segment released too many times")
 	}
 }
 
@@ -133,7 +184,8 @@ func (s *segment) parse() bool {
 	}
 
 	s.options = []byte(h[header.TCPMinimumSize:offset])
-	s.parsedOptions = header.ParseTCPOptions(s.options)
+	s.parsedOptions.SACKBlocks = s.sackBlocks[:0]
+	header.ParseTCPOptionsInto(s.options, &s.parsedOptions)
 	s.data.TrimFront(offset)
 
 	s.sequenceNumber = seqnum.Value(h.SequenceNumber())
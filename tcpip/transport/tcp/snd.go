@@ -6,6 +6,7 @@ package tcp
 
 import (
 	"math"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/netstack/sleep"
@@ -19,8 +20,21 @@ const (
 	// minRTO is the minimum allowed value for the retransmit timeout.
 	minRTO = 200 * time.Millisecond
 
+	// maxRTO is the retransmit timeout past which the connection is given
+	// up on, unless a user timeout is set.
+	maxRTO = 60 * time.Second
+
+	// minPTO is the minimum allowed value for the probe timeout after
+	// which a tail loss probe is sent.
+	minPTO = 10 * time.Millisecond
+
 	// InitialCwnd is the initial congestion window.
 	InitialCwnd = 10
+
+	// swsOverrideTimeout is how long data held back to avoid the Silly
+	// Window Syndrome waits for the send window to open before being sent
+	// anyway, see RFC 1122 section 4.2.3.4.
+	swsOverrideTimeout = 200 * time.Millisecond
 )
 
 // sender holds the state necessary to send TCP segments.
@@ -30,6 +44,12 @@ type sender struct {
 	// lastSendTime is the timestamp when the last packet was sent.
 	lastSendTime time.Time
 
+	// unackedSince is the time, as returned by the stack's clock, since
+	// which outstanding data hasn't been acknowledged. It is only
+	// meaningful while sndUna != sndNxt, and is used to enforce the user
+	// timeout.
+	unackedSince int64
+
 	// dupAckCount is the number of duplicated acks received. It is used for
 	// fast retransmit.
 	dupAckCount int
@@ -56,6 +76,9 @@ type sender struct {
 	// sndWnd is the send window size.
 	sndWnd seqnum.Size
 
+	// maxSndWnd is the largest send window the peer has offered so far.
+	maxSndWnd seqnum.Size
+
 	// sndUna is the next unacknowledged sequence number.
 	sndUna seqnum.Value
 
@@ -87,6 +110,32 @@ type sender struct {
 	rto        time.Duration
 	srttInited bool
 
+	// tlpEnabled is set if tail loss probes are in use, see
+	// TailLossProbeEnabled.
+	tlpEnabled bool
+
+	// probePending is set when resendTimer is enabled to send a tail loss
+	// probe rather than for a retransmission timeout.
+	probePending bool
+
+	// swsPending is set when resendTimer is enabled to send data held back
+	// to avoid the Silly Window Syndrome, rather than for a retransmission
+	// timeout. swsOverride is set while that data is sent.
+	swsPending  bool
+	swsOverride bool
+
+	// tlpRecovery is set after a tail loss probe or a retransmission
+	// timeout, until the peer acknowledges the data sent up to tlpEnd. No
+	// probe is sent meanwhile.
+	tlpRecovery bool
+	tlpEnd      seqnum.Value
+
+	// frtoEnabled is set if F-RTO is in use, see FRTOEnabled.
+	frtoEnabled bool
+
+	// frto holds the state of F-RTO after a retransmission timeout.
+	frto frto
+
 	// maxPayloadSize is the maximum size of the payload of a given segment.
 	// It is initialized on demand.
 	maxPayloadSize int
@@ -97,6 +146,13 @@ type sender struct {
 
 	// maxSentAck is the maxium acknowledgement actually sent.
 	maxSentAck seqnum.Value
+
+	// sackBlocks holds the SACK blocks reported by the peer in the most
+	// recently received ack, and numSACKBlocks is the number of valid
+	// entries. They are used to avoid coalescing segments across SACKed
+	// ranges when retransmitting.
+	sackBlocks    [header.TCPMaxSACKBlocks]header.SACKBlock
+	numSACKBlocks int
 }
 
 // fastRecovery holds information related to fast recovery from a packet loss.
@@ -117,18 +173,41 @@ type fastRecovery struct {
 	maxCwnd int
 }
 
+// frto holds the state of Forward RTO-Recovery (F-RTO), which detects spurious
+// retransmission timeouts as described in RFC 5682, section 2.1.
+type frto struct {
+	// step is the step of the algorithm that processes the next ack: 2
+	// for the first ack after the timeout, and 3 for the one after that.
+	// It is 0 when F-RTO isn't in progress, and the following fields are
+	// then meaningless.
+	step int
+
+	// recover is the sequence number following the highest one sent when
+	// the timeout expired.
+	recover seqnum.Value
+
+	// rtxEnd is the sequence number following the data retransmitted when
+	// the timeout expired.
+	rtxEnd seqnum.Value
+
+	// sndSsthresh is the slow-start threshold before the timeout, which
+	// is restored if the timeout turns out to be spurious.
+	sndSsthresh int
+}
+
 func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint16, sndWndScale int) *sender {
 	s := &sender{
 		ep:               ep,
 		sndCwnd:          InitialCwnd,
 		sndSsthresh:      math.MaxInt64,
 		sndWnd:           sndWnd,
+		maxSndWnd:        sndWnd,
 		sndUna:           iss + 1,
 		sndNxt:           iss + 1,
 		sndNxtList:       iss + 1,
 		rto:              1 * time.Second,
 		rttMeasureSeqNum: iss + 1,
-		lastSendTime:     time.Now(),
+		lastSendTime:     ep.now(),
 		maxPayloadSize:   int(mss),
 		maxSentAck:       irs + 1,
 		fr: fastRecovery{
@@ -145,7 +224,17 @@ func newSender(ep *endpoint, iss, irs seqnum.Value, sndWnd seqnum.Size, mss uint
 
 	s.updateMaxPayloadSize(int(ep.route.MTU()), 0)
 
-	s.resendTimer.init(&s.resendWaker)
+	s.resendTimer.init(&ep.timers, &s.resendWaker)
+
+	var tlp TailLossProbeEnabled
+	if err := ep.stack.TransportProtocolOption(ProtocolNumber, &tlp); err == nil {
+		s.tlpEnabled = bool(tlp)
+	}
+
+	var frtoEnabled FRTOEnabled
+	if err := ep.stack.TransportProtocolOption(ProtocolNumber, &frtoEnabled); err == nil {
+		s.frtoEnabled = bool(frtoEnabled)
+	}
 
 	return s
 }
@@ -159,7 +248,11 @@ func (s *sender) updateMaxPayloadSize(mtu, count int) {
 
 	// Calculate the maximum option size.
 	var maxSackBlocks [header.TCPMaxSACKBlocks]header.SACKBlock
-	options := s.ep.makeOptions(maxSackBlocks[:])
+	var mapping *mptcpMapping
+	if s.ep.mptcp != nil {
+		mapping = &mptcpMapping{}
+	}
+	options := s.ep.makeOptions(maxSackBlocks[:], s.ep.md5Key(s.ep.id.RemoteAddress) != nil, mapping)
 	m -= len(options)
 	putOptions(options)
 
@@ -202,9 +295,18 @@ func (s *sender) updateMaxPayloadSize(mtu, count int) {
 	s.sendData()
 }
 
+// mss returns the maximum size of the payload of the segments to send, which
+// is maxPayloadSize unless MaxSegOption sets a lower one.
+func (s *sender) mss() int {
+	if mss := int(atomic.LoadUint32(&s.ep.userMSS)); mss != 0 && mss < s.maxPayloadSize {
+		return mss
+	}
+	return s.maxPayloadSize
+}
+
 // sendAck sends an ACK segment.
 func (s *sender) sendAck() {
-	s.sendSegment(nil, flagAck, s.sndNxt)
+	s.sendSegment(nil, flagAck, s.sndNxt, nil)
 }
 
 // updateRTO updates the retransmit timeout when a new roud-trip time is
@@ -237,7 +339,8 @@ func (s *sender) resendSegment() {
 
 	// Resend the segment.
 	if seg := s.writeList.Front(); seg != nil {
-		s.sendSegment(&seg.data, seg.flags, seg.sequenceNumber)
+		s.ep.stack.MutableStats().TCP.Retransmits.Increment()
+		s.sendSegment(&seg.data, seg.flags, seg.sequenceNumber, s.ep.mptcpMapping(seg))
 	}
 }
 
@@ -261,14 +364,54 @@ func (s *sender) retransmitTimerExpired() bool {
 		return true
 	}
 
-	// Give up if we've waited more than a minute since the last resend.
-	if s.rto >= 60*time.Second {
+	if s.probePending {
+		s.sendProbe()
+		return true
+	}
+
+	if s.swsPending {
+		s.swsPending = false
+		s.swsOverride = true
+		s.sendData()
+		s.swsOverride = false
+		return true
+	}
+
+	// Give up if data has remained unacknowledged for longer than the user
+	// timeout, if set. Otherwise, give up if we've waited more than a
+	// minute since the last resend.
+	userTimeout := time.Duration(atomic.LoadInt64(&s.ep.userTimeout))
+	var remaining time.Duration
+	if userTimeout != 0 {
+		remaining = userTimeout - time.Duration(s.ep.stack.NowNanoseconds()-s.unackedSince)
+		if remaining <= 0 {
+			return false
+		}
+	} else if s.rto >= maxRTO {
 		return false
 	}
 
+	s.ep.stack.MutableStats().TCP.Timeouts.Increment()
+
 	// Set new timeout. The timer will be restarted by the call to sendData
 	// below.
 	s.rto *= 2
+	if userTimeout != 0 && s.rto > maxRTO {
+		s.rto = maxRTO
+	}
+
+	// Find out whether the timeout is spurious with F-RTO, unless it
+	// interrupted fast recovery, or the recovery from a previous timeout
+	// or tail loss probe.
+	if s.frtoEnabled && !s.fr.active && !s.tlpRecovery && s.frto.step == 0 {
+		s.frto = frto{
+			step:        2,
+			recover:     s.sndNxt,
+			sndSsthresh: s.sndSsthresh,
+		}
+	} else {
+		s.frto.step = 0
+	}
 
 	if s.fr.active {
 		// We were attempting fast recovery but were not successful.
@@ -282,13 +425,19 @@ func (s *sender) retransmitTimerExpired() bool {
 	// we were not in fast recovery.
 	s.fr.last = s.sndNxt - 1
 
+	// Don't probe until the data lost so far is recovered.
+	s.tlpRecovery = true
+	s.tlpEnd = s.sndNxt
+
 	// We lost a packet, so reduce ssthresh.
 	s.reduceSlowStartThreshold()
 
 	// Reduce the congestion window to 1, i.e., enter slow-start. Per
 	// RFC 5681, page 7, we must use 1 regardless of the value of the
-	// initial congestion window.
+	// initial congestion window. The duplicate acks received so far
+	// no longer allow limited transmit either.
 	s.sndCwnd = 1
+	s.dupAckCount = 0
 
 	// Mark the next segment to be sent as the first unacknowledged one and
 	// start sending again. Set the number of outstanding packets to 0 so
@@ -298,23 +447,119 @@ func (s *sender) retransmitTimerExpired() bool {
 	// the data we transmit.
 	s.outstanding = 0
 	s.writeNext = s.writeList.Front()
+	s.coalesceUnacked()
+	if seg := s.writeNext; seg != nil {
+		s.frto.rtxEnd = seg.sequenceNumber.Add(seg.logicalLen())
+	}
 	s.sendData()
 
+	// Don't wait past the user timeout to give up.
+	if userTimeout != 0 && remaining < s.rto {
+		s.resendTimer.enable(remaining)
+	}
+
 	return true
 }
 
+// coalesceUnacked merges consecutive small segments that have already been
+// sent but not yet acknowledged into segments of up to maxPayloadSize bytes,
+// so that fewer packets are needed to retransmit them. Segments are never
+// merged across the edge of a range that the peer has reported as SACKed.
+//
+// It is only called when all the unacknowledged data is to be retransmitted,
+// after a retransmission timeout. Fast retransmit resends only the first
+// unacknowledged segment, as the duplicate acks that trigger it show that the
+// segments after it were received; merging them in would resend them.
+func (s *sender) coalesceUnacked() {
+	for seg := s.writeList.Front(); seg != nil && s.isUnacked(seg); seg = seg.Next() {
+		for {
+			next := seg.Next()
+			if next == nil || !s.isUnacked(next) || next.flags&^flagPsh != seg.flags&^flagPsh {
+				break
+			}
+
+			size := seg.data.Size() + next.data.Size()
+			if size > s.mss() || s.sackEdgeWithin(seg.sequenceNumber, seg.sequenceNumber.Add(seqnum.Size(size))) {
+				break
+			}
+
+			v := buffer.NewView(size)
+			n := copy(v, seg.data.ToView())
+			copy(v[n:], next.data.ToView())
+			seg.views[0] = v
+			seg.data = buffer.NewVectorisedView(size, seg.views[:1])
+			seg.flags |= next.flags & flagPsh
+
+			s.writeList.Remove(next)
+			next.decRef()
+		}
+	}
+}
+
+// isUnacked returns true if seg is a data segment that has already been sent
+// at least once and hasn't been acknowledged yet.
+func (s *sender) isUnacked(seg *segment) bool {
+	// Segments that haven't been sent yet have no flags set, and FIN
+	// segments carry no data.
+	return seg.flags != 0 && seg.data.Size() != 0 && seg.sequenceNumber.LessThan(s.sndNxt)
+}
+
+// sackEdgeWithin returns true if one of the SACK blocks last reported by the
+// peer starts or ends strictly within [first, end), that is, if the range mixes
+// data the peer has and hasn't SACKed.
+func (s *sender) sackEdgeWithin(first, end seqnum.Value) bool {
+	for _, sb := range s.sackBlocks[:s.numSACKBlocks] {
+		if first.LessThan(sb.Start) && sb.Start.LessThan(end) {
+			return true
+		}
+		if first.LessThan(sb.End) && sb.End.LessThan(end) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCwnd decays the congestion window after the connection has been idle
+// for the given interval, per RFC 2861, section 3.1. An idle connection used
+// none of its window, so cwnd is halved once per retransmission timeout that
+// elapsed, down to the restart window RW = min(IW, cwnd) of RFC 5681, page 10.
+// ssthresh is first raised to 3/4 of cwnd so that slow start quickly brings
+// cwnd back to where it was once the connection is active again.
+func (s *sender) validateCwnd(idle time.Duration) {
+	rw := s.sndCwnd
+	if rw > InitialCwnd {
+		rw = InitialCwnd
+	}
+
+	if ssthresh := 3 * s.sndCwnd / 4; s.sndSsthresh < ssthresh {
+		s.sndSsthresh = ssthresh
+	}
+	for ; idle > s.rto && s.sndCwnd > rw; idle -= s.rto {
+		s.sndCwnd /= 2
+	}
+	if s.sndCwnd < rw {
+		s.sndCwnd = rw
+	}
+}
+
 // sendData sends new data segments. It is called when data becomes available or
 // when the send window opens up.
 func (s *sender) sendData() {
-	limit := s.maxPayloadSize
-
-	// Reduce the congestion window to min(IW, cwnd) per RFC 5681, page 10.
-	// "A TCP SHOULD set cwnd to no more than RW before beginning
-	// transmission if the TCP has not sent data in the interval exceeding
-	// the retrasmission timeout."
-	if !s.fr.active && time.Now().Sub(s.lastSendTime) > s.rto {
-		if s.sndCwnd > InitialCwnd {
-			s.sndCwnd = InitialCwnd
+	limit := s.mss()
+
+	// The data held back to avoid the Silly Window Syndrome is sent now if
+	// the window allows it, and held back again otherwise.
+	if s.swsPending {
+		s.swsPending = false
+		s.resendTimer.disable()
+	}
+
+	// Decay the congestion window of a connection that has been idle for
+	// longer than the retransmission timeout, as it no longer reflects the
+	// state of the network.
+	if !s.fr.active {
+		if idle := s.ep.now().Sub(s.lastSendTime); idle > s.rto {
+			s.validateCwnd(idle)
 		}
 	}
 
@@ -323,12 +568,12 @@ func (s *sender) sendData() {
 	// eventually.
 	var seg *segment
 	end := s.sndUna.Add(s.sndWnd)
-	for seg = s.writeNext; seg != nil && s.outstanding < s.sndCwnd; seg = seg.Next() {
+	for seg = s.writeNext; seg != nil && s.outstanding < s.cwndLimit(); seg = seg.Next() {
 		// We abuse the flags field to determine if we have already
 		// assigned a sequence number to this segment.
 		if seg.flags == 0 {
 			seg.sequenceNumber = s.sndNxt
-			seg.flags = flagAck | flagPsh
+			seg.flags = flagAck
 		}
 
 		var segEnd seqnum.Value
@@ -362,20 +607,44 @@ func (s *sender) sendData() {
 				available = limit
 			}
 
+			if s.avoidSWS(seg, available) {
+				// Wait for the window to open, but not forever
+				// if nothing is in flight to get it opened.
+				if s.sndUna == s.sndNxt {
+					s.swsPending = true
+					s.resendTimer.enable(swsOverrideTimeout)
+				}
+				break
+			}
+
 			if seg.data.Size() > available {
 				// Split this segment up.
 				nSeg := seg.clone()
 				nSeg.data.TrimFront(available)
 				nSeg.sequenceNumber.UpdateForward(seqnum.Size(available))
+				nSeg.dataSeq += uint64(available)
 				s.writeList.InsertAfter(seg, nSeg)
 				seg.data.CapLength(available)
+				seg.push = false
+			}
+
+			// Set PSH on segments that end a write that requested
+			// it, and on the last queued one.
+			if seg.push || seg.Next() == nil {
+				seg.flags |= flagPsh
 			}
 
 			s.outstanding++
 			segEnd = seg.sequenceNumber.Add(seqnum.Size(seg.data.Size()))
 		}
 
-		s.sendSegment(&seg.data, seg.flags, seg.sequenceNumber)
+		if s.sndUna == s.sndNxt {
+			// Nothing is outstanding yet, so this segment is the
+			// oldest unacknowledged one.
+			s.unackedSince = s.ep.stack.NowNanoseconds()
+		}
+
+		s.sendSegment(&seg.data, seg.flags, seg.sequenceNumber, s.ep.mptcpMapping(seg))
 
 		// Update sndNxt if we actually sent new data (as opposed to
 		// retransmitting some previously sent data).
@@ -388,6 +657,81 @@ func (s *sender) sendData() {
 	s.writeNext = seg
 
 	// Enable the timer if we have pending data and it's not enabled yet.
+	if !s.resendTimer.enabled() && s.sndUna != s.sndNxt {
+		s.enableResendTimer()
+	}
+}
+
+// avoidSWS returns whether seg should be held back rather than sent in a
+// segment of available bytes, to avoid the Silly Window Syndrome as described
+// in RFC 1122 section 4.2.3.4: data that doesn't fit in the send window is only
+// split to send a full-sized segment, or at least half the largest window the
+// peer has offered, unless the override timeout expired.
+func (s *sender) avoidSWS(seg *segment, available int) bool {
+	if s.swsOverride || seg.data.Size() <= available || available >= s.mss() {
+		return false
+	}
+	return seqnum.Size(available) < s.maxSndWnd/2
+}
+
+// enableResendTimer enables the resend timer to send a tail loss probe if one
+// is due, or else for a retransmission timeout.
+func (s *sender) enableResendTimer() {
+	if pto, ok := s.probeTimeout(); ok {
+		s.probePending = true
+		s.resendTimer.enable(pto)
+		return
+	}
+	s.probePending = false
+	s.resendTimer.enable(s.rto)
+}
+
+// probeTimeout returns the probe timeout (PTO) after which to send a tail loss
+// probe, as computed in RFC 8985 section 7.2, and whether a probe is due at
+// all, which is only the case if it would be sent before the retransmission
+// timeout.
+func (s *sender) probeTimeout() (time.Duration, bool) {
+	if !s.tlpEnabled || !s.srttInited || s.fr.active || s.tlpRecovery {
+		return 0, false
+	}
+
+	pto := 2 * s.srtt
+	if s.outstanding == 1 {
+		// The peer may delay the ack of a single segment.
+		pto += delayedAckTimeout
+	}
+	if pto < minPTO {
+		pto = minPTO
+	}
+	return pto, pto < s.rto
+}
+
+// sendProbe sends a tail loss probe, as described in RFC 8985 section 7.3: new
+// data if the windows allow it, or else the last segment sent again, so that
+// the peer acknowledges it and reveals the losses that precede it. The resend
+// timer is then enabled for a retransmission timeout.
+func (s *sender) sendProbe() {
+	s.ep.stack.MutableStats().TCP.TailLossProbes.Increment()
+	s.probePending = false
+	s.tlpRecovery = true
+
+	if s.canSendNewData() {
+		s.sendData()
+	} else {
+		seg := s.writeList.Back()
+		if s.writeNext != nil {
+			seg = s.writeNext.Prev()
+		}
+		if seg != nil {
+			// Don't use any segments we already sent to measure
+			// RTT, as in resendSegment.
+			s.rttMeasureSeqNum = s.sndNxt
+			s.ep.stack.MutableStats().TCP.Retransmits.Increment()
+			s.sendSegment(&seg.data, seg.flags, seg.sequenceNumber, s.ep.mptcpMapping(seg))
+		}
+	}
+	s.tlpEnd = s.sndNxt
+
 	if !s.resendTimer.enabled() && s.sndUna != s.sndNxt {
 		s.resendTimer.enable(s.rto)
 	}
@@ -398,9 +742,10 @@ func (s *sender) enterFastRecovery() {
 	s.reduceSlowStartThreshold()
 	// Save state to reflect we're now in fast recovery.
 	// See : https://tools.ietf.org/html/rfc5681#section-3.2 Step 3.
-	// We inflat the cwnd by 3 to account for the 3 packets which triggered
-	// the 3 duplicate ACKs and are now not in flight.
-	s.sndCwnd = s.sndSsthresh + 3
+	// We inflate the cwnd by the number of duplicate ACKs (normally 3, fewer
+	// on early retransmit) to account for the packets which triggered them
+	// and are now not in flight.
+	s.sndCwnd = s.sndSsthresh + s.dupAckCount
 	s.fr.first = s.sndUna
 	s.fr.last = s.sndNxt - 1
 	s.fr.maxCwnd = s.sndCwnd + s.outstanding
@@ -473,9 +818,9 @@ func (s *sender) checkDuplicateAck(seg *segment) bool {
 		return false
 	}
 
-	// Enter fast recovery when we reach 3 dups.
+	// Enter fast recovery when we reach the threshold of dups.
 	s.dupAckCount++
-	if s.dupAckCount != 3 {
+	if s.dupAckCount < s.dupAckThreshold() {
 		return false
 	}
 
@@ -493,6 +838,100 @@ func (s *sender) checkDuplicateAck(seg *segment) bool {
 	return true
 }
 
+// dupAckThreshold returns the number of duplicate acks that trigger a fast
+// retransmit. It is normally 3, but is lowered as described in RFC 5827
+// (early retransmit) when fewer than 4 segments are outstanding and no new data
+// can be sent, as 3 duplicates may then never arrive.
+func (s *sender) dupAckThreshold() int {
+	if s.outstanding < 2 || s.outstanding >= 4 || s.canSendNewData() {
+		return 3
+	}
+	return s.outstanding - 1
+}
+
+// cwndLimit returns the number of segments that may be outstanding. Besides the
+// congestion window, Limited Transmit (RFC 3042) allows a new segment to be
+// sent on each of the duplicate acks that precede a fast retransmit, without
+// reducing the window, so that the acks keep coming.
+func (s *sender) cwndLimit() int {
+	if s.fr.active {
+		return s.sndCwnd
+	}
+	return s.sndCwnd + s.dupAckCount
+}
+
+// canSendNewData returns whether there is data that has never been sent and
+// that the send and congestion windows allow to send.
+func (s *sender) canSendNewData() bool {
+	seg := s.writeNext
+	if seg == nil || seg.data.Size() == 0 || s.outstanding >= s.cwndLimit() {
+		return false
+	}
+	return s.sndNxt.LessThan(s.sndUna.Add(s.sndWnd))
+}
+
+// frtoAck processes an ack received while F-RTO is in progress, as described in
+// RFC 5682, section 2.1. advanced is set if the ack acknowledged new data, and
+// dup if it is a duplicate ack; other acks are ignored.
+func (s *sender) frtoAck(ack seqnum.Value, advanced, dup bool) {
+	if !advanced && !dup {
+		return
+	}
+
+	switch s.frto.step {
+	case 2:
+		// Step 2a: fall back to the conventional recovery, that
+		// retransmits the unacknowledged segments in slow start, if
+		// the ack is a duplicate, or acknowledges all the data sent
+		// before the timeout, or only part of the data retransmitted.
+		if dup || !ack.LessThan(s.frto.recover) || ack.LessThan(s.frto.rtxEnd) {
+			s.frto.step = 0
+			return
+		}
+
+		// Step 2b: send two new segments rather than retransmitting
+		// the unacknowledged ones, so that the next ack tells whether
+		// they were lost. Fall back to the conventional recovery if
+		// there's no new data to send.
+		seg := s.writeNext
+		for seg != nil && seg.flags != 0 && seg.sequenceNumber.LessThan(s.sndNxt) {
+			seg = seg.Next()
+		}
+		if seg == nil || seg.data.Size() == 0 || !s.sndNxt.LessThan(s.sndUna.Add(s.sndWnd)) {
+			s.frto.step = 0
+			return
+		}
+		s.writeNext = seg
+		s.sndCwnd = 2
+		s.outstanding = 0
+		s.frto.step = 3
+
+	case 3:
+		s.frto.step = 0
+		if dup {
+			// Step 3a: the segments sent before the timeout were
+			// lost. Retransmit them in slow start, with a congestion
+			// window of at most 3 segments.
+			if s.sndCwnd > 3 {
+				s.sndCwnd = 3
+			}
+			s.outstanding = 0
+			s.writeNext = s.writeList.Front()
+			s.coalesceUnacked()
+			return
+		}
+
+		// Step 3b: the ack covers data that was sent before the timeout
+		// and not retransmitted, so the timeout was spurious. Keep on
+		// sending new data, and restore the slow-start threshold so that
+		// slow start brings the congestion window back to where it was.
+		s.ep.stack.MutableStats().TCP.SpuriousTimeouts.Increment()
+		if s.sndSsthresh < s.frto.sndSsthresh {
+			s.sndSsthresh = s.frto.sndSsthresh
+		}
+	}
+}
+
 // updateCwnd updates the congestion window based on the number of packets that
 // were acknowledged.
 func (s *sender) updateCwnd(packetsAcked int) {
@@ -526,22 +965,35 @@ func (s *sender) updateCwnd(packetsAcked int) {
 func (s *sender) handleRcvdSegment(seg *segment) {
 	// Check if we can extract an RTT measurement from this ack.
 	if s.rttMeasureSeqNum.LessThan(seg.ackNumber) {
-		s.updateRTO(time.Now().Sub(s.rttMeasureTime))
+		s.updateRTO(s.ep.now().Sub(s.rttMeasureTime))
 		s.rttMeasureSeqNum = s.sndNxt
 	}
 
 	// Update Timestamp if required. See RFC7323, section-4.3.
 	s.ep.updateRecentTimestamp(seg.parsedOptions.TSVal, s.maxSentAck, seg.sequenceNumber)
 
+	// Remember which ranges the peer has selectively acknowledged.
+	if s.ep.sackPermitted {
+		s.numSACKBlocks = copy(s.sackBlocks[:], seg.parsedOptions.SACKBlocks)
+	}
+
+	// Tell whether the ack is a duplicate for F-RTO, before the send window
+	// is updated.
+	dup := seg.ackNumber == s.sndUna && seg.logicalLen() == 0 && s.sndWnd == seg.window && s.sndUna != s.sndNxt
+
 	// Count the duplicates and do the fast retransmit if needed.
 	rtx := s.checkDuplicateAck(seg)
 
 	// Stash away the current window size.
 	s.sndWnd = seg.window
+	if s.maxSndWnd < s.sndWnd {
+		s.maxSndWnd = s.sndWnd
+	}
 
 	// Ignore ack if it doesn't acknowledge any new data.
 	ack := seg.ackNumber
-	if (ack - 1).InRange(s.sndUna, s.sndNxt) {
+	advanced := (ack - 1).InRange(s.sndUna, s.sndNxt)
+	if advanced {
 		// When an ack is received we must reset the timer. We stop it
 		// here and it will be restarted later if needed.
 		s.resendTimer.disable()
@@ -550,6 +1002,13 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 		acked := s.sndUna.Size(ack)
 		s.sndUna = ack
 
+		// Probes may be sent again once the data sent up to the last
+		// probe or timeout is acknowledged.
+		if s.tlpRecovery && !ack.LessThan(s.tlpEnd) {
+			s.tlpRecovery = false
+		}
+		s.unackedSince = s.ep.stack.NowNanoseconds()
+
 		ackLeft := acked
 		originalOutstanding := s.outstanding
 		for ackLeft > 0 {
@@ -590,6 +1049,10 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 		}
 	}
 
+	if s.frto.step != 0 {
+		s.frtoAck(ack, advanced, dup)
+	}
+
 	// Now that we've popped all acknowledged data from the retransmit
 	// queue, retransmit if needed.
 	if rtx {
@@ -604,9 +1067,9 @@ func (s *sender) handleRcvdSegment(seg *segment) {
 }
 
 // sendSegment sends a new segment containing the given payload, flags and
-// sequence number.
-func (s *sender) sendSegment(data *buffer.VectorisedView, flags byte, seq seqnum.Value) *tcpip.Error {
-	s.lastSendTime = time.Now()
+// sequence number, along with the Multipath TCP mapping of the payload if any.
+func (s *sender) sendSegment(data *buffer.VectorisedView, flags byte, seq seqnum.Value, mapping *mptcpMapping) *tcpip.Error {
+	s.lastSendTime = s.ep.now()
 	if seq == s.rttMeasureSeqNum {
 		s.rttMeasureTime = s.lastSendTime
 	}
@@ -617,12 +1080,12 @@ func (s *sender) sendSegment(data *buffer.VectorisedView, flags byte, seq seqnum
 	s.maxSentAck = rcvNxt
 
 	if data == nil {
-		return s.ep.sendRaw(nil, flags, seq, rcvNxt, rcvWnd)
+		return s.ep.sendRaw(nil, flags, seq, rcvNxt, rcvWnd, nil)
 	}
 
 	if len(data.Views()) > 1 {
 		panic("send path does not support views with multiple buffers")
 	}
 
-	return s.ep.sendRaw(data.First(), flags, seq, rcvNxt, rcvWnd)
+	return s.ep.sendRaw(data.First(), flags, seq, rcvNxt, rcvWnd, mapping)
 }
@@ -0,0 +1,317 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp
+
+import (
+	"container/heap"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/seqnum"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/waiter"
+)
+
+// ConnectionState holds the state needed to recreate a connected TCP endpoint,
+// possibly in a different stack. It only contains exported fields of plain
+// types so that it can be serialized, for example with encoding/gob.
+type ConnectionState struct {
+	// NetProto is the network protocol of the connection.
+	NetProto tcpip.NetworkProtocolNumber
+
+	// ID is the 4-tuple of the connection.
+	ID stack.TransportEndpointID
+
+	// SndUna is the first unacknowledged sequence number, and SndData
+	// holds the unacknowledged data followed by the data not yet sent.
+	SndUna  seqnum.Value
+	SndData []byte
+
+	// SndWnd and SndWndScale are the peer's advertised window and its
+	// scale. SndWndScale is negative if window scaling is not in use.
+	SndWnd      seqnum.Size
+	SndWndScale int
+
+	// SndCwnd and SndSsthresh are the congestion control state.
+	SndCwnd     int
+	SndSsthresh int
+
+	// SRTT, RTTVar, RTO and SRTTInited are the round-trip time estimation
+	// state, as defined in RFC 6298.
+	SRTT       time.Duration
+	RTTVar     time.Duration
+	RTO        time.Duration
+	SRTTInited bool
+
+	// MSS is the maximum payload size of the segments to send.
+	MSS int
+
+	// RcvNxt is the next sequence number expected from the peer, and
+	// RcvAcc is the right edge of the window advertised to it.
+	RcvNxt seqnum.Value
+	RcvAcc seqnum.Value
+
+	// RcvWndScale is the scale applied to the advertised receive window.
+	RcvWndScale uint8
+
+	// RcvData holds data received in order but not yet read.
+	RcvData []byte
+
+	// OutOfOrder holds the segments received ahead of RcvNxt.
+	OutOfOrder []SegmentState
+
+	// RcvBufSize and SndBufSize are the sizes of the endpoint's buffers.
+	RcvBufSize int
+	SndBufSize int
+
+	// SACKPermitted and SACK are the negotiated SACK option and the SACK
+	// blocks to report to the peer.
+	SACKPermitted bool
+	SACK          SACKInfo
+
+	// TimestampsEnabled, RecentTS and TSOffset are the negotiated
+	// timestamp option state.
+	TimestampsEnabled bool
+	RecentTS          uint32
+	TSOffset          uint32
+
+	// MD5Keys holds the keys set with TCPMD5SigOption, by peer address.
+	MD5Keys map[tcpip.Address][]byte
+
+	// The following fields hold the values of the corresponding options
+	// of the endpoint. BindToDeviceOption isn't saved, as NIC IDs are
+	// specific to a stack.
+	UserMSS     int
+	UserTimeout time.Duration
+	FlowLabel   uint32
+	Priority    uint32
+	DelayedAck  bool
+	QuickAck    bool
+	NoDelay     bool
+	ReuseAddr   bool
+	V6Only      bool
+	SndHighWat  int
+	SndLowWat   int
+}
+
+// SegmentState is a received segment held in ConnectionState.
+type SegmentState struct {
+	Seq  seqnum.Value
+	Data []byte
+}
+
+// SaveConnection returns the state of the given connected endpoint. The
+// endpoint must be paused (e.g., with stack.Stack.Pause) so that its state
+// doesn't change while it's being saved, and must not be shut down in either
+// direction. The endpoint itself is left untouched; once the connection has
+// been restored elsewhere the caller is expected to discard it along with its
+// stack, as closing it would notify the peer.
+func SaveConnection(ep tcpip.Endpoint) (*ConnectionState, *tcpip.Error) {
+	var e *endpoint
+	switch ep := ep.(type) {
+	case *endpoint:
+		e = ep
+	case *endpointClone:
+		e = ep.endpoint
+	default:
+		return nil, tcpip.ErrNotSupported
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.state != stateConnected || e.shutdownFlags != 0 || e.drainDone == nil {
+		return nil, tcpip.ErrInvalidEndpointState
+	}
+
+	// The protocol goroutine must have drained, so that it doesn't touch
+	// the state below while it's being copied.
+	select {
+	case <-e.drainDone:
+	default:
+		return nil, tcpip.ErrInvalidEndpointState
+	}
+
+	if e.snd.closed || e.rcv.closed {
+		return nil, tcpip.ErrInvalidEndpointState
+	}
+
+	st := &ConnectionState{
+		NetProto:          e.netProto,
+		ID:                e.id,
+		SndUna:            e.snd.sndUna,
+		SndWnd:            e.snd.sndWnd,
+		SndWndScale:       -1,
+		SndCwnd:           e.snd.sndCwnd,
+		SndSsthresh:       e.snd.sndSsthresh,
+		SRTT:              e.snd.srtt,
+		RTTVar:            e.snd.rttvar,
+		RTO:               e.snd.rto,
+		SRTTInited:        e.snd.srttInited,
+		MSS:               e.snd.maxPayloadSize,
+		RcvNxt:            e.rcv.rcvNxt,
+		RcvAcc:            e.rcv.rcvAcc,
+		RcvWndScale:       e.rcv.rcvWndScale,
+		SACKPermitted:     e.sackPermitted,
+		SACK:              e.sack,
+		TimestampsEnabled: e.sendTSOk,
+		RecentTS:          e.recentTS,
+		TSOffset:          e.tsOffset,
+		UserMSS:           int(atomic.LoadUint32(&e.userMSS)),
+		UserTimeout:       time.Duration(atomic.LoadInt64(&e.userTimeout)),
+		FlowLabel:         atomic.LoadUint32(&e.flowLabel),
+		Priority:          atomic.LoadUint32(&e.priority),
+		DelayedAck:        atomic.LoadUint32(&e.delayedAck) != 0,
+		QuickAck:          atomic.LoadUint32(&e.quickAck) != 0,
+		NoDelay:           e.noDelay,
+		ReuseAddr:         e.reuseAddr,
+		V6Only:            e.v6only,
+	}
+	if e.snd.sndWndScale > 0 {
+		st.SndWndScale = int(e.snd.sndWndScale)
+	}
+
+	e.md5Mu.RLock()
+	for addr, key := range e.md5Keys {
+		if st.MD5Keys == nil {
+			st.MD5Keys = make(map[tcpip.Address][]byte)
+		}
+		st.MD5Keys[addr] = append([]byte(nil), key...)
+	}
+	e.md5Mu.RUnlock()
+
+	// Acknowledged data is trimmed from the front of the write list as
+	// acks arrive, so its contents start at sndUna.
+	for s := e.snd.writeList.Front(); s != nil; s = s.Next() {
+		st.SndData = append(st.SndData, s.data.ToView()...)
+	}
+
+	e.sndBufMu.Lock()
+	for s := e.sndQueue.Front(); s != nil; s = s.Next() {
+		st.SndData = append(st.SndData, s.data.ToView()...)
+	}
+	st.SndBufSize = e.sndBufSize
+	st.SndHighWat = e.sndHighWat
+	st.SndLowWat = e.sndLowWat
+	e.sndBufMu.Unlock()
+
+	e.rcvListMu.Lock()
+	for s := e.rcvList.Front(); s != nil; s = s.Next() {
+		for _, v := range s.data.Views()[s.viewToDeliver:] {
+			st.RcvData = append(st.RcvData, v...)
+		}
+	}
+	st.RcvBufSize = e.rcvBufSize
+	e.rcvListMu.Unlock()
+
+	for _, s := range e.rcv.pendingRcvdSegments {
+		st.OutOfOrder = append(st.OutOfOrder, SegmentState{
+			Seq:  s.sequenceNumber,
+			Data: s.data.ToView(),
+		})
+	}
+
+	return st, nil
+}
+
+// RestoreConnection creates a connected endpoint in the given stack from state
+// previously returned by SaveConnection. The stack must have a route to the
+// remote address from the local one.
+//
+// Data that was sent but not acknowledged when the state was saved is
+// retransmitted right away, as there is no way to tell whether it reached the
+// peer.
+func RestoreConnection(s *stack.Stack, waiterQueue *waiter.Queue, st *ConnectionState) (tcpip.Endpoint, *tcpip.Error) {
+	r, err := s.FindRoute(0, st.ID.LocalAddress, st.ID.RemoteAddress, st.NetProto)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Release()
+
+	e := newEndpoint(s, st.NetProto, waiterQueue)
+	e.id = st.ID
+	e.boundNICID = r.NICID()
+	e.route = r.Clone()
+	e.effectiveNetProtos = []tcpip.NetworkProtocolNumber{st.NetProto}
+	e.rcvBufSize = st.RcvBufSize
+	e.sndBufSize = st.SndBufSize
+	e.segmentQueue.setLimit(2 * e.rcvBufSize)
+	e.sackPermitted = st.SACKPermitted
+	e.sack = st.SACK
+	e.sendTSOk = st.TimestampsEnabled
+	e.recentTS = st.RecentTS
+	e.tsOffset = st.TSOffset
+	for addr, key := range st.MD5Keys {
+		if err := e.setMD5Key(addr, key); err != nil {
+			e.route.Release()
+			return nil, err
+		}
+	}
+	e.userMSS = uint32(st.UserMSS)
+	e.userTimeout = int64(st.UserTimeout)
+	e.flowLabel = st.FlowLabel
+	e.priority = st.Priority
+	e.delayedAck = boolToUint32(st.DelayedAck)
+	e.quickAck = boolToUint32(st.QuickAck)
+	e.noDelay = st.NoDelay
+	e.reuseAddr = st.ReuseAddr
+	e.v6only = st.V6Only
+	e.sndHighWat = st.SndHighWat
+	e.sndLowWat = st.SndLowWat
+	e.route.FlowLabel = e.flowLabel
+	e.route.Priority = uint8(e.priority)
+
+	if err := s.RegisterTransportEndpoint(e.boundNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e, false); err != nil {
+		e.route.Release()
+		return nil, err
+	}
+	e.isRegistered = true
+	e.state = stateConnected
+
+	e.snd = newSender(e, st.SndUna-1, st.RcvNxt-1, st.SndWnd, uint16(st.MSS), st.SndWndScale)
+	e.snd.sndCwnd = st.SndCwnd
+	e.snd.sndSsthresh = st.SndSsthresh
+	e.snd.srtt = st.SRTT
+	e.snd.rttvar = st.RTTVar
+	e.snd.rto = st.RTO
+	e.snd.srttInited = st.SRTTInited
+
+	e.rcv = newReceiver(e, st.RcvNxt-1, 0, st.RcvWndScale)
+	e.rcv.rcvAcc = st.RcvAcc
+	e.rcv.pendingBufSize = seqnum.Size(e.rcvBufSize)
+	for _, ss := range st.OutOfOrder {
+		seg := newSegmentFromView(&e.route, e.id, append(buffer.View(nil), ss.Data...))
+		seg.sequenceNumber = ss.Seq
+		seg.flags = flagAck
+		e.rcv.pendingBufUsed += seg.logicalLen()
+		heap.Push(&e.rcv.pendingRcvdSegments, seg)
+	}
+
+	if len(st.RcvData) > 0 {
+		seg := newSegmentFromView(&e.route, e.id, append(buffer.View(nil), st.RcvData...))
+		seg.rcvMem = seg.memSize()
+		e.rcvList.PushBack(seg)
+		e.rcvBufUsed = len(st.RcvData)
+		e.rcvMemUsed = seg.rcvMem
+	}
+
+	// The data still to be sent is queued as if it had just been written,
+	// so that the protocol goroutine assigns it sequence numbers starting
+	// at sndUna and sends it.
+	if len(st.SndData) > 0 {
+		seg := newSegmentFromView(&e.route, e.id, append(buffer.View(nil), st.SndData...))
+		e.sndQueue.PushBack(seg)
+		e.sndBufUsed = len(st.SndData)
+		e.sndBufInQueue = seqnum.Size(len(st.SndData))
+		e.sndWaker.Assert()
+	}
+
+	e.workerRunning = true
+	go e.protocolMainLoop(true)
+
+	return e, nil
+}
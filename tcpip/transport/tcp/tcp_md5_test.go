@@ -0,0 +1,287 @@
+// Copyright 2018 The Netstack Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tcp_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"testing"
+	"time"
+
+	"github.com/google/netstack/tcpip"
+	"github.com/google/netstack/tcpip/buffer"
+	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/loopback"
+	"github.com/google/netstack/tcpip/network/ipv4"
+	"github.com/google/netstack/tcpip/seqnum"
+	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/transport/tcp"
+	"github.com/google/netstack/tcpip/transport/tcp/testing/context"
+	"github.com/google/netstack/waiter"
+)
+
+// md5Endpoint is a TCP endpoint of a stack used by the MD5 signature tests.
+type md5Endpoint struct {
+	ep tcpip.Endpoint
+	wq waiter.Queue
+}
+
+func newMD5Endpoint(t *testing.T, s *stack.Stack, key string) *md5Endpoint {
+	e := &md5Endpoint{}
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &e.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	e.ep = ep
+	if key != "" {
+		if err := ep.SetSockOpt(tcpip.TCPMD5SigOption{Addr: context.StackAddr, Key: []byte(key)}); err != nil {
+			t.Fatalf("SetSockOpt(TCPMD5SigOption) failed: %v", err)
+		}
+	}
+	return e
+}
+
+// newMD5Stack creates a stack whose NIC loops packets back to itself.
+func newMD5Stack(t *testing.T) *stack.Stack {
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, context.StackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         1,
+	}})
+	return s
+}
+
+// md5Connect starts a connection from a client endpoint to a listening
+// endpoint, using the given keys. It returns both endpoints and a channel
+// notified when the client connection completes.
+func md5Connect(t *testing.T, s *stack.Stack, clientKey, serverKey string) (client, server *md5Endpoint, connected chan struct{}) {
+	server = newMD5Endpoint(t, s, serverKey)
+	if err := server.ep.Bind(tcpip.FullAddress{Port: context.StackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := server.ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	client = newMD5Endpoint(t, s, clientKey)
+	we, ch := waiter.NewChannelEntry(nil)
+	client.wq.EventRegister(&we, waiter.EventOut)
+	connected = make(chan struct{})
+	go func() {
+		<-ch
+		client.wq.EventUnregister(&we)
+		close(connected)
+	}()
+	if err := client.ep.Connect(tcpip.FullAddress{Addr: context.StackAddr, Port: context.StackPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	return client, server, connected
+}
+
+// md5Read reads from e, waiting for data if necessary.
+func md5Read(t *testing.T, e *md5Endpoint) buffer.View {
+	we, ch := waiter.NewChannelEntry(nil)
+	e.wq.EventRegister(&we, waiter.EventIn)
+	defer e.wq.EventUnregister(&we)
+
+	for {
+		v, _, err := e.ep.Read(nil)
+		if err != tcpip.ErrWouldBlock {
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			return v
+		}
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for data")
+		}
+	}
+}
+
+// md5Digest computes the RFC 2385 signature of the segment h sent from src to
+// dst with the given key.
+func md5Digest(src, dst tcpip.Address, h header.TCP, key string) []byte {
+	d := md5.New()
+	d.Write([]byte(src))
+	d.Write([]byte(dst))
+	d.Write([]byte{0, uint8(tcp.ProtocolNumber), uint8(len(h) >> 8), uint8(len(h))})
+	var fixed [header.TCPMinimumSize]byte
+	copy(fixed[:], h)
+	header.TCP(fixed[:]).SetChecksum(0)
+	d.Write(fixed[:])
+	d.Write(h.Payload())
+	d.Write([]byte(key))
+	return d.Sum(nil)
+}
+
+// sendMD5Segment sends an ack segment carrying payload from the peer of the
+// context, signed with the given key.
+func sendMD5Segment(c *context.Context, key string, payload []byte, seq, ack seqnum.Value) {
+	opts := make([]byte, 2+2+header.TCPMD5DigestSize)
+	opts[0], opts[1] = header.TCPOptionNOP, header.TCPOptionNOP
+	header.EncodeMD5Option(opts[2:])
+	buf := c.BuildSegment(payload, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  seq,
+		AckNum:  ack,
+		RcvWnd:  30000,
+		TCPOpts: opts,
+	})
+
+	// Fill in the digest, and update the checksum that covers it.
+	h := header.TCP(header.IPv4(buf).Payload())
+	copy(header.FindMD5Option(h.Options()), md5Digest(context.TestAddr, context.StackAddr, h, key))
+	xsum := header.Checksum([]byte(context.TestAddr), 0)
+	xsum = header.Checksum([]byte(context.StackAddr), xsum)
+	xsum = header.Checksum([]byte{0, uint8(tcp.ProtocolNumber)}, xsum)
+	xsum = header.Checksum(payload, xsum)
+	h.SetChecksum(0)
+	h.SetChecksum(^h.CalculateChecksum(xsum, uint16(len(h))))
+	c.SendSegment(buf)
+}
+
+// checkMD5Signed checks that the IPv4 packet p sent by the stack of a context
+// carries a segment signed with the given key.
+func checkMD5Signed(t *testing.T, p []byte, key string) {
+	t.Helper()
+	h := header.TCP(header.IPv4(p).Payload())
+	digest := header.FindMD5Option(h.Options())
+	if want := md5Digest(context.StackAddr, context.TestAddr, h, key); !bytes.Equal(digest, want) {
+		t.Fatalf("got MD5 digest %x, want %x", digest, want)
+	}
+}
+
+func TestMD5SignedConnection(t *testing.T) {
+	s := newMD5Stack(t)
+	tap, err := s.AttachPacketTap(1, 0)
+	if err != nil {
+		t.Fatalf("AttachPacketTap failed: %v", err)
+	}
+
+	const key = "secret"
+	client, server, connected := md5Connect(t, s, key, key)
+	defer client.ep.Close()
+	defer server.ep.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for connection")
+	}
+	if err := client.ep.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	server.wq.EventRegister(&we, waiter.EventIn)
+	defer server.wq.EventUnregister(&we)
+	accepted, _, err := server.ep.Accept()
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+		accepted, _, err = server.ep.Accept()
+	}
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer accepted.Close()
+
+	// Exchange data in both directions. The accepted endpoint was created
+	// with a waiter queue of its own, so it is polled.
+	data := buffer.View("signed data")
+	if _, err := client.ep.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	var got buffer.View
+	for deadline := time.Now().Add(5 * time.Second); len(got) == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		got, _, _ = accepted.Read(nil)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got data %q, want %q", got, data)
+	}
+
+	if _, err := accepted.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := md5Read(t, client); !bytes.Equal(got, data) {
+		t.Fatalf("got data %q, want %q", got, data)
+	}
+
+	// All segments carried a signature.
+	tap.Detach()
+	n := 0
+	for p := range tap.C {
+		if p.Direction != stack.PacketOutbound {
+			continue
+		}
+		h := header.TCP(header.IPv4(p.Data).Payload())
+		if header.FindMD5Option(h.Options()) == nil {
+			t.Fatalf("Segment with flags %x has no MD5 signature", h.Flags())
+		}
+		n++
+	}
+	if n == 0 {
+		t.Fatalf("No segments were captured")
+	}
+}
+
+func TestMD5MismatchedKeys(t *testing.T) {
+	testCases := []struct {
+		name      string
+		clientKey string
+		serverKey string
+	}{
+		{"DifferentKeys", "secret", "other secret"},
+		{"NoClientKey", "", "secret"},
+		{"NoServerKey", "secret", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newMD5Stack(t)
+			client, server, connected := md5Connect(t, s, tc.clientKey, tc.serverKey)
+			defer client.ep.Close()
+			defer server.ep.Close()
+
+			// The SYN, and its first retransmission, are dropped.
+			select {
+			case <-connected:
+				t.Fatalf("Connection was established, err = %v", client.ep.GetSockOpt(tcpip.ErrorOption{}))
+			case <-time.After(1500 * time.Millisecond):
+			}
+
+			if _, _, err := server.ep.Accept(); err != tcpip.ErrWouldBlock {
+				t.Fatalf("got Accept() = %v, want %v", err, tcpip.ErrWouldBlock)
+			}
+			if got := s.MutableStats().DroppedPackets.Value(); got == 0 {
+				t.Fatalf("No segments were dropped")
+			}
+		})
+	}
+}
+
+func TestMD5KeyTooLong(t *testing.T) {
+	s := newMD5Stack(t)
+	e := newMD5Endpoint(t, s, "")
+	defer e.ep.Close()
+
+	key := make([]byte, tcp.MaxMD5KeyLen+1)
+	if err := e.ep.SetSockOpt(tcpip.TCPMD5SigOption{Addr: context.StackAddr, Key: key}); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("got SetSockOpt(TCPMD5SigOption) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+}
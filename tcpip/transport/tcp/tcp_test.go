@@ -6,7 +6,10 @@ package tcp_test
 
 import (
 	"bytes"
+	"encoding/gob"
 	"fmt"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -14,11 +17,13 @@ import (
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/checker"
 	"github.com/google/netstack/tcpip/header"
+	"github.com/google/netstack/tcpip/link/channel"
 	"github.com/google/netstack/tcpip/link/loopback"
 	"github.com/google/netstack/tcpip/link/sniffer"
 	"github.com/google/netstack/tcpip/network/ipv4"
 	"github.com/google/netstack/tcpip/seqnum"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/testutil"
 	"github.com/google/netstack/tcpip/transport/tcp"
 	"github.com/google/netstack/tcpip/transport/tcp/testing/context"
 	"github.com/google/netstack/waiter"
@@ -64,6 +69,100 @@ func TestGiveUpConnect(t *testing.T) {
 	}
 }
 
+func TestConnectUnreachable(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		code uint8
+		want *tcpip.Error
+	}{
+		{"NetUnreachable", header.ICMPv4NetUnreachable, tcpip.ErrNoRoute},
+		{"HostUnreachable", header.ICMPv4HostUnreachable, tcpip.ErrNoRoute},
+		{"PortUnreachable", header.ICMPv4PortUnreachable, tcpip.ErrConnectionRefused},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := context.New(t, defaultMTU)
+			defer c.Cleanup()
+
+			var wq waiter.Queue
+			ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			defer ep.Close()
+
+			waitEntry, notifyCh := waiter.NewChannelEntry(nil)
+			wq.EventRegister(&waitEntry, waiter.EventOut)
+			defer wq.EventUnregister(&waitEntry)
+
+			if err := ep.Connect(tcpip.FullAddress{Addr: context.TestAddr, Port: context.TestPort}); err != tcpip.ErrConnectStarted {
+				t.Fatalf("Unexpected return value from Connect: %v", err)
+			}
+
+			// Reply to the SYN with an ICMP error quoting it.
+			syn := c.GetPacket()
+			c.SendICMPPacket(header.ICMPv4DstUnreachable, test.code, make([]byte, 4), syn, defaultMTU)
+
+			select {
+			case <-notifyCh:
+			case <-time.After(time.Second):
+				t.Fatalf("Timed out waiting for the connection to fail")
+			}
+			if err := ep.GetSockOpt(tcpip.ErrorOption{}); err != test.want {
+				t.Fatalf("got ep.GetSockOpt(tcpip.ErrorOption{}) = %v, want = %v", err, test.want)
+			}
+			if got := c.Stack().MutableStats().TCP.FailedConnectionAttempts.Value(); got != 1 {
+				t.Errorf("got FailedConnectionAttempts = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestUnreachableAbortsPassiveHandshake(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	var wq waiter.Queue
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: context.StackPort,
+		Flags:   header.TCPFlagSyn,
+		SeqNum:  789,
+		RcvWnd:  30000,
+	})
+	synAck := c.GetPacket()
+	if eps, _ := c.Stack().RegisteredEndpoints(); len(eps) != 2 {
+		t.Fatalf("got %d registered endpoints during the handshake, want 2: %+v", len(eps), eps)
+	}
+
+	// The error quoting the SYN-ACK aborts the handshake, which unregisters
+	// the connection in SYN-RCVD.
+	c.SendICMPPacket(header.ICMPv4DstUnreachable, header.ICMPv4HostUnreachable, make([]byte, 4), synAck, defaultMTU)
+	for end := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		eps, _ := c.Stack().RegisteredEndpoints()
+		if len(eps) == 1 {
+			break
+		}
+		if time.Now().After(end) {
+			t.Fatalf("got registered endpoints %+v after the handshake failed, want only the listener", eps)
+		}
+	}
+	if _, _, err := ep.Accept(); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got Accept() = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
 func TestActiveHandshake(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -189,6 +288,307 @@ func TestSimpleReceive(t *testing.T) {
 	)
 }
 
+func TestMigrateRemote(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	const newPort = context.TestPort + 1
+	if err := c.EP.SetSockOpt(tcpip.MigrateRemoteOption{Remote: tcpip.FullAddress{Addr: context.TestAddr, Port: newPort}}); err != nil {
+		t.Fatalf("SetSockOpt(MigrateRemoteOption) failed: %v", err)
+	}
+	if got, err := c.EP.GetRemoteAddress(); err != nil || got.Port != newPort {
+		t.Fatalf("GetRemoteAddress() = %+v, %v, want port %d", got, err, newPort)
+	}
+
+	// Segments from the old remote don't match the endpoint anymore, so
+	// they're reset.
+	c.SendPacket([]byte{1, 2, 3}, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.TCPFlagsMatch(header.TCPFlagRst, header.TCPFlagRst),
+		),
+	)
+	if _, _, err := c.EP.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventIn)
+	defer c.WQ.EventUnregister(&we)
+
+	// Segments from the new remote are received, and acknowledged to it.
+	data := []byte{4, 5, 6}
+	c.SendPacket(data, &context.Headers{
+		SrcPort: newPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for data to arrive")
+	}
+
+	v, _, err := c.EP.Read(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+	if !bytes.Equal(data, v) {
+		t.Fatalf("Data is different: expected %v, got %v", data, v)
+	}
+
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(newPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.AckNum(uint32(790+len(data))),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+}
+
+func TestCorruptedSegmentDropped(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	malformed := c.Stack().MutableStats().MalformedRcvdPackets.Value()
+	verified := c.Stack().MutableStats().ChecksumVerifiedRcvdPackets.Value()
+
+	// Send a segment whose payload was corrupted after computing the
+	// checksum.
+	data := []byte{1, 2, 3}
+	s := c.BuildSegment(data, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+	s[len(s)-1] ^= 0xff
+	c.SendSegment(s)
+
+	// The segment must be dropped without being acknowledged.
+	c.CheckNoPacketTimeout("Corrupted segment was acknowledged", 500*time.Millisecond)
+	if _, _, err := c.EP.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+
+	stats := c.Stack().Stats()
+	if got, want := stats.MalformedRcvdPackets.Value(), malformed+1; got != want {
+		t.Fatalf("got MalformedRcvdPackets = %d, want %d", got, want)
+	}
+	if got, want := stats.ChecksumVerifiedRcvdPackets.Value(), verified+1; got != want {
+		t.Fatalf("got ChecksumVerifiedRcvdPackets = %d, want %d", got, want)
+	}
+	if got := stats.ChecksumSkippedRcvdPackets.Value(); got != 0 {
+		t.Fatalf("got ChecksumSkippedRcvdPackets = %d, want 0", got)
+	}
+}
+
+func TestReadView(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// Queue two segments, waiting for them to be acknowledged.
+	seq := 790
+	for _, data := range []string{"abc", "defgh"} {
+		c.SendPacket([]byte(data), &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  seqnum.Value(seq),
+			AckNum:  c.IRS.Add(1),
+			RcvWnd:  30000,
+		})
+		seq += len(data)
+		checker.IPv4(t, c.GetPacket(), checker.TCP(checker.AckNum(uint32(seq))))
+	}
+
+	ep := c.EP.(tcpip.ViewEndpoint)
+	check := func(name string, f func(int) (buffer.VectorisedView, tcpip.ControlMessages, *tcpip.Error), n int, want string) {
+		t.Helper()
+		vv, _, err := f(n)
+		if err != nil {
+			t.Fatalf("%s(%d) failed: %v", name, n, err)
+		}
+		if got := string(vv.ToView()); got != want {
+			t.Fatalf("got %s(%d) = %q, want %q", name, n, got, want)
+		}
+		vv.Release()
+	}
+	readView := func(n int) (buffer.VectorisedView, tcpip.ControlMessages, *tcpip.Error) {
+		return ep.ReadView(n, nil)
+	}
+
+	// Views are split at the requested size, and span segments.
+	check("PeekView", ep.PeekView, 2, "ab")
+	check("ReadView", readView, 2, "ab")
+	check("PeekView", ep.PeekView, 4, "cdef")
+	check("ReadView", readView, 2, "cd")
+
+	// Reads resume where the views were split.
+	v, _, err := c.EP.Read(nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got, want := string(v), "efgh"; got != want {
+		t.Fatalf("got Read() = %q, want %q", got, want)
+	}
+	if _, _, err := ep.ReadView(10, nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got ReadView(10) = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestPeekStraddlingSegments(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	seq := 790
+	for _, data := range []string{"abc", "de", "fghij"} {
+		c.SendPacket([]byte(data), &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  seqnum.Value(seq),
+			AckNum:  c.IRS.Add(1),
+			RcvWnd:  30000,
+		})
+		seq += len(data)
+		checker.IPv4(t, c.GetPacket(), checker.TCP(checker.AckNum(uint32(seq))))
+	}
+
+	// The buffers are filled across the boundaries of the segments.
+	vec := [][]byte{make([]byte, 2), make([]byte, 4), nil, make([]byte, 3)}
+	n, _, err := c.EP.Peek(vec)
+	if err != nil {
+		t.Fatalf("Peek failed: %v", err)
+	}
+	if n != 9 {
+		t.Fatalf("got Peek() = %d, want 9", n)
+	}
+	for i, want := range []string{"ab", "cdef", "", "ghi"} {
+		if got := string(vec[i]); got != want {
+			t.Errorf("got vec[%d] = %q, want %q", i, got, want)
+		}
+	}
+
+	// All the segments are handed back at once, as they were received.
+	vv, _, err := c.EP.(tcpip.ViewEndpoint).ReadView(9, nil)
+	if err != nil {
+		t.Fatalf("ReadView failed: %v", err)
+	}
+	if got, want := len(vv.Views()), 3; got != want {
+		t.Errorf("got %d views, want %d", got, want)
+	}
+	if got, want := string(vv.ToView()), "abcdefghi"; got != want {
+		t.Errorf("got ReadView(9) = %q, want %q", got, want)
+	}
+	vv.Release()
+
+	// The last segment was split, and its rest can be read.
+	v, _, err := c.EP.Read(nil)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got, want := string(v), "j"; got != want {
+		t.Fatalf("got Read() = %q, want %q", got, want)
+	}
+}
+
+func TestReceiveBufferMemory(t *testing.T) {
+	const (
+		bufSize  = 10000
+		segSize  = 1000
+		segCount = 8
+		readSegs = 6
+	)
+	for _, tc := range []struct {
+		name string
+		// linkBufSize is the size of the link buffers the segments
+		// are received into, or zero if they aren't.
+		linkBufSize int
+		wantWnd     uint16
+	}{
+		// The window is what's left of the buffer once the three
+		// segments left unread are accounted for.
+		{"NoLinkBuffers", 0, bufSize - 3*segSize},
+		{"SmallLinkBuffers", 2500, bufSize - 3*segSize},
+		// Three link buffers of half the receive buffer leave room
+		// for half a buffer of memory, twice the receive buffer
+		// being allowed.
+		{"LargeLinkBuffers", 5000, 2*bufSize - 3*5000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := context.New(t, defaultMTU)
+			defer c.Cleanup()
+
+			opt := tcpip.ReceiveBufferSizeOption(bufSize)
+			c.CreateConnected(789, 30000, &opt)
+
+			data := make([]byte, segSize)
+			seq := 790
+			send := func() {
+				t.Helper()
+				s := c.BuildSegment(data, &context.Headers{
+					SrcPort: context.TestPort,
+					DstPort: c.Port,
+					Flags:   header.TCPFlagAck,
+					SeqNum:  seqnum.Value(seq),
+					AckNum:  c.IRS.Add(1),
+					RcvWnd:  30000,
+				})
+				if tc.linkBufSize == 0 {
+					c.SendSegment(s)
+				} else {
+					b := buffer.NewPacketBuffer(nil)
+					b.SetSize(tc.linkBufSize)
+					c.SendSegmentInBuffer(s, b)
+				}
+				seq += segSize
+			}
+
+			for i := 0; i < segCount; i++ {
+				send()
+				checker.IPv4(t, c.GetPacket(), checker.TCP(checker.AckNum(uint32(seq))))
+			}
+			for i := 0; i < readSegs; i++ {
+				if _, _, err := c.EP.Read(nil); err != nil {
+					t.Fatalf("Read failed: %v", err)
+				}
+			}
+
+			send()
+			checker.IPv4(t, c.GetPacket(),
+				checker.TCP(
+					checker.AckNum(uint32(seq)),
+					checker.Window(tc.wantWnd),
+				),
+			)
+		})
+	}
+}
+
 func TestOutOfOrderReceive(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -351,6 +751,67 @@ func TestOutOfOrderFlood(t *testing.T) {
 	)
 }
 
+func TestMixedOrderReceive(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventIn)
+	defer c.WQ.EventUnregister(&we)
+
+	// Send 10 segments of 3 bytes each, with some of them swapped with the
+	// next one, and some of them repeated.
+	data := make([]byte, 30)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, i := range []int{0, 2, 1, 3, 4, 4, 6, 5, 7, 9, 8, 5} {
+		c.SendPacket(data[3*i:3*i+3], &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  seqnum.Value(790 + 3*i),
+			AckNum:  c.IRS.Add(1),
+			RcvWnd:  30000,
+		})
+	}
+
+	read := make([]byte, 0, len(data))
+	for len(read) < len(data) {
+		v, _, err := c.EP.Read(nil)
+		if err != nil {
+			if err == tcpip.ErrWouldBlock {
+				select {
+				case <-ch:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("Timed out waiting for data to arrive, got %v", read)
+				}
+				continue
+			}
+			t.Fatalf("Unexpected error from Read: %v", err)
+		}
+		read = append(read, v...)
+	}
+	if !bytes.Equal(data, read) {
+		t.Fatalf("Data is different: expected %v, got %v", data, read)
+	}
+
+	// Check that the whole data is eventually acknowledged.
+	for {
+		b := c.GetPacket()
+		tcp := header.TCP(header.IPv4(b).Payload())
+		if tcp.AckNumber() == uint32(790+len(data)) {
+			break
+		}
+	}
+	c.CheckNoPacketTimeout("More packets received than expected", 50*time.Millisecond)
+	if _, _, err := c.EP.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+}
+
 func TestRstOnCloseWithUnreadData(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -470,21 +931,97 @@ func TestFullWindowReceive(t *testing.T) {
 	)
 }
 
-func TestNoWindowShrinking(t *testing.T) {
+func TestReceiveWindowUpdateThreshold(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
 
-	// Start off with a window size of 10, then shrink it to 5.
-	opt := tcpip.ReceiveBufferSizeOption(10)
+	// The window update threshold is half the buffer, as the MSS is
+	// larger.
+	const bufSize = 20
+	opt := tcpip.ReceiveBufferSizeOption(bufSize)
 	c.CreateConnected(789, 30000, &opt)
 
-	opt = 5
-	if err := c.EP.SetSockOpt(opt); err != nil {
-		t.Fatalf("SetSockOpt failed: %v", err)
-	}
-
-	we, ch := waiter.NewChannelEntry(nil)
-	c.WQ.EventRegister(&we, waiter.EventIn)
+	// Fill up the window one byte at a time, so that it can be drained one
+	// byte at a time.
+	for i := 0; i < bufSize; i++ {
+		c.SendPacket([]byte{byte(i)}, &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  seqnum.Value(790 + i),
+			AckNum:  c.IRS.Add(1),
+			RcvWnd:  30000,
+		})
+		checker.IPv4(t, c.GetPacket(),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.AckNum(uint32(790+i+1)),
+				checker.Window(uint16(bufSize-i-1)),
+			),
+		)
+	}
+
+	read := func(i int) {
+		t.Helper()
+		v, _, err := c.EP.Read(nil)
+		if err != nil {
+			t.Fatalf("Unexpected error from Read: %v", err)
+		}
+		if want := []byte{byte(i)}; !bytes.Equal(v, want) {
+			t.Fatalf("got Read() = %v, want %v", v, want)
+		}
+	}
+
+	// The window isn't reopened until half the buffer is free.
+	for i := 0; i < bufSize/2-1; i++ {
+		read(i)
+	}
+	c.CheckNoPacket("Window update sent before reaching the threshold")
+
+	read(bufSize/2 - 1)
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.AckNum(uint32(790+bufSize)),
+			checker.TCPFlags(header.TCPFlagAck),
+			checker.Window(bufSize/2),
+		),
+	)
+
+	// A byte received now doesn't make the window grow by one byte either.
+	read(bufSize / 2)
+	c.SendPacket([]byte{0}, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  seqnum.Value(790 + bufSize),
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.AckNum(uint32(790+bufSize+1)),
+			checker.Window(bufSize/2-1),
+		),
+	)
+}
+
+func TestNoWindowShrinking(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	// Start off with a window size of 10, then shrink it to 5.
+	opt := tcpip.ReceiveBufferSizeOption(10)
+	c.CreateConnected(789, 30000, &opt)
+
+	opt = 5
+	if err := c.EP.SetSockOpt(opt); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventIn)
 	defer c.WQ.EventUnregister(&we)
 
 	_, _, err := c.EP.Read(nil)
@@ -617,6 +1154,119 @@ func TestSimpleSend(t *testing.T) {
 	})
 }
 
+func TestRetransmitCoalescesSegments(t *testing.T) {
+	clock := testutil.NewManualClock()
+	c := context.NewWithClock(t, defaultMTU, clock)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// Write several small chunks, each of which goes out as its own segment.
+	const count = 4
+	var data []byte
+	for i := 0; i < count; i++ {
+		view := buffer.NewView(10)
+		for j := range view {
+			view[j] = byte(i*len(view) + j)
+		}
+		data = append(data, view...)
+
+		if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+			t.Fatalf("Unexpected error from Write: %v", err)
+		}
+
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(len(view)+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1+uint32(i*len(view))),
+				checker.AckNum(790),
+			),
+		)
+	}
+
+	// Don't acknowledge anything. When the retransmit timer fires, all the
+	// unacknowledged data must be resent in a single segment.
+	advanceClock(t, clock, time.Second)
+	b := c.GetPacket()
+	checker.IPv4(t, b,
+		checker.PayloadLen(len(data)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.AckNum(790),
+			checker.TCPFlagsMatch(header.TCPFlagAck, ^uint8(header.TCPFlagPsh)),
+		),
+	)
+
+	if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; bytes.Compare(data, p) != 0 {
+		t.Fatalf("Data is different: expected %v, got %v", data, p)
+	}
+
+	// Acknowledge the data.
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1 + seqnum.Size(len(data))),
+		RcvWnd:  30000,
+	})
+
+	c.CheckNoPacketTimeout("Unexpected retransmission after ack", 2*time.Second)
+}
+
+func TestRetransmitDoesNotCoalesceAcrossSACKs(t *testing.T) {
+	clock := testutil.NewManualClock()
+	c := context.NewWithClock(t, defaultMTU, clock)
+	defer c.Cleanup()
+
+	setStackSACKPermitted(t, c, true)
+	rep := createConnectedWithSACKPermittedOption(c)
+
+	// Write three small chunks, each of which goes out as its own segment.
+	const count, size = 3, 10
+	for i := 0; i < count; i++ {
+		view := buffer.NewView(size)
+		if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+			t.Fatalf("Unexpected error from Write: %v", err)
+		}
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(size+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1+uint32(i*size)),
+			),
+		)
+	}
+
+	// SACK the middle segment along with the end of the first one and the
+	// start of the last one, so that all three are partly SACKed.
+	first := c.IRS.Add(1)
+	opts := []byte{header.TCPOptionNOP, header.TCPOptionNOP, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	header.EncodeSACKBlocks([]header.SACKBlock{{Start: first.Add(size / 2), End: first.Add(2*size + size/2)}}, opts[2:])
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  rep.NextSeqNum,
+		AckNum:  first,
+		RcvWnd:  30000,
+		TCPOpts: opts,
+	})
+
+	// The retransmission must not cover the SACKed range along with the
+	// hole before it.
+	advanceClock(t, clock, time.Second)
+	checker.IPv4(t, c.GetPacket(),
+		checker.PayloadLen(size+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(first)),
+		),
+	)
+}
+
 func TestZeroWindowSend(t *testing.T) {
 	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
@@ -672,6 +1322,79 @@ func TestZeroWindowSend(t *testing.T) {
 	})
 }
 
+func TestSendSillyWindowAvoidance(t *testing.T) {
+	clock := testutil.NewManualClock()
+	c := context.NewWithClock(t, defaultMTU, clock)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	const size = 10
+	sent, rcvd := 0, 0
+	window := func(wnd seqnum.Size) {
+		c.SendPacket(nil, &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  seqnum.Value(790 + rcvd),
+			AckNum:  c.IRS.Add(1 + seqnum.Size(sent)),
+			RcvWnd:  wnd,
+		})
+	}
+	// shrinkWindow makes the peer offer a window of a single byte, and
+	// waits for it to be taken into account: the byte of data sent along
+	// is acknowledged.
+	shrinkWindow := func() {
+		t.Helper()
+		c.SendPacket([]byte{0}, &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  seqnum.Value(790 + rcvd),
+			AckNum:  c.IRS.Add(1 + seqnum.Size(sent)),
+			RcvWnd:  1,
+		})
+		rcvd++
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(header.TCPMinimumSize),
+			checker.TCP(checker.AckNum(uint32(790+rcvd))),
+		)
+	}
+	checkData := func(n int) {
+		t.Helper()
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(n+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1+uint32(sent)),
+			),
+		)
+		sent += n
+	}
+
+	// The peer shrinks its window to a single byte, which isn't filled
+	// with a tiny segment.
+	shrinkWindow()
+	if _, err := c.EP.Write(tcpip.SlicePayload(buffer.NewView(size)), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.CheckNoPacketTimeout("Tiny segment sent into a tiny window", 100*time.Millisecond)
+
+	// The data is sent in full once the window opens.
+	window(30000)
+	checkData(size)
+	shrinkWindow()
+
+	// With nothing in flight to get the window opened, a tiny segment is
+	// eventually sent anyway.
+	if _, err := c.EP.Write(tcpip.SlicePayload(buffer.NewView(size)), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.CheckNoPacketTimeout("Tiny segment sent into a tiny window", 100*time.Millisecond)
+	advanceClock(t, clock, 200*time.Millisecond)
+	checkData(1)
+}
+
 func TestScaledWindowConnect(t *testing.T) {
 	// This test ensures that window scaling is used when the peer
 	// does advertise it and connection is established with Connect().
@@ -1167,99 +1890,396 @@ func TestSynCookiePassiveSendMSSLessThanMTU(t *testing.T) {
 	testBrokenUpWrite(t, c, maxPayload)
 }
 
-func TestForwarderSendMSSLessThanMTU(t *testing.T) {
-	const maxPayload = 100
-	const mtu = 1200
-	c := context.New(t, mtu)
-	defer c.Cleanup()
-
-	s := c.Stack()
-	ch := make(chan *tcpip.Error, 1)
-	f := tcp.NewForwarder(s, 65536, 10, func(r *tcp.ForwarderRequest) {
-		var err *tcpip.Error
-		c.EP, err = r.CreateEndpoint(&c.WQ)
-		ch <- err
+// sendHandshakeAck sends a SYN from the given port to the listener on
+// context.StackPort, and then acknowledges the SYN-ACK it replies with. It
+// returns the acknowledgement, so that it can be sent again.
+func sendHandshakeAck(c *context.Context, srcPort uint16) *context.Headers {
+	const iss = 789
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: srcPort,
+		DstPort: context.StackPort,
+		Flags:   header.TCPFlagSyn,
+		SeqNum:  iss,
+		RcvWnd:  30000,
 	})
-	s.SetTransportProtocolHandler(tcp.ProtocolNumber, f.HandlePacket)
-
-	// Do 3-way handshake.
-	c.PassiveConnect(maxPayload, 1, header.TCPSynOptions{MSS: mtu - header.IPv4MinimumSize - header.TCPMinimumSize})
-
-	// Wait for connection to be available.
-	select {
-	case err := <-ch:
-		if err != nil {
-			t.Fatalf("Error creating endpoint: %v", err)
-		}
-	case <-time.After(2 * time.Second):
-		t.Fatalf("Timed out waiting for connection")
+	synAck := header.TCP(header.IPv4(c.GetPacket()).Payload())
+	ack := &context.Headers{
+		SrcPort: srcPort,
+		DstPort: context.StackPort,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  iss + 1,
+		AckNum:  seqnum.Value(synAck.SequenceNumber()).Add(1),
+		RcvWnd:  30000,
 	}
-
-	// Check that data gets properly segmented.
-	testBrokenUpWrite(t, c, maxPayload)
+	c.SendPacket(nil, ack)
+	return ack
 }
 
-func TestSynOptionsOnActiveConnect(t *testing.T) {
-	const mtu = 1400
-	c := context.New(t, mtu)
+func TestSynData(t *testing.T) {
+	c := context.New(t, defaultMTU)
 	defer c.Cleanup()
 
-	// Create TCP endpoint.
-	var err *tcpip.Error
-	c.EP, err = c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.WQ)
+	wq := &waiter.Queue{}
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
 	if err != nil {
 		t.Fatalf("NewEndpoint failed: %v", err)
 	}
-
-	// Set the buffer size to a deterministic size so that we can check the
-	// window scaling option.
-	const rcvBufferSize = 0x20000
-	const wndScale = 2
-	if err := c.EP.SetSockOpt(tcpip.ReceiveBufferSizeOption(rcvBufferSize)); err != nil {
-		t.Fatalf("SetSockOpt failed failed: %v", err)
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
 	}
-
-	// Start connection attempt.
-	we, ch := waiter.NewChannelEntry(nil)
-	c.WQ.EventRegister(&we, waiter.EventOut)
-	defer c.WQ.EventUnregister(&we)
-
-	err = c.EP.Connect(tcpip.FullAddress{Addr: context.TestAddr, Port: context.TestPort})
-	if err != tcpip.ErrConnectStarted {
-		t.Fatalf("Unexpected return value from Connect: %v", err)
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
 	}
 
-	// Receive SYN packet.
-	b := c.GetPacket()
+	const iss = 789
+	c.SendPacket([]byte("abc"), &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: context.StackPort,
+		Flags:   header.TCPFlagSyn,
+		SeqNum:  iss,
+		RcvWnd:  30000,
+	})
 
+	// The data isn't acknowledged until the connection is accepted.
+	b := c.GetPacket()
 	checker.IPv4(t, b,
 		checker.TCP(
-			checker.DstPort(context.TestPort),
-			checker.TCPFlags(header.TCPFlagSyn),
-			checker.TCPSynOptions(header.TCPSynOptions{MSS: mtu - header.IPv4MinimumSize - header.TCPMinimumSize, WS: wndScale}),
-		),
-	)
-
-	tcp := header.TCP(header.IPv4(b).Payload())
-	c.IRS = seqnum.Value(tcp.SequenceNumber())
-
-	// Wait for retransmit.
-	time.Sleep(1 * time.Second)
-	checker.IPv4(t, c.GetPacket(),
-		checker.TCP(
-			checker.DstPort(context.TestPort),
-			checker.TCPFlags(header.TCPFlagSyn),
-			checker.SrcPort(tcp.SourcePort()),
-			checker.SeqNum(tcp.SequenceNumber()),
-			checker.TCPSynOptions(header.TCPSynOptions{MSS: mtu - header.IPv4MinimumSize - header.TCPMinimumSize, WS: wndScale}),
+			checker.AckNum(iss+1),
+			checker.TCPFlags(header.TCPFlagSyn|header.TCPFlagAck),
 		),
 	)
-
-	// Send SYN-ACK.
-	iss := seqnum.Value(789)
+	synAck := header.TCP(header.IPv4(b).Payload())
+	ackNum := seqnum.Value(synAck.SequenceNumber()).Add(1)
 	c.SendPacket(nil, &context.Headers{
-		SrcPort: tcp.DestinationPort(),
-		DstPort: tcp.SourcePort(),
+		SrcPort: context.TestPort,
+		DstPort: context.StackPort,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  iss + 1,
+		AckNum:  ackNum,
+		RcvWnd:  30000,
+	})
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+	c.EP, _, err = ep.Accept()
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+			c.EP, _, err = ep.Accept()
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+	}
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.SeqNum(uint32(ackNum)),
+			checker.AckNum(iss+4),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+
+	// The data sent next follows the SYN's, and a retransmission of the
+	// latter is dropped as a duplicate.
+	for _, p := range []struct {
+		seq  seqnum.Value
+		data string
+	}{
+		{iss + 4, "def"},
+		{iss + 1, "abc"},
+	} {
+		c.SendPacket([]byte(p.data), &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: context.StackPort,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  p.seq,
+			AckNum:  ackNum,
+			RcvWnd:  30000,
+		})
+		checker.IPv4(t, c.GetPacket(),
+			checker.TCP(
+				checker.AckNum(iss+7),
+				checker.TCPFlags(header.TCPFlagAck),
+			),
+		)
+	}
+
+	var got []byte
+	for len(got) < 6 {
+		v, _, err := c.EP.Read(nil)
+		if err != nil {
+			t.Fatalf("Read failed after %q: %v", got, err)
+		}
+		got = append(got, v...)
+	}
+	if want := "abcdef"; string(got) != want {
+		t.Fatalf("got data %q, want %q", got, want)
+	}
+	if _, _, err := c.EP.Read(nil); err != tcpip.ErrWouldBlock {
+		t.Fatalf("got Read = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestAcceptQueueOverflow(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		policy  tcp.AcceptQueueOverflowOption
+		cookies bool
+	}{
+		{"Drop", tcp.AcceptQueueOverflowDrop, false},
+		{"Reset", tcp.AcceptQueueOverflowReset, false},
+		{"DropWithCookies", tcp.AcceptQueueOverflowDrop, true},
+		{"ResetWithCookies", tcp.AcceptQueueOverflowReset, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := context.New(t, defaultMTU)
+			defer c.Cleanup()
+
+			if test.cookies {
+				saved := tcp.SynRcvdCountThreshold
+				defer func() {
+					tcp.SynRcvdCountThreshold = saved
+				}()
+				tcp.SynRcvdCountThreshold = 0
+			}
+			if err := c.Stack().SetTransportProtocolOption(tcp.ProtocolNumber, test.policy); err != nil {
+				t.Fatalf("SetTransportProtocolOption(%d) failed: %v", test.policy, err)
+			}
+
+			wq := &waiter.Queue{}
+			ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			defer ep.Close()
+			if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}, nil); err != nil {
+				t.Fatalf("Bind failed: %v", err)
+			}
+			if err := ep.Listen(1); err != nil {
+				t.Fatalf("Listen failed: %v", err)
+			}
+			we, ch := waiter.NewChannelEntry(nil)
+			wq.EventRegister(&we, waiter.EventIn)
+			defer wq.EventUnregister(&we)
+
+			// The first connection fills the accept queue.
+			sendHandshakeAck(c, context.TestPort)
+			select {
+			case <-ch:
+			case <-time.After(1 * time.Second):
+				t.Fatalf("Timed out waiting for the first connection to be queued")
+			}
+			if queued, backlog, ok := ep.(stack.TransportEndpointAcceptQueueReporter).AcceptQueue(); queued != 1 || backlog != 1 || !ok {
+				t.Fatalf("got AcceptQueue() = %d, %d, %t, want 1, 1, true", queued, backlog, ok)
+			}
+
+			const overflowPort = context.TestPort + 1
+			ack := sendHandshakeAck(c, overflowPort)
+			if test.policy == tcp.AcceptQueueOverflowReset {
+				checker.IPv4(t, c.GetPacket(),
+					checker.TCP(
+						checker.DstPort(overflowPort),
+						checker.SeqNum(uint32(ack.AckNum)),
+						checker.TCPFlagsMatch(header.TCPFlagRst, header.TCPFlagRst),
+					),
+				)
+			} else {
+				c.CheckNoPacketTimeout("Packet sent in reply to a dropped handshake", 100*time.Millisecond)
+			}
+			if got := c.Stack().MutableStats().TCP.ListenOverflows.Value(); got != 1 {
+				t.Errorf("got ListenOverflows = %d, want 1", got)
+			}
+
+			// Once the first connection is accepted, the queue has
+			// room again.
+			n, _, err := ep.Accept()
+			if err != nil {
+				t.Fatalf("Accept failed: %v", err)
+			}
+			defer n.Close()
+
+			if test.policy == tcp.AcceptQueueOverflowReset {
+				return
+			}
+
+			// The retransmitted acknowledgement completes the dropped
+			// handshake.
+			c.SendPacket(nil, ack)
+			select {
+			case <-ch:
+			case <-time.After(1 * time.Second):
+				t.Fatalf("Timed out waiting for the dropped connection to be queued")
+			}
+			n2, _, err := ep.Accept()
+			if err != nil {
+				t.Fatalf("Accept failed: %v", err)
+			}
+			defer n2.Close()
+			if got, err := n2.GetRemoteAddress(); err != nil || got.Port != overflowPort {
+				t.Errorf("got GetRemoteAddress() = %+v, %v, want port %d", got, err, overflowPort)
+			}
+		})
+	}
+}
+
+func TestAcceptQueueOverflowOption(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	var v tcp.AcceptQueueOverflowOption
+	if err := c.Stack().TransportProtocolOption(tcp.ProtocolNumber, &v); err != nil || v != tcp.AcceptQueueOverflowWait {
+		t.Fatalf("got AcceptQueueOverflowOption = %d, %v, want %d, nil", v, err, tcp.AcceptQueueOverflowWait)
+	}
+	if err := c.Stack().SetTransportProtocolOption(tcp.ProtocolNumber, tcp.AcceptQueueOverflowReset+1); err != tcpip.ErrInvalidOptionValue {
+		t.Errorf("got SetTransportProtocolOption(%d) = %v, want %v", tcp.AcceptQueueOverflowReset+1, err, tcpip.ErrInvalidOptionValue)
+	}
+}
+
+func TestForwarderSendMSSLessThanMTU(t *testing.T) {
+	const maxPayload = 100
+	const mtu = 1200
+	c := context.New(t, mtu)
+	defer c.Cleanup()
+
+	s := c.Stack()
+	ch := make(chan *tcpip.Error, 1)
+	f := tcp.NewForwarder(s, 65536, 10, func(r *tcp.ForwarderRequest) {
+		var err *tcpip.Error
+		c.EP, err = r.CreateEndpoint(&c.WQ)
+		ch <- err
+	})
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, f.HandlePacket)
+
+	// Do 3-way handshake.
+	c.PassiveConnect(maxPayload, 1, header.TCPSynOptions{MSS: mtu - header.IPv4MinimumSize - header.TCPMinimumSize})
+
+	// Wait for connection to be available.
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatalf("Error creating endpoint: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for connection")
+	}
+
+	// Check that data gets properly segmented.
+	testBrokenUpWrite(t, c, maxPayload)
+}
+
+func TestAdvertisedMSSFromMTU(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		mtu  uint32
+		v6   bool
+		mss  uint16
+	}{
+		{"IPv4", 1500, false, 1460},
+		{"IPv6", 1500, true, 1440},
+		{"IPv4Jumbo", 9000, false, 8960},
+		{"IPv6Jumbo", 9000, true, 8940},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := context.New(t, test.mtu)
+			defer c.Cleanup()
+
+			addr := tcpip.Address(context.TestAddr)
+			if test.v6 {
+				c.CreateV6Endpoint(true)
+				addr = context.TestV6Addr
+			} else {
+				var err *tcpip.Error
+				c.EP, err = c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.WQ)
+				if err != nil {
+					t.Fatalf("NewEndpoint failed: %v", err)
+				}
+			}
+
+			if err := c.EP.Connect(tcpip.FullAddress{Addr: addr, Port: context.TestPort}); err != tcpip.ErrConnectStarted {
+				t.Fatalf("Unexpected return value from Connect: %v", err)
+			}
+
+			var b []byte
+			var tcpHdr header.TCP
+			if test.v6 {
+				b = c.GetV6Packet()
+				tcpHdr = header.TCP(header.IPv6(b).Payload())
+			} else {
+				b = c.GetPacket()
+				tcpHdr = header.TCP(header.IPv4(b).Payload())
+			}
+			if got := header.ParseSynOptions(tcpHdr.Options(), false).MSS; got != test.mss {
+				t.Fatalf("got advertised MSS %d, want %d", got, test.mss)
+			}
+		})
+	}
+}
+
+func TestSynOptionsOnActiveConnect(t *testing.T) {
+	const mtu = 1400
+	c := context.New(t, mtu)
+	defer c.Cleanup()
+
+	// Create TCP endpoint.
+	var err *tcpip.Error
+	c.EP, err = c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.WQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	// Set the buffer size to a deterministic size so that we can check the
+	// window scaling option.
+	const rcvBufferSize = 0x20000
+	const wndScale = 2
+	if err := c.EP.SetSockOpt(tcpip.ReceiveBufferSizeOption(rcvBufferSize)); err != nil {
+		t.Fatalf("SetSockOpt failed failed: %v", err)
+	}
+
+	// Start connection attempt.
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventOut)
+	defer c.WQ.EventUnregister(&we)
+
+	err = c.EP.Connect(tcpip.FullAddress{Addr: context.TestAddr, Port: context.TestPort})
+	if err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+
+	// Receive SYN packet.
+	b := c.GetPacket()
+
+	checker.IPv4(t, b,
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.TCPFlags(header.TCPFlagSyn),
+			checker.TCPSynOptions(header.TCPSynOptions{MSS: mtu - header.IPv4MinimumSize - header.TCPMinimumSize, WS: wndScale}),
+		),
+	)
+
+	tcp := header.TCP(header.IPv4(b).Payload())
+	c.IRS = seqnum.Value(tcp.SequenceNumber())
+
+	// Wait for retransmit.
+	time.Sleep(1 * time.Second)
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.TCPFlags(header.TCPFlagSyn),
+			checker.SrcPort(tcp.SourcePort()),
+			checker.SeqNum(tcp.SequenceNumber()),
+			checker.TCPSynOptions(header.TCPSynOptions{MSS: mtu - header.IPv4MinimumSize - header.TCPMinimumSize, WS: wndScale}),
+		),
+	)
+
+	// Send SYN-ACK.
+	iss := seqnum.Value(789)
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: tcp.DestinationPort(),
+		DstPort: tcp.SourcePort(),
 		Flags:   header.TCPFlagSyn | header.TCPFlagAck,
 		SeqNum:  iss,
 		AckNum:  c.IRS.Add(1),
@@ -1423,8 +2443,75 @@ func TestFinImmediately(t *testing.T) {
 	)
 }
 
+func TestRetransmitLargeWrite(t *testing.T) {
+	clock := testutil.NewManualClock()
+	c := context.NewWithClock(t, 1500, clock)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 65535, nil)
+
+	// Write a single view spanning several segments, all within the
+	// initial congestion window. The endpoint keeps referring to it
+	// instead of copying it, which must not get in the way of splitting it
+	// up and sending parts of it again.
+	data := buffer.NewView(4000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	if _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	var first []byte
+	for off := 0; off < len(data); {
+		b := c.GetPacket()
+		checker.IPv4(t, b,
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1+uint32(off)),
+				checker.AckNum(790),
+			),
+		)
+		p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]
+		if !bytes.Equal(p, data[off:off+len(p)]) {
+			t.Fatalf("Bad data at offset %d: got %v, want %v", off, p, data[off:off+len(p)])
+		}
+		if first == nil {
+			first = p
+		}
+		off += len(p)
+	}
+
+	// Don't acknowledge anything, so that the first segment is sent again
+	// with the same data.
+	advanceClock(t, clock, time.Second)
+	b := c.GetPacket()
+	checker.IPv4(t, b,
+		checker.PayloadLen(len(first)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.AckNum(790),
+		),
+	)
+	if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; !bytes.Equal(p, data[:len(p)]) {
+		t.Fatalf("Bad retransmitted data: got %v, want %v", p, data[:len(p)])
+	}
+
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1 + seqnum.Size(len(data))),
+		RcvWnd:  65535,
+	})
+	c.CheckNoPacketTimeout("Unexpected retransmission after ack", 2*time.Second)
+}
+
 func TestFinRetransmit(t *testing.T) {
-	c := context.New(t, defaultMTU)
+	clock := testutil.NewManualClock()
+	c := context.NewWithClock(t, defaultMTU, clock)
 	defer c.Cleanup()
 
 	c.CreateConnected(789, 30000, nil)
@@ -1444,7 +2531,9 @@ func TestFinRetransmit(t *testing.T) {
 		),
 	)
 
-	// Don't acknowledge yet. We should get a retransmit of the FIN.
+	// Don't acknowledge yet. We should get a retransmit of the FIN when the
+	// retransmit timer fires.
+	advanceClock(t, clock, time.Second)
 	checker.IPv4(t, c.GetPacket(),
 		checker.PayloadLen(header.TCPMinimumSize),
 		checker.TCP(
@@ -1954,34 +3043,174 @@ func DisabledTestCongestionAvoidance(t *testing.T) {
 	}
 }
 
-func DisabledTestFastRecovery(t *testing.T) {
-	maxPayload := 10
+func TestPushFlag(t *testing.T) {
+	const maxPayload = 10
 	c := context.New(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
 	defer c.Cleanup()
 
 	c.CreateConnected(789, 30000, nil)
 
-	const iterations = 7
-	data := buffer.NewView(2 * maxPayload * (tcp.InitialCwnd << (iterations + 1)))
+	data := buffer.NewView(maxPayload * (tcp.InitialCwnd + 4))
 	for i := range data {
 		data[i] = byte(i)
 	}
 
-	// Write all the data in one shot. Packets will only be written at the
-	// MTU size though.
-	if _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
-		t.Fatalf("Unexpected error from Write: %v", err)
+	// checkPacket receives the packet carrying size bytes at offset, and
+	// checks whether it has the PSH flag set.
+	checkPacket := func(offset, size int, push bool) {
+		t.Helper()
+		flags := uint8(header.TCPFlagAck)
+		if push {
+			flags |= header.TCPFlagPsh
+		}
+		b := c.GetPacket()
+		checker.IPv4(t, b,
+			checker.PayloadLen(size+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1+uint32(offset)),
+				checker.TCPFlags(flags),
+			),
+		)
+		if p := b[header.IPv4MinimumSize+header.TCPMinimumSize:]; !bytes.Equal(p, data[offset:][:size]) {
+			t.Fatalf("got data %v, want %v", p, data[offset:][:size])
+		}
 	}
 
-	// Do slow start for a few iterations.
-	expected := tcp.InitialCwnd
-	bytesRead := 0
-	for i := 0; i < iterations; i++ {
-		expected = tcp.InitialCwnd << uint(i)
-		if i > 0 {
-			// Acknowledge all the data received so far if not on
-			// first iteration.
-			c.SendAck(790, bytesRead)
+	// An unflagged bulk write only has PSH set on its last segment. It
+	// uses up the congestion window.
+	bulk := data[:maxPayload*tcp.InitialCwnd]
+	if _, err := c.EP.Write(tcpip.SlicePayload(bulk), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	for i := 0; i < tcp.InitialCwnd; i++ {
+		checkPacket(i*maxPayload, maxPayload, i == tcp.InitialCwnd-1)
+	}
+
+	// Queue a flagged write and an unflagged one, which are sent together
+	// once the window opens up. PSH is set on the segment ending the
+	// flagged write, and on the last one.
+	flagged := data[len(bulk):][:maxPayload*3/2]
+	if _, err := c.EP.Write(tcpip.SlicePayload(flagged), tcpip.WriteOptions{Push: true}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	unflagged := data[len(bulk)+len(flagged):][:maxPayload*3/2]
+	if _, err := c.EP.Write(tcpip.SlicePayload(unflagged), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.CheckNoPacketTimeout("Packet sent past the congestion window", 50*time.Millisecond)
+	c.SendAck(790, len(bulk))
+
+	offset := len(bulk)
+	checkPacket(offset, maxPayload, false)
+	checkPacket(offset+maxPayload, maxPayload/2, true)
+	offset += len(flagged)
+	checkPacket(offset, maxPayload, false)
+	checkPacket(offset+maxPayload, maxPayload/2, true)
+}
+
+func TestCongestionWindowValidation(t *testing.T) {
+	const maxPayload = 10
+	clock := testutil.NewManualClock()
+	c := context.NewWithClock(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload), clock)
+	defer c.Cleanup()
+
+	acked := make(chan seqnum.Value, 100)
+	c.Stack().AddTCPProbe(func(state stack.TCPEndpointState) {
+		acked <- state.Sender.SndUna
+	})
+
+	c.CreateConnected(789, 30000, nil)
+
+	data := buffer.NewView(maxPayload * 200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// sendTrain writes packets segments worth of data and checks that only the first
+	// expected of them are sent before they're acknowledged.
+	bytesRead := 0
+	sendTrain := func(packets, expected int) {
+		t.Helper()
+		view := data[bytesRead : bytesRead+packets*maxPayload]
+		if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+			t.Fatalf("Unexpected error from Write: %v", err)
+		}
+		for sent := 0; sent < packets; {
+			for j := 0; j < expected && sent < packets; j++ {
+				c.ReceiveAndCheckPacket(data, bytesRead, maxPayload)
+				bytesRead += maxPayload
+				sent++
+			}
+			c.CheckNoPacketTimeout("More packets received than expected for this cwnd.", 50*time.Millisecond)
+			c.SendAck(790, bytesRead)
+			expected *= 2
+		}
+	}
+
+	// waitAcked waits for the endpoint to process the last acknowledgement
+	// by sending it again: the probe is invoked with the state of the
+	// endpoint before it handles each segment.
+	waitAcked := func() {
+		t.Helper()
+		c.SendAck(790, bytesRead)
+		want := c.IRS.Add(1 + seqnum.Size(bytesRead))
+		for {
+			select {
+			case sndUna := <-acked:
+				if sndUna == want {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for the acknowledgement of %d bytes", bytesRead)
+			}
+		}
+	}
+
+	// Grow cwnd to 4*IW with slow start. The RTT measured on the fake
+	// clock is zero, so the RTO is the minimum one.
+	sendTrain(3*tcp.InitialCwnd, tcp.InitialCwnd)
+	waitAcked()
+
+	// After an idle interval of one and a half RTOs, cwnd is halved once.
+	clock.Advance(300 * time.Millisecond)
+	sendTrain(3*tcp.InitialCwnd, 2*tcp.InitialCwnd)
+	waitAcked()
+
+	// cwnd is back to 4*IW, but it doesn't decay below IW however long
+	// the connection stays idle.
+	clock.Advance(time.Minute)
+	sendTrain(2*tcp.InitialCwnd, tcp.InitialCwnd)
+}
+
+func DisabledTestFastRecovery(t *testing.T) {
+	maxPayload := 10
+	c := context.New(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload))
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	const iterations = 7
+	data := buffer.NewView(2 * maxPayload * (tcp.InitialCwnd << (iterations + 1)))
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// Write all the data in one shot. Packets will only be written at the
+	// MTU size though.
+	if _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+
+	// Do slow start for a few iterations.
+	expected := tcp.InitialCwnd
+	bytesRead := 0
+	for i := 0; i < iterations; i++ {
+		expected = tcp.InitialCwnd << uint(i)
+		if i > 0 {
+			// Acknowledge all the data received so far if not on
+			// first iteration.
+			c.SendAck(790, bytesRead)
 		}
 
 		// Read all packets expected on this iteration. Don't
@@ -2376,6 +3605,76 @@ func TestReadAfterClosedState(t *testing.T) {
 	}
 }
 
+func TestCloneListener(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	wq := &waiter.Queue{}
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	// Unbound endpoints can't be cloned.
+	if _, err := ep.(tcpip.CloneableEndpoint).Clone(); err != tcpip.ErrInvalidEndpointState {
+		t.Fatalf("Clone of an unbound endpoint = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+
+	if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := ep.Listen(10); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	clone, err := ep.(tcpip.CloneableEndpoint).Clone()
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	ep.Close()
+
+	bindToStackPort := func() *tcpip.Error {
+		ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &waiter.Queue{})
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		defer ep.Close()
+		return ep.Bind(tcpip.FullAddress{Port: context.StackPort}, nil)
+	}
+
+	// The clone keeps the port and still accepts connections.
+	if err := bindToStackPort(); err != tcpip.ErrPortInUse {
+		t.Fatalf("Bind to the port of the closed listener = %v, want %v", err, tcpip.ErrPortInUse)
+	}
+
+	c.PassiveConnectWithOptions(100, 5, header.TCPSynOptions{MSS: defaultIPv4MSS})
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn)
+	defer wq.EventUnregister(&we)
+
+	c.EP, _, err = clone.Accept()
+	if err == tcpip.ErrWouldBlock {
+		select {
+		case <-ch:
+			c.EP, _, err = clone.Accept()
+			if err != nil {
+				t.Fatalf("Accept failed: %v", err)
+			}
+
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Timed out waiting for accept")
+		}
+	}
+
+	// Closing the clone, even several times, releases the port.
+	clone.Close()
+	clone.Close()
+	if err := bindToStackPort(); err != nil {
+		t.Fatalf("Bind to the port of the closed listener and clone failed: %v", err)
+	}
+}
+
 func TestReusePort(t *testing.T) {
 	// This test ensures that ports are immediately available for reuse
 	// after Close on the endpoints using them returns.
@@ -2570,6 +3869,292 @@ func TestMinMaxBufferSizes(t *testing.T) {
 	checkSendBufferSize(t, ep, tcp.DefaultBufferSize*30)
 }
 
+// BenchmarkInOrderReceive measures the rate at which data is sent and received
+// by an endpoint connected to itself over a loopback link, so all the segments
+// are received in order.
+func BenchmarkInOrderReceive(b *testing.B) {
+	ep, ch := newLoopbackConnection(b)
+	defer ep.Close()
+
+	const size = 1024
+	view := buffer.NewView(size)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ep.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+			b.Fatalf("Write failed: %v", err)
+		}
+		for n := 0; n < size; {
+			v, _, err := ep.Read(nil)
+			if err == tcpip.ErrWouldBlock {
+				<-ch
+				continue
+			}
+			if err != nil {
+				b.Fatalf("Read failed: %v", err)
+			}
+			n += len(v)
+		}
+	}
+}
+
+// BenchmarkReceiveThroughput measures the rate at which large writes are
+// received by an endpoint connected to itself over a loopback link, read as
+// they're segmented with Read, or all at once with ReadView.
+func BenchmarkReceiveThroughput(b *testing.B) {
+	for _, size := range []int{16 << 10, 256 << 10} {
+		for _, bm := range []struct {
+			name string
+			read func(tcpip.Endpoint, int) (int, *tcpip.Error)
+		}{
+			{"Read", func(ep tcpip.Endpoint, _ int) (int, *tcpip.Error) {
+				v, _, err := ep.Read(nil)
+				return len(v), err
+			}},
+			{"ReadView", func(ep tcpip.Endpoint, n int) (int, *tcpip.Error) {
+				vv, _, err := ep.(tcpip.ViewEndpoint).ReadView(n, nil)
+				vv.Release()
+				return vv.Size(), err
+			}},
+		} {
+			b.Run(fmt.Sprintf("%s/%dKiB", bm.name, size>>10), func(b *testing.B) {
+				ep, ch := newLoopbackConnection(b)
+				defer ep.Close()
+				if err := ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(4 * size)); err != nil {
+					b.Fatalf("SetSockOpt failed: %v", err)
+				}
+
+				view := buffer.NewView(size)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for n := 0; n < size; {
+						w, err := ep.Write(tcpip.SlicePayload(view[n:]), tcpip.WriteOptions{})
+						if err != nil {
+							b.Fatalf("Write failed: %v", err)
+						}
+						n += int(w)
+					}
+					for n := 0; n < size; {
+						r, err := bm.read(ep, size-n)
+						if err == tcpip.ErrWouldBlock {
+							<-ch
+							continue
+						}
+						if err != nil {
+							b.Fatalf("Read failed: %v", err)
+						}
+						n += r
+					}
+				}
+			})
+		}
+	}
+}
+
+// newLoopbackConnection returns an endpoint connected to itself over a
+// loopback link, along with a channel notified when it's readable or
+// writable.
+func newLoopbackConnection(b *testing.B) (tcpip.Endpoint, chan struct{}) {
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		b.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, context.StackAddr); err != nil {
+		b.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Gateway: "", NIC: 1}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		b.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}, nil); err != nil {
+		b.Fatalf("Bind failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn|waiter.EventOut)
+	if err := ep.Connect(tcpip.FullAddress{Addr: context.StackAddr, Port: context.StackPort}); err != tcpip.ErrConnectStarted {
+		b.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	<-ch
+	if err := ep.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+		b.Fatalf("Connect failed: %v", err)
+	}
+
+	return ep, ch
+}
+
+// TestLongTransferHeap checks that the heap doesn't grow over a long transfer
+// between an endpoint connected to itself over a loopback link, as the
+// segments sent and received are recycled.
+func TestLongTransferHeap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping long transfer in short mode")
+	}
+
+	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, context.StackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Gateway: "", NIC: 1}})
+
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventIn|waiter.EventOut)
+	defer wq.EventUnregister(&we)
+	if err := ep.Connect(tcpip.FullAddress{Addr: context.StackAddr, Port: context.StackPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+	<-ch
+	if err := ep.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	const (
+		size   = 16 << 10
+		warmup = 1 << 10
+		rounds = 64 << 10
+	)
+	view := buffer.NewView(size)
+	transfer := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, err := ep.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			for n := 0; n < size; {
+				v, _, err := ep.Read(nil)
+				if err == tcpip.ErrWouldBlock {
+					<-ch
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Read failed: %v", err)
+				}
+				n += len(v)
+			}
+		}
+	}
+	heap := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc
+	}
+
+	transfer(warmup)
+	before := heap()
+	transfer(rounds)
+	after := heap()
+
+	// Allow for some slack, e.g., for the stats and the timers of the
+	// runtime, but not for a leak proportional to the data transferred.
+	if after > before+(1<<20) {
+		t.Errorf("Heap grew from %d to %d bytes over a %d MiB transfer", before, after, rounds*size>>20)
+	}
+}
+
+// countingClock is a ManualClock that counts the runtime timers created by the
+// stack, and the times they expire.
+type countingClock struct {
+	*testutil.ManualClock
+	created int64
+	fired   int64
+}
+
+// AfterFunc implements tcpip.Clock.AfterFunc.
+func (c *countingClock) AfterFunc(d time.Duration, f func()) tcpip.Timer {
+	atomic.AddInt64(&c.created, 1)
+	return c.ManualClock.AfterFunc(d, func() {
+		atomic.AddInt64(&c.fired, 1)
+		f()
+	})
+}
+
+// TestIdleConnections checks that idle connections don't hold runtime timers,
+// and aren't woken up, and reports the memory they use.
+func TestIdleConnections(t *testing.T) {
+	count := 50000
+	if testing.Short() {
+		count = 1000
+	}
+
+	clock := &countingClock{ManualClock: testutil.NewManualClock()}
+	s := stack.New(clock, []string{ipv4.ProtocolName}, []string{tcp.ProtocolName})
+	defer s.Close(stack.CloseOptions{Silent: true})
+	if err := s.CreateNIC(1, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := s.AddAddress(1, ipv4.ProtocolNumber, context.StackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: "\x00\x00\x00\x00", Mask: "\x00\x00\x00\x00", Gateway: "", NIC: 1}})
+
+	memory := func() uint64 {
+		var m runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&m)
+		return m.HeapAlloc + m.StackInuse
+	}
+	before := memory()
+
+	// Each connection is an endpoint connected to itself, so that it's
+	// made of a single endpoint.
+	var wq waiter.Queue
+	we, ch := waiter.NewChannelEntry(nil)
+	wq.EventRegister(&we, waiter.EventOut)
+	defer wq.EventUnregister(&we)
+	for i := 0; i < count; i++ {
+		ep, err := s.NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		addr := tcpip.FullAddress{Addr: context.StackAddr, Port: uint16(1024 + i)}
+		if err := ep.Bind(addr, nil); err != nil {
+			t.Fatalf("Bind failed: %v", err)
+		}
+		if err := ep.Connect(addr); err != tcpip.ErrConnectStarted {
+			t.Fatalf("Unexpected return value from Connect: %v", err)
+		}
+		<-ch
+		if err := ep.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+			t.Fatalf("Connect failed: %v", err)
+		}
+	}
+
+	after := memory()
+	t.Logf("%d idle connections use %d bytes each", count, (after-before)/uint64(count))
+
+	// The only runtime timers ever created are those of the handshakes,
+	// which are stopped once the connections are established.
+	if got := atomic.LoadInt64(&clock.created); got > int64(count) {
+		t.Errorf("got %d runtime timers created for %d connections, want at most %d", got, count, count)
+	}
+	if got := clock.PendingTimers(); got != 0 {
+		t.Errorf("got %d pending timers, want 0", got)
+	}
+	clock.Advance(time.Hour)
+	if got := atomic.LoadInt64(&clock.fired); got != 0 {
+		t.Errorf("got %d wakeups of idle connections over an hour, want 0", got)
+	}
+}
+
 func TestSelfConnect(t *testing.T) {
 	// This test ensures that intentional self-connects work. In particular,
 	// it checks that if an endpoint binds to say 127.0.0.1:1000 then
@@ -2713,6 +4298,55 @@ func TestPathMTUDiscovery(t *testing.T) {
 	receivePackets(c, sizes, -1, uint32(c.IRS)+1)
 }
 
+func TestTCPInfoNegotiatedOptions(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		options bool
+	}{
+		{"all options", true},
+		{"no options", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := context.New(t, 1500)
+			defer c.Cleanup()
+
+			if err := c.Stack().SetTransportProtocolOption(tcp.ProtocolNumber, tcp.SACKEnabled(true)); err != nil {
+				t.Fatalf("SetTransportProtocolOption failed: %v", err)
+			}
+
+			const sndWndScale = 2
+			var options []byte
+			if test.options {
+				options = make([]byte, 40)
+				offset := header.EncodeWSOption(sndWndScale, options)
+				offset += header.EncodeTSOption(1, 0, options[offset:])
+				offset += header.EncodeSACKPermittedOption(options[offset:])
+				offset += header.AddTCPOptionPadding(options, offset)
+				options = options[:offset]
+			}
+			c.CreateConnectedWithRawOptions(789, 30000, nil, options)
+
+			var info tcpip.TCPInfoOption
+			if err := c.EP.GetSockOpt(&info); err != nil {
+				t.Fatalf("GetSockOpt failed: %v", err)
+			}
+
+			want := tcpip.TCPInfoOption{}
+			if test.options {
+				want = tcpip.TCPInfoOption{
+					SndWndScale:   sndWndScale,
+					RcvWndScale:   uint8(tcp.FindWndScale(tcp.DefaultBufferSize)),
+					SACKPermitted: true,
+					Timestamps:    true,
+				}
+			}
+			if info != want {
+				t.Errorf("Got TCPInfoOption = %+v, want = %+v", info, want)
+			}
+		})
+	}
+}
+
 func TestTCPEndpointProbe(t *testing.T) {
 	c := context.New(t, 1500)
 	defer c.Cleanup()
@@ -2757,3 +4391,1392 @@ func TestTCPEndpointProbe(t *testing.T) {
 		t.Fatalf("TCP Probe function was not called")
 	}
 }
+
+func TestDelayedAck(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	if err := c.EP.SetSockOpt(tcpip.DelayedAckOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var v tcpip.DelayedAckOption
+	if err := c.EP.GetSockOpt(&v); err != nil || v != 1 {
+		t.Fatalf("GetSockOpt(DelayedAckOption) = %d, %v, want 1, nil", v, err)
+	}
+
+	data := []byte{1, 2, 3}
+	seq := seqnum.Value(790)
+	send := func() {
+		c.SendPacket(data, &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  seq,
+			AckNum:  c.IRS.Add(1),
+			RcvWnd:  30000,
+		})
+		seq = seq.Add(seqnum.Size(len(data)))
+	}
+	checkAck := func() {
+		checker.IPv4(t, c.GetPacket(),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1),
+				checker.AckNum(uint32(seq)),
+				checker.TCPFlags(header.TCPFlagAck),
+			),
+		)
+	}
+
+	// The first segment isn't acknowledged immediately, but the second one
+	// is.
+	send()
+	c.CheckNoPacketTimeout("Got an ACK for the first segment", 50*time.Millisecond)
+	send()
+	checkAck()
+
+	// A single segment is acknowledged once the delayed ACK timer fires.
+	send()
+	c.CheckNoPacketTimeout("Got an immediate ACK for a single segment", 50*time.Millisecond)
+	checkAck()
+
+	// Once delayed ACKs are disabled, every segment is acknowledged
+	// immediately.
+	if err := c.EP.SetSockOpt(tcpip.DelayedAckOption(0)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	send()
+	checkAck()
+}
+
+func TestTimersShareRuntimeTimer(t *testing.T) {
+	clock := testutil.NewManualClock()
+	c := context.NewWithClock(t, defaultMTU, clock)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// An idle connection has no runtime timer set.
+	if got := clock.PendingTimers(); got != 0 {
+		t.Fatalf("got %d pending timers on an idle connection, want 0", got)
+	}
+
+	if err := c.EP.SetSockOpt(tcpip.DelayedAckOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	// A single segment is acknowledged once the delayed ACK timer expires.
+	c.SendPacket([]byte("abc"), &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+	waitForTimer(t, clock, 200*time.Millisecond)
+	clock.Advance(199 * time.Millisecond)
+	c.CheckNoPacketTimeout("ACK sent before the delayed ACK timer expired", 50*time.Millisecond)
+	clock.Advance(time.Millisecond)
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.AckNum(793),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+	if _, _, err := c.EP.Read(nil); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	// Unacknowledged data is retransmitted once the retransmit timer
+	// expires.
+	if _, err := c.EP.Write(tcpip.SlicePayload("xyz"), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(header.TCPMinimumSize+3),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1),
+				checker.AckNum(793),
+			),
+		)
+		if i == 0 {
+			waitForTimer(t, clock, time.Second)
+			clock.Advance(time.Second - time.Millisecond)
+			c.CheckNoPacketTimeout("Data retransmitted before the retransmit timer expired", 50*time.Millisecond)
+			clock.Advance(time.Millisecond)
+		}
+	}
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  793,
+		AckNum:  c.IRS.Add(4),
+		RcvWnd:  30000,
+	})
+
+	// The connection is reset 3 seconds after the endpoint is closed, if
+	// the peer doesn't close it. The retransmit timer of the FIN, disabled
+	// when the FIN is acknowledged, doesn't get in the way.
+	c.EP.Close()
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+4),
+			checker.AckNum(793),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagFin),
+		),
+	)
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  793,
+		AckNum:  c.IRS.Add(5),
+		RcvWnd:  30000,
+	})
+	advanceClock(t, clock, 3*time.Second-time.Millisecond)
+	c.CheckNoPacketTimeout("Connection reset before the close timer expired", 50*time.Millisecond)
+	advanceClock(t, clock, time.Millisecond)
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+5),
+			checker.AckNum(793),
+			checker.TCPFlags(header.TCPFlagAck|header.TCPFlagRst),
+		),
+	)
+}
+
+func TestQuickAck(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	if err := c.EP.SetSockOpt(tcpip.DelayedAckOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if err := c.EP.SetSockOpt(tcpip.QuickAckOption(1)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	data := []byte{1, 2, 3}
+	seq := seqnum.Value(790)
+	send := func() {
+		c.SendPacket(data, &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  seq,
+			AckNum:  c.IRS.Add(1),
+			RcvWnd:  30000,
+		})
+		seq = seq.Add(seqnum.Size(len(data)))
+	}
+	checkAck := func() {
+		checker.IPv4(t, c.GetPacket(),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1),
+				checker.AckNum(uint32(seq)),
+				checker.TCPFlags(header.TCPFlagAck),
+			),
+		)
+	}
+
+	// While quickack is active, the next segment is acknowledged
+	// immediately.
+	start := time.Now()
+	send()
+	checkAck()
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("Got ACK after %v while quickack was active, want it immediately", d)
+	}
+
+	// Quickack is then cleared, and delayed ACKs apply again.
+	var v tcpip.QuickAckOption
+	if err := c.EP.GetSockOpt(&v); err != nil || v != 0 {
+		t.Fatalf("GetSockOpt(QuickAckOption) = %d, %v, want 0, nil", v, err)
+	}
+	send()
+	c.CheckNoPacketTimeout("Got an immediate ACK after quickack was cleared", 50*time.Millisecond)
+	send()
+	checkAck()
+}
+
+// advanceClock advances clock by d once a timer is set to expire within d. The
+// protocol goroutine sets the retransmit timer right after sending the segments
+// it times, or handling the acks it gets, so it may not have done so yet when
+// the test gets to advancing the clock.
+func advanceClock(t *testing.T, clock *testutil.ManualClock, d time.Duration) {
+	t.Helper()
+	waitForTimer(t, clock, d)
+	clock.Advance(d)
+}
+
+// waitForTimer waits for a timer of clock to be set to expire within d.
+func waitForTimer(t *testing.T, clock *testutil.ManualClock, d time.Duration) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if next, ok := clock.NextExpiration(); ok && next <= d {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for a timer to be set to expire within %v", d)
+		}
+	}
+}
+
+func TestSendBufferWatermarks(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	if err := c.EP.SetSockOpt(tcpip.SendBufferWatermarksOption{High: 500, Low: 1000}); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("SetSockOpt with Low > High = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	want := tcpip.SendBufferWatermarksOption{High: 750, Low: 250}
+	if err := c.EP.SetSockOpt(want); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var v tcpip.SendBufferWatermarksOption
+	if err := c.EP.GetSockOpt(&v); err != nil || v != want {
+		t.Fatalf("GetSockOpt(SendBufferWatermarksOption) = %+v, %v, want %+v, nil", v, err, want)
+	}
+
+	highEntry, highCh := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&highEntry, waiter.EventSndHigh)
+	defer c.WQ.EventUnregister(&highEntry)
+	lowEntry, lowCh := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&lowEntry, waiter.EventSndLow)
+	defer c.WQ.EventUnregister(&lowEntry)
+
+	if got := c.EP.Readiness(waiter.EventSndHigh | waiter.EventSndLow); got != waiter.EventSndLow {
+		t.Fatalf("got Readiness = %#x before writing, want %#x", got, waiter.EventSndLow)
+	}
+
+	// Fill the send buffer past the high watermark in two writes, only the
+	// second one crosses it.
+	const writeSize = 500
+	data := buffer.NewView(2 * writeSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := c.EP.Write(tcpip.SlicePayload(data[:writeSize]), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.ReceiveAndCheckPacket(data, 0, writeSize)
+	select {
+	case <-highCh:
+		t.Fatalf("got high watermark event below the high watermark")
+	default:
+	}
+
+	if _, err := c.EP.Write(tcpip.SlicePayload(data[writeSize:]), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.ReceiveAndCheckPacket(data, writeSize, writeSize)
+	select {
+	case <-highCh:
+	default:
+		t.Fatalf("didn't get high watermark event")
+	}
+	if got := c.EP.Readiness(waiter.EventSndHigh | waiter.EventSndLow); got != waiter.EventSndHigh {
+		t.Fatalf("got Readiness = %#x above the high watermark, want %#x", got, waiter.EventSndHigh)
+	}
+
+	// Acknowledging the first write leaves the buffer above the low
+	// watermark.
+	c.SendAck(790, writeSize)
+	select {
+	case <-lowCh:
+		t.Fatalf("got low watermark event above the low watermark")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Acknowledging everything drains it.
+	c.SendAck(790, len(data))
+	select {
+	case <-lowCh:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("timed out waiting for low watermark event")
+	}
+	if got := c.EP.Readiness(waiter.EventSndHigh | waiter.EventSndLow); got != waiter.EventSndLow {
+		t.Fatalf("got Readiness = %#x after draining, want %#x", got, waiter.EventSndLow)
+	}
+}
+
+func TestBindToDevice(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	if err := c.Stack().CreateNIC(2, loopback.New()); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+
+	listen := func(nic tcpip.NICID, wantBindErr *tcpip.Error) (tcpip.Endpoint, *waiter.Queue) {
+		t.Helper()
+		wq := &waiter.Queue{}
+		ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if err := ep.SetSockOpt(tcpip.BindToDeviceOption(nic)); err != nil {
+			t.Fatalf("SetSockOpt(BindToDeviceOption(%d)) failed: %v", nic, err)
+		}
+		if err := ep.Bind(tcpip.FullAddress{Port: context.StackPort}, nil); err != wantBindErr {
+			t.Fatalf("Bind on NIC %d = %v, want %v", nic, err, wantBindErr)
+		}
+		if wantBindErr != nil {
+			ep.Close()
+			return nil, nil
+		}
+		if err := ep.Listen(10); err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		return ep, wq
+	}
+
+	// Listeners bound to different NICs can share a port, but not with an
+	// unbound one.
+	ep1, wq1 := listen(1, nil)
+	defer ep1.Close()
+	ep2, _ := listen(2, nil)
+	defer ep2.Close()
+	listen(0, tcpip.ErrPortInUse)
+
+	// Connections on NIC 1 are only accepted by the listener bound to it.
+	we, ch := waiter.NewChannelEntry(nil)
+	wq1.EventRegister(&we, waiter.EventIn)
+	defer wq1.EventUnregister(&we)
+
+	c.PassiveConnectWithOptions(100, 5, header.TCPSynOptions{MSS: defaultIPv4MSS})
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for accept")
+	}
+	n, _, err := ep1.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer n.Close()
+	var v tcpip.BindToDeviceOption
+	if err := n.GetSockOpt(&v); err != nil || v != 1 {
+		t.Fatalf("GetSockOpt(BindToDeviceOption) = %d, %v, want 1, nil", v, err)
+	}
+	if _, _, err := ep2.Accept(); err != tcpip.ErrWouldBlock {
+		t.Fatalf("Accept on the listener bound to NIC 2 = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
+func TestMaxSegOptionOnActiveConnect(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	var err *tcpip.Error
+	c.EP, err = c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &c.WQ)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	if err := c.EP.SetSockOpt(tcpip.MaxSegOption(-1)); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("SetSockOpt(MaxSegOption(-1)) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	const mss = 500
+	if err := c.EP.SetSockOpt(tcpip.MaxSegOption(mss)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var v tcpip.MaxSegOption
+	if err := c.EP.GetSockOpt(&v); err != nil || v != mss {
+		t.Fatalf("GetSockOpt(MaxSegOption) = %d, %v, want %d, nil", v, err, mss)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventOut)
+	defer c.WQ.EventUnregister(&we)
+
+	if err := c.EP.Connect(tcpip.FullAddress{Addr: context.TestAddr, Port: context.TestPort}); err != tcpip.ErrConnectStarted {
+		t.Fatalf("Unexpected return value from Connect: %v", err)
+	}
+
+	// The SYN advertises the clamped MSS.
+	b := c.GetPacket()
+	tcpHdr := header.TCP(header.IPv4(b).Payload())
+	if got := header.ParseSynOptions(tcpHdr.Options(), false).MSS; got != mss {
+		t.Fatalf("got advertised MSS %d, want %d", got, mss)
+	}
+	c.IRS = seqnum.Value(tcpHdr.SequenceNumber())
+
+	// The peer advertises a larger one.
+	const peerMSS = 1000
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: tcpHdr.DestinationPort(),
+		DstPort: tcpHdr.SourcePort(),
+		Flags:   header.TCPFlagSyn | header.TCPFlagAck,
+		SeqNum:  789,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+		TCPOpts: []byte{header.TCPOptionMSS, 4, byte(peerMSS / 256), byte(peerMSS % 256)},
+	})
+	c.GetPacket()
+
+	select {
+	case <-ch:
+		if err := c.EP.GetSockOpt(tcpip.ErrorOption{}); err != nil {
+			t.Fatalf("Unexpected error when connecting: %v", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for connection")
+	}
+
+	// Segments don't exceed the clamped MSS.
+	data := buffer.NewView(1200)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	c.ReceiveAndCheckPacket(data, 0, mss)
+	c.ReceiveAndCheckPacket(data, mss, mss)
+	c.ReceiveAndCheckPacket(data, 2*mss, len(data)-2*mss)
+}
+
+func TestMaxSegOptionAfterConnect(t *testing.T) {
+	c := context.New(t, 1500)
+	defer c.Cleanup()
+
+	const maxPayload = 1500 - header.TCPMinimumSize - header.IPv4MinimumSize
+	c.CreateConnectedWithRawOptions(789, 30000, nil, []byte{
+		header.TCPOptionMSS, 4, byte(maxPayload / 256), byte(maxPayload % 256),
+	})
+
+	const mss = 1000
+	if err := c.EP.SetSockOpt(tcpip.MaxSegOption(mss)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	data := buffer.NewView(4*mss + 500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// receive checks that the next packets carry segments of the given
+	// sizes starting at seqNum. It returns the first one.
+	receive := func(seqNum uint32, sizes ...int) []byte {
+		t.Helper()
+		var first []byte
+		for _, size := range sizes {
+			p := c.GetPacket()
+			if first == nil {
+				first = p
+			}
+			checker.IPv4(t, p,
+				checker.PayloadLen(size+header.TCPMinimumSize),
+				checker.TCP(
+					checker.DstPort(context.TestPort),
+					checker.SeqNum(seqNum),
+				),
+			)
+			seqNum += uint32(size)
+		}
+		return first
+	}
+
+	seqNum := uint32(c.IRS) + 1
+	if _, err := c.EP.Write(tcpip.SlicePayload(data[:2*mss+500]), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	receive(seqNum, mss, mss, 500)
+	seqNum += 2*mss + 500
+	c.SendAck(790, 2*mss+500)
+
+	if _, err := c.EP.Write(tcpip.SlicePayload(data[2*mss+500:4*mss+500]), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	first := receive(seqNum, mss, mss)
+
+	// A path MTU below the clamped MSS takes precedence; the outstanding
+	// segments are retransmitted in smaller pieces.
+	const newMTU = 800
+	const newMaxPayload = newMTU - header.IPv4MinimumSize - header.TCPMinimumSize
+	mtu := []byte{0, 0, newMTU / 256, newMTU % 256}
+	c.SendICMPPacket(header.ICMPv4DstUnreachable, header.ICMPv4FragmentationNeeded, mtu, first, newMTU)
+	receive(seqNum, newMaxPayload, mss-newMaxPayload, newMaxPayload, mss-newMaxPayload)
+}
+
+func TestUserTimeoutOption(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	if err := c.EP.SetSockOpt(tcpip.TCPUserTimeoutOption(-1)); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("SetSockOpt(TCPUserTimeoutOption(-1)) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	want := tcpip.TCPUserTimeoutOption(5 * time.Second)
+	if err := c.EP.SetSockOpt(want); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var v tcpip.TCPUserTimeoutOption
+	if err := c.EP.GetSockOpt(&v); err != nil || v != want {
+		t.Fatalf("GetSockOpt(TCPUserTimeoutOption) = %v, %v, want %v, nil", time.Duration(v), err, time.Duration(want))
+	}
+}
+
+func TestUserTimeout(t *testing.T) {
+	clock := testutil.NewManualClock()
+	c := context.NewWithClock(t, defaultMTU, clock)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	if err := c.EP.SetSockOpt(tcpip.TCPUserTimeoutOption(5 * time.Second)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+
+	data := []byte{1, 2, 3}
+	view := buffer.NewView(len(data))
+	copy(view, data)
+	if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// The data is never acknowledged.
+	checker.IPv4(t, c.GetPacket(),
+		checker.PayloadLen(len(data)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.TCPFlagsMatch(header.TCPFlagAck, ^uint8(header.TCPFlagPsh)),
+		),
+	)
+
+	// Once the user timeout has elapsed, the connection is reset when the
+	// retransmit timer fires, instead of retransmitting, even though the
+	// retransmissions are far from having been given up on.
+	advanceClock(t, clock, 6*time.Second)
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.TCPFlagsMatch(header.TCPFlagRst, header.TCPFlagRst),
+		),
+	)
+
+	// Wait for the protocol goroutine to record the error.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != tcpip.ErrTimeout {
+		t.Fatalf("Write returned %v, want %v", err, tcpip.ErrTimeout)
+	}
+}
+
+func TestDeleteNICFailsConnection(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// Leave some data in flight.
+	data := []byte{1, 2, 3}
+	view := buffer.NewView(len(data))
+	copy(view, data)
+	if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checker.IPv4(t, c.GetPacket(),
+		checker.PayloadLen(len(data)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.AckNum(790),
+		),
+	)
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventHUp)
+	defer c.WQ.EventUnregister(&we)
+
+	if err := c.Stack().DeleteNIC(1); err != nil {
+		t.Fatalf("DeleteNIC failed: %v", err)
+	}
+
+	// The connection fails right away rather than when it times out.
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for the connection to fail")
+	}
+	if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != tcpip.ErrNoRoute {
+		t.Errorf("Write after DeleteNIC = %v, want %v", err, tcpip.ErrNoRoute)
+	}
+
+	// Once closed, the endpoint is released.
+	c.EP.Close()
+	c.EP = nil
+	if eps, _ := c.Stack().RegisteredEndpoints(); len(eps) != 0 {
+		t.Errorf("got %d endpoints registered after Close, want 0: %+v", len(eps), eps)
+	}
+}
+
+func TestStackCloseResetsConnections(t *testing.T) {
+	for _, silent := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Silent=%t", silent), func(t *testing.T) {
+			c := context.New(t, defaultMTU)
+			defer c.Cleanup()
+
+			c.CreateConnected(789, 30000, nil)
+
+			c.Stack().Close(stack.CloseOptions{Silent: silent})
+
+			if silent {
+				c.CheckNoPacket("Packet was sent to the peer of a connection dropped silently")
+			} else {
+				checker.IPv4(t, c.GetPacket(),
+					checker.TCP(
+						checker.DstPort(context.TestPort),
+						checker.SeqNum(uint32(c.IRS)+1),
+						checker.AckNum(790),
+						checker.TCPFlagsMatch(header.TCPFlagRst, header.TCPFlagRst),
+					),
+				)
+			}
+
+			if _, _, err := c.EP.Read(nil); err != tcpip.ErrConnectionAborted {
+				t.Errorf("got Read = %v after Close, want %v", err, tcpip.ErrConnectionAborted)
+			}
+		})
+	}
+}
+
+func TestRouteChangeMovesConnection(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// A second NIC with the same address can take over the connection.
+	id, linkEP := channel.New(10, defaultMTU, "")
+	if err := c.Stack().CreateNIC(2, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := c.Stack().AddAddress(2, ipv4.ProtocolNumber, context.StackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	data := []byte{1, 2, 3}
+	write := func() {
+		t.Helper()
+		view := buffer.NewView(len(data))
+		copy(view, data)
+		if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	checkData := func(b []byte, seq uint32) {
+		t.Helper()
+		checker.IPv4(t, b,
+			checker.SrcAddr(context.StackAddr),
+			checker.DstAddr(context.TestAddr),
+			checker.PayloadLen(len(data)+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(seq),
+				checker.AckNum(790),
+			),
+		)
+	}
+
+	write()
+	checkData(c.GetPacket(), uint32(c.IRS)+1)
+	c.SendAck(790, len(data))
+
+	// Once the default route goes through NIC 2, so does the connection.
+	c.Stack().SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         2,
+	}})
+	write()
+	select {
+	case p := <-linkEP.C:
+		checkData(append(append([]byte(nil), p.Header...), p.Payload...), uint32(c.IRS)+1+uint32(len(data)))
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Packet wasn't written out through NIC 2")
+	}
+	c.CheckNoPacket("Packet was written out through NIC 1 after the route changed")
+	c.SendAck(790, 2*len(data))
+
+	// Without a route to the peer, the connection fails.
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventHUp)
+	defer c.WQ.EventUnregister(&we)
+
+	c.Stack().SetRouteTable(nil)
+	write()
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for the connection to fail")
+	}
+	view := buffer.NewView(len(data))
+	if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != tcpip.ErrNoRoute {
+		t.Errorf("Write after removing the route = %v, want %v", err, tcpip.ErrNoRoute)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	data := []byte{1, 2, 3}
+	view := buffer.NewView(len(data))
+	copy(view, data)
+	if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checkData := func() {
+		t.Helper()
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(len(data)+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1),
+				checker.AckNum(790),
+			),
+		)
+	}
+	checkData()
+
+	// Don't acknowledge the data. While the stack is paused, the
+	// retransmit timer doesn't fire, and received segments are dropped.
+	c.Stack().Pause()
+	dropped := c.Stack().MutableStats().DroppedPackets.Value()
+	c.SendPacket(data, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+	if got := c.Stack().MutableStats().DroppedPackets.Value(); got != dropped+1 {
+		t.Errorf("got DroppedPackets = %d, want %d", got, dropped+1)
+	}
+	c.CheckNoPacketTimeout("Packet sent while the stack was paused", 1500*time.Millisecond)
+
+	// Once resumed, the data is retransmitted, and the connection works
+	// as before.
+	c.Stack().Resume()
+	checkData()
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.WQ.EventRegister(&we, waiter.EventIn)
+	defer c.WQ.EventUnregister(&we)
+
+	c.SendPacket(data, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1 + seqnum.Size(len(data))),
+		RcvWnd:  30000,
+	})
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for data to arrive")
+	}
+	if v, _, err := c.EP.Read(nil); err != nil || !bytes.Equal(v, data) {
+		t.Fatalf("Read() = %v, %v, want %v", v, err, data)
+	}
+	checker.IPv4(t, c.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1+uint32(len(data))),
+			checker.AckNum(uint32(790+len(data))),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+}
+
+func TestSaveRestoreConnection(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	write := func(data []byte) {
+		t.Helper()
+		view := buffer.NewView(len(data))
+		copy(view, data)
+		if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	send := func(c *context.Context, data []byte, seq, ack seqnum.Value) {
+		c.SendPacket(data, &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  seq,
+			AckNum:  ack,
+			RcvWnd:  30000,
+		})
+	}
+
+	// Send some acknowledged data, then some that is left unacknowledged.
+	acked := []byte{1, 2, 3}
+	write(acked)
+	c.GetPacket()
+	send(c, nil, 790, c.IRS.Add(1+seqnum.Size(len(acked))))
+
+	unacked := []byte{4, 5, 6, 7}
+	write(unacked)
+	c.GetPacket()
+
+	// Receive data that isn't read, and data past a gap.
+	inOrder := []byte{11, 12, 13}
+	gap := []byte{14, 15}
+	outOfOrder := []byte{16, 17, 18, 19}
+	sndAck := c.IRS.Add(1 + seqnum.Size(len(acked)))
+	send(c, inOrder, 790, sndAck)
+	c.GetPacket()
+	send(c, outOfOrder, seqnum.Value(790+len(inOrder)+len(gap)), sndAck)
+	c.GetPacket()
+
+	c.Stack().Pause()
+	st, err := tcp.SaveConnection(c.EP)
+	if err != nil {
+		t.Fatalf("SaveConnection failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(st); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	var decoded tcp.ConnectionState
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	c2 := context.New(t, defaultMTU)
+	defer c2.Cleanup()
+	c2.Port = c.Port
+
+	ep, err := tcp.RestoreConnection(c2.Stack(), &c2.WQ, &decoded)
+	if err != nil {
+		t.Fatalf("RestoreConnection failed: %v", err)
+	}
+	defer ep.Close()
+
+	// The unacknowledged data is retransmitted by the restored endpoint.
+	rcvNxt := uint32(790 + len(inOrder))
+	checker.IPv4(t, c2.GetPacket(),
+		checker.PayloadLen(len(unacked)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(sndAck)),
+			checker.AckNum(rcvNxt),
+		),
+	)
+	send(c2, nil, seqnum.Value(rcvNxt), sndAck.Add(seqnum.Size(len(unacked))))
+
+	// Filling the gap makes all received data readable.
+	we, ch := waiter.NewChannelEntry(nil)
+	c2.WQ.EventRegister(&we, waiter.EventIn)
+	defer c2.WQ.EventUnregister(&we)
+
+	send(c2, gap, seqnum.Value(rcvNxt), sndAck.Add(seqnum.Size(len(unacked))))
+	checker.IPv4(t, c2.GetPacket(),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(sndAck)+uint32(len(unacked))),
+			checker.AckNum(rcvNxt+uint32(len(gap)+len(outOfOrder))),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+
+	want := append(append(append([]byte(nil), inOrder...), gap...), outOfOrder...)
+	var got []byte
+	for len(got) < len(want) {
+		v, _, err := ep.Read(nil)
+		if err == tcpip.ErrWouldBlock {
+			select {
+			case <-ch:
+			case <-time.After(1 * time.Second):
+				t.Fatalf("Timed out waiting for data, got %v", got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		got = append(got, v...)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got data = %v, want %v", got, want)
+	}
+
+	// New data flows as well.
+	more := []byte{8, 9}
+	view := buffer.NewView(len(more))
+	copy(view, more)
+	if _, err := ep.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checker.IPv4(t, c2.GetPacket(),
+		checker.PayloadLen(len(more)+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(sndAck)+uint32(len(unacked))),
+		),
+	)
+}
+
+func TestSaveRestoreConnectionOptions(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	const key = "secret"
+	const mss = 100
+	const userTimeout = tcpip.TCPUserTimeoutOption(time.Minute)
+	if err := c.EP.SetSockOpt(tcpip.TCPMD5SigOption{Addr: context.TestAddr, Key: []byte(key)}); err != nil {
+		t.Fatalf("SetSockOpt(TCPMD5SigOption) failed: %v", err)
+	}
+	if err := c.EP.SetSockOpt(tcpip.MaxSegOption(mss)); err != nil {
+		t.Fatalf("SetSockOpt(MaxSegOption) failed: %v", err)
+	}
+	if err := c.EP.SetSockOpt(userTimeout); err != nil {
+		t.Fatalf("SetSockOpt(TCPUserTimeoutOption) failed: %v", err)
+	}
+
+	c.Stack().Pause()
+	st, err := tcp.SaveConnection(c.EP)
+	if err != nil {
+		t.Fatalf("SaveConnection failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(st); err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	var decoded tcp.ConnectionState
+	if err := gob.NewDecoder(&buf).Decode(&decoded); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+
+	c2 := context.New(t, defaultMTU)
+	defer c2.Cleanup()
+	c2.Port = c.Port
+
+	ep, err := tcp.RestoreConnection(c2.Stack(), &c2.WQ, &decoded)
+	if err != nil {
+		t.Fatalf("RestoreConnection failed: %v", err)
+	}
+	defer ep.Close()
+
+	var gotMSS tcpip.MaxSegOption
+	if err := ep.GetSockOpt(&gotMSS); err != nil || gotMSS != mss {
+		t.Fatalf("GetSockOpt(MaxSegOption) = %d, %v, want %d, nil", gotMSS, err, mss)
+	}
+	var gotUserTimeout tcpip.TCPUserTimeoutOption
+	if err := ep.GetSockOpt(&gotUserTimeout); err != nil || gotUserTimeout != userTimeout {
+		t.Fatalf("GetSockOpt(TCPUserTimeoutOption) = %v, %v, want %v, nil", gotUserTimeout, err, userTimeout)
+	}
+
+	// Signed data from the peer is accepted, and acknowledged with a
+	// signed segment.
+	we, ch := waiter.NewChannelEntry(nil)
+	c2.WQ.EventRegister(&we, waiter.EventIn)
+	defer c2.WQ.EventUnregister(&we)
+
+	sndNxt := c.IRS.Add(1)
+	data := []byte{1, 2, 3}
+	sendMD5Segment(c2, key, data, 790, sndNxt)
+	p := c2.GetPacket()
+	checker.IPv4(t, p,
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(sndNxt)),
+			checker.AckNum(uint32(790+len(data))),
+			checker.TCPFlags(header.TCPFlagAck),
+		),
+	)
+	checkMD5Signed(t, p, key)
+
+	select {
+	case <-ch:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Timed out waiting for data to arrive")
+	}
+	if v, _, err := ep.Read(nil); err != nil || !bytes.Equal(v, data) {
+		t.Fatalf("Read() = %v, %v, want %v", v, err, data)
+	}
+
+	// Written data is sent in signed segments clamped to the MSS.
+	view := buffer.NewView(mss + mss/2)
+	if _, err := ep.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	seq := uint32(sndNxt)
+	for _, size := range []int{mss, mss / 2} {
+		p := c2.GetPacket()
+		checker.IPv4(t, p,
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(seq),
+			),
+		)
+		if got := len(header.TCP(header.IPv4(p).Payload()).Payload()); got != size {
+			t.Fatalf("got segment of %d bytes, want %d", got, size)
+		}
+		checkMD5Signed(t, p, key)
+		seq += uint32(size)
+	}
+}
+
+func TestEphemeralPortRange(t *testing.T) {
+	c := context.New(t, defaultMTU)
+	defer c.Cleanup()
+
+	const first, last = 60000, 60009
+	if err := c.Stack().SetPortRange(first, last); err != nil {
+		t.Fatalf("SetPortRange failed: %v", err)
+	}
+
+	var wq waiter.Queue
+	for i := 0; i <= last-first; i++ {
+		ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		defer ep.Close()
+		if err := ep.Connect(tcpip.FullAddress{Addr: context.TestAddr, Port: context.TestPort}); err != tcpip.ErrConnectStarted {
+			t.Fatalf("Connect #%d = %v, want %v", i, err, tcpip.ErrConnectStarted)
+		}
+		addr, err := ep.GetLocalAddress()
+		if err != nil {
+			t.Fatalf("GetLocalAddress failed: %v", err)
+		}
+		if addr.Port < first || addr.Port > last {
+			t.Fatalf("got local port %d, want one in [%d, %d]", addr.Port, first, last)
+		}
+	}
+
+	ep, err := c.Stack().NewEndpoint(tcp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Connect(tcpip.FullAddress{Addr: context.TestAddr, Port: context.TestPort}); err != tcpip.ErrNoPortAvailable {
+		t.Fatalf("got Connect = %v, want %v", err, tcpip.ErrNoPortAvailable)
+	}
+}
+
+func TestEarlyRetransmit(t *testing.T) {
+	// The clock never moves, so the retransmit timer can't fire.
+	c := context.NewWithClock(t, defaultMTU, testutil.NewManualClock())
+	defer c.Cleanup()
+
+	c.CreateConnected(789, 30000, nil)
+
+	// Send two segments, which is all the data there is to send.
+	const size = 10
+	for i := 0; i < 2; i++ {
+		view := buffer.NewView(size)
+		if _, err := c.EP.Write(tcpip.SlicePayload(view), tcpip.WriteOptions{}); err != nil {
+			t.Fatalf("Unexpected error from Write: %v", err)
+		}
+
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(size+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1+uint32(i*size)),
+				checker.AckNum(790),
+			),
+		)
+	}
+
+	// The first segment is lost, so the second one only triggers a single
+	// duplicate ack. It must be enough to retransmit the first segment
+	// without waiting for the retransmit timer.
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1),
+		RcvWnd:  30000,
+	})
+
+	checker.IPv4(t, c.GetPacket(),
+		checker.PayloadLen(size+header.TCPMinimumSize),
+		checker.TCP(
+			checker.DstPort(context.TestPort),
+			checker.SeqNum(uint32(c.IRS)+1),
+			checker.AckNum(790),
+		),
+	)
+
+	stats := c.Stack().Stats().TCP
+	if got := stats.Retransmits.Value(); got != 1 {
+		t.Errorf("got stats.TCP.Retransmits.Value() = %d, want 1", got)
+	}
+	if got := stats.Timeouts.Value(); got != 0 {
+		t.Errorf("got stats.TCP.Timeouts.Value() = %d, want 0", got)
+	}
+
+	// Acknowledge all the data.
+	c.SendPacket(nil, &context.Headers{
+		SrcPort: context.TestPort,
+		DstPort: c.Port,
+		Flags:   header.TCPFlagAck,
+		SeqNum:  790,
+		AckNum:  c.IRS.Add(1 + 2*size),
+		RcvWnd:  30000,
+	})
+
+	c.CheckNoPacketTimeout("Unexpected retransmission after ack", 2*time.Second)
+}
+
+func TestLimitedTransmit(t *testing.T) {
+	const maxPayload = 10
+	// The clock never moves, so the retransmit timer can't fire.
+	c := context.NewWithClock(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload), testutil.NewManualClock())
+	defer c.Cleanup()
+
+	states := make(chan stack.TCPEndpointState, 10)
+	c.Stack().AddTCPProbe(func(state stack.TCPEndpointState) {
+		states <- state
+	})
+
+	c.CreateConnected(789, 30000, nil)
+
+	// Write more data than the initial congestion window allows to send.
+	data := buffer.NewView((tcp.InitialCwnd + 4) * maxPayload)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+	for i := 0; i < tcp.InitialCwnd; i++ {
+		c.ReceiveAndCheckPacket(data, i*maxPayload, maxPayload)
+	}
+	c.CheckNoPacketTimeout("More packets received than expected for this cwnd.", 50*time.Millisecond)
+
+	// dupAck sends a duplicate ack and returns the state of the sender
+	// before it handled it.
+	dupAck := func() stack.TCPSenderState {
+		t.Helper()
+		c.SendAck(790, 0)
+		select {
+		case state := <-states:
+			return state.Sender
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the duplicate ack to be processed")
+		}
+		return stack.TCPSenderState{}
+	}
+
+	// The first two duplicate acks each send a new segment, without
+	// reducing the congestion window.
+	for i := 0; i < 2; i++ {
+		if got := dupAck(); got.SndCwnd != tcp.InitialCwnd {
+			t.Fatalf("got cwnd %d before duplicate ack %d, want %d", got.SndCwnd, i+1, tcp.InitialCwnd)
+		}
+		c.ReceiveAndCheckPacket(data, (tcp.InitialCwnd+i)*maxPayload, maxPayload)
+		c.CheckNoPacketTimeout("More than one new segment sent on a duplicate ack.", 50*time.Millisecond)
+	}
+
+	// The third one triggers a fast retransmit, which reduces the window.
+	if got := dupAck(); got.SndCwnd != tcp.InitialCwnd {
+		t.Fatalf("got cwnd %d before duplicate ack 3, want %d", got.SndCwnd, tcp.InitialCwnd)
+	}
+	c.ReceiveAndCheckPacket(data, 0, maxPayload)
+	if got := dupAck(); !got.FastRecovery.Active || got.SndCwnd >= tcp.InitialCwnd {
+		t.Fatalf("got fast recovery %t and cwnd %d after fast retransmit, want fast recovery with cwnd < %d", got.FastRecovery.Active, got.SndCwnd, tcp.InitialCwnd)
+	}
+}
+
+func TestTailLossProbe(t *testing.T) {
+	clock := testutil.NewManualClock()
+	c := context.NewWithClock(t, defaultMTU, clock)
+	defer c.Cleanup()
+
+	if err := c.Stack().SetTransportProtocolOption(tcp.ProtocolNumber, tcp.TailLossProbeEnabled(true)); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+
+	c.CreateConnected(789, 30000, nil)
+
+	const size = 10
+	write := func(i int) {
+		t.Helper()
+		if _, err := c.EP.Write(tcpip.SlicePayload(buffer.NewView(size)), tcpip.WriteOptions{}); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(size+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1+uint32(i*size)),
+			),
+		)
+	}
+	ack := func(n int) {
+		c.SendPacket(nil, &context.Headers{
+			SrcPort: context.TestPort,
+			DstPort: c.Port,
+			Flags:   header.TCPFlagAck,
+			SeqNum:  790,
+			AckNum:  c.IRS.Add(1 + seqnum.Size(n*size)),
+			RcvWnd:  30000,
+		})
+	}
+	checkRetransmit := func(i int) {
+		t.Helper()
+		checker.IPv4(t, c.GetPacket(),
+			checker.PayloadLen(size+header.TCPMinimumSize),
+			checker.TCP(
+				checker.DstPort(context.TestPort),
+				checker.SeqNum(uint32(c.IRS)+1+uint32(i*size)),
+			),
+		)
+	}
+
+	// Measure a round-trip time of 10ms with the first segment, while
+	// sending three more. The acknowledgement of the first two leaves an
+	// SRTT of 10ms, hence a probe timeout of 20ms, and an RTO of 200ms.
+	write(0)
+	clock.Advance(10 * time.Millisecond)
+	for i := 1; i < 4; i++ {
+		write(i)
+	}
+	ack(2)
+
+	// The last two segments are lost. The probe retransmits the last one
+	// once the probe timeout has elapsed.
+	advanceClock(t, clock, 20*time.Millisecond)
+	checkRetransmit(3)
+
+	stats := c.Stack().Stats().TCP
+	if got := stats.TailLossProbes.Value(); got != 1 {
+		t.Errorf("got stats.TCP.TailLossProbes.Value() = %d, want 1", got)
+	}
+	if got := stats.Timeouts.Value(); got != 0 {
+		t.Errorf("got stats.TCP.Timeouts.Value() = %d, want 0", got)
+	}
+
+	// The peer acknowledges the probe with a duplicate ack, which is
+	// enough to retransmit the other lost segment with early retransmit.
+	ack(2)
+	checkRetransmit(2)
+	ack(4)
+
+	stats = c.Stack().Stats().TCP
+	if got := stats.Retransmits.Value(); got != 2 {
+		t.Errorf("got stats.TCP.Retransmits.Value() = %d, want 2", got)
+	}
+	if got := stats.Timeouts.Value(); got != 0 {
+		t.Errorf("got stats.TCP.Timeouts.Value() = %d, want 0", got)
+	}
+}
+
+func TestFRTO(t *testing.T) {
+	const maxPayload = 10
+	for _, spurious := range []bool{true, false} {
+		t.Run(fmt.Sprintf("spurious=%t", spurious), func(t *testing.T) {
+			clock := testutil.NewManualClock()
+			c := context.NewWithClock(t, uint32(header.TCPMinimumSize+header.IPv4MinimumSize+maxPayload), clock)
+			defer c.Cleanup()
+
+			if err := c.Stack().SetTransportProtocolOption(tcp.ProtocolNumber, tcp.FRTOEnabled(true)); err != nil {
+				t.Fatalf("SetTransportProtocolOption failed: %v", err)
+			}
+
+			c.CreateConnected(789, 30000, nil)
+
+			// Write more data than the initial congestion window
+			// allows to send.
+			data := buffer.NewView((tcp.InitialCwnd + 4) * maxPayload)
+			for i := range data {
+				data[i] = byte(i)
+			}
+			if _, err := c.EP.Write(tcpip.SlicePayload(data), tcpip.WriteOptions{}); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			for i := 0; i < tcp.InitialCwnd; i++ {
+				c.ReceiveAndCheckPacket(data, i*maxPayload, maxPayload)
+			}
+
+			// No ack arrives within the initial RTO, so the first
+			// segment is retransmitted, and only it.
+			advanceClock(t, clock, time.Second)
+			c.ReceiveAndCheckPacket(data, 0, maxPayload)
+			c.CheckNoPacketTimeout("More than one segment retransmitted on timeout.", 50*time.Millisecond)
+
+			// The first ack after the timeout acknowledges the
+			// retransmitted segment, and the one after it too if the
+			// timeout is spurious. Rather than retransmitting, two
+			// new segments are sent.
+			acked := 1
+			if spurious {
+				acked = 2
+			}
+			c.SendAck(790, acked*maxPayload)
+			c.ReceiveAndCheckPacket(data, tcp.InitialCwnd*maxPayload, maxPayload)
+			c.ReceiveAndCheckPacket(data, (tcp.InitialCwnd+1)*maxPayload, maxPayload)
+			c.CheckNoPacketTimeout("More than two segments sent on the first ack after a timeout.", 50*time.Millisecond)
+
+			if !spurious {
+				// The segments sent before the timeout were lost,
+				// so the peer acknowledges the new ones with
+				// duplicate acks, and the lost segments are
+				// retransmitted.
+				c.SendAck(790, acked*maxPayload)
+				c.ReceiveAndCheckPacket(data, maxPayload, maxPayload)
+				c.ReceiveAndCheckPacket(data, 2*maxPayload, maxPayload)
+				if got := c.Stack().MutableStats().TCP.SpuriousTimeouts.Value(); got != 0 {
+					t.Errorf("got stats.TCP.SpuriousTimeouts.Value() = %d, want 0", got)
+				}
+				return
+			}
+
+			// The delayed acks of the segments sent before the
+			// timeout keep on arriving, which shows the timeout was
+			// spurious. The rest of the new data is sent, and none
+			// of the old data is retransmitted.
+			c.SendAck(790, 5*maxPayload)
+			c.ReceiveAndCheckPacket(data, (tcp.InitialCwnd+2)*maxPayload, maxPayload)
+			c.ReceiveAndCheckPacket(data, (tcp.InitialCwnd+3)*maxPayload, maxPayload)
+			c.SendAck(790, len(data))
+			c.CheckNoPacketTimeout("Data retransmitted after a spurious timeout.", 50*time.Millisecond)
+
+			stats := c.Stack().Stats().TCP
+			if got := stats.SpuriousTimeouts.Value(); got != 1 {
+				t.Errorf("got stats.TCP.SpuriousTimeouts.Value() = %d, want 1", got)
+			}
+			if got := stats.Timeouts.Value(); got != 1 {
+				t.Errorf("got stats.TCP.Timeouts.Value() = %d, want 1", got)
+			}
+		})
+	}
+}
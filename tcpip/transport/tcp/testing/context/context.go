@@ -129,7 +129,12 @@ type Context struct {
 // New allocates and initializes a test context containing a new
 // stack and a link-layer endpoint.
 func New(t *testing.T, mtu uint32) *Context {
-	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{tcp.ProtocolName})
+	return NewWithClock(t, mtu, &tcpip.StdClock{})
+}
+
+// NewWithClock is like New, but the stack uses the given clock.
+func NewWithClock(t *testing.T, mtu uint32, clock tcpip.Clock) *Context {
+	s := stack.New(clock, []string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{tcp.ProtocolName})
 
 	// Allow minimum send/receive buffer sizes to be 1 during tests.
 	if err := s.SetTransportProtocolOption(tcp.ProtocolNumber, tcp.SendBufferSizeOption{1, tcp.DefaultBufferSize, tcp.DefaultBufferSize * 10}); err != nil {
@@ -267,6 +272,12 @@ func (c *Context) SendICMPPacket(typ header.ICMPv4Type, code uint8, p1, p2 []byt
 // SendPacket builds and sends a TCP segment(with the provided payload & TCP
 // headers) in an IPv4 packet via the link layer endpoint.
 func (c *Context) SendPacket(payload []byte, h *Headers) {
+	c.SendSegment(c.BuildSegment(payload, h))
+}
+
+// BuildSegment builds a TCP segment(with the provided payload & TCP headers)
+// in an IPv4 packet, without sending it.
+func (c *Context) BuildSegment(payload []byte, h *Headers) buffer.View {
 	// Allocate a buffer for data and headers.
 	buf := buffer.NewView(header.TCPMinimumSize + header.IPv4MinimumSize + len(h.TCPOpts) + len(payload))
 	copy(buf[len(buf)-len(payload):], payload)
@@ -306,10 +317,26 @@ func (c *Context) SendPacket(payload []byte, h *Headers) {
 	xsum = header.Checksum(payload, xsum)
 	t.SetChecksum(^t.CalculateChecksum(xsum, length))
 
-	// Inject packet.
+	return buf
+}
+
+// SendSegment sends an IPv4 packet built by BuildSegment via the link layer
+// endpoint.
+func (c *Context) SendSegment(s buffer.View) {
 	var views [1]buffer.View
-	vv := buf.ToVectorisedView(views)
+	vv := s.ToVectorisedView(views)
+	c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+}
+
+// SendSegmentInBuffer is like SendSegment, with the packet read into the link
+// buffer buf. The reference buf holds is handed over to the stack, along with
+// the packet, and released once it's delivered.
+func (c *Context) SendSegmentInBuffer(s buffer.View, buf *buffer.PacketBuffer) {
+	var views [1]buffer.View
+	vv := s.ToVectorisedView(views)
+	vv.SetBuffer(buf)
 	c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+	vv.Release()
 }
 
 // SendAck sends an ACK packet.
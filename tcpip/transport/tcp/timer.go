@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/google/netstack/sleep"
+	"github.com/google/netstack/tcpip"
 )
 
 type timerState int
@@ -15,13 +16,14 @@ type timerState int
 const (
 	timerStateDisabled timerState = iota
 	timerStateEnabled
-	timerStateOrphaned
+	timerStateExpired
 )
 
-// timer is a timer implementation that reduces the interactions with the
-// runtime timer infrastructure by letting timers run (and potentially
-// eventually expire) even if they are stopped. It makes it cheaper to
-// disable/reenable timers at the expense of spurious wakes. This is useful for
+// timerGroup multiplexes the timers of an endpoint onto a single runtime timer,
+// set to expire when the first of them does. An idle endpoint, with none of its
+// timers enabled, has no runtime timer programmed, and enabling and disabling
+// timers rarely interacts with the runtime: timers are left to expire even if
+// they are disabled, at the expense of spurious wakes. This is useful for
 // cases when the same timer is disabled/reenabled repeatedly with relatively
 // long timeouts farther into the future.
 //
@@ -34,98 +36,164 @@ const (
 // of timers, whenever a timer is enabled or disabled, and may make a syscall.
 //
 // This struct is thread-compatible.
+type timerGroup struct {
+	// clock provides the time and the runtime timer.
+	clock tcpip.Clock
+
+	// waker is asserted when the runtime timer expires, after which fire
+	// must be called.
+	waker sleep.Waker
+
+	// timer is the runtime timer, created the first time a timer of the
+	// group is enabled. It's pending if scheduled is set, in which case
+	// it expires at runtimeTarget, which may be earlier than the
+	// expiration time of all the timers, if the first one to expire was
+	// disabled or reenabled since.
+	timer         tcpip.Timer
+	scheduled     bool
+	runtimeTarget time.Time
+
+	// timers are the timers of the group.
+	timers []*timer
+}
+
+// init initializes the group, whose timers measure time with the given clock.
+func (g *timerGroup) init(clock tcpip.Clock) {
+	g.clock = clock
+}
+
+// now returns the current time according to the clock of the group.
+func (g *timerGroup) now() time.Time {
+	return time.Unix(0, g.clock.NowNanoseconds())
+}
+
+// schedule sets the runtime timer to expire at target, unless it's already set
+// to expire earlier.
+func (g *timerGroup) schedule(target time.Time) {
+	if g.scheduled && !target.Before(g.runtimeTarget) {
+		return
+	}
+	g.scheduled = true
+	g.runtimeTarget = target
+	d := target.Sub(g.now())
+	if g.timer == nil {
+		g.timer = g.clock.AfterFunc(d, g.waker.Assert)
+		return
+	}
+	g.timer.Reset(d)
+}
+
+// fire is called when the waker of the group is asserted. It asserts the wakers
+// of the timers that have expired, and sets the runtime timer to expire when
+// the next one does.
+func (g *timerGroup) fire() {
+	g.scheduled = false
+
+	now := g.now()
+	var next time.Time
+	for _, t := range g.timers {
+		if t.state != timerStateEnabled {
+			continue
+		}
+		if !now.Before(t.target) {
+			t.state = timerStateExpired
+			t.waker.Assert()
+			continue
+		}
+		if next.IsZero() || t.target.Before(next) {
+			next = t.target
+		}
+	}
+	if !next.IsZero() {
+		g.schedule(next)
+	}
+}
+
+// cleanup frees all resources associated with the group.
+func (g *timerGroup) cleanup() {
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+}
+
+// pause stops the runtime timer, so that the timers don't expire until resume
+// is called.
+func (g *timerGroup) pause() {
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+}
+
+// resume restarts the timers stopped by pause, pushing their expiration times
+// back by d, the duration of the pause.
+func (g *timerGroup) resume(d time.Duration) {
+	for _, t := range g.timers {
+		if t.state == timerStateEnabled {
+			t.target = t.target.Add(d)
+		}
+	}
+	if g.scheduled {
+		g.runtimeTarget = g.runtimeTarget.Add(d)
+		g.timer.Reset(g.runtimeTarget.Sub(g.now()))
+	}
+}
+
+// timer is a timer of a timerGroup. Once it expires, its waker is asserted,
+// and checkExpiration tells whether it's still expired when the waker is
+// handled.
+//
+// This struct is thread-compatible, and must be used along with its group.
 type timer struct {
+	group *timerGroup
+	waker *sleep.Waker
+
 	// state is the current state of the timer, it can be one of the
 	// following values:
 	//     disabled - the timer is disabled.
-	//     orphaned - the timer is disabled, but the runtime timer is
-	//                enabled, which means that it will evetually cause a
-	//                spurious wake (unless it gets enabled again before
-	//                then).
-	//     enabled  - the timer is enabled, but the runtime timer may be set
-	//                to an earlier expiration time due to a previous
-	//                orphaned state.
+	//     enabled  - the timer is enabled, and expires at target.
+	//     expired  - the timer has expired, and its waker was asserted.
 	state timerState
 
 	// target is the expiration time of the current timer. It is only
 	// meaningful in the enabled state.
 	target time.Time
-
-	// runtimeTarget is the expiration time of the runtime timer. It is
-	// meaningful in the enabled and orphaned states.
-	runtimeTarget time.Time
-
-	// timer is the runtime timer used to wait on.
-	timer *time.Timer
 }
 
-// init initializes the timer. Once it expires, it the given waker will be
-// asserted.
-func (t *timer) init(w *sleep.Waker) {
+// init adds the timer to the given group. Once it expires, the given waker will
+// be asserted.
+func (t *timer) init(g *timerGroup, w *sleep.Waker) {
+	t.group = g
+	t.waker = w
 	t.state = timerStateDisabled
-
-	// Initialize a runtime timer that will assert the waker, then
-	// immediately stop it.
-	t.timer = time.AfterFunc(time.Hour, func() {
-		w.Assert()
-	})
-	t.timer.Stop()
-}
-
-// cleanup frees all resources associated with the timer.
-func (t *timer) cleanup() {
-	t.timer.Stop()
+	g.timers = append(g.timers, t)
 }
 
 // checkExpiration checks if the given timer has actually expired, it should be
 // called whenever a sleeper wakes up due to the waker being asserted, and is
-// used to check if it's a supurious wake (due to a previously orphaned timer)
-// or a legitimate one.
+// used to check if the timer was disabled or reenabled since it expired.
 func (t *timer) checkExpiration() bool {
-	// Transition to fully disabled state if we're just consuming an
-	// orphaned timer.
-	if t.state == timerStateOrphaned {
-		t.state = timerStateDisabled
+	if t.state != timerStateExpired {
 		return false
 	}
-
-	// The timer is enabled, but it may have expired early. Check if that's
-	// the case, and if so, reset the runtime timer to the correct time.
-	now := time.Now()
-	if now.Before(t.target) {
-		t.runtimeTarget = t.target
-		t.timer.Reset(t.target.Sub(now))
-		return false
-	}
-
-	// The timer has actually expired, disable it for now and inform the
-	// caller.
 	t.state = timerStateDisabled
 	return true
 }
 
-// disable disables the timer, leaving it in an orphaned state if it wasn't
-// already disabled.
+// disable disables the timer. The runtime timer is left as is, which may
+// eventually cause a spurious wake of the group.
 func (t *timer) disable() {
-	if t.state != timerStateDisabled {
-		t.state = timerStateOrphaned
-	}
+	t.state = timerStateDisabled
 }
 
-// enabled returns true if the timer is currently enabled, false otherwise.
+// enabled returns true if the timer is currently enabled, or has expired but
+// checkExpiration wasn't called yet, false otherwise.
 func (t *timer) enabled() bool {
-	return t.state == timerStateEnabled
+	return t.state != timerStateDisabled
 }
 
 // enable enables the timer, programming the runtime timer if necessary.
 func (t *timer) enable(d time.Duration) {
-	t.target = time.Now().Add(d)
-
-	// Check if we need to set the runtime timer.
-	if t.state == timerStateDisabled || t.target.Before(t.runtimeTarget) {
-		t.runtimeTarget = t.target
-		t.timer.Reset(d)
-	}
-
+	t.target = t.group.now().Add(d)
 	t.state = timerStateEnabled
+	t.group.schedule(t.target)
 }
@@ -6,6 +6,7 @@ package udp
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/google/netstack/sleep"
 	"github.com/google/netstack/tcpip"
@@ -26,6 +27,14 @@ type udpPacket struct {
 	views [8]buffer.View
 }
 
+// packetPool recycles the datagrams consumed by Read, so that receiving a
+// datagram doesn't allocate one.
+var packetPool = sync.Pool{
+	New: func() interface{} {
+		return &udpPacket{}
+	},
+}
+
 type endpointState int
 
 const (
@@ -35,6 +44,22 @@ const (
 	stateClosed
 )
 
+// String implements fmt.Stringer.String.
+func (s endpointState) String() string {
+	switch s {
+	case stateInitial:
+		return "INITIAL"
+	case stateBound:
+		return "BOUND"
+	case stateConnected:
+		return "CONNECTED"
+	case stateClosed:
+		return "CLOSED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
 // endpoint represents a UDP endpoint. This struct serves as the interface
 // between users of the endpoint and the protocol implementation; it is legal to
 // have concurrent goroutines make calls into the endpoint, they are properly
@@ -43,6 +68,7 @@ type endpoint struct {
 	// The following fields are initialized at creation time and do not
 	// change throughout the lifetime of the endpoint.
 	stack       *stack.Stack
+	protocol    *protocol
 	netProto    tcpip.NetworkProtocolNumber
 	waiterQueue *waiter.Queue
 
@@ -67,6 +93,25 @@ type endpoint struct {
 	route      stack.Route
 	dstPort    uint16
 	v6only     bool
+	flowLabel  uint32
+	tos        uint8
+	ttl        uint8
+	priority   uint8
+
+	// reuseAddr is whether the endpoint may share its local address and
+	// port with other endpoints that set ReuseAddressOption. It is
+	// applied when the endpoint is bound.
+	reuseAddr bool
+
+	// bindID and bindNetProtos are the ID and network protocols the
+	// endpoint was registered with when it was bound. They are restored
+	// when a connected endpoint is disconnected.
+	bindID        stack.TransportEndpointID
+	bindNetProtos []tcpip.NetworkProtocolNumber
+
+	// bindToDevice is the NIC set with BindToDeviceOption, if any. It
+	// is also stored in bindNICID, which it keeps Bind from changing.
+	bindToDevice tcpip.NICID
 
 	// effectiveNetProtos contains the network protocols actually in use. In
 	// most cases it will only contain "netProto", but in cases like IPv6
@@ -75,11 +120,33 @@ type endpoint struct {
 	// IPv4 when IPv6 endpoint is bound or connected to an IPv4 mapped
 	// address).
 	effectiveNetProtos []tcpip.NetworkProtocolNumber
+
+	// clones is the number of references to the endpoint returned by
+	// Clone that haven't been closed yet. The endpoint is only closed by
+	// its last reference.
+	clones int
+
+	// sendRoute caches the route of the last datagram written to an
+	// explicit destination, which was found for sendRouteKey, so that
+	// datagrams sent to the same destination don't search the route table
+	// again while the route is valid. They are protected by sendRouteMu.
+	sendRouteMu  sync.Mutex
+	sendRoute    stack.Route
+	sendRouteKey sendRouteKey
+}
+
+// sendRouteKey holds the arguments to FindRoute that found a cached route.
+type sendRouteKey struct {
+	nicid    tcpip.NICID
+	local    tcpip.Address
+	remote   tcpip.Address
+	netProto tcpip.NetworkProtocolNumber
 }
 
-func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
+func newEndpoint(stack *stack.Stack, p *protocol, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) *endpoint {
 	return &endpoint{
 		stack:         stack,
+		protocol:      p,
 		netProto:      netProto,
 		waiterQueue:   waiterQueue,
 		rcvBufSizeMax: 32 * 1024,
@@ -90,10 +157,11 @@ func newEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waite
 // NewConnectedEndpoint creates a new endpoint in the connected state using the
 // provided route.
 func NewConnectedEndpoint(stack *stack.Stack, r *stack.Route, id stack.TransportEndpointID, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
-	ep := newEndpoint(stack, r.NetProto, waiterQueue)
+	p, _ := stack.TransportProtocolInstance(ProtocolNumber).(*protocol)
+	ep := newEndpoint(stack, p, r.NetProto, waiterQueue)
 
 	// Register new endpoint so that packets are routed to it.
-	if err := stack.RegisterTransportEndpoint(r.NICID(), []tcpip.NetworkProtocolNumber{r.NetProto}, ProtocolNumber, id, ep); err != nil {
+	if err := stack.RegisterTransportEndpoint(r.NICID(), []tcpip.NetworkProtocolNumber{r.NetProto}, ProtocolNumber, id, ep, false); err != nil {
 		ep.Close()
 		return nil, err
 	}
@@ -102,6 +170,7 @@ func NewConnectedEndpoint(stack *stack.Stack, r *stack.Route, id stack.Transport
 	ep.route = r.Clone()
 	ep.dstPort = id.RemotePort
 	ep.regNICID = r.NICID()
+	ep.effectiveNetProtos = []tcpip.NetworkProtocolNumber{r.NetProto}
 
 	ep.state = stateConnected
 
@@ -114,9 +183,15 @@ func (e *endpoint) Close() {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	// Only close the endpoint once it is its last reference.
+	if e.clones > 0 {
+		e.clones--
+		return
+	}
+
 	switch e.state {
 	case stateBound, stateConnected:
-		e.stack.UnregisterTransportEndpoint(e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id)
+		e.stack.UnregisterTransportEndpoint(e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
 	}
 
 	// Close the receive list and drain it.
@@ -126,18 +201,128 @@ func (e *endpoint) Close() {
 	for !e.rcvList.Empty() {
 		p := e.rcvList.Front()
 		e.rcvList.Remove(p)
+		p.data.Release()
 	}
 	e.rcvMu.Unlock()
 
 	e.route.Release()
 
+	e.sendRouteMu.Lock()
+	e.sendRoute.Release()
+	e.sendRouteMu.Unlock()
+
 	// Update the state.
 	e.state = stateClosed
 }
 
+// routeTo returns a route to the given remote address, like FindRoute, which
+// is reused while it's valid if datagrams keep being sent to the same
+// destination. The route must be released by the caller.
+func (e *endpoint) routeTo(nicid tcpip.NICID, remote tcpip.Address, netProto tcpip.NetworkProtocolNumber) (stack.Route, *tcpip.Error) {
+	key := sendRouteKey{
+		nicid:    nicid,
+		local:    e.bindAddr,
+		remote:   remote,
+		netProto: netProto,
+	}
+
+	e.sendRouteMu.Lock()
+	defer e.sendRouteMu.Unlock()
+
+	if e.sendRouteKey != key || !e.sendRoute.IsValid() {
+		// The cached route is released even if no route is found, so
+		// that it doesn't keep its address in use.
+		e.sendRoute.Release()
+		r, err := e.stack.FindRoute(nicid, e.bindAddr, remote, netProto)
+		if err != nil {
+			return stack.Route{}, err
+		}
+		e.sendRoute = r
+		e.sendRouteKey = key
+	}
+	return e.sendRoute.Clone(), nil
+}
+
+// Clone implements tcpip.CloneableEndpoint.Clone. Only bound endpoints can be
+// cloned.
+func (e *endpoint) Clone() (tcpip.Endpoint, *tcpip.Error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state != stateBound {
+		return nil, tcpip.ErrInvalidEndpointState
+	}
+
+	e.clones++
+	return &endpointClone{endpoint: e}, nil
+}
+
+// endpointClone is a reference to an endpoint returned by Clone.
+type endpointClone struct {
+	*endpoint
+
+	// closed is set atomically when the reference is closed, so that it
+	// only releases the endpoint once.
+	closed uint32
+}
+
+// Close implements tcpip.Endpoint.Close.
+func (c *endpointClone) Close() {
+	if atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		c.endpoint.Close()
+	}
+}
+
 // Read reads data from the endpoint. This method does not block if
 // there is no data pending.
+//
+// Each call returns a single datagram, zero-length datagrams are returned as
+// empty views with a nil error.
 func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, tcpip.ControlMessages, *tcpip.Error) {
+	p, cm, err := e.readPacket(addr)
+	if err != nil {
+		return buffer.View{}, cm, err
+	}
+
+	v := p.data.ToView()
+	p.data.Release()
+
+	// Unlike ReadView, Read doesn't hand the views of the datagram out, so
+	// it can be recycled.
+	*p = udpPacket{}
+	packetPool.Put(p)
+	return v, cm, nil
+}
+
+// ReadView implements tcpip.ViewEndpoint.ReadView. The datagram is returned
+// along with the reference the endpoint held to its PacketBuffer.
+func (e *endpoint) ReadView(_ int, addr *tcpip.FullAddress) (buffer.VectorisedView, tcpip.ControlMessages, *tcpip.Error) {
+	p, cm, err := e.readPacket(addr)
+	if err != nil {
+		return buffer.VectorisedView{}, cm, err
+	}
+	return p.data, cm, nil
+}
+
+// PeekView implements tcpip.ViewEndpoint.PeekView.
+func (e *endpoint) PeekView(int) (buffer.VectorisedView, tcpip.ControlMessages, *tcpip.Error) {
+	e.rcvMu.Lock()
+	defer e.rcvMu.Unlock()
+
+	if e.rcvList.Empty() {
+		if e.rcvClosed {
+			return buffer.VectorisedView{}, tcpip.ControlMessages{}, tcpip.ErrClosedForReceive
+		}
+		return buffer.VectorisedView{}, tcpip.ControlMessages{}, tcpip.ErrWouldBlock
+	}
+
+	p := e.rcvList.Front()
+	return p.data.Clone(nil), e.controlMessages(p, e.rcvTimestamp), nil
+}
+
+// readPacket removes the first datagram from the receive queue, storing its
+// sender in addr if not nil.
+func (e *endpoint) readPacket(addr *tcpip.FullAddress) (*udpPacket, tcpip.ControlMessages, *tcpip.Error) {
 	e.rcvMu.Lock()
 
 	if e.rcvList.Empty() {
@@ -146,7 +331,7 @@ func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, tcpip.ControlMess
 			err = tcpip.ErrClosedForReceive
 		}
 		e.rcvMu.Unlock()
-		return buffer.View{}, tcpip.ControlMessages{}, err
+		return nil, tcpip.ControlMessages{}, err
 	}
 
 	p := e.rcvList.Front()
@@ -160,12 +345,22 @@ func (e *endpoint) Read(addr *tcpip.FullAddress) (buffer.View, tcpip.ControlMess
 		*addr = p.senderAddress
 	}
 
-	if ts && !p.hasTimestamp {
+	return p, e.controlMessages(p, ts), nil
+}
+
+// controlMessages returns the control messages of the datagram p for a reader,
+// including its receive timestamp if ts is set.
+func (e *endpoint) controlMessages(p *udpPacket, ts bool) tcpip.ControlMessages {
+	if !ts {
+		return tcpip.ControlMessages{}
+	}
+	if !p.hasTimestamp {
+		// The datagram was received before timestamps were enabled.
 		// Linux uses the current time.
 		p.timestamp = e.stack.NowNanoseconds()
+		p.hasTimestamp = true
 	}
-
-	return p.data.ToView(), tcpip.ControlMessages{HasTimestamp: ts, Timestamp: p.timestamp}, nil
+	return tcpip.ControlMessages{HasTimestamp: true, Timestamp: p.timestamp}
 }
 
 // prepareForWrite prepares the endpoint for sending data. In particular, it
@@ -239,9 +434,9 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, *tc
 		route = &e.route
 		dstPort = e.dstPort
 
-		if route.IsResolutionRequired() {
+		if !route.IsValid() || route.IsResolutionRequired() {
 			// Promote lock to exclusive if using a shared route, given that it may need to
-			// change in Route.Resolve() call below.
+			// change in Route.Refresh() or Route.Resolve() calls below.
 			e.mu.RUnlock()
 			defer e.mu.RLock()
 
@@ -252,6 +447,14 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, *tc
 			if e.state != stateConnected {
 				return 0, tcpip.ErrInvalidEndpointState
 			}
+
+			// The routing configuration changed since the endpoint
+			// connected, so the route to the peer is found again.
+			if !route.IsValid() {
+				if err := route.Refresh(e.regNICID); err != nil {
+					return 0, err
+				}
+			}
 		}
 	} else {
 		// Reject destination address if it goes through a different
@@ -273,12 +476,16 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, *tc
 		}
 
 		// Find the enpoint.
-		r, err := e.stack.FindRoute(nicid, e.bindAddr, to.Addr, netProto)
+		r, err := e.routeTo(nicid, to.Addr, netProto)
 		if err != nil {
 			return 0, err
 		}
 		defer r.Release()
 
+		r.FlowLabel = e.flowLabel
+		r.TOS = e.tos
+		r.Priority = e.priority
+		r.TTL = e.ttl
 		route = &r
 		dstPort = to.Port
 	}
@@ -303,7 +510,7 @@ func (e *endpoint) Write(p tcpip.Payload, opts tcpip.WriteOptions) (uintptr, *tc
 	if err != nil {
 		return 0, err
 	}
-	sendUDP(route, v, e.id.LocalPort, dstPort)
+	sendUDP(route, v, e.id.LocalPort, dstPort, e.checksumRequired(route))
 	return uintptr(len(v)), nil
 }
 
@@ -332,10 +539,75 @@ func (e *endpoint) SetSockOpt(opt interface{}) *tcpip.Error {
 
 		e.v6only = v != 0
 
+	case tcpip.BindToDeviceOption:
+		nicid := tcpip.NICID(v)
+		if nicid != 0 && !e.stack.CheckNIC(nicid) {
+			return tcpip.ErrUnknownNICID
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		// We only allow this to be set when we're in the initial state.
+		if e.state != stateInitial {
+			return tcpip.ErrInvalidEndpointState
+		}
+
+		e.bindToDevice = nicid
+		e.bindNICID = nicid
+
+	case tcpip.ReuseAddressOption:
+		e.mu.Lock()
+		e.reuseAddr = v != 0
+		e.mu.Unlock()
+
+	case tcpip.IPv6FlowInfoOption:
+		// We only recognize this option on v6 endpoints.
+		if e.netProto != header.IPv6ProtocolNumber {
+			return tcpip.ErrInvalidEndpointState
+		}
+		if v&^header.IPv6FlowLabelMask != 0 {
+			return tcpip.ErrInvalidOptionValue
+		}
+
+		e.mu.Lock()
+		e.flowLabel = uint32(v)
+		if e.state == stateConnected {
+			e.route.FlowLabel = e.flowLabel
+		}
+		e.mu.Unlock()
+
+	case tcpip.TOSOption:
+		e.mu.Lock()
+		e.tos = uint8(v)
+		if e.state == stateConnected {
+			e.route.TOS = e.tos
+		}
+		e.mu.Unlock()
+
+	case tcpip.PriorityOption:
+		e.mu.Lock()
+		e.priority = uint8(v)
+		if e.state == stateConnected {
+			e.route.Priority = e.priority
+		}
+		e.mu.Unlock()
+
+	case tcpip.TTLOption:
+		e.mu.Lock()
+		e.ttl = uint8(v)
+		if e.state == stateConnected {
+			e.route.TTL = e.ttl
+		}
+		e.mu.Unlock()
+
 	case tcpip.TimestampOption:
 		e.rcvMu.Lock()
 		e.rcvTimestamp = v != 0
 		e.rcvMu.Unlock()
+
+	case tcpip.MigrateRemoteOption:
+		return e.migrate(v.Remote)
 	}
 	return nil
 }
@@ -358,6 +630,23 @@ func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
 		e.rcvMu.Unlock()
 		return nil
 
+	case *tcpip.BindToDeviceOption:
+		e.mu.RLock()
+		*o = tcpip.BindToDeviceOption(e.bindToDevice)
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.ReuseAddressOption:
+		e.mu.RLock()
+		v := e.reuseAddr
+		e.mu.RUnlock()
+
+		*o = 0
+		if v {
+			*o = 1
+		}
+		return nil
+
 	case *tcpip.V6OnlyOption:
 		// We only recognize this option on v6 endpoints.
 		if e.netProto != header.IPv6ProtocolNumber {
@@ -374,6 +663,35 @@ func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
 		}
 		return nil
 
+	case *tcpip.IPv6FlowInfoOption:
+		// We only recognize this option on v6 endpoints.
+		if e.netProto != header.IPv6ProtocolNumber {
+			return tcpip.ErrUnknownProtocolOption
+		}
+
+		e.mu.RLock()
+		*o = tcpip.IPv6FlowInfoOption(e.flowLabel)
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.TOSOption:
+		e.mu.RLock()
+		*o = tcpip.TOSOption(e.tos)
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.PriorityOption:
+		e.mu.RLock()
+		*o = tcpip.PriorityOption(e.priority)
+		e.mu.RUnlock()
+		return nil
+
+	case *tcpip.TTLOption:
+		e.mu.RLock()
+		*o = tcpip.TTLOption(e.ttl)
+		e.mu.RUnlock()
+		return nil
+
 	case *tcpip.ReceiveQueueSizeOption:
 		e.rcvMu.Lock()
 		if e.rcvList.Empty() {
@@ -392,16 +710,28 @@ func (e *endpoint) GetSockOpt(opt interface{}) *tcpip.Error {
 			*o = 1
 		}
 		e.rcvMu.Unlock()
+		return nil
 	}
 
 	return tcpip.ErrUnknownProtocolOption
 }
 
+// checksumRequired returns whether datagrams sent on the given route must carry
+// a checksum, which is the case unless NoChecksumOption is enabled and the
+// route is an IPv4 one.
+func (e *endpoint) checksumRequired(r *stack.Route) bool {
+	if r.NetProto == header.IPv6ProtocolNumber || e.protocol == nil {
+		return true
+	}
+	return atomic.LoadUint32(&e.protocol.noChecksum) == 0
+}
+
 // sendUDP sends a UDP segment via the provided network endpoint and under the
-// provided identity.
-func sendUDP(r *stack.Route, data buffer.View, localPort, remotePort uint16) *tcpip.Error {
-	// Allocate a buffer for the UDP header.
-	hdr := buffer.NewPrependable(header.UDPMinimumSize + int(r.MaxHeaderLength()))
+// provided identity. The checksum is left zero if checksum is false.
+func sendUDP(r *stack.Route, data buffer.View, localPort, remotePort uint16, checksum bool) *tcpip.Error {
+	// Get a buffer for the UDP header.
+	hdr := r.NewHeader(header.UDPMinimumSize)
+	defer hdr.Release()
 
 	// Initialize the header.
 	udp := header.UDP(hdr.Prepend(header.UDPMinimumSize))
@@ -413,17 +743,29 @@ func sendUDP(r *stack.Route, data buffer.View, localPort, remotePort uint16) *tc
 		Length:  length,
 	})
 
-	// Only calculate the checksum if offloading isn't supported.
-	if r.Capabilities()&stack.CapabilityChecksumOffload == 0 {
+	// Only calculate the checksum if offloading isn't supported. If the
+	// link endpoint can complete it, only fill in the pseudo-header part.
+	var csum *stack.PartialChecksum
+	if caps := r.Capabilities(); checksum && caps&stack.CapabilityChecksumOffload == 0 {
 		xsum := r.PseudoHeaderChecksum(ProtocolNumber)
-		if data != nil {
-			xsum = header.Checksum(data, xsum)
+		if caps&stack.CapabilityTXChecksumOffload != 0 {
+			udp.SetChecksum(header.PseudoHeaderChecksumWithLength(xsum, length))
+			csum = &stack.PartialChecksum{ChecksumOffset: header.UDPChecksumOffset}
+		} else {
+			if data != nil {
+				xsum = header.Checksum(data, xsum)
+			}
+
+			udp.SetChecksum(^udp.CalculateChecksum(xsum, length))
 		}
+	}
 
-		udp.SetChecksum(^udp.CalculateChecksum(xsum, length))
+	if err := r.WritePacket(csum, &hdr, data, ProtocolNumber); err != nil {
+		return err
 	}
 
-	return r.WritePacket(&hdr, data, ProtocolNumber)
+	r.Stats().UDP.PacketsSent.Increment()
+	return nil
 }
 
 func (e *endpoint) checkV4Mapped(addr *tcpip.FullAddress, allowMismatch bool) (tcpip.NetworkProtocolNumber, *tcpip.Error) {
@@ -451,7 +793,14 @@ func (e *endpoint) checkV4Mapped(addr *tcpip.FullAddress, allowMismatch bool) (t
 }
 
 // Connect connects the endpoint to its peer. Specifying a NIC is optional.
+// Connecting to the unspecified address disconnects the endpoint instead.
 func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
+	if addr.Addr == "" {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.disconnectLocked()
+	}
+
 	if addr.Port == 0 {
 		// We don't support connecting to port zero.
 		return tcpip.ErrInvalidEndpointState
@@ -466,17 +815,16 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 	case stateInitial:
 	case stateBound, stateConnected:
 		localPort = e.id.LocalPort
-		if e.bindNICID == 0 {
-			break
-		}
+	default:
+		return tcpip.ErrInvalidEndpointState
+	}
 
+	if e.bindNICID != 0 {
 		if nicid != 0 && nicid != e.bindNICID {
 			return tcpip.ErrInvalidEndpointState
 		}
 
 		nicid = e.bindNICID
-	default:
-		return tcpip.ErrInvalidEndpointState
 	}
 
 	netProto, err := e.checkV4Mapped(&addr, false)
@@ -516,11 +864,15 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 
 	// Remove the old registration.
 	if e.id.LocalPort != 0 {
-		e.stack.UnregisterTransportEndpoint(e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id)
+		e.stack.UnregisterTransportEndpoint(e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
 	}
 
 	e.id = id
 	e.route = r.Clone()
+	e.route.FlowLabel = e.flowLabel
+	e.route.TOS = e.tos
+	e.route.TTL = e.ttl
+	e.route.Priority = e.priority
 	e.dstPort = addr.Port
 	e.regNICID = nicid
 	e.effectiveNetProtos = netProtos
@@ -534,6 +886,106 @@ func (e *endpoint) Connect(addr tcpip.FullAddress) *tcpip.Error {
 	return nil
 }
 
+// disconnectLocked reverts a connected endpoint to the bound state, so that it
+// receives datagrams from any source again. The endpoint keeps its local port,
+// and is registered with the local address and NIC it was bound to, if any.
+// Endpoints that aren't connected are left as they are.
+func (e *endpoint) disconnectLocked() *tcpip.Error {
+	if e.state != stateConnected {
+		return nil
+	}
+
+	id := e.bindID
+	id.LocalPort = e.id.LocalPort
+	netProtos := e.bindNetProtos
+	if netProtos == nil {
+		// The endpoint was connected without being bound first, so it
+		// is registered as if bound to the wildcard address.
+		netProtos = []tcpip.NetworkProtocolNumber{e.netProto}
+		if e.netProto == header.IPv6ProtocolNumber && !e.v6only {
+			netProtos = []tcpip.NetworkProtocolNumber{
+				header.IPv6ProtocolNumber,
+				header.IPv4ProtocolNumber,
+			}
+		}
+	}
+
+	if err := e.stack.RegisterTransportEndpoint(e.bindNICID, netProtos, ProtocolNumber, id, e, e.reuseAddr); err != nil {
+		return err
+	}
+	e.stack.UnregisterTransportEndpoint(e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id, e)
+
+	e.id = id
+	e.route.Release()
+	e.route = stack.Route{}
+	e.dstPort = 0
+	e.regNICID = e.bindNICID
+	e.effectiveNetProtos = netProtos
+
+	e.state = stateBound
+
+	return nil
+}
+
+// migrate moves the connected endpoint to a new remote address and port. The
+// local address and port are kept, and so is the receive queue.
+func (e *endpoint) migrate(addr tcpip.FullAddress) *tcpip.Error {
+	if addr.Port == 0 {
+		// We don't support connecting to port zero.
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.state != stateConnected {
+		return tcpip.ErrNotConnected
+	}
+
+	nicid := addr.NIC
+	if e.regNICID != 0 {
+		if nicid != 0 && nicid != e.regNICID {
+			return tcpip.ErrInvalidEndpointState
+		}
+		nicid = e.regNICID
+	}
+
+	netProto, err := e.checkV4Mapped(&addr, false)
+	if err != nil {
+		return err
+	}
+
+	// The local address is kept, so the network protocol can't change.
+	if netProto != e.route.NetProto {
+		return tcpip.ErrInvalidEndpointState
+	}
+
+	r, err := e.stack.FindRoute(nicid, e.id.LocalAddress, addr.Addr, netProto)
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+
+	id := e.id
+	id.RemoteAddress = r.RemoteAddress
+	id.RemotePort = addr.Port
+
+	if err := e.stack.MoveTransportEndpoint(e.regNICID, e.effectiveNetProtos, ProtocolNumber, e.id, id, e, e.reuseAddr); err != nil {
+		return err
+	}
+
+	e.id = id
+	e.route.Release()
+	e.route = r.Clone()
+	e.route.FlowLabel = e.flowLabel
+	e.route.TOS = e.tos
+	e.route.TTL = e.ttl
+	e.route.Priority = e.priority
+	e.dstPort = addr.Port
+
+	return nil
+}
+
 // ConnectEndpoint is not supported.
 func (*endpoint) ConnectEndpoint(tcpip.Endpoint) *tcpip.Error {
 	return tcpip.ErrInvalidEndpointState
@@ -577,14 +1029,14 @@ func (e *endpoint) registerWithStack(nicid tcpip.NICID, netProtos []tcpip.Networ
 	if id.LocalPort != 0 {
 		// The endpoint already has a local port, just attempt to
 		// register it.
-		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, id, e)
+		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, id, e, e.reuseAddr)
 		return id, err
 	}
 
 	// We need to find a port for the endpoint.
 	_, err := e.stack.PickEphemeralPort(func(p uint16) (bool, *tcpip.Error) {
 		id.LocalPort = p
-		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, id, e)
+		err := e.stack.RegisterTransportEndpoint(nicid, netProtos, ProtocolNumber, id, e, e.reuseAddr)
 		switch err {
 		case nil:
 			return true, nil
@@ -621,6 +1073,13 @@ func (e *endpoint) bindLocked(addr tcpip.FullAddress, commit func() *tcpip.Error
 		}
 	}
 
+	if e.bindToDevice != 0 {
+		if addr.NIC != 0 && addr.NIC != e.bindToDevice {
+			return tcpip.ErrInvalidEndpointState
+		}
+		addr.NIC = e.bindToDevice
+	}
+
 	if len(addr.Addr) != 0 {
 		// A local address was specified, verify that it's valid.
 		if e.stack.CheckLocalAddress(addr.NIC, netProto, addr.Addr) == 0 {
@@ -639,14 +1098,17 @@ func (e *endpoint) bindLocked(addr tcpip.FullAddress, commit func() *tcpip.Error
 	if commit != nil {
 		if err := commit(); err != nil {
 			// Unregister, the commit failed.
-			e.stack.UnregisterTransportEndpoint(addr.NIC, netProtos, ProtocolNumber, id)
+			e.stack.UnregisterTransportEndpoint(addr.NIC, netProtos, ProtocolNumber, id, e)
 			return err
 		}
 	}
 
 	e.id = id
 	e.regNICID = addr.NIC
+	e.bindNICID = addr.NIC
 	e.effectiveNetProtos = netProtos
+	e.bindID = id
+	e.bindNetProtos = netProtos
 
 	// Mark endpoint as bound.
 	e.state = stateBound
@@ -669,7 +1131,6 @@ func (e *endpoint) Bind(addr tcpip.FullAddress, commit func() *tcpip.Error) *tcp
 		return err
 	}
 
-	e.bindNICID = addr.NIC
 	e.bindAddr = addr.Addr
 
 	return nil
@@ -724,32 +1185,106 @@ func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 // HandlePacket is called by the stack when new packets arrive to this transport
 // endpoint.
 func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv *buffer.VectorisedView) {
-	// Get the header then trim it from the view.
-	hdr := header.UDP(vv.First())
-	if int(hdr.Length()) > vv.Size() {
-		// Malformed packet.
+	if !e.parsePacket(r, vv) {
 		return
 	}
 
-	vv.TrimFront(header.UDPMinimumSize)
+	e.rcvMu.Lock()
+	wasEmpty := e.rcvList.Empty()
+	queued := e.enqueueLocked(r, id, vv)
+	e.rcvMu.Unlock()
+
+	if !queued {
+		return
+	}
+
+	e.stack.MutableStats().UDP.PacketsReceived.Increment()
+
+	// Notify any waiters that there's data to be read now.
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventIn)
+	}
+}
 
+// HandlePackets implements stack.BatchTransportEndpoint.HandlePackets. The
+// packets are validated before taking the receive lock, then queued while
+// holding it only once, and the waiters are notified at most once.
+func (e *endpoint) HandlePackets(pkts []stack.TransportPacket) {
+	valid := pkts[:0]
+	for _, p := range pkts {
+		if e.parsePacket(p.Route, p.VV) {
+			valid = append(valid, p)
+		}
+	}
+	if len(valid) == 0 {
+		return
+	}
+
+	queued := 0
 	e.rcvMu.Lock()
+	wasEmpty := e.rcvList.Empty()
+	for _, p := range valid {
+		if e.enqueueLocked(p.Route, p.ID, p.VV) {
+			queued++
+		}
+	}
+	e.rcvMu.Unlock()
 
-	// Drop the packet if our buffer is currently full.
-	if !e.rcvReady || e.rcvClosed || e.rcvBufSize >= e.rcvBufSizeMax {
-		e.rcvMu.Unlock()
+	if queued == 0 {
 		return
 	}
 
-	wasEmpty := e.rcvBufSize == 0
+	e.stack.MutableStats().UDP.PacketsReceived.IncrementBy(uint64(queued))
+
+	// Notify any waiters that there's data to be read now.
+	if wasEmpty {
+		e.waiterQueue.Notify(waiter.EventIn)
+	}
+}
+
+// parsePacket validates the datagram in vv and trims its header. It returns
+// false if the datagram is malformed, and must be dropped.
+func (e *endpoint) parsePacket(r *stack.Route, vv *buffer.VectorisedView) bool {
+	hdr := header.UDP(vv.First())
+	if int(hdr.Length()) > vv.Size() || hdr.Length() < header.UDPMinimumSize {
+		// Malformed packet.
+		e.stack.MutableStats().UDP.MalformedPacketsReceived.Increment()
+		return false
+	}
+	vv.CapLength(int(hdr.Length()))
+
+	if !e.checksumValid(r, hdr, vv) {
+		e.stack.MutableStats().MalformedRcvdPackets.Increment()
+		e.stack.MutableStats().UDP.MalformedPacketsReceived.Increment()
+		return false
+	}
+
+	vv.TrimFront(header.UDPMinimumSize)
+	return true
+}
+
+// enqueueLocked pushes the datagram parsed by parsePacket into the receive
+// list. It returns false if the datagram was dropped instead.
+//
+// Precondition: e.rcvMu must be held.
+func (e *endpoint) enqueueLocked(r *stack.Route, id stack.TransportEndpointID, vv *buffer.VectorisedView) bool {
+	// Drop the packet if we no longer receive or our buffer is currently
+	// full.
+	if !e.rcvReady || e.rcvClosed {
+		e.stack.MutableStats().ClosedEndpointRcvdPackets.Increment()
+		return false
+	}
+	if e.rcvBufSize >= e.rcvBufSizeMax {
+		e.stack.MutableStats().UDP.ReceiveBufferErrors.Increment()
+		return false
+	}
 
 	// Push new packet into receive list and increment the buffer size.
-	pkt := &udpPacket{
-		senderAddress: tcpip.FullAddress{
-			NIC:  r.NICID(),
-			Addr: id.RemoteAddress,
-			Port: hdr.SourcePort(),
-		},
+	pkt := packetPool.Get().(*udpPacket)
+	pkt.senderAddress = tcpip.FullAddress{
+		NIC:  r.NICID(),
+		Addr: id.RemoteAddress,
+		Port: id.RemotePort,
 	}
 	pkt.data = vv.Clone(pkt.views[:])
 	e.rcvList.PushBack(pkt)
@@ -759,15 +1294,38 @@ func (e *endpoint) HandlePacket(r *stack.Route, id stack.TransportEndpointID, vv
 		pkt.timestamp = e.stack.NowNanoseconds()
 		pkt.hasTimestamp = true
 	}
+	return true
+}
 
-	e.rcvMu.Unlock()
+// checksumValid verifies the checksum of the datagram in vv, unless the link
+// has already validated it or the sender didn't compute one, which only IPv4
+// allows.
+func (e *endpoint) checksumValid(r *stack.Route, hdr header.UDP, vv *buffer.VectorisedView) bool {
+	if hdr.Checksum() == 0 && r.NetProto != header.IPv4ProtocolNumber {
+		return false
+	}
 
-	// Notify any waiters that there's data to be read now.
-	if wasEmpty {
-		e.waiterQueue.Notify(waiter.EventIn)
+	if r.ChecksumValidated {
+		e.stack.MutableStats().ChecksumSkippedRcvdPackets.Increment()
+		return true
+	}
+
+	if hdr.Checksum() == 0 {
+		return true
 	}
+
+	e.stack.MutableStats().ChecksumVerifiedRcvdPackets.Increment()
+	xsum := header.PseudoHeaderChecksumWithLength(r.PseudoHeaderChecksum(ProtocolNumber), hdr.Length())
+	return header.ChecksumVV(*vv, xsum) == 0xffff
 }
 
 // HandleControlPacket implements stack.TransportEndpoint.HandleControlPacket.
 func (e *endpoint) HandleControlPacket(id stack.TransportEndpointID, typ stack.ControlType, extra uint32, vv *buffer.VectorisedView) {
 }
+
+// State implements stack.TransportEndpointStateReporter.State.
+func (e *endpoint) State() string {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.state.String()
+}
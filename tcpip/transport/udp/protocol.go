@@ -11,6 +11,8 @@
 package udp
 
 import (
+	"sync/atomic"
+
 	"github.com/google/netstack/tcpip"
 	"github.com/google/netstack/tcpip/buffer"
 	"github.com/google/netstack/tcpip/header"
@@ -26,7 +28,16 @@ const (
 	ProtocolNumber = header.UDPProtocolNumber
 )
 
-type protocol struct{}
+// NoChecksumOption is used by SetOption and Option to configure whether IPv4
+// datagrams are sent without a checksum, as allowed by RFC 768. Checksums are
+// mandatory for IPv6, so IPv6 datagrams always carry one.
+type NoChecksumOption bool
+
+type protocol struct {
+	// noChecksum is non-zero if NoChecksumOption is enabled. It is accessed
+	// atomically.
+	noChecksum uint32
+}
 
 // Number returns the udp protocol number.
 func (*protocol) Number() tcpip.TransportProtocolNumber {
@@ -34,8 +45,8 @@ func (*protocol) Number() tcpip.TransportProtocolNumber {
 }
 
 // NewEndpoint creates a new udp endpoint.
-func (*protocol) NewEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
-	return newEndpoint(stack, netProto, waiterQueue), nil
+func (p *protocol) NewEndpoint(stack *stack.Stack, netProto tcpip.NetworkProtocolNumber, waiterQueue *waiter.Queue) (tcpip.Endpoint, *tcpip.Error) {
+	return newEndpoint(stack, p, netProto, waiterQueue), nil
 }
 
 // MinimumPacketSize returns the minimum valid udp packet size.
@@ -58,12 +69,30 @@ func (p *protocol) HandleUnknownDestinationPacket(*stack.Route, stack.TransportE
 
 // SetOption implements TransportProtocol.SetOption.
 func (p *protocol) SetOption(option interface{}) *tcpip.Error {
-	return tcpip.ErrUnknownProtocolOption
+	switch v := option.(type) {
+	case NoChecksumOption:
+		var b uint32
+		if v {
+			b = 1
+		}
+		atomic.StoreUint32(&p.noChecksum, b)
+		return nil
+
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
 }
 
 // Option implements TransportProtocol.Option.
 func (p *protocol) Option(option interface{}) *tcpip.Error {
-	return tcpip.ErrUnknownProtocolOption
+	switch v := option.(type) {
+	case *NoChecksumOption:
+		*v = atomic.LoadUint32(&p.noChecksum) != 0
+		return nil
+
+	default:
+		return tcpip.ErrUnknownProtocolOption
+	}
 }
 
 func init() {
@@ -6,6 +6,7 @@ package udp_test
 
 import (
 	"bytes"
+	"fmt"
 	"math/rand"
 	"testing"
 	"time"
@@ -19,6 +20,7 @@ import (
 	"github.com/google/netstack/tcpip/network/ipv4"
 	"github.com/google/netstack/tcpip/network/ipv6"
 	"github.com/google/netstack/tcpip/stack"
+	"github.com/google/netstack/tcpip/testutil"
 	"github.com/google/netstack/tcpip/transport/udp"
 	"github.com/google/netstack/waiter"
 )
@@ -56,7 +58,11 @@ type headers struct {
 }
 
 func newDualTestContext(t *testing.T, mtu uint32) *testContext {
-	s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{udp.ProtocolName})
+	return newDualTestContextWithClock(t, mtu, &tcpip.StdClock{})
+}
+
+func newDualTestContextWithClock(t *testing.T, mtu uint32, clock tcpip.Clock) *testContext {
+	s := stack.New(clock, []string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{udp.ProtocolName})
 
 	id, linkEP := channel.New(256, mtu, "")
 	if testing.Verbose() {
@@ -159,6 +165,17 @@ func (c *testContext) getPacket() []byte {
 }
 
 func (c *testContext) sendV6Packet(payload []byte, h *headers) {
+	buf := newV6Packet(payload, h)
+
+	// Inject packet.
+	var views [1]buffer.View
+	vv := buf.ToVectorisedView(views)
+	c.linkEP.Inject(ipv6.ProtocolNumber, &vv)
+}
+
+// newV6Packet builds an IPv6 packet carrying a UDP datagram with the given
+// payload from the test address to the stack address.
+func newV6Packet(payload []byte, h *headers) buffer.View {
 	// Allocate a buffer for data and headers.
 	buf := buffer.NewView(header.UDPMinimumSize + header.IPv6MinimumSize + len(payload))
 	copy(buf[len(buf)-len(payload):], payload)
@@ -191,13 +208,27 @@ func (c *testContext) sendV6Packet(payload []byte, h *headers) {
 	xsum = header.Checksum(payload, xsum)
 	u.SetChecksum(^u.CalculateChecksum(xsum, length))
 
+	return buf
+}
+
+func (c *testContext) sendPacket(payload []byte, h *headers) {
+	buf := newPacket(payload, h)
+
 	// Inject packet.
 	var views [1]buffer.View
 	vv := buf.ToVectorisedView(views)
-	c.linkEP.Inject(ipv6.ProtocolNumber, &vv)
+	c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
 }
 
-func (c *testContext) sendPacket(payload []byte, h *headers) {
+// newPacket builds an IPv4 packet carrying a UDP datagram with the given
+// payload from the test address to the stack address.
+func newPacket(payload []byte, h *headers) buffer.View {
+	return newPacketTo(stackAddr, payload, h)
+}
+
+// newPacketTo builds an IPv4 packet carrying a UDP datagram with the given
+// payload from the test address to dst.
+func newPacketTo(dst tcpip.Address, payload []byte, h *headers) buffer.View {
 	// Allocate a buffer for data and headers.
 	buf := buffer.NewView(header.UDPMinimumSize + header.IPv4MinimumSize + len(payload))
 	copy(buf[len(buf)-len(payload):], payload)
@@ -210,7 +241,7 @@ func (c *testContext) sendPacket(payload []byte, h *headers) {
 		TTL:         65,
 		Protocol:    uint8(udp.ProtocolNumber),
 		SrcAddr:     testAddr,
-		DstAddr:     stackAddr,
+		DstAddr:     dst,
 	})
 	ip.SetChecksum(^ip.CalculateChecksum())
 
@@ -224,7 +255,7 @@ func (c *testContext) sendPacket(payload []byte, h *headers) {
 
 	// Calculate the UDP pseudo-header checksum.
 	xsum := header.Checksum([]byte(testAddr), 0)
-	xsum = header.Checksum([]byte(stackAddr), xsum)
+	xsum = header.Checksum([]byte(dst), xsum)
 	xsum = header.Checksum([]byte{0, uint8(udp.ProtocolNumber)}, xsum)
 
 	// Calculate the UDP checksum and set it.
@@ -232,10 +263,7 @@ func (c *testContext) sendPacket(payload []byte, h *headers) {
 	xsum = header.Checksum(payload, xsum)
 	u.SetChecksum(^u.CalculateChecksum(xsum, length))
 
-	// Inject packet.
-	var views [1]buffer.View
-	vv := buf.ToVectorisedView(views)
-	c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+	return buf
 }
 
 func newPayload() []byte {
@@ -286,6 +314,173 @@ func testV4Read(c *testContext) {
 	}
 }
 
+func TestZeroLengthDatagram(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	we, ch := waiter.NewChannelEntry(nil)
+	c.wq.EventRegister(&we, waiter.EventIn)
+	defer c.wq.EventUnregister(&we)
+
+	h := &headers{srcPort: testPort, dstPort: stackPort}
+	c.sendPacket(nil, h)
+	select {
+	case <-ch:
+	default:
+		c.t.Fatalf("No notification for a zero-length datagram")
+	}
+	payload := newPayload()
+	c.sendPacket(payload, h)
+	c.sendPacket(nil, h)
+
+	// Datagram boundaries are preserved.
+	want := tcpip.FullAddress{NIC: 1, Addr: testAddr, Port: testPort}
+	for _, p := range [][]byte{nil, payload, nil} {
+		var addr tcpip.FullAddress
+		v, _, err := c.ep.Read(&addr)
+		if err != nil {
+			c.t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(v, p) {
+			c.t.Fatalf("Bad payload: got %x, want %x", v, p)
+		}
+		if addr != want {
+			c.t.Fatalf("Unexpected remote address: got %+v, want %+v", addr, want)
+		}
+	}
+	if _, _, err := c.ep.Read(nil); err != tcpip.ErrWouldBlock {
+		c.t.Fatalf("Read = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+	if got := c.s.MutableStats().UDP.PacketsReceived.Value(); got != 3 {
+		c.t.Fatalf("got PacketsReceived = %d, want 3", got)
+	}
+}
+
+func TestReceiveTimestamps(t *testing.T) {
+	clock := testutil.NewManualClock()
+	c := newDualTestContextWithClock(t, defaultMTU, clock)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	h := &headers{srcPort: testPort, dstPort: stackPort}
+
+	// Without the option, no timestamp is reported.
+	c.sendPacket(newPayload(), h)
+	if _, cm, err := c.ep.Read(nil); err != nil || cm.HasTimestamp {
+		c.t.Fatalf("got Read = (_, %+v, %v), want no timestamp", cm, err)
+	}
+
+	if err := c.ep.SetSockOpt(tcpip.TimestampOption(1)); err != nil {
+		c.t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var v tcpip.TimestampOption
+	if err := c.ep.GetSockOpt(&v); err != nil || v != 1 {
+		c.t.Fatalf("got GetSockOpt(&v) = %v, v = %d, want nil and 1", err, v)
+	}
+
+	const interval = 5 * time.Millisecond
+	c.sendPacket(newPayload(), h)
+	clock.Advance(interval)
+	c.sendPacket(newPayload(), h)
+	clock.Advance(interval)
+
+	// Timestamps are taken when the datagram is received, not when it is
+	// read, and peeking reports the same one.
+	_, peeked, err := c.ep.(tcpip.ViewEndpoint).PeekView(0)
+	if err != nil {
+		c.t.Fatalf("PeekView failed: %v", err)
+	}
+	_, first, err := c.ep.Read(nil)
+	if err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	if !first.HasTimestamp || first != peeked {
+		c.t.Fatalf("got Read control messages %+v, PeekView ones %+v, want equal with a timestamp", first, peeked)
+	}
+	_, second, err := c.ep.Read(nil)
+	if err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	if !second.HasTimestamp {
+		c.t.Fatalf("got control messages %+v, want a timestamp", second)
+	}
+	if got := second.Timestamp - first.Timestamp; got != interval.Nanoseconds() {
+		c.t.Fatalf("got timestamps %d apart, want %d", got, interval.Nanoseconds())
+	}
+	if got, want := second.Timestamp, clock.NowNanoseconds()-interval.Nanoseconds(); got != want {
+		c.t.Fatalf("got timestamp %d, want %d", got, want)
+	}
+}
+
+func TestReadView(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+	ep := c.ep.(tcpip.ViewEndpoint)
+
+	h := &headers{srcPort: testPort, dstPort: stackPort}
+	payloads := [][]byte{newPayload(), newPayload()}
+	for _, p := range payloads {
+		c.sendPacket(p, h)
+	}
+
+	// Whole datagrams are returned, whatever the requested size, and
+	// peeking doesn't consume them.
+	for i := 0; i < 2; i++ {
+		vv, _, err := ep.PeekView(1)
+		if err != nil {
+			c.t.Fatalf("PeekView failed: %v", err)
+		}
+		if got := vv.ToView(); !bytes.Equal(got, payloads[0]) {
+			c.t.Fatalf("got PeekView(1) = %x, want %x", got, payloads[0])
+		}
+		vv.Release()
+	}
+	want := tcpip.FullAddress{NIC: 1, Addr: testAddr, Port: testPort}
+	for _, p := range payloads {
+		var addr tcpip.FullAddress
+		vv, _, err := ep.ReadView(1, &addr)
+		if err != nil {
+			c.t.Fatalf("ReadView failed: %v", err)
+		}
+		if got := vv.ToView(); !bytes.Equal(got, p) {
+			c.t.Fatalf("got ReadView(1) = %x, want %x", got, p)
+		}
+		vv.Release()
+		if addr != want {
+			c.t.Fatalf("Unexpected remote address: got %+v, want %+v", addr, want)
+		}
+	}
+	if _, _, err := ep.ReadView(1, nil); err != tcpip.ErrWouldBlock {
+		c.t.Fatalf("ReadView = %v, want %v", err, tcpip.ErrWouldBlock)
+	}
+}
+
 func TestV4ReadOnV6(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -588,6 +783,70 @@ func TestV6WriteOnConnected(t *testing.T) {
 	}
 }
 
+func TestV6FlowLabel(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	flowLabel := func(ep tcpip.Endpoint, opts tcpip.WriteOptions) uint32 {
+		if _, err := ep.Write(tcpip.SlicePayload(newPayload()), opts); err != nil {
+			c.t.Fatalf("Write failed: %v", err)
+		}
+		_, l := header.IPv6(c.getV6Packet()).TOS()
+		return l
+	}
+
+	// Packets of a connection carry the same label.
+	c.createV6Endpoint(false)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+	first := flowLabel(c.ep, tcpip.WriteOptions{})
+	if first == 0 {
+		t.Fatalf("got flow label 0, want a computed label")
+	}
+	if got := flowLabel(c.ep, tcpip.WriteOptions{}); got != first {
+		t.Fatalf("got flow label %#x on the second packet, want %#x", got, first)
+	}
+
+	// Another connection, from another port, gets another label.
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+	if got := flowLabel(ep, tcpip.WriteOptions{}); got == 0 || got == first {
+		t.Fatalf("got flow label %#x on another connection, want a non-zero label other than %#x", got, first)
+	}
+
+	// An explicit label is honored, whether the endpoint is connected or
+	// not.
+	const label = 0x12345
+	if err := ep.SetSockOpt(tcpip.IPv6FlowInfoOption(label)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var v tcpip.IPv6FlowInfoOption
+	if err := ep.GetSockOpt(&v); err != nil || v != label {
+		t.Fatalf("got GetSockOpt(&v) = %v, v = %#x, want nil and %#x", err, v, label)
+	}
+	if got := flowLabel(ep, tcpip.WriteOptions{}); got != label {
+		t.Fatalf("got flow label %#x, want %#x", got, label)
+	}
+	if err := c.ep.SetSockOpt(tcpip.IPv6FlowInfoOption(label)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	if got := flowLabel(c.ep, tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: testV6Addr, Port: testPort + 1}}); got != label {
+		t.Fatalf("got flow label %#x, want %#x", got, label)
+	}
+
+	if err := ep.SetSockOpt(tcpip.IPv6FlowInfoOption(header.IPv6FlowLabelMask + 1)); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("got SetSockOpt(IPv6FlowInfoOption(%#x)) = %v, want %v", header.IPv6FlowLabelMask+1, err, tcpip.ErrInvalidOptionValue)
+	}
+}
+
 func TestV4WriteOnConnected(t *testing.T) {
 	c := newDualTestContext(t, defaultMTU)
 	defer c.cleanup()
@@ -623,3 +882,1521 @@ func TestV4WriteOnConnected(t *testing.T) {
 		c.t.Fatalf("Bad payload: got %x, want %x", udp.Payload(), payload)
 	}
 }
+
+func TestBindToForeignAddress(t *testing.T) {
+	const foreignAddr = "\x0a\x00\x00\x63"
+
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+
+	// Addresses that aren't assigned to a NIC can't be bound to without
+	// spoofing.
+	if err := c.ep.Bind(tcpip.FullAddress{Addr: foreignAddr, Port: stackPort}, nil); err != tcpip.ErrBadLocalAddress {
+		c.t.Fatalf("Bind = %v, want %v", err, tcpip.ErrBadLocalAddress)
+	}
+
+	if err := c.s.SetSpoofing(1, true); err != nil {
+		c.t.Fatalf("SetSpoofing failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Addr: foreignAddr, Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	payload := buffer.View(newPayload())
+	if _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: testAddr, Port: testPort}}); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+
+	// Check that the packet is sent from the foreign address.
+	select {
+	case p := <-c.linkEP.C:
+		b := append(buffer.View(nil), p.Header...)
+		b = append(b, p.Payload...)
+		checker.IPv4(c.t, b,
+			checker.SrcAddr(foreignAddr),
+			checker.DstAddr(testAddr),
+			checker.UDP(
+				checker.SrcPort(stackPort),
+				checker.DstPort(testPort),
+			),
+		)
+		if udp := header.UDP(header.IPv4(b).Payload()); !bytes.Equal(payload, udp.Payload()) {
+			c.t.Fatalf("Bad payload: got %x, want %x", udp.Payload(), payload)
+		}
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Packet wasn't written out")
+	}
+}
+
+func TestClone(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+
+	if _, err := c.ep.(tcpip.CloneableEndpoint).Clone(); err != tcpip.ErrInvalidEndpointState {
+		t.Fatalf("Clone of an unbound endpoint = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	clone, err := c.ep.(tcpip.CloneableEndpoint).Clone()
+	if err != nil {
+		t.Fatalf("Clone failed: %v", err)
+	}
+	c.ep.Close()
+
+	bindToStackPort := func() *tcpip.Error {
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv6.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		defer ep.Close()
+		return ep.Bind(tcpip.FullAddress{Port: stackPort}, nil)
+	}
+
+	// The clone keeps the port and still receives datagrams.
+	if err := bindToStackPort(); err != tcpip.ErrPortInUse {
+		t.Fatalf("Bind to the port of the closed endpoint = %v, want %v", err, tcpip.ErrPortInUse)
+	}
+	c.ep = clone
+	testV4Read(c)
+
+	// Closing the clone, even several times, releases the port.
+	clone.Close()
+	clone.Close()
+	if err := bindToStackPort(); err != nil {
+		t.Fatalf("Bind to the port of the closed endpoint and clone failed: %v", err)
+	}
+}
+
+func TestMigrateRemote(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+
+	const (
+		newAddr = "\x0a\x00\x00\x03"
+		newPort = testPort + 1
+	)
+
+	// send injects a datagram from the given remote, and returns whether
+	// it was received by the endpoint.
+	send := func(addr tcpip.Address, port uint16) bool {
+		buf := newPacket(newPayload(), &headers{port, stackPort})
+		ip := header.IPv4(buf)
+		ip.SetSourceAddress(addr)
+		ip.SetChecksum(0)
+		ip.SetChecksum(^ip.CalculateChecksum())
+		// A zero checksum isn't checked, so it needn't be updated.
+		header.UDP(ip.Payload()).SetChecksum(0)
+
+		var views [1]buffer.View
+		vv := buf.ToVectorisedView(views)
+		c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+
+		var got tcpip.FullAddress
+		_, _, err := c.ep.Read(&got)
+		switch err {
+		case nil:
+			if got.Addr != addr || got.Port != port {
+				c.t.Fatalf("got sender %+v, want %v:%d", got, addr, port)
+			}
+			return true
+		case tcpip.ErrWouldBlock:
+			return false
+		default:
+			c.t.Fatalf("Read failed: %v", err)
+			return false
+		}
+	}
+
+	if !send(testAddr, testPort) {
+		c.t.Fatalf("datagram from the original remote wasn't received")
+	}
+
+	if err := c.ep.SetSockOpt(tcpip.MigrateRemoteOption{Remote: tcpip.FullAddress{Addr: newAddr, Port: newPort}}); err != nil {
+		c.t.Fatalf("SetSockOpt(MigrateRemoteOption) failed: %v", err)
+	}
+
+	if got, err := c.ep.GetRemoteAddress(); err != nil || got.Addr != newAddr || got.Port != newPort {
+		c.t.Fatalf("GetRemoteAddress() = %+v, %v, want %v:%d", got, err, newAddr, newPort)
+	}
+	if got, err := c.ep.GetLocalAddress(); err != nil || got.Addr != stackAddr || got.Port != stackPort {
+		c.t.Fatalf("GetLocalAddress() = %+v, %v, want %v:%d", got, err, stackAddr, stackPort)
+	}
+
+	if send(testAddr, testPort) {
+		c.t.Fatalf("datagram from the old remote was received after migrating")
+	}
+	if !send(newAddr, newPort) {
+		c.t.Fatalf("datagram from the new remote wasn't received after migrating")
+	}
+
+	// Writes go to the new remote.
+	if _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{}); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case p := <-c.linkEP.C:
+		b := append(buffer.View(nil), p.Header...)
+		b = append(b, p.Payload...)
+		checker.IPv4(c.t, b,
+			checker.SrcAddr(stackAddr),
+			checker.DstAddr(newAddr),
+			checker.UDP(
+				checker.SrcPort(stackPort),
+				checker.DstPort(newPort),
+			),
+		)
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("Packet wasn't written out")
+	}
+}
+
+func TestMigrateRemoteNotConnected(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		c.t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		c.t.Fatalf("Bind failed: %v", err)
+	}
+
+	if err := c.ep.SetSockOpt(tcpip.MigrateRemoteOption{Remote: tcpip.FullAddress{Addr: testAddr, Port: testPort}}); err != tcpip.ErrNotConnected {
+		c.t.Fatalf("SetSockOpt(MigrateRemoteOption) = %v, want %v", err, tcpip.ErrNotConnected)
+	}
+}
+
+func TestWriteChecksumOffload(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		caps    stack.LinkEndpointCapabilities
+		partial bool
+	}{
+		{"NoOffload", 0, false},
+		{"TXChecksumOffload", stack.CapabilityTXChecksumOffload, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.linkEP.LinkEPCapabilities = tc.caps
+			c.createV6Endpoint(false)
+
+			payload := buffer.View(newPayload())
+			if _, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{
+				To: &tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort},
+			}); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+
+			var p channel.PacketInfo
+			select {
+			case p = <-c.linkEP.C:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Packet wasn't written out")
+			}
+
+			b := append(append([]byte(nil), p.Header...), p.Payload...)
+			udp := header.UDP(header.IPv4(b).Payload())
+			xsum := header.PseudoHeaderChecksum(header.UDPProtocolNumber, stackAddr, testAddr)
+			xsum = header.PseudoHeaderChecksumWithLength(xsum, uint16(len(udp)))
+
+			if got := p.Checksum != nil; got != tc.partial {
+				t.Fatalf("got partial checksum = %v, want %v", got, tc.partial)
+			}
+			if tc.partial {
+				if got, want := p.Checksum.TransportOffset, uint16(header.IPv4MinimumSize); got != want {
+					t.Fatalf("got TransportOffset = %v, want %v", got, want)
+				}
+				if got, want := p.Checksum.ChecksumOffset, uint16(header.UDPChecksumOffset); got != want {
+					t.Fatalf("got ChecksumOffset = %v, want %v", got, want)
+				}
+				if got := udp.Checksum(); got != xsum {
+					t.Fatalf("got partial checksum 0x%x, want pseudo-header checksum 0x%x", got, xsum)
+				}
+
+				// Complete the checksum as the link endpoint would.
+				p.Checksum.Complete(udp[:header.UDPMinimumSize], udp.Payload())
+			}
+
+			if got := header.Checksum(udp, xsum); got != 0xffff {
+				t.Fatalf("Bad checksum: got 0x%x, want 0xffff", got)
+			}
+		})
+	}
+}
+
+func TestReadChecksumValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		corrupt      bool
+		validated    bool
+		wantAccepted bool
+		wantSkipped  uint64
+		wantVerified uint64
+	}{
+		{"Valid", false, false, true, 0, 1},
+		{"Corrupted", true, false, false, 0, 1},
+		{"CorruptedButValidatedByLink", true, true, true, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createV6Endpoint(false)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+				t.Fatalf("Bind failed: %v", err)
+			}
+
+			payload := newPayload()
+			buf := newPacket(payload, &headers{
+				srcPort: testPort,
+				dstPort: stackPort,
+			})
+			if tc.corrupt {
+				buf[len(buf)-1] ^= 0xff
+				payload[len(payload)-1] ^= 0xff
+			}
+
+			var views [1]buffer.View
+			vv := buf.ToVectorisedView(views)
+			if tc.validated {
+				c.linkEP.InjectChecksumValidated(ipv4.ProtocolNumber, &vv)
+			} else {
+				c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+			}
+
+			// Packets are delivered synchronously, so there is no
+			// need to wait for them.
+			v, _, err := c.ep.Read(nil)
+			if !tc.wantAccepted {
+				if err != tcpip.ErrWouldBlock {
+					t.Fatalf("Read returned %v, want %v", err, tcpip.ErrWouldBlock)
+				}
+				if got := c.s.MutableStats().MalformedRcvdPackets.Value(); got != 1 {
+					t.Fatalf("got MalformedRcvdPackets = %d, want 1", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Read failed: %v", err)
+				}
+				if !bytes.Equal(payload, v) {
+					t.Fatalf("Bad payload: got %x, want %x", v, payload)
+				}
+			}
+
+			stats := c.s.Stats()
+			if got := stats.ChecksumSkippedRcvdPackets.Value(); got != tc.wantSkipped {
+				t.Fatalf("got ChecksumSkippedRcvdPackets = %d, want %d", got, tc.wantSkipped)
+			}
+			if got := stats.ChecksumVerifiedRcvdPackets.Value(); got != tc.wantVerified {
+				t.Fatalf("got ChecksumVerifiedRcvdPackets = %d, want %d", got, tc.wantVerified)
+			}
+		})
+	}
+}
+
+func TestZeroChecksumReceive(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		proto        tcpip.NetworkProtocolNumber
+		wantAccepted bool
+	}{
+		{"IPv4", ipv4.ProtocolNumber, true},
+		{"IPv6", ipv6.ProtocolNumber, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.createV6Endpoint(false)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+				t.Fatalf("Bind failed: %v", err)
+			}
+
+			payload := newPayload()
+			h := &headers{testPort, stackPort}
+			var buf buffer.View
+			var u header.UDP
+			if tc.proto == ipv4.ProtocolNumber {
+				buf = newPacket(payload, h)
+				u = header.UDP(header.IPv4(buf).Payload())
+			} else {
+				buf = newV6Packet(payload, h)
+				u = header.UDP(header.IPv6(buf).Payload())
+			}
+			u.SetChecksum(0)
+
+			var views [1]buffer.View
+			vv := buf.ToVectorisedView(views)
+			c.linkEP.Inject(tc.proto, &vv)
+
+			v, _, err := c.ep.Read(nil)
+			if !tc.wantAccepted {
+				if err != tcpip.ErrWouldBlock {
+					t.Fatalf("Read returned %v, want %v", err, tcpip.ErrWouldBlock)
+				}
+				if got := c.s.MutableStats().UDP.MalformedPacketsReceived.Value(); got != 1 {
+					t.Fatalf("got UDP.MalformedPacketsReceived = %d, want 1", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if !bytes.Equal(payload, v) {
+				t.Fatalf("Bad payload: got %x, want %x", v, payload)
+			}
+		})
+	}
+}
+
+func TestBindToDevice(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Add a second NIC with the same address.
+	id, linkEP2 := channel.New(256, defaultMTU, "")
+	if err := c.s.CreateNIC(2, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := c.s.AddAddress(2, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	newBoundEndpoint := func(nic tcpip.NICID) tcpip.Endpoint {
+		t.Helper()
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if err := ep.SetSockOpt(tcpip.BindToDeviceOption(nic)); err != nil {
+			t.Fatalf("SetSockOpt(BindToDeviceOption(%d)) failed: %v", nic, err)
+		}
+		if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+			t.Fatalf("Bind failed: %v", err)
+		}
+		return ep
+	}
+
+	// Endpoints bound to different NICs can share a port.
+	ep1 := newBoundEndpoint(1)
+	defer ep1.Close()
+	ep2 := newBoundEndpoint(2)
+	var v tcpip.BindToDeviceOption
+	if err := ep2.GetSockOpt(&v); err != nil || v != 2 {
+		t.Fatalf("GetSockOpt(BindToDeviceOption) = %d, %v, want 2, nil", v, err)
+	}
+	// As can an endpoint bound to no NIC.
+	epAny := newBoundEndpoint(0)
+	defer epAny.Close()
+
+	// send injects a datagram on the linkEP, and returns which of the
+	// endpoints received it.
+	eps := []tcpip.Endpoint{ep1, ep2, epAny}
+	send := func(linkEP *channel.Endpoint) tcpip.Endpoint {
+		t.Helper()
+		buf := newPacket(newPayload(), &headers{testPort, stackPort})
+		var views [1]buffer.View
+		vv := buf.ToVectorisedView(views)
+		linkEP.Inject(ipv4.ProtocolNumber, &vv)
+
+		var got tcpip.Endpoint
+		for _, ep := range eps {
+			if ep == nil {
+				continue
+			}
+			switch _, _, err := ep.Read(nil); err {
+			case nil:
+				if got != nil {
+					t.Fatalf("datagram was received by several endpoints")
+				}
+				got = ep
+			case tcpip.ErrWouldBlock:
+			default:
+				t.Fatalf("Read failed: %v", err)
+			}
+		}
+		return got
+	}
+
+	// Datagrams only go to the endpoint bound to the NIC they arrived on,
+	// which takes precedence over the unbound one.
+	if got := send(c.linkEP); got != ep1 {
+		t.Errorf("datagram on NIC 1 was received by %v, want %v", got, ep1)
+	}
+	if got := send(linkEP2); got != ep2 {
+		t.Errorf("datagram on NIC 2 was received by %v, want %v", got, ep2)
+	}
+
+	// Without an endpoint bound to NIC 2, the unbound one gets its
+	// datagrams.
+	ep2.Close()
+	eps[1] = nil
+	if got := send(linkEP2); got != epAny {
+		t.Errorf("datagram on NIC 2 was received by %v, want %v", got, epAny)
+	}
+
+	// Binding to another NIC than the one the endpoint is bound to fails.
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.SetSockOpt(tcpip.BindToDeviceOption(3)); err != tcpip.ErrUnknownNICID {
+		t.Fatalf("SetSockOpt(BindToDeviceOption(3)) = %v, want %v", err, tcpip.ErrUnknownNICID)
+	}
+	if err := ep.SetSockOpt(tcpip.BindToDeviceOption(1)); err != nil {
+		t.Fatalf("SetSockOpt(BindToDeviceOption(1)) failed: %v", err)
+	}
+	if err := ep.Bind(tcpip.FullAddress{NIC: 2, Port: stackPort + 1}, nil); err != tcpip.ErrInvalidEndpointState {
+		t.Fatalf("Bind on NIC 2 = %v, want %v", err, tcpip.ErrInvalidEndpointState)
+	}
+}
+
+func TestRouteChangeMovesConnectedEndpoint(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	// Add a second NIC with the same address.
+	id, linkEP2 := channel.New(256, defaultMTU, "")
+	if err := c.s.CreateNIC(2, id); err != nil {
+		t.Fatalf("CreateNIC failed: %v", err)
+	}
+	if err := c.s.AddAddress(2, ipv4.ProtocolNumber, stackAddr); err != nil {
+		t.Fatalf("AddAddress failed: %v", err)
+	}
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+
+	payload := buffer.View(newPayload())
+	write := func() *tcpip.Error {
+		_, err := c.ep.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{})
+		return err
+	}
+
+	if err := write(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	checker.IPv4(t, c.getPacket(), checker.UDP(checker.DstPort(testPort)))
+
+	// Once the default route goes through NIC 2, so do the datagrams of the
+	// connected endpoint.
+	c.s.SetRouteTable([]tcpip.Route{{
+		Destination: "\x00\x00\x00\x00",
+		Mask:        "\x00\x00\x00\x00",
+		NIC:         2,
+	}})
+	if err := write(); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	select {
+	case p := <-linkEP2.C:
+		b := append(append([]byte(nil), p.Header...), p.Payload...)
+		checker.IPv4(t, b, checker.SrcAddr(stackAddr), checker.DstAddr(testAddr), checker.UDP(checker.DstPort(testPort)))
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Packet wasn't written out through NIC 2")
+	}
+	select {
+	case <-c.linkEP.C:
+		t.Fatalf("Packet was written out through NIC 1 after the route changed")
+	default:
+	}
+
+	// Without a route to the peer, writes fail.
+	c.s.SetRouteTable(nil)
+	if err := write(); err != tcpip.ErrNoRoute {
+		t.Fatalf("got Write = %v after removing the route, want %v", err, tcpip.ErrNoRoute)
+	}
+}
+
+func TestRouteCache(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		connected bool
+	}{
+		{"Connected", true},
+		{"Unconnected", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			var err *tcpip.Error
+			c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			to := tcpip.FullAddress{Addr: testAddr, Port: testPort}
+			opts := tcpip.WriteOptions{To: &to}
+			if test.connected {
+				if err := c.ep.Connect(to); err != nil {
+					t.Fatalf("Connect failed: %v", err)
+				}
+				opts.To = nil
+			}
+
+			lookups := c.s.MutableStats().RouteLookups.Value()
+			// checkLookups writes datagrams, and checks that the
+			// route to the peer was looked up want times since the
+			// last call.
+			checkLookups := func(want uint64) {
+				t.Helper()
+				for i := 0; i < 3; i++ {
+					if _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), opts); err != nil {
+						t.Fatalf("Write failed: %v", err)
+					}
+					checker.IPv4(t, c.getPacket(), checker.DstAddr(testAddr), checker.UDP(checker.DstPort(testPort)))
+				}
+				prev := lookups
+				lookups = c.s.MutableStats().RouteLookups.Value()
+				if got := lookups - prev; got != want {
+					t.Fatalf("got %d route lookups, want %d", got, want)
+				}
+			}
+
+			if test.connected {
+				// The route was found by Connect.
+				checkLookups(0)
+			} else {
+				checkLookups(1)
+			}
+			checkLookups(0)
+
+			// Changing the route table invalidates the cached route.
+			c.s.SetRouteTable([]tcpip.Route{{
+				Destination: "\x00\x00\x00\x00",
+				Mask:        "\x00\x00\x00\x00",
+				NIC:         1,
+			}})
+			checkLookups(1)
+
+			// So does changing the link address of a neighbor.
+			c.s.AddLinkAddress(1, testAddr, "\x02\x00\x00\x00\x00\x01")
+			checkLookups(0)
+			c.s.AddLinkAddress(1, testAddr, "\x02\x00\x00\x00\x00\x02")
+			checkLookups(1)
+		})
+	}
+}
+
+func TestSelfAddressedLoopback(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		netProto tcpip.NetworkProtocolNumber
+		addr     tcpip.Address
+	}{
+		{"IPv4", ipv4.ProtocolNumber, stackAddr},
+		{"IPv6", ipv6.ProtocolNumber, stackV6Addr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			var err *tcpip.Error
+			c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, tc.netProto, &c.wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+				t.Fatalf("Bind failed: %v", err)
+			}
+
+			var wq waiter.Queue
+			sender, err := c.s.NewEndpoint(udp.ProtocolNumber, tc.netProto, &wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			defer sender.Close()
+
+			payload := newPayload()
+			if _, err := sender.Write(tcpip.SlicePayload(payload), tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: tc.addr, Port: stackPort}}); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+
+			var addr tcpip.FullAddress
+			v, _, err := c.ep.Read(&addr)
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if !bytes.Equal(payload, v) {
+				t.Fatalf("got payload %x, want %x", v, payload)
+			}
+			if addr.Addr != tc.addr {
+				t.Errorf("got sender address %v, want %v", addr.Addr, tc.addr)
+			}
+
+			select {
+			case p := <-c.linkEP.C:
+				t.Fatalf("self-addressed packet was sent on the link: %x", p.Header)
+			default:
+			}
+		})
+	}
+}
+
+func TestBroadcastMulticastDelivery(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	const multicastAddr = "\xe8\x2b\xd3\xea"
+	if err := c.s.JoinGroup(ipv4.ProtocolNumber, 1, multicastAddr); err != nil {
+		t.Fatalf("JoinGroup failed: %v", err)
+	}
+	subnet, err := tcpip.NewSubnet(header.IPv4Broadcast, tcpip.AddressMask(header.IPv4Broadcast))
+	if err != nil {
+		t.Fatalf("NewSubnet failed: %v", err)
+	}
+	if err := c.s.AddSubnet(1, ipv4.ProtocolNumber, subnet); err != nil {
+		t.Fatalf("AddSubnet failed: %v", err)
+	}
+
+	newEndpoint := func(reuse tcpip.ReuseAddressOption) (tcpip.Endpoint, *tcpip.Error) {
+		t.Helper()
+		var wq waiter.Queue
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		if err := ep.SetSockOpt(reuse); err != nil {
+			t.Fatalf("SetSockOpt(%T(%d)) failed: %v", reuse, reuse, err)
+		}
+		return ep, ep.Bind(tcpip.FullAddress{Port: stackPort}, nil)
+	}
+
+	// Endpoints reusing the address can share the port.
+	var eps []tcpip.Endpoint
+	for i := 0; i < 3; i++ {
+		ep, err := newEndpoint(1)
+		defer ep.Close()
+		if err != nil {
+			t.Fatalf("Bind of endpoint %d failed: %v", i, err)
+		}
+		eps = append(eps, ep)
+	}
+	other, bindErr := newEndpoint(0)
+	defer other.Close()
+	if bindErr != tcpip.ErrPortInUse {
+		t.Fatalf("Bind without ReuseAddressOption = %v, want %v", bindErr, tcpip.ErrPortInUse)
+	}
+
+	// send injects a datagram to dst, and returns the number of endpoints
+	// that received it.
+	send := func(dst tcpip.Address) int {
+		t.Helper()
+		payload := newPayload()
+		buf := newPacketTo(dst, payload, &headers{testPort, stackPort})
+		var views [1]buffer.View
+		vv := buf.ToVectorisedView(views)
+		c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+
+		n := 0
+		for i, ep := range eps {
+			switch v, _, err := ep.Read(nil); err {
+			case nil:
+				if !bytes.Equal(payload, v) {
+					t.Fatalf("endpoint %d got bad payload: got %x, want %x", i, v, payload)
+				}
+				n++
+			case tcpip.ErrWouldBlock:
+			default:
+				t.Fatalf("Read failed: %v", err)
+			}
+		}
+		return n
+	}
+
+	for _, dst := range []tcpip.Address{header.IPv4Broadcast, multicastAddr} {
+		if got := send(dst); got != len(eps) {
+			t.Errorf("datagram to %v was received by %d endpoints, want %d", dst, got, len(eps))
+		}
+	}
+	if got := send(stackAddr); got != 1 {
+		t.Errorf("unicast datagram was received by %d endpoints, want 1", got)
+	}
+}
+
+func TestUnknownPortStats(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var ids []stack.TransportEndpointID
+	c.s.SetUnknownPortHook(time.Hour, func(p tcpip.TransportProtocolNumber, id stack.TransportEndpointID) {
+		if p != udp.ProtocolNumber {
+			t.Errorf("hook called with protocol %d, want %d", p, udp.ProtocolNumber)
+		}
+		ids = append(ids, id)
+	})
+
+	// Datagrams to an unbound port are counted, and only the first one
+	// is passed to the hook within the interval.
+	for i := 0; i < 2; i++ {
+		c.sendPacket(newPayload(), &headers{testPort, stackPort})
+	}
+	stats := c.s.Stats()
+	if got := stats.UnknownPortRcvdPackets.Value(); got != 2 {
+		t.Errorf("got UnknownPortRcvdPackets = %d, want 2", got)
+	}
+	if got := stats.UDP.UnknownPortErrors.Value(); got != 2 {
+		t.Errorf("got UDP.UnknownPortErrors = %d, want 2", got)
+	}
+	udpStats, err := c.s.TransportProtocolStats(udp.ProtocolNumber)
+	if err != nil {
+		t.Fatalf("TransportProtocolStats failed: %v", err)
+	}
+	if got := udpStats.UnknownPortRcvdPackets; got != 2 {
+		t.Errorf("got UDP UnknownPortRcvdPackets = %d, want 2", got)
+	}
+	want := stack.TransportEndpointID{LocalPort: stackPort, LocalAddress: stackAddr, RemotePort: testPort, RemoteAddress: testAddr}
+	if len(ids) != 1 || ids[0] != want {
+		t.Errorf("hook called with %+v, want once with %+v", ids, want)
+	}
+
+	// A datagram too short for a UDP header is malformed.
+	buf := buffer.NewView(header.IPv4MinimumSize + header.UDPMinimumSize/2)
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         header.IPv4MinimumSize,
+		TotalLength: uint16(len(buf)),
+		TTL:         65,
+		Protocol:    uint8(udp.ProtocolNumber),
+		SrcAddr:     testAddr,
+		DstAddr:     stackAddr,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	var views [1]buffer.View
+	vv := buf.ToVectorisedView(views)
+	c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+	udpStats, _ = c.s.TransportProtocolStats(udp.ProtocolNumber)
+	if got := udpStats.MalformedRcvdPackets; got != 1 {
+		t.Errorf("got UDP MalformedRcvdPackets = %d, want 1", got)
+	}
+
+	// A datagram to an endpoint shut down for reading is dropped.
+	c.createV6Endpoint(false)
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if err := c.ep.Shutdown(tcpip.ShutdownRead); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	c.sendPacket(newPayload(), &headers{testPort, stackPort})
+	stats = c.s.Stats()
+	if got := stats.ClosedEndpointRcvdPackets.Value(); got != 1 {
+		t.Errorf("got ClosedEndpointRcvdPackets = %d, want 1", got)
+	}
+	if got := stats.UnknownPortRcvdPackets.Value(); got != 2 {
+		t.Errorf("got UnknownPortRcvdPackets = %d after binding, want 2", got)
+	}
+}
+
+func TestConnectDisconnect(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var err *tcpip.Error
+	c.ep, err = c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &c.wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+		t.Fatalf("Bind failed: %v", err)
+	}
+
+	// received sends a datagram from the given source port, and returns
+	// whether the endpoint received it.
+	received := func(srcPort uint16) bool {
+		t.Helper()
+		payload := newPayload()
+		c.sendPacket(payload, &headers{srcPort, stackPort})
+		switch v, _, err := c.ep.Read(nil); err {
+		case nil:
+			if !bytes.Equal(payload, v) {
+				t.Fatalf("Bad payload: got %x, want %x", v, payload)
+			}
+			return true
+		case tcpip.ErrWouldBlock:
+			return false
+		default:
+			t.Fatalf("Read failed: %v", err)
+			return false
+		}
+	}
+
+	const peerA, peerB = testPort, testPort + 1
+
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: peerA}); err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	if !received(peerA) {
+		t.Errorf("datagram from the connected peer wasn't received")
+	}
+	if received(peerB) {
+		t.Errorf("datagram from another peer was received while connected")
+	}
+
+	// Connecting to the unspecified address disconnects the endpoint.
+	if err := c.ep.Connect(tcpip.FullAddress{}); err != nil {
+		t.Fatalf("Connect to the unspecified address failed: %v", err)
+	}
+	if _, err := c.ep.GetRemoteAddress(); err != tcpip.ErrNotConnected {
+		t.Errorf("GetRemoteAddress after disconnecting = %v, want %v", err, tcpip.ErrNotConnected)
+	}
+	if addr, err := c.ep.GetLocalAddress(); err != nil || addr.Port != stackPort {
+		t.Errorf("GetLocalAddress after disconnecting = %+v, %v, want port %d", addr, err, stackPort)
+	}
+	for _, p := range []uint16{peerA, peerB} {
+		if !received(p) {
+			t.Errorf("datagram from port %d wasn't received after disconnecting", p)
+		}
+	}
+
+	// The endpoint can be connected again.
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: peerB}); err != nil {
+		t.Fatalf("Connect after disconnecting failed: %v", err)
+	}
+	if received(peerA) {
+		t.Errorf("datagram from another peer was received after reconnecting")
+	}
+	if !received(peerB) {
+		t.Errorf("datagram from the new peer wasn't received")
+	}
+}
+
+func TestNoChecksumOption(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var v udp.NoChecksumOption
+	if err := c.s.TransportProtocolOption(udp.ProtocolNumber, &v); err != nil || v {
+		t.Fatalf("got TransportProtocolOption(&v) = %v, v = %v, want nil and false", err, v)
+	}
+	if err := c.s.SetTransportProtocolOption(udp.ProtocolNumber, udp.NoChecksumOption(true)); err != nil {
+		t.Fatalf("SetTransportProtocolOption failed: %v", err)
+	}
+	if err := c.s.TransportProtocolOption(udp.ProtocolNumber, &v); err != nil || !v {
+		t.Fatalf("got TransportProtocolOption(&v) = %v, v = %v, want nil and true", err, v)
+	}
+
+	c.createV6Endpoint(false)
+
+	// IPv4 datagrams are sent without a checksum.
+	if _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: testV4MappedAddr, Port: testPort},
+	}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := header.UDP(header.IPv4(c.getPacket()).Payload()).Checksum(); got != 0 {
+		t.Fatalf("got IPv4 checksum 0x%x, want 0", got)
+	}
+
+	// IPv6 ones still carry one.
+	if _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{
+		To: &tcpip.FullAddress{Addr: testV6Addr, Port: testPort},
+	}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := header.UDP(header.IPv6(c.getV6Packet()).Payload()).Checksum(); got == 0 {
+		t.Fatalf("got IPv6 checksum 0, want a computed checksum")
+	}
+}
+
+func TestAutoFlowLabelOption(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	if err := c.s.SetNetworkProtocolOption(ipv6.ProtocolNumber, ipv6.AutoFlowLabelOption(false)); err != nil {
+		t.Fatalf("SetNetworkProtocolOption failed: %v", err)
+	}
+	var v ipv6.AutoFlowLabelOption
+	if err := c.s.NetworkProtocolOption(ipv6.ProtocolNumber, &v); err != nil || v {
+		t.Fatalf("got NetworkProtocolOption(&v) = %v, v = %v, want nil and false", err, v)
+	}
+
+	c.createV6Endpoint(false)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+	flowLabel := func() uint32 {
+		if _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{}); err != nil {
+			c.t.Fatalf("Write failed: %v", err)
+		}
+		_, l := header.IPv6(c.getV6Packet()).TOS()
+		return l
+	}
+	if got := flowLabel(); got != 0 {
+		t.Fatalf("got flow label %#x, want 0", got)
+	}
+
+	if err := c.s.SetNetworkProtocolOption(ipv6.ProtocolNumber, ipv6.AutoFlowLabelOption(true)); err != nil {
+		t.Fatalf("SetNetworkProtocolOption failed: %v", err)
+	}
+	if got := flowLabel(); got == 0 {
+		t.Fatalf("got flow label 0, want a computed label")
+	}
+
+	if err := c.s.SetNetworkProtocolOption(ipv6.ProtocolNumber, udp.NoChecksumOption(true)); err != tcpip.ErrUnknownProtocolOption {
+		t.Fatalf("got SetNetworkProtocolOption(udp.NoChecksumOption) = %v, want %v", err, tcpip.ErrUnknownProtocolOption)
+	}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	c.createV6Endpoint(false)
+	if err := c.ep.Connect(tcpip.FullAddress{Addr: testV6Addr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+	var wq waiter.Queue
+	ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+	if err != nil {
+		t.Fatalf("NewEndpoint failed: %v", err)
+	}
+	defer ep.Close()
+	if err := ep.Connect(tcpip.FullAddress{Addr: testAddr, Port: testPort}); err != nil {
+		c.t.Fatalf("Connect failed: %v", err)
+	}
+
+	// ttls returns the TTL and hop limit of packets written by ep and
+	// c.ep.
+	ttls := func() (uint8, uint8) {
+		if _, err := ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{}); err != nil {
+			c.t.Fatalf("Write failed: %v", err)
+		}
+		ttl := header.IPv4(c.getPacket()).TTL()
+		if _, err := c.ep.Write(tcpip.SlicePayload(newPayload()), tcpip.WriteOptions{}); err != nil {
+			c.t.Fatalf("Write failed: %v", err)
+		}
+		return ttl, header.IPv6(c.getV6Packet()).HopLimit()
+	}
+	if ttl, hopLimit := ttls(); ttl != 65 || hopLimit != 65 {
+		t.Fatalf("got TTL %d and hop limit %d, want 65 and 65", ttl, hopLimit)
+	}
+
+	// A new default applies to the existing endpoints.
+	if err := c.s.SetNetworkProtocolOption(ipv4.ProtocolNumber, tcpip.DefaultTTLOption(100)); err != nil {
+		t.Fatalf("SetNetworkProtocolOption failed: %v", err)
+	}
+	var v tcpip.DefaultTTLOption
+	if err := c.s.NetworkProtocolOption(ipv4.ProtocolNumber, &v); err != nil || v != 100 {
+		t.Fatalf("got NetworkProtocolOption(&v) = %v, v = %d, want nil and 100", err, v)
+	}
+	if ttl, hopLimit := ttls(); ttl != 100 || hopLimit != 65 {
+		t.Fatalf("got TTL %d and hop limit %d, want 100 and 65", ttl, hopLimit)
+	}
+	if err := c.s.SetDefaultTTL(200); err != nil {
+		t.Fatalf("SetDefaultTTL failed: %v", err)
+	}
+	if ttl, hopLimit := ttls(); ttl != 200 || hopLimit != 200 {
+		t.Fatalf("got TTL %d and hop limit %d, want 200 and 200", ttl, hopLimit)
+	}
+
+	// The TTL of an endpoint overrides the default.
+	if err := c.ep.SetSockOpt(tcpip.TTLOption(7)); err != nil {
+		t.Fatalf("SetSockOpt failed: %v", err)
+	}
+	var ttl tcpip.TTLOption
+	if err := c.ep.GetSockOpt(&ttl); err != nil || ttl != 7 {
+		t.Fatalf("got GetSockOpt(&v) = %v, v = %d, want nil and 7", err, ttl)
+	}
+	if ttl, hopLimit := ttls(); ttl != 200 || hopLimit != 7 {
+		t.Fatalf("got TTL %d and hop limit %d, want 200 and 7", ttl, hopLimit)
+	}
+
+	if err := c.s.SetNetworkProtocolOption(ipv6.ProtocolNumber, tcpip.DefaultTTLOption(0)); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("got SetNetworkProtocolOption(DefaultTTLOption(0)) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+	if err := c.s.SetDefaultTTL(0); err != tcpip.ErrInvalidOptionValue {
+		t.Fatalf("got SetDefaultTTL(0) = %v, want %v", err, tcpip.ErrInvalidOptionValue)
+	}
+}
+
+// dispatchingEndpoint is a link endpoint that lets tests deliver packets to
+// the stack directly, without the copies channel endpoints make.
+type dispatchingEndpoint struct {
+	stack.LinkEndpoint
+	dispatcher stack.NetworkDispatcher
+}
+
+func (e *dispatchingEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.dispatcher = dispatcher
+	e.LinkEndpoint.Attach(dispatcher)
+}
+
+func TestDeliveryAllocations(t *testing.T) {
+	const runs = 100
+
+	for _, tc := range []struct {
+		name     string
+		netProto tcpip.NetworkProtocolNumber
+		addr     tcpip.Address
+		packet   func(payload []byte, h *headers) buffer.View
+	}{
+		{"IPv4", ipv4.ProtocolNumber, stackAddr, newPacket},
+		{"IPv6", ipv6.ProtocolNumber, stackV6Addr, newV6Packet},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName, ipv6.ProtocolName}, []string{udp.ProtocolName})
+			id, _ := channel.New(0, defaultMTU, "")
+			linkEP := &dispatchingEndpoint{LinkEndpoint: stack.FindLinkEndpoint(id)}
+			if err := s.CreateNIC(1, stack.RegisterLinkEndpoint(linkEP)); err != nil {
+				t.Fatalf("CreateNIC failed: %v", err)
+			}
+			if err := s.AddAddress(1, tc.netProto, tc.addr); err != nil {
+				t.Fatalf("AddAddress failed: %v", err)
+			}
+
+			var wq waiter.Queue
+			ep, err := s.NewEndpoint(udp.ProtocolNumber, tc.netProto, &wq)
+			if err != nil {
+				t.Fatalf("NewEndpoint failed: %v", err)
+			}
+			defer ep.Close()
+			if err := ep.Bind(tcpip.FullAddress{Addr: tc.addr, Port: stackPort}, nil); err != nil {
+				t.Fatalf("Bind failed: %v", err)
+			}
+
+			pkt := tc.packet(newPayload(), &headers{testPort, stackPort})
+			if err := ep.SetSockOpt(tcpip.ReceiveBufferSizeOption(2 * (runs + 1) * len(pkt))); err != nil {
+				t.Fatalf("SetSockOpt failed: %v", err)
+			}
+
+			var views [1]buffer.View
+			var vv buffer.VectorisedView
+			deliver := func() {
+				views[0] = pkt
+				vv = buffer.NewVectorisedView(len(pkt), views[:])
+				linkEP.dispatcher.DeliverNetworkPacket(linkEP, "", tc.netProto, &vv, false)
+			}
+
+			// Datagrams consumed by Read are recycled, and so are the
+			// addresses of the peers already seen.
+			for i := 0; i <= runs; i++ {
+				deliver()
+			}
+			for i := 0; i <= runs; i++ {
+				if _, _, err := ep.Read(nil); err != nil {
+					t.Fatalf("Read failed: %v", err)
+				}
+			}
+
+			if allocs := testing.AllocsPerRun(runs, deliver); allocs != 0 {
+				t.Errorf("got %.1f allocations per delivered datagram, want 0", allocs)
+			}
+
+			// All the datagrams were queued rather than dropped.
+			want := tcpip.FullAddress{NIC: 1, Addr: testAddr, Port: testPort}
+			if tc.netProto == ipv6.ProtocolNumber {
+				want.Addr = testV6Addr
+			}
+			for i := 0; i <= runs; i++ {
+				var addr tcpip.FullAddress
+				if _, _, err := ep.Read(&addr); err != nil {
+					t.Fatalf("Read #%d failed: %v", i, err)
+				}
+				if addr != want {
+					t.Fatalf("got sender %+v, want %+v", addr, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRXChecksumOffload(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		caps         stack.LinkEndpointCapabilities
+		corruptIP    bool
+		wantAccepted bool
+		wantTrusted  uint64
+	}{
+		{"NoOffload", 0, false, false, 0},
+		{"NoOffloadBadIPChecksum", 0, true, false, 0},
+		{"Offload", stack.CapabilityRXChecksumOffload, false, true, 1},
+		{"OffloadBadIPChecksum", stack.CapabilityRXChecksumOffload, true, true, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			c.linkEP.LinkEPCapabilities = tc.caps
+			c.createV6Endpoint(false)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+				t.Fatalf("Bind failed: %v", err)
+			}
+
+			// Corrupt the UDP checksum, and the IP header one if asked to.
+			payload := newPayload()
+			buf := newPacket(payload, &headers{
+				srcPort: testPort,
+				dstPort: stackPort,
+			})
+			ip := header.IPv4(buf)
+			if tc.corruptIP {
+				ip.SetChecksum(^ip.Checksum())
+			}
+			udp := header.UDP(ip.Payload())
+			udp.SetChecksum(^udp.Checksum())
+
+			var views [1]buffer.View
+			vv := buf.ToVectorisedView(views)
+			c.linkEP.Inject(ipv4.ProtocolNumber, &vv)
+
+			v, _, err := c.ep.Read(nil)
+			if !tc.wantAccepted {
+				if err != tcpip.ErrWouldBlock {
+					t.Fatalf("Read returned %v, want %v", err, tcpip.ErrWouldBlock)
+				}
+				if got := c.s.MutableStats().MalformedRcvdPackets.Value(); got != 1 {
+					t.Fatalf("got MalformedRcvdPackets = %d, want 1", got)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Read failed: %v", err)
+				}
+				if !bytes.Equal(payload, v) {
+					t.Fatalf("Bad payload: got %x, want %x", v, payload)
+				}
+			}
+
+			stats, err := c.s.NICStats(1)
+			if err != nil {
+				t.Fatalf("NICStats failed: %v", err)
+			}
+			if stats.RxChecksumTrustedPackets != tc.wantTrusted {
+				t.Fatalf("got RxChecksumTrustedPackets = %d, want %d", stats.RxChecksumTrustedPackets, tc.wantTrusted)
+			}
+		})
+	}
+}
+
+func TestBatchDelivery(t *testing.T) {
+	c := newDualTestContext(t, defaultMTU)
+	defer c.cleanup()
+
+	var eps [2]tcpip.Endpoint
+	var wqs [2]waiter.Queue
+	for i := range eps {
+		ep, err := c.s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wqs[i])
+		if err != nil {
+			t.Fatalf("NewEndpoint failed: %v", err)
+		}
+		defer ep.Close()
+		if err := ep.Bind(tcpip.FullAddress{Port: stackPort + uint16(i)}, nil); err != nil {
+			t.Fatalf("Bind failed: %v", err)
+		}
+		eps[i] = ep
+	}
+
+	// The datagrams sent to both endpoints are interleaved with one sent
+	// to an unbound port and a corrupted one.
+	var payloads [][]byte
+	var pkts []stack.InboundPacket
+	add := func(dstPort uint16, corrupt bool) []byte {
+		payload := newPayload()
+		buf := newPacket(payload, &headers{testPort, dstPort})
+		if corrupt {
+			u := header.UDP(header.IPv4(buf).Payload())
+			u.SetChecksum(^u.Checksum())
+		}
+		pkts = append(pkts, stack.InboundPacket{
+			Protocol: ipv4.ProtocolNumber,
+			VV:       buf.ToVectorisedView([1]buffer.View{}),
+		})
+		return payload
+	}
+	payloads = append(payloads, add(stackPort, false))
+	payloads = append(payloads, add(stackPort+1, false))
+	add(stackPort+2, false)
+	add(stackPort, true)
+	payloads = append(payloads, add(stackPort, false))
+
+	we, ch := waiter.NewChannelEntry(nil)
+	wqs[0].EventRegister(&we, waiter.EventIn)
+	defer wqs[0].EventUnregister(&we)
+
+	c.linkEP.InjectBatch(pkts)
+
+	select {
+	case <-ch:
+	default:
+		t.Fatalf("endpoint wasn't notified of the batch")
+	}
+
+	for _, r := range []struct {
+		ep      tcpip.Endpoint
+		payload []byte
+	}{
+		{eps[0], payloads[0]},
+		{eps[0], payloads[2]},
+		{eps[1], payloads[1]},
+	} {
+		var addr tcpip.FullAddress
+		v, _, err := r.ep.Read(&addr)
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if !bytes.Equal(v, r.payload) {
+			t.Fatalf("Bad payload: got %x, want %x", v, r.payload)
+		}
+		if want := (tcpip.FullAddress{NIC: 1, Addr: testAddr, Port: testPort}); addr != want {
+			t.Fatalf("got sender %+v, want %+v", addr, want)
+		}
+	}
+	for i, ep := range eps {
+		if _, _, err := ep.Read(nil); err != tcpip.ErrWouldBlock {
+			t.Fatalf("Read on endpoint %d returned %v, want %v", i, err, tcpip.ErrWouldBlock)
+		}
+	}
+
+	stats := c.s.Stats()
+	if got := stats.UDP.PacketsReceived.Value(); got != 3 {
+		t.Errorf("got UDP.PacketsReceived = %d, want 3", got)
+	}
+	if got := stats.UDP.UnknownPortErrors.Value(); got != 1 {
+		t.Errorf("got UDP.UnknownPortErrors = %d, want 1", got)
+	}
+	if got := stats.UDP.MalformedPacketsReceived.Value(); got != 1 {
+		t.Errorf("got UDP.MalformedPacketsReceived = %d, want 1", got)
+	}
+}
+
+func BenchmarkBatchDelivery(b *testing.B) {
+	for _, size := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			s := stack.New(&tcpip.StdClock{}, []string{ipv4.ProtocolName}, []string{udp.ProtocolName})
+			id, linkEP := channel.New(0, defaultMTU, "")
+			if err := s.CreateNIC(1, id); err != nil {
+				b.Fatalf("CreateNIC failed: %v", err)
+			}
+			if err := s.AddAddress(1, ipv4.ProtocolNumber, stackAddr); err != nil {
+				b.Fatalf("AddAddress failed: %v", err)
+			}
+
+			var wq waiter.Queue
+			ep, err := s.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+			if err != nil {
+				b.Fatalf("NewEndpoint failed: %v", err)
+			}
+			defer ep.Close()
+			if err := ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+				b.Fatalf("Bind failed: %v", err)
+			}
+
+			pkts := make([]stack.InboundPacket, size)
+			for i := range pkts {
+				buf := newPacket(make([]byte, 64), &headers{testPort, stackPort})
+				pkts[i] = stack.InboundPacket{
+					Protocol: ipv4.ProtocolNumber,
+					VV:       buf.ToVectorisedView([1]buffer.View{}),
+				}
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n += size {
+				linkEP.InjectBatch(pkts)
+				for i := 0; i < size; i++ {
+					if _, _, err := ep.Read(nil); err != nil {
+						b.Fatalf("Read failed: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// newSourceRoutedPacket builds an IPv4 packet like newPacket, carrying a loose
+// source route option whose pointer is at ptr. The route it lists is complete
+// if ptr is past its two addresses.
+func newSourceRoutedPacket(payload []byte, h *headers, ptr uint8) buffer.View {
+	pkt := newPacket(payload, h)
+	opts := []byte{
+		header.IPv4OptionNOP,
+		header.IPv4OptionLSRR, 11, ptr,
+		10, 0, 0, 3,
+		10, 0, 0, 1,
+	}
+	buf := buffer.NewView(len(pkt) + len(opts))
+	copy(buf, pkt[:header.IPv4MinimumSize])
+	copy(buf[header.IPv4MinimumSize:], opts)
+	copy(buf[header.IPv4MinimumSize+len(opts):], pkt[header.IPv4MinimumSize:])
+
+	ip := header.IPv4(buf)
+	ip[0] = header.IPv4Version<<4 | uint8(header.IPv4MinimumSize+len(opts))/4
+	ip.SetTotalLength(uint16(len(buf)))
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+	return buf
+}
+
+// newRoutedV6Packet builds an IPv6 packet carrying a UDP datagram with the
+// given payload from the test address to the stack address, through a routing
+// header of the given type listing one more address.
+func newRoutedV6Packet(payload []byte, h *headers, typ, segmentsLeft uint8) buffer.View {
+	const rhSize = header.IPv6RoutingMinimumSize + header.IPv6AddressSize
+	buf := buffer.NewView(header.IPv6MinimumSize + rhSize + header.UDPMinimumSize + len(payload))
+	copy(buf[len(buf)-len(payload):], payload)
+
+	length := uint16(header.UDPMinimumSize + len(payload))
+	header.IPv6(buf).Encode(&header.IPv6Fields{
+		PayloadLength: rhSize + length,
+		NextHeader:    header.IPv6RoutingHeader,
+		HopLimit:      65,
+		SrcAddr:       testV6Addr,
+		DstAddr:       stackV6Addr,
+	})
+
+	rh := buf[header.IPv6MinimumSize:]
+	rh[0] = uint8(udp.ProtocolNumber)
+	rh[1] = rhSize/8 - 1
+	rh[2] = typ
+	rh[3] = segmentsLeft
+	copy(rh[header.IPv6RoutingMinimumSize:], testV6Addr)
+
+	u := header.UDP(buf[header.IPv6MinimumSize+rhSize:])
+	u.Encode(&header.UDPFields{
+		SrcPort: h.srcPort,
+		DstPort: h.dstPort,
+		Length:  length,
+	})
+	xsum := header.Checksum([]byte(testV6Addr), 0)
+	xsum = header.Checksum([]byte(stackV6Addr), xsum)
+	xsum = header.Checksum([]byte{0, uint8(udp.ProtocolNumber)}, xsum)
+	xsum = header.Checksum(payload, xsum)
+	u.SetChecksum(^u.CalculateChecksum(xsum, length))
+	return buf
+}
+
+func TestSourceRoutedPackets(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		accept        bool
+		protocol      tcpip.NetworkProtocolNumber
+		build         func(payload []byte, h *headers) buffer.View
+		wantDelivered bool
+	}{
+		{
+			name:     "IPv4 LSRR",
+			protocol: ipv4.ProtocolNumber,
+			build: func(payload []byte, h *headers) buffer.View {
+				return newSourceRoutedPacket(payload, h, 12)
+			},
+		},
+		{
+			name:     "IPv4 LSRR accepted",
+			accept:   true,
+			protocol: ipv4.ProtocolNumber,
+			build: func(payload []byte, h *headers) buffer.View {
+				return newSourceRoutedPacket(payload, h, 12)
+			},
+			wantDelivered: true,
+		},
+		{
+			name:     "IPv4 LSRR to forward",
+			accept:   true,
+			protocol: ipv4.ProtocolNumber,
+			build: func(payload []byte, h *headers) buffer.View {
+				return newSourceRoutedPacket(payload, h, 8)
+			},
+		},
+		{
+			name:     "IPv6 RH0",
+			protocol: ipv6.ProtocolNumber,
+			build: func(payload []byte, h *headers) buffer.View {
+				return newRoutedV6Packet(payload, h, header.IPv6RoutingType0, 0)
+			},
+		},
+		{
+			name:     "IPv6 RH0 accepted",
+			accept:   true,
+			protocol: ipv6.ProtocolNumber,
+			build: func(payload []byte, h *headers) buffer.View {
+				return newRoutedV6Packet(payload, h, header.IPv6RoutingType0, 0)
+			},
+			wantDelivered: true,
+		},
+		{
+			name:     "IPv6 RH0 to forward",
+			accept:   true,
+			protocol: ipv6.ProtocolNumber,
+			build: func(payload []byte, h *headers) buffer.View {
+				return newRoutedV6Packet(payload, h, header.IPv6RoutingType0, 1)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newDualTestContext(t, defaultMTU)
+			defer c.cleanup()
+
+			if err := c.s.SetNetworkProtocolOption(tc.protocol, tcpip.AcceptSourceRouteOption(tc.accept)); err != nil {
+				t.Fatalf("SetNetworkProtocolOption failed: %v", err)
+			}
+			c.createV6Endpoint(false)
+			if err := c.ep.Bind(tcpip.FullAddress{Port: stackPort}, nil); err != nil {
+				t.Fatalf("Bind failed: %v", err)
+			}
+
+			payload := newPayload()
+			buf := tc.build(payload, &headers{testPort, stackPort})
+			var views [1]buffer.View
+			vv := buf.ToVectorisedView(views)
+			c.linkEP.Inject(tc.protocol, &vv)
+
+			var wantDropped uint64 = 1
+			v, _, err := c.ep.Read(nil)
+			if tc.wantDelivered {
+				wantDropped = 0
+				if err != nil {
+					t.Fatalf("Read failed: %v", err)
+				}
+				if !bytes.Equal(v, payload) {
+					t.Fatalf("Bad payload: got %x, want %x", v, payload)
+				}
+			} else if err != tcpip.ErrWouldBlock {
+				t.Fatalf("Read returned %v, want %v", err, tcpip.ErrWouldBlock)
+			}
+			if got := c.s.MutableStats().IP.SourceRoutedPacketsDropped.Value(); got != wantDropped {
+				t.Errorf("got IP.SourceRoutedPacketsDropped = %d, want %d", got, wantDropped)
+			}
+		})
+	}
+}
@@ -67,6 +67,15 @@ const (
 	EventNVal EventMask = 0x20 // Not defined in syscall.
 )
 
+// Events that are not defined by poll(). They are reported by endpoints
+// configured with send buffer watermarks: EventSndHigh once the send buffer
+// occupancy rises to the high watermark, and EventSndLow once it drains back
+// to the low watermark.
+const (
+	EventSndHigh EventMask = 0x40
+	EventSndLow  EventMask = 0x80
+)
+
 // Waitable contains the methods that need to be implemented by waitable
 // objects.
 type Waitable interface {